@@ -0,0 +1,131 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// how often conn tracking maps are audited for leaks
+	auditfreq = 1 * time.Minute
+	// flows audited per handler per pass; so that a pass never holds
+	// up the data path for long, see: core.ConnMapper.Audit
+	auditn = 256
+)
+
+// udp flows idle for this long are leaks, since their reads and writes
+// time out far sooner; tcp flows may legitimately idle for hours, and
+// so are only audited for conns that are closed or dead.
+var udpleakidle = 5 * udptimeout
+
+// auditor periodically (and on-demand) sweeps the conn tracking maps of
+// flow handlers for entries whose close paths never ran (ex: errors before
+// the deferred untrack, netstack conns that never teardown), and reaps them.
+type auditor struct {
+	tcp      tracker // may be nil
+	udp      tracker // may be nil
+	listener SocketListener
+	reaped   atomic.Int64 // total leaks reaped
+	sigterm  context.CancelFunc
+}
+
+func newAuditor(l SocketListener, tcph, udph any) *auditor {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &auditor{
+		listener: l,
+		sigterm:  cancel,
+	}
+	a.tcp, _ = tcph.(tracker)
+	a.udp, _ = udph.(tracker)
+	go a.run(ctx)
+	return a
+}
+
+func (a *auditor) run(ctx context.Context) {
+	tick := time.NewTicker(auditfreq)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.I("audit: stopped")
+			return
+		case <-tick.C:
+			a.pass()
+		}
+	}
+}
+
+func (a *auditor) stop() {
+	a.sigterm()
+}
+
+// pass audits up to auditn flows of each handler, and returns the leaks reaped.
+func (a *auditor) pass() (n int) {
+	if a.tcp != nil {
+		n += a.reap(ProtoTypeTCP, a.tcp.conns(), 0)
+	}
+	if a.udp != nil {
+		n += a.reap(ProtoTypeUDP, a.udp.conns(), udpleakidle)
+	}
+	return
+}
+
+// sweep audits all flows of all handlers in passes of auditn, and returns
+// the leaks reaped.
+func (a *auditor) sweep() (n int) {
+	passes := 1
+	for _, t := range []tracker{a.tcp, a.udp} {
+		if t != nil {
+			passes = max(passes, t.conns().Len()/auditn+1)
+		}
+	}
+	for i := 0; i < passes; i++ {
+		n += a.pass()
+	}
+	log.I("audit: sweep: reaped %d in %d passes; total %d", n, passes, a.reaped.Load())
+	return
+}
+
+// reap audits up to auditn flows of proto in cm (see: core.ConnMapper.Audit),
+// and reports leaks to the listener, as they were tracked; flows whose close
+// paths do run later do not report themselves, as their Reason is
+// errAuditedLeak; see: forward
+func (a *auditor) reap(proto string, cm core.ConnMapper, idle time.Duration) int {
+	cids, tuples := cm.Audit(idle, auditn, errAuditedLeak)
+	if len(cids) <= 0 {
+		return 0
+	}
+	a.reaped.Add(int64(len(cids)))
+	log.W("audit: %s: reaped %d leaks: %v", proto, len(cids), cids)
+	for i, cid := range cids {
+		t := tuples[i]
+		smm := &SocketSummary{
+			Proto: proto,
+			ID:    cid,
+			PID:   t.Pid,
+			UID:   t.Uid,
+			start: t.Start,
+			Msg:   errNone.Error(),
+		}
+		if t.Dst.IsValid() {
+			smm.Target = t.Dst.String()
+		}
+		if smm.start.IsZero() { // tracked sans a start
+			smm.start = time.Now()
+		}
+		smm.done(errAuditedLeak)
+		go sendNotif(a.listener, smm)
+	}
+	return len(cids)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+)
+
+// auditTracker is a tracker of just conns.
+type auditTracker struct {
+	cm core.ConnMapper
+}
+
+func (t auditTracker) conns() core.ConnMapper { return t.cm }
+func (auditTracker) stalls() *core.ExpMap     { return nil }
+
+func TestAuditReapsAsTracked(t *testing.T) {
+	clk := core.NewFakeClock(time.Now())
+	cm := core.NewConnMapWithClock(clk).Proto(ProtoTypeUDP)
+	l := newTestListener("wg0")
+	a := &auditor{listener: l, udp: auditTracker{cm}}
+
+	smm := udpSummary("u1", "wg0", "10001", netip.MustParseAddr("192.0.2.1"))
+	start := smm.start
+	local, lpeer := net.Pipe()
+	remote, rpeer := net.Pipe()
+	defer lpeer.Close()
+	defer rpeer.Close()
+	done := make(chan struct{})
+	go func() {
+		forward(local, remote, cm, l, smm, nil, core.NewFair())
+		close(done)
+	}()
+	eventually(t, 5*time.Second, func() bool { return cm.Len() == 1 }, "audit: flow not tracked")
+
+	// idle past udpleakidle, and so, leaked
+	clk.Advance(2 * udpleakidle)
+	if n := a.pass(); n != 1 {
+		t.Fatalf("audit: reaped %d; want 1", n)
+	}
+	select {
+	case <-done: // reaped conns are closed
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit: forward not done after reap")
+	}
+
+	s := l.summaries(t, 1)[0]
+	if s.ID != "u1" || s.PID != "wg0" || s.UID != "10001" || s.Target != "192.0.2.1" || s.Proto != ProtoTypeUDP {
+		t.Errorf("audit: summary %s; want as tracked", s.str())
+	}
+	if s.Code != x.ErrAuditedLeak || !s.start.Equal(start) {
+		t.Errorf("audit: summary code %s, start %s; want %s, %s", x.ErrName(s.Code), s.start, x.ErrName(x.ErrAuditedLeak), start)
+	}
+	// forward does not summarize a flow the audit already did
+	noMoreSummaries(t, l, 1500*time.Millisecond)
+	if n := a.reaped.Load(); n != 1 {
+		t.Errorf("audit: %d reaped in all; want 1", n)
+	}
+}
@@ -13,6 +13,8 @@ const ( // see dnsx/transport.go
 	DNS53    = "DNS"
 	DOT      = "DNS-over-TLS"
 	ODOH     = "Oblivious DNS-over-HTTPS"
+	Group    = "Group"  // of other transports; see: AddTransportGroup
+	Client   = "Client" // implemented by the client; see: AddClientTransport
 
 	CT = "Cache" // cached transport prefix
 
@@ -23,6 +25,7 @@ const ( // see dnsx/transport.go
 	Default   = "Default"   // default (fallback) dns
 	Preferred = "Preferred" // user preferred dns, primary for alg
 	Preset    = "Preset"    // synthesizes answers from presets (ex: IPs)
+	LocalRecs = "Local"     // synthesizes answers from local records; never cached!
 	BlockFree = "BlockFree" // no local blocks; if not set, default is used
 	BlockAll  = "BlockAll"  // all blocks; never cached!
 	Bootstrap = "Bootstrap" // bootstrap dns; always encapsulted by Default
@@ -30,6 +33,8 @@ const ( // see dnsx/transport.go
 	DcProxy   = "DcProxy"   // dnscrypt.Proxy as a transport
 	IpMapper  = "IpMapper"  // dns resolver for dns resolvers
 
+	Designated = "Designated" // encrypted dns designated by System; see: SetDDR
+
 	SummaryProxyLabel = "proxy:"
 )
 
@@ -52,6 +57,11 @@ const ( // from dnsx/queryerror.go
 	TransportError
 	// ClientError: Client has issues
 	ClientError
+	// AuthError: Server rejected the client's credentials (ex: http 401, 403)
+	AuthError
+	// StrictError: query strictly bound to a transport could not be sent over it,
+	// or failed there, and was not sent elsewhere; see: SetStrictTransport
+	StrictError
 )
 
 const ( // from: dnsx/rethinkdns.go
@@ -59,6 +69,116 @@ const ( // from: dnsx/rethinkdns.go
 	EB64
 )
 
+const ( // from: dnsx/rebind.go
+	// RebindOff: answers are not checked for rebinding
+	RebindOff = iota
+	// RebindStrip: private ips are removed from answers
+	RebindStrip
+	// RebindBlock: answers with private ips are blocked
+	RebindBlock
+)
+
+const ( // from: dnsx/integrity.go; see: DNSIntegrity
+	// IntegrityUnknown: too few answers were cross-checked to tell
+	IntegrityUnknown = "unknown"
+	// IntegrityOK: no name diverges from the reference, of late
+	IntegrityOK = "ok"
+	// IntegritySuspect: answers for some names diverge from the reference
+	IntegritySuspect = "suspect"
+)
+
+const ( // from: dnsx/wall.go
+	// SVCBBlockNoData: blocked svcb and https queries are answered with no records
+	SVCBBlockNoData = iota
+	// SVCBBlockFakeTarget: blocked svcb and https queries are answered with a record
+	// that points to a fake domain (and an unspecified ip for it)
+	SVCBBlockFakeTarget
+	// SVCBBlockDotTarget: blocked svcb and https queries are answered with a record
+	// that points to "." (the blocked name itself), with no hints
+	SVCBBlockDotTarget
+)
+
+const ( // from: dnsx/padding.go
+	// PadOff: queries are not padded
+	PadOff = iota
+	// PadFixed: queries are padded to multiples of a set block size
+	PadFixed
+	// PadRecommended: queries are padded to multiples of 128 bytes; rfc8467 sec 4.1
+	PadRecommended
+)
+
+const ( // from: dnsx/questions.go
+	// MultiQFirst: the first question of queries with many is answered; the rest are stripped
+	MultiQFirst = iota
+	// MultiQRefuse: queries with many questions are refused
+	MultiQRefuse
+)
+
+const ( // from: dnsx/order.go
+	// AnswerPreserve: ips in answers are left in the order upstreams sent them
+	AnswerPreserve = iota
+	// AnswerShuffle: ips in answers are rotated by one on every query
+	AnswerShuffle
+	// AnswerByLatency: ips in answers are sorted by connect latency, lowest first
+	AnswerByLatency
+)
+
+const ( // from: dnsx/provenance.go; see: DNSSummary.Route
+	// RouteDefault: no transport was picked (ex: bad query), or OnQuery set none
+	RouteDefault = iota
+	// RouteListener: transports as set by DNSListener.OnQuery; RouteWhy is its csv
+	RouteListener
+	// RouteChosen: transports chosen by the tunnel (ex: LocalLookup); RouteWhy is the csv
+	RouteChosen
+	// RouteBlockAll: BlockAll as set by OnQuery, or as its preset ips are unspecified
+	RouteBlockAll
+	// RouteUndelegated: System (or Goos) as the name is in an undelegated domain; RouteWhy is the domain
+	RouteUndelegated
+	// RouteMDNS: mdns for *.local names; RouteWhy is the rule that matched
+	RouteMDNS
+	// RouteAlg: Alg resolves over Preferred, or BlockFree if firewalling
+	RouteAlg
+	// RouteFallback: the transport set is missing, and another stood in for it; RouteWhy is its id
+	RouteFallback
+	// RouteDomain: the name has a domain route (see: AddDomainRoute); RouteWhy is its proxy
+	RouteDomain
+	// RouteServedOver: the query was sent over a proxy (ex: port 53 flows); RouteWhy is the proxy
+	RouteServedOver
+	// RouteExit: resolved by the dns of the uid's exit proxy (see: DNSOpts.UID); RouteWhy is the proxy
+	RouteExit
+	// RouteLocalRecords: answered by local records (see: AddLocalRecord)
+	RouteLocalRecords
+	// RouteUID: the query's uid has a transport (see: SetUIDTransport); RouteWhy is the uid
+	RouteUID
+	// RouteListenerTimeout: OnQuery did not answer in time (see: SetListenerTimeout); RouteWhy is the policy
+	RouteListenerTimeout
+)
+
+var routenames = []string{
+	RouteDefault:         "default",
+	RouteListener:        "listener",
+	RouteChosen:          "chosen",
+	RouteBlockAll:        "block-all",
+	RouteUndelegated:     "undelegated",
+	RouteMDNS:            "mdns",
+	RouteAlg:             "alg",
+	RouteFallback:        "fallback",
+	RouteDomain:          "domain-route",
+	RouteServedOver:      "served-over",
+	RouteExit:            "exit",
+	RouteLocalRecords:    "local-records",
+	RouteUID:             "uid",
+	RouteListenerTimeout: "listener-timeout",
+}
+
+// RouteName returns a stable name for route (see: DNSSummary.Route).
+func RouteName(route int) string {
+	if route < 0 || route >= len(routenames) {
+		return routenames[RouteDefault]
+	}
+	return routenames[route]
+}
+
 // DNSTransport exports necessary methods from dnsx.Transport
 type DNSTransport interface {
 	// uniquely identifies this transport
@@ -73,6 +193,24 @@ type DNSTransport interface {
 	Status() int
 }
 
+// DNSClientTransport is a dns transport implemented by the client (ex: one
+// that answers queries from an on-device database); see: AddClientTransport.
+type DNSClientTransport interface {
+	// uniquely identifies this transport
+	ID() string
+	// free-form kind of this transport (ex: "enterprise-db"), for logs
+	Type() string
+	// Query returns the answer (with matching ID) to the dns query q, both
+	// in wire format; or an error, if there is none.
+	Query(q []byte) ([]byte, error)
+	// Return the server host address of this transport, if any.
+	GetAddr() string
+	// State of the transport after the previous query, if it failed; one of
+	// SendFailed, NoResponse, BadQuery, BadResponse, TransportError, ClientError
+	// (see: queryerror.go); anything else is taken to be TransportError.
+	Status() int
+}
+
 type DNSTransportMult interface {
 	// Add adds a transport to this multi-transport.
 	Add(t DNSTransport) bool
@@ -82,8 +220,15 @@ type DNSTransportMult interface {
 	Get(id string) (DNSTransport, error)
 	// Stop stops this multi-transport.
 	Stop() error
-	// Refresh re-registers transports and returns a csv of active ones.
+	// Refresh re-registers transports in the background, and returns a csv
+	// of those active as of now; see: RefreshReport for the outcome.
 	Refresh() (string, error)
+	// RefreshReport re-registers transports, as Refresh does, but waits on
+	// them, and returns json of RefreshReport with the outcome for each.
+	RefreshReport() string
+	// Start is RefreshReport, but also starts periodic refreshes of transports
+	// that do so (ex: certs of dnscrypt servers), if yet to.
+	Start() string
 	// LiveTransports returns a csv of active transports.
 	LiveTransports() string
 }
@@ -114,9 +259,303 @@ type RDNSResolver interface {
 	Translate(bool)
 }
 
+type LocalRecords interface {
+	// AddLocalRecord answers queries for name of type rrtype (A, AAAA, CNAME, TXT)
+	// with value for ttl secs. Wildcard names (*.lab.home) match all subdomains.
+	AddLocalRecord(name, rrtype, value string, ttl int) error
+	// RemoveLocalRecord removes records of type rrtype for name; or all records
+	// for name if rrtype is empty. Returns true if any record was removed.
+	RemoveLocalRecord(name, rrtype string) bool
+	// ListLocalRecords returns all local records, one record per line.
+	ListLocalRecords() string
+}
+
+type DomainRouter interface {
+	// AddDomainRoute routes name over proxy pid: queries for name are resolved
+	// over pid (with its dns, if any), and flows to its answers are forwarded
+	// over pid, overriding SocketListener.Flow's verdict unless it is a block.
+	// Wildcard names (*.bbc.co.uk) match all subdomains. A name also matches if
+	// it is a cname target of the query. pid must not be Base, Exit, or Block.
+	// Names prefixed "cat:" route domains of that category (see: SetCategorizer),
+	// once categorized; routes on names win over routes on categories.
+	AddDomainRoute(name, pid string) error
+	// RemoveDomainRoute removes the route for name; true if there was one.
+	RemoveDomainRoute(name string) bool
+	// ListDomainRoutes returns all routes as name=pid, one route per line.
+	ListDomainRoutes() string
+}
+
+type UIDTransports interface {
+	// SetUIDTransport resolves queries of apps of uid over transport id instead of
+	// the ones DNSListener.OnQuery sets (unless they are BlockAll), whichever proxy
+	// carries their flows. Queries are known to be of uid only if sent over the
+	// tunnel (ex: to its dns), and not by the os on its behalf; others resolve as
+	// usual. An empty id removes uid's transport.
+	SetUIDTransport(uid, id string) error
+	// ListUIDTransports returns all uid transports as uid=id, one per line.
+	ListUIDTransports() string
+}
+
+type DNSRetrier interface {
+	// SetRetries sets the number of times a query over transport id is retried
+	// if it fails to send or gets no response; 0 (the default) disables
+	// retries. Returns an error if the transport does not exist or does not
+	// support retries.
+	SetRetries(id string, n int) error
+}
+
+type DNSPadding interface {
+	// SetPadding sets how queries over encrypted transport id (DoH, ODoH, DoT) are
+	// padded: PadOff, PadFixed (to multiples of block bytes), or PadRecommended (the
+	// default). Padding is stripped from answers. Returns an error if the transport
+	// does not exist or is not encrypted, or if policy or block is invalid.
+	SetPadding(id string, policy, block int) error
+}
+
+type DNSHeaders interface {
+	// SetHeader sets header key to value on every request sent by DoH transport
+	// id, replacing its current value, if any; an empty value removes key. Pooled
+	// conns are kept as-is. Values (ex: tokens) are never logged.
+	SetHeader(id, key, value string) error
+}
+
+type DNSCertChecks interface {
+	// SetCertChecks sets checks of certs of servers of encrypted transport id (DoH,
+	// DoT), on top of chain validation; all off by default. If staple, handshakes with
+	// no stapled ocsp response, or one that is not good (revoked, unknown, stale, or
+	// not signed by the issuer), fail. If minscts is positive, handshakes with fewer
+	// signed cert timestamps (in the tls extension, the staple, or the leaf) fail;
+	// scts are counted, not verified. Failed handshakes fail queries with
+	// TransportError. If keys, leaf keys of servers are remembered, and a change to
+	// a key not seen in the week before, while the previous leaf is over 30 days
+	// from expiry, is sent to DNSListener.OnDNSCertChange; the handshake goes on.
+	// Returns an error if the transport does not exist or does not check certs.
+	SetCertChecks(id string, staple bool, minscts int, keys bool) error
+	// CertStatus returns "server=spki=k;notafter=t;staple=s;scts=n;changes=n;at=t"
+	// of servers of transport id seen since checks were set, one per line; where
+	// spki is the base64 sha256 of the last leaf's SubjectPublicKeyInfo, staple is
+	// one of none, good, revoked, unknown, invalid, and changes is the number of
+	// unexpected key changes.
+	CertStatus(id string) string
+}
+
+type DNSDesignated interface {
+	// SetDDR sets whether the encrypted resolvers that System designates (rfc9462;
+	// its answer to _dns.resolver.arpa SVCB) are discovered as System is set, on by
+	// default. The first designated DoH (h2, with a dohpath) or DoT resolver, in
+	// order of priority, whose cert covers the ip of System that answered, and that
+	// answers a query over it, is added as Designated, and is preferred over System
+	// for as long as System is not set again. Results are sent to
+	// DNSListener.OnDNSDiscovery. If off, Designated is removed.
+	SetDDR(on bool)
+	// DDRStatus returns "on=b;server=ip;at=t" of the last discovery, followed by
+	// "url=verdict;why", one per line, of the resolvers System designated.
+	DDRStatus() string
+}
+
+type DNSIntegrity interface {
+	// SetCrossCheck has answers (a, aaaa) to pct percent (0 to 100) of queries, and
+	// to all queries for canary names (csv), checked in the background against those
+	// of transport refid (ex: a DoH transport) to detect forged answers (ex: of isps
+	// that intercept port 53). Answers agree if they share an ip, or a /24 (ipv4) or
+	// /48 (ipv6), as cdns answer differently to different resolvers. Once answers for
+	// a name diverge thrice in a row, DNSListener.OnDNSDivergence is called. An empty
+	// refid (the default) turns it off.
+	SetCrossCheck(refid string, pct int, canarycsv string) error
+	// DNSIntegrity returns "verdict=v;checked=n;agreed=n;diverged=n;since=t" of
+	// cross-checks on the current network (since the last link change), where v is
+	// one of IntegrityUnknown, IntegrityOK, IntegritySuspect; followed by
+	// "name=ips;refips", one per line, of names whose answers diverge.
+	DNSIntegrity() string
+}
+
+type RebindProtector interface {
+	// SetRebindProtection sets mode (RebindOff, RebindStrip, RebindBlock) for answers
+	// that resolve public names to private, loopback, link-local, CGNAT, or ULA ips.
+	// trustedsuffixes is a csv of domain suffixes (ex: internal or own DDNS names)
+	// whose answers are never checked.
+	SetRebindProtection(mode int, trustedsuffixes string)
+}
+
+type TTLClamper interface {
+	// SetTTLClamp clamps ttls of all answers to [minsecs, maxsecs], and caches
+	// answers for as long; 0 unsets either bound. Unset by default.
+	SetTTLClamp(minsecs, maxsecs int)
+	// SetDNS64TTLClamp clamps ttls of dns64 synthesized answers to [minsecs, maxsecs],
+	// instead of the bounds set by SetTTLClamp; 0 unsets either bound.
+	SetDNS64TTLClamp(minsecs, maxsecs int)
+	// SetBlockTTL sets the ttl of blocked answers; 0 resets it to 5 secs.
+	SetBlockTTL(secs int)
+}
+
+type QuestionsPolicy interface {
+	// SetMultiQuestion sets mode (MultiQFirst, MultiQRefuse) for queries with
+	// more than one question; MultiQFirst by default. Regardless, queries with
+	// no questions are answered FORMERR, and those that are not standard
+	// queries (ex: NOTIFY, UPDATE) are answered NOTIMP; neither is forwarded.
+	SetMultiQuestion(mode int)
+}
+
+type AnswerOrderer interface {
+	// SetAnswerOrder sets mode (AnswerPreserve, AnswerShuffle, AnswerByLatency)
+	// for ips in A and AAAA answers; AnswerPreserve by default. The order is
+	// applied to the final answer (after blocks and alg) on every query, incl
+	// those answered from the cache; ips with no latency measured yet are put
+	// after those with, as-is, in AnswerByLatency.
+	SetAnswerOrder(mode int)
+}
+
+type BlockStats interface {
+	// GetBlockStats returns a json of queries blocked since start (or reset):
+	// the total, hits per blocklist, and the topk (10 if not positive) most
+	// blocked names with their counts, most first.
+	GetBlockStats(topk int) string
+	// ResetBlockStats zeroes all counts of blocked queries.
+	ResetBlockStats()
+}
+
+type DNSUsage interface {
+	// GetDNSUsage returns a json of bytes of queries (tx) and answers (rx) the
+	// resolver exchanged with apps since start (or reset), by uid; counted for
+	// dns it serves in place of flows (ex: to the fake dns addrs), which go
+	// unreported in SocketSummary. Those of unknown uids are counted as -1.
+	GetDNSUsage() string
+	// ResetDNSUsage zeroes all counts of bytes of dns served to apps.
+	ResetDNSUsage()
+}
+
+type BlockResponder interface {
+	// SetSVCBBlockMode sets mode (SVCBBlockNoData, SVCBBlockFakeTarget, SVCBBlockDotTarget)
+	// of answers to blocked svcb and https queries; SVCBBlockNoData by default.
+	SetSVCBBlockMode(mode int)
+}
+
+type Categorizer interface {
+	// Categorize returns categories (csv; ex: "gambling,social") of domain, if
+	// any. Never called on the query or flow path; results are cached.
+	Categorize(domain string) string
+}
+
+type DomainCategorizer interface {
+	// SetCategorizer sets c to categorize domains of queries and flows; nil unsets it.
+	// Categories are cached for ttlsecs (30m if not positive), and are sent to Flow
+	// as "cat:<category>" in blocklists; domain routes may be set on categories, as
+	// "cat:<category>" (see: AddDomainRoute). Lookups never wait on c: domains not
+	// yet categorized are categorized in the background, for later queries and flows.
+	SetCategorizer(c Categorizer, ttlsecs int)
+}
+
+type DNSWarmer interface {
+	// Warmup connects all transports (tcp, tls, certs) ahead of queries, in
+	// the background; ex: after network changes. Transports are also warmed
+	// up as they are added. Latencies are sent to DNSListener.OnDNSWarmup.
+	Warmup()
+	// SetWarmupCanary sets the name queried over each transport once it is
+	// connected; empty (default) sends no queries.
+	SetWarmupCanary(name string)
+}
+
+type AlgJournal interface {
+	// SetAlgJournal sets how many alg ips evicted from the alg table (along with
+	// the domains they were answered for) are remembered, and for how long (secs),
+	// so that flows of apps that hold on to answers past their ttls re-resolve
+	// those domains instead of dialing alg ips that lead nowhere; flows to alg ips
+	// not remembered fail right away with a "stale-algip" summary. A size of 0 turns
+	// the journal off; 1024 alg ips for 6h (if ttlsecs is not positive) by default.
+	SetAlgJournal(size, ttlsecs int)
+}
+
+type DNSLimiter interface {
+	// SetQueryLimit caps queries in flight over transport id to n; excess queries
+	// wait, in order, in a queue of up to queued, for up to waitms (1s if not
+	// positive) or the query's deadline, whichever is sooner; those that find the
+	// queue full, or wait for as long, fail with SendFailed. Queries answered from
+	// the cache are not capped. An n of 0 (the default) or less removes the cap.
+	SetQueryLimit(id string, n, queued, waitms int)
+	// QueryLimits returns "id=inflight=n/max;queued=n/cap" of all capped
+	// transports, one per line.
+	QueryLimits() string
+}
+
+const ( // from: dnsx/failsafe.go; see: DNSFailsafe
+	// QueryFailOpen: queries OnQuery does not answer in time go to the default transport
+	QueryFailOpen = iota
+	// QueryFailClosed: queries OnQuery does not answer in time are answered with SERVFAIL
+	QueryFailClosed
+)
+
+type DNSFailsafe interface {
+	// SetListenerTimeout waits up to ms for DNSListener.OnQuery to answer; queries it
+	// does not answer in time are resolved as per policy, QueryFailOpen (the default)
+	// or QueryFailClosed, with their summaries' Route set to RouteListenerTimeout. An
+	// ms of 0 (the default) or less waits for as long as OnQuery takes.
+	SetListenerTimeout(ms, policy int)
+	// ListenerTimeouts returns the number of queries OnQuery did not answer in time.
+	ListenerTimeouts() int
+}
+
+type DNSRefreshGens interface {
+	// RefreshGens returns json of RefreshGens of Refresh (and RefreshReport): a
+	// refresh (ex: on a network change, which come in bursts) supersedes those
+	// still underway, which then neither re-register any more transports, nor
+	// refresh DcProxy.
+	RefreshGens() string
+}
+
+type DNSStrict interface {
+	// SetStrictTransport binds queries routed to transport id (ex: a proxy's own,
+	// see: AddProxyDNS; or the one OnQuery picks), or of flows over proxy id, to it,
+	// if strict: they are never sent to (as a fallback, or a secondary) transports
+	// other than id and those in allowed (csv of ids). Queries so bound that cannot
+	// be sent over id (ex: it is gone) or that fail there are answered SERVFAIL with
+	// an extended dns error, and their summaries' Status is StrictError. Not strict
+	// (the default) unbinds id.
+	SetStrictTransport(id string, strict bool, allowed string)
+}
+
+type DNSConnStats interface {
+	// ConnStats returns "opened=n;reused=n;queries=n;reusepct=p;closed=idle:n,
+	// error:n,goaway:n,done:n" of conns of encrypted transport id (DoH, DoT):
+	// conns opened, queries sent over reused conns, of all queries sent, and conns
+	// closed as they were idle, on errors, by the server while in use (ex: http2
+	// GOAWAY), or after their only query (DoT does not reuse conns). A reusepct of
+	// -1 means no queries were sent. Empty if id does not exist or does not count.
+	ConnStats(id string) string
+	// SetConnReuseAlert calls DNSListener.OnDNSConnReuse when, over a window of 64
+	// queries of an encrypted transport, less than pct percent of them were sent
+	// over reused conns, and not so in the window before (ex: a middlebox resets
+	// conns, and so, tls is re-established for nearly every query). A pct of 0 (the
+	// default) or less turns it off.
+	SetConnReuseAlert(pct int)
+}
+
 type DNSResolver interface {
 	DNSTransportMult
 	RDNSResolver
+	LocalRecords
+	DomainRouter
+	UIDTransports
+	DNSRetrier
+	DNSHeaders
+	DNSPadding
+	DNSCertChecks
+	DNSDesignated
+	DNSIntegrity
+	RebindProtector
+	TTLClamper
+	QuestionsPolicy
+	AnswerOrderer
+	BlockStats
+	DNSUsage
+	BlockResponder
+	DNSWarmer
+	AlgJournal
+	DomainCategorizer
+	DNSLimiter
+	DNSFailsafe
+	DNSConnStats
+	DNSStrict
+	DNSRefreshGens
 }
 
 type ResolverListener interface {
@@ -12,6 +12,9 @@ import "fmt"
 type DNSSummary struct {
 	Type           string  // dnscrypt, dns53, doh, odoh, dot
 	ID             string  // transport id
+	Member         string  // id of the group member that served the query, if ID is a group
+	Route          int     // why the query was sent to ID; see: RouteName
+	RouteWhy       string  // the rule or suggestion behind Route, if any (ex: matched domain)
 	Latency        float64 // Response (or failure) latency in seconds
 	QName          string  // query domain
 	QType          int     // A, AAAA, SVCB, HTTPS, etc.
@@ -23,7 +26,13 @@ type DNSSummary struct {
 	Status         int
 	Blocklists     string // csv separated list of blocklists names, if any.
 	UpstreamBlocks bool   // true if any among upstream transports returned blocked ans.
-	Msg            string // final status message, if any
+	Attempts       int    // number of attempts made to the upstream; 0 if unknown.
+	AttemptOK      int    // attempt (1-based) that got a response; 0 if none did.
+	Deadline       int    // timeout hint in millis applied to the query; 0 if none.
+	Order          string // order applied to ips in the answer: shuffle, latency; empty if preserved.
+	Msg            string // final status message, if any; human-readable, may change.
+	Code           int    // stable code for Status and RCode; see: ErrNone and ErrName.
+	UID            string // uid of the app that sent the query, if known; see: SetUIDTransport.
 }
 
 type DNSOpts struct {
@@ -31,15 +40,20 @@ type DNSOpts struct {
 	PID string
 	// csv of ips to answer for this query; incl unspecified.
 	IPCSV string
-	// csv of transports ids to use for this query.
+	// csv of transports ids to use for this query; each id may carry
+	// a timeout hint in millis, as in "Preferred|1500".
 	TIDCSV string
 	// bypass on-device blocklists.
 	NOBLOCK bool
+	// uid of the app that sent this query, if known; if set, the query
+	// is resolved over PID's own dns transport (see: AddProxyDNS), if any,
+	// and its alg answers are bound to PID as the exit.
+	UID string
 }
 
 func (s *DNSSummary) Str() string {
-	return fmt.Sprintf("type: %s, id: %s, latency: %f, qname: %s, rdata: %s, rcode: %d, rttl: %d, server: %s, relay: %s, status: %d, blocklists: %s",
-		s.Type, s.ID, s.Latency, s.QName, s.RData, s.RCode, s.RTtl, s.Server, s.RelayServer, s.Status, s.Blocklists)
+	return fmt.Sprintf("type: %s, id: %s, latency: %f, qname: %s, rdata: %s, rcode: %d, rttl: %d, server: %s, relay: %s, status: %d, code: %s, blocklists: %s, route: %s(%s)",
+		s.Type, s.ID, s.Latency, s.QName, s.RData, s.RCode, s.RTtl, s.Server, s.RelayServer, s.Status, ErrName(s.Code), s.Blocklists, RouteName(s.Route), s.RouteWhy)
 }
 
 // DNSListener receives Summaries.
@@ -50,4 +64,28 @@ type DNSListener interface {
 	OnQuery(domain string, qtyp int) *DNSOpts
 	// OnResponse is called when a DNS response is received.
 	OnResponse(*DNSSummary)
+	// OnRebind is called when an answer for public domain resolves to
+	// private ips (csv); blocked is true if the whole answer was blocked,
+	// false if only those ips were removed from it.
+	OnRebind(domain string, ips string, blocked bool)
+	// OnDNSWarmup is called once transport id is warmed up (connected, and
+	// if set, the warmup canary answered) in ms millis; ok is false if it
+	// failed or did not finish in time.
+	OnDNSWarmup(id string, ms int64, ok bool)
+	// OnDNSCertChange is called when the leaf key of server of transport id
+	// changes unexpectedly from prev to next (base64 sha256 of their
+	// SubjectPublicKeyInfo), even as its chain validates; see: SetCertChecks.
+	OnDNSCertChange(id, server, prev, next string)
+	// OnDNSConnReuse is called when pct percent of the last 64 queries of
+	// transport id were sent over reused conns, below the percent set with
+	// SetConnReuseAlert.
+	OnDNSConnReuse(id string, pct int)
+	// OnDNSDiscovery is called when an encrypted resolver at url, designated
+	// by System at ip server, is found, validated, or rejected (verdict), and
+	// why, if rejected; see: SetDDR.
+	OnDNSDiscovery(server, url, verdict, why string)
+	// OnDNSDivergence is called when answers (csv of ips) of transport id for
+	// qname diverge, thrice in a row, from those of the reference transport
+	// refid; see: SetCrossCheck.
+	OnDNSDivergence(qname, id, ips, refid, refips string)
 }
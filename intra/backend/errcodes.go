@@ -0,0 +1,172 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backend
+
+// Stable error codes set on SocketSummary.Code and DNSSummary.Code, so that
+// clients need not match on error messages (Msg), which may change anytime.
+// Codes are only ever appended to; never renumbered, nor reused.
+const (
+	// ErrNone: no error
+	ErrNone = iota
+	// ErrUnknown: error with no code
+	ErrUnknown
+	// ErrFirewalled: blocked by the client's verdict
+	ErrFirewalled
+	// ErrKillSwitch: proxy is down and has its kill switch set
+	ErrKillSwitch
+	// ErrPurged: all flows of the uid were purged
+	ErrPurged
+	// ErrDNSBypassBlocked: flow to a known public resolver was blocked
+	ErrDNSBypassBlocked
+	// ErrDNSBypassRedirected: flow to a known public resolver was served by the tunnel
+	ErrDNSBypassRedirected
+	// ErrNoProxy: proxy missing, or not set up
+	ErrNoProxy
+	// ErrProxyDown: proxy stopped, or unresponsive
+	ErrProxyDown
+	// ErrProxyAuthFailed: proxy rejected its credentials
+	ErrProxyAuthFailed
+	// ErrProxyUnsupported: proxy does not support the op (ex: udp)
+	ErrProxyUnsupported
+	// ErrDialTimeout: remote did not answer in time
+	ErrDialTimeout
+	// ErrDialRefused: remote refused to connect
+	ErrDialRefused
+	// ErrUnreachable: remote or its network is unreachable
+	ErrUnreachable
+	// ErrTimeout: conn idled out
+	ErrTimeout
+	// ErrConnReset: conn was reset or aborted by either end
+	ErrConnReset
+	// ErrConnSetup: conn could not be set up
+	ErrConnSetup
+	// ErrTunnelClosed: tunnel is closed or closing
+	ErrTunnelClosed
+	// ErrDNSServfail: upstream answered with SERVFAIL
+	ErrDNSServfail
+	// ErrDNSSendFailed: query could not be sent upstream
+	ErrDNSSendFailed
+	// ErrDNSNoResponse: upstream did not answer in time
+	ErrDNSNoResponse
+	// ErrDNSBadQuery: query is malformed
+	ErrDNSBadQuery
+	// ErrDNSBadResponse: answer is malformed
+	ErrDNSBadResponse
+	// ErrDNSTransport: no such transport, or upstream erred (ex: http 5xx)
+	ErrDNSTransport
+	// ErrDNSClient: upstream rejected the query (ex: http 4xx)
+	ErrDNSClient
+	// ErrDNSInternal: bug
+	ErrDNSInternal
+	// ErrDNSProxied: plain dns flow was served by the tunnel over its proxy
+	ErrDNSProxied
+	// ErrAuditedLeak: flow was found leaked (dead, yet tracked) and reaped
+	ErrAuditedLeak
+	// ErrDNSAuth: upstream rejected the credentials (ex: http 401, 403)
+	ErrDNSAuth
+	// ErrPeerDead: peer vanished (no fin or rst) and the flow was reaped
+	ErrPeerDead
+	// ErrCircuitOpen: dials to the destination failed repeatedly; flow failed without a dial
+	ErrCircuitOpen
+	// ErrStaleAlgIP: dst is an alg ip no longer known of, and not re-resolvable
+	ErrStaleAlgIP
+	// ErrMetered: background flow on a metered network was blocked to save data
+	ErrMetered
+	// ErrListenerTimeout: the listener did not answer in time (or at all), and the
+	// flow was blocked, or the query failed, as per the fail-closed policy
+	ErrListenerTimeout
+	// ErrRouteChanged: the link no longer routes the family of the flow's upstream socket, and it was closed
+	ErrRouteChanged
+	// ErrDNSDiverted: dns sent to an arbitrary resolver was answered by the tunnel's resolver instead, as DNSModePort traps all dns
+	ErrDNSDiverted
+	// ErrDNSStrict: query strictly bound to a transport failed there (or could not be sent over it), and was answered servfail
+	ErrDNSStrict
+	// ErrEndpoint: netstack could not create an endpoint for the flow; Msg has why (ex: no-route)
+	ErrEndpoint
+	// ErrSuperseded: refresh given up on, as a newer one (ex: on another network change) began since
+	ErrSuperseded
+	// ErrProxySecret: proxy's secret could not be had from SecretProvider
+	ErrProxySecret
+)
+
+var errnames = []string{
+	ErrNone:                "ok",
+	ErrUnknown:             "unknown",
+	ErrFirewalled:          "firewalled",
+	ErrKillSwitch:          "killswitch",
+	ErrPurged:              "purged",
+	ErrDNSBypassBlocked:    "dns-bypass-blocked",
+	ErrDNSBypassRedirected: "dns-bypass-redirected",
+	ErrNoProxy:             "no-proxy",
+	ErrProxyDown:           "proxy-down",
+	ErrProxyAuthFailed:     "proxy-auth-failed",
+	ErrProxyUnsupported:    "proxy-unsupported",
+	ErrDialTimeout:         "dial-timeout",
+	ErrDialRefused:         "dial-refused",
+	ErrUnreachable:         "unreachable",
+	ErrTimeout:             "timeout",
+	ErrConnReset:           "conn-reset",
+	ErrConnSetup:           "conn-setup",
+	ErrTunnelClosed:        "tunnel-closed",
+	ErrDNSServfail:         "dns-servfail",
+	ErrDNSSendFailed:       "dns-send-failed",
+	ErrDNSNoResponse:       "dns-no-response",
+	ErrDNSBadQuery:         "dns-bad-query",
+	ErrDNSBadResponse:      "dns-bad-response",
+	ErrDNSTransport:        "dns-transport",
+	ErrDNSClient:           "dns-client",
+	ErrDNSInternal:         "dns-internal",
+	ErrDNSProxied:          "dns-proxied",
+	ErrAuditedLeak:         "audited-leak",
+	ErrDNSAuth:             "dns-auth",
+	ErrPeerDead:            "peer-dead",
+	ErrCircuitOpen:         "circuit-open",
+	ErrStaleAlgIP:          "stale-algip",
+	ErrMetered:             "metered",
+	ErrListenerTimeout:     "listener-timeout",
+	ErrRouteChanged:        "route-changed",
+	ErrDNSDiverted:         "dns-diverted",
+	ErrDNSStrict:           "dns-strict",
+	ErrEndpoint:            "endpoint",
+	ErrSuperseded:          "superseded",
+	ErrProxySecret:         "proxy-secret",
+}
+
+// ErrName returns the canonical short name of error code; "unknown" for
+// codes it does not know of.
+func ErrName(code int) string {
+	if code < 0 || code >= len(errnames) {
+		return errnames[ErrUnknown]
+	}
+	return errnames[code]
+}
+
+// RefreshResult is the outcome of refreshing one proxy or dns transport.
+type RefreshResult struct {
+	ID   string `json:"id"`
+	OK   bool   `json:"ok"`
+	Code int    `json:"code"` // one of ErrNone, ErrUnknown etc
+	Err  string `json:"error,omitempty"`
+}
+
+// RefreshReport is the json returned by RefreshProxiesReport and
+// RefreshReport: {"active": csv, "results": [{"id":..., "ok":bool,
+// "code":int, "error":...}, ...]}.
+type RefreshReport struct {
+	Active  string          `json:"active"` // csv of ids that are up
+	Results []RefreshResult `json:"results"`
+	Gen     int64           `json:"gen,omitempty"` // generation of this refresh; see: RefreshGens
+}
+
+// RefreshGens is the json returned by RefreshProxiesGens and RefreshGens:
+// every refresh begins a new generation, superseding all before it; those
+// superseded abort, and do not apply their results. Completed is of the
+// latest refresh that did.
+type RefreshGens struct {
+	Current   int64 `json:"current"`
+	Completed int64 `json:"completed"`
+}
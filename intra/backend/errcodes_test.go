@@ -0,0 +1,29 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backend
+
+import "testing"
+
+func TestErrName(t *testing.T) {
+	seen := make(map[string]int)
+	for code := range len(errnames) {
+		name := ErrName(code)
+		if len(name) <= 0 {
+			t.Errorf("code %d: no name", code)
+		}
+		if prev, ok := seen[name]; ok {
+			t.Errorf("code %d: name %q dup of code %d", code, name, prev)
+		}
+		seen[name] = code
+	}
+	if n := ErrName(-1); n != "unknown" {
+		t.Errorf("ErrName(-1) = %q; want unknown", n)
+	}
+	if n := ErrName(len(errnames)); n != "unknown" {
+		t.Errorf("ErrName(max+1) = %q; want unknown", n)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// batches are delivered at least this often, if not full
+	defaultBatchWait = 30 * time.Second
+	// max summaries in a batch
+	maxBatchSize = 10000
+)
+
+type SocketBatchListener interface {
+	// OnSocketsClosed reports summaries of sockets closed since the last
+	// batch, as a json array of SocketSummary, in the order they closed;
+	// only if batching is on, see: Tunnel.SetSummaryBatching.
+	OnSocketsClosed(batch []byte)
+}
+
+// batcher is a Listener that holds socket summaries back, if so set, and
+// delivers them in batches; all other calls pass through to Listener.
+type batcher struct {
+	Listener // delivers summaries and batches
+
+	mu    sync.Mutex // protects size, wait, q, timer
+	size  int        // max summaries per batch; 0 turns batching off
+	wait  time.Duration
+	q     []*SocketSummary
+	timer *time.Timer
+
+	fmu sync.Mutex // serializes deliveries, so that summaries stay in order
+}
+
+var _ Listener = (*batcher)(nil)
+
+func newBatcher(l Listener) *batcher {
+	return &batcher{Listener: l}
+}
+
+// set sets the max summaries per batch, and the max time (in millis) they
+// are held back for; size <= 0 turns batching off, after delivering those
+// held back, if any.
+func (b *batcher) set(size, millis int) {
+	// summaries held back are delivered before any passed through after
+	b.fmu.Lock()
+	defer b.fmu.Unlock()
+
+	b.mu.Lock()
+	b.size = min(max(size, 0), maxBatchSize)
+	b.wait = time.Duration(millis) * time.Millisecond
+	if b.wait <= 0 {
+		b.wait = defaultBatchWait
+	}
+	off := b.size <= 0
+	log.I("batch: size %d; wait %s", b.size, b.wait)
+	b.mu.Unlock()
+
+	if off {
+		b.flushLocked()
+	}
+}
+
+// OnSocketClosed implements SocketListener.
+func (b *batcher) OnSocketClosed(s *SocketSummary) {
+	b.mu.Lock()
+	if b.size <= 0 {
+		b.mu.Unlock()
+		// wait on deliveries underway (ex: of those held back till now)
+		b.fmu.Lock()
+		defer b.fmu.Unlock()
+		b.Listener.OnSocketClosed(s)
+		return
+	}
+	b.q = append(b.q, s)
+	full := len(b.q) >= b.size
+	if !full && b.timer == nil {
+		b.timer = time.AfterFunc(b.wait, func() { b.flush() })
+	}
+	b.mu.Unlock()
+
+	if full {
+		b.flush()
+	}
+}
+
+// flush delivers all summaries held back, if any, as one batch.
+func (b *batcher) flush() (n int) {
+	b.fmu.Lock()
+	defer b.fmu.Unlock()
+	return b.flushLocked()
+}
+
+// flushLocked is flush, with fmu held.
+func (b *batcher) flushLocked() (n int) {
+	b.mu.Lock()
+	q := b.q
+	b.q = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	if n = len(q); n <= 0 {
+		return
+	}
+	blob, err := json.Marshal(q)
+	if err != nil { // unlikely
+		log.E("batch: marshal %d summaries: %v", n, err)
+		return 0
+	}
+	log.V("batch: flush %d summaries; %d bytes", n, len(blob))
+	b.Listener.OnSocketsClosed(blob)
+	return
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchListener records ids of summaries in the order they are delivered,
+// and sizes of batches; batches take slow to deliver.
+type batchListener struct {
+	Listener // unused
+	slow     time.Duration
+
+	mu      sync.Mutex
+	ids     []string
+	batches []int
+}
+
+func (l *batchListener) OnSocketClosed(s *SocketSummary) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids = append(l.ids, s.ID)
+}
+
+func (l *batchListener) OnSocketsClosed(blob []byte) {
+	time.Sleep(l.slow)
+	var q []*SocketSummary
+	if err := json.Unmarshal(blob, &q); err != nil {
+		panic(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range q {
+		l.ids = append(l.ids, s.ID)
+	}
+	l.batches = append(l.batches, len(q))
+}
+
+func (l *batchListener) got() (ids []string, batches []int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.ids), slices.Clone(l.batches)
+}
+
+// closeN closes summaries with ids from, from+1, ... from+n-1.
+func closeN(b *batcher, from, n int) {
+	for i := range n {
+		b.OnSocketClosed(&SocketSummary{ID: strconv.Itoa(from + i)})
+	}
+}
+
+func seq(from, n int) []string {
+	ids := make([]string, 0, n)
+	for i := range n {
+		ids = append(ids, strconv.Itoa(from+i))
+	}
+	return ids
+}
+
+func TestBatchSize(t *testing.T) {
+	l := &batchListener{}
+	b := newBatcher(l)
+
+	// off by default
+	closeN(b, 0, 2)
+	if ids, batches := l.got(); !slices.Equal(ids, seq(0, 2)) || len(batches) != 0 {
+		t.Fatalf("batch: off: ids %v, batches %v; want one by one", ids, batches)
+	}
+
+	// full batches are delivered as summaries close; the rest held back
+	b.set(3, 60*1000)
+	closeN(b, 2, 7)
+	ids, batches := l.got()
+	if !slices.Equal(ids, seq(0, 8)) || !slices.Equal(batches, []int{3, 3}) {
+		t.Errorf("batch: size: ids %v, batches %v; want [0..7], [3 3]", ids, batches)
+	}
+	if n := b.flush(); n != 1 {
+		t.Errorf("batch: flushed %d; want 1", n)
+	}
+	if n := b.flush(); n != 0 {
+		t.Errorf("batch: flushed %d again; want 0", n)
+	}
+	ids, batches = l.got()
+	if !slices.Equal(ids, seq(0, 9)) || !slices.Equal(batches, []int{3, 3, 1}) {
+		t.Errorf("batch: flush: ids %v, batches %v; want [0..8], [3 3 1]", ids, batches)
+	}
+}
+
+func TestBatchInterval(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	l := &batchListener{}
+	b := newBatcher(l)
+	b.set(100, int(wait/time.Millisecond))
+
+	start := time.Now()
+	closeN(b, 0, 2)
+	if ids, _ := l.got(); len(ids) != 0 {
+		t.Fatalf("batch: %v delivered before the interval", ids)
+	}
+	eventually(t, 5*time.Second, func() bool {
+		ids, _ := l.got()
+		return len(ids) == 2
+	}, "batch: not delivered after the interval")
+	if took := time.Since(start); took < wait {
+		t.Errorf("batch: delivered in %s; want >= %s", took, wait)
+	}
+
+	// and the timer is set again for the next batch
+	closeN(b, 2, 1)
+	eventually(t, 5*time.Second, func() bool {
+		_, batches := l.got()
+		return slices.Equal(batches, []int{2, 1})
+	}, "batch: second batch not delivered after the interval")
+}
+
+// Disconnect turns batching off, which delivers those held back.
+func TestBatchOff(t *testing.T) {
+	l := &batchListener{}
+	b := newBatcher(l)
+	b.set(100, 60*1000)
+	closeN(b, 0, 3)
+
+	b.set(0, 0)
+	closeN(b, 3, 1)
+	ids, batches := l.got()
+	if !slices.Equal(ids, seq(0, 4)) || !slices.Equal(batches, []int{3}) {
+		t.Errorf("batch: off: ids %v, batches %v; want [0..3], [3]", ids, batches)
+	}
+}
+
+// Summaries passed through as batching is turned off are not delivered
+// before those held back till then.
+func TestBatchOffInOrder(t *testing.T) {
+	const n = 200
+	l := &batchListener{slow: 20 * time.Millisecond}
+	b := newBatcher(l)
+	b.set(n, 60*1000)
+	closeN(b, 0, 10)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		closeN(b, 10, n)
+	}()
+	b.set(0, 0)
+	wg.Wait()
+	b.flush()
+
+	if ids, _ := l.got(); !slices.Equal(ids, seq(0, n+10)) {
+		t.Errorf("batch: out of order: %v", ids)
+	}
+}
@@ -42,6 +42,7 @@ type DefaultDNS interface {
 	x.DNSTransport
 	kickstart(px ipn.Proxies, g Bridge) error
 	reinit(typ, ipOrUrl, ips string) error
+	renew() (DefaultDNS, error)
 }
 
 type bootstrap struct {
@@ -149,6 +150,48 @@ func (b *bootstrap) recreate() error {
 	return b.kickstart(b.proxies, b.bridge)
 }
 
+// renew returns a new DefaultDNS set up and kickstarted as b is.
+func (b *bootstrap) renew() (DefaultDNS, error) {
+	ippOrUrl, ips := b.ipports, ""
+	if b.typ == dnsx.DOH {
+		ippOrUrl, ips = b.url, b.ipports
+	}
+	d, err := NewDefaultDNS(b.typ, ippOrUrl, ips)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.kickstart(b.proxies, b.bridge); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// fork returns a new bootstrap for typ, ippOrUrl, ips, which is set up
+// (see: kickstart) as b is, if at all; b is left as-is.
+func (b *bootstrap) fork(typ, ippOrUrl, ips string) (*bootstrap, error) {
+	nb := new(bootstrap)
+	if err := nb.reinit(typ, ippOrUrl, ips); err != nil {
+		return nil, err
+	}
+	if b.proxies != nil && b.bridge != nil {
+		if err := nb.kickstart(b.proxies, b.bridge); err != nil {
+			return nil, err
+		}
+	}
+	return nb, nil
+}
+
+// adopt makes b use o's transport, as o is set up; o is not to be used
+// thereafter. See: fork
+func (b *bootstrap) adopt(o *bootstrap) {
+	b.Transport = o.Transport
+	b.typ = o.typ
+	b.ipports = o.ipports
+	b.url = o.url
+	b.hostname = o.hostname
+	log.I("dns: default: adopted %s %s[%s]", b.typ, b.hostname, b.ipports)
+}
+
 func (b *bootstrap) kickstart(px ipn.Proxies, g Bridge) error {
 	if px == nil || g == nil {
 		return errCannotStart
@@ -0,0 +1,253 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// max destinations tracked
+	breakermax = 1024
+	// prefix lengths of ips that key destinations sans domains
+	breakerbits4 = 24
+	breakerbits6 = 64
+)
+
+// states of a circuit
+const (
+	circuitClosed = iota // flows dialed as usual
+	circuitOpen          // flows failed right away, until cooldown
+	circuitHalf          // one flow (the probe) dialed; others failed
+)
+
+var circuitnames = []string{
+	circuitClosed: "closed",
+	circuitOpen:   "open",
+	circuitHalf:   "half-open",
+}
+
+// breaker fails new flows to a destination right away, once dials to all of
+// its ips have failed fails times within window, for cooldown; after which,
+// one flow is let through as a probe: if it dials ok, the destination is
+// dialed as usual, or else, the breaker opens again. Flows that are blocked
+// (by the firewall, or by proxies) are not failures; and failures are counted
+// per destination whichever proxy dialed.
+type breaker struct {
+	sync.Mutex                     // protects all fields
+	fails      int                 // failures that open a circuit; 0 disables
+	window     time.Duration       // failures older than window are forgotten
+	cooldown   time.Duration       // how long a circuit stays open
+	m          map[string]*circuit // breakerkey -> circuit
+}
+
+type circuit struct {
+	state int
+	fails int       // failures since start
+	start time.Time // start of the current window
+	until time.Time // open until; or, if half-open, the probe's deadline
+}
+
+func newBreaker() *breaker {
+	return &breaker{m: make(map[string]*circuit)}
+}
+
+// set sets failures within window that open a circuit for cooldown;
+// fails of 0 (or less) disables the breaker, and forgets all circuits.
+func (b *breaker) set(fails int, window, cooldown time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if fails <= 0 || window <= 0 || cooldown <= 0 {
+		fails = 0
+		clear(b.m)
+	}
+	b.fails, b.window, b.cooldown = fails, window, cooldown
+	log.I("breaker: fails %d in %s; cooldown %s", fails, window, cooldown)
+}
+
+// breakerkey returns the key for the first of domains (csv); or for
+// the prefix dst is in, if there are no domains.
+func breakerkey(domains string, dst netip.Addr) string {
+	d, _, _ := strings.Cut(domains, ",")
+	d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if len(d) > 0 {
+		return d
+	}
+	if !dst.IsValid() || dst.IsUnspecified() {
+		return ""
+	}
+	bits := breakerbits6
+	if dst.Is4() {
+		bits = breakerbits4
+	}
+	if p, err := dst.Prefix(bits); err == nil {
+		return p.String()
+	}
+	return ""
+}
+
+// allow returns false if flows to k must fail right away; if it returns
+// true, the outcome of the flow's dials must be reported with done.
+func (b *breaker) allow(k string) bool {
+	if len(k) <= 0 {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.fails <= 0 {
+		return true
+	}
+	c, ok := b.m[k]
+	if !ok {
+		return true
+	}
+	switch c.state {
+	case circuitOpen:
+		if time.Now().Before(c.until) {
+			return false
+		}
+		c.state = circuitHalf // this flow is the probe
+		c.until = time.Now().Add(retrytimeout)
+		log.D("breaker: %s: half-open; probe", k)
+		return true
+	case circuitHalf:
+		if time.Now().Before(c.until) {
+			return false // probe in flight
+		}
+		c.until = time.Now().Add(retrytimeout)
+		log.D("breaker: %s: half-open; probe unreported, re-probe", k)
+		return true
+	}
+	return true
+}
+
+// done reports the outcome of dials to k; err is that of the last dial.
+// Errors that say nothing about the destination (ex: proxy down) are
+// ignored, but a probe that ends so is allowed to be retried.
+func (b *breaker) done(k string, err error) {
+	if len(k) <= 0 {
+		return
+	}
+	failed := destFailed(err)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.fails <= 0 {
+		return
+	}
+	c, ok := b.m[k]
+	if err == nil {
+		if ok {
+			if c.state != circuitClosed {
+				log.I("breaker: %s: closed; was %s", k, circuitnames[c.state])
+			}
+			delete(b.m, k)
+		}
+		return
+	}
+	if !failed {
+		if ok && c.state == circuitHalf {
+			c.until = time.Now() // the next flow probes
+		}
+		return
+	}
+
+	now := time.Now()
+	if !ok {
+		if len(b.m) >= breakermax {
+			b.evictLocked(now)
+		}
+		c = &circuit{start: now}
+		b.m[k] = c
+	}
+	switch c.state {
+	case circuitHalf:
+		c.state = circuitOpen
+		c.until = now.Add(b.cooldown)
+		log.I("breaker: %s: probe failed; open for %s", k, b.cooldown)
+	case circuitClosed:
+		if now.Sub(c.start) > b.window {
+			c.fails, c.start = 0, now
+		}
+		c.fails++
+		if c.fails >= b.fails {
+			c.state = circuitOpen
+			c.until = now.Add(b.cooldown)
+			log.I("breaker: %s: open for %s; %d fails in %s", k, b.cooldown, c.fails, now.Sub(c.start))
+		}
+	} // circuitOpen: flows dialed before it opened; no-op
+}
+
+// destFailed returns true if err says the destination is unreachable.
+func destFailed(err error) bool {
+	switch ipn.ErrCode(err) {
+	case x.ErrDialTimeout, x.ErrDialRefused, x.ErrUnreachable:
+		return true
+	}
+	return false
+}
+
+// list returns "key=state:fails" of destinations tracked, one per line.
+func (b *breaker) list() string {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	lines := make([]string, 0, len(b.m))
+	for k, c := range b.m {
+		state := c.state
+		if state == circuitOpen && now.After(c.until) {
+			state = circuitHalf // the next flow probes
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s:%d", k, circuitnames[state], c.fails))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// OnLinkChange implements core.LinkObserver; destinations unreachable
+// on the previous link may be reachable on the new one.
+func (b *breaker) OnLinkChange(l core.Link) {
+	b.Lock()
+	defer b.Unlock()
+
+	log.D("breaker: link: %s; forget %d", l.L3, len(b.m))
+	clear(b.m)
+}
+
+// evictLocked removes closed circuits whose windows have lapsed, and
+// open ones past their cooldown; or, if none are, an arbitrary one.
+func (b *breaker) evictLocked(now time.Time) {
+	n := len(b.m)
+	for k, c := range b.m {
+		if (c.state == circuitClosed && now.Sub(c.start) > b.window) ||
+			(c.state == circuitOpen && now.After(c.until)) {
+			delete(b.m, k)
+		}
+	}
+	if len(b.m) < n {
+		return
+	}
+	for k := range b.m {
+		delete(b.m, k)
+		return
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+)
+
+var errTestRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+// failN reports n failed dials to k, each allowed.
+func failN(tb testing.TB, b *breaker, k string, n int, err error) {
+	tb.Helper()
+	for i := range n {
+		if !b.allow(k) {
+			tb.Fatalf("breaker: %s: fail#%d not allowed", k, i)
+		}
+		b.done(k, err)
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	b := newBreaker()
+	const k = "a.test"
+
+	// off by default
+	failN(t, b, k, 5, errTestRefused)
+	if s := b.list(); len(s) > 0 {
+		t.Fatalf("breaker: off: tracks %s", s)
+	}
+
+	b.set(3, time.Minute, time.Hour)
+	failN(t, b, k, 2, errTestRefused)
+	if s := b.list(); s != k+"=closed:2" {
+		t.Errorf("breaker: after 2 fails: %q", s)
+	}
+	// an ok dial forgets failures
+	b.done(k, nil)
+	failN(t, b, k, 2, errTestRefused)
+	if !b.allow(k) {
+		t.Fatal("breaker: open before 3 fails")
+	}
+	b.done(k, errTestRefused)
+	if b.allow(k) {
+		t.Error("breaker: not open after 3 fails")
+	}
+	if s := b.list(); s != k+"=open:3" {
+		t.Errorf("breaker: after 3 fails: %q", s)
+	}
+	// other destinations are dialed as usual
+	if !b.allow("b.test") {
+		t.Error("breaker: b.test not allowed")
+	}
+
+	// turned off, all are forgotten
+	b.set(0, 0, 0)
+	if !b.allow(k) || len(b.list()) > 0 {
+		t.Error("breaker: circuits remain once off")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	const window = 50 * time.Millisecond
+	b := newBreaker()
+	b.set(2, window, time.Hour)
+	const k = "a.test"
+
+	failN(t, b, k, 1, errTestRefused)
+	time.Sleep(2 * window)
+	// the failure before is forgotten
+	failN(t, b, k, 1, errTestRefused)
+	if !b.allow(k) {
+		t.Error("breaker: open for fails across windows")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	b := newBreaker()
+	b.set(1, time.Minute, cooldown)
+	const k = "a.test"
+
+	// a probe that fails opens the circuit again
+	failN(t, b, k, 1, errTestRefused)
+	if b.allow(k) {
+		t.Fatal("breaker: not open")
+	}
+	time.Sleep(2 * cooldown)
+	if s := b.list(); s != k+"=half-open:1" {
+		t.Errorf("breaker: after cooldown: %q", s)
+	}
+	if !b.allow(k) {
+		t.Fatal("breaker: no probe after cooldown")
+	}
+	if b.allow(k) {
+		t.Error("breaker: allowed while the probe is in flight")
+	}
+	b.done(k, errTestRefused)
+	if b.allow(k) {
+		t.Error("breaker: not open after the probe failed")
+	}
+
+	// a probe that ends sans a verdict on the destination is retried
+	time.Sleep(2 * cooldown)
+	if !b.allow(k) {
+		t.Fatal("breaker: no probe after cooldown")
+	}
+	b.done(k, ipn.ErrFirewalled)
+	if !b.allow(k) {
+		t.Fatal("breaker: probe not retried")
+	}
+
+	// and a probe that dials ok closes it
+	b.done(k, nil)
+	if s := b.list(); len(s) > 0 {
+		t.Errorf("breaker: after the probe dialed ok: %q", s)
+	}
+	for range 3 {
+		if !b.allow(k) {
+			t.Fatal("breaker: not closed after the probe dialed ok")
+		}
+	}
+}
+
+func TestBreakerIgnoresFirewalls(t *testing.T) {
+	b := newBreaker()
+	b.set(2, time.Minute, time.Hour)
+	const k = "a.test"
+
+	noverdicts := []error{
+		ipn.ErrFirewalled,
+		errTcpFirewalled,
+		errUdpFirewalled,
+		fmt.Errorf("proxy: %w", ipn.ErrFirewalled),
+		syscall.ECONNRESET, // not a dial error
+	}
+	for _, err := range noverdicts {
+		failN(t, b, k, 3, err)
+	}
+	if s := b.list(); len(s) > 0 || !b.allow(k) {
+		t.Errorf("breaker: counts errors that are not the destination's: %q", s)
+	}
+
+	dial := []error{
+		errTestRefused,
+		&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH},
+		&net.OpError{Op: "dial", Err: timeoutError{}},
+	}
+	for _, err := range dial {
+		if !destFailed(err) {
+			t.Errorf("breaker: %v: not a failure of the destination", err)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestBreakerEvicts(t *testing.T) {
+	const window = 50 * time.Millisecond
+	b := newBreaker()
+	b.set(2, window, time.Hour)
+
+	// closed circuits whose window lapsed go first
+	for i := range breakermax {
+		failN(t, b, fmt.Sprintf("c%d.test", i), 1, errTestRefused)
+	}
+	time.Sleep(2 * window)
+	failN(t, b, "open.test", 2, errTestRefused)
+	b.Lock()
+	n := len(b.m)
+	b.Unlock()
+	if n != 1 {
+		t.Errorf("breaker: %d tracked after evictions; want 1", n)
+	}
+
+	// or else, any one, but never more than breakermax
+	for i := range breakermax {
+		failN(t, b, fmt.Sprintf("d%d.test", i), 1, errTestRefused)
+	}
+	b.Lock()
+	n = len(b.m)
+	b.Unlock()
+	if n != breakermax {
+		t.Errorf("breaker: %d tracked; want %d", n, breakermax)
+	}
+}
+
+func TestBreakerKey(t *testing.T) {
+	tests := []struct {
+		domains string
+		dst     string
+		want    string
+	}{
+		{"A.test.,b.test", "192.0.2.1", "a.test"},
+		{"", "192.0.2.1", "192.0.2.0/24"},
+		{"", "2001:db8::1", "2001:db8::/64"},
+		{"", "0.0.0.0", ""},
+	}
+	for _, tc := range tests {
+		if got := breakerkey(tc.domains, netip.MustParseAddr(tc.dst)); got != tc.want {
+			t.Errorf("breaker: key(%q, %s) = %q; want %q", tc.domains, tc.dst, got, tc.want)
+		}
+	}
+}
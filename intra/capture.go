@@ -0,0 +1,95 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/base64"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// bytes of the first payload kept, by default
+	defaultCaptureLen = 128
+	// max bytes of the first payload kept
+	maxCaptureLen = 1024
+	// bytes of the first payload read to guess its protocol
+	maxSniffLen = 2 << 10
+	// how long tcp clients are waited on to send, once the handshake completes
+	captureWaitTCP = 3 * time.Second
+	// how long udp clients are waited on; their first datagram is already in
+	captureWaitUDP = 50 * time.Millisecond
+)
+
+// capture reads the first payload of blocked flows of uids so set, and
+// reports a snippet of it (redacted, if it looks like it has credentials),
+// and a guess of its protocol, in their summaries; ex: to debug rules.
+type capture struct {
+	sync.RWMutex
+	n    int             // bytes kept
+	uids map[string]bool // uids whose blocked flows are captured
+}
+
+func newCapture() *capture {
+	return &capture{
+		n:    defaultCaptureLen,
+		uids: make(map[string]bool),
+	}
+}
+
+// set turns capture on or off for blocked flows of uid.
+func (c *capture) set(uid string, on bool) {
+	c.Lock()
+	defer c.Unlock()
+	if on {
+		c.uids[uid] = true
+	} else {
+		delete(c.uids, uid)
+	}
+	log.I("capture: uid %s on? %t; uids: %d", uid, on, len(c.uids))
+}
+
+// setLen sets the bytes of payloads kept; or the default, if not positive.
+func (c *capture) setLen(n int) {
+	if n <= 0 {
+		n = defaultCaptureLen
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.n = min(n, maxCaptureLen)
+}
+
+// on returns true if blocked flows of uid are captured.
+func (c *capture) on(uid string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.uids[uid]
+}
+
+// read reads the first payload from conn, waiting on it for up to wait,
+// and sets what was captured in smm. Does not close conn.
+func (c *capture) read(conn net.Conn, wait time.Duration, smm *SocketSummary) {
+	c.RLock()
+	n := c.n
+	c.RUnlock()
+
+	b := make([]byte, maxSniffLen)
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	sz, err := conn.Read(b)
+	if sz <= 0 {
+		log.D("capture: %s nothing in %s; err? %v", smm.ID, wait, err)
+		return
+	}
+	b = b[:sz]
+	smm.CaptureProto, smm.CaptureHost = core.Sniff(b)
+	smm.Capture = base64.StdEncoding.EncodeToString(core.Redact(b[:min(n, sz)]))
+	log.I("capture: %s %d bytes; proto: %s, host: %s", smm.ID, sz, smm.CaptureProto, smm.CaptureHost)
+}
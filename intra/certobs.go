@@ -0,0 +1,233 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+// port of flows whose tls handshakes are observed
+const certobsport = 443
+
+var errCertPin = errors.New("certpin: not a base64 sha256 hash")
+
+// CertAlert reports a flow whose server's leaf cert matches none of
+// the pins of its domain; see: Tunnel.SetCertPins.
+type CertAlert struct {
+	ID          string // Conn ID of the flow; see: SocketSummary.ID.
+	PID         string // Proxy ID that handled the flow.
+	UID         string // UID of the app that owns the flow.
+	Target      string // Remote IP.
+	Domain      string // The pinned domain.
+	Pins        string // Its pins (csv); base64 sha256 of SubjectPublicKeyInfo.
+	CertSPKI    string // Base64 sha256 of the leaf cert's SubjectPublicKeyInfo.
+	CertSubject string // Subject of the leaf cert.
+	CertIssuer  string // Issuer of the leaf cert.
+}
+
+type CertListener interface {
+	// OnCertPinMismatch is called as soon as the leaf cert of a flow to
+	// a pinned domain is seen to match none of its pins.
+	OnCertPinMismatch(*CertAlert)
+}
+
+// certobs decides which flows have their tls handshakes observed, and
+// holds pins of domains to check the certs seen against;
+// see: Tunnel.SetCertObservation
+type certobs struct {
+	sync.RWMutex                                // protects all fields
+	on           bool                           // observe flows not sent over proxies
+	pins         map[string]map[string]struct{} // domain -> spki hashes
+	listener     CertListener
+}
+
+func newCertObs(l CertListener) *certobs {
+	return &certobs{
+		pins:     make(map[string]map[string]struct{}),
+		listener: l,
+	}
+}
+
+// set turns observing tls handshakes on or off.
+func (c *certobs) set(on bool) {
+	c.Lock()
+	c.on = on
+	c.Unlock()
+
+	log.I("certobs: on? %t", on)
+}
+
+// setPins pins domain to csv of base64 sha256 hashes of spki; or unpins
+// it, if csv is empty.
+func (c *certobs) setPins(domain, csv string) error {
+	domain = normalizeDomain(domain)
+	if len(domain) <= 0 {
+		return errCertPin
+	}
+	m := make(map[string]struct{})
+	for _, v := range strings.Split(csv, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) <= 0 {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(v); err != nil || len(b) != sha256.Size {
+			log.W("certobs: pin %s for %s: %v", v, domain, errCertPin)
+			return errCertPin
+		}
+		m[v] = struct{}{}
+	}
+
+	c.Lock()
+	if len(m) <= 0 {
+		delete(c.pins, domain)
+	} else {
+		c.pins[domain] = m
+	}
+	c.Unlock()
+
+	log.I("certobs: %s pins %d", domain, len(m))
+	return nil
+}
+
+// watch returns a watcher for the flow smm over proxy pid to port, or
+// nil if it is not to be observed. Flows over proxies are opaque (ex:
+// wireguard) or may be intercepted by the proxy itself, and so, only
+// those sent out as-is (Base, Exit) are observed.
+func (c *certobs) watch(pid string, port uint16, domains string, smm *SocketSummary) *tlswatch {
+	if port != certobsport || (pid != ipn.Base && pid != ipn.Exit) {
+		return nil
+	}
+
+	c.RLock()
+	on := c.on
+	c.RUnlock()
+
+	if !on {
+		return nil
+	}
+	return &tlswatch{certs: c, domains: domains, smm: smm}
+}
+
+// mismatch returns the pinned domain, and its pins (csv), that spki does
+// not match; domains (csv; from alg) are checked, or if none, sans of leaf.
+func (c *certobs) mismatch(domains string, leaf *x509.Certificate, spki string) (domain, pins string) {
+	ds := strings.Split(domains, ",")
+	if len(domains) <= 0 {
+		ds = leaf.DNSNames
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, d := range ds {
+		d = normalizeDomain(d)
+		m, ok := c.pins[d]
+		if !ok {
+			continue
+		}
+		if _, ok := m[spki]; ok {
+			continue
+		}
+		all := make([]string, 0, len(m))
+		for p := range m {
+			all = append(all, p)
+		}
+		return d, strings.Join(all, ",")
+	}
+	return "", ""
+}
+
+// tlswatch observes the server's side of the tls handshake of a flow.
+type tlswatch struct {
+	core.TLSObserver
+	certs   *certobs
+	domains string // csv, from alg; may be empty
+	smm     *SocketSummary
+}
+
+// copy copies from remote to local till w is done observing the flow,
+// and returns bytes copied; the rest of the flow is for the caller to copy.
+func (w *tlswatch) copy(local io.Writer, remote net.Conn) (n int64, err error) {
+	bptr := core.Alloc()
+	b := *bptr
+	b = b[:cap(b)]
+	defer func() {
+		*bptr = b
+		core.Recycle(bptr)
+	}()
+
+	defer w.report()
+	for !w.Done() {
+		r, rerr := remote.Read(b)
+		if r > 0 {
+			nw, werr := local.Write(b[:r])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			w.Observe(b[:r])
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, nil
+}
+
+// report records what was observed in smm, and alerts the listener
+// if the leaf cert matches none of the pins of the flow's domain.
+func (w *tlswatch) report() {
+	smm := w.smm
+	if w.Version > 0 {
+		smm.TLSVersion = tls.VersionName(w.Version)
+	}
+	leaf := w.Leaf
+	if leaf == nil {
+		return
+	}
+	h := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	smm.CertSPKI = base64.StdEncoding.EncodeToString(h[:])
+	smm.CertSubject = leaf.Subject.String()
+	smm.CertIssuer = leaf.Issuer.String()
+	smm.CertNotAfter = leaf.NotAfter.Unix()
+
+	domain, pins := w.certs.mismatch(w.domains, leaf, smm.CertSPKI)
+	if len(domain) <= 0 {
+		return
+	}
+	log.W("certobs: %s pin mismatch for %s; got %s (%s), want %s", smm.ID, domain, smm.CertSPKI, smm.CertSubject, pins)
+	if l := w.certs.listener; l != nil {
+		go l.OnCertPinMismatch(&CertAlert{
+			ID:          smm.ID,
+			PID:         smm.PID,
+			UID:         smm.UID,
+			Target:      smm.Target,
+			Domain:      domain,
+			Pins:        pins,
+			CertSPKI:    smm.CertSPKI,
+			CertSubject: smm.CertSubject,
+			CertIssuer:  smm.CertIssuer,
+		})
+	}
+}
+
+// normalizeDomain lowercases d, sans its trailing dot.
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
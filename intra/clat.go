@@ -0,0 +1,105 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dialers"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+// nat64 prefixes of the underlying network, in order of preference: as set
+// by the client (or discovered with its resolver); discovered with rfc7050.
+// Local464Resolver's prefix is never used, as it is not routable.
+var clatprefixes = []string{dnsx.UnderlayResolver, dnsx.OverlayResolver}
+
+// xlat464 translates ipp to ip6 using the nat64 prefix of the underlying
+// network (464xlat, rfc6877), if ipp is ip4, and is dialed by proxy pid
+// straight into the underlying network, which does not route ip4; returns
+// ipp as-is (and false) otherwise. DNS64 is of no help to apps that connect
+// to ip4 literals on ip6-only networks.
+func xlat464(pt dnsx.NAT64, pid string, ipp netip.AddrPort) (netip.AddrPort, bool) {
+	if pid != ipn.Base && pid != ipn.Exit {
+		return ipp, false // proxies route ip4 over their own networks
+	}
+	if dialers.Use4() || !ipp.Addr().Is4() || ipp.Addr().IsUnspecified() || ipp.Addr().IsLoopback() {
+		return ipp, false
+	}
+	ip4 := ipp.Addr().AsSlice()
+	for _, id := range clatprefixes {
+		if ip6, ok := core.IPFromSlice(pt.S64(id, ip4)); ok && ip6.Is6() {
+			log.D("clat: %s -> %s via %s", ipp, ip6, id)
+			return netip.AddrPortFrom(ip6, ipp.Port()), true
+		}
+	}
+	log.W("clat: %s: no nat64 prefix on an ip6-only network", ipp)
+	return ipp, false
+}
+
+// unxlat464 undoes xlat464, so that apps see replies from the ip4 they
+// sent datagrams to, and not its ip6 translation.
+func unxlat464(pt dnsx.NAT64, ipp netip.AddrPort) netip.AddrPort {
+	if dialers.Use4() || !ipp.Addr().Is6() {
+		return ipp
+	}
+	ip6 := ipp.Addr().AsSlice()
+	for _, id := range clatprefixes {
+		if !pt.IsNat64(id, ip6) {
+			continue
+		}
+		if ip4, ok := core.IPFromSlice(pt.X64(id, ip6)); ok && ip4.Is4() {
+			return netip.AddrPortFrom(ip4, ipp.Port())
+		}
+	}
+	return ipp
+}
+
+// xlatconn is an announced (unconnected) conn over which datagrams to ip4
+// literals are sent to their 464xlat-ed ip6s (see: xlat464), and replies
+// from those ip6s are seen as from their ip4s (see: unxlat464).
+type xlatconn struct {
+	core.UDPConn
+	pt  dnsx.NAT64
+	pid string
+}
+
+var _ core.UDPConn = (*xlatconn)(nil)
+
+// xlatUDP wraps pc, announced over proxy pid, in an xlatconn, but only if
+// pc is a core.UDPConn and pid dials straight into the underlying network.
+func xlatUDP(pt dnsx.NAT64, pid string, pc io.Closer) io.Closer {
+	uc, ok := pc.(core.UDPConn)
+	if !ok || (pid != ipn.Base && pid != ipn.Exit) {
+		return pc
+	}
+	return &xlatconn{UDPConn: uc, pt: pt, pid: pid}
+}
+
+func (c *xlatconn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if dst, err := ipp(addr); err == nil {
+		if dst6, ok := xlat464(c.pt, c.pid, dst); ok {
+			addr = net.UDPAddrFromAddrPort(dst6)
+		}
+	}
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+func (c *xlatconn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if src, perr := ipp(addr); perr == nil {
+		if src4 := unxlat464(c.pt, src); src4 != src {
+			addr = net.UDPAddrFromAddrPort(src4)
+		}
+	}
+	return n, addr, err
+}
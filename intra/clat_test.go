@@ -0,0 +1,208 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dialers"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// the well-known nat64 prefix (rfc6052), as discovered on the underlay
+var nat64prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+var (
+	lit4 = netip.MustParseAddr("192.0.2.1")         // an ip4 literal apps send to
+	lit6 = netip.MustParseAddr("64:ff9b::c000:201") // lit4, 464xlat-ed
+)
+
+// nat64Resolver is testResolver, but with nat64prefix on the underlay.
+type nat64Resolver struct {
+	testResolver
+}
+
+func (*nat64Resolver) S64(id string, ip4 []byte) []byte {
+	if id != dnsx.UnderlayResolver || len(ip4) != 4 {
+		return nil
+	}
+	ip6 := nat64prefix.Addr().As16()
+	copy(ip6[12:], ip4)
+	return ip6[:]
+}
+
+func (*nat64Resolver) IsNat64(id string, ip []byte) bool {
+	ip6, ok := netip.AddrFromSlice(ip)
+	return id == dnsx.UnderlayResolver && ok && nat64prefix.Contains(ip6)
+}
+
+func (r *nat64Resolver) X64(id string, ip []byte) []byte {
+	if !r.IsNat64(id, ip) {
+		return nil
+	}
+	return ip[12:16]
+}
+
+// ip6only has the underlying network route ip6 alone, till tb is done.
+func ip6only(tb testing.TB) {
+	dialers.IPProtos(settings.IP6)
+	tb.Cleanup(func() { dialers.IPProtos(settings.IP46) })
+}
+
+func TestXlatTCP(t *testing.T) {
+	ip6only(t)
+	closed := make(chan struct{}, 1)
+	tt := newTestTunnelWith(ipn.Base, &nat64Resolver{})
+	tt.px.to = map[string]string{"tcp": echoTCP(t, closed)}
+	client := tt.up(t, settings.IP4)
+
+	c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(lit4.As4()), Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := []byte("xlat")
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("clat: tcp not echoed: %v", err)
+	}
+	c.Close()
+
+	want := netip.AddrPortFrom(lit6, 80).String()
+	if got := tt.px.dialed(); !slices.Equal(got, []string{want}) {
+		t.Errorf("clat: tcp dialed %v; want %s", got, want)
+	}
+	s := tt.l.summaries(t, 1)[0]
+	if s.Target != lit6.String() || s.Target4 != lit4.String() {
+		t.Errorf("clat: tcp target %s (from %s); want %s (from %s)", s.Target, s.Target4, lit6, lit4)
+	}
+}
+
+func TestXlatUDP(t *testing.T) {
+	ip6only(t)
+	tt := newTestTunnelWith(ipn.Base, &nat64Resolver{})
+	tt.px.to = map[string]string{"udp": echoServer(t).String()}
+	client := tt.up(t, settings.IP4)
+
+	c, err := gonet.DialUDP(client, nil, &tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(lit4.As4()), Port: 7}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b := []byte("xlat")
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(b); err != nil {
+		t.Fatalf("clat: udp not echoed: %v", err)
+	}
+
+	want := netip.AddrPortFrom(lit6, 7).String()
+	if got := tt.px.dialed(); !slices.Equal(got, []string{want}) {
+		t.Errorf("clat: udp dialed %v; want %s", got, want)
+	}
+	if err := tt.udp.End(); err != nil {
+		t.Fatal(err)
+	}
+	s := tt.l.summaries(t, 1)[0]
+	if s.Target != lit6.String() || s.Target4 != lit4.String() {
+		t.Errorf("clat: udp target %s (from %s); want %s (from %s)", s.Target, s.Target4, lit6, lit4)
+	}
+}
+
+// packetConn records the addr of the last datagram written to it, and
+// reads one datagram from src.
+type packetConn struct {
+	core.UDPConn // unused
+	to, src      net.Addr
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.to = addr
+	return len(b), nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, c.src, nil
+}
+
+func TestXlatAnnounced(t *testing.T) {
+	r := &nat64Resolver{}
+	ipp4 := netip.AddrPortFrom(lit4, 3478)
+	ipp6 := netip.AddrPortFrom(lit6, 3478)
+	other6 := netip.MustParseAddrPort("[2001:db8::1]:3478")
+
+	tests := []struct {
+		name         string
+		pid          string
+		only6        bool
+		to, wantto   netip.AddrPort // written to, and as sent
+		src, wantsrc netip.AddrPort // read from, and as seen
+	}{
+		{"ip6-only", ipn.Base, true, ipp4, ipp6, ipp6, ipp4},
+		{"ip6-only exit", ipn.Exit, true, ipp4, ipp6, ipp6, ipp4},
+		{"ip6-only non-nat64", ipn.Base, true, other6, other6, other6, other6},
+		{"dual-stack", ipn.Base, false, ipp4, ipp4, ipp6, ipp6},
+	}
+	for _, tc := range tests {
+		if tc.only6 {
+			dialers.IPProtos(settings.IP6)
+		} else {
+			dialers.IPProtos(settings.IP46)
+		}
+		pc := &packetConn{src: net.UDPAddrFromAddrPort(tc.src)}
+		c := xlatUDP(r, tc.pid, pc).(core.UDPConn)
+		_, _ = c.WriteTo(nil, net.UDPAddrFromAddrPort(tc.to))
+		_, from, _ := c.ReadFrom(nil)
+		if got, _ := ipp(pc.to); got != tc.wantto {
+			t.Errorf("clat: %s: sent to %s; want %s", tc.name, got, tc.wantto)
+		}
+		if got, _ := ipp(from); got != tc.wantsrc {
+			t.Errorf("clat: %s: read from %s; want %s", tc.name, got, tc.wantsrc)
+		}
+	}
+	dialers.IPProtos(settings.IP46)
+
+	// proxies route ip4 over their own networks
+	if c := xlatUDP(r, "wg0", &packetConn{}); c == nil {
+		t.Error("clat: nil conn")
+	} else if _, ok := c.(*xlatconn); ok {
+		t.Error("clat: conn of wg0 translated")
+	}
+}
+
+func TestXlatConnectUnconnected(t *testing.T) {
+	tt := newTestTunnelWith(ipn.Base, &nat64Resolver{})
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// unconnected sockets are announced; their writes to ip4 literals are
+	// translated, as the network may turn ip6-only while they are in use
+	local, smm, err := tt.udp.Connect(a, netip.MustParseAddrPort("10.111.222.1:5000"), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if _, ok := local.(*xlatconn); !ok {
+		t.Errorf("clat: %s: announced conn %T not translated", smm.ID, local)
+	}
+}
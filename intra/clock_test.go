@@ -0,0 +1,158 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestStallEscalatesAndDecays(t *testing.T) {
+	clock := core.NewFakeClock(time.Unix(1_000_000, 0))
+	m := core.NewExpiringMapWithClock(clock)
+	k := stallkey("10", "a.test")
+
+	// the first block is not stalled; the next few, for up to 5s
+	if secs := stall(m, k, stallmaxtcp); secs != 0 {
+		t.Errorf("stall: first: %ds; want none", secs)
+	}
+	for i := 1; i < 5; i++ {
+		if secs := stall(m, k, stallmaxtcp); secs < 1 || secs > 5 {
+			t.Errorf("stall: #%d: %ds; want 1s to 5s", i, secs)
+		}
+	}
+	// and those after, for as many secs as blocks in a row, up to 30s
+	for i := 5; i <= 35; i++ {
+		want := uint32(min(i, 30))
+		if secs := stall(m, k, 30); secs != want {
+			t.Errorf("stall: #%d: %ds; want %ds", i, secs, want)
+		}
+	}
+	// capped at maxsecs, but escalating all the same
+	if secs := stall(m, k, stallmaxudp); secs != stallmaxudp {
+		t.Errorf("stall: capped: %ds; want %ds", secs, stallmaxudp)
+	}
+	if secs := stall(m, k, stallmaxtcp); secs != stallmaxtcp {
+		t.Errorf("stall: after cap: %ds; want %ds", secs, stallmaxtcp)
+	}
+	// other keys are stalled on their own
+	if secs := stall(m, stallkey("11", "a.test"), stallmaxtcp); secs != 0 {
+		t.Errorf("stall: other uid: %ds; want none", secs)
+	}
+
+	// blocks stop for 30s, and the stall decays
+	clock.Advance(30*time.Second + time.Millisecond)
+	if secs := stall(m, k, stallmaxtcp); secs != 0 {
+		t.Errorf("stall: after 30s: %ds; want none", secs)
+	}
+	// blocks spaced further apart than the stall do not escalate it
+	for i := range 3 {
+		clock.Advance(29 * time.Second)
+		if secs := stall(m, k, stallmaxtcp); secs < 1 || secs > 5 {
+			t.Errorf("stall: spaced#%d, in the window: %ds; want 1s to 5s", i, secs)
+		}
+		clock.Advance(31 * time.Second)
+		if secs := stall(m, k, stallmaxtcp); secs != 0 {
+			t.Errorf("stall: spaced#%d, after the window: %ds; want none", i, secs)
+		}
+	}
+
+	if n := m.Trim(); n != 1 {
+		t.Errorf("stall: trimmed %d; want 1, of the other uid", n)
+	}
+}
+
+// blocked udp flows that are stalled go unanswered until the clock moves
+// past the stall, and are then closed with a summary
+func TestUDPStallOnClock(t *testing.T) {
+	clock := core.NewFakeClock(time.Now())
+	tt := newTestTunnelOn(ipn.Block, &testResolver{}, clock)
+	client := tt.up(t, settings.IP4)
+	defer tt.udp.End()
+
+	sendUDP(t, client, 5000, []byte("q1"))
+	if s := tt.l.summaries(t, 1)[0]; s.ID != "t1" {
+		t.Errorf("udp: first block: %s; want t1", s.ID)
+	}
+
+	sendUDP(t, client, 5000, []byte("q2"))
+	eventually(t, 5*time.Second, func() bool {
+		return clock.Pending() == 1
+	}, "udp: second block not stalled")
+	select {
+	case s := <-tt.l.smms:
+		t.Fatalf("udp: stalled flow closed early: %+v", s)
+	case <-time.After(1500 * time.Millisecond): // sendNotif waits 1s
+	}
+
+	clock.Advance(stallmaxudp * time.Second)
+	if s := tt.l.summaries(t, 1)[0]; s.ID != "t2" {
+		t.Errorf("udp: stalled block: %s; want t2", s.ID)
+	}
+	if n := clock.Pending(); n != 0 {
+		t.Errorf("udp: %d pending after the stall", n)
+	}
+}
+
+// udp flows idle for longer than their nat would be are reaped, and summarized
+func TestUDPNatExpirySummary(t *testing.T) {
+	clock := core.NewFakeClock(time.Now())
+	tt := newTestTunnelOn(ipn.Base, &testResolver{}, clock)
+	tt.px.to = map[string]string{"udp": echoUDP(t)}
+	client := tt.up(t, settings.IP4)
+	defer tt.udp.End()
+	a := &auditor{listener: tt.l, udp: tt.udp}
+
+	c, err := gonet.DialUDP(client, nil, &tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 443}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b := make([]byte, 1500)
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("udp: flow: got %q; err? %v", b[:n], err)
+	}
+
+	clock.Advance(udpleakidle - time.Second)
+	if n := a.pass(); n != 0 {
+		t.Errorf("udp: %d reaped before expiry", n)
+	}
+	// a read or write extends the nat
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	if n := a.pass(); n != 0 {
+		t.Errorf("udp: %d reaped after it was extended", n)
+	}
+
+	clock.Advance(udpleakidle)
+	if n := a.pass(); n != 1 {
+		t.Fatalf("udp: %d reaped after expiry; want 1", n)
+	}
+	s := tt.l.summaries(t, 1)[0]
+	if s.ID != "t1" || s.Proto != ProtoTypeUDP || s.PID != ipn.Base || s.Target != "10.111.222.3" {
+		t.Errorf("udp: expiry summary: %+v", s)
+	}
+	if n := tt.udp.conns().Len(); n != 0 {
+		t.Errorf("udp: %d flows tracked after expiry", n)
+	}
+}
@@ -17,34 +17,44 @@ import (
 	"time"
 
 	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dialers"
 	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
 	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
 )
 
-// pipe copies data from src to dst, and returns the number of bytes copied.
-// Prefers src.WriteTo(dst) and dst.ReadFrom(src) if available.
-// Otherwise, uses io.CopyBuffer, recycling buffers from global pool.
+// pipe copies data from src to dst, and returns the number of bytes copied;
+// see: core.Copy, whose buffers adapt to the throughput of the flow.
 func pipe(dst io.Writer, src io.Reader) (int64, error) {
-	if x, ok := src.(io.WriterTo); ok {
-		return x.WriteTo(dst)
-	} else if x, ok := dst.(io.ReaderFrom); ok {
-		return x.ReadFrom(src)
-	}
-	bptr := core.AllocRegion(core.BMAX)
-	b := *bptr
-	b = b[:cap(b)]
-	defer func() {
-		*bptr = b
-		core.Recycle(bptr)
-	}()
-	return io.CopyBuffer(dst, src, b)
+	return core.Copy(dst, src)
+}
+
+// stampw stores the time of every write to w in last; see: ConnMapper.Stamp
+type stampw struct {
+	w    io.Writer
+	last *core.Activity
+}
+
+func (s stampw) Write(b []byte) (int, error) {
+	s.last.Touch()
+	return s.w.Write(b)
+}
+
+// stamped returns w that stamps last on every write, or w as-is if last is nil.
+func stamped(w io.Writer, last *core.Activity) io.Writer {
+	if last == nil {
+		return w
+	}
+	return stampw{w, last}
 }
 
 // TODO: Propagate TCP RST using local.Abort(), on appropriate errors.
-func upload(cid string, local net.Conn, remote net.Conn, ioch chan<- ioinfo) {
+// Writes to remote are scheduled by f, if not nil, as those of a flow of uid.
+func upload(cid, uid string, local net.Conn, remote net.Conn, last *core.Activity, f *core.Fair, ioch chan<- ioinfo) {
 	ci := conn2str(local, remote)
 
-	n, err := pipe(remote, local)
+	n, err := pipe(f.Writer(stamped(remote, last), uid), local)
 	log.D("intra: %s upload(%d) done(%v) b/w %s", cid, n, err, ci)
 
 	pclose(local, "r")
@@ -52,10 +62,30 @@ func upload(cid string, local net.Conn, remote net.Conn, ioch chan<- ioinfo) {
 	ioch <- ioinfo{n, err}
 }
 
-func download(cid string, local net.Conn, remote net.Conn) (n int64, err error) {
+// rxwaiter is a conn that waits for data to read, without reading it.
+type rxwaiter interface {
+	awaitRx() error
+}
+
+// download copies data from remote to local; observing the tls handshake
+// with w, if not nil, before the rest of it is piped as-is. Remote that is
+// an rxwaiter is waited on till it has data, before buffers are taken up.
+func download(cid string, local net.Conn, remote net.Conn, last *core.Activity, w *tlswatch) (n int64, err error) {
 	ci := conn2str(local, remote)
 
-	n, err = pipe(local, remote)
+	if x, ok := remote.(rxwaiter); ok {
+		err = x.awaitRx()
+	}
+	if w != nil && err == nil {
+		n, err = w.copy(stamped(local, last), remote)
+	}
+	if err == io.EOF { // like pipe, eof is not an error
+		err = nil
+	} else if err == nil {
+		var m int64
+		m, err = pipe(stamped(local, last), remote)
+		n += m
+	}
 	log.D("intra: %s download(%d) done(%v) b/w %s", cid, n, err, ci)
 
 	pclose(local, "w")
@@ -63,20 +93,28 @@ func download(cid string, local net.Conn, remote net.Conn) (n int64, err error)
 	return
 }
 
-// forward copies data between local and remote, and tracks the connection.
-// It also sends a summary to the listener when done. Always called in a goroutine.
-func forward(local net.Conn, remote net.Conn, t core.ConnMapper, l SocketListener, smm *SocketSummary) {
+// forward copies data between local and remote, and tracks the connection;
+// observing the tls handshake with w, if not nil; and scheduling uploads with
+// f, if not nil. It also sends a summary to the listener when done. Always
+// called in a goroutine.
+func forward(local net.Conn, remote net.Conn, t core.ConnMapper, l SocketListener, smm *SocketSummary, w *tlswatch, f *core.Fair) {
 	cid := smm.ID
 
-	t.Track(cid, local, remote)
+	if n := t.TrackTuple(smm.tuple(), smm.start, cid, local, remote); n <= 0 {
+		log.I("intra: forward: %s for uid %s purged", cid, smm.UID)
+		smm.done(errPurged)
+		go sendNotif(l, smm)
+		return
+	}
 	defer t.Untrack(cid)
 
 	uploadch := make(chan ioinfo)
+	last := t.Stamp(cid) // for audits; see: auditor
 
 	var dbytes int64
 	var derr error
-	go upload(cid, local, remote, uploadch)
-	dbytes, derr = download(cid, local, remote)
+	go upload(cid, smm.UID, local, remote, last, f, uploadch)
+	dbytes, derr = download(cid, local, remote, last, w)
 
 	upload := <-uploadch
 
@@ -84,8 +122,15 @@ func forward(local net.Conn, remote net.Conn, t core.ConnMapper, l SocketListene
 	// its remote addr may not be the same as smm.Target
 	smm.Rx = dbytes
 	smm.Tx = upload.bytes
+	smm.Split = dialers.DidSplit(remote)
 
-	smm.done(derr, upload.err)
+	// why the conns were closed, if reaped; ex: errPeerDead
+	why := t.Reason(cid)
+	if errors.Is(why, errAuditedLeak) { // already summarized; see: auditor.reap
+		log.D("intra: forward: %s reaped by audit", cid)
+		return
+	}
+	smm.done(why, derr, upload.err)
 	go sendNotif(l, smm)
 }
 
@@ -102,24 +147,58 @@ func sendNotif(l SocketListener, s *SocketSummary) {
 	ok1 := l != nil      // likely due to bugs
 	ok2 := len(s.ID) > 0 // likely due to bugs
 	log.V("intra: end? sendNotif(%t,%t): %s", ok1, ok2, s.str())
+	if s.trace != nil {
+		s.trace.Event("flow-summary", "%s", s.str())
+	}
 	if ok1 && ok2 {
 		l.OnSocketClosed(s) // s.Duration may be uninitialized (zero)
 	}
 }
 
-func dnsOverride(r dnsx.Resolver, proto string, conn net.Conn, addr netip.AddrPort) bool {
+// dnsOverride serves conn with r if addr is one of r's dns addrs (or, in
+// DNSModePort, any dns addr not let through), or if redirect is set (ex: for
+// flows to known public resolvers); diverted is set for the former, if addr
+// is not one of the fake dns addrs. Bytes of conn are counted for uid by r,
+// as its SocketSummary (if any) carries none; see: x.DNSUsage
+func dnsOverride(r dnsx.Resolver, proto string, conn net.Conn, addr netip.AddrPort, redirect bool, uid string) (ok, diverted bool) {
 	// addr with zone information removed; see: netip.ParseAddrPort which h.resolver relies on
 	// addr2 := &net.TCPAddr{IP: addr.IP, Port: addr.Port}
-	if r.IsDnsAddr(addr.String()) {
-		// conn closed by the resolver
-		r.Serve(proto, conn)
-		return true
+	ipport := addr.String()
+	if redirect || r.IsDnsAddr(ipport) {
+		diverted = !redirect && r.IsDivertedDnsAddr(ipport)
+		// conn closed by the resolver; queries are of uid (of the flow), if known
+		r.ServeFor(proto, conn, "", uid)
+		return true, diverted
 	}
-	return false
+	return false, false
+}
+
+// flows in flight are waited on for as long by handlers as they end
+const endtimeout = 3 * time.Second
+
+var (
+	errEnded      = errors.New("handler ended")
+	errEndTimeout = errors.New("handler ended; flows still running")
+)
+
+const (
+	// max secs blocked tcp flows are held for before they are reset
+	stallmaxtcp = 25
+	// max secs blocked udp flows are held for before they are closed;
+	// any longer only delays retries of apps
+	stallmaxudp = 2
+)
+
+// stallkey returns the fwtracker key for uid and s (target or domains);
+// stallsep keeps uids from being prefixes of one another, see: Tunnel.PurgeUid
+func stallkey(uid, s string) string {
+	return uid + stallsep + s
 }
 
 // TODO: move this to ipn.Ground
-func stall(m *core.ExpMap, k string) (secs uint32) {
+// stall returns secs (up to maxsecs) blocked flows of k are to be held for
+// before they are failed; the more of them in a row, the longer.
+func stall(m *core.ExpMap, k string, maxsecs uint32) (secs uint32) {
 	if n := m.Get(k); n <= 0 {
 		secs = 0 // no stall
 	} else if n > 30 {
@@ -129,16 +208,16 @@ func stall(m *core.ExpMap, k string) (secs uint32) {
 	} else {
 		secs = n
 	}
-	// track uid->target for n secs, or 30s if n is 0
+	// track uid->target for n secs, or 30s if n is 0; regardless of
+	// maxsecs, so that repeated attempts still escalate
 	life30s := ((29 + secs) % 30) + 1
 	newlife := time.Duration(life30s) * time.Second
 	m.Set(k, newlife)
-	return
+	return min(secs, maxsecs)
 }
 
 func netipFrom(ip net.IP) *netip.Addr {
-	if addr, ok := netip.AddrFromSlice(ip); ok {
-		addr = addr.Unmap()
+	if addr, ok := core.IPFromSlice(ip); ok {
 		return &addr
 	}
 	return nil
@@ -170,7 +249,9 @@ func makeIPPorts(realips string, origipp netip.AddrPort, cap int) []netip.AddrPo
 		}
 		// len may be zero when realips is "," or ""
 		if len(v) > 0 {
-			ip, err := netip.ParseAddr(v)
+			// realips may be 4in6; dial them as ip4 so that
+			// dialers on ip4-only networks do not skip them
+			ip, err := core.ParseAddr(v)
 			if err == nil && ip.IsValid() && !ip.IsUnspecified() {
 				r = append(r, netip.AddrPortFrom(ip, origipp.Port()))
 			}
@@ -187,8 +268,12 @@ func makeIPPorts(realips string, origipp netip.AddrPort, cap int) []netip.AddrPo
 	return []netip.AddrPort{origipp}
 }
 
-func undoAlg(r dnsx.Resolver, algip netip.Addr) (realips, domains, probableDomains, blocklists string) {
+// undoAlg returns realips, domains, probable domains, and blocklists (with
+// categories of domains, as cached, like "cat:gambling") for algip; and meta,
+// a csv of tags about the destination, like "alpn:h3,alpn:h2,exit:wg1,route:wg1".
+func undoAlg(r dnsx.Resolver, algip netip.Addr) (realips, domains, probableDomains, blocklists, meta string) {
 	force := true // force PTR resolution
+	algip, _ = core.UnmapAddr(algip)
 	if gw := r.Gateway(); !algip.IsUnspecified() && algip.IsValid() && gw != nil {
 		dst := algip.AsSlice()
 		domains = gw.PTR(dst, !force)
@@ -197,12 +282,81 @@ func undoAlg(r dnsx.Resolver, algip netip.Addr) (realips, domains, probableDomai
 		}
 		realips = gw.X(dst)
 		blocklists = gw.RDNSBL(dst)
+		meta = tagsOf(alpnprefix, gw.ALPN(dst))
+		if exit := gw.Exit(dst); len(exit) > 0 {
+			meta = withTag(meta, exitprefix+exit)
+		}
+		// categories are looked up as flows start, for ones to come if
+		// not cached yet; routes set at resolution time win
+		cats, route := r.CategoriesOf(domains + "," + probableDomains)
+		if len(cats) > 0 {
+			blocklists = withTag(blocklists, tagsOf(catprefix, cats))
+		}
+		if pinned := gw.Route(dst); len(pinned) > 0 {
+			route = pinned
+		}
+		if len(route) > 0 {
+			meta = withTag(meta, routeprefix+route)
+		}
+		// alg ips shared by many domains (cdns) would otherwise make for
+		// flow callbacks too large to cross over to the client
+		realips = xdns.CapCsv(realips)
+		domains = xdns.CapCsv(domains)
+		probableDomains = xdns.CapCsv(probableDomains)
+		blocklists = xdns.CapCsv(blocklists)
 	} else {
 		log.W("alg: undoAlg: no gw(%t) or dst(%v) or alg-ip(%s)", gw == nil, algip, algip)
 	}
 	return
 }
 
+// routeOf returns the proxy tagged as the domain route in meta, if any,
+// in place of pid; see SocketListener.Flow for the order of precedence.
+func routeOf(prox ipn.Proxies, pid, meta string) string {
+	if pid == ipn.Block || pid == ipn.Defer {
+		return pid
+	}
+	route := ""
+	for _, tag := range strings.Split(meta, ",") {
+		if r, ok := strings.CutPrefix(tag, routeprefix); ok {
+			route = r
+			break
+		}
+	}
+	if len(route) <= 0 || route == pid {
+		return pid
+	}
+	if _, err := prox.ProxyFor(route); err != nil && !prox.KillSwitched(route) {
+		log.W("route: %s missing; flow stays with %s; err: %v", route, pid, err)
+		return pid
+	}
+	log.D("route: override %s => %s", pid, route)
+	return route
+}
+
+// withRoute returns a copy of res with its PID per routeOf, if it differs.
+func withRoute(prox ipn.Proxies, res *Mark, meta string) *Mark {
+	if res == nil {
+		return res
+	}
+	if pid := routeOf(prox, res.PID, meta); pid != res.PID {
+		return &Mark{PID: pid, CID: res.CID, UID: res.UID}
+	}
+	return res
+}
+
+// tagsOf prefixes each id (ex: alpn id, category) in csv with prefix.
+func tagsOf(prefix, csv string) string {
+	if len(csv) <= 0 {
+		return ""
+	}
+	ids := strings.Split(csv, ",")
+	for i, id := range ids {
+		ids[i] = prefix + id
+	}
+	return strings.Join(ids, ",")
+}
+
 // returns proxy-id, conn-id, user-id
 func splitCidPidUid(decision *Mark) (cid, pid, uid string) {
 	if decision == nil {
@@ -289,3 +443,15 @@ func pclose(c io.Closer, a string) {
 		x.Close()
 	}
 }
+
+// mtuOf returns the mtu of px, if it has one; or 0.
+func mtuOf(px ipn.Proxy) int {
+	if px == nil {
+		return 0
+	}
+	mtu, err := px.MTU()
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/netstack"
+	"github.com/celzero/firestack/intra/netstat"
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	link "gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// addrs of the app (client) and of its dst, as seen on the tun device
+var (
+	testClient = tcpip.AddrFrom4([4]byte{10, 111, 222, 1})
+	testServer = tcpip.AddrFrom4([4]byte{10, 111, 222, 3})
+)
+
+var errTestNoProxy = errors.New("test: no such proxy")
+
+// testResolver is a resolver with no alg, nat64, or dns addrs.
+type testResolver struct {
+	dnsx.Resolver // unused
+}
+
+func (*testResolver) Gateway() dnsx.Gateway              { return nil }
+func (*testResolver) StaleAlg(netip.Addr) (string, bool) { return "", false }
+func (*testResolver) ReclaimAlg(netip.Addr) error        { return nil }
+func (*testResolver) IsDnsAddr(string) bool              { return false }
+func (*testResolver) IsDivertedDnsAddr(string) bool      { return false }
+func (*testResolver) IsNat64(string, []byte) bool        { return false }
+func (*testResolver) S64(string, []byte) []byte          { return nil }
+func (*testResolver) X64(string, []byte) []byte          { return nil }
+func (*testResolver) CategoriesOf(string) (_, _ string)  { return }
+
+// testListener decides all flows as pid, and records their summaries.
+type testListener struct {
+	Listener // unused
+	pid      string
+	n        atomic.Int32        // cids handed out
+	smms     chan *SocketSummary // summaries of closed flows
+	doms     chan string         // domains of flows decided, if set
+	metas    chan string         // meta of flows decided, if set
+	pids     map[uint16]string   // dst port -> pid of its flows, if not pid
+}
+
+func newTestListener(pid string) *testListener {
+	return &testListener{pid: pid, smms: make(chan *SocketSummary, 64)}
+}
+
+func (l *testListener) Flow(_ int32, uid int, _, dst, _, domains, _, _, meta string) *Mark {
+	if l.doms != nil {
+		l.doms <- domains
+	}
+	if l.metas != nil {
+		l.metas <- meta
+	}
+	pid := l.pid
+	if ipp, err := netip.ParseAddrPort(dst); err == nil && l.pids != nil {
+		if p, ok := l.pids[ipp.Port()]; ok {
+			pid = p
+		}
+	}
+	return &Mark{PID: pid, CID: "t" + strconv.Itoa(int(l.n.Add(1))), UID: strconv.Itoa(uid)}
+}
+
+func (l *testListener) OnSocketClosed(s *SocketSummary) {
+	l.smms <- s
+}
+
+// summaries returns n summaries, or fails tb if they do not arrive in time;
+// summaries are sent a second after flows close (see: sendNotif).
+func (l *testListener) summaries(tb testing.TB, n int) []*SocketSummary {
+	tb.Helper()
+	out := make([]*SocketSummary, 0, n)
+	timeout := time.After(10 * time.Second)
+	for len(out) < n {
+		select {
+		case s := <-l.smms:
+			out = append(out, s)
+		case <-timeout:
+			tb.Fatalf("summaries: got %d of %d", len(out), n)
+		}
+	}
+	return out
+}
+
+// testProxy dials out as-is (over the loopback, in tests), or to the addr
+// set in to for the network, if any; and tracks conns it dialed.
+type testProxy struct {
+	ipn.Proxy // unused
+	id        string
+	to        map[string]string // network -> addr all its dials go to
+	remotes   map[uint16]string // dst port -> remote addr its conns report, if set
+	dials     atomic.Int32
+
+	mu    sync.Mutex
+	conns []net.Conn // dialed
+	addrs []string   // dialed, as asked to
+}
+
+func (p *testProxy) ID() string        { return p.id }
+func (p *testProxy) MTU() (int, error) { return 1500, nil }
+func (p *testProxy) GetAddr() string   { return "" }
+func (p *testProxy) Dialer() *protect.RDial {
+	return &protect.RDial{Owner: p.id, Dialer: &net.Dialer{}}
+}
+
+func (p *testProxy) Dial(network, addr string) (protect.Conn, error) {
+	p.dials.Add(1)
+	p.mu.Lock()
+	p.addrs = append(p.addrs, addr)
+	p.mu.Unlock()
+	var remote net.Addr
+	if ipp, err := netip.ParseAddrPort(addr); err == nil && p.remotes != nil {
+		if ra, ok := p.remotes[ipp.Port()]; ok {
+			remote = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(ra))
+		}
+	}
+	if to, ok := p.to[network]; ok {
+		addr = to
+	}
+	c, err := net.Dial(network, addr)
+	if err == nil && remote != nil {
+		switch x := c.(type) {
+		case *net.TCPConn:
+			c = &remoteTCPConn{x, remote}
+		case *net.UDPConn:
+			c = &remoteUDPConn{x, remote}
+		}
+	}
+	if err == nil {
+		p.mu.Lock()
+		p.conns = append(p.conns, c)
+		p.mu.Unlock()
+	}
+	return c, err
+}
+
+func (p *testProxy) Announce(network, local string) (protect.PacketConn, error) {
+	p.dials.Add(1)
+	return net.ListenPacket(network, "127.0.0.1:0")
+}
+
+// dialed returns addrs p was asked to dial, in order.
+func (p *testProxy) dialed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.addrs...)
+}
+
+// open returns the number of conns p dialed that are yet to be closed.
+func (p *testProxy) open() (n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		if _, err := c.Write(nil); !errors.Is(err, net.ErrClosed) {
+			n++
+		}
+	}
+	return
+}
+
+// remoteTCPConn and remoteUDPConn report addr as their remote; ex: to pass
+// off conns over the loopback as those of a family, see: core.Unrouted
+type remoteTCPConn struct {
+	*net.TCPConn
+	addr net.Addr
+}
+
+type remoteUDPConn struct {
+	*net.UDPConn
+	addr net.Addr
+}
+
+func (c *remoteTCPConn) RemoteAddr() net.Addr { return c.addr }
+func (c *remoteUDPConn) RemoteAddr() net.Addr { return c.addr }
+
+// testProxies has just the one proxy, and others, if set.
+type testProxies struct {
+	ipn.Proxies // unused
+	px          *testProxy
+	others      map[string]*testProxy // id -> proxy
+}
+
+func (p *testProxies) ProxyFor(id string) (ipn.Proxy, error) {
+	if id == p.px.id {
+		return p.px, nil
+	}
+	if px, ok := p.others[id]; ok {
+		return px, nil
+	}
+	return nil, errTestNoProxy
+}
+
+func (*testProxies) KillSwitched(string) bool { return false }
+
+// testTunnel is the handlers of a tunnel, all deciding flows as pid.
+type testTunnel struct {
+	l     *testListener
+	px    *testProxy
+	conns core.ConnMapper
+	tcp   *tcpHandler
+	udp   *udpHandler
+	icmp  *icmpHandler
+}
+
+func newTestTunnel(pid string) *testTunnel {
+	return newTestTunnelWith(pid, &testResolver{})
+}
+
+// newTestTunnelWith is newTestTunnel with resolver r.
+func newTestTunnelWith(pid string, r dnsx.Resolver) *testTunnel {
+	return newTestTunnelOn(pid, r, core.RealClock)
+}
+
+// newTestTunnelOn is newTestTunnelWith, whose flows are tracked, and whose
+// udp flows expire, stall, and dedup, as told by clock.
+func newTestTunnelOn(pid string, r dnsx.Resolver, clock core.Clock) *testTunnel {
+	l := newTestListener(pid)
+	px := &testProxy{id: pid}
+	prox := &testProxies{px: px}
+	mode := settings.NewTunMode(settings.DNSModeIP, settings.BlockModeFilter, settings.PtModeNo46)
+	hold := newParking()
+	bypass := newDNSBypass()
+	hairpin := newHairpin()
+	pxdns := newPxDNS()
+	sticky := newSticky()
+	breaker := newBreaker()
+	retries := newRetries()
+	fair := core.NewFair()
+	capture := newCapture()
+	metered := newMetered()
+	procs := netstat.NewProcNet(netstat.DefaultStaleness)
+	conns := core.NewConnMapWithClock(clock)
+	tcph := NewTCPHandler(r, prox, mode, hold, bypass, hairpin, pxdns, sticky, breaker, retries, fair, newCertObs(l), capture, metered, procs, conns, nil, l)
+	udph := NewUDPHandler(r, prox, mode, hold, bypass, hairpin, pxdns, sticky, breaker, retries, fair, capture, metered, procs, conns, nil, l)
+	icmph := NewICMPHandler(r, prox, mode, procs, conns, l)
+	udp := udph.(*udpHandler)
+	udp.clock = clock
+	udp.fwtracker = core.NewExpiringMapWithClock(clock)
+	udp.dups = core.NewDupFilter(dupwindow, clock)
+	return &testTunnel{
+		l:     l,
+		px:    px,
+		conns: conns,
+		tcp:   tcph.(*tcpHandler),
+		udp:   udp,
+		icmp:  icmph.(*icmpHandler),
+	}
+}
+
+// up links t to a client stack (at testClient) as if over a tun device,
+// whose netstack is routed for l3 (settings.IP4, IP6, IP46) only.
+func (t *testTunnel) up(tb testing.TB, l3 string) (client *stack.Stack) {
+	tb.Helper()
+	cep, sep := link.New("", "", 1500)
+
+	s := netstack.NewNetstack()
+	if err := netstack.Up(s, sep, netstack.NewGConnHandler(t.tcp, t.udp, t.icmp)); err != nil {
+		tb.Fatal(err)
+	}
+	netstack.Route(s, l3)
+
+	client = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	if err := client.CreateNIC(1, cep); err != nil {
+		tb.Fatal(err)
+	}
+	addr := tcpip.ProtocolAddress{Protocol: ipv4.ProtocolNumber, AddressWithPrefix: testClient.WithPrefix()}
+	if err := client.AddProtocolAddress(1, addr, stack.AddressProperties{}); err != nil {
+		tb.Fatal(err)
+	}
+	client.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+	tb.Cleanup(func() {
+		client.Destroy()
+		s.Destroy()
+	})
+	return client
+}
+
+// fds returns the number of fds open in this process.
+func fds(tb testing.TB) int {
+	tb.Helper()
+	ents, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		tb.Skipf("fds: %v", err)
+	}
+	return len(ents)
+}
+
+// eventually polls ok till it is true, or fails tb with msg after d.
+func eventually(tb testing.TB, d time.Duration, ok func() bool, msg string, args ...any) {
+	tb.Helper()
+	for end := time.Now().Add(d); !ok(); {
+		if time.Now().After(end) {
+			tb.Fatalf(msg, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+var (
+	errConfigOpen   = errors.New("tun: config: another is open")
+	errConfigToken  = errors.New("tun: config: not open")
+	errNotStageable = errors.New("tun: config: resolver or proxies cannot stage")
+	errNotStaged    = errors.New("tun: config: resolver or proxies not staging")
+)
+
+// txconfig is a config of a Tunnel staged since BeginConfig; see: Tunnel.
+type txconfig struct {
+	sync.Mutex                 // protects all fields below
+	token      int64           // of the open config; 0 if none
+	last       int64           // last token handed out
+	mode       *[3]int         // dnsmode, blockmode, ptmode; if staged
+	engine     *int            // route; if staged
+	specs      []transportspec // of transports staged
+	version    atomic.Int64    // of the live config; see: ConfigVersion
+}
+
+func newTxConfig() *txconfig {
+	return &txconfig{}
+}
+
+// stage has f stage a change, and returns true, if a config is open.
+func (c *txconfig) stage(f func()) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.token == 0 {
+		return false
+	}
+	f()
+	return true
+}
+
+// stagers returns the resolver and proxies of t, if they can stage.
+func (t *rtunnel) stagers() (dnsx.Stager, ipn.Stager, error) {
+	r, rerr := t.internalResolver()
+	pxr, perr := t.internalProxies()
+	if rerr != nil || perr != nil {
+		return nil, nil, errors.Join(rerr, perr)
+	}
+	rs, ok1 := r.(dnsx.Stager)
+	ps, ok2 := pxr.(ipn.Stager)
+	if !ok1 || !ok2 {
+		return nil, nil, errNotStageable
+	}
+	return rs, ps, nil
+}
+
+func (t *rtunnel) BeginConfig() (int64, error) {
+	c := t.cfg
+	c.Lock()
+	defer c.Unlock()
+
+	if c.token != 0 {
+		return 0, errConfigOpen
+	}
+	rs, ps, err := t.stagers()
+	if err != nil {
+		return 0, err
+	}
+	if err := ps.Stage(); err != nil {
+		return 0, err
+	}
+	if err := rs.Stage(); err != nil {
+		ps.Discard()
+		return 0, err
+	}
+	c.last++
+	c.token = c.last
+	log.I("tun: config: #%d begin; v%d", c.token, c.version.Load())
+	return c.token, nil
+}
+
+func (t *rtunnel) CommitConfig(token int64) error {
+	c := t.cfg
+	c.Lock()
+	defer c.Unlock()
+
+	if token == 0 || c.token != token {
+		return fmt.Errorf("%w: #%d", errConfigToken, token)
+	}
+	mode, engine, specs := c.mode, c.engine, c.specs
+	c.reset()
+
+	// the resolver and proxies apply their staged changes at once, which
+	// are not undone; and so, they are committed last, once the rest is
+	rs, ps, err := t.stagers()
+	if err == nil && (!rs.Staging() || !ps.Staging()) {
+		err = errNotStaged
+	}
+	if err != nil { // closed since
+		t.discardStaged()
+		log.W("tun: config: #%d commit; nothing applied; err: %v", token, err)
+		return err
+	}
+
+	var undo []func() // of changes applied, in order
+	rollback := func(err error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		t.discardStaged()
+		log.W("tun: config: #%d commit; rolled back %d; err: %v", token, len(undo), err)
+		return err
+	}
+
+	if mode != nil {
+		m := t.tunmode
+		prev := [3]int{m.DNSMode, m.BlockMode, m.PtMode}
+		m.SetMode(mode[0], mode[1], mode[2])
+		undo = append(undo, func() { m.SetMode(prev[0], prev[1], prev[2]) })
+	}
+	undo = append(undo, t.specs.swap(specs...))
+	if engine != nil {
+		prev, _ := t.l3.Load().(string)
+		if err := t.setRoute(*engine); err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func() {
+			if len(prev) <= 0 { // never routed
+				return
+			}
+			if err := t.setRoute(engineOf(prev)); err != nil {
+				log.E("tun: config: #%d rollback: route %s; err: %v", token, prev, err)
+			}
+		})
+	}
+	// proxies before transports, which may be dialed over them; neither
+	// errs, as both are staging (see: Staging), and c is locked
+	if err := ps.Commit(); err != nil {
+		return rollback(err)
+	}
+	if err := rs.Commit(); err != nil {
+		return rollback(err) // proxies committed stay
+	}
+	v := c.version.Add(1)
+	log.I("tun: config: #%d commit; v%d; mode? %t, route? %t, transports %d",
+		token, v, mode != nil, engine != nil, len(specs))
+	return nil
+}
+
+func (t *rtunnel) AbortConfig(token int64) error {
+	c := t.cfg
+	c.Lock()
+	defer c.Unlock()
+
+	if token == 0 || c.token != token {
+		return fmt.Errorf("%w: #%d", errConfigToken, token)
+	}
+	c.reset()
+	t.discardStaged()
+	log.I("tun: config: #%d abort", token)
+	return nil
+}
+
+func (t *rtunnel) ConfigVersion() int64 {
+	return t.cfg.version.Load()
+}
+
+// discardConfig aborts the open config, if any.
+func (t *rtunnel) discardConfig() {
+	c := t.cfg
+	c.Lock()
+	defer c.Unlock()
+	if c.token != 0 {
+		log.I("tun: config: #%d discard", c.token)
+		c.reset()
+		t.discardStaged()
+	}
+}
+
+// discardStaged discards changes staged by the resolver and proxies.
+func (t *rtunnel) discardStaged() {
+	if rs, ps, err := t.stagers(); err == nil {
+		rs.Discard()
+		ps.Discard()
+	}
+}
+
+// engineOf returns the engine that routes l3; see: settings.L3
+func engineOf(l3 string) int {
+	switch l3 {
+	case settings.IP46:
+		return settings.Ns46
+	case settings.IP6:
+		return settings.Ns6
+	default:
+		return settings.Ns4
+	}
+}
+
+// reset closes the open config, if any; must be called with c locked.
+func (c *txconfig) reset() {
+	c.token = 0
+	c.mode = nil
+	c.engine = nil
+	c.specs = nil
+}
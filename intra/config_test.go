@@ -0,0 +1,161 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/tunnel"
+)
+
+var errTestRoute = errors.New("test: route failed")
+
+// testStage records how staged changes end.
+type testStage struct {
+	staging   bool
+	committed int
+	discarded int
+}
+
+func (s *testStage) Stage() error {
+	s.staging = true
+	return nil
+}
+
+func (s *testStage) Commit() error {
+	s.staging = false
+	s.committed++
+	return nil
+}
+
+func (s *testStage) Discard() {
+	if s.staging {
+		s.discarded++
+	}
+	s.staging = false
+}
+
+func (s *testStage) Staging() bool { return s.staging }
+
+// stageResolver is a testResolver that stages.
+type stageResolver struct {
+	testResolver
+	testStage
+}
+
+// stageProxies are proxies that stage.
+type stageProxies struct {
+	ipn.Proxies // unused
+	testStage
+}
+
+// routeTunnel is a tunnel.Tunnel whose routes fail to set, if fail.
+type routeTunnel struct {
+	tunnel.Tunnel // unused
+	fail          bool
+	routes        []int // set
+}
+
+func (t *routeTunnel) SetRoute(engine int) error {
+	if t.fail {
+		return errTestRoute
+	}
+	t.routes = append(t.routes, engine)
+	return nil
+}
+
+func TestCommitConfigRollback(t *testing.T) {
+	gt := &routeTunnel{}
+	r := &stageResolver{}
+	pxr := &stageProxies{}
+	tun := &rtunnel{
+		Tunnel:   gt,
+		tunmode:  settings.NewTunMode(settings.DNSModeIP, settings.BlockModeFilter, settings.PtModeNo46),
+		proxies:  pxr,
+		resolver: r,
+		specs:    newTunSpecs(),
+		cfg:      newTxConfig(),
+	}
+	tun.l3.Store(settings.IP4)
+	s0 := transportspec{Kind: specDoH, ID: "d0", Args: []string{"https://a.test/dns-query"}}
+	tun.specs.put(s0)
+
+	stage := func() int64 {
+		token, err := tun.BeginConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tun.SetTunMode(settings.DNSModePort, settings.BlockModeNone, settings.PtModeAuto)
+		if err := tun.SetRoute(settings.Ns6); err != nil {
+			t.Fatal(err)
+		}
+		tun.remember(transportspec{Kind: specDoH, ID: "d0", Args: []string{"https://b.test/dns-query"}})
+		tun.remember(transportspec{Kind: specDNS53, ID: "d1", Args: []string{"192.0.2.53", "53"}})
+		return token
+	}
+
+	// staged changes are not live
+	token := stage()
+	if m := tun.tunmode; m.DNSMode != settings.DNSModeIP || m.BlockMode != settings.BlockModeFilter {
+		t.Errorf("config: mode %v applied before commit", *m)
+	}
+	if len(gt.routes) != 0 {
+		t.Errorf("config: routes %v set before commit", gt.routes)
+	}
+
+	// a step that fails undoes the rest
+	gt.fail = true
+	if err := tun.CommitConfig(token); !errors.Is(err, errTestRoute) {
+		t.Fatalf("config: commit: want %v, got %v", errTestRoute, err)
+	}
+	if m := tun.tunmode; m.DNSMode != settings.DNSModeIP || m.BlockMode != settings.BlockModeFilter || m.PtMode != settings.PtModeNo46 {
+		t.Errorf("config: mode %v not rolled back", *m)
+	}
+	if got := tun.specs.all(); !slices.EqualFunc(got, []transportspec{s0}, transportspec.equal) {
+		t.Errorf("config: transports %v not rolled back; want %v", got, s0)
+	}
+	if l3, _ := tun.l3.Load().(string); l3 != settings.IP4 {
+		t.Errorf("config: route %s; want %s", l3, settings.IP4)
+	}
+	for what, s := range map[string]*testStage{"resolver": &r.testStage, "proxies": &pxr.testStage} {
+		if s.committed != 0 || s.discarded != 1 || s.staging {
+			t.Errorf("config: %s: committed %d, discarded %d; staging? %t", what, s.committed, s.discarded, s.staging)
+		}
+	}
+	if v := tun.ConfigVersion(); v != 0 {
+		t.Errorf("config: v%d after a failed commit", v)
+	}
+	if err := tun.CommitConfig(token); !errors.Is(err, errConfigToken) {
+		t.Errorf("config: #%d open after a failed commit; err: %v", token, err)
+	}
+
+	// and once it does not, all of it applies
+	gt.fail = false
+	token = stage()
+	if err := tun.CommitConfig(token); err != nil {
+		t.Fatal(err)
+	}
+	if m := tun.tunmode; m.DNSMode != settings.DNSModePort || m.BlockMode != settings.BlockModeNone || m.PtMode != settings.PtModeAuto {
+		t.Errorf("config: mode %v not applied", *m)
+	}
+	if len(tun.specs.all()) != 2 {
+		t.Errorf("config: transports %v not applied", tun.specs.all())
+	}
+	if l3, _ := tun.l3.Load().(string); l3 != settings.IP6 || !slices.Equal(gt.routes, []int{settings.Ns6}) {
+		t.Errorf("config: route %s (%v); want %s", l3, gt.routes, settings.IP6)
+	}
+	if r.committed != 1 || pxr.committed != 1 {
+		t.Errorf("config: committed resolver %d, proxies %d; want 1", r.committed, pxr.committed)
+	}
+	if v := tun.ConfigVersion(); v != 1 {
+		t.Errorf("config: v%d; want v1", v)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and schedules on it; RealClock is the wall clock,
+// FakeClock moves only when told to, so that expiries are testable.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// After returns a chan that is sent the time once d elapses.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine once d elapses.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call of Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the call, and returns false if it was already
+	// called or stopped.
+	Stop() bool
+}
+
+// RealClock is the wall clock, as told by package time.
+var RealClock Clock = realclock{}
+
+type realclock struct{}
+
+var _ Clock = realclock{}
+
+func (realclock) Now() time.Time                         { return time.Now() }
+func (realclock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realclock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realclock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// FakeClock is a Clock that stays put till Advance'd; its chans due by
+// then are sent to, and its funcs started, in the order of their deadlines.
+type FakeClock struct {
+	sync.Mutex              // protects now, waiters
+	now        time.Time    // current time
+	waiters    []*fakewaker // pending; in no particular order
+}
+
+type fakewaker struct {
+	c    *FakeClock
+	at   time.Time      // deadline
+	ch   chan time.Time // for After; nil for AfterFunc
+	f    func()         // for AfterFunc; nil for After
+	done bool           // fired or stopped; guarded by c
+}
+
+var _ Clock = (*FakeClock)(nil)
+var _ Timer = (*fakewaker)(nil)
+
+// NewFakeClock returns a FakeClock that starts at t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now implements Clock.
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Since implements Clock.
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// After implements Clock.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	w := &fakewaker{c: c, ch: make(chan time.Time, 1)}
+	c.add(w, d)
+	return w.ch
+}
+
+// AfterFunc implements Clock.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	w := &fakewaker{c: c, f: f}
+	c.add(w, d)
+	return w
+}
+
+func (c *FakeClock) add(w *fakewaker, d time.Duration) {
+	c.Lock()
+	w.at = c.now.Add(d)
+	due := d <= 0
+	if !due {
+		c.waiters = append(c.waiters, w)
+	} else {
+		w.done = true
+	}
+	now := c.now
+	c.Unlock()
+	if due {
+		w.fire(now)
+	}
+}
+
+// Advance moves the clock forward by d, and fires all that are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakewaker
+	c.waiters = slices.DeleteFunc(c.waiters, func(w *fakewaker) bool {
+		if w.done {
+			return true
+		}
+		if !w.at.After(now) {
+			w.done = true
+			due = append(due, w)
+			return true
+		}
+		return false
+	})
+	c.Unlock()
+
+	slices.SortStableFunc(due, func(a, b *fakewaker) int {
+		return a.at.Compare(b.at)
+	})
+	for _, w := range due {
+		w.fire(now)
+	}
+}
+
+// Pending returns the number of chans and funcs yet to fire.
+func (c *FakeClock) Pending() (n int) {
+	c.Lock()
+	defer c.Unlock()
+	for _, w := range c.waiters {
+		if !w.done {
+			n++
+		}
+	}
+	return
+}
+
+func (w *fakewaker) fire(now time.Time) {
+	if w.ch != nil {
+		w.ch <- now // buffered
+	}
+	if w.f != nil {
+		go w.f()
+	}
+}
+
+// Stop implements Timer.
+func (w *fakewaker) Stop() bool {
+	w.c.Lock()
+	defer w.c.Unlock()
+	if w.done {
+		return false
+	}
+	w.done = true
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeClock(t *testing.T) {
+	c := NewFakeClock(epoch)
+	late := c.After(2 * time.Second)
+	early := c.After(time.Second)
+	fired := make(chan string, 2)
+	c.AfterFunc(time.Second, func() { fired <- "f" })
+	stopped := c.AfterFunc(time.Second, func() { fired <- "stopped" })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("clock: stop: want true, then false")
+	}
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-early:
+		t.Fatal("clock: fired early")
+	default:
+	}
+	if n := c.Pending(); n != 3 {
+		t.Errorf("clock: pending: want 3, got %d", n)
+	}
+
+	c.Advance(time.Millisecond)
+	if at := <-early; !at.Equal(epoch.Add(time.Second)) {
+		t.Errorf("clock: early: fired at %s", at)
+	}
+	if f := <-fired; f != "f" {
+		t.Errorf("clock: want f, got %s", f)
+	}
+	select {
+	case <-late:
+		t.Fatal("clock: late fired early")
+	case f := <-fired:
+		t.Fatalf("clock: %s fired", f)
+	default:
+	}
+
+	c.Advance(time.Hour)
+	<-late
+	if d := c.Since(epoch); d != time.Hour+time.Second {
+		t.Errorf("clock: since: got %s", d)
+	}
+	if n := c.Pending(); n != 0 {
+		t.Errorf("clock: pending: want 0, got %d", n)
+	}
+}
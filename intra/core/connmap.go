@@ -8,35 +8,234 @@ package core
 
 import (
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// purged uids are remembered for this long, so that flows admitted
+// before the purge but tracked after it are closed, too.
+const purgewindow = 2 * time.Minute
+
+// ids active in the last auditgrace are not audited, as their
+// close paths may yet be running; see: ConnMapper.Audit
+const auditgrace = 30 * time.Second
+
+// max reasons remembered of reaped ids; see: ConnMapper.Reason
+const maxreasons = 1024
+
 type ConnMapper interface {
 	Clear() []string
+	Len() int
 	Track(id string, x ...net.Conn) int
+	// TrackUid tracks conns x owned by uid that started at since; x are
+	// closed and not tracked (returns 0) if uid was purged after since.
+	TrackUid(uid string, since time.Time, id string, x ...net.Conn) int
+	// TrackTuple is TrackUid for t.Uid, which also tags id with t; see: Find.
+	TrackTuple(t ConnTuple, since time.Time, id string, x ...net.Conn) int
+	// UntrackUid closes and untracks all conns owned by uid, and
+	// returns their ids.
+	UntrackUid(uid string) []string
 	Untrack(id string) int
 	UntrackBatch(ids []string) []string
+	UntrackIdle(d time.Duration, n int) []string
+	// Stamp returns the last activity time of id, for its copy loops to
+	// Touch; nil if id is not tracked.
+	Stamp(id string) *Activity
+	// Audit checks up to n tracked ids for leaks, and closes, untracks,
+	// and returns those that fail, with the tuples they were tagged with;
+	// why is then their Reason. See: cm.Audit
+	Audit(idle time.Duration, n int, why error) ([]string, []ConnTuple)
+	// Reap checks up to n tracked ids with dead, and closes, untracks, and
+	// returns those it is true for; why is then their Reason.
+	Reap(n int, why error, dead func(id string, x []net.Conn) bool) []string
+	// ReapUids closes and untracks all ids owned by uids that dead is true
+	// for, and returns them; why is then their Reason.
+	ReapUids(why error, dead func(uid string) bool) []string
+	// ReapAll is Reap, for all tracked ids at once.
+	ReapAll(why error, dead func(id string, x []net.Conn) bool) []string
+	// Reason returns why id was reaped, if it was, and forgets it.
+	Reason(id string) error
+	// Tuple returns the tuple id was tagged with, if it is tracked.
+	Tuple(id string) (ConnTuple, bool)
+	// Find returns ids of tracked conns whose tuples match m; see: ConnTuple.
+	Find(m ConnTuple) []string
+	// Proto returns a view of the same conns, scoped to those of proto (and
+	// to all, if empty), which tags the ids it tracks with proto; views are
+	// made once per proto, and so, may be kept.
+	Proto(proto string) ConnMapper
 }
 
-type cm struct {
+// ConnTuple tags tracked ids, so that conns of all flow handlers (which
+// track into views of one ConnMapper) may be queried together.
+type ConnTuple struct {
+	Proto string     // tcp, udp, or icmp; set by the view that tracked it
+	Uid   string     // owner, if any
+	Pid   string     // proxy the flow is over, if any
+	Dst   netip.Addr // destination of the flow, if known
+	Start time.Time  // when the flow started, if known; never matched
+}
+
+// matches returns true if t has all fields of m that are set.
+func (t ConnTuple) matches(m ConnTuple) bool {
+	return (len(m.Proto) <= 0 || t.Proto == m.Proto) &&
+		(len(m.Uid) <= 0 || t.Uid == m.Uid) &&
+		(len(m.Pid) <= 0 || t.Pid == m.Pid) &&
+		(!m.Dst.IsValid() || t.Dst == m.Dst)
+}
+
+// Idler is a net.Conn that knows how long it has been idle for.
+type Idler interface {
+	IdleFor() time.Duration
+}
+
+// Activity is the last activity time (unix nanos) of a tracked id, as told
+// by the clock of its ConnMapper; see: ConnMapper.Stamp
+type Activity struct {
+	atomic.Int64
+	clock Clock
+}
+
+// Touch stores now as the last activity time.
+func (a *Activity) Touch() {
+	a.Store(a.clock.Now().UnixNano())
+}
+
+// Liveness is a net.Conn that knows if it is still usable.
+type Liveness interface {
+	Alive() bool
+}
+
+// conntrack holds conns of all views (of all protos); see: cm
+type conntrack struct {
 	sync.Mutex
 	conntracker map[string][]net.Conn
+	owners      map[string]string       // id -> uid
+	tuples      map[string]ConnTuple    // id -> proto, uid, dst
+	counts      map[string]int          // proto -> ids tracked
+	purged      map[ConnTuple]time.Time // proto, uid -> purged at
+	stamps      map[string]*Activity    // id -> last active at
+	reasons     map[string]reason       // id -> why it was reaped
+	views       map[string]*cm          // proto -> view
+	clock       Clock                   // for stamps, purges, audits
+}
+
+type reason struct {
+	proto string // of the view that reaped it; empty if all
+	err   error
+}
+
+// sees returns true if r is of an id reaped by this view, or by one of all.
+func (h *cm) sees(r reason) bool {
+	return len(h.proto) <= 0 || len(r.proto) <= 0 || r.proto == h.proto
+}
+
+// cm is a view of conntrack, scoped to conns of proto, or to all if empty.
+type cm struct {
+	*conntrack
+	proto  string   // tcp, udp, icmp; or empty for all
+	audits []string // ids yet to be audited this round
+	reaps  []string // ids yet to be checked by Reap this round
 }
 
 var _ ConnMapper = (*cm)(nil)
 
 func NewConnMap() *cm {
-	return &cm{
+	return NewConnMapWithClock(RealClock)
+}
+
+// NewConnMapWithClock returns a ConnMapper that stamps and audits
+// conns as told by c.
+func NewConnMapWithClock(c Clock) *cm {
+	t := &conntrack{
 		conntracker: make(map[string][]net.Conn),
+		owners:      make(map[string]string),
+		tuples:      make(map[string]ConnTuple),
+		counts:      make(map[string]int),
+		purged:      make(map[ConnTuple]time.Time),
+		stamps:      make(map[string]*Activity),
+		reasons:     make(map[string]reason),
+		views:       make(map[string]*cm),
+		clock:       c,
+	}
+	h := &cm{conntrack: t}
+	t.views[""] = h
+	return h
+}
+
+func (h *cm) Proto(proto string) ConnMapper {
+	h.Lock()
+	defer h.Unlock()
+
+	v, ok := h.views[proto]
+	if !ok {
+		v = &cm{conntrack: h.conntrack, proto: proto}
+		h.views[proto] = v
+	}
+	return v
+}
+
+// mine returns true if id is tracked by (and so, visible to) this view;
+// must be called locked.
+func (h *cm) mine(id string) bool {
+	if _, ok := h.conntracker[id]; !ok {
+		return false
 	}
+	return len(h.proto) <= 0 || h.tuples[id].Proto == h.proto
 }
 
 func (h *cm) Track(cid string, conns ...net.Conn) (n int) {
 	h.Lock()
 	defer h.Unlock()
 
+	return h.track(ConnTuple{}, false, cid, conns)
+}
+
+func (h *cm) TrackUid(uid string, since time.Time, cid string, conns ...net.Conn) (n int) {
+	return h.TrackTuple(ConnTuple{Uid: uid}, since, cid, conns...)
+}
+
+func (h *cm) TrackTuple(t ConnTuple, since time.Time, cid string, conns ...net.Conn) (n int) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.purgedSince(t.Uid, since) {
+		for _, c := range conns {
+			if c != nil {
+				go c.Close()
+			}
+		}
+		return 0
+	}
+	return h.track(t, true, cid, conns)
+}
+
+// purgedSince returns true if uid was purged from this view (or from all)
+// at or after since; must be called locked.
+func (h *cm) purgedSince(uid string, since time.Time) bool {
+	for _, k := range []ConnTuple{{Proto: h.proto, Uid: uid}, {Uid: uid}} {
+		if at, ok := h.purged[k]; ok && !since.After(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// track tracks conns as id, tagged with t (and owned by t.Uid, if owned);
+// must be called locked.
+func (h *cm) track(t ConnTuple, owned bool, cid string, conns []net.Conn) (n int) {
+	if len(h.proto) > 0 {
+		t.Proto = h.proto
+	}
+	if owned {
+		h.owners[cid] = t.Uid
+	}
+	h.stamp(cid)
 	if v, ok := h.conntracker[cid]; !ok {
 		h.conntracker[cid] = conns
+		h.tuples[cid] = t
+		h.counts[t.Proto]++
 		n = len(conns)
 	} else { // should not happen?
 		h.conntracker[cid] = append(v, conns...)
@@ -45,32 +244,73 @@ func (h *cm) Track(cid string, conns ...net.Conn) (n int) {
 	return
 }
 
-func (h *cm) Untrack(cid string) (n int) {
-	h.Lock()
-	defer h.Unlock()
-
-	for _, c := range h.conntracker[cid] {
+// drop closes and untracks id, and returns the no. of conns closed;
+// must be called locked.
+func (h *cm) drop(id string) (n int) {
+	v, ok := h.conntracker[id]
+	for _, c := range v {
 		if c != nil {
 			n++
 			go c.Close()
 		}
 	}
-	delete(h.conntracker, cid)
+	if ok {
+		p := h.tuples[id].Proto
+		if h.counts[p]--; h.counts[p] <= 0 {
+			delete(h.counts, p)
+		}
+	}
+	delete(h.conntracker, id)
+	delete(h.owners, id)
+	delete(h.tuples, id)
+	delete(h.stamps, id)
 	return
 }
 
+func (h *cm) UntrackUid(uid string) (out []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	now := h.clock.Now()
+	for k, at := range h.purged {
+		if now.Sub(at) > purgewindow {
+			delete(h.purged, k)
+		}
+	}
+	h.purged[ConnTuple{Proto: h.proto, Uid: uid}] = now
+
+	out = make([]string, 0)
+	for id, u := range h.owners {
+		if u != uid || !h.mine(id) {
+			continue
+		}
+		h.drop(id)
+		out = append(out, id)
+	}
+	return
+}
+
+func (h *cm) Untrack(cid string) (n int) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.mine(cid) {
+		return 0
+	}
+	return h.drop(cid)
+}
+
+// UntrackBatch closes and untracks cids of this view; and returns all
+// cids, as conns of those not tracked (anymore) are closed, too.
 func (h *cm) UntrackBatch(cids []string) (out []string) {
 	h.Lock()
 	defer h.Unlock()
 
 	out = make([]string, 0, len(cids))
 	for _, id := range cids {
-		for _, c := range h.conntracker[id] {
-			if c != nil {
-				go c.Close()
-			}
+		if h.mine(id) {
+			h.drop(id)
 		}
-		delete(h.conntracker, id)
 		out = append(out, id)
 	}
 	return
@@ -80,15 +320,252 @@ func (h *cm) Clear() (ids []string) {
 	h.Lock()
 	defer h.Unlock()
 
-	ids = make([]string, 0, len(h.conntracker))
-	for k, v := range h.conntracker {
-		for _, c := range v {
-			if c != nil {
-				go c.Close()
+	ids = make([]string, 0, h.len())
+	for id := range h.conntracker {
+		if h.mine(id) {
+			h.drop(id)
+			ids = append(ids, id)
+		}
+	}
+	for id, r := range h.reasons {
+		if len(h.proto) <= 0 || r.proto == h.proto {
+			delete(h.reasons, id)
+		}
+	}
+	h.audits = nil
+	h.reaps = nil
+	return
+}
+
+func (h *cm) Len() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.len()
+}
+
+// len returns the no. of ids of this view; must be called locked.
+func (h *cm) len() int {
+	if len(h.proto) <= 0 {
+		return len(h.conntracker)
+	}
+	return h.counts[h.proto]
+}
+
+func (h *cm) Tuple(id string) (ConnTuple, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.mine(id) {
+		return ConnTuple{}, false
+	}
+	return h.tuples[id], true
+}
+
+func (h *cm) Find(m ConnTuple) (out []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	out = make([]string, 0)
+	for id, t := range h.tuples {
+		if h.mine(id) && t.matches(m) {
+			out = append(out, id)
+		}
+	}
+	return
+}
+
+// UntrackIdle closes and untracks up to n conns (if n > 0) that have been
+// idle for at least d, and returns their ids. Conns that are not Idlers
+// are never considered idle.
+func (h *cm) UntrackIdle(d time.Duration, n int) (out []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	out = make([]string, 0)
+	for id, v := range h.conntracker {
+		if n > 0 && len(out) >= n {
+			break
+		}
+		if !h.mine(id) || !idle(d, v) {
+			continue
+		}
+		h.drop(id)
+		out = append(out, id)
+	}
+	return
+}
+
+// idle returns true if at least one conn in v is an Idler,
+// and all such Idlers have been idle for at least d.
+func idle(d time.Duration, v []net.Conn) (ok bool) {
+	for _, c := range v {
+		if x, isidler := c.(Idler); isidler {
+			if x.IdleFor() < d {
+				return false
 			}
+			ok = true
 		}
-		ids = append(ids, k)
 	}
-	clear(h.conntracker)
 	return
 }
+
+// stamp sets the last activity time of id to now; must be called locked.
+func (h *cm) stamp(id string) {
+	t, ok := h.stamps[id]
+	if !ok {
+		t = &Activity{clock: h.clock}
+		h.stamps[id] = t
+	}
+	t.Touch()
+}
+
+func (h *cm) Stamp(id string) *Activity {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.mine(id) {
+		return nil
+	}
+	return h.stamps[id]
+}
+
+// Audit checks up to n (if n > 0) tracked ids for leaks, and closes,
+// untracks, and returns those that fail: ids without conns, or with a
+// Liveness conn that is not Alive, or (if idle > 0) that saw no activity
+// for idle. Ids are checked in turns across calls, so that no call holds
+// the lock for more than n ids; ids active in the last auditgrace are
+// skipped, as their close paths may yet be running. tuples[i] is the tuple
+// ids[i] was tagged with; and why is remembered as their Reason.
+func (h *cm) Audit(idle time.Duration, n int, why error) (ids []string, tuples []ConnTuple) {
+	h.Lock()
+	defer h.Unlock()
+
+	now := h.clock.Now()
+	ids = h.sweep(&h.audits, n, func(id string, v []net.Conn) bool {
+		var since time.Duration
+		if t, ok := h.stamps[id]; ok {
+			since = now.Sub(time.Unix(0, t.Load()))
+		}
+		if since < auditgrace || !leaked(idle, since, v) {
+			return false
+		}
+		tuples = append(tuples, h.tuples[id]) // before it is dropped
+		return true
+	})
+	h.because(why, ids)
+	return
+}
+
+// Reap checks up to n (if n > 0) tracked ids with dead, and closes, untracks,
+// and returns those it is true for; why is remembered as their Reason. Like
+// Audit, ids are checked in turns across calls; dead is called locked.
+func (h *cm) Reap(n int, why error, dead func(id string, v []net.Conn) bool) (out []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	out = h.sweep(&h.reaps, n, dead)
+	h.because(why, out)
+	return
+}
+
+// ReapUids is Reap, for all ids (at once) of owners that dead is true for;
+// ids tracked sans an owner are left as-is. dead is called locked.
+func (h *cm) ReapUids(why error, dead func(uid string) bool) (out []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	var q []string // all ids, in one pass
+	out = h.sweep(&q, 0, func(id string, _ []net.Conn) bool {
+		uid, ok := h.owners[id]
+		return ok && dead(uid)
+	})
+	h.because(why, out)
+	return
+}
+
+// ReapAll is Reap, for all tracked ids at once; dead is called locked.
+func (h *cm) ReapAll(why error, dead func(id string, v []net.Conn) bool) (out []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	var q []string // all ids, in one pass
+	out = h.sweep(&q, 0, dead)
+	h.because(why, out)
+	return
+}
+
+// because remembers why ids were reaped; must be called locked.
+func (h *cm) because(why error, ids []string) {
+	if len(h.reasons)+len(ids) > maxreasons { // ids whose close paths never ran
+		for id, r := range h.reasons {
+			if len(h.proto) <= 0 || r.proto == h.proto {
+				delete(h.reasons, id)
+			}
+		}
+	}
+	for _, id := range ids {
+		h.reasons[id] = reason{proto: h.proto, err: why}
+	}
+}
+
+func (h *cm) Reason(id string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	r, ok := h.reasons[id]
+	if !ok || !h.sees(r) {
+		return nil
+	}
+	delete(h.reasons, id)
+	return r.err
+}
+
+// sweep checks up to n (if n > 0) ids in q with dead, refilling q with all
+// ids of this view when empty; and closes, untracks, and returns those dead
+// is true for. Must be called locked.
+func (h *cm) sweep(q *[]string, n int, dead func(id string, v []net.Conn) bool) (out []string) {
+	if len(*q) <= 0 { // next round
+		*q = make([]string, 0, h.len())
+		for id := range h.conntracker {
+			if h.mine(id) {
+				*q = append(*q, id)
+			}
+		}
+	}
+	if n <= 0 || n > len(*q) {
+		n = len(*q)
+	}
+	ids := (*q)[:n]
+	*q = (*q)[n:]
+
+	out = make([]string, 0)
+	for _, id := range ids {
+		v := h.conntracker[id]
+		if !h.mine(id) || !dead(id, v) { // untracked since, or alive
+			continue
+		}
+		h.drop(id)
+		out = append(out, id)
+	}
+	return
+}
+
+// leaked returns true if v has no conns, or if any of its conns is not
+// Alive, or if idle > 0 and v was last active at least idle ago.
+func leaked(idle, since time.Duration, v []net.Conn) bool {
+	if idle > 0 && since >= idle {
+		return true
+	}
+	live := 0
+	for _, c := range v {
+		if c == nil {
+			continue
+		}
+		if x, ok := c.(Liveness); ok && !x.Alive() {
+			return true
+		}
+		live++
+	}
+	return live <= 0
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUntrackUid(t *testing.T) {
+	h := NewConnMap()
+	before := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, b := net.Pipe()
+			uid := "1000"
+			if i%2 == 0 {
+				uid = "10001"
+			}
+			h.TrackUid(uid, before, strconv.Itoa(i), a, b)
+		}(i)
+	}
+	// purge races with the goroutines above
+	purged := len(h.UntrackUid("1000"))
+	wg.Wait()
+
+	// flows of 1000 admitted before the purge must be closed or absent
+	if n := len(h.UntrackUid("1000")); purged+n > 500 {
+		t.Errorf("purged %d + %d; want at most 500", purged, n)
+	}
+	if n := h.TrackUid("1000", before, "late", nil); n != 0 {
+		t.Errorf("late flow tracked %d conns; want 0", n)
+	}
+	if n := h.TrackUid("1000", time.Now(), "new", nil); n != 1 {
+		t.Errorf("new flow tracked %d conns; want 1", n)
+	}
+	for _, id := range h.UntrackUid("1000") {
+		if id != "new" {
+			t.Errorf("unexpected id %s", id)
+		}
+	}
+	if n := h.Len(); n > 500 {
+		t.Errorf("len %d; want at most 500 (uid 10001)", n)
+	}
+}
+
+type liveconn struct {
+	net.Conn
+	alive bool
+}
+
+func (c *liveconn) Alive() bool { return c.alive }
+
+func TestAudit(t *testing.T) {
+	h := NewConnMap()
+	old := time.Now().Add(-time.Hour).UnixNano()
+	orphan := func(id string, conns ...net.Conn) {
+		h.Track(id, conns...)
+		h.Stamp(id).Store(old)
+	}
+
+	const leaks = 100
+	for i := 0; i < leaks; i++ {
+		a, _ := net.Pipe()
+		orphan("dead"+strconv.Itoa(i), &liveconn{a, false})
+	}
+	orphan("empty")
+	orphan("nil", nil)
+	a, b := net.Pipe()
+	orphan("idle", &liveconn{a, true}, b)
+	c, _ := net.Pipe()
+	h.Track("fresh", &liveconn{c, false}) // within auditgrace
+
+	// incremental: at most n per pass
+	reaped := make(map[string]bool)
+	for pass := 0; pass < 20; pass++ {
+		out, _ := h.Audit(0, 10, nil)
+		if len(out) > 10 {
+			t.Fatalf("pass %d: reaped %d; want at most 10", pass, len(out))
+		}
+		for _, id := range out {
+			reaped[id] = true
+		}
+	}
+	if len(reaped) != leaks+2 {
+		t.Errorf("reaped %d; want %d", len(reaped), leaks+2)
+	}
+	if reaped["idle"] || reaped["fresh"] {
+		t.Errorf("reaped live or fresh flows")
+	}
+	if n := h.Len(); n != 2 {
+		t.Errorf("len %d; want 2", n)
+	}
+
+	// idle flows are reaped only if idle is set
+	var out []string
+	for pass := 0; pass < 2; pass++ {
+		ids, _ := h.Audit(10*time.Minute, 10, nil)
+		out = append(out, ids...)
+	}
+	if len(out) != 1 || out[0] != "idle" {
+		t.Errorf("reaped %v; want [idle]", out)
+	}
+	if h.Stamp("idle") != nil {
+		t.Errorf("stamp of reaped flow not removed")
+	}
+
+	// leaks are returned as tagged, and remember why they were reaped
+	errLeak := errors.New("leak")
+	tup := ConnTuple{Uid: "10", Pid: "wg0", Dst: netip.MustParseAddr("192.0.2.1"), Start: time.Unix(1, 0)}
+	h.TrackTuple(tup, time.Now(), "tagged")
+	h.Stamp("tagged").Store(old)
+	ids, tuples := h.Audit(0, 0, errLeak)
+	if len(ids) != 1 || ids[0] != "tagged" || len(tuples) != 1 || tuples[0] != tup {
+		t.Errorf("audit: %v %+v; want [tagged] %+v", ids, tuples, tup)
+	}
+	if err := h.Reason("tagged"); err != errLeak {
+		t.Errorf("audit: reason %v; want %v", err, errLeak)
+	}
+}
+
+func TestReap(t *testing.T) {
+	h := NewConnMap()
+	for i := 0; i < 10; i++ {
+		a, b := net.Pipe()
+		h.Track(strconv.Itoa(i), a, b)
+	}
+	why := errors.New("dead")
+	odd := func(id string, _ []net.Conn) bool {
+		n, _ := strconv.Atoi(id)
+		return n%2 == 1
+	}
+
+	var out []string
+	for pass := 0; pass < 4; pass++ {
+		out = append(out, h.Reap(3, why, odd)...)
+	}
+	if len(out) != 5 {
+		t.Errorf("reaped %v; want 5 odd ids", out)
+	}
+	for _, id := range out {
+		if err := h.Reason(id); err != why {
+			t.Errorf("reason of %s = %v; want %v", id, err, why)
+		}
+		if err := h.Reason(id); err != nil {
+			t.Errorf("reason of %s not forgotten: %v", id, err)
+		}
+	}
+	if n := h.Len(); n != 5 {
+		t.Errorf("len %d; want 5", n)
+	}
+}
+
+func TestReapUids(t *testing.T) {
+	h := NewConnMap()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		a, b := net.Pipe()
+		h.TrackUid(strconv.Itoa(10000+i%3), now, strconv.Itoa(i), a, b)
+	}
+	h.Track("anon", nil)
+	why := errors.New("metered")
+	out := h.ReapUids(why, func(uid string) bool { return uid != "10000" })
+	if len(out) != 6 {
+		t.Errorf("reaped %v; want 6 ids of uids 10001, 10002", out)
+	}
+	for _, id := range out {
+		if n, _ := strconv.Atoi(id); n%3 == 0 {
+			t.Errorf("reaped %s of uid 10000", id)
+		}
+		if err := h.Reason(id); err != why {
+			t.Errorf("reason of %s = %v; want %v", id, err, why)
+		}
+	}
+	if n := h.Len(); n != 5 {
+		t.Errorf("len %d; want 5 (4 of uid 10000, and anon)", n)
+	}
+}
+
+// idleconn is idle since its last read or write, as told by clock.
+type idleconn struct {
+	net.Conn
+	clock Clock
+	last  time.Time
+}
+
+func (c *idleconn) IdleFor() time.Duration { return c.clock.Since(c.last) }
+
+func TestUntrackIdleClock(t *testing.T) {
+	c := NewFakeClock(epoch)
+	h := NewConnMapWithClock(c)
+	a, b := net.Pipe()
+	h.Track("quiet", &idleconn{a, c, c.Now()})
+	busy := &idleconn{b, c, c.Now()}
+	h.Track("busy", busy)
+
+	c.Advance(time.Minute)
+	if out := h.UntrackIdle(2*time.Minute, 0); len(out) != 0 {
+		t.Errorf("idle: untracked %v early", out)
+	}
+	busy.last = c.Now()
+	c.Advance(time.Minute)
+	out := h.UntrackIdle(2*time.Minute, 0)
+	if len(out) != 1 || out[0] != "quiet" {
+		t.Errorf("idle: untracked %v; want [quiet]", out)
+	}
+	// the closed conn ends the flow (and so, its summary is sent)
+	if _, err := b.Write([]byte{1}); err == nil {
+		t.Errorf("idle: peer of quiet conn still open")
+	}
+
+	// stamps, and so audits, go by the clock, too
+	c.Advance(time.Hour)
+	if out, _ := h.Audit(time.Hour, 0, nil); len(out) != 1 || out[0] != "busy" {
+		t.Errorf("idle: audit %v; want [busy]", out)
+	}
+}
+
+// sockconn is a socket to raddr.
+type sockconn struct {
+	net.Conn
+	raddr net.Addr
+}
+
+func (c *sockconn) RemoteAddr() net.Addr                  { return c.raddr }
+func (c *sockconn) SyscallConn() (syscall.RawConn, error) { return nil, syscall.EINVAL }
+
+// wrapconn wraps a conn, as the udp handler does its upstreams.
+type wrapconn struct {
+	net.Conn
+}
+
+func (c *wrapconn) Unwrap() net.Conn { return c.Conn }
+
+func TestReapAllUnrouted(t *testing.T) {
+	h := NewConnMap()
+	flow := func(id, raddr string) {
+		a, b := net.Pipe()
+		up, _ := net.ResolveTCPAddr("tcp", raddr)
+		h.Track(id, a, &sockconn{Conn: b, raddr: up})
+	}
+	for i := range 3 {
+		flow("v4-"+strconv.Itoa(i), "192.0.2.1:443")
+		flow("v6-"+strconv.Itoa(i), "[2001:db8::1]:443")
+	}
+	flow("lo6", "[::1]:443")
+	flow("mapped", "[::ffff:192.0.2.1]:443")
+	a, b := net.Pipe()
+	up, _ := net.ResolveUDPAddr("udp", "[2001:db8::1]:53")
+	h.Track("v6-wrapped", a, &wrapconn{&wrapconn{&sockconn{Conn: b, raddr: up}}})
+	a, _ = net.Pipe()
+	h.Track("userspace", a) // ex: over wireguard
+
+	why := errors.New("route-changed")
+	unrouted := func(use4, use6 bool) func(string, []net.Conn) bool {
+		return func(_ string, v []net.Conn) bool { return Unrouted(use4, use6, v...) }
+	}
+	if out := h.ReapAll(why, unrouted(true, true)); len(out) != 0 {
+		t.Errorf("dual-stack: reaped %v; want none", out)
+	}
+	out := h.ReapAll(why, unrouted(true, false)) // v4-only
+	if len(out) != 4 {
+		t.Errorf("v4-only: reaped %v; want 4 v6 ids", out)
+	}
+	for _, id := range out {
+		if !strings.HasPrefix(id, "v6-") {
+			t.Errorf("v4-only: reaped %s", id)
+		}
+		if err := h.Reason(id); err != why {
+			t.Errorf("reason of %s = %v; want %v", id, err, why)
+		}
+	}
+	out = h.ReapAll(why, unrouted(false, true)) // v6-only
+	if len(out) != 4 {
+		t.Errorf("v6-only: reaped %v; want 3 v4 ids, and mapped", out)
+	}
+	if n := h.Len(); n != 2 {
+		t.Errorf("len %d; want 2 (lo6, userspace)", n)
+	}
+}
+
+// closed returns true if the peer of c sees it closed.
+func closed(t *testing.T, peer net.Conn) bool {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestProtoViews(t *testing.T) {
+	all := NewConnMap()
+	tcp, udp, icmp := all.Proto("tcp"), all.Proto("udp"), all.Proto("icmp")
+	if all.Proto("tcp") != tcp {
+		t.Fatalf("views: tcp view made twice")
+	}
+
+	now := time.Now()
+	dst := netip.MustParseAddr("192.0.2.1")
+	peers := make(map[string]net.Conn)
+	flow := func(v ConnMapper, id, uid string, dst netip.Addr) {
+		a, b := net.Pipe()
+		peers[id] = b
+		if n := v.TrackTuple(ConnTuple{Uid: uid, Dst: dst}, now, id, a); n != 1 {
+			t.Fatalf("views: %s tracked %d", id, n)
+		}
+	}
+	flow(tcp, "t1", "10001", dst)
+	flow(tcp, "t2", "10002", netip.Addr{})
+	flow(udp, "u1", "10001", dst)
+	flow(udp, "u2", "10002", dst)
+	flow(icmp, "i1", "10001", dst)
+
+	if tcp.Len() != 2 || udp.Len() != 2 || icmp.Len() != 1 || all.Len() != 5 {
+		t.Errorf("views: len %d, %d, %d, all %d", tcp.Len(), udp.Len(), icmp.Len(), all.Len())
+	}
+	if tu, ok := all.Tuple("u1"); !ok || tu != (ConnTuple{Proto: "udp", Uid: "10001", Dst: dst}) {
+		t.Errorf("views: tuple of u1: %+v", tu)
+	}
+	if _, ok := tcp.Tuple("u1"); ok || tcp.Stamp("u1") != nil {
+		t.Errorf("views: tcp sees u1")
+	}
+
+	find := func(v ConnMapper, m ConnTuple) []string {
+		ids := v.Find(m)
+		slices.Sort(ids)
+		return ids
+	}
+	for _, tc := range []struct {
+		v    ConnMapper
+		m    ConnTuple
+		want []string
+	}{
+		{all, ConnTuple{Uid: "10001"}, []string{"i1", "t1", "u1"}},
+		{all, ConnTuple{Proto: "udp"}, []string{"u1", "u2"}},
+		{all, ConnTuple{Dst: dst}, []string{"i1", "t1", "u1", "u2"}},
+		{all, ConnTuple{Proto: "tcp", Dst: dst}, []string{"t1"}},
+		{udp, ConnTuple{Uid: "10001"}, []string{"u1"}},
+		{tcp, ConnTuple{Proto: "udp"}, []string{}},
+	} {
+		if got := find(tc.v, tc.m); !slices.Equal(got, tc.want) {
+			t.Errorf("views: find %+v: got %v; want %v", tc.m, got, tc.want)
+		}
+	}
+
+	// a view closes nothing of other views
+	if n := tcp.Untrack("u1"); n != 0 || all.Len() != 5 {
+		t.Errorf("views: tcp untracked u1: %d", n)
+	}
+	if out := tcp.UntrackUid("10001"); !slices.Equal(out, []string{"t1"}) || !closed(t, peers["t1"]) {
+		t.Errorf("views: tcp purged %v; want [t1]", out)
+	}
+	// purges are per view: udp still admits flows of 10001
+	if n := tcp.TrackUid("10001", now, "t3", nil); n != 0 {
+		t.Errorf("views: tcp admitted purged uid")
+	}
+	if n := udp.TrackUid("10001", now, "u3", nil); n != 1 {
+		t.Errorf("views: udp did not admit uid purged by tcp")
+	}
+
+	// reasons are per view
+	why := errors.New("reaped")
+	out := udp.ReapAll(why, func(id string, _ []net.Conn) bool { return id == "u2" })
+	if !slices.Equal(out, []string{"u2"}) || !closed(t, peers["u2"]) {
+		t.Errorf("views: udp reaped %v; want [u2]", out)
+	}
+	if tcp.Reason("u2") != nil || udp.Reason("u2") != why {
+		t.Errorf("views: reason of u2 not with udp")
+	}
+	// and those of reaps across all views are seen by each view
+	flow(icmp, "i2", "10003", dst)
+	if out := all.ReapAll(why, func(id string, _ []net.Conn) bool { return id == "i2" }); len(out) != 1 {
+		t.Errorf("views: all reaped %v; want [i2]", out)
+	}
+	if icmp.Reason("i2") != why {
+		t.Errorf("views: reason of i2 not seen by icmp")
+	}
+
+	// clears are per view
+	if out := udp.Clear(); len(out) != 2 || !closed(t, peers["u1"]) {
+		t.Errorf("views: udp cleared %v; want [u1 u3]", out)
+	}
+	if tcp.Len() != 1 || udp.Len() != 0 || icmp.Len() != 1 || all.Len() != 2 {
+		t.Errorf("views: after clear: len %d, %d, %d, all %d", tcp.Len(), udp.Len(), icmp.Len(), all.Len())
+	}
+	if out := icmp.UntrackBatch([]string{"i1", "t2"}); len(out) != 2 || !closed(t, peers["i1"]) {
+		t.Errorf("views: icmp batch %v", out)
+	}
+	if _, ok := all.Tuple("t2"); !ok || closed(t, peers["t2"]) {
+		t.Errorf("views: icmp closed tcp's t2")
+	}
+	if out := all.Clear(); !slices.Equal(out, []string{"t2"}) || all.Len() != 0 || tcp.Len() != 0 {
+		t.Errorf("views: all cleared %v", out)
+	}
+}
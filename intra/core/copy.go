@@ -0,0 +1,153 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// default bounds of buffers of Copy
+	copymin = B4096
+	copymax = BMAX
+	// reads that fill the buffer as many times in a row grow it
+	copygrowafter = 4
+)
+
+var errInvalidWrite = errors.New("copy: invalid write result")
+
+// bounds of buffers of Copy: min<<32 | max
+var copybounds atomic.Uint64
+
+func init() {
+	copybounds.Store(uint64(copymin)<<32 | uint64(copymax))
+}
+
+// SetCopyBufs bounds buffers of Copy to [min, max] bytes, each rounded down
+// to a size class of AllocRegion (2k to 64k); a min or max that is not
+// positive is reset to its default (4k, 64k). Low-ram devices may prefer
+// a lower max (ex: 16k), at some cost to throughput of bulk transfers.
+func SetCopyBufs(min, max int) {
+	if min <= 0 {
+		min = copymin
+	}
+	if max <= 0 {
+		max = copymax
+	}
+	min, max = sizeclass(min), sizeclass(max)
+	if max < min {
+		max = min
+	}
+	copybounds.Store(uint64(min)<<32 | uint64(max))
+}
+
+// CopyBufs returns the bounds of buffers of Copy; see: SetCopyBufs.
+func CopyBufs() (min, max int) {
+	b := copybounds.Load()
+	return int(b >> 32), int(b & 0xffffffff)
+}
+
+// sizeclass rounds sz down to a size class of AllocRegion, in [B2048, BMAX].
+func sizeclass(sz int) int {
+	c := B2048
+	for c < BMAX && c*2 <= sz {
+		c *= 2
+	}
+	return c
+}
+
+// Copy copies from src to dst till eof (which is not an error) or an error,
+// and returns the bytes copied. It prefers src.WriteTo(dst) or dst.ReadFrom(src),
+// but not of sockets, unless both ends are (when the kernel may splice them),
+// as sockets otherwise copy over fresh buffers of their own. Else, it copies
+// over buffers from the pool that start at the min of CopyBufs, double (up to
+// its max) once reads fill them copygrowafter times in a row, and halve once
+// reads fall to a quarter of them; and while src, if a socket, has nothing
+// to read, buffers larger than the min are given back, and so, flows that
+// idle after a burst hold none.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	_, srcsock := src.(syscall.Conn)
+	_, dstsock := dst.(syscall.Conn)
+	splice := srcsock && dstsock
+	if x, ok := src.(io.WriterTo); ok && (!srcsock || splice) {
+		return x.WriteTo(dst)
+	} else if x, ok := dst.(io.ReaderFrom); ok && (!dstsock || splice) {
+		return x.ReadFrom(src)
+	}
+
+	lo, hi := CopyBufs()
+	var bptr *[]byte
+	size := lo
+	alloc := func() []byte {
+		bptr = AllocRegion(size)
+		return (*bptr)[:size]
+	}
+	free := func() {
+		if bptr != nil {
+			Recycle(bptr)
+			bptr = nil
+		}
+	}
+	defer free()
+
+	var written int64
+	var full int
+	b := alloc()
+	for {
+		nr, er := src.Read(b)
+		if nr > 0 {
+			nw, ew := dst.Write(b[:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = errInvalidWrite
+				}
+			}
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return written, nil
+		} else if er != nil {
+			return written, er
+		}
+
+		next := size
+		if nr >= size {
+			if full++; full >= copygrowafter {
+				next, full = min(size*2, hi), 0
+			}
+		} else {
+			full = 0
+			if nr <= size/4 {
+				next = max(size/2, lo)
+			}
+			if size > lo && srcsock { // drained; hold no buffer till more
+				free()
+				if ok, err := AwaitRx(src); ok && err != nil {
+					return written, err
+				}
+				size = next
+				b = alloc()
+				continue
+			}
+		}
+		if next != size {
+			free()
+			size = next
+			b = alloc()
+		}
+	}
+}
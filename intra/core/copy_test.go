@@ -0,0 +1,195 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sizedr reads up to n bytes per read, in chunks as big as chunks[i] (the
+// last repeats), and records the size of buffers it is given.
+type sizedr struct {
+	n      int
+	chunks []int
+	sizes  []int
+}
+
+func (r *sizedr) Read(b []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	r.sizes = append(r.sizes, len(b))
+	c := r.chunks[min(len(r.sizes)-1, len(r.chunks)-1)]
+	c = min(c, len(b), r.n)
+	r.n -= c
+	return c, nil
+}
+
+// onlyw hides io.ReaderFrom of its writer.
+type onlyw struct{ io.Writer }
+
+func TestCopyAdapts(t *testing.T) {
+	defer SetCopyBufs(0, 0)
+	SetCopyBufs(B4096, B16384)
+
+	// bulk: fills every buffer, so grows to max
+	r := &sizedr{n: 1 << 20, chunks: []int{BMAX}}
+	var out bytes.Buffer
+	n, err := Copy(onlyw{&out}, r)
+	if err != nil || n != 1<<20 || out.Len() != 1<<20 {
+		t.Fatalf("copy: bulk: got %d, %v; out %d", n, err, out.Len())
+	}
+	if r.sizes[0] != B4096 {
+		t.Errorf("copy: bulk: want first buf %d, got %d", B4096, r.sizes[0])
+	}
+	if last := r.sizes[len(r.sizes)-1]; last != B16384 {
+		t.Errorf("copy: bulk: want last buf %d, got %d", B16384, last)
+	}
+	for _, sz := range r.sizes {
+		if sz > B16384 {
+			t.Fatalf("copy: bulk: buf %d over max %d", sz, B16384)
+		}
+	}
+
+	// burst then trickle: grows, then shrinks back to min
+	chunks := make([]int, 0, 32)
+	for range 12 {
+		chunks = append(chunks, BMAX)
+	}
+	chunks = append(chunks, 100)
+	r = &sizedr{n: 1 << 20, chunks: chunks}
+	if _, err := Copy(onlyw{io.Discard}, r); err != nil {
+		t.Fatal(err)
+	}
+	if last := r.sizes[len(r.sizes)-1]; last != B4096 {
+		t.Errorf("copy: trickle: want last buf %d, got %d", B4096, last)
+	}
+}
+
+func TestCopyBufs(t *testing.T) {
+	defer SetCopyBufs(0, 0)
+
+	if lo, hi := CopyBufs(); lo != copymin || hi != copymax {
+		t.Errorf("copybufs: want defaults %d, %d; got %d, %d", copymin, copymax, lo, hi)
+	}
+	SetCopyBufs(5000, 1<<20)
+	if lo, hi := CopyBufs(); lo != B4096 || hi != BMAX {
+		t.Errorf("copybufs: want %d, %d; got %d, %d", B4096, BMAX, lo, hi)
+	}
+	SetCopyBufs(B16384, 100)
+	if lo, hi := CopyBufs(); lo != B16384 || hi != B16384 {
+		t.Errorf("copybufs: want %d, %d; got %d, %d", B16384, B16384, lo, hi)
+	}
+}
+
+func TestCopySocketIdles(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	burst := bytes.Repeat([]byte("x"), 1<<20)
+	go func() {
+		_, _ = c.Write(burst)
+		time.Sleep(50 * time.Millisecond) // idle; buffers are given back
+		_, _ = c.Write([]byte("tail"))
+		_ = c.CloseWrite()
+	}()
+
+	var out bytes.Buffer
+	n, err := Copy(onlyw{&out}, s) // s is a socket, out is not: no WriteTo
+	if err != nil || n != int64(len(burst)+4) {
+		t.Fatalf("copy: socket: got %d, %v", n, err)
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("xtail")) {
+		t.Errorf("copy: socket: bad tail")
+	}
+}
+
+// fixedcopy copies as before Copy did: over a buffer of BMAX.
+func fixedcopy(dst io.Writer, src io.Reader) (int64, error) {
+	bptr := AllocRegion(BMAX)
+	defer Recycle(bptr)
+	return io.CopyBuffer(dst, src, (*bptr)[:BMAX])
+}
+
+// BenchmarkCopyManySmall reports heap held by many flows blocked on reads
+// after a small exchange each, as is typical of apps that keep conns open.
+func BenchmarkCopyManySmall(b *testing.B) {
+	const flows = 512
+	for _, bc := range []struct {
+		name string
+		cp   func(io.Writer, io.Reader) (int64, error)
+	}{{"adaptive", Copy}, {"fixed", fixedcopy}} {
+		b.Run(bc.name, func(b *testing.B) {
+			var held uint64
+			for range b.N {
+				var wg sync.WaitGroup
+				ws := make([]*io.PipeWriter, 0, flows)
+				var m0, m1 runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&m0)
+				for range flows {
+					pr, pw := io.Pipe()
+					ws = append(ws, pw)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, _ = bc.cp(onlyw{io.Discard}, pr)
+					}()
+					_, _ = pw.Write([]byte("hello"))
+				}
+				runtime.ReadMemStats(&m1)
+				if m1.HeapInuse > m0.HeapInuse {
+					held += m1.HeapInuse - m0.HeapInuse
+				}
+				for _, pw := range ws {
+					pw.Close()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(held)/float64(b.N)/flows, "heap-B/flow")
+		})
+	}
+}
+
+// BenchmarkCopyBulk reports throughput of a single bulk transfer.
+func BenchmarkCopyBulk(b *testing.B) {
+	const sz = 64 << 20
+	for _, bc := range []struct {
+		name string
+		cp   func(io.Writer, io.Reader) (int64, error)
+	}{{"adaptive", Copy}, {"fixed", fixedcopy}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(sz)
+			b.ReportAllocs()
+			for range b.N {
+				r := &sizedr{n: sz, chunks: []int{BMAX}, sizes: make([]int, 0, sz/B4096)}
+				if n, err := bc.cp(onlyw{io.Discard}, r); n != sz || err != nil {
+					b.Fatalf("copy: got %d, %v", n, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keys seen are swept of those past the window once there are as many
+const dupsweepat = 256
+
+// DupFilter remembers the last datagram (a hash of it) seen on a key (ex:
+// a flow), so that exact duplicates of it (ex: retransmits by apps of
+// datagrams that go unanswered) seen within a window of it may be dropped.
+type DupFilter struct {
+	sync.Mutex
+	window time.Duration
+	clock  Clock
+	last   map[string]dgram // key -> last datagram seen
+	n      atomic.Int64     // duplicates seen
+}
+
+type dgram struct {
+	sum uint64    // hash of the datagram
+	at  time.Time // last seen
+}
+
+// NewDupFilter returns a DupFilter that considers datagrams to be duplicates
+// of the last one seen on their key, if seen within window of it.
+func NewDupFilter(window time.Duration, c Clock) *DupFilter {
+	return &DupFilter{
+		window: window,
+		clock:  c,
+		last:   make(map[string]dgram),
+	}
+}
+
+// See remembers sum as the last datagram on k; a sum of 0 is unknown,
+// and is never a duplicate.
+func (f *DupFilter) See(k string, sum uint64) {
+	if sum == 0 {
+		return
+	}
+	now := f.clock.Now()
+
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.last) >= dupsweepat {
+		for x, d := range f.last {
+			if now.Sub(d.at) > f.window {
+				delete(f.last, x)
+			}
+		}
+	}
+	f.last[k] = dgram{sum: sum, at: now}
+}
+
+// Dup returns true if sum is of the last datagram seen on k, within the
+// window of it; which then extends to now, so that a burst of duplicates
+// are all dropped.
+func (f *DupFilter) Dup(k string, sum uint64) bool {
+	if sum == 0 {
+		return false
+	}
+	now := f.clock.Now()
+
+	f.Lock()
+	defer f.Unlock()
+
+	d, ok := f.last[k]
+	if !ok || d.sum != sum || now.Sub(d.at) > f.window {
+		return false
+	}
+	f.last[k] = dgram{sum: sum, at: now}
+	f.n.Add(1)
+	return true
+}
+
+// Forget forgets datagrams seen on k.
+func (f *DupFilter) Forget(k string) {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.last, k)
+}
+
+// Dups returns the no. of duplicates seen so far.
+func (f *DupFilter) Dups() int64 {
+	return f.n.Load()
+}
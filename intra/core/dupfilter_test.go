@@ -0,0 +1,63 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDupFilterStalls has a dns stub retransmit a query of a blocked flow,
+// as it goes unanswered; stalls must escalate as if it was sent just once.
+func TestDupFilterStalls(t *testing.T) {
+	c := NewFakeClock(epoch)
+	f := NewDupFilter(500*time.Millisecond, c)
+	stalls := NewExpiringMapWithClock(c)
+	const k = "10.111.222.1|10.111.222.3:53"
+
+	attempts := 0
+	var hits uint32
+	send := func(sum uint64) {
+		if f.Dup(k, sum) {
+			return // dropped
+		}
+		attempts++
+		hits = stalls.Get(k) // as the udp handler escalates stalls
+		stalls.Set(k, 30*time.Second)
+		f.See(k, sum) // blocked
+	}
+
+	for range 4 { // the query, and 3 retransmits
+		send(0xabc)
+		c.Advance(200 * time.Millisecond)
+	}
+	if attempts != 1 || hits != 0 || f.Dups() != 3 {
+		t.Errorf("retransmits: attempts %d, hits %d, dups %d; want 1, 0, 3", attempts, hits, f.Dups())
+	}
+
+	send(0xdef) // a different query
+	if attempts != 2 || hits != 1 {
+		t.Errorf("new query: attempts %d, hits %d; want 2, 1", attempts, hits)
+	}
+
+	c.Advance(time.Second) // past the window
+	send(0xdef)
+	if attempts != 3 || f.Dups() != 3 {
+		t.Errorf("past window: attempts %d, dups %d; want 3, 3", attempts, f.Dups())
+	}
+
+	// allowed flows forget; their duplicates may be legit (ex: quic)
+	f.Forget(k)
+	if f.Dup(k, 0xdef) {
+		t.Errorf("forgotten: dup")
+	}
+	// unknown datagrams are never duplicates
+	f.See(k, 0)
+	if f.Dup(k, 0) {
+		t.Errorf("unknown: dup")
+	}
+}
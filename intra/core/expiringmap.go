@@ -7,6 +7,7 @@
 package core
 
 import (
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,13 +28,20 @@ type ExpMap struct {
 	sync.Mutex // guards ExpMap.
 	m          map[string]*val
 	lastreap   time.Time
+	clock      Clock
 }
 
 // NewExpiringMap returns a new ExpMap.
 func NewExpiringMap() *ExpMap {
+	return NewExpiringMapWithClock(RealClock)
+}
+
+// NewExpiringMapWithClock returns a new ExpMap whose keys expire as told by c.
+func NewExpiringMapWithClock(c Clock) *ExpMap {
 	m := &ExpMap{
 		m:        make(map[string]*val),
-		lastreap: time.Now(),
+		lastreap: c.Now(),
+		clock:    c,
 	}
 	// test: go.dev/play/p/EYq_STKvugb
 	return m
@@ -41,7 +49,7 @@ func NewExpiringMap() *ExpMap {
 
 // Get returns the number of hits for the given key.
 func (m *ExpMap) Get(key string) uint32 {
-	n := time.Now()
+	n := m.clock.Now()
 
 	m.Lock()
 	defer m.Unlock()
@@ -62,7 +70,7 @@ func (m *ExpMap) Get(key string) uint32 {
 
 // Set sets the expiry for the given key and returns the number of hits.
 func (m *ExpMap) Set(key string, expiry time.Duration) uint32 {
-	n := time.Now().Add(expiry)
+	n := m.clock.Now().Add(expiry)
 
 	m.Lock()
 	defer m.Unlock()
@@ -90,6 +98,21 @@ func (m *ExpMap) Delete(key string) {
 	delete(m.m, key)
 }
 
+// DeletePrefix deletes all keys that begin with prefix
+// and returns the number of keys deleted.
+func (m *ExpMap) DeletePrefix(prefix string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	l := len(m.m)
+	for k := range m.m {
+		if strings.HasPrefix(k, prefix) {
+			delete(m.m, k)
+		}
+	}
+	return l - len(m.m)
+}
+
 // Len returns the number of keys, which may or may not have expired.
 func (m *ExpMap) Len() int {
 	m.Lock()
@@ -108,6 +131,22 @@ func (m *ExpMap) Clear() int {
 	return l
 }
 
+// Trim deletes all expired keys and returns the number of keys deleted.
+func (m *ExpMap) Trim() int {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.clock.Now()
+	m.lastreap = now
+	l := len(m.m)
+	for k, v := range m.m {
+		if now.Sub(v.expiry) > 0 {
+			delete(m.m, k)
+		}
+	}
+	return l - len(m.m)
+}
+
 // reaper deletes expired keys.
 func (m *ExpMap) reaper() {
 	m.Lock()
@@ -118,7 +157,7 @@ func (m *ExpMap) reaper() {
 		return
 	}
 
-	now := time.Now()
+	now := m.clock.Now()
 	treap := m.lastreap.Add(reapthreshold)
 	// if last reap was reap-threshold minutes ago...
 	if now.Sub(treap) <= 0 {
@@ -0,0 +1,69 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpMapReap(t *testing.T) {
+	c := NewFakeClock(epoch)
+	m := NewExpiringMapWithClock(c)
+	for i := range sizethreshold {
+		m.Set(strconv.Itoa(i), time.Minute)
+	}
+	m.Set("long", time.Hour)
+
+	c.Advance(2 * time.Minute)
+	m.reaper() // too soon since the last reap
+	if n := m.Len(); n != sizethreshold+1 {
+		t.Errorf("expmap: reaped before threshold; len %d", n)
+	}
+
+	c.Advance(reapthreshold)
+	m.reaper()
+	if n := m.Len(); n < sizethreshold+1-(maxreapiter+1) || n >= sizethreshold+1 {
+		t.Errorf("expmap: reap: want up to %d reaped, len %d", maxreapiter+1, m.Len())
+	}
+	m.Trim()
+	if n := m.Len(); n != 1 {
+		t.Errorf("expmap: trim: want only long, len %d", n)
+	}
+	if n := m.Get("long"); n != 1 { // unexpired, so the hit counts
+		t.Errorf("expmap: long: want 1 hit, got %d", n)
+	}
+}
+
+// escalate mimics how blocked flows are stalled: each attempt within the
+// life of the previous one counts, and extends it.
+func escalate(m *ExpMap, k string) uint32 {
+	n := m.Get(k)
+	m.Set(k, time.Duration(n+1)*time.Second)
+	return n
+}
+
+func TestExpMapHitsDecay(t *testing.T) {
+	c := NewFakeClock(epoch)
+	m := NewExpiringMapWithClock(c)
+
+	for want := uint32(0); want < 5; want++ {
+		if n := escalate(m, "k"); n != want {
+			t.Fatalf("expmap: escalate: want %d, got %d", want, n)
+		}
+		c.Advance(time.Duration(want) * time.Second) // within life
+	}
+	// life of the last attempt is 5s
+	c.Advance(5*time.Second + time.Millisecond)
+	if n := escalate(m, "k"); n != 0 {
+		t.Errorf("expmap: decay: want 0, got %d", n)
+	}
+	if n := escalate(m, "k"); n != 1 {
+		t.Errorf("expmap: escalate after decay: want 1, got %d", n)
+	}
+}
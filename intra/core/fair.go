@@ -0,0 +1,320 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// classes of flows; see: Fair
+const (
+	FairInteractive = iota
+	FairBulk
+	fairclasses
+)
+
+var fairnames = []string{
+	FairInteractive: "interactive",
+	FairBulk:        "bulk",
+}
+
+const (
+	// writes that block for as long are slow
+	fairslow = 2 * time.Millisecond
+	// slow writes of as many flows at once say the link is saturated; and
+	// not just that the peer of a flow is slow, or stalled
+	fairslowflows = 2
+	// the link is taken to be saturated for as long since the last slow write
+	fairhold = 500 * time.Millisecond
+	// writes wait for their turn for at most as long, lest a stuck write stall all
+	fairmaxwait = 100 * time.Millisecond
+	// writes hold their turn for at most as long; those that block for longer
+	// (ex: as the peer stalled) go on without, lest they hold up other flows
+	fairlease = 10 * time.Millisecond
+	// flows that wrote as many bytes, in writes as large on average, are bulk
+	fairbulkbytes = 512 * 1024
+	fairbulkwrite = 1024
+)
+
+// bytes each class may write per round; and so, the largest of its writes
+// while the link is saturated; interactive flows get 4x as much as bulk.
+var fairquantum = [fairclasses]int{
+	FairInteractive: B16384,
+	FairBulk:        B4096,
+}
+
+// Fair schedules writes of flows (see: Fair.Writer) on the egress path in
+// favor of interactive flows over bulk ones, but only while the link is
+// saturated (as told by writes of many flows that block): writes are then
+// split into quanta of their class, and are let through one at a time in
+// deficit round robin order of the two classes; a write holds its turn for
+// no longer than fairlease, done or not. Otherwise, writes go through as-is.
+// Flows are bulk if hinted so, or once they write a lot in large writes. Off
+// by default; the zero value is not usable, see: NewFair.
+type Fair struct {
+	on    atomic.Bool
+	until atomic.Int64               // unix nanos; saturated till then
+	bytes [fairclasses]atomic.Int64  // written, by class
+	sats  atomic.Int64               // times the link turned saturated
+	hints sync.Map                   // key -> bool (bulk)
+	smu   sync.Mutex                 // protects slow
+	slow  map[*fairw]int64           // flow -> unix nanos of its last slow write
+	mu    sync.Mutex                 // protects fields below
+	q     [fairclasses][]*fairwaiter // writes waiting for their turn
+	dfc   [fairclasses]int           // deficits of classes
+	next  int                        // class visited next
+	fresh bool                       // true if next is yet to get its quantum
+	busy  bool                       // a write is in flight
+}
+
+type fairwaiter struct {
+	n       int           // bytes to write
+	ready   chan struct{} // closed once granted
+	granted bool          // guarded by Fair.mu
+	gone    bool          // gave up waiting; guarded by Fair.mu
+}
+
+// NewFair returns a Fair, off.
+func NewFair() *Fair {
+	return &Fair{fresh: true, slow: make(map[*fairw]int64)}
+}
+
+// Set turns f on or off; writes in flight, or waiting, when f is turned
+// off go through as they would have.
+func (f *Fair) Set(on bool) {
+	f.on.Store(on)
+	if !on {
+		f.until.Store(0)
+		f.smu.Lock()
+		clear(f.slow)
+		f.smu.Unlock()
+	}
+}
+
+// On returns true if f is on.
+func (f *Fair) On() bool {
+	return f.on.Load()
+}
+
+// Hint has flows of key (ex: an app's uid) be bulk, if bulk; or be
+// classified as usual, if not.
+func (f *Fair) Hint(key string, bulk bool) {
+	if bulk {
+		f.hints.Store(key, true)
+	} else {
+		f.hints.Delete(key)
+	}
+}
+
+// Saturated returns true if the link is taken to be saturated.
+func (f *Fair) Saturated() bool {
+	return time.Now().UnixNano() < f.until.Load()
+}
+
+// Bytes returns bytes written by flows of class, since f was made.
+func (f *Fair) Bytes(class int) int64 {
+	if class < 0 || class >= fairclasses {
+		return 0
+	}
+	return f.bytes[class].Load()
+}
+
+// String returns "on=..;saturated=..;saturations=..;interactive=..;bulk=..";
+// the latter two are bytes written by flows of that class.
+func (f *Fair) String() string {
+	return fmt.Sprintf("on=%t;saturated=%t;saturations=%d;%s=%d;%s=%d",
+		f.On(), f.Saturated(), f.sats.Load(),
+		fairnames[FairInteractive], f.Bytes(FairInteractive),
+		fairnames[FairBulk], f.Bytes(FairBulk))
+}
+
+// Writer returns w whose writes are scheduled by f, as those of a flow of
+// key (see: Hint); or w as-is, if f is nil.
+func (f *Fair) Writer(w io.Writer, key string) io.Writer {
+	if f == nil {
+		return w
+	}
+	return &fairw{w: w, f: f, key: key}
+}
+
+// observe notes a write of w that took d; the link is saturated once
+// writes of fairslowflows flows were slow within fairhold of each other.
+func (f *Fair) observe(w *fairw, d time.Duration) {
+	if d < fairslow {
+		return
+	}
+	now := time.Now().UnixNano()
+	f.smu.Lock()
+	f.slow[w] = now
+	for x, at := range f.slow {
+		if now-at > int64(fairhold) {
+			delete(f.slow, x)
+		}
+	}
+	n := len(f.slow)
+	f.smu.Unlock()
+
+	if n < fairslowflows {
+		return
+	}
+	if prev := f.until.Swap(now + int64(fairhold)); prev < now {
+		f.sats.Add(1)
+	}
+}
+
+// acquire waits for the turn of a write of n bytes of class; and returns
+// true if it must be released, once written.
+func (f *Fair) acquire(class, n int) bool {
+	f.mu.Lock()
+	if !f.busy && len(f.q[FairInteractive])+len(f.q[FairBulk]) <= 0 {
+		f.busy = true
+		f.mu.Unlock()
+		return true
+	}
+	w := &fairwaiter{n: n, ready: make(chan struct{})}
+	f.q[class] = append(f.q[class], w)
+	f.mu.Unlock()
+
+	t := time.NewTimer(fairmaxwait)
+	defer t.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-t.C:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if w.granted { // just now
+		return true
+	}
+	w.gone = true // dropped by dispatchLocked
+	return false
+}
+
+// lease returns a func that ends the turn of the write in flight; the turn
+// ends by itself after fairlease, if the write is not done by then.
+func (f *Fair) lease() (end func()) {
+	var once sync.Once
+	rel := func() { once.Do(f.release) }
+	t := time.AfterFunc(fairlease, rel)
+	return func() {
+		t.Stop()
+		rel()
+	}
+}
+
+// release ends the write in flight, and lets the next one through.
+func (f *Fair) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.busy = false
+	f.dispatchLocked()
+}
+
+// dispatchLocked grants the next write in deficit round robin order: a class,
+// as it is visited, gets its quantum added to its deficit, and its writes
+// are let through while its deficit covers them; then, the other class is
+// visited. Must be called with f.mu locked.
+func (f *Fair) dispatchLocked() {
+	for range 2 * fairclasses {
+		c := f.next
+		q := f.q[c]
+		for len(q) > 0 && q[0].gone {
+			q = q[1:]
+		}
+		f.q[c] = q
+		if len(q) <= 0 { // idle classes bank no deficit
+			f.dfc[c] = 0
+			f.next, f.fresh = (c+1)%fairclasses, true
+			continue
+		}
+		if f.fresh {
+			f.dfc[c] += fairquantum[c]
+			f.fresh = false
+		}
+		w := q[0]
+		if f.dfc[c] < w.n { // spent; writes are at most a quantum
+			f.next, f.fresh = (c+1)%fairclasses, true
+			continue
+		}
+		f.q[c] = q[1:]
+		f.dfc[c] -= w.n
+		w.granted = true
+		f.busy = true
+		close(w.ready)
+		return
+	}
+}
+
+// fairw is a writer of a flow; see: Fair.Writer
+type fairw struct {
+	w      io.Writer
+	f      *Fair
+	key    string
+	n      int64 // bytes written
+	writes int64
+	bulk   bool // sticky, once classified so
+}
+
+var _ io.Writer = (*fairw)(nil)
+
+func (w *fairw) class() int {
+	if w.bulk {
+		return FairBulk
+	}
+	if v, ok := w.f.hints.Load(w.key); ok && v.(bool) {
+		return FairBulk
+	}
+	if w.n >= fairbulkbytes && w.n/max(w.writes, 1) >= fairbulkwrite {
+		w.bulk = true
+		return FairBulk
+	}
+	return FairInteractive
+}
+
+// Write implements io.Writer.
+func (w *fairw) Write(b []byte) (n int, err error) {
+	f := w.f
+	if !f.on.Load() {
+		return w.w.Write(b)
+	}
+	c := w.class()
+	defer func() {
+		w.n += int64(n)
+		w.writes++
+		f.bytes[c].Add(int64(n))
+	}()
+
+	if !f.Saturated() {
+		start := time.Now()
+		n, err = w.w.Write(b)
+		f.observe(w, time.Since(start))
+		return
+	}
+	for len(b) > 0 && err == nil {
+		p := b[:min(len(b), fairquantum[c])]
+		var end func()
+		if f.acquire(c, len(p)) {
+			end = f.lease()
+		}
+		start := time.Now()
+		var m int
+		m, err = w.w.Write(p)
+		f.observe(w, time.Since(start))
+		if end != nil {
+			end()
+		}
+		n += m
+		b = b[m:]
+	}
+	return
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// link is a bottleneck shared by all flows: it sends one write at a time,
+// taking perkb for every 1k of it.
+type link struct {
+	sync.Mutex
+	perkb time.Duration
+}
+
+// linkw is a flow's socket on l.
+type linkw struct{ l *link }
+
+func (w linkw) Write(b []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	time.Sleep(w.l.perkb * time.Duration(len(b)) / 1024)
+	return len(b), nil
+}
+
+// stallw is a flow's socket whose peer stalls: its first write takes d, and
+// those after block till stuck is closed.
+type stallw struct {
+	d       time.Duration
+	stuck   chan struct{}
+	writes  atomic.Int32
+	blocked atomic.Bool
+}
+
+func (w *stallw) Write(b []byte) (int, error) {
+	if w.writes.Add(1) == 1 {
+		time.Sleep(w.d)
+		return len(b), nil
+	}
+	w.blocked.Store(true)
+	<-w.stuck
+	return len(b), nil
+}
+
+// bulkRun has a bulk flow of key write to w till stop is called.
+func bulkRun(t *testing.T, f *Fair, w io.Writer, key string) (stop func()) {
+	bulk := f.Writer(w, key)
+	f.Hint(key, true)
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, BMAX)
+		for !done.Load() {
+			if _, err := bulk.Write(b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	return func() {
+		done.Store(true)
+		wg.Wait()
+	}
+}
+
+// interactiveRun has an interactive flow send small writes to w, and
+// returns its write latencies, sorted.
+func interactiveRun(t *testing.T, f *Fair, w io.Writer) []time.Duration {
+	interactive := f.Writer(w, "interactive")
+	var lat []time.Duration
+	b := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		if _, err := interactive.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		lat = append(lat, time.Since(start))
+		time.Sleep(5 * time.Millisecond)
+	}
+	slices.Sort(lat)
+	return lat
+}
+
+// fairRun has two bulk flows saturate a link while an interactive flow sends
+// small writes, and returns the interactive flow's write latencies.
+func fairRun(t *testing.T, f *Fair) []time.Duration {
+	l := &link{perkb: time.Millisecond} // ~1 MiB/s
+	defer bulkRun(t, f, linkw{l}, "bulk1")()
+	defer bulkRun(t, f, linkw{l}, "bulk2")()
+
+	// let the bulk flows saturate the link
+	time.Sleep(200 * time.Millisecond)
+	if f.On() && !f.Saturated() {
+		t.Fatal("link not saturated")
+	}
+	return interactiveRun(t, f, linkw{l})
+}
+
+func TestFairBoundsInteractive(t *testing.T) {
+	// a bulk write (64k) holds the link for ~64ms; a quantum of it (4k), ~4ms
+	const bound = 30 * time.Millisecond
+
+	off := NewFair()
+	latoff := fairRun(t, off)
+
+	on := NewFair()
+	on.Set(true)
+	laton := fairRun(t, on)
+
+	p90 := func(lat []time.Duration) time.Duration { return lat[len(lat)*9/10] }
+	t.Logf("interactive p90: off %s; on %s; %s", p90(latoff), p90(laton), on)
+
+	if d := p90(laton); d > bound {
+		t.Errorf("on: interactive p90 %s; want at most %s", d, bound)
+	}
+	if on.Bytes(FairBulk) <= 0 || on.Bytes(FairInteractive) != 20*100 {
+		t.Errorf("bytes: bulk %d, interactive %d; want >0, %d", on.Bytes(FairBulk), on.Bytes(FairInteractive), 20*100)
+	}
+	if off.Bytes(FairBulk) != 0 || off.Bytes(FairInteractive) != 0 {
+		t.Errorf("off: bytes counted: %s", off)
+	}
+}
+
+// a flow whose peer stalls is slow, but the link is not saturated for it
+func TestFairStalledWriterAlone(t *testing.T) {
+	f := NewFair()
+	f.Set(true)
+	sw := &stallw{d: 10 * fairslow, stuck: make(chan struct{})}
+	stop := bulkRun(t, f, sw, "stalled")
+	defer stop()
+	defer close(sw.stuck)
+
+	lat := interactiveRun(t, f, discardw{})
+	if f.Saturated() || f.sats.Load() != 0 {
+		t.Errorf("stalled alone: saturated; %s", f)
+	}
+	if d := lat[len(lat)-1]; d > fairslow {
+		t.Errorf("stalled alone: interactive max %s; want at most %s", d, fairslow)
+	}
+}
+
+// a flow whose peer stalls while the link is saturated does not hold up the
+// writes of other flows for as long as it stalls
+func TestFairStalledWriterSaturated(t *testing.T) {
+	f := NewFair()
+	f.Set(true)
+	// the first write of the stalled flow outlasts that of bulk (64ms), so
+	// that its next, which stalls, waits its turn on the saturated link
+	sw := &stallw{d: 100 * time.Millisecond, stuck: make(chan struct{})}
+	l := &link{perkb: time.Millisecond}
+	defer bulkRun(t, f, linkw{l}, "bulk")()
+	defer bulkRun(t, f, sw, "stalled")()
+	defer close(sw.stuck)
+
+	for end := time.Now().Add(time.Second); !f.Saturated() || !sw.blocked.Load(); {
+		if time.Now().After(end) {
+			t.Fatalf("stalled: saturated? %t; stalled? %t", f.Saturated(), sw.blocked.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	lat := interactiveRun(t, f, discardw{})
+	t.Logf("stalled: interactive p90 %s, max %s; %s", lat[len(lat)*9/10], lat[len(lat)-1], f)
+	if d := lat[len(lat)-1]; d >= fairmaxwait/2 {
+		t.Errorf("stalled: interactive max %s; want under %s", d, fairmaxwait/2)
+	}
+	if !sw.blocked.Load() || sw.writes.Load() != 2 {
+		t.Errorf("stalled: %d writes; want 2, the latter blocked", sw.writes.Load())
+	}
+}
+
+func TestFairClassifies(t *testing.T) {
+	f := NewFair()
+	f.Set(true)
+	w := f.Writer(discardw{}, "k").(*fairw)
+
+	small := make([]byte, 100)
+	for i := 0; i < 100; i++ {
+		_, _ = w.Write(small)
+	}
+	if c := w.class(); c != FairInteractive {
+		t.Errorf("small writes: class %d; want interactive", c)
+	}
+	large := make([]byte, BMAX)
+	for i := 0; i < 16; i++ {
+		_, _ = w.Write(large)
+	}
+	if c := w.class(); c != FairBulk {
+		t.Errorf("large writes: class %d; want bulk", c)
+	}
+
+	h := f.Writer(discardw{}, "hinted").(*fairw)
+	f.Hint("hinted", true)
+	if c := h.class(); c != FairBulk {
+		t.Errorf("hinted: class %d; want bulk", c)
+	}
+	f.Hint("hinted", false)
+	if c := h.class(); c != FairInteractive {
+		t.Errorf("unhinted: class %d; want interactive", c)
+	}
+}
+
+type discardw struct{}
+
+func (discardw) Write(b []byte) (int, error) { return len(b), nil }
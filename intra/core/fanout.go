@@ -0,0 +1,102 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrNotDone is set for ids FanOut gave up waiting on; it wraps
+// os.ErrDeadlineExceeded, so that it is seen as a timeout.
+var ErrNotDone = fmt.Errorf("fanout: not done in time: %w", os.ErrDeadlineExceeded)
+
+// FanOut runs f for each of ids on at most n goroutines at once, and
+// returns errs by id; ids not done within d (if positive) are set to
+// ErrNotDone, and those that had started are left to finish in the
+// background, while the rest are never run.
+func FanOut(ids []string, n int, d time.Duration, f func(id string) error) map[string]error {
+	type res struct {
+		id  string
+		err error
+	}
+	out := make(chan res, len(ids)) // never blocks senders
+	sem := make(chan struct{}, max(n, 1))
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for _, id := range ids {
+			select {
+			case <-stop:
+				return
+			case sem <- struct{}{}:
+			}
+			go func(id string) {
+				defer func() {
+					if r := recover(); r != nil {
+						out <- res{id, fmt.Errorf("fanout: %s: panic: %v", id, r)}
+					}
+					<-sem
+				}()
+				out <- res{id, f(id)}
+			}(id)
+		}
+	}()
+
+	var deadline <-chan time.Time // nil blocks forever
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	errs := make(map[string]error, len(ids))
+	for len(errs) < len(ids) {
+		select {
+		case r := <-out:
+			errs[r.id] = r.err
+		case <-deadline:
+			for _, id := range ids {
+				if _, ok := errs[id]; !ok {
+					errs[id] = ErrNotDone
+				}
+			}
+			return errs
+		}
+	}
+	return errs
+}
+
+// Await returns what f returns, and true, if f returns within d (if
+// positive); or the zero value of T, and false, if it does not, in which
+// case f is left to finish in the background. f that panics returns the
+// zero value of T. If d is not positive, f is called inline, as is.
+func Await[T any](d time.Duration, f func() T) (v T, ok bool) {
+	if d <= 0 {
+		return f(), true
+	}
+	out := make(chan T, 1) // never blocks f
+	go func() {
+		var v T
+		defer func() {
+			_ = recover()
+			out <- v
+		}()
+		v = f()
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case v = <-out:
+		return v, true
+	case <-t.C:
+		return v, false
+	}
+}
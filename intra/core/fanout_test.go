@@ -0,0 +1,106 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	errOdd := errors.New("odd")
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+
+	var running, peak atomic.Int32
+	errs := FanOut(ids, 3, time.Minute, func(id string) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		if i, _ := strconv.Atoi(id); i%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+	if len(errs) != len(ids) {
+		t.Fatalf("fanout: want %d errs, got %d", len(ids), len(errs))
+	}
+	for i, id := range ids {
+		if want := i%2 == 1; errors.Is(errs[id], errOdd) != want {
+			t.Errorf("fanout: %s: err %v", id, errs[id])
+		}
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("fanout: want at most 3 at once, got %d", p)
+	}
+}
+
+func TestFanOutDeadline(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	var ran atomic.Int32
+	start := time.Now()
+	errs := FanOut([]string{"hung", "a", "b", "c"}, 1, 50*time.Millisecond, func(id string) error {
+		ran.Add(1)
+		if id == "hung" {
+			<-hang
+		}
+		panic("never run") // "hung" hogs the only slot
+	})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("fanout: deadline not honoured; took %s", d)
+	}
+	for id, err := range errs {
+		if !errors.Is(err, ErrNotDone) || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("fanout: %s: want not done, got %v", id, err)
+		}
+	}
+	if len(errs) != 4 || ran.Load() != 1 {
+		t.Errorf("fanout: want 4 errs and 1 run, got %d and %d", len(errs), ran.Load())
+	}
+
+	errs = FanOut([]string{"p"}, 1, 0, func(string) error { panic("boom") })
+	if errs["p"] == nil {
+		t.Errorf("fanout: panic not reported")
+	}
+}
+
+func TestAwait(t *testing.T) {
+	if v, ok := Await(0, func() int { return 1 }); !ok || v != 1 {
+		t.Errorf("await: inline: got %d, %t", v, ok)
+	}
+	if v, ok := Await(time.Second, func() int { return 2 }); !ok || v != 2 {
+		t.Errorf("await: in time: got %d, %t", v, ok)
+	}
+	if v, ok := Await(time.Second, func() int { panic("oops") }); !ok || v != 0 {
+		t.Errorf("await: panic: got %d, %t", v, ok)
+	}
+
+	hang := make(chan struct{})
+	defer close(hang)
+	start := time.Now()
+	v, ok := Await(20*time.Millisecond, func() int { <-hang; return 3 })
+	if ok || v != 0 {
+		t.Errorf("await: hung: got %d, %t", v, ok)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("await: hung: waited %s", d)
+	}
+}
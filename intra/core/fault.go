@@ -0,0 +1,231 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// kinds of targets of faults; see: InjectFault
+const (
+	FaultDNS   = "dns"   // dns transports, by id
+	FaultProxy = "proxy" // proxies, by id
+)
+
+// errors injected by faults; see: FaultProfile.Err
+const (
+	FaultRefused  = "refused"  // conn refused (the default)
+	FaultTimeout  = "timeout"  // no answer in time
+	FaultReset    = "reset"    // conn reset
+	FaultServfail = "servfail" // dns answer with rcode SERVFAIL; refused, for proxies
+)
+
+const (
+	// faults clear after at most this long
+	MaxFaultDuration = 1 * time.Hour
+	// max latency a fault adds
+	maxFaultDelay = 30 * time.Second
+)
+
+var (
+	errFaultKind    = errors.New("fault: kind must be dns or proxy")
+	errFaultProfile = errors.New("fault: bad profile")
+	errFaultTTL     = errors.New("fault: ttl must be positive")
+
+	// ErrFaultServfail is returned by Fault.Fail for FaultServfail; dns
+	// transports answer SERVFAIL for it, while proxies refuse conns.
+	ErrFaultServfail = errors.New("fault: servfail")
+)
+
+// FaultProfile is a named set of faults injected into a dns transport or a
+// proxy; as json: {"name": "flaky", "errevery": 3, "delayms": 2000}.
+type FaultProfile struct {
+	Name       string  `json:"name"`
+	ErrRate    float64 `json:"errrate,omitempty"`    // fraction [0, 1] of queries or dials that fail
+	ErrEvery   int     `json:"errevery,omitempty"`   // every nth query or dial fails, too
+	Err        string  `json:"err,omitempty"`        // FaultRefused, FaultTimeout, FaultReset, FaultServfail
+	DelayMs    int     `json:"delayms,omitempty"`    // latency added to each query or dial
+	JitterMs   int     `json:"jitterms,omitempty"`   // and up to as much more, uniformly at random
+	TruncRate  float64 `json:"truncrate,omitempty"`  // fraction [0, 1] of dns answers truncated
+	ResetAfter int64   `json:"resetafter,omitempty"` // conns are reset once as many bytes are read
+}
+
+func (p *FaultProfile) valid() bool {
+	switch p.Err {
+	case "", FaultRefused, FaultTimeout, FaultReset, FaultServfail:
+	default:
+		return false
+	}
+	return p.ErrRate >= 0 && p.ErrRate <= 1 && p.TruncRate >= 0 && p.TruncRate <= 1 &&
+		p.ErrEvery >= 0 && p.DelayMs >= 0 && p.JitterMs >= 0 && p.ResetAfter >= 0
+}
+
+// Fault is a FaultProfile in effect on a target, till it expires.
+type Fault struct {
+	FaultProfile
+	target string
+	exp    time.Time
+	n      atomic.Int64 // queries or dials so far
+	hits   atomic.Int64 // faults injected so far
+}
+
+// Delay returns the latency to add to the next query or dial.
+func (f *Fault) Delay() time.Duration {
+	if f == nil {
+		return 0
+	}
+	d := time.Duration(f.DelayMs) * time.Millisecond
+	if f.JitterMs > 0 {
+		d += time.Duration(rand.IntN(f.JitterMs+1)) * time.Millisecond
+	}
+	return min(d, maxFaultDelay)
+}
+
+// Fail returns the error the next query or dial fails with, if it is to;
+// errors mimic those of the network (ex: syscall.ECONNREFUSED), so that
+// they are handled (and summarized) as such.
+func (f *Fault) Fail() error {
+	if f == nil {
+		return nil
+	}
+	n := f.n.Add(1)
+	every := f.ErrEvery > 0 && n%int64(f.ErrEvery) == 0
+	if !every && (f.ErrRate <= 0 || rand.Float64() >= f.ErrRate) {
+		return nil
+	}
+	f.hits.Add(1)
+	switch f.Err {
+	case FaultTimeout:
+		return fmt.Errorf("fault: %s: %w", f.Name, os.ErrDeadlineExceeded)
+	case FaultReset:
+		return fmt.Errorf("fault: %s: %w", f.Name, syscall.ECONNRESET)
+	case FaultServfail:
+		return fmt.Errorf("%w: %s", ErrFaultServfail, f.Name)
+	default:
+		return fmt.Errorf("fault: %s: %w", f.Name, syscall.ECONNREFUSED)
+	}
+}
+
+// Truncate returns true if the next dns answer is to be truncated.
+func (f *Fault) Truncate() bool {
+	if f == nil || f.TruncRate <= 0 || rand.Float64() >= f.TruncRate {
+		return false
+	}
+	f.hits.Add(1)
+	return true
+}
+
+// Faults are faults in effect, by target ("kind:id"), each till its ttl.
+type Faults struct {
+	on    atomic.Bool // if any fault is in effect
+	clock Clock
+	mu    sync.Mutex        // protects m
+	m     map[string]*Fault // target -> fault
+}
+
+// NewFaults returns Faults whose ttls are told by c.
+func NewFaults(c Clock) *Faults {
+	return &Faults{clock: c, m: make(map[string]*Fault)}
+}
+
+// Inject puts profile (json of FaultProfile) in effect on id of kind
+// (FaultDNS, FaultProxy) for ttl (capped at MaxFaultDuration), replacing
+// the fault on it, if any.
+func (fs *Faults) Inject(kind, id, profile string, ttl time.Duration) error {
+	if kind != FaultDNS && kind != FaultProxy {
+		return errFaultKind
+	}
+	if ttl <= 0 {
+		return errFaultTTL
+	}
+	var p FaultProfile
+	if err := json.Unmarshal([]byte(profile), &p); err != nil || len(id) <= 0 || !p.valid() {
+		return errors.Join(errFaultProfile, err)
+	}
+	target := kind + ":" + id
+	f := &Fault{FaultProfile: p, target: target, exp: fs.clock.Now().Add(min(ttl, MaxFaultDuration))}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.m[target] = f
+	fs.on.Store(true)
+	return nil
+}
+
+// Clear clears all faults.
+func (fs *Faults) Clear() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clear(fs.m)
+	fs.on.Store(false)
+}
+
+// For returns the fault in effect on id of kind, if any; nil otherwise.
+// It is a single atomic load if there are no faults.
+func (fs *Faults) For(kind, id string) *Fault {
+	if !fs.on.Load() {
+		return nil
+	}
+	target := kind + ":" + id
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f := fs.m[target]
+	if f != nil && !fs.clock.Now().Before(f.exp) {
+		delete(fs.m, target)
+		fs.on.Store(len(fs.m) > 0)
+		return nil
+	}
+	return f
+}
+
+// String returns "kind:id=name;hits=n/m;ttl=d" of faults in effect, one per line.
+func (fs *Faults) String() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	now := fs.clock.Now()
+	targets := make([]string, 0, len(fs.m))
+	for target, f := range fs.m {
+		if now.Before(f.exp) {
+			targets = append(targets, target)
+		}
+	}
+	slices.Sort(targets)
+	var b strings.Builder
+	for _, target := range targets {
+		f := fs.m[target]
+		fmt.Fprintf(&b, "%s=%s;hits=%d/%d;ttl=%s\n", target, f.Name, f.hits.Load(), f.n.Load(), f.exp.Sub(now).Truncate(time.Second))
+	}
+	return b.String()
+}
+
+// faults in effect process-wide; see: InjectFault
+var faults = NewFaults(RealClock)
+
+// InjectFault puts profile (json of FaultProfile) in effect on id of kind
+// (FaultDNS, FaultProxy) for ttl; see: Faults.Inject.
+func InjectFault(kind, id, profile string, ttl time.Duration) error {
+	return faults.Inject(kind, id, profile, ttl)
+}
+
+// ClearFaults clears all faults.
+func ClearFaults() { faults.Clear() }
+
+// FaultFor returns the fault in effect on id of kind, if any.
+func FaultFor(kind, id string) *Fault { return faults.For(kind, id) }
+
+// FaultsStatus returns faults in effect; see: Faults.String.
+func FaultsStatus() string { return faults.String() }
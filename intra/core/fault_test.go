@@ -0,0 +1,85 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaults(t *testing.T) {
+	c := NewFakeClock(epoch)
+	fs := NewFaults(c)
+
+	if f := fs.For(FaultProxy, "wg0"); f != nil || f.Fail() != nil || f.Delay() != 0 || f.Truncate() {
+		t.Fatalf("fault: none in effect, got %v", f)
+	}
+	for _, bad := range []string{`{`, `{"err": "nope"}`, `{"errrate": 2}`, `{"delayms": -1}`} {
+		if err := fs.Inject(FaultProxy, "wg0", bad, time.Minute); !errors.Is(err, errFaultProfile) {
+			t.Errorf("fault: %s: want %v, got %v", bad, errFaultProfile, err)
+		}
+	}
+	if err := fs.Inject("icmp", "wg0", `{}`, time.Minute); !errors.Is(err, errFaultKind) {
+		t.Errorf("fault: bad kind: want %v, got %v", errFaultKind, err)
+	}
+
+	if err := fs.Inject(FaultProxy, "wg0", `{"name": "flaky", "errevery": 3, "err": "reset", "delayms": 100}`, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Inject(FaultDNS, "wg0", `{"name": "slow", "errrate": 1, "err": "timeout"}`, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	f := fs.For(FaultProxy, "wg0")
+	if f == nil || f.Delay() != 100*time.Millisecond {
+		t.Fatalf("fault: flaky: not in effect, got %v", f)
+	}
+	var fails int
+	for range 9 {
+		if err := f.Fail(); err != nil {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("fault: flaky: want %v, got %v", syscall.ECONNRESET, err)
+			}
+			fails++
+		}
+	}
+	if fails != 3 {
+		t.Errorf("fault: flaky: want 3 of 9 to fail, got %d", fails)
+	}
+	if err := fs.For(FaultDNS, "wg0").Fail(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("fault: slow: want %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+	if s := fs.String(); !strings.Contains(s, "proxy:wg0=flaky;hits=3/9;ttl=1m0s") || !strings.Contains(s, "dns:wg0=slow") {
+		t.Errorf("fault: status %q", s)
+	}
+
+	c.Advance(time.Minute) // flaky expires
+	if f := fs.For(FaultProxy, "wg0"); f != nil {
+		t.Errorf("fault: flaky: want expired, got %v", f)
+	}
+	if fs.For(FaultDNS, "wg0") == nil {
+		t.Error("fault: slow: expired early")
+	}
+	c.Advance(time.Minute) // slow expires
+	if f := fs.For(FaultDNS, "wg0"); f != nil || fs.on.Load() || len(fs.String()) > 0 {
+		t.Errorf("fault: slow: want expired, got %v", f)
+	}
+
+	_ = fs.Inject(FaultDNS, "wg0", `{"name": "long"}`, 24*time.Hour)
+	fs.Clear()
+	if fs.For(FaultDNS, "wg0") != nil {
+		t.Error("fault: long: not cleared")
+	}
+	_ = fs.Inject(FaultDNS, "wg0", `{"name": "long"}`, 24*time.Hour)
+	c.Advance(MaxFaultDuration)
+	if fs.For(FaultDNS, "wg0") != nil {
+		t.Error("fault: long: ttl not capped")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrSuperseded is returned by work given up on as a newer generation of
+// it has begun since; see: Gen.
+var ErrSuperseded = errors.New("superseded")
+
+// Gen hands out monotonically increasing generations of some work (ex:
+// refreshes on network changes, which come in bursts), so that work begun
+// in a generation may abort, and not apply its results, once a newer one
+// begins. The zero value is ready to use.
+type Gen struct {
+	cur  atomic.Uint64 // latest begun
+	done atomic.Uint64 // latest completed
+}
+
+// Next begins a new generation, superseding all before it, and returns it.
+func (g *Gen) Next() uint64 {
+	return g.cur.Add(1)
+}
+
+// Current returns the latest generation begun; 0 if none.
+func (g *Gen) Current() uint64 {
+	return g.cur.Load()
+}
+
+// Completed returns the latest generation marked Done; 0 if none.
+func (g *Gen) Completed() uint64 {
+	return g.done.Load()
+}
+
+// Superseded returns true if a generation newer than gen has begun.
+func (g *Gen) Superseded(gen uint64) bool {
+	return g.cur.Load() > gen
+}
+
+// Done marks gen as completed, unless it is superseded; and returns false
+// if it is, in which case, its results must not be applied.
+func (g *Gen) Done(gen uint64) bool {
+	if g.Superseded(gen) {
+		return false
+	}
+	for {
+		d := g.done.Load()
+		if d >= gen || g.done.CompareAndSwap(d, gen) {
+			return true
+		}
+	}
+}
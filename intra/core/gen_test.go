@@ -0,0 +1,31 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import "testing"
+
+func TestGen(t *testing.T) {
+	var g Gen
+	if g.Current() != 0 || g.Completed() != 0 {
+		t.Fatalf("gen: zero value: %d, %d", g.Current(), g.Completed())
+	}
+
+	g1 := g.Next()
+	g2 := g.Next()
+	if g1 >= g2 || g.Current() != g2 {
+		t.Fatalf("gen: not monotonic: %d, %d; current %d", g1, g2, g.Current())
+	}
+	if !g.Superseded(g1) || g.Superseded(g2) {
+		t.Errorf("gen: superseded? %d: %t, %d: %t", g1, g.Superseded(g1), g2, g.Superseded(g2))
+	}
+	if g.Done(g1) || g.Completed() != 0 {
+		t.Errorf("gen: superseded %d marked done; completed %d", g1, g.Completed())
+	}
+	if !g.Done(g2) || g.Completed() != g2 {
+		t.Errorf("gen: current %d not marked done; completed %d", g2, g.Completed())
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// 4in6 mapped addrs (::ffff:1.2.3.4) are not equal to their ip4 forms
+// (1.2.3.4) in netip, and so, all addrs entering maps, lookups, and
+// comparisons must be normalized by one of the helpers below.
+
+// UnmapAddr returns ip with its 4in6 mapping, if any, removed;
+// ok is false if ip is not valid.
+func UnmapAddr(ip netip.Addr) (out netip.Addr, ok bool) {
+	if !ip.IsValid() {
+		return ip, false
+	}
+	return ip.Unmap(), true
+}
+
+// UnmapAddrPort returns ipp with its ip unmapped; ok is false if ipp
+// is not valid, in which case ipp is returned as-is.
+func UnmapAddrPort(ipp netip.AddrPort) (out netip.AddrPort, ok bool) {
+	if !ipp.IsValid() {
+		return ipp, false
+	}
+	if ip := ipp.Addr(); ip.Is4In6() {
+		return netip.AddrPortFrom(ip.Unmap(), ipp.Port()), true
+	}
+	return ipp, true
+}
+
+// IPFromSlice returns an unmapped ip from b (4 or 16 bytes);
+// ok is false if b is not an ip.
+func IPFromSlice(b []byte) (ip netip.Addr, ok bool) {
+	if ip, ok = netip.AddrFromSlice(b); !ok {
+		return
+	}
+	return UnmapAddr(ip)
+}
+
+// ParseAddr parses s as an ip and unmaps it.
+func ParseAddr(s string) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return ip, err
+	}
+	return ip.Unmap(), nil
+}
+
+// ParseAddrPort parses s as an ip:port and unmaps its ip.
+func ParseAddrPort(s string) (netip.AddrPort, error) {
+	ipp, err := netip.ParseAddrPort(strings.TrimSpace(s))
+	if err != nil {
+		return ipp, err
+	}
+	ipp, _ = UnmapAddrPort(ipp)
+	return ipp, nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestUnmap(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"64:ff9b::102:304", "64:ff9b::102:304"},
+		{"::1", "::1"},
+	}
+	for _, c := range cases {
+		want := netip.MustParseAddr(c.want)
+		if ip, err := ParseAddr(c.in); err != nil || ip != want {
+			t.Errorf("ParseAddr(%s) = %v, %v; want %v", c.in, ip, err, want)
+		}
+		if ip, ok := UnmapAddr(netip.MustParseAddr(c.in)); !ok || ip != want {
+			t.Errorf("UnmapAddr(%s) = %v; want %v", c.in, ip, want)
+		}
+		for _, b := range [][]byte{net.ParseIP(c.in), net.ParseIP(c.in).To4()} {
+			if b == nil {
+				continue
+			}
+			if ip, ok := IPFromSlice(b); !ok || ip != want {
+				t.Errorf("IPFromSlice(%v) = %v; want %v", b, ip, want)
+			}
+		}
+		ipp := netip.AddrPortFrom(netip.MustParseAddr(c.in), 53)
+		if out, ok := UnmapAddrPort(ipp); !ok || out != netip.AddrPortFrom(want, 53) {
+			t.Errorf("UnmapAddrPort(%s) = %v; want %v:53", ipp, out, want)
+		}
+		if out, err := ParseAddrPort(ipp.String()); err != nil || out.Addr() != want {
+			t.Errorf("ParseAddrPort(%s) = %v, %v; want %v", ipp, out, err, want)
+		}
+	}
+	if _, ok := UnmapAddr(netip.Addr{}); ok {
+		t.Error("UnmapAddr: invalid addr ok")
+	}
+	if _, ok := UnmapAddrPort(netip.AddrPort{}); ok {
+		t.Error("UnmapAddrPort: invalid addrport ok")
+	}
+}
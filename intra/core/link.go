@@ -0,0 +1,121 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+)
+
+// Link describes the tunnel's link (tun device) once it is swapped.
+type Link struct {
+	L3  string // settings.IP4, IP6, or IP46; families the link routes
+	MTU int    // mtu of the link; 0 if unchanged (ex: only its routes changed)
+}
+
+// LinkObserver is notified when the tunnel's link is swapped for
+// another (ex: the vpn is re-established on a new network), so that it
+// may drop conclusions drawn on the previous link (ex: answers, nat64
+// prefixes, reachable families).
+type LinkObserver interface {
+	// OnLinkChange is called synchronously, in the order observers were
+	// added; slow work (ex: network i/o) must be done in a goroutine.
+	OnLinkChange(l Link)
+}
+
+// LinkFunc adapts fn to a LinkObserver.
+type LinkFunc func(l Link)
+
+func (fn LinkFunc) OnLinkChange(l Link) { fn(l) }
+
+type linkobs struct {
+	id uint64
+	o  LinkObserver
+}
+
+var links struct {
+	sync.Mutex           // protects obs and next
+	obs        []linkobs // in the order added
+	next       uint64    // id of the next observer
+}
+
+// ObserveLink adds o to be notified of link changes; the returned func
+// removes o, and is safe to call more than once.
+func ObserveLink(o LinkObserver) (cancel func()) {
+	if o == nil {
+		return func() {}
+	}
+	links.Lock()
+	defer links.Unlock()
+
+	links.next++
+	id := links.next
+	links.obs = append(links.obs, linkobs{id, o})
+	return func() {
+		links.Lock()
+		defer links.Unlock()
+		for i, x := range links.obs {
+			if x.id == id {
+				links.obs = append(links.obs[:i:i], links.obs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// LinkChanged notifies all observers of l; returns the number notified.
+func LinkChanged(l Link) int {
+	links.Lock()
+	obs := make([]linkobs, len(links.obs))
+	copy(obs, links.obs)
+	links.Unlock()
+
+	for _, x := range obs {
+		x.o.OnLinkChange(l)
+	}
+	return len(obs)
+}
+
+// ConnWrapper is a conn that wraps another; ex: to keep time of reads and
+// writes over it.
+type ConnWrapper interface {
+	// Unwrap returns the wrapped conn.
+	Unwrap() net.Conn
+}
+
+// Unrouted returns true if any of x is a socket (a syscall.Conn; and not, ex,
+// a conn over a userspace stack) to a remote of a family the link does not
+// route: ip4, unless use4; ip6, unless use6. Loopbacks are always routed.
+// Conns in x are unwrapped, if wrapped; see: ConnWrapper.
+func Unrouted(use4, use6 bool, x ...net.Conn) bool {
+	for _, c := range x {
+		for w, ok := c.(ConnWrapper); ok; w, ok = c.(ConnWrapper) {
+			c = w.Unwrap()
+		}
+		if _, ok := c.(syscall.Conn); !ok {
+			continue
+		}
+		addr := c.RemoteAddr()
+		if addr == nil {
+			continue
+		}
+		ipp, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		ip := ipp.Addr().Unmap()
+		if ip.IsLoopback() {
+			continue
+		}
+		if (ip.Is4() && !use4) || (ip.Is6() && !use6) {
+			return true
+		}
+	}
+	return false
+}
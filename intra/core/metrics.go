@@ -0,0 +1,270 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// max series (distinct label values) per metric; more are folded
+	// into one series whose labels are all set to MetricsOverflow
+	MaxSeries = 256
+	// label value of the series those over MaxSeries are folded into
+	MetricsOverflow = "other"
+)
+
+// types of metrics
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+	MetricSummary = "summary" // sans quantiles; that is, _sum and _count
+)
+
+// Metrics is a registry of counters, gauges, and summaries, rendered in the
+// prometheus text exposition format; while it is off, Add, Set, and Observe
+// are no-ops that return right away, and no series are kept.
+// ref: prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+type Metrics struct {
+	on         atomic.Bool
+	mu         sync.Mutex         // protects fams, collectors
+	fams       map[string]*family // name -> family
+	collectors []func(*Metrics)   // called on every render
+}
+
+type family struct {
+	name, typ, help string
+	labels          []string
+	series          map[string]*series // joined label values -> series
+}
+
+type series struct {
+	vals []string
+	v    float64 // sum for summaries
+	n    uint64  // count for summaries
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{fams: make(map[string]*family)}
+}
+
+// Enable turns m on or off; series kept are forgotten once off.
+func (m *Metrics) Enable(y bool) {
+	if m.on.Swap(y) == y || y {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.fams {
+		clear(f.series)
+	}
+}
+
+// On returns true if m is on.
+func (m *Metrics) On() bool {
+	return m != nil && m.on.Load()
+}
+
+// Register registers metric name of typ (MetricCounter, MetricGauge,
+// MetricSummary) with labels; registering name again is a no-op.
+func (m *Metrics) Register(name, typ, help string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.fams[name]; ok {
+		return
+	}
+	m.fams[name] = &family{
+		name:   name,
+		typ:    typ,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+// Collect has fn called on every render, before metrics are rendered;
+// ex: to Set gauges of values that are kept elsewhere.
+func (m *Metrics) Collect(fn func(*Metrics)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+// Add adds v to counter (or gauge) name of labels vals.
+func (m *Metrics) Add(name string, v float64, vals ...string) {
+	if !m.On() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.seriesLocked(name, vals); s != nil {
+		s.v += v
+	}
+}
+
+// Set sets gauge (or counter kept elsewhere) name of labels vals to v.
+func (m *Metrics) Set(name string, v float64, vals ...string) {
+	if !m.On() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.seriesLocked(name, vals); s != nil {
+		s.v = v
+	}
+}
+
+// Observe adds sample v to summary name of labels vals.
+func (m *Metrics) Observe(name string, v float64, vals ...string) {
+	if !m.On() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.seriesLocked(name, vals); s != nil {
+		s.v += v
+		s.n++
+	}
+}
+
+func (m *Metrics) seriesLocked(name string, vals []string) *series {
+	f, ok := m.fams[name]
+	if !ok || len(vals) != len(f.labels) {
+		return nil // not registered; or a bug
+	}
+	k := strings.Join(vals, "\x00")
+	if s, ok := f.series[k]; ok {
+		return s
+	}
+	if len(f.series) >= MaxSeries {
+		vals = make([]string, len(f.labels))
+		for i := range vals {
+			vals[i] = MetricsOverflow
+		}
+		k = strings.Join(vals, "\x00")
+		if s, ok := f.series[k]; ok {
+			return s
+		}
+	}
+	s := &series{vals: vals}
+	f.series[k] = s
+	return s
+}
+
+// WriteTo renders all metrics to w; implements io.WriterTo.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+	for _, fn := range collectors {
+		fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.fams))
+	for name := range m.fams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, name := range names {
+		f := m.fams[name]
+		if len(f.series) <= 0 {
+			continue
+		}
+		cw.str("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+		cw.str("# TYPE " + f.name + " " + f.typ + "\n")
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			lbl := labelset(f.labels, s.vals)
+			if f.typ == MetricSummary {
+				cw.sample(f.name+"_sum", lbl, s.v)
+				cw.sample(f.name+"_count", lbl, float64(s.n))
+			} else {
+				cw.sample(f.name, lbl, s.v)
+			}
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves all metrics; implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = m.WriteTo(w)
+}
+
+func labelset(labels, vals []string) string {
+	if len(labels) <= 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(vals[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) str(s string) {
+	if c.err != nil {
+		return
+	}
+	n, err := c.w.WriteString(s)
+	c.n += int64(n)
+	c.err = err
+}
+
+func (c *countingWriter) sample(name, lbl string, v float64) {
+	c.str(name + lbl + " " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	// metric{label="value",...} value
+	sampleline = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*",?)*\})? (\S+)$`)
+	// # HELP metric text; # TYPE metric type
+	commentline = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+)
+
+func newTestMetrics() *Metrics {
+	m := NewMetrics()
+	m.Register("test_flows_total", MetricCounter, "Flows.", "proto", "uid")
+	m.Register("test_conns", MetricGauge, "Open conns.", "proto")
+	m.Register("test_latency_seconds", MetricSummary, "Latency\nof \\ queries.", "transport")
+	m.Collect(func(m *Metrics) { m.Set("test_conns", 3, "tcp") })
+	return m
+}
+
+func TestMetricsServeParseable(t *testing.T) {
+	m := newTestMetrics()
+	m.Enable(true)
+	m.Add("test_flows_total", 1, "tcp", "10001")
+	m.Add("test_flows_total", 2, "udp", `we"ird\uid`+"\n")
+	m.Observe("test_latency_seconds", 0.25, "Preferred")
+	m.Observe("test_latency_seconds", 0.5, "Preferred")
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("metrics: content-type %q", ct)
+	}
+
+	types := make(map[string]string)
+	samples := make(map[string]float64)
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if c := commentline.FindStringSubmatch(line); c != nil {
+			if c[1] == "TYPE" {
+				types[c[2]] = c[3]
+			}
+			continue
+		}
+		s := sampleline.FindStringSubmatch(line)
+		if s == nil {
+			t.Fatalf("metrics: unparseable line %q", line)
+		}
+		v, err := strconv.ParseFloat(s[4], 64)
+		if err != nil {
+			t.Fatalf("metrics: %q: bad value: %v", line, err)
+		}
+		samples[s[1]+s[2]] = v
+	}
+
+	want := map[string]float64{
+		`test_flows_total{proto="tcp",uid="10001"}`:          1,
+		`test_flows_total{proto="udp",uid="we\"ird\\uid\n"}`: 2,
+		`test_conns{proto="tcp"}`:                            3,
+		`test_latency_seconds_sum{transport="Preferred"}`:    0.75,
+		`test_latency_seconds_count{transport="Preferred"}`:  2,
+	}
+	for k, v := range want {
+		if got, ok := samples[k]; !ok || got != v {
+			t.Errorf("metrics: %s: want %v, got %v (%t)", k, v, got, ok)
+		}
+	}
+	if types["test_latency_seconds"] != MetricSummary || types["test_conns"] != MetricGauge {
+		t.Errorf("metrics: types: %v", types)
+	}
+}
+
+func TestMetricsCardinalityBounded(t *testing.T) {
+	m := newTestMetrics()
+	m.Enable(true)
+	for uid := range 10 * MaxSeries {
+		m.Add("test_flows_total", 1, "tcp", strconv.Itoa(uid))
+	}
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	n := strings.Count(b.String(), "\ntest_flows_total{")
+	if n > MaxSeries+1 {
+		t.Errorf("metrics: want at most %d series, got %d", MaxSeries+1, n)
+	}
+	other := `test_flows_total{proto="` + MetricsOverflow + `",uid="` + MetricsOverflow + `"} ` + strconv.Itoa(9*MaxSeries)
+	if !strings.Contains(b.String(), other) {
+		t.Errorf("metrics: want overflow series %q", other)
+	}
+}
+
+func TestMetricsOffNoop(t *testing.T) {
+	m := newTestMetrics()
+	m.Add("test_flows_total", 1, "tcp", "10001")
+	m.Enable(true)
+	m.Add("test_flows_total", 1, "tcp", "10001")
+	m.Add("test_unregistered", 1)
+	m.Add("test_flows_total", 1, "tcp") // too few labels
+	m.Enable(false)
+	m.Add("test_flows_total", 1, "tcp", "10001")
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() > 0 {
+		t.Errorf("metrics: off: want nothing rendered, got %q", b.String())
+	}
+}
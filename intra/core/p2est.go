@@ -9,20 +9,22 @@ package core
 import (
 	"math"
 	"sort"
+	"sync"
 )
 
 // from: github.com/celzero/rethink-app/main/app/src/main/java/com/celzero/bravedns/util/P2QuantileEstimation.kt
 // details: aakinshin.net/posts/p2-quantile-estimator/
 // orig impl: github.com/AndreyAkinshin/perfolizer p2.cs
 type p2 struct {
-	p     float64   // percentile
-	u     int       // sample size
-	mid   int       // u / 2
-	n     []int     // marker positions
-	ns    []float64 // desired marker positions
-	dns   []float64
-	q     []float64 // marker heights
-	count int       // total sampled so far
+	sync.Mutex           // protects all below, but p
+	p          float64   // percentile
+	u          int       // sample size
+	mid        int       // u / 2
+	n          []int     // marker positions
+	ns         []float64 // desired marker positions
+	dns        []float64
+	q          []float64 // marker heights
+	count      int       // total sampled so far
 }
 
 // P2QuantileEstimator is an interface for the P2 quantile estimator.
@@ -69,6 +71,9 @@ func (est *p2) P() float64 {
 // Add a sample to the estimator.
 // www.cse.wustl.edu/~jain/papers/ftp/psqr.pdf (p. 1078)
 func (est *p2) Add(x float64) {
+	est.Lock()
+	defer est.Unlock()
+
 	if est.count < est.u {
 		est.q[est.count] = x
 		est.count++
@@ -177,6 +182,9 @@ func (est *p2) linear(i int, d int) float64 {
 
 // Get the estimation for p.
 func (est *p2) Get() int64 {
+	est.Lock()
+	defer est.Unlock()
+
 	c := est.count
 
 	if c > est.u {
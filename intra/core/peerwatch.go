@@ -0,0 +1,143 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCPHealth is a snapshot of the send side of a tcp conn, as seen by its stack.
+type TCPHealth struct {
+	Retrans uint64 // retransmits (and rto timeouts) so far
+	SegsIn  uint64 // segments from the peer (acks, data) so far; 0 if unknown
+	Unacked uint32 // segments sent yet unacked; 0 if unknown
+	ZeroWnd bool   // the peer is being probed, ex: as it advertises a zero window
+}
+
+// TCPProber is a net.Conn that knows its TCPHealth; ok is false if it does not.
+type TCPProber interface {
+	TCPHealth() (h TCPHealth, ok bool)
+}
+
+// HealthOf returns the TCPHealth of c, if c is a TCPProber, or a tcp socket
+// (then, from the kernel's TCP_INFO); ok is false otherwise.
+func HealthOf(c net.Conn) (h TCPHealth, ok bool) {
+	if p, isprober := c.(TCPProber); isprober {
+		return p.TCPHealth()
+	}
+	sc, issocket := c.(syscall.Conn)
+	if !issocket {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = raw.Control(func(fd uintptr) {
+		ti, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil || ti == nil {
+			return
+		}
+		h.Retrans = uint64(ti.Total_retrans)
+		h.SegsIn = uint64(ti.Segs_in)
+		h.Unacked = ti.Unacked
+		// probes are sent to peers with a zero window (or by keepalives)
+		// when there's nothing in flight
+		h.ZeroWnd = ti.Probes > 0 && ti.Unacked == 0
+		ok = true
+	})
+	return
+}
+
+// peerstate is what PeerWatch remembers of conns of an id across checks.
+type peerstate struct {
+	retrans []uint64  // of each conn, as of the last check
+	segsin  []uint64  // of each conn, as of the last check
+	stuck   time.Time // since when; zero if not stuck
+	seen    time.Time // last checked at
+}
+
+// PeerWatch tells if the peers of conns have vanished (ex: without fin or
+// rst, as the wifi ap rebooted) from their TCPHealth across checks: conns
+// are stuck once retransmits climb, or the peer is probed, and remain so
+// while data is unacked, but never while the peer acks (however lossy the
+// path); those stuck for long are deemed dead.
+type PeerWatch struct {
+	mu sync.Mutex
+	m  map[string]*peerstate // id -> state
+}
+
+func NewPeerWatch() *PeerWatch {
+	return &PeerWatch{m: make(map[string]*peerstate)}
+}
+
+// Dead returns true if any of hs (the TCPHealth of conns of id, in the same
+// order on every check) has been stuck for at least d.
+func (w *PeerWatch) Dead(id string, hs []TCPHealth, d time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	st, ok := w.m[id]
+	if !ok {
+		st = &peerstate{}
+		w.m[id] = st
+	}
+	// progress is not known on the first check
+	seen := ok && len(st.retrans) == len(hs)
+	stuck := false
+	for i, h := range hs {
+		climbing := seen && h.Retrans > st.retrans[i]
+		acking := seen && h.SegsIn > st.segsin[i]
+		held := h.ZeroWnd || climbing || (!st.stuck.IsZero() && h.Unacked > 0)
+		stuck = stuck || (held && !acking)
+	}
+	st.retrans = st.retrans[:0]
+	st.segsin = st.segsin[:0]
+	for _, h := range hs {
+		st.retrans = append(st.retrans, h.Retrans)
+		st.segsin = append(st.segsin, h.SegsIn)
+	}
+	st.seen = now
+
+	if !stuck {
+		st.stuck = time.Time{}
+		return false
+	}
+	if st.stuck.IsZero() {
+		st.stuck = now
+	}
+	return now.Sub(st.stuck) >= d
+}
+
+// Forget drops the state of id.
+func (w *PeerWatch) Forget(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.m, id)
+}
+
+// Prune drops the state of ids not checked in the last d, and
+// returns how many remain.
+func (w *PeerWatch) Prune(d time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for id, st := range w.m {
+		if now.Sub(st.seen) >= d {
+			delete(w.m, id)
+		}
+	}
+	return len(w.m)
+}
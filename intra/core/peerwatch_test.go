@@ -0,0 +1,96 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerWatch(t *testing.T) {
+	w := NewPeerWatch()
+	const d = 50 * time.Millisecond
+
+	h := TCPHealth{Retrans: 1, Unacked: 2}
+	if w.Dead("a", []TCPHealth{h}, 0) {
+		t.Error("dead on first check")
+	}
+	h.Retrans++ // climbing
+	if !w.Dead("a", []TCPHealth{h}, 0) {
+		t.Error("not dead as retransmits climb")
+	}
+	if w.Dead("a", []TCPHealth{h}, d) {
+		t.Error("dead before d")
+	}
+	time.Sleep(d)
+	if !w.Dead("a", []TCPHealth{h}, d) { // stuck while unacked
+		t.Error("not dead after d")
+	}
+	h.Unacked = 0 // acked
+	if w.Dead("a", []TCPHealth{h}, 0) {
+		t.Error("dead once acked")
+	}
+
+	// lossy, but the peer acks
+	l := TCPHealth{Retrans: 1, Unacked: 2}
+	w.Dead("l", []TCPHealth{l}, 0)
+	l.Retrans++
+	l.SegsIn++
+	if w.Dead("l", []TCPHealth{l}, 0) {
+		t.Error("dead as retransmits climb while the peer acks")
+	}
+	l.Retrans++ // and no acks since
+	if !w.Dead("l", []TCPHealth{l}, 0) {
+		t.Error("not dead as retransmits climb sans acks")
+	}
+
+	// acks on one conn of an id do not keep the other alive
+	src, dst := TCPHealth{}, TCPHealth{Retrans: 1, Unacked: 1}
+	w.Dead("p", []TCPHealth{src, dst}, 0)
+	src.SegsIn++
+	dst.Retrans++
+	if !w.Dead("p", []TCPHealth{src, dst}, 0) {
+		t.Error("not dead as retransmits climb on dst while src acks")
+	}
+
+	if !w.Dead("z", []TCPHealth{{ZeroWnd: true}}, 0) {
+		t.Error("not dead with zero window")
+	}
+	if w.Dead("z", []TCPHealth{{}}, 0) {
+		t.Error("dead once window opens")
+	}
+
+	time.Sleep(d)
+	w.Dead("b", []TCPHealth{{}}, d)
+	if n := w.Prune(d); n != 1 {
+		t.Errorf("pruned to %d; want 1", n)
+	}
+}
+
+func TestHealthOf(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, ok := HealthOf(a); ok {
+		t.Error("health of a pipe")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Close()
+	if h, ok := HealthOf(c); !ok || h.Retrans != 0 || h.SegsIn <= 0 { // syn-ack
+		t.Errorf("health of a fresh tcp conn: %v %t", h, ok)
+	}
+}
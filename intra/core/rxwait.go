@@ -0,0 +1,35 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// AwaitRx waits till c, if a socket, has data (a datagram, for udp) queued
+// to read, or till its read deadline; without reading it, and so, without
+// holding a buffer. ok is false if c is not a socket, and was not waited on.
+// Errors queued on the socket (ex: icmp port unreachable) end the wait, and
+// are left for the next read to return.
+func AwaitRx(c any) (ok bool, err error) {
+	sc, issocket := c.(syscall.Conn)
+	if !issocket {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	var one [1]byte
+	err = raw.Read(func(fd uintptr) bool {
+		_, _, perr := unix.Recvfrom(int(fd), one[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		return perr != unix.EAGAIN && perr != unix.EWOULDBLOCK // else, wait
+	})
+	return true, err
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAwaitRx(t *testing.T) {
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.DialUDP("udp", nil, a.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if ok, err := AwaitRx(a); !ok || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("rxwait: nothing sent: want timeout, got %t, %v", ok, err)
+	}
+
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Write([]byte("late reply"))
+	}()
+	if ok, err := AwaitRx(a); !ok || err != nil {
+		t.Fatalf("rxwait: sent: got %t, %v", ok, err)
+	}
+	// the datagram is left whole for the read
+	buf := make([]byte, 64)
+	if n, _, err := a.ReadFrom(buf); err != nil || string(buf[:n]) != "late reply" {
+		t.Errorf("rxwait: read %q, %v", buf[:n], err)
+	}
+
+	p, q := net.Pipe()
+	defer p.Close()
+	defer q.Close()
+	if ok, err := AwaitRx(p); ok || err != nil {
+		t.Errorf("rxwait: not a socket: got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"bytes"
+	"regexp"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// protocols Sniff guesses.
+const (
+	SniffTLS  = "tls"
+	SniffHTTP = "http"
+	SniffQUIC = "quic"
+)
+
+const (
+	tlsClientHello = 1
+	tlsServerName  = 0 // extension
+	sniHostName    = 0 // name type
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+// headers whose values are redacted from plaintext http
+var httpSecretHeaders = [][]byte{
+	[]byte("authorization:"), []byte("proxy-authorization:"), []byte("cookie:"),
+	[]byte("x-api-key:"), []byte("x-auth-token:"), []byte("x-access-token:"),
+}
+
+// query params (and form fields) whose values are redacted from plaintext http
+var httpSecretParams = regexp.MustCompile(`(?i)(?:^|[?&;\s])(?:pass(?:word|wd)?|pwd|token|secret|api_?key|key|auth|session|sid|sig(?:nature)?)=([^&\s]*)`)
+
+// Sniff guesses the protocol of b, the first bytes a client sent, and the
+// host it is meant for, if any: the SNI of a TLS ClientHello, or the Host of
+// an HTTP request. Neither is returned if b is none of SniffTLS, SniffHTTP,
+// or SniffQUIC (whose hosts are in encrypted initial packets).
+func Sniff(b []byte) (proto, host string) {
+	switch {
+	case len(b) >= 5 && b[0] == tlsRecHandshake && b[1] == 3:
+		return SniffTLS, sni(b[5:])
+	case isHTTP(b):
+		return SniffHTTP, httpHost(b)
+	case isQUIC(b):
+		return SniffQUIC, ""
+	}
+	return
+}
+
+// sni returns the server name in hs, the handshake messages of
+// the first tls record of a client; "" if there is none.
+func sni(hs []byte) string {
+	s := cryptobyte.String(hs)
+	var typ uint8
+	var sid, ciphers, comps, exts cryptobyte.String
+	// type(1) length(3); the message may be cut short, and so, its
+	// length is not checked against what is left of hs
+	if !s.ReadUint8(&typ) || typ != tlsClientHello || !s.Skip(3) ||
+		!s.Skip(2+32) || // version, random
+		!s.ReadUint8LengthPrefixed(&sid) ||
+		!s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&comps) ||
+		!s.ReadUint16LengthPrefixed(&exts) {
+		return ""
+	}
+	for !exts.Empty() {
+		var etyp uint16
+		var ext, names cryptobyte.String
+		if !exts.ReadUint16(&etyp) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return ""
+		}
+		if etyp != tlsServerName || !ext.ReadUint16LengthPrefixed(&names) {
+			continue
+		}
+		for !names.Empty() {
+			var ntyp uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&ntyp) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if ntyp == sniHostName {
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+// IsClientHello returns true if b begins with a tls handshake record of a
+// plausible version (ssl 3.0 to tls 1.3) whose first message is a ClientHello.
+func IsClientHello(b []byte) bool {
+	return len(b) >= 6 && b[0] == tlsRecHandshake && b[1] == 3 && b[2] <= 4 && b[5] == tlsClientHello
+}
+
+func isHTTP(b []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpHost returns the value of the Host header in request b, if any.
+func httpHost(b []byte) string {
+	for _, line := range bytes.Split(b, []byte("\r\n"))[1:] {
+		if len(line) <= 0 { // end of headers
+			break
+		}
+		k, v, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(bytes.TrimSpace(k), []byte("host")) {
+			return string(bytes.TrimSpace(v))
+		}
+	}
+	return ""
+}
+
+// isQUIC returns true if b is a quic long header packet; rfc9000 sec 17.2
+func isQUIC(b []byte) bool {
+	// header form (1) fixed bit (1) ...; version(4)
+	if len(b) < 5 || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch v := uint32(b[1])<<24 | uint32(b[2])<<16 | uint32(b[3])<<8 | uint32(b[4]); v {
+	case 0x00000001, 0x6b3343cf: // v1, v2
+		return true
+	default: // drafts
+		return v>>8 == 0xff0000
+	}
+}
+
+// Redact returns a copy of b with values that look like credentials in a
+// plaintext http request (ex: the Authorization header, "password=" params)
+// masked; b as-is if it is not http.
+func Redact(b []byte) []byte {
+	if !isHTTP(b) {
+		return b
+	}
+	out := bytes.Clone(b)
+	mask := func(x []byte) {
+		for i := range x {
+			x[i] = '*'
+		}
+	}
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		lower := bytes.ToLower(line)
+		for _, h := range httpSecretHeaders {
+			if bytes.HasPrefix(lower, h) {
+				mask(bytes.TrimRight(line[len(h):], "\r\n"))
+			}
+		}
+	}
+	for _, m := range httpSecretParams.FindAllSubmatchIndex(out, -1) {
+		if s, e := m[2], m[3]; s >= 0 { // the value
+			mask(out[s:e])
+		}
+	}
+	return out
+}
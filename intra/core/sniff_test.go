@@ -0,0 +1,89 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first bytes a tls client sends to sni.
+func clientHello(t *testing.T, sni string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		cli := tls.Client(c, &tls.Config{ServerName: sni})
+		_ = cli.Handshake()
+	}()
+	b := make([]byte, 4096)
+	_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := s.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return b[:n]
+}
+
+func TestSniff(t *testing.T) {
+	hello := clientHello(t, "blocked.example.com")
+	if p, h := Sniff(hello); p != SniffTLS || h != "blocked.example.com" {
+		t.Errorf("tls: %s %s", p, h)
+	}
+	if p, h := Sniff(hello[:64]); p != SniffTLS || h != "" { // cut short
+		t.Errorf("tls cut: %s %s", p, h)
+	}
+	req := []byte("GET /x HTTP/1.1\r\nHost: plain.example.com\r\nAccept: */*\r\n\r\n")
+	if p, h := Sniff(req); p != SniffHTTP || h != "plain.example.com" {
+		t.Errorf("http: %s %s", p, h)
+	}
+	quic := []byte{0xc3, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	if p, _ := Sniff(quic); p != SniffQUIC {
+		t.Errorf("quic: %s", p)
+	}
+	if p, h := Sniff([]byte{1, 2, 3}); p != "" || h != "" {
+		t.Errorf("junk: %s %s", p, h)
+	}
+	if !IsClientHello(hello) || !IsClientHello(hello[:6]) {
+		t.Error("hello: not a client hello")
+	}
+	for _, b := range [][]byte{req, quic, hello[:5], {22, 3, 9, 0, 1, 1}, {22, 3, 3, 0, 1, 2}} {
+		if IsClientHello(b) {
+			t.Errorf("%v: is a client hello", b)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	req := []byte("POST /login?user=a&password=hunter2&monkey=ok HTTP/1.1\r\n" +
+		"Host: x.example\r\nAuthorization: Bearer abc\r\nCookie: sid=1\r\n\r\ntoken=xyz")
+	out := Redact(req)
+	for _, secret := range []string{"hunter2", "Bearer abc", "sid=1", "xyz"} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("%q not redacted: %q", secret, out)
+		}
+	}
+	for _, kept := range []string{"user=a", "monkey=ok", "Host: x.example"} {
+		if !strings.Contains(string(out), kept) {
+			t.Errorf("%q redacted: %q", kept, out)
+		}
+	}
+	if len(out) != len(req) {
+		t.Errorf("len %d; want %d", len(out), len(req))
+	}
+	if !bytes.Contains(req, []byte("hunter2")) {
+		t.Error("redacted in place")
+	}
+	tlsb := []byte{22, 3, 1, 0, 5}
+	if !bytes.Equal(Redact(tlsb), tlsb) {
+		t.Error("non-http redacted")
+	}
+}
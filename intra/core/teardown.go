@@ -0,0 +1,86 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often End reaps, as it waits for goroutines to return
+const teardowntick = 20 * time.Millisecond
+
+// Teardown tracks goroutines of some work (ex: flows of a handler) so that
+// they may all be ended at once: once End is called, Go runs no more of
+// them, Done is closed, and End waits (up to a bound) for those running to
+// return. Goroutines must select on Done wherever they wait on anything
+// other than conns, which End has reaped instead.
+type Teardown struct {
+	ended atomic.Bool
+	n     atomic.Int64 // goroutines running
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewTeardown returns a Teardown yet to end.
+func NewTeardown() *Teardown {
+	return &Teardown{done: make(chan struct{})}
+}
+
+// Go runs f in a goroutine, and returns true; or returns false, if ended.
+func (t *Teardown) Go(f func()) bool {
+	t.n.Add(1) // before the check, so that End waits on f if it is run
+	if t.ended.Load() {
+		t.n.Add(-1)
+		return false
+	}
+	go func() {
+		defer t.n.Add(-1)
+		f()
+	}()
+	return true
+}
+
+// Done returns a chan closed once End is called.
+func (t *Teardown) Done() <-chan struct{} {
+	return t.done
+}
+
+// Ended returns true once End is called.
+func (t *Teardown) Ended() bool {
+	return t.ended.Load()
+}
+
+// Running returns the number of goroutines yet to return.
+func (t *Teardown) Running() int64 {
+	return t.n.Load()
+}
+
+// End stops Go from running goroutines, closes Done, and waits up to d for
+// goroutines to return, calling reap (may be nil; ex: to close their conns)
+// right away, and every so often while waiting. Returns false if goroutines
+// are still running after d. Safe to call more than once.
+func (t *Teardown) End(d time.Duration, reap func()) bool {
+	t.once.Do(func() {
+		t.ended.Store(true)
+		close(t.done)
+	})
+	deadline := time.Now().Add(d)
+	for {
+		if reap != nil { // conns of goroutines that began just before End, too
+			reap()
+		}
+		if t.n.Load() <= 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(teardowntick)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTeardown(t *testing.T) {
+	const flows = 50
+	const bound = 2 * time.Second
+
+	td := NewTeardown()
+	cm := NewConnMap()
+
+	var upstreams []net.Conn
+	for i := 0; i < flows; i++ {
+		local, remote := net.Pipe()
+		upstream, peer := net.Pipe()
+		upstreams = append(upstreams, upstream)
+		cid := strconv.Itoa(i)
+		// a flow: relays local and upstream till either closes
+		ok := td.Go(func() {
+			if n := cm.Track(cid, local, upstream); n <= 0 {
+				return
+			}
+			defer cm.Untrack(cid)
+			go func() { _, _ = io.Copy(upstream, local) }()
+			_, _ = io.Copy(local, upstream)
+		})
+		if !ok {
+			t.Fatalf("flow %d not run", i)
+		}
+		// ends of the app and of the server, never closed by them
+		_ = remote
+		_ = peer
+	}
+	// an ingress loop: waits on something other than conns
+	td.Go(func() {
+		<-td.Done()
+	})
+
+	for cm.Len() < flows { // flows tracked
+		time.Sleep(time.Millisecond)
+	}
+	if n := td.Running(); n != flows+1 {
+		t.Fatalf("running %d; want %d", n, flows+1)
+	}
+
+	start := time.Now()
+	if !td.End(bound, func() { cm.Clear() }) {
+		t.Fatalf("running %d after %s", td.Running(), bound)
+	}
+	if d := time.Since(start); d > bound {
+		t.Errorf("ended in %s; want within %s", d, bound)
+	}
+	if n := td.Running(); n != 0 {
+		t.Errorf("running %d; want 0", n)
+	}
+	for i, c := range upstreams {
+		if _, err := c.Write([]byte{1}); err == nil {
+			t.Errorf("upstream %d open", i)
+		}
+	}
+	if !td.Ended() {
+		t.Error("not ended")
+	}
+	if td.Go(func() { t.Error("run after end") }) {
+		t.Error("go after end")
+	}
+	select {
+	case <-td.Done():
+	default:
+		t.Error("done not closed")
+	}
+	if !td.End(bound, nil) { // again
+		t.Error("end again")
+	}
+}
+
+func TestTeardownBound(t *testing.T) {
+	td := NewTeardown()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	td.Go(func() { <-stuck }) // ignores Done
+
+	const bound = 100 * time.Millisecond
+	start := time.Now()
+	if td.End(bound, nil) {
+		t.Error("ended with a goroutine running")
+	}
+	if d := time.Since(start); d > 10*bound {
+		t.Errorf("end took %s; want about %s", d, bound)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"crypto/x509"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// MaxTLSObserved is the most bytes of the server's side of a flow that
+// TLSObserver looks at; cert chains in the wild mostly fit in it.
+const MaxTLSObserved = 16 << 10
+
+// tls record and handshake message types; see: rfc8446 sec 5.1 & 4
+const (
+	tlsRecHandshake  = 22
+	tlsServerHello   = 2
+	tlsCertificate   = 11
+	tlsHelloDone     = 14
+	tlsSupportedVers = 43 // extension
+	tlsVersion12     = 0x0303
+)
+
+// TLSVersion13 is the version TLSObserver reports for TLS 1.3 flows.
+const TLSVersion13 = 0x0304
+
+// TLSObserver passively parses the server's side of a TLS handshake, as
+// it is copied to the client, for the version the server picked and the
+// leaf of the cert chain it sent. TLS 1.3 encrypts the chain, and so, only
+// its version is seen. Not safe for concurrent use.
+type TLSObserver struct {
+	// Version is the TLS version the server picked; 0 if not seen.
+	Version uint16
+	// Leaf is the server's leaf cert; nil if not seen.
+	Leaf *x509.Certificate
+
+	rec  []byte // bytes of records yet to be parsed
+	hs   []byte // bytes of handshake messages yet to be parsed
+	seen int    // bytes observed so far
+	msgs int    // handshake messages parsed so far
+	done bool
+}
+
+// Observe parses b, the next bytes sent by the server, and returns true
+// once nothing more is to be learnt from the flow; ex: it is not TLS, the
+// leaf cert was seen, or MaxTLSObserved bytes were observed.
+func (o *TLSObserver) Observe(b []byte) (done bool) {
+	if o.done {
+		return true
+	}
+	n := min(len(b), MaxTLSObserved-o.seen)
+	o.seen += n
+	o.rec = append(o.rec, b[:n]...)
+
+	for !o.done && len(o.rec) >= 5 {
+		// type(1) version(2) length(2); only handshake records, which
+		// are all in the clear, precede the server's cert chain
+		if o.rec[0] != tlsRecHandshake || o.rec[1] != 3 {
+			o.done = true
+			break
+		}
+		sz := int(o.rec[3])<<8 | int(o.rec[4])
+		if len(o.rec) < 5+sz {
+			break
+		}
+		o.hs = append(o.hs, o.rec[5:5+sz]...)
+		o.rec = o.rec[5+sz:]
+		o.handshake()
+	}
+	if o.seen >= MaxTLSObserved {
+		o.done = true
+	}
+	if o.done {
+		o.rec, o.hs = nil, nil
+	}
+	return o.done
+}
+
+// Done returns true if Observe is done with the flow.
+func (o *TLSObserver) Done() bool {
+	return o.done
+}
+
+// handshake parses whole handshake messages in o.hs.
+func (o *TLSObserver) handshake() {
+	for !o.done && len(o.hs) >= 4 {
+		// type(1) length(3)
+		sz := int(o.hs[1])<<16 | int(o.hs[2])<<8 | int(o.hs[3])
+		if len(o.hs) < 4+sz {
+			return
+		}
+		typ, msg := o.hs[0], o.hs[4:4+sz]
+		o.hs = o.hs[4+sz:]
+		o.msgs++
+
+		switch {
+		case o.msgs == 1 && typ != tlsServerHello: // not a server's flight
+			o.done = true
+		case typ == tlsServerHello:
+			o.done = !o.serverHello(msg) || o.Version >= TLSVersion13
+		case typ == tlsCertificate:
+			o.certificate(msg)
+			o.done = true
+		case typ == tlsHelloDone: // sans certs; ex: psk
+			o.done = true
+		}
+	}
+}
+
+// serverHello sets o.Version from msg; returns false if msg is malformed.
+func (o *TLSObserver) serverHello(msg []byte) bool {
+	s := cryptobyte.String(msg)
+	var vers uint16
+	var sid, exts cryptobyte.String
+	if !s.ReadUint16(&vers) || !s.Skip(32) || // random
+		!s.ReadUint8LengthPrefixed(&sid) || !s.Skip(2+1) { // cipher, compression
+		return false
+	}
+	o.Version = vers
+	if s.Empty() { // no extensions
+		return true
+	}
+	if !s.ReadUint16LengthPrefixed(&exts) {
+		return false
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return false
+		}
+		// tls1.3 sets legacy_version to tls1.2, and the real one in an ext
+		if typ == tlsSupportedVers && vers == tlsVersion12 {
+			if !ext.ReadUint16(&vers) {
+				return false
+			}
+			o.Version = vers
+		}
+	}
+	return true
+}
+
+// certificate sets o.Leaf from msg (TLS 1.2 and older), if it parses.
+func (o *TLSObserver) certificate(msg []byte) {
+	s := cryptobyte.String(msg)
+	var certs, leaf cryptobyte.String
+	if !s.ReadUint24LengthPrefixed(&certs) || !certs.ReadUint24LengthPrefixed(&leaf) {
+		return
+	}
+	if c, err := x509.ParseCertificate(leaf); err == nil {
+		o.Leaf = c
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recConn records bytes written to it.
+type recConn struct {
+	net.Conn
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (c *recConn) Write(b []byte) (int, error) {
+	c.Lock()
+	c.b.Write(b)
+	c.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recConn) bytes() []byte {
+	c.Lock()
+	defer c.Unlock()
+	return bytes.Clone(c.b.Bytes())
+}
+
+func selfSigned(t *testing.T, cn string) tls.Certificate {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: k}
+}
+
+// serverFlight returns bytes a tls server (of at most version max) sent
+// during a handshake with a client.
+func serverFlight(t *testing.T, cert tls.Certificate, max uint16) []byte {
+	c, s := net.Pipe()
+	rs := &recConn{Conn: s}
+	srv := tls.Server(rs, &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: max})
+	cli := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close() // not srv & cli, which wait on close_notify to be read
+	defer s.Close()
+
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Handshake() }()
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return rs.bytes()
+}
+
+func observe(b []byte, chunk int) *TLSObserver {
+	o := new(TLSObserver)
+	for len(b) > 0 && !o.Observe(b[:min(chunk, len(b))]) {
+		b = b[min(chunk, len(b)):]
+	}
+	return o
+}
+
+func TestTLSObserver(t *testing.T) {
+	cert := selfSigned(t, "tlsobs.test")
+
+	b12 := serverFlight(t, cert, tls.VersionTLS12)
+	for _, chunk := range []int{1, 7, 1500, len(b12)} {
+		o := observe(b12, chunk)
+		if !o.Done() || o.Version != tls.VersionTLS12 {
+			t.Fatalf("tls12(%d): done? %t vers %x", chunk, o.Done(), o.Version)
+		}
+		if o.Leaf == nil || !bytes.Equal(o.Leaf.Raw, cert.Certificate[0]) {
+			t.Fatalf("tls12(%d): leaf not seen", chunk)
+		}
+	}
+
+	o := observe(serverFlight(t, cert, tls.VersionTLS13), 100)
+	if !o.Done() || o.Version != TLSVersion13 || o.Leaf != nil {
+		t.Errorf("tls13: done? %t vers %x leaf? %t", o.Done(), o.Version, o.Leaf != nil)
+	}
+
+	o = observe([]byte("HTTP/1.1 200 OK\r\n\r\n"), 100)
+	if !o.Done() || o.Version != 0 || o.Leaf != nil {
+		t.Errorf("http: done? %t vers %x", o.Done(), o.Version)
+	}
+
+	// a record that never ends is given up on after MaxTLSObserved bytes
+	o = observe(append([]byte{22, 3, 3, 0xff, 0xff}, make([]byte, 2*MaxTLSObserved)...), 4096)
+	if !o.Done() || o.Leaf != nil {
+		t.Errorf("long: done? %t", o.Done())
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// max events recorded per trace; the rest are counted, but dropped
+	MaxTraceEvents = 2048
+	// traces end after at most this long
+	MaxTraceDuration = 30 * time.Minute
+	// events queued for the sink; more are left out of it (but recorded)
+	traceSinkQueue = 256
+)
+
+// stage of the trace that marks it as capped
+const TraceCapped = "capped"
+
+var errTraceSelector = errors.New("trace: selector must be dom:<domain> or uid:<uid>")
+
+// TraceSink receives events (one-line json) of trace id as they are recorded.
+type TraceSink func(id, event string)
+
+// Trace records events of every stage of queries and flows that match
+// its selector (a domain and its subdomains; or a uid); see: StartTrace.
+type Trace struct {
+	ID   string
+	dom  string // sans the trailing period, lowercase
+	uid  string
+	seq  atomic.Int32
+	q    chan string   // events to sink; nil if no sink
+	done chan struct{} // closed once the trace ends
+	once sync.Once
+
+	mu  sync.Mutex // protects evs
+	evs []string
+}
+
+type traceEvent struct {
+	Trace string `json:"trace"`
+	Seq   int32  `json:"seq"`
+	At    int64  `json:"at"` // unix millis
+	Stage string `json:"stage"`
+	Msg   string `json:"msg,omitempty"`
+}
+
+var (
+	// the trace in progress, if any
+	curtrace atomic.Pointer[Trace]
+	// the trace started last, if any; its events outlive it
+	lasttrace atomic.Pointer[Trace]
+)
+
+// StartTrace traces queries and flows that match selector, "dom:<domain>"
+// or "uid:<uid>", for d (capped to MaxTraceDuration), and ends the trace
+// in progress, if any; events are sent to sink (if not nil), in order.
+func StartTrace(selector string, d time.Duration, sink TraceSink) (*Trace, error) {
+	kind, v, _ := strings.Cut(selector, ":")
+	v = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(v), "."))
+	if len(v) <= 0 || d <= 0 {
+		return nil, errTraceSelector
+	}
+	t := &Trace{
+		ID:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		done: make(chan struct{}),
+	}
+	switch kind {
+	case "dom":
+		t.dom = v
+	case "uid":
+		t.uid = v
+	default:
+		return nil, errTraceSelector
+	}
+	if sink != nil {
+		t.q = make(chan string, traceSinkQueue)
+		go t.deliver(sink)
+	}
+
+	d = min(d, MaxTraceDuration)
+	lasttrace.Store(t)
+	if prev := curtrace.Swap(t); prev != nil {
+		prev.end()
+	}
+	time.AfterFunc(d, func() {
+		curtrace.CompareAndSwap(t, nil)
+		t.end()
+	})
+	return t, nil
+}
+
+// StopTrace ends the trace in progress, if any.
+func StopTrace() {
+	if t := curtrace.Swap(nil); t != nil {
+		t.end()
+	}
+}
+
+// LastTrace returns the trace in progress, or the one that ended last,
+// if its id is id; nil otherwise.
+func LastTrace(id string) *Trace {
+	if t := lasttrace.Load(); t != nil && t.ID == id {
+		return t
+	}
+	return nil
+}
+
+// Traced returns the trace in progress if domains (csv) or uid match it;
+// nil otherwise. It is a single atomic load if there is no trace.
+func Traced(domains, uid string) *Trace {
+	t := curtrace.Load()
+	if t == nil {
+		return nil
+	}
+	if len(t.uid) > 0 {
+		if uid == t.uid {
+			return t
+		}
+		return nil
+	}
+	for _, d := range strings.Split(domains, ",") {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		if d == t.dom || strings.HasSuffix(d, "."+t.dom) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Event records stage of t, with msg formatted as per format; t may be nil.
+func (t *Trace) Event(stage, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	n := t.seq.Add(1)
+	if n > MaxTraceEvents+1 {
+		return
+	} else if n > MaxTraceEvents {
+		stage, format, args = TraceCapped, "events over %d are dropped", []any{MaxTraceEvents}
+	}
+	b, err := json.Marshal(traceEvent{
+		Trace: t.ID,
+		Seq:   n,
+		At:    time.Now().UnixMilli(),
+		Stage: stage,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+	if err != nil {
+		return
+	}
+	ev := string(b)
+
+	t.mu.Lock()
+	t.evs = append(t.evs, ev)
+	t.mu.Unlock()
+
+	if t.q != nil {
+		select {
+		case <-t.done:
+		case t.q <- ev:
+		default: // sink is behind; ev is only recorded
+		}
+	}
+}
+
+// Events returns events recorded so far, one per line, in order.
+func (t *Trace) Events() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.evs, "\n")
+}
+
+// Done returns true if t has ended.
+func (t *Trace) Done() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Trace) end() {
+	t.once.Do(func() { close(t.done) })
+}
+
+// deliver sends queued events to sink until t ends, and then those
+// still queued.
+func (t *Trace) deliver(sink TraceSink) {
+	for {
+		select {
+		case ev := <-t.q:
+			sink(t.ID, ev)
+		case <-t.done:
+			for {
+				select {
+				case ev := <-t.q:
+					sink(t.ID, ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceSelectors(t *testing.T) {
+	defer StopTrace()
+
+	for _, bad := range []string{"", "dom:", "uid:", "ip:1.1.1.1", "example.com"} {
+		if _, err := StartTrace(bad, time.Minute, nil); err == nil {
+			t.Errorf("trace: %q: want err", bad)
+		}
+	}
+
+	if _, err := StartTrace("dom:Example.com.", time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	for doms, want := range map[string]bool{
+		"example.com":              true,
+		"www.example.com.":         true,
+		"cdn.net,WWW.Example.Com.": true,
+		"badexample.com":           false,
+		"example.com.evil":         false,
+		"":                         false,
+	} {
+		if got := Traced(doms, "10234") != nil; got != want {
+			t.Errorf("trace: dom: %q: want %t, got %t", doms, want, got)
+		}
+	}
+
+	if _, err := StartTrace("uid:10234", time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	if Traced("example.com", "10235") != nil || Traced("", "10234") == nil {
+		t.Error("trace: uid: mismatched")
+	}
+
+	StopTrace()
+	if Traced("example.com", "10234") != nil {
+		t.Error("trace: stopped: want no trace")
+	}
+}
+
+func TestTraceEvents(t *testing.T) {
+	defer StopTrace()
+
+	var mu sync.Mutex
+	var got []string
+	sink := func(id, ev string) {
+		mu.Lock()
+		got = append(got, ev)
+		mu.Unlock()
+	}
+	tr, err := StartTrace("uid:10234", time.Minute, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range MaxTraceEvents + 10 {
+		Traced("", "10234").Event("dial", "attempt %d", i)
+	}
+	Traced("", "10235").Event("dial", "not traced") // nil trace
+
+	lines := strings.Split(tr.Events(), "\n")
+	if len(lines) != MaxTraceEvents+1 {
+		t.Fatalf("trace: want %d events, got %d", MaxTraceEvents+1, len(lines))
+	}
+	var first, last traceEvent
+	_ = json.Unmarshal([]byte(lines[0]), &first)
+	_ = json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if first.Trace != tr.ID || first.Seq != 1 || first.Stage != "dial" || first.Msg != "attempt 0" {
+		t.Errorf("trace: first: %+v", first)
+	}
+	if last.Stage != TraceCapped {
+		t.Errorf("trace: last: want capped, got %+v", last)
+	}
+
+	StopTrace()
+	if !tr.Done() || LastTrace(tr.ID) != tr || LastTrace("nope") != nil {
+		t.Error("trace: not ended, or not retrievable")
+	}
+	// the sink gets events in order, if not all of them
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) <= 0 || got[0] != lines[0] {
+		t.Fatalf("trace: sink: got %d events", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		var a, b traceEvent
+		_ = json.Unmarshal([]byte(got[i-1]), &a)
+		_ = json.Unmarshal([]byte(got[i]), &b)
+		if a.Seq >= b.Seq {
+			t.Fatalf("trace: sink: out of order %d, %d", a.Seq, b.Seq)
+		}
+	}
+}
+
+func TestTraceExpires(t *testing.T) {
+	defer StopTrace()
+
+	tr, _ := StartTrace("dom:example.com", 20*time.Millisecond, nil)
+	next, _ := StartTrace("dom:example.org", time.Minute, nil)
+	if !tr.Done() || Traced("example.com", "") != nil {
+		t.Error("trace: not replaced")
+	}
+	time.Sleep(50 * time.Millisecond)
+	// an expired trace does not end the one that replaced it
+	if next.Done() || Traced("example.org", "") != next {
+		t.Error("trace: next ended")
+	}
+
+	last, _ := StartTrace("dom:example.net", 20*time.Millisecond, nil)
+	time.Sleep(50 * time.Millisecond)
+	if !last.Done() || Traced("example.net", "") != nil {
+		t.Error("trace: not expired")
+	}
+}
+
+func BenchmarkTracedOff(b *testing.B) {
+	StopTrace()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Traced("www.example.com", "10234").Event("dial", "attempt %d", i)
+	}
+}
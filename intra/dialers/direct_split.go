@@ -17,6 +17,7 @@ package dialers
 import (
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/celzero/firestack/intra/protect"
 )
@@ -31,15 +32,20 @@ type DuplexConn interface {
 
 type splitter struct {
 	*net.TCPConn
-	used bool // Initially false.  Becomes true after the first write.
+	used  bool        // Initially false.  Becomes true after the first write.
+	split atomic.Bool // true if the first write was split
 }
 
-// split returns a DuplexConn that always splits the initial upstream segment.
+var _ Splitter = (*splitter)(nil)
+
+// split returns a DuplexConn that splits the initial upstream segment, if
+// it is a tls ClientHello; see: SplitPorts.
 func split(c *net.TCPConn) DuplexConn {
 	return &splitter{TCPConn: c}
 }
 
-// DialWithSplit returns a TCP connection that always splits the initial upstream segment.
+// DialWithSplit returns a TCP connection that splits the initial upstream segment,
+// if it is a tls ClientHello, whatever the port; see: SplitPorts.
 // Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
 func DialWithSplit(d *protect.RDial, addr *net.TCPAddr) (DuplexConn, error) {
@@ -63,6 +69,10 @@ func (s *splitter) Write(b []byte) (int, error) {
 
 	// Setting `used` to true ensures that this code only runs once per socket.
 	s.used = true
+	if !shouldSplit(portOf(conn.RemoteAddr()), b) {
+		return conn.Write(b)
+	}
+	s.split.Store(true)
 	b1, b2 := splitHello(b)
 	n1, err := conn.Write(b1)
 	if err != nil {
@@ -72,6 +82,11 @@ func (s *splitter) Write(b []byte) (int, error) {
 	return n1 + n2, err
 }
 
+// Split implements Splitter.
+func (s *splitter) Split() bool {
+	return s.split.Load()
+}
+
 func (s *splitter) ReadFrom(reader io.Reader) (bytes int64, err error) {
 	if !s.used {
 		// This is the first write on this socket.
@@ -0,0 +1,291 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// ClientHello profiles; see: settings.SetTLSHello
+const (
+	// HelloGo is crypto/tls, as-is; the default.
+	HelloGo = "go"
+	// HelloRandomized is crypto/tls with a random subset of cipher suites
+	// and curves, in random order, on every handshake.
+	HelloRandomized = "randomized"
+	// HelloChrome parrots Chrome; needs the utls build tag.
+	HelloChrome = "chrome"
+	// HelloFirefox parrots Firefox; needs the utls build tag.
+	HelloFirefox = "firefox"
+)
+
+var errNoHello = errors.New("tls: no such hello profile")
+
+// HelloConn is a tls client conn.
+type HelloConn interface {
+	net.Conn
+	HandshakeContext(context.Context) error
+	ConnectionState() tls.ConnectionState
+}
+
+// Hello makes tls client conns that say hello as per its profile.
+type Hello interface {
+	// Client returns a tls client conn over c, yet to handshake. Client
+	// must honour cfg's ServerName, NextProtos (alpn), ClientSessionCache
+	// (resumption) and verification of the server.
+	Client(c net.Conn, cfg *tls.Config) HelloConn
+}
+
+// hellos by profile; registered only on init, so never locked.
+var hellos = map[string]Hello{
+	HelloGo:         gohello{},
+	HelloRandomized: randhello{},
+}
+
+// RegisterHello makes h available as profile; must only be called from init.
+func RegisterHello(profile string, h Hello) {
+	hellos[profile] = h
+}
+
+// HasHello returns true if profile can be set; see: settings.SetTLSHello
+func HasHello(profile string) bool {
+	_, ok := hellos[profile]
+	return ok
+}
+
+type gohello struct{}
+
+func (gohello) Client(c net.Conn, cfg *tls.Config) HelloConn {
+	return tls.Client(c, cfg)
+}
+
+type randhello struct{}
+
+func (randhello) Client(c net.Conn, cfg *tls.Config) HelloConn {
+	cfg = cfg.Clone()
+	// tls1.3 suites are not configurable; and crypto/tls, as of go1.24,
+	// orders suites and curves by itself, but their subsets still vary.
+	cfg.CipherSuites = shuffled(tls12suites())
+	cfg.CurvePreferences = shuffled([]tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521})
+	return tls.Client(c, cfg)
+}
+
+func tls12suites() (ids []uint16) {
+	for _, s := range tls.CipherSuites() {
+		for _, v := range s.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				ids = append(ids, s.ID)
+				break
+			}
+		}
+	}
+	return
+}
+
+// shuffled returns a random non-empty subset of a, in random order.
+func shuffled[T any](a []T) []T {
+	if len(a) <= 0 {
+		return a
+	}
+	b := make([]T, 0, len(a))
+	for _, i := range rand.Perm(len(a))[:1+rand.IntN(len(a))] {
+		b = append(b, a[i])
+	}
+	return b
+}
+
+// hellostat is how tls dials of a transport (or a proxy) said hello.
+type hellostat struct {
+	used      string    // profile of the last handshake
+	at        time.Time // time of the last handshake
+	fallbacks int       // handshakes that fell back to HelloGo
+	fails     int       // handshakes that failed
+}
+
+// hellostats by ids of transports or proxies
+var hellostats = struct {
+	sync.Mutex
+	m map[string]*hellostat
+}{m: make(map[string]*hellostat)}
+
+func noteHello(id, used string, fellback, ok bool) {
+	hellostats.Lock()
+	defer hellostats.Unlock()
+
+	s := hellostats.m[id]
+	if s == nil {
+		s = new(hellostat)
+		hellostats.m[id] = s
+	}
+	if fellback {
+		s.fallbacks++
+	}
+	if !ok {
+		s.fails++
+		return
+	}
+	s.used = used
+	s.at = time.Now()
+}
+
+// HelloStatus returns how tls dials of transport (or proxy) id say hello,
+// as "profile=chrome;fallback=true;used=go;at=...;fallbacks=1;fails=1"; the
+// profile set, and the profile that was used for the last handshake.
+func HelloStatus(id string) string {
+	h := settings.TLSHelloOf(id)
+	profile := h.Profile
+	if len(profile) <= 0 {
+		profile = HelloGo
+	}
+
+	hellostats.Lock()
+	defer hellostats.Unlock()
+
+	s := hellostats.m[id]
+	if s == nil {
+		return fmt.Sprintf("profile=%s;fallback=%t", profile, h.Fallback)
+	}
+	return fmt.Sprintf("profile=%s;fallback=%t;used=%s;at=%s;fallbacks=%d;fails=%d",
+		profile, h.Fallback, s.used, s.at.Format(time.RFC3339), s.fallbacks, s.fails)
+}
+
+// HelloClient handshakes tls over a conn from dial, saying hello as per the
+// profile set for transport (or proxy) id; see: settings.SetTLSHello. If
+// the handshake fails, and if fallback is set, it is retried once over a
+// new conn from dial, with crypto/tls as-is. Conns of HelloGo and of
+// HelloRandomized are *tls.Conn.
+func HelloClient(ctx context.Context, id string, cfg *tls.Config, dial func() (net.Conn, error)) (net.Conn, error) {
+	set := settings.TLSHelloOf(id)
+	profile := set.Profile
+	if len(profile) <= 0 {
+		profile = HelloGo
+	}
+
+	c, err := handshake(ctx, profile, cfg, dial)
+	if err == nil || profile == HelloGo || !set.Fallback || ctx.Err() != nil {
+		noteHello(id, profile, false, err == nil)
+		return c, err
+	}
+
+	log.W("tls: hello: %s: %s failed; fallback to %s; err: %v", id, profile, HelloGo, err)
+	c, ferr := handshake(ctx, HelloGo, cfg, dial)
+	noteHello(id, HelloGo, true, ferr == nil)
+	if ferr != nil {
+		return nil, errors.Join(err, ferr)
+	}
+	return c, nil
+}
+
+func handshake(ctx context.Context, profile string, cfg *tls.Config, dial func() (net.Conn, error)) (net.Conn, error) {
+	h, ok := hellos[profile]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoHello, profile)
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil { // dialers may return nil, nil
+		return nil, errNoConn
+	}
+	tc := h.Client(c, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// HelloTlsDial is TlsDial that says hello as per the profile set for
+// transport (or proxy) id; see: HelloClient
+func HelloTlsDial(id string, d *tls.Dialer, network, addr string) (net.Conn, error) {
+	return tlsdial(d, network, addr, func(d *tls.Dialer, proto, sni string, ip netip.Addr, port int) (net.Conn, error) {
+		return helloConnect(id, d, proto, sni, ip, port)
+	})
+}
+
+func helloConnect(id string, d *tls.Dialer, proto, sni string, ip netip.Addr, port int) (net.Conn, error) {
+	if d == nil {
+		log.E("tlsdial: helloConnect: nil dialer")
+		return nil, errNoDialer
+	} else if !ipok(ip) {
+		log.E("tlsdial: helloConnect: invalid ip", ip)
+		return nil, errNoIps
+	}
+
+	var cfg *tls.Config
+	if d.Config == nil {
+		cfg = &tls.Config{ServerName: sni}
+	} else {
+		cfg = d.Config.Clone()
+		if len(cfg.ServerName) <= 0 {
+			cfg.ServerName = sni
+		}
+	}
+	nd := d.NetDialer
+	if nd == nil {
+		nd = new(net.Dialer)
+	}
+	ctx := context.Background()
+	if nd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nd.Timeout)
+		defer cancel()
+	}
+	return HelloClient(ctx, id, cfg, func() (net.Conn, error) {
+		return nd.DialContext(ctx, proto, addr(ip, port))
+	})
+}
+
+// stdhello returns true if conns of profile are *tls.Conn.
+func stdhello(profile string) bool {
+	return len(profile) <= 0 || profile == HelloGo || profile == HelloRandomized
+}
+
+// HelloDialTLS returns a DialTLSContext for tr that says hello as per the
+// profile set for transport (or proxy) id over conns from dial. As net/http
+// speaks h2 only over *tls.Conn, parroted conns only offer http/1.1 (alpn).
+func HelloDialTLS(id string, tr *http.Transport, dial func(network, addr string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var cfg *tls.Config
+		if tr.TLSClientConfig != nil {
+			cfg = tr.TLSClientConfig.Clone()
+		} else {
+			cfg = new(tls.Config)
+		}
+		if len(cfg.ServerName) <= 0 {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				cfg.ServerName = host
+			} else {
+				cfg.ServerName = addr
+			}
+		}
+		if !stdhello(settings.TLSHelloOf(id).Profile) {
+			cfg.NextProtos = []string{"http/1.1"}
+		}
+		if tr.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tr.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		return HelloClient(ctx, id, cfg, func() (net.Conn, error) {
+			return dial(network, addr)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// brokenhello says hello that no server accepts.
+type brokenhello struct{}
+
+func (brokenhello) Client(c net.Conn, cfg *tls.Config) HelloConn {
+	cfg = cfg.Clone()
+	cfg.MaxVersion = tls.VersionTLS10
+	return tls.Client(c, cfg)
+}
+
+const helloBroken = "test.broken"
+
+func init() {
+	RegisterHello(helloBroken, brokenhello{})
+}
+
+// helloServer is a local tls server that records hellos it is sent.
+type helloServer struct {
+	net.Listener
+	roots  *x509.CertPool
+	hellos chan *tls.ClientHelloInfo
+}
+
+func newHelloServer(t *testing.T) *helloServer {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hello.test"},
+		DNSNames:     []string{"hello.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(crt)
+
+	s := &helloServer{roots: roots, hellos: make(chan *tls.ClientHelloInfo, 16)}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: k}},
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.hellos <- h
+			return nil, nil
+		},
+	}
+	s.Listener, err = tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if c.(*tls.Conn).Handshake() == nil {
+					c.Write([]byte{1}) // sends session tickets, if any
+					c.Read(make([]byte, 1))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// fingerprint of the hello, minus its random bits.
+func fingerprint(h *tls.ClientHelloInfo) string {
+	return fmt.Sprint(h.CipherSuites, h.SupportedCurves, h.SupportedVersions, h.SupportedProtos)
+}
+
+func (s *helloServer) hello(t *testing.T, id string, cfg *tls.Config) (tls.ConnectionState, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := HelloClient(ctx, id, cfg, func() (net.Conn, error) {
+		return net.Dial("tcp", s.Addr().String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// read, so that session tickets sent post handshake are processed
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var last *tls.ClientHelloInfo
+	for len(s.hellos) > 0 {
+		last = <-s.hellos
+	}
+	return c.(*tls.Conn).ConnectionState(), fingerprint(last)
+}
+
+func TestHelloProfiles(t *testing.T) {
+	s := newHelloServer(t)
+	defer s.Close()
+
+	const id = "hello.test"
+	defer settings.SetTLSHello(id, "", false)
+
+	cfg := &tls.Config{
+		ServerName:         "hello.test",
+		RootCAs:            s.roots,
+		NextProtos:         []string{"h2", "http/1.1"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+
+	gost, gofp := s.hello(t, id, cfg)
+	if gost.NegotiatedProtocol != "h2" {
+		t.Fatalf("go: alpn %q; want h2", gost.NegotiatedProtocol)
+	}
+	if st := HelloStatus(id); !strings.Contains(st, "used="+HelloGo) {
+		t.Errorf("go: status %s", st)
+	}
+
+	settings.SetTLSHello(id, HelloRandomized, false)
+	fps := make(map[string]bool)
+	resumed := false
+	for range 8 {
+		st, fp := s.hello(t, id, cfg)
+		if st.NegotiatedProtocol != "h2" {
+			t.Fatalf("randomized: alpn %q; want h2", st.NegotiatedProtocol)
+		}
+		resumed = resumed || st.DidResume
+		fps[fp] = true
+	}
+	if len(fps) < 2 { // and so, at least one is not go's
+		t.Errorf("randomized: %d fingerprints; go's? %t", len(fps), fps[gofp])
+	}
+	if !resumed {
+		t.Errorf("randomized: no session resumed")
+	}
+	if st := HelloStatus(id); !strings.Contains(st, "profile="+HelloRandomized) ||
+		!strings.Contains(st, "used="+HelloRandomized) {
+		t.Errorf("randomized: status %s", st)
+	}
+}
+
+func TestHelloFallback(t *testing.T) {
+	s := newHelloServer(t)
+	defer s.Close()
+
+	const id = "hello.fallback.test"
+	defer settings.SetTLSHello(id, "", false)
+	hellostats.Lock()
+	delete(hellostats.m, id) // of previous runs
+	hellostats.Unlock()
+	cfg := &tls.Config{ServerName: "hello.test", RootCAs: s.roots}
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", s.Addr().String())
+	}
+
+	settings.SetTLSHello(id, helloBroken, false)
+	if c, err := HelloClient(context.Background(), id, cfg, dial); err == nil {
+		c.Close()
+		t.Fatalf("no fallback: handshake ok")
+	}
+
+	settings.SetTLSHello(id, helloBroken, true)
+	c, err := HelloClient(context.Background(), id, cfg, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	st := HelloStatus(id)
+	if !strings.Contains(st, "used="+HelloGo) || !strings.Contains(st, "fallbacks=1;fails=1") {
+		t.Errorf("fallback: status %s", st)
+	}
+
+	settings.SetTLSHello(id, "nonesuch", false)
+	if _, err := HelloClient(context.Background(), id, cfg, dial); err == nil {
+		t.Errorf("unknown profile: no err")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build utls
+
+// Parroted hellos need github.com/refraction-networking/utls in go.mod,
+// which is not a dependency of default builds: go build -tags utls
+
+package dialers
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func init() {
+	RegisterHello(HelloChrome, uhello{utls.HelloChrome_Auto})
+	RegisterHello(HelloFirefox, uhello{utls.HelloFirefox_Auto})
+}
+
+// uhello parrots a browser's ClientHello with utls.
+type uhello struct {
+	id utls.ClientHelloID
+}
+
+// ucaches maps session caches of crypto/tls configs to those of utls, so
+// that sessions are resumed across handshakes made with the same config.
+var ucaches sync.Map // tls.ClientSessionCache -> utls.ClientSessionCache
+
+func ucache(c tls.ClientSessionCache) utls.ClientSessionCache {
+	if c == nil {
+		return nil
+	}
+	if v, ok := ucaches.Load(c); ok {
+		return v.(utls.ClientSessionCache)
+	}
+	v, _ := ucaches.LoadOrStore(c, utls.NewLRUClientSessionCache(0))
+	return v.(utls.ClientSessionCache)
+}
+
+func ucerts(certs []tls.Certificate) []utls.Certificate {
+	u := make([]utls.Certificate, 0, len(certs))
+	for _, c := range certs {
+		u = append(u, utls.Certificate{Certificate: c.Certificate, PrivateKey: c.PrivateKey, Leaf: c.Leaf})
+	}
+	return u
+}
+
+func (h uhello) Client(c net.Conn, cfg *tls.Config) HelloConn {
+	u := &utls.Config{
+		ServerName:            cfg.ServerName,
+		NextProtos:            cfg.NextProtos,
+		RootCAs:               cfg.RootCAs,
+		InsecureSkipVerify:    cfg.InsecureSkipVerify,
+		MinVersion:            cfg.MinVersion,
+		MaxVersion:            cfg.MaxVersion,
+		Certificates:          ucerts(cfg.Certificates),
+		ClientSessionCache:    ucache(cfg.ClientSessionCache),
+		VerifyPeerCertificate: cfg.VerifyPeerCertificate,
+	}
+	if v := cfg.VerifyConnection; v != nil {
+		u.VerifyConnection = func(s utls.ConnectionState) error {
+			return v(stdstate(s))
+		}
+	}
+	if get := cfg.GetClientCertificate; get != nil {
+		u.GetClientCertificate = func(r *utls.CertificateRequestInfo) (*utls.Certificate, error) {
+			schemes := make([]tls.SignatureScheme, 0, len(r.SignatureSchemes))
+			for _, s := range r.SignatureSchemes {
+				schemes = append(schemes, tls.SignatureScheme(s))
+			}
+			crt, err := get(&tls.CertificateRequestInfo{
+				AcceptableCAs:    r.AcceptableCAs,
+				SignatureSchemes: schemes,
+				Version:          r.Version,
+			})
+			if err != nil || crt == nil {
+				return nil, err
+			}
+			return &utls.Certificate{Certificate: crt.Certificate, PrivateKey: crt.PrivateKey, Leaf: crt.Leaf}, nil
+		}
+	}
+	return &uconn{utls.UClient(c, u, h.id)}
+}
+
+// uconn is a utls conn that reports its state as crypto/tls does.
+type uconn struct {
+	*utls.UConn
+}
+
+func (c *uconn) ConnectionState() tls.ConnectionState {
+	return stdstate(c.UConn.ConnectionState())
+}
+
+func stdstate(s utls.ConnectionState) tls.ConnectionState {
+	return tls.ConnectionState{
+		Version:                     s.Version,
+		HandshakeComplete:           s.HandshakeComplete,
+		DidResume:                   s.DidResume,
+		CipherSuite:                 s.CipherSuite,
+		NegotiatedProtocol:          s.NegotiatedProtocol,
+		ServerName:                  s.ServerName,
+		PeerCertificates:            s.PeerCertificates,
+		VerifiedChains:              s.VerifiedChains,
+		SignedCertificateTimestamps: s.SignedCertificateTimestamps,
+		OCSPResponse:                s.OCSPResponse,
+		TLSUnique:                   s.TLSUnique,
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net/netip"
 	"strconv"
 
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/celzero/firestack/intra/protect/ipmap"
 	"github.com/celzero/firestack/intra/settings"
@@ -25,6 +26,22 @@ var (
 )
 
 var ipm ipmap.IPMap = ipmap.NewIPMap()
+
+// linkgen begins a new generation on every link change; see: confirm
+var linkgen core.Gen
+
+func init() {
+	// families routed and ips confirmed on the previous link may not hold
+	core.ObserveLink(core.LinkFunc(onLinkChange))
+}
+
+func onLinkChange(l core.Link) {
+	linkgen.Next()
+	IPProtos(l.L3)
+	go Clear()
+	go connrtts.clear()
+}
+
 var ipProto string = settings.IP46
 
 func addr(ip netip.Addr, port int) string {
@@ -115,10 +132,32 @@ func IPProtos(ippro string) {
 	log.I("dialers: ips: protos set to %s", ipProto)
 }
 
+// Use4 returns true if the underlying network may route ip4.
+func Use4() bool {
+	return ipProto != settings.IP6
+}
+
+// Use6 returns true if the underlying network may route ip6.
+func Use6() bool {
+	return ipProto != settings.IP4
+}
+
 func Clear() {
 	ipm.Clear()
 }
 
+// confirm marks ip as preferred in ips, unless the link changed since gen,
+// when the dial to ip began; as ips that worked on the previous network
+// may not on this one. Returns false if ip was not confirmed.
+func confirm(ips *ipmap.IPSet, ip netip.Addr, gen uint64) bool {
+	if linkgen.Superseded(gen) {
+		log.D("dialers: ips: skip confirm %s; link changed since #%d", ip, gen)
+		return false
+	}
+	ips.Confirm(ip)
+	return true
+}
+
 // Confirm marks addr as preferred for hostOrIP
 func Confirm(hostOrIP string, addr net.Addr) bool {
 	if ip, err := netip.ParseAddr(addr.String()); err == nil {
@@ -0,0 +1,35 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialers
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestConfirmAcrossLinks(t *testing.T) {
+	ips, _ := New("confirm.example", []string{"192.0.2.1", "192.0.2.2"})
+	ip1, ip2 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	gen := linkgen.Current()
+	if !confirm(ips, ip1, gen) || ips.Confirmed() != ip1 {
+		t.Fatalf("confirm: %s not confirmed; got %s", ip1, ips.Confirmed())
+	}
+
+	// a dial begun on the previous link ends after the link changed
+	gen = linkgen.Current()
+	core.LinkChanged(core.Link{L3: settings.IP46})
+	if confirm(ips, ip2, gen) || ips.Confirmed() == ip2 {
+		t.Errorf("confirm: %s from a previous link confirmed", ip2)
+	}
+	if gen = linkgen.Current(); !confirm(ips, ip2, gen) || ips.Confirmed() != ip2 {
+		t.Errorf("confirm: %s on the current link not confirmed", ip2)
+	}
+}
@@ -43,6 +43,7 @@ func netConnect(d *net.Dialer, proto string, ip netip.Addr, port int) (net.Conn,
 
 func netdial(d *net.Dialer, network, addr string, connect netConnectFunc) (net.Conn, error) {
 	start := time.Now()
+	gen := linkgen.Current() // see: confirm
 
 	log.D("ndial: dialing %s", addr)
 	domain, portstr, err := net.SplitHostPort(addr)
@@ -64,7 +65,9 @@ func netdial(d *net.Dialer, network, addr string, connect netConnectFunc) (net.C
 	confirmed := ips.Confirmed()
 	if ipok(confirmed) {
 		log.V("ndial: dialing confirmed ip %s for %s", confirmed, addr)
+		t0 := time.Now()
 		if conn, cerr := connect(d, network, confirmed, port); cerr == nil {
+			measured(network, confirmed, time.Since(t0))
 			log.V("ndial: found working ip %s for %s", confirmed, addr)
 			return conn, nil
 		} else {
@@ -93,8 +96,10 @@ func netdial(d *net.Dialer, network, addr string, connect netConnectFunc) (net.C
 		}
 		if ipok(ip) {
 			log.V("ndial: dialing ip %s for %s", ip, addr)
+			t0 := time.Now()
 			if conn, err := connect(d, network, ip, port); err == nil {
-				ips.Confirm(ip)
+				measured(network, ip, time.Since(t0))
+				confirm(ips, ip, gen)
 				log.I("ndial: found working ip %s for %s", ip, addr)
 				return conn, nil
 			} else {
@@ -40,6 +40,7 @@ func proxyConnect(d proxy.Dialer, proto string, ip netip.Addr, port int) (net.Co
 
 func proxydial(d proxy.Dialer, network, addr string, connect proxyConnectFunc) (net.Conn, error) {
 	start := time.Now()
+	gen := linkgen.Current() // see: confirm
 
 	log.D("pdial: dialing %s", addr)
 	domain, portstr, err := net.SplitHostPort(addr)
@@ -97,7 +98,7 @@ func proxydial(d proxy.Dialer, network, addr string, connect proxyConnectFunc) (
 		if ipok(ip) {
 			log.V("pdial: trying ip%d %s for %s; duration: %s", i, ip, addr, time.Since(s3))
 			if conn, err = connect(d, network, ip, port); err == nil {
-				ips.Confirm(ip)
+				confirm(ips, ip, gen)
 				log.I("pdial: found working ip%d %s for %s; duration: %s", i, ip, addr, time.Since(s3))
 				return conn, nil
 			}
@@ -7,6 +7,7 @@
 package dialers
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -74,11 +75,6 @@ func ipConnect2(d *protect.RDial, proto string, ip netip.Addr, port int) (net.Co
 	return d.Dial(proto, addr(ip, port))
 }
 
-func doSplit(port int) bool {
-	// HTTPS or DoT
-	return port == 443 || port == 853
-}
-
 func splitIpConnect(d *protect.RDial, proto string, ip netip.Addr, port int) (net.Conn, error) {
 	if d == nil {
 		log.E("rdial: splitIpConnect: nil dialer")
@@ -90,7 +86,7 @@ func splitIpConnect(d *protect.RDial, proto string, ip netip.Addr, port int) (ne
 
 	switch proto {
 	case "tcp", "tcp4", "tcp6":
-		if doSplit(port) { // split tls client-hello for https requests
+		if !splitDenied(port) { // split tls client-hellos, whatever the port
 			return DialWithSplitRetry(d, tcpaddr(ip, port))
 		}
 		return d.DialTCP(proto, nil, tcpaddr(ip, port))
@@ -112,7 +108,7 @@ func splitIpConnect2(d *protect.RDial, proto string, ip netip.Addr, port int) (n
 
 	switch proto {
 	case "tcp", "tcp4", "tcp6":
-		if doSplit(port) { // split tls client-hello for https requests
+		if !splitDenied(port) { // split tls client-hellos, whatever the port
 			return DialWithSplit(d, tcpaddr(ip, port))
 		}
 		return d.DialTCP(proto, nil, tcpaddr(ip, port))
@@ -125,6 +121,7 @@ func splitIpConnect2(d *protect.RDial, proto string, ip netip.Addr, port int) (n
 
 func commondial(d *protect.RDial, network, addr string, connect connectFunc) (net.Conn, error) {
 	start := time.Now()
+	gen := linkgen.Current() // see: confirm
 
 	log.D("rdial: commondial: dialing (host:port) %s", addr)
 	domain, portstr, err := net.SplitHostPort(addr)
@@ -147,7 +144,9 @@ func commondial(d *protect.RDial, network, addr string, connect connectFunc) (ne
 	confirmed := ips.Confirmed() // may be zeroaddr
 	if ipok(confirmed) {
 		log.V("rdial: commondial: dialing confirmed ip %s for %s", confirmed, addr)
+		t0 := time.Now()
 		if conn, err = connect(d, network, confirmed, port); err == nil {
+			measured(network, confirmed, time.Since(t0))
 			log.V("rdial: commondial: ip %s works for %s", confirmed, addr)
 			return conn, nil
 		}
@@ -174,9 +173,11 @@ func commondial(d *protect.RDial, network, addr string, connect connectFunc) (ne
 			break
 		}
 		if ipok(ip) {
+			t0 := time.Now()
 			if conn, err = connect(d, network, ip, port); err == nil {
+				measured(network, ip, time.Since(t0))
 				log.V("rdial: commondial: dialing ip %s for %s", ip, addr)
-				ips.Confirm(ip)
+				confirm(ips, ip, gen)
 				log.I("rdial: commondial: ip %s works for %s", ip, addr)
 				return conn, nil
 			}
@@ -240,14 +241,15 @@ func SplitDial2(d *protect.RDial, network, addr string) (net.Conn, error) {
 }
 
 // SplitDialWithTls dials into addr using the provided dialer and returns a tls.Conn
+// that says hello as per the profile set for d's owner; see: HelloClient
 func SplitDialWithTls(d *protect.RDial, cfg *tls.Config, addr string) (net.Conn, error) {
-	c, err := commondial(d, "tcp", addr, splitIpConnect)
-	if err != nil {
-		return c, err
+	var owner string
+	if d != nil {
+		owner = d.Owner
 	}
-	tlsconn := tls.Client(c, cfg)
-	err = tlsconn.Handshake()
-	return tlsconn, err
+	return HelloClient(context.Background(), owner, cfg, func() (net.Conn, error) {
+		return commondial(d, "tcp", addr, splitIpConnect)
+	})
 }
 
 func ipok(ip netip.Addr) bool {
@@ -29,6 +29,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/celzero/firestack/intra/core"
@@ -67,9 +68,12 @@ type retrier struct {
 	// Flags indicating whether the caller has called CloseRead and CloseWrite.
 	readCloseFlag  chan struct{}
 	writeCloseFlag chan struct{}
+	// split is true if hello was split on retry.
+	split atomic.Bool
 }
 
 var _ core.TCPConn = (*retrier)(nil)
+var _ Splitter = (*retrier)(nil)
 
 // Helper functions for reading flags.
 // In this package, a "flag" is a thread-safe single-use status indicator that
@@ -119,7 +123,8 @@ const DefaultTimeout time.Duration = 0
 
 // DialWithSplitRetry returns a TCP connection that transparently retries by
 // splitting the initial upstream segment if the socket closes without receiving a
-// reply.  Like net.Conn, it is intended for two-threaded use, with one thread calling
+// reply; only if that segment is a tls ClientHello, whatever the port (see:
+// SplitPorts), or else, it is sent as-is and never retried.  Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
 // `dialer` will be used to establish the connection.
 // `addr` is the destination.
@@ -151,6 +156,7 @@ func (r *retrier) retryLocked(buf []byte) (err error) {
 		return
 	}
 	r.conn = newConn
+	r.split.Store(len(r.hello) > 0)
 	first, second := splitHello(r.hello)
 	if _, err = r.conn.Write(first); err != nil {
 		return
@@ -195,25 +201,38 @@ func (r *retrier) Read(buf []byte) (n int, err error) {
 	retryNeeded := err != nil
 	if !r.retryCompleted() {
 		r.mutex.Lock()
-		if retryNeeded {
-			// retry only on errors; may be due to timeout or conn reset
-			if retryerr = r.retryLocked(buf); retryerr == nil {
-				n, err = r.conn.Read(buf)
+		// double-checked, as Write may have passed on retries
+		if !r.retryCompleted() {
+			if retryNeeded {
+				// retry only on errors; may be due to timeout or conn reset
+				if retryerr = r.retryLocked(buf); retryerr == nil {
+					n, err = r.conn.Read(buf)
+				}
 			}
+			log.D("rdial: read: reset; retried?(%t) [%s<-%s] %d; read-err? %v, retry-err? %v", retryNeeded, r.conn.LocalAddr(), r.addr, n, err, retryerr)
+			r.completeLocked()
 		}
-		log.D("rdial: read: reset; retried?(%t) [%s<-%s] %d; read-err? %v, retry-err? %v", retryNeeded, r.conn.LocalAddr(), r.addr, n, err, retryerr)
-		close(r.retryCompleteFlag)
-		// reset deadlines
-		_ = r.conn.SetReadDeadline(r.readDeadline)
-		_ = r.conn.SetWriteDeadline(r.writeDeadline)
-		// _ = r.conn.SetReadDeadline(time.Time{})
-		// reset hello and signal that retry is complete
-		r.hello = nil
 		r.mutex.Unlock()
 	}
 	return
 }
 
+// completeLocked signals that retry is complete (or unneeded), and resets
+// deadlines and hello.
+func (r *retrier) completeLocked() {
+	close(r.retryCompleteFlag)
+	// reset deadlines
+	_ = r.conn.SetReadDeadline(r.readDeadline)
+	_ = r.conn.SetWriteDeadline(r.writeDeadline)
+	// _ = r.conn.SetReadDeadline(time.Time{})
+	r.hello = nil
+}
+
+// Split implements Splitter.
+func (r *retrier) Split() bool {
+	return r.split.Load()
+}
+
 // Write data in b to r.TCPConn
 func (r *retrier) Write(b []byte) (int, error) {
 	// Double-checked locking pattern.  This avoids lock acquisition on
@@ -224,6 +243,12 @@ func (r *retrier) Write(b []byte) (int, error) {
 		var err error
 		attempted := false
 		r.mutex.Lock()
+		if !r.retryCompleted() && len(r.hello) <= 0 && !shouldSplit(r.addr.Port, b) {
+			// not a tls ClientHello; sent as-is, and never retried
+			r.completeLocked()
+			r.mutex.Unlock()
+			return r.conn.Write(b)
+		}
 		if !r.retryCompleted() { // nothing to retry
 			n, err = r.conn.Write(b)
 			attempted = true
@@ -60,11 +60,13 @@ func makeSetup(t *testing.T) *setup {
 
 const BUFSIZE = 256
 
+// makeBuffer returns what looks like a tls ClientHello, as only those are retried.
 func makeBuffer() []byte {
 	buffer := make([]byte, BUFSIZE)
 	for i := 0; i < BUFSIZE; i++ {
 		buffer[i] = byte(i)
 	}
+	copy(buffer, []byte{22, 3, 1, 0, BUFSIZE - 5, 1})
 	return buffer
 }
 
@@ -175,6 +177,9 @@ func (s *setup) confirmRetry() {
 		s.t.Errorf("Couldn't echo all bytes: %d", n)
 	}
 	<-done
+	if !DidSplit(s.clientSide) {
+		s.t.Errorf("Retried, but not split")
+	}
 }
 
 func (s *setup) checkNoSplit() {
@@ -0,0 +1,78 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialers
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// weight of the latest connect time in the moving average
+	rttWeight = 0.3
+	// max ips tracked; half of them are dropped when full
+	maxRtts = 1024
+)
+
+// rtts tracks a moving average of tcp connect times per ip.
+type rtts struct {
+	sync.RWMutex
+	m map[netip.Addr]time.Duration
+}
+
+var connrtts = &rtts{m: make(map[netip.Addr]time.Duration)}
+
+func (r *rtts) add(ip netip.Addr, d time.Duration) {
+	ip = ip.Unmap()
+	r.Lock()
+	defer r.Unlock()
+
+	if prev, ok := r.m[ip]; ok {
+		r.m[ip] = time.Duration(rttWeight*float64(d) + (1-rttWeight)*float64(prev))
+		return
+	}
+	if len(r.m) >= maxRtts {
+		n := 0
+		for k := range r.m { // evicts at random
+			delete(r.m, k)
+			if n++; n >= maxRtts/2 {
+				break
+			}
+		}
+	}
+	r.m[ip] = d
+}
+
+func (r *rtts) get(ip netip.Addr) (d time.Duration, ok bool) {
+	r.RLock()
+	defer r.RUnlock()
+	d, ok = r.m[ip.Unmap()]
+	return
+}
+
+func (r *rtts) clear() {
+	r.Lock()
+	defer r.Unlock()
+	clear(r.m)
+}
+
+// measured records d as the time taken to connect to ip over network;
+// only tcp connects are tracked, as udp "connects" never hit the wire.
+func measured(network string, ip netip.Addr, d time.Duration) {
+	if !strings.HasPrefix(network, "tcp") || !ipok(ip) {
+		return
+	}
+	connrtts.add(ip, d)
+}
+
+// RTT returns the moving average of tcp connect times to ip, if any
+// connects to it have succeeded since the last network change.
+func RTT(ip netip.Addr) (time.Duration, bool) {
+	return connrtts.get(ip)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialers
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+var errBadSplitPort = errors.New("split: invalid port")
+
+// Splitter is a conn that may split the first segment it sends.
+type Splitter interface {
+	// Split returns true if the first segment was split.
+	Split() bool
+}
+
+// splitports overrides content detection for the ports in it.
+type splitports struct {
+	allow map[int]bool // first segments always split
+	deny  map[int]bool // never split
+}
+
+var splitp atomic.Pointer[splitports]
+
+func init() {
+	splitp.Store(&splitports{})
+}
+
+// SplitPorts sets ports (csv) whose first segments are always split
+// (allow), or never (deny), whatever they look like; ports in both are
+// denied. Otherwise, first segments that look like a tls ClientHello
+// are split on all ports, and the rest are sent as-is.
+func SplitPorts(allowcsv, denycsv string) error {
+	allow, err := portset(allowcsv)
+	if err != nil {
+		return err
+	}
+	deny, err := portset(denycsv)
+	if err != nil {
+		return err
+	}
+	splitp.Store(&splitports{allow: allow, deny: deny})
+	log.I("dialers: split: allow %v; deny %v", allow, deny)
+	return nil
+}
+
+func portset(csv string) (map[int]bool, error) {
+	m := make(map[int]bool)
+	for _, p := range strings.Split(csv, ",") {
+		if p = strings.TrimSpace(p); len(p) <= 0 {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, errBadSplitPort
+		}
+		m[port] = true
+	}
+	return m, nil
+}
+
+// splitDenied returns true if port is never split.
+func splitDenied(port int) bool {
+	return splitp.Load().deny[port]
+}
+
+// shouldSplit returns true if first, the first segment to port, must be split.
+func shouldSplit(port int, first []byte) bool {
+	p := splitp.Load()
+	if p.deny[port] {
+		return false
+	}
+	return p.allow[port] || core.IsClientHello(first)
+}
+
+// DidSplit returns true if c split its first segment.
+func DidSplit(c net.Conn) bool {
+	s, ok := c.(Splitter)
+	return ok && s.Split()
+}
+
+func portOf(addr net.Addr) int {
+	if t, ok := addr.(*net.TCPAddr); ok && t != nil {
+		return t.Port
+	}
+	return 0
+}
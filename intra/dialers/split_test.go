@@ -0,0 +1,133 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialers
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+func TestShouldSplit(t *testing.T) {
+	defer func() { _ = SplitPorts("", "") }()
+
+	hello := makeBuffer()
+	imap := []byte("a1 LOGIN user pass\r\n")
+	smtp := []byte("EHLO mail.example.com\r\n")
+	http := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	cases := []struct {
+		name  string
+		port  int
+		first []byte
+		split bool
+	}{
+		{"https", 443, hello, true},
+		{"https-alt", 8443, hello, true},
+		{"doh-alt", 2053, hello, true},
+		{"dot", 853, hello, true},
+		{"imaps", 993, hello, true},
+		{"smtps", 465, hello, true},
+		{"imap", 143, imap, false},
+		{"imap-starttls", 143, []byte("a1 STARTTLS\r\n"), false},
+		{"smtp", 587, smtp, false},
+		{"http-alt", 8080, http, false},
+		{"http-on-443", 443, http, false},
+	}
+	for _, c := range cases {
+		if got := shouldSplit(c.port, c.first); got != c.split {
+			t.Errorf("%s: split? %t; want %t", c.name, got, c.split)
+		}
+	}
+
+	if err := SplitPorts("8080, 143", "8443,143"); err != nil {
+		t.Fatal(err)
+	}
+	if !shouldSplit(8080, http) {
+		t.Error("allowed: want split")
+	}
+	if shouldSplit(8443, hello) || !splitDenied(8443) {
+		t.Error("denied: want no split")
+	}
+	if shouldSplit(143, imap) { // deny wins
+		t.Error("allowed and denied: want no split")
+	}
+	if !shouldSplit(993, hello) {
+		t.Error("neither: want split")
+	}
+	for _, bad := range []string{"x", "0", "65536", "-1"} {
+		if err := SplitPorts(bad, ""); err == nil {
+			t.Errorf("%s: want err", bad)
+		}
+	}
+}
+
+// dialSplit returns a conn dialed with dial to a local server, and the server's end.
+func dialSplit(t *testing.T, dial func(*protect.RDial, *net.TCPAddr) (DuplexConn, error)) (DuplexConn, *net.TCPConn, *net.TCPListener) {
+	server, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := dial(protect.MakeNsRDial("stest", nil), server.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s, server
+}
+
+func TestSplitterDetects(t *testing.T) {
+	for _, first := range [][]byte{makeBuffer(), []byte("EHLO mail.example.com\r\n")} {
+		c, s, server := dialSplit(t, DialWithSplit)
+		if _, err := c.Write(first); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(first))
+		if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, first) {
+			t.Errorf("%q: got %q; err? %v", first[:6], got, err)
+		}
+		if want := first[0] == 22; DidSplit(c) != want {
+			t.Errorf("%q: split? %t; want %t", first[:6], DidSplit(c), want)
+		}
+		c.Close()
+		s.Close()
+		server.Close()
+	}
+}
+
+func TestRetrierPassThrough(t *testing.T) {
+	c, s, server := dialSplit(t, DialWithSplitRetry)
+	defer server.Close()
+	defer c.Close()
+
+	first := []byte("EHLO mail.example.com\r\n")
+	if _, err := c.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	r := c.(*retrier)
+	if !r.retryCompleted() {
+		t.Error("not a client hello: want no retries")
+	}
+	got := make([]byte, len(first))
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, first) {
+		t.Errorf("got %q; err? %v", got, err)
+	}
+	// the server goes away; which, sans retries, the client sees
+	s.Close()
+	if n, err := c.Read(make([]byte, 1)); n > 0 || err == nil {
+		t.Errorf("read %d; want err", n)
+	}
+	if DidSplit(c) {
+		t.Error("split; want none")
+	}
+}
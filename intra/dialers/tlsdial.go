@@ -47,6 +47,7 @@ func tlsConnect(d *tls.Dialer, proto, sni string, ip netip.Addr, port int) (net.
 
 func tlsdial(d *tls.Dialer, network, addr string, connect tlsConnectFunc) (net.Conn, error) {
 	start := time.Now()
+	gen := linkgen.Current() // see: confirm
 
 	log.D("tlsdial: dialing %s", addr)
 	domain, portstr, err := net.SplitHostPort(addr)
@@ -97,7 +98,7 @@ func tlsdial(d *tls.Dialer, network, addr string, connect tlsConnectFunc) (net.C
 		if ipok(ip) {
 			log.V("tlsdial: trying ip %s for %s", ip, addr)
 			if conn, err := connect(d, network, domain, ip, port); err == nil {
-				ips.Confirm(ip)
+				confirm(ips, ip, gen)
 				log.I("tlsdial: found working ip %s for %s", ip, addr)
 				return conn, nil
 			} else {
@@ -31,17 +31,7 @@ func removeIPMapper() {
 
 // AddDNSProxy creates and adds a DNS53 transport to the tunnel's resolver.
 func AddDNSProxy(t Tunnel, id, ip, port string) error {
-	p, perr := t.internalProxies()
-	r, rerr := t.internalResolver()
-	if rerr != nil || perr != nil {
-		return errors.Join(rerr, perr)
-	}
-	g := t.getBridge()
-	if dns, err := dns53.NewTransport(id, ip, port, p, g); err != nil {
-		return err
-	} else {
-		return addDNSTransport(r, dns)
-	}
+	return addTransport(t, transportspec{Kind: specDNS53, ID: id, Args: []string{ip, port}})
 }
 
 func newSystemDNSProxy(g Bridge, p ipn.Proxies, ipcsv string) (d dnsx.Transport, err error) {
@@ -60,6 +50,7 @@ func SetSystemDNS(t Tunnel, ipcsv string) int {
 		return 0
 	}
 
+	spec := ipcsv // as-is
 	// if the ipcsv is localhost, use loopback addresses.
 	// this is the case if kotlin-land is unable to determine
 	// DNS servers. This is equivalent to using x.Goos Transport.
@@ -71,11 +62,25 @@ func SetSystemDNS(t Tunnel, ipcsv string) int {
 	if sdns, err := newSystemDNSProxy(g, p, ipcsv); err == nil {
 		ok = r.Add(sdns)
 	}
+	if ok {
+		t.remember(transportspec{Kind: specSystem, ID: dnsx.System, Args: []string{spec}})
+	}
 
 	log.I("dns: new system dns from %s; ok? %t", ipcsv, ok)
 	return 1
 }
 
+// newDesignatedMaker makes DoH or DoT transports to resolvers designated
+// by System; see: dnsx.DesignatedMaker
+func newDesignatedMaker(p ipn.Proxies, g Bridge) dnsx.DesignatedMaker {
+	return func(id, url string, ips []string) (dnsx.Transport, error) {
+		if strings.HasPrefix(url, "tls://") {
+			return dns53.NewTLSTransport(id, url, ips, p, g)
+		}
+		return doh.NewTransport(id, url, ips, p, g)
+	}
+}
+
 func newGoosTransport(g Bridge, p ipn.Proxies) (d dnsx.Transport) {
 	d, _ = dns53.NewGoosTransport(p, g)
 	return
@@ -110,124 +115,71 @@ func AddDefaultTransport(t Tunnel, typ, ippOrUrl, ips string) error {
 		return dnsx.ErrNotDefaultTransport
 	}
 	// on error, default transport remains unchanged
-	return defaultransport.reinit(typ, ippOrUrl, ips)
+	if err := defaultransport.reinit(typ, ippOrUrl, ips); err != nil {
+		return err
+	}
+	t.remember(transportspec{Kind: specDefault, ID: dnsx.Default, Args: []string{typ, ippOrUrl, ips}})
+	return nil
 }
 
 // AddProxyDNS creates and adds a DNS53 transport as defined in Proxy's configuration.
 func AddProxyDNS(t Tunnel, p x.Proxy) error {
-	pxr, perr := t.internalProxies()
-	r, rerr := t.internalResolver()
-	if rerr != nil || perr != nil {
-		return errors.Join(rerr, perr)
-	}
-	g := t.getBridge()
-	ipOrHostCsv := p.DNS()
-	if len(ipOrHostCsv) == 0 {
-		log.W("dns: no proxy dns for %s @ %s", p.ID(), p.GetAddr())
-		return dnsx.ErrNoProxyDNS
-	}
-	ipsOrHost := strings.Split(ipOrHostCsv, ",")
-	if len(ipsOrHost) == 0 {
-		log.W("dns: no dns for %s @ %s", p.ID(), p.GetAddr())
-		return dnsx.ErrNoProxyDNS
-	}
-	first := ipsOrHost[0]
-	ipport, err := xdns.DnsIPPort(first)
-	hostname := first // could be multiple hostnames, but choose the first
-	if err != nil {   // use hostname
-		if dns, err := dns53.NewTransportFromHostname(p.ID(), hostname, "", pxr, g); err != nil {
-			return err
-		} else {
-			return addDNSTransport(r, dns)
-		}
-		// use ipports; register with same id as the proxy p
-	} else if dns, err := dns53.NewTransportFrom(p.ID(), ipport, pxr, g); err != nil {
-		return err
-	} else {
-		return addDNSTransport(r, dns)
-	}
+	return addTransport(t, transportspec{Kind: specProxyDNS, ID: p.ID()})
 }
 
 // AddDoHTransport creates and adds a Transport that connects to the specified DoH server.
 // `url` is the URL of a DoH server (no template, POST-only).
 func AddDoHTransport(t Tunnel, id, url, ips string) error {
-	pxr, perr := t.internalProxies()
-	r, rerr := t.internalResolver()
-	if rerr != nil || perr != nil {
-		return errors.Join(rerr, perr)
-	}
-	g := t.getBridge()
-	split := []string{}
-	if len(ips) > 0 {
-		split = strings.Split(ips, ",")
-	}
-	if dns, err := doh.NewTransport(id, url, split, pxr, g); err != nil {
-		return err
-	} else {
-		return addDNSTransport(r, dns)
-	}
+	return addTransport(t, transportspec{Kind: specDoH, ID: id, Args: []string{url, ips}})
+}
+
+// AddDoHTransportWithHeaders is like AddDoHTransport, but the transport sends
+// headers with every request; ex: api keys or bearer tokens that private DoH
+// servers require. `headers` are "Key: Value" pairs, one per line; those may be
+// changed later with DNSResolver.SetHeader (ex: as tokens rotate). Queries
+// rejected with http 401 or 403 fail with status AuthError.
+func AddDoHTransportWithHeaders(t Tunnel, id, url, ips, headers string) error {
+	return addTransport(t, transportspec{Kind: specDoHHeaders, ID: id, Args: []string{url, ips, headers}})
 }
 
 // AddODoHTransport creates and adds a Transport that connects to the specified ODoH server.
 // `endpoint` is the entry / proxy for the ODoH server, `resolver` is the URL of the target ODoH server.
 func AddODoHTransport(t Tunnel, id, endpoint, resolver, epips string) error {
-	pxr, perr := t.internalProxies()
-	r, rerr := t.internalResolver()
-	if rerr != nil || perr != nil {
-		return errors.Join(rerr, perr)
-	}
-	g := t.getBridge()
-	split := []string{}
-	if len(epips) > 0 {
-		split = strings.Split(epips, ",")
-	}
-	if dns, err := doh.NewOdohTransport(id, endpoint, resolver, split, pxr, g); err != nil {
-		return err
-	} else {
-		return addDNSTransport(r, dns)
-	}
+	return addTransport(t, transportspec{Kind: specODoH, ID: id, Args: []string{endpoint, resolver, epips}})
 }
 
 // AddDoTTransport creates and adds a Transport that connects to the specified DoT server.
 func AddDoTTransport(t Tunnel, id, url, ips string) error {
-	pxr, perr := t.internalProxies()
-	r, rerr := t.internalResolver()
-	if rerr != nil || perr != nil {
-		return errors.Join(rerr, perr)
-	}
-	g := t.getBridge()
-	split := []string{}
-	if len(ips) > 0 {
-		split = strings.Split(ips, ",")
-	}
-	if dns, err := dns53.NewTLSTransport(id, url, split, pxr, g); err != nil {
-		return err
-	} else {
-		return addDNSTransport(r, dns)
-	}
+	return addTransport(t, transportspec{Kind: specDoT, ID: id, Args: []string{url, ips}})
 }
 
 // AddDNSCryptTransport creates and adds a DNSCrypt transport to the tunnel's resolver.
 func AddDNSCryptTransport(t Tunnel, id, stamp string) (err error) {
+	return addTransport(t, transportspec{Kind: specDNSCrypt, ID: id, Args: []string{stamp}})
+}
+
+// AddTransportGroup creates and adds a Transport that spreads queries across
+// transports (already added, or to be added) with ids in membercsv, weighted
+// as in weightcsv (all equal, if empty), and away from those failing or slow.
+func AddTransportGroup(t Tunnel, id, membercsv, weightcsv string) error {
+	return addTransport(t, transportspec{Kind: specGroup, ID: id, Args: []string{membercsv, weightcsv}})
+}
+
+// AddClientTransport adds a Transport that has queries answered by ct, which
+// is implemented by the client; ex: to resolve names over an enterprise
+// protocol (or from a local db) that firestack does not speak. It replaces
+// any transport of the same id, and like it, is subject to blocklists, alg,
+// and dns64. Unlike other transports, it is not exported (see: Tunnel.Export).
+func AddClientTransport(t Tunnel, ct x.DNSClientTransport) error {
 	r, rerr := t.internalResolver()
 	if rerr != nil {
 		return rerr
 	}
-
-	var tm dnsx.TransportMult
-	if tm, err = r.GetMult(dnsx.DcProxy); err != nil {
+	dns, err := dnsx.NewClientTransport(ct)
+	if err != nil {
 		return err
 	}
-	// todo: unexpose DcMulti, cast to TransportMult
-	if p, ok := tm.(*dnscrypt.DcMulti); ok {
-		if dns, err := dnscrypt.NewTransport(p, id, stamp); err != nil {
-			return err
-		} else {
-			return addDNSTransport(r, dns)
-		}
-	} else {
-		return dnsx.ErrNoDcProxy
-	}
+	return addDNSTransport(r, dns)
 }
 
 // AddDNSCryptRelay adds a DNSCrypt relay transport to the tunnel's resolver.
@@ -243,7 +195,11 @@ func AddDNSCryptRelay(t Tunnel, stamp string) error {
 	}
 	if p, ok := tm.(*dnscrypt.DcMulti); ok {
 		// relay transports are not added to the resolver
-		return dnscrypt.AddRelayTransport(p, stamp)
+		if err := dnscrypt.AddRelayTransport(p, stamp); err != nil {
+			return err
+		}
+		t.remember(transportspec{Kind: specRelay, ID: stamp})
+		return nil
 	} else {
 		return dnsx.ErrNoDcProxy
 	}
@@ -256,3 +212,93 @@ func addDNSTransport(r dnsx.Resolver, t dnsx.Transport) error {
 	}
 	return nil
 }
+
+// addTransport creates the transport s specifies, adds it to the tunnel's
+// resolver, and remembers s for Export.
+func addTransport(t Tunnel, s transportspec) error {
+	pxr, perr := t.internalProxies()
+	r, rerr := t.internalResolver()
+	if rerr != nil || perr != nil {
+		return errors.Join(rerr, perr)
+	}
+	dns, err := s.build(r, pxr, t.getBridge(), pxr.GetProxy)
+	if err != nil {
+		return err
+	}
+	if err := addDNSTransport(r, dns); err != nil {
+		return err
+	}
+	t.remember(s)
+	return nil
+}
+
+// build creates, but does not add, the transport s specifies; proxy
+// returns the proxy whose dns a specProxyDNS transport is set up with.
+func (s transportspec) build(r dnsx.Resolver, pxr ipn.Proxies, g Bridge, proxy func(string) (x.Proxy, error)) (dnsx.Transport, error) {
+	nargs := map[string]int{specDNS53: 2, specProxyDNS: 0, specDoH: 2, specDoHHeaders: 3, specODoH: 3, specDoT: 2, specDNSCrypt: 1, specGroup: 2}
+	if n, ok := nargs[s.Kind]; !ok {
+		return nil, errSpecKind
+	} else if len(s.Args) != n {
+		return nil, errSpecArgs
+	}
+	csv := func(v string) []string {
+		if len(v) <= 0 {
+			return []string{}
+		}
+		return strings.Split(v, ",")
+	}
+
+	switch s.Kind {
+	case specDNS53:
+		return dns53.NewTransport(s.ID, s.Args[0], s.Args[1], pxr, g)
+	case specProxyDNS:
+		p, err := proxy(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		return newProxyDNS(p, pxr, g)
+	case specDoH:
+		return doh.NewTransport(s.ID, s.Args[0], csv(s.Args[1]), pxr, g)
+	case specDoHHeaders:
+		return doh.NewTransportWithHeaders(s.ID, s.Args[0], csv(s.Args[1]), s.Args[2], pxr, g)
+	case specODoH:
+		return doh.NewOdohTransport(s.ID, s.Args[0], s.Args[1], csv(s.Args[2]), pxr, g)
+	case specDoT:
+		return dns53.NewTLSTransport(s.ID, s.Args[0], csv(s.Args[1]), pxr, g)
+	case specDNSCrypt:
+		tm, err := r.GetMult(dnsx.DcProxy)
+		if err != nil {
+			return nil, err
+		}
+		// todo: unexpose DcMulti, cast to TransportMult
+		if p, ok := tm.(*dnscrypt.DcMulti); ok {
+			return dnscrypt.NewTransport(p, s.ID, s.Args[0])
+		}
+		return nil, dnsx.ErrNoDcProxy
+	case specGroup:
+		return dnsx.NewTransportGroup(s.ID, s.Args[0], s.Args[1], r)
+	}
+	return nil, errSpecKind
+}
+
+// newProxyDNS creates a DNS53 transport as defined in Proxy's configuration.
+func newProxyDNS(p x.Proxy, pxr ipn.Proxies, g Bridge) (dnsx.Transport, error) {
+	ipOrHostCsv := p.DNS()
+	if len(ipOrHostCsv) == 0 {
+		log.W("dns: no proxy dns for %s @ %s", p.ID(), p.GetAddr())
+		return nil, dnsx.ErrNoProxyDNS
+	}
+	ipsOrHost := strings.Split(ipOrHostCsv, ",")
+	if len(ipsOrHost) == 0 {
+		log.W("dns: no dns for %s @ %s", p.ID(), p.GetAddr())
+		return nil, dnsx.ErrNoProxyDNS
+	}
+	first := ipsOrHost[0]
+	ipport, err := xdns.DnsIPPort(first)
+	hostname := first // could be multiple hostnames, but choose the first
+	if err != nil {   // use hostname
+		return dns53.NewTransportFromHostname(p.ID(), hostname, "", pxr, g)
+	}
+	// use ipports; register with same id as the proxy p
+	return dns53.NewTransportFrom(p.ID(), ipport, pxr, g)
+}
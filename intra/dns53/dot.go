@@ -7,10 +7,13 @@
 package dns53
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"net/url"
 	"time"
 
@@ -34,14 +37,24 @@ type dot struct {
 	rd      *protect.RDial
 	proxies ipn.Proxies // may be nil
 	relay   ipn.Proxy   // may be nil
+	pad     *dnsx.Padding
+	certs   *dnsx.CertChecks
+	conns   dnsx.ConnStats // conns are not pooled; see: sendRequest
 	est     core.P2QuantileEstimator
 }
 
 var _ dnsx.Transport = (*dot)(nil)
+var _ dnsx.Warmer = (*dot)(nil)
+var _ dnsx.Padder = (*dot)(nil)
+var _ dnsx.CertChecker = (*dot)(nil)
+var _ dnsx.ConnReporter = (*dot)(nil)
 
 // NewTLSTransport returns a DNS over TLS transport, ready for use.
 func NewTLSTransport(id, rawurl string, addrs []string, px ipn.Proxies, ctl protect.Controller) (t dnsx.Transport, err error) {
-	tlscfg := &tls.Config{}
+	tlscfg := &tls.Config{
+		// conns aren't pooled; resumes sessions of previous (warmup) conns
+		ClientSessionCache: tls.NewLRUClientSessionCache(dotsessions),
+	}
 	// rawurl is either tls:host[:port] or tls://host[:port] or host[:port]
 	parsedurl, err := url.Parse(rawurl)
 	if err != nil {
@@ -61,6 +74,9 @@ func NewTLSTransport(id, rawurl string, addrs []string, px ipn.Proxies, ctl prot
 	_, ok := dialers.New(hostname, addrs)
 	// add sni to tls config
 	tlscfg.ServerName = hostname
+	certs := dnsx.NewCertChecks()
+	// checks beyond the chain, if set; see: SetCertChecks
+	tlscfg.VerifyConnection = certs.Verify
 	tx := &dot{
 		id:      id,
 		url:     rawurl,
@@ -69,6 +85,8 @@ func NewTLSTransport(id, rawurl string, addrs []string, px ipn.Proxies, ctl prot
 		proxies: px,
 		rd:      rd,
 		relay:   relay,
+		pad:     dnsx.NewPadding(),
+		certs:   certs,
 		est:     core.NewP50Estimator(),
 	}
 	// local dialer: protect.MakeNsDialer(id, ctl)
@@ -133,9 +151,14 @@ func (t *dot) pxdial(pid string) (conn *dns.Conn, err error) {
 	}
 	// higher timeout for proxy
 	_ = pxconn.SetDeadline(time.Now().Add(dottimeout * 3))
-	pxconn, err = t.addtls(pxconn)
+	pxconn, err = t.addtls(pxconn, func() (net.Conn, error) {
+		c, err := px.Dialer().Dial("tcp", t.addr)
+		if c != nil {
+			_ = c.SetDeadline(time.Now().Add(dottimeout * 3))
+		}
+		return c, err
+	})
 	if err != nil {
-		clos(pxconn)
 		return
 	}
 	conn = &dns.Conn{Conn: pxconn}
@@ -148,11 +171,17 @@ func clos(c io.Closer) {
 	}
 }
 
-// perform tls handshake
-func (t *dot) addtls(c net.Conn) (net.Conn, error) {
-	tlsconn := tls.Client(c, t.c.TLSConfig)
-	err := tlsconn.Handshake()
-	return tlsconn, err
+// perform tls handshake over c, saying hello as set (see: SetTLSHello);
+// redial, if needed, dials a new conn to fall back over.
+func (t *dot) addtls(c net.Conn, redial func() (net.Conn, error)) (net.Conn, error) {
+	first := true
+	return dialers.HelloClient(context.Background(), t.id, t.c.TLSConfig, func() (net.Conn, error) {
+		if first {
+			first = false
+			return c, nil
+		}
+		return redial()
+	})
 }
 
 func (t *dot) sendRequest(pid string, q []byte) (response []byte, elapsed time.Duration, qerr *dnsx.QueryError) {
@@ -177,11 +206,20 @@ func (t *dot) sendRequest(pid string, q []byte) (response []byte, elapsed time.D
 
 	if err == nil {
 		// FIXME: conn pooling using t.c.Dial + ExchangeWithConn
+		t.conns.Got(false) // never reused
 		ans, elapsed, err = t.c.ExchangeWithConn(msg, conn)
 		clos(conn)
+		if err != nil {
+			t.conns.Closed(dnsx.ConnError)
+		} else {
+			t.conns.Closed(dnsx.ConnDone)
+		}
 	} // fallthrough
 
-	if err != nil {
+	if errors.Is(err, dnsx.ErrCertCheck) {
+		qerr = dnsx.NewTransportQueryError(err)
+		return
+	} else if err != nil {
 		qerr = dnsx.NewSendFailedQueryError(err)
 		return
 	}
@@ -198,13 +236,15 @@ func (t *dot) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error)
 
 	_, pid := xdns.Net2ProxyID(network)
 
-	response, elapsed, qerr := t.doQuery(pid, q)
+	response, elapsed, qerr := t.doQuery(pid, t.pad.Pad(q))
 
 	status := dnsx.Complete
 	if qerr != nil {
 		err = qerr.Unwrap()
 		status = qerr.Status()
 		log.W("dot: err(%v) / size(%d)", err, len(response))
+	} else {
+		response = t.pad.Unpad(response)
 	}
 	ans := xdns.AsMsg(response)
 	t.status = status
@@ -227,6 +267,46 @@ func (t *dot) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error)
 	return response, err
 }
 
+// SetPadding implements dnsx.Padder
+func (t *dot) SetPadding(policy, block int) error {
+	return t.pad.Set(policy, block)
+}
+
+// SetCertChecks implements dnsx.CertChecker
+func (t *dot) SetCertChecks(staple bool, minscts int, keys bool, alert dnsx.CertAlert) error {
+	t.certs.Set(staple, minscts, keys, alert)
+	return nil
+}
+
+// ConnStats implements dnsx.ConnReporter
+func (t *dot) ConnStats() *dnsx.ConnStats {
+	return &t.conns
+}
+
+// CertStatus implements dnsx.CertChecker
+func (t *dot) CertStatus() string {
+	return t.certs.Status()
+}
+
+// CoverIPs implements dnsx.CertChecker
+func (t *dot) CoverIPs(ips ...netip.Addr) {
+	t.certs.Cover(ips...)
+}
+
+// Warmup implements dnsx.Warmer
+func (t *dot) Warmup() (err error) {
+	var conn *dns.Conn
+	if t.relay != nil {
+		conn, err = t.pxdial("")
+	} else {
+		conn, err = t.tlsdial()
+	}
+	if conn != nil {
+		clos(conn)
+	}
+	return
+}
+
 func (t *dot) ID() string {
 	return t.id
 }
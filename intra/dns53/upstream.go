@@ -7,11 +7,14 @@
 package dns53
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/netip"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	x "github.com/celzero/firestack/intra/backend"
@@ -32,6 +35,22 @@ const (
 	DotPort    = "853"      // default DNS over TLS port
 	timeout    = 5 * time.Second
 	dottimeout = 8 * time.Second
+
+	// tls sessions cached per dot transport
+	dotsessions = 4
+
+	// retries after the first attempt, by default; none, as before
+	// retries were added, and so, opt-in per transport (see: SetRetries)
+	defretries = 0
+	// max retries after the first attempt
+	maxretries = 4
+	// all attempts complete within this duration; well under the
+	// usual stub resolver timeouts, so that stubs need not retry
+	retrybudget = 1800 * time.Millisecond
+	// backoff before the first retry; doubles for each retry thereafter
+	retrybackoff = 250 * time.Millisecond
+	// min time given to an attempt, if the budget allows
+	minattempt = 300 * time.Millisecond
 )
 
 var errQueryParse = errors.New("dns53: err parse query")
@@ -46,10 +65,13 @@ type transport struct {
 	dialer   *protect.RDial
 	proxies  ipn.Proxies // should never be nil
 	relay    ipn.Proxy   // may be nil
+	retries  atomic.Int32
 	est      core.P2QuantileEstimator
 }
 
 var _ dnsx.Transport = (*transport)(nil)
+var _ dnsx.Retrier = (*transport)(nil)
+var _ dnsx.ContextQuerier = (*transport)(nil)
 
 // NewTransportFromHostname returns a DNS53 transport serving from hostname, ready for use.
 func NewTransportFromHostname(id, hostname string, ipcsv string, px ipn.Proxies, ctl protect.Controller) (t dnsx.Transport, err error) {
@@ -90,6 +112,7 @@ func newTransport(id string, do *settings.DNSOptions, px ipn.Proxies, ctl protec
 		relay:    relay, // may be nil
 		est:      core.NewP50Estimator(),
 	}
+	tx.retries.Store(defretries)
 	ipcsv := do.ResolvedAddrs()
 	hasips := len(ipcsv) > 0
 	ips := strings.Split(ipcsv, ",")       // may be nil or empty or ip:port
@@ -121,13 +144,18 @@ func NewTransportFrom(id string, ipp netip.AddrPort, px ipn.Proxies, ctl protect
 // Given a raw DNS query (including the query ID), this function sends the
 // query.  If the query is successful, it returns the response and a nil qerr.  Otherwise,
 // it returns a SERVFAIL response and a qerr with a status value indicating the cause.
-func (t *transport) doQuery(network, pid string, q []byte) (response []byte, elapsed time.Duration, qerr *dnsx.QueryError) {
+func (t *transport) doQuery(ctx context.Context, network, pid string, q []byte) (response []byte, elapsed time.Duration, attempts int, qerr *dnsx.QueryError) {
 	if len(q) < 2 {
 		qerr = dnsx.NewBadQueryError(fmt.Errorf("dns53: query length is %d", len(q)))
 		return
 	}
 
-	response, elapsed, qerr = t.send(network, pid, q)
+	if retries := int(t.retries.Load()); retries > 0 {
+		response, elapsed, attempts, qerr = t.sendWithRetries(ctx, network, pid, q, retries)
+	} else {
+		response, elapsed, qerr = t.send(ctx, network, pid, q, timeout)
+		attempts = 1
+	}
 
 	if qerr != nil { // only on send-request errors
 		response = xdns.Servfail(q)
@@ -175,8 +203,64 @@ func (t *transport) dial(network string) (*dns.Conn, error) {
 	}
 }
 
+// sendWithRetries sends q up to retries+1 times if it fails to send or gets no
+// response, backing off (with jitter) between attempts; the final attempt is
+// over tcp. All attempts complete within retrybudget, or until ctx is done.
+func (t *transport) sendWithRetries(ctx context.Context, network, pid string, q []byte, retries int) (response []byte, elapsed time.Duration, n int, qerr *dnsx.QueryError) {
+	start := time.Now()
+	backoff := retrybackoff
+	total := retries + 1
+
+	defer func() {
+		elapsed = time.Since(start)
+	}()
+
+	for n = 1; n <= total; n++ {
+		// split what's left of the budget between the remaining attempts
+		left := retrybudget - time.Since(start)
+		to := left / time.Duration(total-n+1)
+		if to < minattempt {
+			to = min(minattempt, left)
+		}
+		proto := network
+		if n == total && n > 1 {
+			proto = dnsx.NetTypeTCP
+		}
+
+		sent := time.Now()
+		response, _, qerr = t.send(ctx, proto, pid, q, to)
+		if qerr == nil || !retriable(qerr) || n >= total {
+			return
+		}
+
+		// wait for backoff ± 50%, less the time spent on this attempt
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		wait -= time.Since(sent)
+		if time.Since(start)+max(wait, 0) >= retrybudget-minattempt/2 {
+			log.D("dns53: send: (%s) no budget to retry #%d; err %v", t.id, n, qerr)
+			return
+		}
+		log.D("dns53: send: (%s) retry #%d in %s; err %v", t.id, n, wait, qerr)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				log.D("dns53: send: (%s) gave up on retry #%d; %v", t.id, n, ctx.Err())
+				return
+			}
+		}
+		backoff *= 2
+	}
+	return
+}
+
+func retriable(qerr *dnsx.QueryError) bool {
+	s := qerr.Status()
+	return s == dnsx.SendFailed || s == dnsx.NoResponse
+}
+
 // ref: github.com/celzero/midway/blob/77ede02c/midway/server.go#L179
-func (t *transport) send(network, pid string, q []byte) (response []byte, elapsed time.Duration, qerr *dnsx.QueryError) {
+func (t *transport) send(ctx context.Context, network, pid string, q []byte, to time.Duration) (response []byte, elapsed time.Duration, qerr *dnsx.QueryError) {
 	var ans *dns.Msg
 	var err error
 	msg := xdns.AsMsg(q)
@@ -184,6 +268,10 @@ func (t *transport) send(network, pid string, q []byte) (response []byte, elapse
 		qerr = dnsx.NewBadQueryError(errQueryParse)
 		return
 	}
+	if err = ctx.Err(); err != nil {
+		qerr = dnsx.NewNoResponseQueryError(err)
+		return
+	}
 
 	var conn *dns.Conn
 
@@ -213,7 +301,17 @@ func (t *transport) send(network, pid string, q []byte) (response []byte, elapse
 
 	if err == nil { // send query
 		t.lastaddr = remoteAddrIfAny(conn) // may return empty string
-		ans, elapsed, err = t.client.ExchangeWithConn(msg, conn)
+		c := t.client
+		if d, ok := ctx.Deadline(); ok {
+			to = min(to, time.Until(d))
+		}
+		if to != c.Timeout {
+			c = &dns.Client{Net: c.Net, Timeout: to}
+		}
+		// unblocks the exchange as soon as ctx is done
+		stop := context.AfterFunc(ctx, func() { clos(conn) })
+		ans, elapsed, err = c.ExchangeWithConn(msg, conn)
+		stop()
 		clos(conn) // TODO: conn pooling w/ ExchangeWithConn
 		if err != nil {
 			qerr = dnsx.NewSendFailedQueryError(err)
@@ -233,8 +331,13 @@ func (t *transport) send(network, pid string, q []byte) (response []byte, elapse
 }
 
 func (t *transport) Query(network string, q []byte, smm *x.DNSSummary) (r []byte, err error) {
+	return t.QueryContext(context.Background(), network, q, smm)
+}
+
+// QueryContext implements dnsx.ContextQuerier
+func (t *transport) QueryContext(ctx context.Context, network string, q []byte, smm *x.DNSSummary) (r []byte, err error) {
 	proto, pid := xdns.Net2ProxyID(network)
-	response, elapsed, qerr := t.doQuery(proto, pid, q)
+	response, elapsed, attempts, qerr := t.doQuery(ctx, proto, pid, q)
 
 	status := dnsx.Complete
 	if qerr != nil {
@@ -256,6 +359,10 @@ func (t *transport) Query(network string, q []byte, smm *x.DNSSummary) (r []byte
 		smm.RelayServer = x.SummaryProxyLabel + pid
 	}
 	smm.Status = status
+	smm.Attempts = attempts
+	if qerr == nil {
+		smm.AttemptOK = attempts
+	}
 	t.est.Add(smm.Latency)
 
 	log.V("dns53: len(res): %d, data: %s, via: %s, err? %v", len(response), smm.RData, smm.RelayServer, err)
@@ -263,6 +370,16 @@ func (t *transport) Query(network string, q []byte, smm *x.DNSSummary) (r []byte
 	return response, err
 }
 
+// SetRetries implements dnsx.Retrier
+func (t *transport) SetRetries(n int) {
+	if n < 0 {
+		n = 0
+	} else if n > maxretries {
+		n = maxretries
+	}
+	t.retries.Store(int32(n))
+}
+
 func (t *transport) ID() string {
 	return t.id
 }
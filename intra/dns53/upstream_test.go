@@ -0,0 +1,189 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dns53
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/miekg/dns"
+)
+
+var errTestNoProxy = errors.New("test: no proxies")
+
+// noProxies has no proxies, and so, no relays.
+type noProxies struct {
+	ipn.Proxies // unused
+}
+
+func (noProxies) ProxyFor(string) (ipn.Proxy, error) { return nil, errTestNoProxy }
+
+// lossyServer answers queries over udp and tcp on the same loopback port,
+// but drops the first dropudp queries over udp; counts queries it saw.
+type lossyServer struct {
+	addr    string
+	dropudp int32
+	udp     atomic.Int32 // queries over udp
+	tcp     atomic.Int32 // queries over tcp
+}
+
+func newLossyServer(tb testing.TB, dropudp int32) *lossyServer {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		tb.Skipf("dns53: tcp port %s: %v", pc.LocalAddr(), err)
+	}
+	s := &lossyServer{addr: pc.LocalAddr().String(), dropudp: dropudp}
+	answer := func(w dns.ResponseWriter, q *dns.Msg) {
+		if _, isudp := w.RemoteAddr().(*net.UDPAddr); isudp {
+			if s.udp.Add(1) <= s.dropudp {
+				return // dropped
+			}
+		} else {
+			s.tcp.Add(1)
+		}
+		ans := new(dns.Msg)
+		ans.SetReply(q)
+		ans.Answer = append(ans.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		_ = w.WriteMsg(ans)
+	}
+	us := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(answer)}
+	ts := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(answer)}
+	go func() { _ = us.ActivateAndServe() }()
+	go func() { _ = ts.ActivateAndServe() }()
+	tb.Cleanup(func() {
+		_ = us.Shutdown()
+		_ = ts.Shutdown()
+	})
+	return s
+}
+
+func query(tb testing.TB) []byte {
+	tb.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func newTestTransport(tb testing.TB, addr string) *transport {
+	tb.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	dt, err := NewTransport("test53", host, port, noProxies{}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dt.(*transport)
+}
+
+func TestRetriesOffByDefault(t *testing.T) {
+	s := newLossyServer(t, 1)
+	tx := newTestTransport(t, s.addr)
+
+	smm := new(x.DNSSummary)
+	if _, err := tx.Query(dnsx.NetTypeUDP, query(t), smm); err == nil {
+		t.Fatal("dns53: dropped query answered sans retries")
+	}
+	if smm.Attempts != 1 || smm.AttemptOK != 0 {
+		t.Errorf("dns53: attempts %d, ok #%d; want 1, 0", smm.Attempts, smm.AttemptOK)
+	}
+	if n := s.udp.Load() + s.tcp.Load(); n != 1 {
+		t.Errorf("dns53: server saw %d queries; want 1", n)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		dropudp int32
+		ok      int   // attempt that succeeds; 0 if none
+		udp     int32 // queries over udp
+		tcp     int32 // queries over tcp
+	}{
+		{"first", 2, 0, 1, 1, 0},
+		{"second", 2, 1, 2, 2, 0},
+		{"final-over-tcp", 2, 2, 3, 2, 1},
+		{"tcp-only-retry", 1, 1, 2, 1, 1},
+		{"clamped", maxretries + 3, 0, 1, 1, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newLossyServer(t, tc.dropudp)
+			tx := newTestTransport(t, s.addr)
+			tx.SetRetries(tc.retries)
+
+			smm := new(x.DNSSummary)
+			start := time.Now()
+			if _, err := tx.Query(dnsx.NetTypeUDP, query(t), smm); err != nil {
+				t.Fatalf("dns53: query: %v", err)
+			}
+			if d := time.Since(start); d > retrybudget+200*time.Millisecond {
+				t.Errorf("dns53: took %s; over budget %s", d, retrybudget)
+			}
+			if smm.AttemptOK != tc.ok || smm.Attempts != tc.ok {
+				t.Errorf("dns53: attempts %d, ok #%d; want %d", smm.Attempts, smm.AttemptOK, tc.ok)
+			}
+			if u, c := s.udp.Load(), s.tcp.Load(); u != tc.udp || c != tc.tcp {
+				t.Errorf("dns53: udp %d, tcp %d; want %d, %d", u, c, tc.udp, tc.tcp)
+			}
+		})
+	}
+}
+
+func TestQueryContextCancels(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+	}{
+		{"once", 0},
+		{"with-retries", 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newLossyServer(t, 1<<30) // drops all over udp
+			tx := newTestTransport(t, s.addr)
+			tx.SetRetries(tc.retries)
+
+			const d = 200 * time.Millisecond
+			ctx, cancel := context.WithTimeout(context.Background(), d)
+			defer cancel()
+			smm := new(x.DNSSummary)
+			start := time.Now()
+			if _, err := tx.QueryContext(ctx, dnsx.NetTypeUDP, query(t), smm); err == nil {
+				t.Fatal("dns53: dropped query answered")
+			}
+			if took := time.Since(start); took > d+200*time.Millisecond {
+				t.Errorf("dns53: gave up after %s; want ~%s", took, d)
+			}
+			if smm.AttemptOK != 0 {
+				t.Errorf("dns53: attempt #%d ok; want none", smm.AttemptOK)
+			}
+			if n := s.tcp.Load(); n != 0 {
+				t.Errorf("dns53: %d queries over tcp after cancel", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/log"
+)
+
+// Policies for flows of apps that send dns straight to a known public
+// resolver, bypassing the tunnel's resolver; see: Tunnel.SetDNSBypassPolicy
+const (
+	// DNSBypassAllow lets such flows through; the default.
+	DNSBypassAllow = iota
+	// DNSBypassBlock resets (tcp) or refuses (udp) such flows.
+	DNSBypassBlock
+	// DNSBypassRedirect serves plain dns (port 53) and DoT (tcp port 853)
+	// flows with the tunnel's resolver; DoH (443) and DoQ (udp port 853)
+	// flows cannot be served transparently, and so, are blocked instead.
+	DNSBypassRedirect
+)
+
+// tag in Flow's meta for flows to known public resolvers
+const dnsbypasstag = "dnsbypass"
+
+// ports of plain (53), DoH (443), DoT and DoQ (853) resolvers
+var dnsbypassports = []uint16{53, 443, 853}
+
+// well-known public resolvers (Google, Cloudflare, Quad9, OpenDNS, AdGuard,
+// CleanBrowsing, NextDNS); replaceable with Tunnel.SetDNSBypassList
+var defaultDNSBypassList = strings.Join([]string{
+	"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+	"1.1.1.1", "1.0.0.1", "1.1.1.2", "1.0.0.2", "1.1.1.3", "1.0.0.3",
+	"2606:4700:4700::1111", "2606:4700:4700::1001",
+	"9.9.9.9", "149.112.112.112", "9.9.9.11", "149.112.112.11",
+	"2620:fe::fe", "2620:fe::9", "2620:fe::11", "2620:fe::fe:11",
+	"208.67.222.222", "208.67.220.220", "2620:119:35::35", "2620:119:53::53",
+	"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff",
+	"185.228.168.9", "185.228.169.9", "2a0d:2a00:1::2", "2a0d:2a00:2::2",
+	"45.90.28.0/24", "45.90.30.0/24", "2a07:a8c0::/33", "2a07:a8c1::/33",
+}, ",")
+
+var (
+	errDNSBypassList     = errors.New("dns bypass: no valid endpoints")
+	errDNSBypassBlocked  = errors.New("dns bypass: blocked")
+	errDNSBypassRedirect = errors.New("dns bypass: redirected")
+)
+
+// dnsbypass matches flows against known public resolver endpoints,
+// and holds per-uid policies for them.
+type dnsbypass struct {
+	sync.RWMutex                             // protects all fields
+	list         string                      // csv as set; empty for the built-in list
+	pfx          []netip.Prefix              // resolvers on any of dnsbypassports
+	ipp          map[netip.AddrPort]struct{} // resolver endpoints
+	policy       map[string]int              // uid -> policy
+	def          int                         // policy for uids sans one
+}
+
+func newDNSBypass() *dnsbypass {
+	b := &dnsbypass{
+		ipp:    make(map[netip.AddrPort]struct{}),
+		policy: make(map[string]int),
+		def:    DNSBypassAllow,
+	}
+	_ = b.setList("")
+	return b
+}
+
+// setList replaces known resolvers with csv of ips, cidrs, or ip:ports;
+// the built-in list is restored if csv is empty.
+func (b *dnsbypass) setList(csv string) error {
+	pfx, ipp, err := parseDNSBypassList(csv)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.list = strings.TrimSpace(csv)
+	b.pfx = pfx
+	b.ipp = ipp
+	b.Unlock()
+
+	log.I("dnsbypass: %d resolvers, %d endpoints", len(pfx), len(ipp))
+	return nil
+}
+
+// parseDNSBypassList parses csv of ips, cidrs, or ip:ports; or
+// the built-in list, if csv is empty.
+func parseDNSBypassList(csv string) (pfx []netip.Prefix, ipp map[netip.AddrPort]struct{}, err error) {
+	if len(strings.TrimSpace(csv)) <= 0 {
+		csv = defaultDNSBypassList
+	}
+	pfx = make([]netip.Prefix, 0)
+	ipp = make(map[netip.AddrPort]struct{})
+	for _, v := range strings.Split(csv, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) <= 0 {
+			continue
+		}
+		if p, err := netip.ParsePrefix(v); err == nil {
+			pfx = append(pfx, p.Masked())
+		} else if ip, err := core.ParseAddr(v); err == nil {
+			pfx = append(pfx, netip.PrefixFrom(ip, ip.BitLen()))
+		} else if x, err := core.ParseAddrPort(v); err == nil {
+			ipp[x] = struct{}{}
+		} else {
+			log.W("dnsbypass: skip invalid endpoint %s", v)
+		}
+	}
+	if len(pfx) <= 0 && len(ipp) <= 0 {
+		return nil, nil, errDNSBypassList
+	}
+	return
+}
+
+// setPolicy sets policy for uid; or for all uids sans one, if uid is empty.
+func (b *dnsbypass) setPolicy(uid string, policy int) {
+	if policy < DNSBypassAllow || policy > DNSBypassRedirect {
+		policy = DNSBypassAllow
+	}
+
+	b.Lock()
+	if len(uid) <= 0 {
+		b.def = policy
+	} else if policy == DNSBypassAllow {
+		delete(b.policy, uid)
+	} else {
+		b.policy[uid] = policy
+	}
+	b.Unlock()
+
+	log.I("dnsbypass: uid %s policy %d", uid, policy)
+}
+
+// rules returns the list (csv) as set, the policy for uids sans one, and
+// policies of uids that have one.
+func (b *dnsbypass) rules() (list string, def int, policies map[string]int) {
+	b.RLock()
+	defer b.RUnlock()
+
+	policies = make(map[string]int, len(b.policy))
+	for uid, p := range b.policy {
+		policies[uid] = p
+	}
+	return b.list, b.def, policies
+}
+
+// setRules replaces the list, and all policies, at once; see: rules.
+func (b *dnsbypass) setRules(list string, def int, policies map[string]int) error {
+	pfx, ipp, err := parseDNSBypassList(list)
+	if err != nil {
+		return err
+	}
+	valid := func(p int) bool { return p >= DNSBypassAllow && p <= DNSBypassRedirect }
+	if !valid(def) {
+		def = DNSBypassAllow
+	}
+	pol := make(map[string]int, len(policies))
+	for uid, p := range policies {
+		if len(uid) > 0 && valid(p) && p != DNSBypassAllow {
+			pol[uid] = p
+		}
+	}
+
+	b.Lock()
+	b.list = strings.TrimSpace(list)
+	b.pfx = pfx
+	b.ipp = ipp
+	b.def = def
+	b.policy = pol
+	b.Unlock()
+
+	log.I("dnsbypass: rules: %d resolvers, %d endpoints, %d policies", len(pfx), len(ipp), len(pol))
+	return nil
+}
+
+// policyFor returns the policy for uid.
+func (b *dnsbypass) policyFor(uid string) int {
+	b.RLock()
+	defer b.RUnlock()
+
+	if p, ok := b.policy[uid]; ok {
+		return p
+	}
+	return b.def
+}
+
+// match returns true if target, or any of its realips (csv), is a known resolver.
+func (b *dnsbypass) match(target netip.AddrPort, realips string) bool {
+	if !isDNSBypassPort(target.Port()) {
+		return false
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, x := range append(makeIPPorts(realips, target, 0), target) {
+		if _, ok := b.ipp[x]; ok {
+			return true
+		}
+		for _, p := range b.pfx {
+			if p.Contains(x.Addr()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verdict returns the error to end the flow (over proto) to a known resolver
+// with, if uid's policy blocks it, and whether the flow must be served by the
+// tunnel's resolver, instead.
+func (b *dnsbypass) verdict(uid, proto string, target netip.AddrPort) (redirect bool, err error) {
+	switch b.policyFor(uid) {
+	case DNSBypassBlock:
+		return false, errDNSBypassBlocked
+	case DNSBypassRedirect:
+		if servable(proto, target.Port()) {
+			return true, nil
+		}
+		return false, errDNSBypassBlocked
+	}
+	return false, nil
+}
+
+// servable returns true if dns flows over proto to port can be served
+// by the tunnel's resolver; that is, plain dns and DoT, but not DoH or DoQ.
+func servable(proto string, port uint16) bool {
+	return port == 53 || (port == 853 && proto == dnsx.NetTypeTCP)
+}
+
+func isDNSBypassPort(port uint16) bool {
+	for _, p := range dnsbypassports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// withTag appends tag to the csv meta.
+func withTag(meta, tag string) string {
+	if len(meta) <= 0 {
+		return tag
+	}
+	return meta + "," + tag
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/celzero/firestack/intra/dnsx"
+)
+
+func TestDNSBypassMatch(t *testing.T) {
+	b := newDNSBypass()
+	tests := []struct {
+		target  string
+		realips string
+		want    bool
+	}{
+		{"8.8.8.8:53", "", true},
+		{"8.8.8.8:443", "", true},
+		{"[2606:4700:4700::1111]:853", "", true},
+		{"45.90.28.77:853", "", true}, // cidr
+		{"8.8.8.8:80", "", false},     // not a dns port
+		{"192.0.2.1:443", "", false},
+		{"10.111.222.9:443", "1.1.1.1", true}, // alg ip of a resolver
+	}
+	for _, tc := range tests {
+		if got := b.match(netip.MustParseAddrPort(tc.target), tc.realips); got != tc.want {
+			t.Errorf("dnsbypass: match(%s, %q): got %t; want %t", tc.target, tc.realips, got, tc.want)
+		}
+	}
+
+	if err := b.setList("192.0.2.53, 198.51.100.1:5353"); err != nil {
+		t.Fatal(err)
+	}
+	if b.match(netip.MustParseAddrPort("8.8.8.8:53"), "") {
+		t.Error("dnsbypass: built-in list in effect after it was replaced")
+	}
+	if !b.match(netip.MustParseAddrPort("192.0.2.53:853"), "") {
+		t.Error("dnsbypass: listed ip not matched")
+	}
+	if err := b.setList(" , nope"); err != errDNSBypassList {
+		t.Errorf("dnsbypass: want %v, got %v", errDNSBypassList, err)
+	}
+}
+
+func TestDNSBypassVerdict(t *testing.T) {
+	b := newDNSBypass()
+	b.setPolicy("10", DNSBypassBlock)
+	b.setPolicy("20", DNSBypassRedirect)
+
+	tests := []struct {
+		uid      string
+		proto    string
+		target   string
+		redirect bool
+		err      error
+	}{
+		{"1", dnsx.NetTypeUDP, "8.8.8.8:53", false, nil}, // allowed
+		{"10", dnsx.NetTypeTCP, "8.8.8.8:853", false, errDNSBypassBlocked},
+		{"20", dnsx.NetTypeUDP, "8.8.8.8:53", true, nil},
+		{"20", dnsx.NetTypeTCP, "8.8.8.8:53", true, nil},
+		{"20", dnsx.NetTypeTCP, "8.8.8.8:853", true, nil},                  // DoT
+		{"20", dnsx.NetTypeUDP, "8.8.8.8:853", false, errDNSBypassBlocked}, // DoQ
+		{"20", dnsx.NetTypeTCP, "8.8.8.8:443", false, errDNSBypassBlocked}, // DoH
+	}
+	for _, tc := range tests {
+		redirect, err := b.verdict(tc.uid, tc.proto, netip.MustParseAddrPort(tc.target))
+		if redirect != tc.redirect || err != tc.err {
+			t.Errorf("dnsbypass: %s %s %s: got %t, %v; want %t, %v", tc.uid, tc.proto, tc.target, redirect, err, tc.redirect, tc.err)
+		}
+	}
+
+	// uids sans a policy of their own fall back to the default
+	b.setPolicy("", DNSBypassRedirect)
+	if redirect, err := b.verdict("1", dnsx.NetTypeTCP, netip.MustParseAddrPort("1.1.1.1:853")); !redirect || err != nil {
+		t.Errorf("dnsbypass: default: got %t, %v; want redirect", redirect, err)
+	}
+	b.setPolicy("10", DNSBypassAllow)
+	if redirect, err := b.verdict("10", dnsx.NetTypeTCP, netip.MustParseAddrPort("1.1.1.1:853")); !redirect || err != nil {
+		t.Errorf("dnsbypass: allow falls back to the default: got %t, %v", redirect, err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnscrypt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// how long a server being removed or stopped waits for its in-flight queries
+const draintimeout = 5 * time.Second
+
+var errDraining = errors.New("dnscrypt: server draining")
+
+// drainer counts in-flight queries on a server, and once draining,
+// turns away new ones till the in-flight ones are done.
+type drainer struct {
+	sync.Mutex
+	n        int           // in-flight queries
+	draining bool          // no new queries if set
+	done     chan struct{} // closed when draining and n is 0
+}
+
+func newDrainer() *drainer {
+	return &drainer{done: make(chan struct{})}
+}
+
+// acquire returns false if d is draining; and true otherwise,
+// in which case, release must be called once the query is done.
+func (d *drainer) acquire() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.n++
+	return true
+}
+
+func (d *drainer) release() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.n--
+	if d.n <= 0 && d.draining {
+		d.closeLocked()
+	}
+}
+
+func (d *drainer) closeLocked() {
+	select {
+	case <-d.done:
+	default:
+		close(d.done)
+	}
+}
+
+// isDraining returns true if d no longer accepts new queries.
+func (d *drainer) isDraining() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.draining
+}
+
+// drain turns away new queries, and waits up to timeout for
+// in-flight ones; returns false if some are still in-flight.
+func (d *drainer) drain(timeout time.Duration) bool {
+	d.Lock()
+	d.draining = true
+	if d.n <= 0 {
+		d.closeLocked()
+	}
+	d.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-d.done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
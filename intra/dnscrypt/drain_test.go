@@ -0,0 +1,174 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnscrypt
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dnsx"
+)
+
+// fakeResolve answers q as-is, unless si was removed mid-query.
+func fakeResolve(_ string, q []byte, si *serverinfo, smm *x.DNSSummary) ([]byte, error) {
+	if si == nil {
+		smm.Status = dnsx.InternalError
+		return nil, errNoServers
+	}
+	time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+	if si.isDraining() {
+		smm.Status = dnsx.SendFailed
+		return nil, errDraining
+	}
+	smm.Status = dnsx.Complete
+	smm.Server = si.Name
+	return q, nil
+}
+
+func newFakeMult() *DcMulti {
+	return &DcMulti{
+		registeredServers: make(map[string]registeredserver),
+		serversInfo:       newServersInfo(),
+		est:               core.NewP50Estimator(),
+	}
+}
+
+func addFakeServer(p *DcMulti, name string) *serverinfo {
+	si := &serverinfo{Name: name, mult: p, drain: newDrainer()}
+	r := registeredserver{name: name}
+	p.Lock()
+	p.registeredServers[name] = r
+	p.Unlock()
+	p.serversInfo.Lock()
+	p.serversInfo.registeredServers[name] = r
+	p.serversInfo.inner[name] = si
+	p.serversInfo.Unlock()
+	return si
+}
+
+func TestDrainChurn(t *testing.T) {
+	resolveq = fakeResolve
+	defer func() { resolveq = resolve }()
+
+	p := newFakeMult()
+	addFakeServer(p, "s0") // never removed
+
+	done := make(chan struct{})
+	go func() { // churn
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			name := "s" + strconv.Itoa(1+i%4)
+			addFakeServer(p, name)
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			p.Remove(name)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var fails []string
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				smm := new(x.DNSSummary)
+				ch := make(chan error, 1)
+				go func() {
+					var err error
+					if si := p.serversInfo.get("s" + strconv.Itoa(1+i%4)); g%2 == 0 && si != nil {
+						_, err = si.Query(dnsx.NetTypeUDP, aquery("example.com"), smm)
+					} else {
+						_, err = p.Query(dnsx.NetTypeUDP, aquery("example.com"), smm)
+					}
+					ch <- err
+				}()
+				select {
+				case err := <-ch:
+					if err != nil || smm.Status != dnsx.Complete {
+						mu.Lock()
+						fails = append(fails, smm.Server+": "+err.Error())
+						mu.Unlock()
+					}
+				case <-time.After(draintimeout * 2):
+					t.Error("query hung")
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	<-done
+
+	if len(fails) > 0 {
+		t.Errorf("%d queries lost; ex: %v", len(fails), fails[0])
+	}
+	if live := p.serversInfo.all(); len(live) != 1 || live[0].Name != "s0" {
+		t.Errorf("servers left: %v", live)
+	}
+}
+
+func TestDrainWaitsInflight(t *testing.T) {
+	release := make(chan struct{})
+	resolveq = func(_ string, q []byte, si *serverinfo, smm *x.DNSSummary) ([]byte, error) {
+		<-release
+		smm.Status = dnsx.Complete
+		return q, nil
+	}
+	defer func() { resolveq = resolve }()
+
+	p := newFakeMult()
+	addFakeServer(p, "s0")
+	addFakeServer(p, "s1")
+	p.setLiveServers([]string{"s0", "s1"})
+
+	si := p.serversInfo.get("s1")
+	qdone := make(chan error, 1)
+	go func() {
+		_, err := si.Query(dnsx.NetTypeUDP, aquery("example.com"), new(x.DNSSummary))
+		qdone <- err
+	}()
+	for inflight(si) <= 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rmdone := make(chan struct{})
+	go func() {
+		p.Remove("s1")
+		close(rmdone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case <-rmdone:
+		t.Fatal("removed with a query in-flight")
+	default:
+	}
+	if live := p.LiveTransports(); live != "s0" {
+		t.Errorf("live %q; want s0", live)
+	}
+
+	close(release)
+	if err := <-qdone; err != nil {
+		t.Errorf("in-flight query err: %v", err)
+	}
+	<-rmdone
+	if p.serversInfo.get("s1") != nil {
+		t.Error("s1 not deregistered")
+	}
+}
+
+func inflight(si *serverinfo) int {
+	si.drain.Lock()
+	defer si.drain.Unlock()
+	return si.drain.n
+}
@@ -18,11 +18,15 @@ import (
 	"context"
 	crypto_rand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	x "github.com/celzero/firestack/intra/backend"
@@ -49,8 +53,8 @@ type DcMulti struct {
 	liveServers         []string
 	proxies             ipn.Proxies
 	sigterm             context.CancelFunc
-	lastStatus          int
-	lastAddr            string
+	lastStatus          atomic.Int32 // queries may be concurrent
+	lastAddr            atomic.Value // string
 	ctl                 protect.Controller
 	dialer              *protect.RDial
 	est                 core.P2QuantileEstimator
@@ -61,9 +65,20 @@ var (
 	certRefreshDelayAfterFailure = 10 * time.Second
 )
 
+const (
+	// max servers whose certs are fetched at once
+	maxRefreshers = 4
+	// total time to wait on certs of all servers
+	refreshTimeout = 20 * time.Second
+)
+
 var _ dnsx.TransportMult = (*DcMulti)(nil)
+var _ dnsx.Warmer = (*DcMulti)(nil)
 var timeout8s = 8000 * time.Millisecond
 
+// resolveq resolves queries on dnscrypt servers; swapped out by tests.
+var resolveq = resolve
+
 var (
 	errNoCert          = errors.New("dnscrypt: error refreshing cert")
 	errQueryTooShort   = errors.New("dnscrypt: query size too short")
@@ -343,19 +358,68 @@ func resolve(network string, data []byte, si *serverinfo, smm *x.DNSSummary) (re
 	return response, err
 }
 
+// queryWith resolves q on si, or on another live server if si is nil or
+// draining. If si is removed (drained) while q is in-flight, q is retried
+// once on another live server, before its error is surfaced.
+func (proxy *DcMulti) queryWith(si *serverinfo, network string, q []byte, smm *x.DNSSummary) (r []byte, err error) {
+	if !si.acquire() {
+		if si = proxy.serversInfo.getOne(si); !si.acquire() {
+			// no live servers; resolve sets a terminal status on smm
+			return resolveq(network, q, nil, smm)
+		}
+	}
+	r, err = resolveq(network, q, si, smm)
+	si.release()
+
+	if err == nil || !si.isDraining() {
+		return
+	}
+	if other := proxy.serversInfo.getOne(si); other.acquire() {
+		log.I("dnscrypt: %s removed mid-query (err: %v); retry on %s", si.ID(), err, other.ID())
+		r, err = resolveq(network, q, other, smm)
+		other.release()
+	}
+	return
+}
+
+// setLiveServers sets the servers that are currently in-use.
+func (proxy *DcMulti) setLiveServers(live []string) int {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.liveServers = live
+	return len(live)
+}
+
+// Warmup implements dnsx.Warmer; fetches certs of all servers.
+func (proxy *DcMulti) Warmup() error {
+	_, err := proxy.Refresh()
+	return err
+}
+
 // LiveTransports returns csv of dnscrypt server-names currently in-use
 func (proxy *DcMulti) LiveTransports() string {
-	if len(proxy.liveServers) <= 0 {
-		return ""
+	proxy.RLock()
+	defer proxy.RUnlock()
+
+	// servers removed since the last refresh must not be reported
+	live := make([]string, 0, len(proxy.liveServers))
+	for _, name := range proxy.liveServers {
+		if proxy.serversInfo.live(name) {
+			live = append(live, name)
+		}
 	}
-	return strings.Join(proxy.liveServers[:], ",")
+	return strings.Join(live, ",")
 }
 
 func (proxy *DcMulti) refreshOne(uid string) bool {
+	proxy.RLock()
 	r, ok := proxy.registeredServers[uid]
+	proxy.RUnlock()
 	if !ok {
 		return false
 	}
+	proxy.serversInfo.registerServer(r.name, r.stamp)
 	if err := proxy.serversInfo.refreshServer(proxy, r.name, r.stamp); err != nil {
 		log.E("dnscrypt: refresh failed %s: %s; err: %v", r.name, stamp2str(&r.stamp), err)
 		return false
@@ -366,35 +430,98 @@ func (proxy *DcMulti) refreshOne(uid string) bool {
 
 // Refresh re-registers servers
 func (proxy *DcMulti) Refresh() (string, error) {
+	active, errs := proxy.refresh()
+	if len(active) > 0 {
+		return active, nil
+	}
+	for _, err := range errs { // ignore errors if live-servers are around
+		if err != nil {
+			return "", err
+		}
+	}
+	return active, nil
+}
+
+// RefreshReport re-registers servers, as Refresh does, and returns json
+// of x.RefreshReport with the outcome for each server.
+func (proxy *DcMulti) RefreshReport() string {
+	return report(proxy.refresh())
+}
+
+// Start starts periodic cert refreshes, if yet to, as they only start
+// with servers registered; and refreshes servers, as RefreshReport does.
+func (proxy *DcMulti) Start() string {
+	active, errs, err := proxy.start()
+	if err == errStarted {
+		active, errs = proxy.refresh()
+	}
+	return report(active, errs)
+}
+
+// report returns json of x.RefreshReport of active servers, and of the
+// outcome for each server in errs.
+func report(active string, errs map[string]error) string {
+	rs := make([]x.RefreshResult, 0, len(errs))
+	for name, err := range errs {
+		r := x.RefreshResult{ID: name, OK: err == nil, Code: x.ErrNone}
+		if err != nil {
+			r.Code = x.ErrDNSTransport
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				r.Code = x.ErrTimeout
+			}
+			r.Err = err.Error()
+		}
+		rs = append(rs, r)
+	}
+	slices.SortFunc(rs, func(a, b x.RefreshResult) int { return strings.Compare(a.ID, b.ID) })
+
+	b, err := json.Marshal(x.RefreshReport{Active: active, Results: rs})
+	if err != nil {
+		log.W("dnscrypt: refresh report: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// refresh re-registers servers, fetches their certs, and returns a csv
+// of live servers and errs (nil if ok) by name of each server.
+func (proxy *DcMulti) refresh() (string, map[string]error) {
+	proxy.RLock()
 	for _, registeredServer := range proxy.registeredServers {
 		proxy.serversInfo.registerServer(registeredServer.name, registeredServer.stamp)
 	}
-	var err error
-	proxy.liveServers, err = proxy.serversInfo.refresh(proxy)
-	if len(proxy.liveServers) > 0 {
+	proxy.RUnlock()
+	live, errs := proxy.serversInfo.refresh(proxy)
+	if proxy.setLiveServers(live) > 0 {
 		proxy.certIgnoreTimestamp = false
-	} else if err != nil {
-		// ignore error if live-servers are around
-		return "", err
 	}
-	return proxy.LiveTransports(), nil
+	return proxy.LiveTransports(), errs
 }
 
 // start starts this dnscrypt proxy
-func (proxy *DcMulti) start() error {
+func (proxy *DcMulti) start() (active string, errs map[string]error, err error) {
 	if proxy.sigterm != nil {
-		return errStarted
+		return "", nil, errStarted
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	proxy.sigterm = cancel
 
-	if _, err := crypto_rand.Read(proxy.proxySecretKey[:]); err != nil {
-		return err
+	// keys are made once, as shared keys of servers are derived from them
+	if proxy.proxyPublicKey == ([32]byte{}) {
+		if _, err = crypto_rand.Read(proxy.proxySecretKey[:]); err != nil {
+			cancel()
+			proxy.sigterm = nil
+			return
+		}
+		curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
 	}
-	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
 
-	_, err := proxy.Refresh()
-	if len(proxy.serversInfo.registeredServers) > 0 {
+	active, errs = proxy.refresh()
+	if len(proxy.serversInfo.registeredServers) <= 0 {
+		// no cert refreshes till servers are; see: Start
+		cancel()
+		proxy.sigterm = nil
+	} else {
 		go func(ctx context.Context) {
 			for {
 				select {
@@ -402,26 +529,38 @@ func (proxy *DcMulti) start() error {
 					log.I("dnscrypt: cert refresh stopped")
 					return
 				default:
-					hasServers := len(proxy.serversInfo.registeredServers) > 0
-					allDead := len(proxy.liveServers) == 0
+					hasServers := len(proxy.serversInfo.all()) > 0
+					allDead := len(proxy.LiveTransports()) == 0
 					delay := certRefreshDelay
 					if hasServers && allDead {
 						delay = certRefreshDelayAfterFailure
 					}
 					time.Sleep(delay)
-					proxy.liveServers, _ = proxy.serversInfo.refresh(proxy)
-					if someAlive := len(proxy.liveServers) > 0; someAlive {
+					live, _ := proxy.serversInfo.refresh(proxy)
+					if someAlive := proxy.setLiveServers(live) > 0; someAlive {
 						proxy.certIgnoreTimestamp = false
 					}
 				}
 			}
 		}(ctx)
 	}
-	return err
+	return
 }
 
-// Stop stops this dnscrypt proxy
+// Stop stops this dnscrypt proxy, after in-flight queries are done
 func (proxy *DcMulti) Stop() error {
+	var wg sync.WaitGroup
+	for _, si := range proxy.serversInfo.all() {
+		wg.Add(1)
+		go func(si *serverinfo) {
+			defer wg.Done()
+			if si.drain != nil && !si.drain.drain(draintimeout) {
+				log.W("dnscrypt: stop: %s: in-flight queries remain", si.ID())
+			}
+		}(si)
+	}
+	wg.Wait()
+
 	if proxy.sigterm != nil {
 		proxy.sigterm()
 	}
@@ -460,12 +599,22 @@ func (proxy *DcMulti) RemoveGateways(routescsv string) (int, error) {
 	return l - len(proxy.routes), nil
 }
 
+// removeOne stops routing new queries to uid, waits (bounded) for
+// its in-flight queries to be done, and then deregisters it.
 func (proxy *DcMulti) removeOne(uid string) int {
 	proxy.Lock()
-	defer proxy.Unlock()
+	delete(proxy.registeredServers, uid)
+	proxy.Unlock()
+
+	// no more refreshes; and no new queries once draining
+	if si := proxy.serversInfo.deregister(uid); si != nil && si.drain != nil {
+		if !si.drain.drain(draintimeout) {
+			log.W("dnscrypt: remove: %s: in-flight queries remain", uid)
+		}
+	}
+
 	// TODO: handle err
 	n, _ := proxy.serversInfo.unregisterServer(uid)
-	delete(proxy.registeredServers, uid)
 	return n
 }
 
@@ -565,21 +714,22 @@ func (p *DcMulti) Type() string {
 
 // Query implements dnsx.TransportMult
 func (p *DcMulti) Query(network string, q []byte, summary *x.DNSSummary) (r []byte, err error) {
-	r, err = resolve(network, q, p.serversInfo.getOne(), summary)
-	p.lastStatus = summary.Status
-	p.lastAddr = summary.Server
+	r, err = p.queryWith(p.serversInfo.getOne(), network, q, summary)
+	p.lastStatus.Store(int32(summary.Status))
+	p.lastAddr.Store(summary.Server)
 	p.est.Add(summary.Latency)
 	return
 }
 
 // GetAddr returns the last server address
 func (p *DcMulti) GetAddr() string {
-	return p.lastAddr
+	s, _ := p.lastAddr.Load().(string)
+	return s
 }
 
 // Status implements dnsx.TransportMult
 func (p *DcMulti) Status() int {
-	return p.lastStatus
+	return int(p.lastStatus.Load())
 }
 
 func stamp2str(s *stamps.ServerStamp) string {
@@ -594,13 +744,13 @@ func NewDcMult(px ipn.Proxies, ctl protect.Controller) *DcMulti {
 		certIgnoreTimestamp: false,
 		serversInfo:         newServersInfo(),
 		liveServers:         nil,
-		lastStatus:          dnsx.Start,
 		proxies:             px,
-		lastAddr:            "",
 		ctl:                 ctl,
 		dialer:              protect.MakeNsRDial(dnsx.DcProxy, ctl),
 		est:                 core.NewP50Estimator(),
 	}
+	dc.lastStatus.Store(dnsx.Start)
+	dc.lastAddr.Store("")
 	dc.start()
 	return dc
 }
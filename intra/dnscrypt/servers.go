@@ -21,6 +21,7 @@ import (
 	"math/rand"
 	"net"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -61,6 +62,8 @@ type serverinfo struct {
 	relay              ipn.Proxy   // proxy relay to use, may be nil
 	dialer             *protect.RDial
 	est                core.P2QuantileEstimator
+	mult               *DcMulti // owner; may be nil
+	drain              *drainer // in-flight queries; may be nil
 }
 
 var _ dnsx.Transport = (*serverinfo)(nil)
@@ -79,7 +82,9 @@ func newServersInfo() ServersInfo {
 	}
 }
 
-func (serversInfo *ServersInfo) getOne() (serverInfo *serverinfo) {
+// getOne returns one among live servers, except those in skip;
+// servers that are draining are never returned.
+func (serversInfo *ServersInfo) getOne(skip ...*serverinfo) (serverInfo *serverinfo) {
 	serversInfo.RLock()
 	defer serversInfo.RUnlock()
 
@@ -87,20 +92,59 @@ func (serversInfo *ServersInfo) getOne() (serverInfo *serverinfo) {
 	if serversCount <= 0 {
 		return nil
 	}
-	candidate := rand.Intn(xdns.Min(serversCount, 5))
-	i := 0
+	candidates := make([]*serverinfo, 0, xdns.Min(serversCount, 5))
 	for _, si := range serversInfo.inner {
-		if i == candidate {
-			log.V("dnscrypt: candidate [%v]", si) // may be nil?
-			serverInfo = si
+		if len(candidates) >= 5 {
 			break
 		}
-		i++
+		if si == nil || si.isDraining() || slices.Contains(skip, si) {
+			continue
+		}
+		candidates = append(candidates, si)
+	}
+	if len(candidates) <= 0 {
+		return nil
 	}
+	serverInfo = candidates[rand.Intn(len(candidates))]
+	log.V("dnscrypt: candidate [%v]", serverInfo)
 
 	return serverInfo
 }
 
+// live returns true if server name is registered and not draining.
+func (serversInfo *ServersInfo) live(name string) bool {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+
+	_, ok := serversInfo.registeredServers[name]
+	si := serversInfo.inner[name]
+	return ok && si != nil && !si.isDraining()
+}
+
+// deregister stops server name from being refreshed or re-registered,
+// and returns its serverinfo, if any.
+func (serversInfo *ServersInfo) deregister(name string) *serverinfo {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	delete(serversInfo.registeredServers, name)
+	return serversInfo.inner[name]
+}
+
+// all returns all servers.
+func (serversInfo *ServersInfo) all() []*serverinfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+
+	out := make([]*serverinfo, 0, len(serversInfo.inner))
+	for _, si := range serversInfo.inner {
+		if si != nil {
+			out = append(out, si)
+		}
+	}
+	return out
+}
+
 func (serversInfo *ServersInfo) get(name string) *serverinfo {
 	serversInfo.RLock()
 	defer serversInfo.RUnlock()
@@ -129,18 +173,32 @@ func (serversInfo *ServersInfo) registerServer(name string, stamp stamps.ServerS
 	serversInfo.registeredServers[name] = newRegisteredServer
 }
 
-func (serversInfo *ServersInfo) refresh(proxy *DcMulti) ([]string, error) {
+// refresh fetches certs of all registered servers, a few at a time, and
+// returns names of live servers and errs (nil if ok) by name of each.
+func (serversInfo *ServersInfo) refresh(proxy *DcMulti) ([]string, map[string]error) {
 	log.D("dnscrypt: refreshing certificates")
+	serversInfo.RLock()
+	registered := make(map[string]registeredserver, len(serversInfo.registeredServers))
+	names := make([]string, 0, len(serversInfo.registeredServers))
+	for name, r := range serversInfo.registeredServers {
+		registered[name] = r
+		names = append(names, name)
+	}
+	serversInfo.RUnlock()
+
+	errs := core.FanOut(names, maxRefreshers, refreshTimeout, func(name string) error {
+		r := registered[name]
+		return serversInfo.refreshServer(proxy, r.name, r.stamp)
+	})
 	var liveServers []string
-	var err error
-	for _, registeredServer := range serversInfo.registeredServers {
-		if err = serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp); err == nil {
-			liveServers = append(liveServers, registeredServer.name)
+	for _, name := range names {
+		if err := errs[name]; err == nil {
+			liveServers = append(liveServers, name)
 		} else {
-			log.E("dnscrypt: %s not a live server? %w", registeredServer.stamp, err)
+			log.E("dnscrypt: %s not a live server? %v", registered[name].stamp, err)
 		}
 	}
-	return liveServers, err
+	return liveServers, errs
 }
 
 func (serversInfo *ServersInfo) refreshServer(proxy *DcMulti, name string, stamp stamps.ServerStamp) error {
@@ -153,9 +211,12 @@ func (serversInfo *ServersInfo) refreshServer(proxy *DcMulti, name string, stamp
 	}
 
 	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	// name may have been removed while its cert was being fetched
+	if _, ok := serversInfo.registeredServers[name]; !ok {
+		return errNoServers
+	}
 	serversInfo.inner[name] = &newServer
-	serversInfo.registeredServers[name] = registeredserver{name: name, stamp: stamp}
-	serversInfo.Unlock()
 
 	return nil
 }
@@ -229,6 +290,8 @@ func fetchDNSCryptServerInfo(proxy *DcMulti, name string, stamp stamps.ServerSta
 		relay:              relay,
 		dialer:             dialer,
 		est:                core.NewP50Estimator(),
+		mult:               proxy,
+		drain:              newDrainer(),
 	}
 	log.I("dnscrypt: (%s) setup: %s; relay? %t", name, si.HostName, relay != nil)
 	return si, nil
@@ -320,7 +383,11 @@ func (s *serverinfo) Type() string {
 }
 
 func (s *serverinfo) Query(network string, q []byte, summary *x.DNSSummary) (r []byte, err error) {
-	r, err = resolve(network, q, s, summary)
+	if s.mult != nil {
+		r, err = s.mult.queryWith(s, network, q, summary)
+	} else {
+		r, err = resolve(network, q, s, summary)
+	}
 	s.status = summary.Status
 
 	if s.est != nil {
@@ -330,6 +397,24 @@ func (s *serverinfo) Query(network string, q []byte, summary *x.DNSSummary) (r [
 	return
 }
 
+// acquire returns false if s is nil or draining; see: drainer.acquire
+func (s *serverinfo) acquire() bool {
+	if s == nil {
+		return false
+	}
+	return s.drain == nil || s.drain.acquire()
+}
+
+func (s *serverinfo) release() {
+	if s != nil && s.drain != nil {
+		s.drain.release()
+	}
+}
+
+func (s *serverinfo) isDraining() bool {
+	return s != nil && s.drain != nil && s.drain.isDraining()
+}
+
 func (s *serverinfo) P50() int64 {
 	if s.est != nil {
 		return s.est.Get()
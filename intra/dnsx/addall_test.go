@@ -0,0 +1,59 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+type addListener struct {
+	warmListener
+	added atomic.Int32
+}
+
+func (l *addListener) OnDNSAdded(string) { l.added.Add(1) }
+
+// badTransport is of a type the resolver does not add.
+type badTransport struct{ *warmTransport }
+
+func (*badTransport) Type() string { return "bad" }
+
+func TestAddAll(t *testing.T) {
+	l := &addListener{}
+	r := &resolver{transports: make(map[string]Transport), listener: l, warm: newWarmer()}
+
+	var n, max atomic.Int32
+	t1 := &warmTransport{id: "t1", n: &n, max: &max}
+	t2 := &warmTransport{id: "t2", n: &n, max: &max}
+	bad := &badTransport{&warmTransport{id: "bad", n: &n, max: &max}}
+
+	if err := r.AddAll(t1, bad, t2); !errors.Is(err, ErrAddFailed) {
+		t.Fatalf("add all with bad: %v; want %v", err, ErrAddFailed)
+	}
+	if len(r.transports) != 0 {
+		t.Fatalf("added %d transports; want none", len(r.transports))
+	}
+
+	old := &warmTransport{id: "t1", n: &n, max: &max}
+	r.transports[old.ID()] = old
+	if err := r.AddAll(t1, t2); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"t1", "t2"} {
+		if _, ok := r.transports[id]; !ok {
+			t.Errorf("%s not added", id)
+		}
+		if _, ok := r.transports[CT+id]; !ok {
+			t.Errorf("%s not cached", id)
+		}
+	}
+	if r.transports["t1"] != t1 {
+		t.Error("t1 not replaced")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/celzero/firestack/intra/settings"
 	"github.com/celzero/firestack/intra/xdns"
@@ -30,6 +31,7 @@ const (
 	algttl      = 15              // 15s ttl for alg dns
 	key4        = ":a"
 	key6        = ":aaaa"
+	keyexit     = "@"
 	notransport = "NoTransport"
 	maxiter     = 100 // max number alg/nat evict iterations
 )
@@ -56,10 +58,31 @@ type Gateway interface {
 	PTR(algip []byte, force bool) (domaincsv string)
 	// given an alg or real ip, retrieve assoc blocklists as csv, if any
 	RDNSBL(algip []byte) (blocklistcsv string)
+	// given an alg or real ip, retrieve alpn ids advertised by https / svcb
+	// answers for its domains as csv, if any and unexpired
+	ALPN(algip []byte) (alpncsv string)
+	// given an alg ip, retrieve the proxy id its answer was resolved over,
+	// if the query was bound to an exit
+	Exit(algip []byte) (pid string)
+	// given an alg or real ip, retrieve the proxy id its domains are routed
+	// over (see: AddDomainRoute), if any
+	Route(algip []byte) (pid string)
 	// translate overwrites ip answers to alg ip answers
 	translate(yes bool)
-	// Query using t1 as primary transport and t2 as secondary and preset as pre-determined ip answers
-	q(t1 Transport, t2 Transport, preset []*netip.Addr, network string, q []byte, s *x.DNSSummary) ([]byte, error)
+	// Query using t1 as primary transport and t2 as secondary and preset as pre-determined ip answers;
+	// alg answers are kept apart per exit, if set
+	q(t1 Transport, t2 Transport, preset []*netip.Addr, exit, network string, q []byte, s *x.DNSSummary) ([]byte, error)
+	// Len returns the number of alg, nat, and ptr entries
+	Len() int
+	// Trim removes expired alg, nat, and ptr entries; returns the number removed
+	Trim() int
+	// journal of alg ips evicted
+	journal() *algjournal
+	// stale returns true if algip is an alg ip with no mapping, along with the
+	// qname and exit it was evicted with, if it is in the journal
+	stale(algip netip.Addr) (qname, exit string, stale bool)
+	// reclaim maps algip to the current answer for qname over exit, if any
+	reclaim(algip netip.Addr, qname, exit string) bool
 	// clear obj state
 	stop()
 }
@@ -76,9 +99,17 @@ type ans struct {
 	domain       []string      // all domain names in an answer (incl qname)
 	qname        string        // the query domain name
 	blocklists   string        // csv blocklists containing qname per active config at the time
+	exit         string        // proxy id the answer was resolved over, if bound to one
+	route        string        // proxy id the answer's domains are routed over, if any
 	ttl          time.Time
 }
 
+// alpns are alpn ids advertised by https / svcb answers for a domain.
+type alpns struct {
+	ids []string
+	ttl time.Time // expires along with the answer
+}
+
 type ansMulti struct {
 	algip        []*netip.Addr // generated answers
 	realip       []*netip.Addr // all ip answers
@@ -86,18 +117,34 @@ type ansMulti struct {
 	domain       []string      // all domain names in an answer (incl qname)
 	qname        string        // the query domain name
 	blocklists   string        // csv blocklists containing qname per active config at the time
+	exit         string        // proxy id the answer was resolved over, if bound to one
+	route        string        // proxy id the answer's domains are routed over, if any
 	ttl          time.Time
 }
 
+// dualips are realips of a and of aaaa answers (incl those fetched for the
+// sibling family) of a domain; shared by its alg ip4 and alg ip6, so that
+// whichever family apps dial, realips of both are translated to.
+type dualips struct {
+	ip4, ip6   []*netip.Addr
+	ttl4, ttl6 time.Time
+}
+
 // TODO: Keep a context here so that queries can be canceled.
 type dnsgateway struct {
 	sync.RWMutex                     // locks alg, nat, octets, hexes
 	mod          bool                // modify realip to algip
-	alg          map[string]*ans     // domain+type -> ans
+	alg          map[string]*ans     // domain+exit+type -> ans
 	nat          map[netip.Addr]*ans // algip -> ans
 	ptr          map[netip.Addr]*ans // realip -> ans
+	alpn         map[string]*alpns   // domain -> alpn ids
+	dual         map[string]*dualips // domain+exit -> realips of a and aaaa
+	sibs         map[string]struct{} // domain+exit+type -> sibling query in flight
 	rdns         RdnsResolver        // local and remote rdns blocks
 	dns64        NatPt               // dns64/nat64
+	ttls         *ttlclamp           // ttl bounds of answers; may be nil
+	routes       *domainroutes       // domain -> proxy routes; may be nil
+	evicted      *algjournal         // algips evicted from nat, and their domains
 	octets       []uint8             // ip4 octets, 100.x.y.z
 	hexes        []uint16            // ip6 hex, 64:ff9b:1:da19:0100.x.y.z
 	chash        bool                // use consistent hashing to generae alg ips
@@ -112,14 +159,18 @@ func NewDNSGateway(outer RdnsResolver, dns64 NatPt) (t *dnsgateway) {
 	ptr := make(map[netip.Addr]*ans)
 
 	t = &dnsgateway{
-		alg:    alg,
-		nat:    nat,
-		ptr:    ptr,
-		rdns:   outer,
-		dns64:  dns64,
-		octets: rfc6598,
-		hexes:  rfc8215a,
-		chash:  true,
+		alg:     alg,
+		nat:     nat,
+		ptr:     ptr,
+		alpn:    make(map[string]*alpns),
+		dual:    make(map[string]*dualips),
+		sibs:    make(map[string]struct{}),
+		rdns:    outer,
+		dns64:   dns64,
+		evicted: newAlgJournal(),
+		octets:  rfc6598,
+		hexes:   rfc8215a,
+		chash:   true,
 	}
 	log.I("alg: setup done")
 	return
@@ -137,10 +188,105 @@ func (t *dnsgateway) stop() {
 
 	clear(t.alg)
 	clear(t.nat)
+	clear(t.alpn)
+	clear(t.dual)
 	t.octets = rfc6598
 	t.hexes = rfc8215a
 }
 
+func (t *dnsgateway) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+
+	return len(t.alg) + len(t.nat) + len(t.ptr) + len(t.alpn) + len(t.dual)
+}
+
+func (t *dnsgateway) Trim() (n int) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	for k, v := range t.alg {
+		if now.After(v.ttl) {
+			delete(t.alg, k)
+			n++
+		}
+	}
+	for ip, v := range t.nat {
+		if now.After(v.ttl) {
+			delete(t.nat, ip)
+			t.evicted.add(ip, v.qname, v.exit)
+			n++
+		}
+	}
+	for ip, v := range t.ptr {
+		if now.After(v.ttl) {
+			delete(t.ptr, ip)
+			n++
+		}
+	}
+	for d, v := range t.alpn {
+		if now.After(v.ttl) {
+			delete(t.alpn, d)
+			n++
+		}
+	}
+	for k, v := range t.dual {
+		if now.After(v.ttl4) && now.After(v.ttl6) {
+			delete(t.dual, k)
+			n++
+		}
+	}
+	log.I("alg: trim: removed %d; alg: %d, nat: %d, ptr: %d, alpn: %d, dual: %d", n, len(t.alg), len(t.nat), len(t.ptr), len(t.alpn), len(t.dual))
+	return n
+}
+
+func (t *dnsgateway) journal() *algjournal {
+	return t.evicted
+}
+
+func (t *dnsgateway) stale(algip netip.Addr) (qname, exit string, stale bool) {
+	if !t.mod || !isAlgIP(algip) {
+		return "", "", false // not an alg ip, or alg ips are not handed out
+	}
+
+	t.RLock()
+	_, natok := t.nat[algip]
+	_, ptrok := t.ptr[algip] // realips may be in alg ranges (ex: cgnat)
+	t.RUnlock()
+
+	if natok || ptrok {
+		return "", "", false
+	}
+	// only alg ips known to have been handed out, and evicted since, are
+	// stale; others (ex: realips in cgnat ranges, evictions no longer in
+	// the journal, or all of them with the journal off) are left be
+	return t.evicted.find(algip)
+}
+
+func (t *dnsgateway) reclaim(algip netip.Addr, qname, exit string) bool {
+	k := algkey(qname, exit) + key4 + "0"
+	if algip.Is6() {
+		k = algkey(qname, exit) + key6 + "0"
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.nat[algip]; ok {
+		return true // reclaimed by another flow
+	}
+	cur, ok := t.alg[k]
+	if !ok || len(cur.realips) <= 0 {
+		return false
+	}
+	x := *cur // algip and its answer share all but the algip
+	x.algip = &algip
+	x.ttl = time.Now().Add(ttl2m)
+	t.nat[algip] = &x
+	return true
+}
+
 func (t *dnsgateway) querySecondary(t2 Transport, network string, q []byte, out chan<- secans, in <-chan []byte) {
 	var r []byte
 	var msg *dns.Msg
@@ -232,7 +378,7 @@ func (t *dnsgateway) querySecondary(t2 Transport, network string, q []byte, out
 }
 
 // Implements Gateway
-func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q []byte, summary *x.DNSSummary) (r []byte, err error) {
+func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, exit, network string, q []byte, summary *x.DNSSummary) (r []byte, err error) {
 	if t1 == nil {
 		return nil, errNoTransportAlg
 	}
@@ -244,6 +390,12 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 		t2 = nil
 	}
 	mod := t.mod // allow alg?
+	// realips of the other family are fetched alongside (answers do not
+	// wait on them), for apps that dial the alg ip of a family the network
+	// may not have routes for
+	if mod && !usepreset {
+		t.querySibling(t1, exit, network, q)
+	}
 	secch := make(chan secans, 1)
 	resch := make(chan []byte, 1)
 	innersummary := new(x.DNSSummary)
@@ -286,6 +438,7 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 		summary.UpstreamBlocks = true
 	}
 
+	synth64 := false
 	if !hasans && hasaaaaq && !ans0000 {
 		// override original resp with dns64 if needed
 		d64 := t.dns64.D64(t1.ID(), r, t1) // d64 is disabled by default
@@ -293,12 +446,17 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 			ans64 := new(dns.Msg)
 			_ = ans64.Unpack(d64)
 
-			withDNS64Summary(ans64, summary)
+			withDNS64Summary(ans64, summary) // records ttl before clamping
 			ansin = ans64
-			r = d64
+			r = repack(ans64, d64, t.ttls.dns64(ans64))
+			synth64 = true
 		} // else: d64 is nil on no D64 or error
 	} // else: no d64; not AAAA question or AAAA answer already exists
 
+	if !synth64 { // summary.RTtl is as set by t1, before clamping
+		r = repack(ansin, r, t.ttls.answer(ansin))
+	}
+
 	hasq := hasaaaaq || xdns.HasAQuestion(ansin) || xdns.HasSVCBQuestion(ansin) || xdns.HasHTTPQuestion(ansin)
 	hasans = xdns.HasAnyAnswer(ansin) // recheck after d64
 	rgood := xdns.HasRcodeSuccess(ansin)
@@ -314,6 +472,8 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 	ip6hints := xdns.IPHints(ansin, dns.SVCB_IPV6HINT)
 	// TODO: generate one alg ip per target, synth one rec per target
 	targets := xdns.Targets(ansin)
+	// qname (targets[0]) may not be routed, but its cname targets may be
+	route := t.routes.match(targets...)
 	realip := make([]*netip.Addr, 0)
 	algips := make([]*netip.Addr, 0)
 	// fetch secondary ips before lock
@@ -334,6 +494,12 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 	t.Lock()
 	defer t.Unlock()
 
+	// alpn ids outlive alg / nat / ptr entries of this answer, as
+	// a / aaaa answers for qname may be registered independently
+	t.registerALPNLocked(qname, xdns.ALPNs(ansin), xdns.RTtl(ansin))
+
+	// answers for the same qname over different exits get alg ips of their own
+	k := algkey(qname, exit)
 	algip4hints := []*netip.Addr{}
 	algip6hints := []*netip.Addr{}
 	algip4s := []*netip.Addr{}
@@ -341,7 +507,7 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 	for i, ip4 := range ip4hints {
 		realip = append(realip, ip4)
 		// 0th algip is reserved for A records
-		algip, ipok := t.take4Locked(qname, i+1)
+		algip, ipok := t.take4Locked(k, i+1)
 		if !ipok {
 			return r, errNotAvailableAlg
 		}
@@ -350,29 +516,43 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 	for i, ip6 := range ip6hints {
 		realip = append(realip, ip6)
 		// 0th algip is reserved for AAAA records
-		algip, ipok := t.take6Locked(qname, i+1)
+		algip, ipok := t.take6Locked(k, i+1)
 		if !ipok {
 			return r, errNotAvailableAlg
 		}
 		algip6hints = append(algip6hints, algip)
 	}
+	// alg ips of the sibling family, if not yet taken; not in the answer
+	var sib4, sib6 *netip.Addr
 	if len(a6) > 0 {
 		realip = append(realip, a6...)
 		// choose the first alg ip6; may've been generated by ip6hints
-		algip, ipok := t.take6Locked(qname, 0)
+		algip, ipok := t.take6Locked(k, 0)
 		if !ipok {
 			return r, errNotAvailableAlg
 		}
 		algip6s = append(algip6s, algip)
+		t.setDualLocked(k, a6)
+		if len(a4) <= 0 && !t.hasAlgLocked(k+key4+"0") {
+			if sib4, ipok = t.take4Locked(k, 0); !ipok {
+				return r, errNotAvailableAlg
+			}
+		}
 	}
 	if len(a4) > 0 {
 		realip = append(realip, a4...)
 		// choose the first alg ip4; may've been generated by ip4hints
-		algip, ipok := t.take4Locked(qname, 0)
+		algip, ipok := t.take4Locked(k, 0)
 		if !ipok {
 			return r, errNotAvailableAlg
 		}
 		algip4s = append(algip4s, algip)
+		t.setDualLocked(k, a4)
+		if len(a6) <= 0 && !t.hasAlgLocked(k+key6+"0") {
+			if sib6, ipok = t.take6Locked(k, 0); !ipok {
+				return r, errNotAvailableAlg
+			}
+		}
 	}
 
 	substok4 := false
@@ -422,14 +602,16 @@ func (t *dnsgateway) q(t1, t2 Transport, preset []*netip.Addr, network string, q
 		domain:       targets, // may be nil
 		qname:        qname,
 		blocklists:   secres.summary.Blocklists,
+		exit:         exit,
+		route:        route,
 		// qname->realip valid for next ttl seconds
 		ttl: time.Now().Add(ttl2m),
 	}
 
-	log.D("alg: ok; domains %s ips %s => subst %s; mod? %t", targets, realip, algips, mod)
+	log.D("alg: ok; domains %s ips %s => subst %s; exit %s; route %s; mod? %t", targets, realip, algips, exit, route, mod)
 
 	if rout, err := ansout.Pack(); err == nil {
-		if t.registerMultiLocked(qname, x) {
+		if t.registerMultiLocked(k, x) && t.registerSiblingsLocked(k, x, sib4, sib6) {
 			// if mod is set, send modified answer
 			if mod {
 				withAlgSummaryIfNeeded(algips, summary)
@@ -472,9 +654,9 @@ func withAlgSummaryIfNeeded(algips []*netip.Addr, s *x.DNSSummary) {
 		ipcsv := netip2csv(algips)
 
 		if len(s.RData) > 0 {
-			s.RData = s.RData + "," + ipcsv
+			s.RData = xdns.CapCsv(s.RData + "," + ipcsv)
 		} else {
-			s.RData = ipcsv
+			s.RData = xdns.CapCsv(ipcsv)
 		}
 		prefix := PrefixFor(Alg)
 		if len(s.Server) > 0 {
@@ -493,6 +675,8 @@ func (am *ansMulti) ansViewLocked(i int) *ans {
 		domain:       am.domain,
 		qname:        am.qname,
 		blocklists:   am.blocklists,
+		exit:         am.exit,
+		route:        am.route,
 		ttl:          am.ttl,
 	}
 }
@@ -512,6 +696,128 @@ func (t *dnsgateway) registerMultiLocked(q string, am *ansMulti) bool {
 	return true
 }
 
+// registerSiblingsLocked registers alg ips sib4 and sib6 (either may be nil)
+// of the sibling family for am's answer; they translate just as its own do.
+func (t *dnsgateway) registerSiblingsLocked(q string, am *ansMulti, sib4, sib6 *netip.Addr) bool {
+	for _, sib := range []*netip.Addr{sib4, sib6} {
+		if sib == nil {
+			continue
+		}
+		x := am.ansViewLocked(0)
+		x.algip = sib
+		if ok := t.registerNatLocked(q, 0, x); !ok {
+			return false
+		}
+		log.D("alg: sibling %s for %s", sib, q)
+	}
+	return true
+}
+
+func (t *dnsgateway) hasAlgLocked(k string) bool {
+	_, ok := t.alg[k]
+	return ok
+}
+
+// setDualLocked sets realips (all of one family) of a or aaaa answers for k.
+func (t *dnsgateway) setDualLocked(k string, realips []*netip.Addr) {
+	if len(realips) <= 0 {
+		return
+	}
+	d, ok := t.dual[k]
+	if !ok {
+		d = &dualips{}
+		t.dual[k] = d
+	}
+	if realips[0].Unmap().Is4() {
+		d.ip4, d.ttl4 = realips, time.Now().Add(ttl2m)
+	} else {
+		d.ip6, d.ttl6 = realips, time.Now().Add(ttl2m)
+	}
+}
+
+// dualFreshLocked returns true if realips of k for qtyp (A, AAAA) are known.
+func (t *dnsgateway) dualFreshLocked(k string, qtyp uint16) bool {
+	d, ok := t.dual[k]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if qtyp == dns.TypeA {
+		return now.Before(d.ttl4)
+	}
+	return now.Before(d.ttl6)
+}
+
+// querySibling queries t1 in the background for the sibling family (aaaa
+// for a; a for aaaa) of q, unless its realips are already known or being
+// fetched, and records them for alg ips of either family.
+func (t *dnsgateway) querySibling(t1 Transport, exit, network string, q []byte) {
+	msg := xdns.AsMsg(q)
+	if msg == nil || len(msg.Question) != 1 {
+		return
+	}
+	var sibtyp uint16
+	switch msg.Question[0].Qtype {
+	case dns.TypeA:
+		sibtyp = dns.TypeAAAA
+	case dns.TypeAAAA:
+		sibtyp = dns.TypeA
+	default:
+		return
+	}
+	qname, err := xdns.NormalizeQName(xdns.QName(msg))
+	if err != nil {
+		return
+	}
+	sib := msg.Copy()
+	sib.Id = dns.Id()
+	sib.Question[0].Qtype = sibtyp
+	sq, err := sib.Pack()
+	if err != nil {
+		return
+	}
+
+	k := algkey(qname, exit)
+	sk := k + ":" + strconv.Itoa(int(sibtyp))
+	t.Lock()
+	if _, busy := t.sibs[sk]; busy || t.dualFreshLocked(k, sibtyp) {
+		t.Unlock()
+		return
+	}
+	t.sibs[sk] = struct{}{}
+	t.Unlock()
+
+	go func() {
+		defer func() {
+			t.Lock()
+			delete(t.sibs, sk)
+			t.Unlock()
+		}()
+		r, err := query(t1, network, sq, new(x.DNSSummary))
+		ans := xdns.AsMsg(r)
+		if err != nil || ans == nil || !xdns.HasRcodeSuccess(ans) {
+			log.D("alg: sibling: %s (%d) no answer; err? %v", qname, sibtyp, err)
+			return
+		}
+		realips := xdns.AAnswer(ans)
+		if sibtyp == dns.TypeAAAA {
+			realips = xdns.AAAAAnswer(ans)
+		}
+		t.Lock()
+		t.setDualLocked(k, realips)
+		t.Unlock()
+		log.D("alg: sibling: %s (%d) => %v", qname, sibtyp, realips)
+	}()
+}
+
+// algkey scopes alg entries for qname to exit, if any.
+func algkey(qname, exit string) string {
+	if len(exit) <= 0 {
+		return qname
+	}
+	return qname + keyexit + exit
+}
+
 // register mapping from qname -> algip+realip (alg) and algip -> qname+realip (nat)
 func (t *dnsgateway) registerNatLocked(q string, idx int, x *ans) bool {
 	ip := x.algip
@@ -530,8 +836,11 @@ func (t *dnsgateway) registerNatLocked(q string, idx int, x *ans) bool {
 
 // register mapping from realip -> algip+qname (ptr)
 func (t *dnsgateway) registerPtrLocked(idx int, x *ans) bool {
-	ip := x.realips[idx]
-	t.ptr[*ip] = x // x contains qname and the algip
+	ip, ok := core.UnmapAddr(*x.realips[idx])
+	if !ok {
+		return true // nothing to register
+	}
+	t.ptr[ip] = x // x contains qname and the algip
 	return true
 }
 
@@ -584,6 +893,7 @@ func (t *dnsgateway) take4Locked(q string, idx int) (*netip.Addr, bool) {
 				log.I("alg: reuse stale alg %s for %s", kx, k)
 				delete(t.alg, kx)
 				delete(t.nat, *ent.algip)
+				// not journaled, as ent.algip is now k's
 				return ent.algip, true
 			}
 			i += 1
@@ -697,7 +1007,7 @@ func (t *dnsgateway) X(algip []byte) (ips string) {
 	t.RLock()
 	defer t.RUnlock()
 
-	if fip, ok := netip.AddrFromSlice(algip); ok {
+	if fip, ok := core.IPFromSlice(algip); ok {
 		rip := t.xLocked(fip, !t.mod)
 		if len(rip) > 0 {
 			var s []string
@@ -717,7 +1027,7 @@ func (t *dnsgateway) PTR(algip []byte, force bool) (domains string) {
 	t.RLock()
 	defer t.RUnlock()
 
-	if fip, ok := netip.AddrFromSlice(algip); ok {
+	if fip, ok := core.IPFromSlice(algip); ok {
 		d := t.ptrLocked(fip, (!t.mod || force))
 		if len(d) > 0 {
 			domains = strings.Join(d, ",")
@@ -732,7 +1042,7 @@ func (t *dnsgateway) RDNSBL(algip []byte) (blocklists string) {
 	t.RLock()
 	defer t.RUnlock()
 
-	if fip, ok := netip.AddrFromSlice(algip); ok {
+	if fip, ok := core.IPFromSlice(algip); ok {
 		blocklists = t.rdnsblLocked(fip, !t.mod)
 	} else {
 		log.W("alg: invalid algip(%s)", algip)
@@ -740,15 +1050,89 @@ func (t *dnsgateway) RDNSBL(algip []byte) (blocklists string) {
 	return blocklists
 }
 
+func (t *dnsgateway) ALPN(algip []byte) (alpncsv string) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if fip, ok := core.IPFromSlice(algip); ok {
+		alpncsv = strings.Join(t.alpnLocked(fip), ",")
+	} else {
+		log.W("alg: invalid algip(%s)", algip)
+	}
+	return
+}
+
+func (t *dnsgateway) Exit(algip []byte) (pid string) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if fip, ok := core.IPFromSlice(algip); ok {
+		// only alg ips are bound to an exit; realips may be shared
+		if ans, ok := t.nat[fip.Unmap()]; ok {
+			pid = ans.exit
+		}
+	} else {
+		log.W("alg: invalid algip(%s)", algip)
+	}
+	return
+}
+
+func (t *dnsgateway) Route(algip []byte) (pid string) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if fip, ok := core.IPFromSlice(algip); ok {
+		fip = fip.Unmap()
+		if ans, ok := t.nat[fip]; ok {
+			pid = ans.route
+		} else if ans, ok := t.ptr[fip]; ok { // alg may be off
+			pid = ans.route
+		}
+	} else {
+		log.W("alg: invalid algip(%s)", algip)
+	}
+	return
+}
+
+// registerALPNLocked maps qname to alpn ids for ttl secs; an answer
+// with no alpn ids leaves any previous mapping as-is until it expires.
+func (t *dnsgateway) registerALPNLocked(qname string, ids []string, ttl int) {
+	if len(qname) <= 0 || len(ids) <= 0 || ttl <= 0 {
+		return
+	}
+	t.alpn[qname] = &alpns{
+		ids: ids,
+		ttl: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	log.D("alg: alpn: %s => %v for %ds", qname, ids, ttl)
+}
+
+func (t *dnsgateway) alpnLocked(ip netip.Addr) []string {
+	// alpn is metadata, not a translation; both alg and real ips are looked up
+	ans, ok := t.nat[ip]
+	if !ok {
+		if ans, ok = t.ptr[ip]; !ok {
+			return nil
+		}
+	}
+	now := time.Now()
+	for _, d := range append([]string{ans.qname}, ans.domain...) {
+		if a, ok := t.alpn[d]; ok && now.Before(a.ttl) {
+			return a.ids
+		}
+	}
+	return nil
+}
+
 func (t *dnsgateway) xLocked(algip netip.Addr, useptr bool) []*netip.Addr {
 	var realips []*netip.Addr
 	// alg ips are always unmappped; see take4Locked
 	unmapped := algip.Unmap()
 	if ans, ok := t.nat[unmapped]; ok {
-		realips = append(ans.realips, ans.secondaryips...)
+		realips = t.withDualLocked(ans, append(ans.realips, ans.secondaryips...))
 	} else if ans, ok := t.ptr[unmapped]; useptr && ok {
 		// translate from realip only if not in mod mode
-		realips = append(ans.realips, ans.secondaryips...)
+		realips = t.withDualLocked(ans, append(ans.realips, ans.secondaryips...))
 	}
 	unnated := t.maybeUndoNat64(realips) // modifies / NATs realip in-place
 	log.D("alg: dns64: algip(%v) -> realips(%v) -> unnated(%v)", unmapped, realips, unnated)
@@ -758,7 +1142,35 @@ func (t *dnsgateway) xLocked(algip netip.Addr, useptr bool) []*netip.Addr {
 	return realips
 }
 
+// withDualLocked prepends realips of both families of ans's domain to
+// realips, sans dups; ex: realip4s for alg ip6s of aaaa answers. Alg ips
+// of either family of a domain so translate to the same realips.
+func (t *dnsgateway) withDualLocked(ans *ans, realips []*netip.Addr) []*netip.Addr {
+	d, ok := t.dual[algkey(ans.qname, ans.exit)]
+	if !ok {
+		return realips
+	}
+	out := make([]*netip.Addr, 0, len(realips)+len(d.ip4)+len(d.ip6))
+	seen := make(map[netip.Addr]struct{})
+	for _, ips := range [][]*netip.Addr{d.ip4, d.ip6, realips} {
+		for _, ip := range ips {
+			if ip == nil {
+				continue
+			}
+			if _, dup := seen[*ip]; dup {
+				continue
+			}
+			seen[*ip] = struct{}{}
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
 func (t *dnsgateway) maybeUndoNat64(realips []*netip.Addr) (unnat []*netip.Addr) {
+	if t.dns64 == nil { // ex: in tests
+		return
+	}
 	for _, nip := range realips {
 		if !nip.Unmap().Is6() {
 			continue
@@ -0,0 +1,178 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// dualTransport answers a and aaaa queries with realips of their family;
+// aaaa queries wait on hold6, if set.
+type dualTransport struct {
+	fakeTransport
+	queries *atomic.Int32
+	hold6   chan struct{}
+}
+
+func (t dualTransport) Query(_ string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	t.queries.Add(1)
+	msg := xdns.AsMsg(q)
+	if t.hold6 != nil && msg.Question[0].Qtype == dns.TypeAAAA {
+		<-t.hold6
+	}
+	ans := new(dns.Msg)
+	ans.SetReply(msg)
+	name := msg.Question[0].Name
+	switch msg.Question[0].Qtype {
+	case dns.TypeA:
+		ans.Answer = []dns.RR{xdns.MakeARecord(name, "93.184.216.34", 60)}
+	case dns.TypeAAAA:
+		ans.Answer = []dns.RR{xdns.MakeAAAARecord(name, "2606:2800:220:1::1", 60)}
+	}
+	smm.Status = Complete
+	return ans.Pack()
+}
+
+func newDualResolver(t *testing.T) (*resolver, *dnsgateway, dualTransport) {
+	return newDualResolverWith(dualTransport{queries: new(atomic.Int32)})
+}
+
+func newDualResolverWith(dt dualTransport) (*resolver, *dnsgateway, dualTransport) {
+	r := NewResolver("", settings.DefaultTunMode(), dt, &tidListener{tid: dt.ID()}, nil).(*resolver)
+	r.Lock()
+	r.transports[dt.ID()] = dt
+	r.Unlock()
+	r.Translate(true)
+	return r, r.gateway.(*dnsgateway), dt
+}
+
+func resolveAlgOf(t *testing.T, r *resolver, name string, qtyp uint16) netip.Addr {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtyp)
+	qb, _ := q.Pack()
+	res, err := r.Forward(qb)
+	ans := xdns.AsMsg(res)
+	if err != nil || ans == nil || len(ans.Answer) != 1 {
+		t.Fatalf("alg: %s (%d): want one answer; got %v; err? %v", name, qtyp, ans, err)
+	}
+	var algip netip.Addr
+	switch rr := ans.Answer[0].(type) {
+	case *dns.A:
+		algip, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		algip, _ = netip.AddrFromSlice(rr.AAAA)
+	default:
+		t.Fatalf("alg: %s (%d): unexpected answer %s", name, qtyp, rr)
+	}
+	if !isAlgIP(algip) || (qtyp == dns.TypeA) != algip.Is4() {
+		t.Fatalf("alg: %s (%d): want alg ip of the same family, got %s", name, qtyp, algip)
+	}
+	return algip
+}
+
+// only4 is what filterFamilyForDialing leaves of realips on ip4-only networks.
+func only4(csv string) (ip4s []string) {
+	for _, s := range strings.Split(csv, ",") {
+		if ip, err := netip.ParseAddr(s); err == nil && ip.Unmap().Is4() {
+			ip4s = append(ip4s, ip.String())
+		}
+	}
+	return
+}
+
+// An app that only ever resolves aaaa, and dials the alg ip6 on an ip4-only
+// network, must still be dialed to realip4s.
+func TestAlgDualStackAAAAOnly(t *testing.T) {
+	r, gw, _ := newDualResolver(t)
+	fake6 := resolveAlgOf(t, r, "v6.example.", dns.TypeAAAA)
+
+	// realip4s are fetched in the background
+	var ips string
+	waitFor(t, func() bool {
+		ips = gw.X(fake6.AsSlice())
+		return len(only4(ips)) > 0
+	})
+	if got := only4(ips); len(got) != 1 || got[0] != "93.184.216.34" {
+		t.Fatalf("alg: %s: want realip4 candidates, got %q (of %q)", fake6, got, ips)
+	}
+	if !strings.Contains(ips, "2606:2800:220:1::1") {
+		t.Errorf("alg: %s: want realip6, too; got %q", fake6, ips)
+	}
+
+	// the sibling alg ip4 was allocated lazily, and is what a later a answers with
+	fake4 := resolveAlgOf(t, r, "v6.example.", dns.TypeA)
+	if got := gw.X(fake4.AsSlice()); got != ips {
+		t.Errorf("alg: x: %s => %q; but %s => %q", fake4, got, fake6, ips)
+	}
+	if p4, p6 := gw.PTR(fake4.AsSlice(), false), gw.PTR(fake6.AsSlice(), false); p4 != p6 || len(p4) <= 0 {
+		t.Errorf("alg: ptr: %s => %q; but %s => %q", fake4, p4, fake6, p6)
+	}
+	if b4, b6 := gw.RDNSBL(fake4.AsSlice()), gw.RDNSBL(fake6.AsSlice()); b4 != b6 {
+		t.Errorf("alg: rdnsbl: %s => %q; but %s => %q", fake4, b4, fake6, b6)
+	}
+	if again := resolveAlgOf(t, r, "v6.example.", dns.TypeAAAA); again != fake6 {
+		t.Errorf("alg: aaaa: want %s again, got %s", fake6, again)
+	}
+}
+
+func TestAlgDualStackPaired(t *testing.T) {
+	r, gw, dt := newDualResolver(t)
+	fake4 := resolveAlgOf(t, r, "both.example.", dns.TypeA)
+	waitFor(t, func() bool { return dt.queries.Load() == 2 }) // incl the sibling aaaa
+	waitFor(t, func() bool { return strings.Contains(gw.X(fake4.AsSlice()), "2606:2800:220:1::1") })
+	n := dt.queries.Load()
+	fake6 := resolveAlgOf(t, r, "both.example.", dns.TypeAAAA)
+
+	x4, x6 := gw.X(fake4.AsSlice()), gw.X(fake6.AsSlice())
+	if x4 != x6 || !strings.Contains(x4, "93.184.216.34") || !strings.Contains(x4, "2606:2800:220:1::1") {
+		t.Errorf("alg: want realips of both families for either; %s => %q, %s => %q", fake4, x4, fake6, x6)
+	}
+	// realip6s were fetched with the a query; the aaaa query fetches no sibling
+	if got := dt.queries.Load() - n; got != 1 {
+		t.Errorf("alg: aaaa: want 1 query upstream, got %d", got)
+	}
+
+	// flows to alg ips without ptr (alg off) are not translated via siblings
+	r.Translate(false)
+	if ips := gw.X(netip.MustParseAddr("100.64.77.77").AsSlice()); len(ips) > 0 {
+		t.Errorf("alg: unknown alg ip: want nothing, got %q", ips)
+	}
+}
+
+// Answers are not held back for realips of the sibling family, nor is the
+// sibling queried again while it is in flight.
+func TestAlgDualStackNoWait(t *testing.T) {
+	dt := dualTransport{queries: new(atomic.Int32), hold6: make(chan struct{})}
+	r, gw, _ := newDualResolverWith(dt)
+
+	start := time.Now()
+	fake4 := resolveAlgOf(t, r, "slow6.example.", dns.TypeA)
+	if took := time.Since(start); took > 250*time.Millisecond {
+		t.Errorf("alg: a: answered in %s; held back by the sibling aaaa", took)
+	}
+	_ = resolveAlgOf(t, r, "slow6.example.", dns.TypeA)
+	// a, a, and only one sibling aaaa
+	waitFor(t, func() bool { return dt.queries.Load() >= 3 })
+	if got := dt.queries.Load(); got != 3 {
+		t.Errorf("alg: a: want 3 queries upstream, got %d", got)
+	}
+	if ips := gw.X(fake4.AsSlice()); strings.Contains(ips, "2606:2800:220:1::1") {
+		t.Errorf("alg: %s: realip6 before the sibling answered: %q", fake4, ips)
+	}
+
+	close(dt.hold6)
+	waitFor(t, func() bool { return strings.Contains(gw.X(fake4.AsSlice()), "2606:2800:220:1::1") })
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// alg ips evicted that are remembered, by default
+	defaultJournalSize = 1024
+	// how long evicted alg ips are remembered, by default
+	defaultJournalTTL = 6 * time.Hour
+	// max alg ips evicted that are remembered
+	maxJournalSize = 1 << 16
+)
+
+var (
+	// ErrStaleAlgIP is returned for alg ips that the gateway evicted, and
+	// that could not be re-established; see: ReclaimAlg.
+	ErrStaleAlgIP = errors.New("stale alg ip")
+
+	// alg ips are generated from these; see: gen4Locked, gen6Locked
+	algprefix4 = netip.MustParsePrefix("100.64.0.0/10")
+	algprefix6 = netip.MustParsePrefix("64:ff9b:1:da19:100::/80")
+)
+
+// algjournal is a ring of alg ips evicted from the gateway along with the
+// domains they were answered for, so that flows of apps that hold on to
+// answers well past their ttls can be re-resolved instead of dialing alg
+// ips that lead nowhere.
+type algjournal struct {
+	sync.Mutex                    // protects all fields
+	ring       []algevicted       // ring of evictions, oldest overwritten
+	next       int                // next slot in ring
+	idx        map[netip.Addr]int // algip -> slot in ring
+	ttl        time.Duration      // how long evictions are remembered
+}
+
+type algevicted struct {
+	algip netip.Addr
+	qname string // the query domain name
+	exit  string // proxy id the answer was resolved over, if any
+	at    time.Time
+}
+
+func newAlgJournal() *algjournal {
+	return &algjournal{
+		ring: make([]algevicted, defaultJournalSize),
+		idx:  make(map[netip.Addr]int),
+		ttl:  defaultJournalTTL,
+	}
+}
+
+// set resizes the journal to size (capped at maxJournalSize), which
+// forgets all evictions, and remembers evictions for ttl; a size of
+// 0 (or less) turns the journal off, and a ttl that is not positive
+// resets it to the default.
+func (j *algjournal) set(size int, ttl time.Duration) {
+	size = max(0, min(size, maxJournalSize))
+	if ttl <= 0 {
+		ttl = defaultJournalTTL
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.ring = make([]algevicted, size)
+	j.next = 0
+	clear(j.idx)
+	j.ttl = ttl
+	log.I("alg: journal: size %d; ttl %s", size, ttl)
+}
+
+// add remembers that algip, answered for qname over exit, was evicted.
+func (j *algjournal) add(algip netip.Addr, qname, exit string) {
+	if !algip.IsValid() || len(qname) <= 0 {
+		return
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if len(j.ring) <= 0 {
+		return
+	}
+	if i, ok := j.idx[algip]; ok { // older eviction of the same algip
+		j.ring[i] = algevicted{}
+		delete(j.idx, algip)
+	}
+	if old := j.ring[j.next]; old.algip.IsValid() {
+		delete(j.idx, old.algip)
+	}
+	j.ring[j.next] = algevicted{algip: algip, qname: qname, exit: exit, at: time.Now()}
+	j.idx[algip] = j.next
+	j.next = (j.next + 1) % len(j.ring)
+}
+
+// find returns the qname and exit algip was evicted with, if it was,
+// and is not older than the journal's ttl.
+func (j *algjournal) find(algip netip.Addr) (qname, exit string, ok bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	i, ok := j.idx[algip]
+	if !ok {
+		return "", "", false
+	}
+	e := j.ring[i]
+	if time.Since(e.at) > j.ttl {
+		return "", "", false
+	}
+	return e.qname, e.exit, true
+}
+
+// isAlgIP returns true if ip is among those alg ips are generated from.
+func isAlgIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return algprefix4.Contains(ip) || algprefix6.Contains(ip)
+}
+
+// Implements x.AlgJournal
+func (r *resolver) SetAlgJournal(size, ttlsecs int) {
+	r.gateway.journal().set(size, time.Duration(ttlsecs)*time.Second)
+}
+
+// Implements Resolver
+func (r *resolver) StaleAlg(algip netip.Addr) (qname string, stale bool) {
+	gw := r.Gateway()
+	if gw == nil || !algip.IsValid() {
+		return "", false
+	}
+	qname, _, stale = gw.stale(algip.Unmap())
+	return
+}
+
+// Implements Resolver
+func (r *resolver) ReclaimAlg(algip netip.Addr) error {
+	gw := r.Gateway()
+	if gw == nil || !algip.IsValid() {
+		return nil
+	}
+	algip = algip.Unmap()
+	qname, exit, stale := gw.stale(algip)
+	if !stale {
+		return nil
+	}
+
+	qtyp := dns.TypeA
+	if algip.Is6() {
+		qtyp = dns.TypeAAAA
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(qname), qtyp)
+	q, err := msg.Pack()
+	if err != nil {
+		return errors.Join(ErrStaleAlgIP, err)
+	}
+	// re-registers alg entries for qname over exit, if it resolves
+	if _, err = r.forward(q, exit, ""); err != nil {
+		log.W("alg: reclaim: %s: re-resolve %s over %q: %v", algip, qname, exit, err)
+		return errors.Join(ErrStaleAlgIP, err)
+	}
+	if !gw.reclaim(algip, qname, exit) {
+		log.W("alg: reclaim: %s: %s over %q has no answers", algip, qname, exit)
+		return ErrStaleAlgIP
+	}
+	log.I("alg: reclaim: %s: ok; %s over %q", algip, qname, exit)
+	return nil
+}
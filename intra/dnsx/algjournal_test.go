@@ -0,0 +1,164 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// tidListener is a countingListener that has queries sent to tid.
+type tidListener struct {
+	countingListener
+	tid string
+}
+
+func (l *tidListener) OnQuery(string, int) *x.DNSOpts { return &x.DNSOpts{TIDCSV: l.tid} }
+
+func newAlgResolver(t *testing.T) (*resolver, *dnsgateway) {
+	ft := fakeTransport{rrs: func(n string) []dns.RR {
+		if strings.HasPrefix(n, "gone.") { // nxdomain
+			return nil
+		}
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}
+	r := NewResolver("", settings.DefaultTunMode(), ft, &tidListener{tid: ft.ID()}, nil).(*resolver)
+	r.Lock()
+	r.transports[ft.ID()] = ft
+	r.Unlock()
+	r.Translate(true)
+	return r, r.gateway.(*dnsgateway)
+}
+
+func resolveAlg(t *testing.T, r *resolver, name string) netip.Addr {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qb, _ := q.Pack()
+	res, err := r.Forward(qb)
+	ans := xdns.AsMsg(res)
+	if err != nil || ans == nil || len(ans.Answer) <= 0 {
+		t.Fatalf("alg: %s: no answer; err? %v", name, err)
+	}
+	a, _ := ans.Answer[0].(*dns.A)
+	algip, _ := netip.AddrFromSlice(a.A.To4())
+	if !isAlgIP(algip) {
+		t.Fatalf("alg: %s: want alg ip, got %s", name, algip)
+	}
+	return algip
+}
+
+func TestAlgReclaimAfterEviction(t *testing.T) {
+	r, gw := newAlgResolver(t)
+	algip := resolveAlg(t, r, "app.example.")
+
+	// the app holds on to algip, while its entries expire and are trimmed
+	gw.Lock()
+	for _, v := range gw.nat {
+		v.ttl = time.Now().Add(-time.Second)
+	}
+	gw.Unlock()
+	gw.Trim()
+	if ips := gw.X(algip.AsSlice()); len(ips) > 0 {
+		t.Fatalf("alg: %s: want evicted, got %s", algip, ips)
+	}
+
+	// and connects to it later
+	if q, stale := r.StaleAlg(algip); !stale || q != "app.example" {
+		t.Fatalf("alg: %s: stale? %t, %q; want app.example", algip, stale, q)
+	}
+	if err := r.ReclaimAlg(algip); err != nil {
+		t.Fatalf("alg: %s: reclaim: %v", algip, err)
+	}
+	if ips := gw.X(algip.AsSlice()); !strings.Contains(ips, "1.2.3.4") {
+		t.Errorf("alg: %s: want 1.2.3.4 once reclaimed, got %q", algip, ips)
+	}
+
+	// alg ips that were evicted with a domain that now has other alg ips
+	other := netip.MustParseAddr("100.64.9.9")
+	gw.evicted.add(other, "app.example", "")
+	if err := r.ReclaimAlg(other); err != nil {
+		t.Fatalf("alg: %s: reclaim: %v", other, err)
+	}
+	if ips := gw.X(other.AsSlice()); !strings.Contains(ips, "1.2.3.4") {
+		t.Errorf("alg: %s: want 1.2.3.4 once reclaimed, got %q", other, ips)
+	}
+
+	// evicted alg ips that do not resolve fail fast
+	gone := netip.MustParseAddr("100.64.9.10")
+	gw.evicted.add(gone, "gone.example", "")
+	if err := r.ReclaimAlg(gone); !errors.Is(err, ErrStaleAlgIP) {
+		t.Errorf("alg: %s: unresolved: want ErrStaleAlgIP, got %v", gone, err)
+	}
+
+	// ips in alg ranges never handed out (ex: cgnat realips) are left be
+	unknown := netip.MustParseAddr("100.100.1.1")
+	if _, stale := r.StaleAlg(unknown); stale {
+		t.Errorf("alg: %s: never handed out, but stale", unknown)
+	}
+	if err := r.ReclaimAlg(unknown); err != nil {
+		t.Errorf("alg: %s: never handed out: want nil, got %v", unknown, err)
+	}
+	// as are ips that are not alg ips
+	if err := r.ReclaimAlg(netip.MustParseAddr("1.1.1.1")); err != nil {
+		t.Errorf("alg: not an alg ip: want nil, got %v", err)
+	}
+	// and evicted alg ips, with the journal off
+	r.SetAlgJournal(0, 0)
+	if _, stale := r.StaleAlg(other); stale {
+		t.Errorf("alg: %s: journal off, but stale", other)
+	}
+	// or with alg off
+	r.SetAlgJournal(defaultJournalSize, 0)
+	gw.evicted.add(gone, "gone.example", "")
+	r.Translate(false)
+	if err := r.ReclaimAlg(gone); err != nil {
+		t.Errorf("alg: translate off: want nil, got %v", err)
+	}
+}
+
+func TestAlgJournal(t *testing.T) {
+	ip1, ip2, ip3 := netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("100.64.0.3")
+
+	j := newAlgJournal()
+	j.set(2, time.Minute)
+	j.add(ip1, "one.example", "")
+	j.add(ip2, "two.example", "wg0")
+	j.add(ip3, "three.example", "") // overwrites ip1
+	if _, _, ok := j.find(ip1); ok {
+		t.Errorf("journal: %s: want overwritten", ip1)
+	}
+	if q, exit, ok := j.find(ip2); !ok || q != "two.example" || exit != "wg0" {
+		t.Errorf("journal: %s: got %s %s %t", ip2, q, exit, ok)
+	}
+	// re-evicted ips take a new slot; their older one is freed
+	j.add(ip2, "two.example", "")
+	j.add(ip1, "one.example", "") // overwrites ip3, not ip2
+	if _, exit, ok := j.find(ip2); !ok || exit != "" {
+		t.Errorf("journal: %s: want latest eviction; got %s %t", ip2, exit, ok)
+	}
+
+	j.Lock()
+	j.ring[j.idx[ip1]].at = time.Now().Add(-2 * time.Minute)
+	j.Unlock()
+	if _, _, ok := j.find(ip1); ok {
+		t.Errorf("journal: %s: want expired", ip1)
+	}
+
+	j.set(0, 0)
+	j.add(ip1, "one.example", "")
+	if _, _, ok := j.find(ip1); ok {
+		t.Errorf("journal: off: %s: want nothing", ip1)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func httpsRR(qname string, alpns ...string) dns.RR {
+	r := new(dns.HTTPS)
+	r.Hdr = dns.RR_Header{Name: qname, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300}
+	r.Priority = 1
+	r.Target = "."
+	r.Value = []dns.SVCBKeyValue{
+		&dns.SVCBAlpn{Alpn: alpns},
+		&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("1.1.1.1").To4()}},
+	}
+	return r
+}
+
+func algQuery(t *testing.T, gw *dnsgateway, qname string, qtype uint16, rrs func(string) []dns.RR) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	qb, _ := q.Pack()
+	res, err := gw.q(fakeTransport{rrs: rrs}, nil, nil, "", NetTypeUDP, qb, new(x.DNSSummary))
+	if err != nil {
+		t.Fatalf("alg: %s err %v", qname, err)
+	}
+	ans := xdns.AsMsg(res)
+	if ips := append(xdns.AAnswer(ans), xdns.IPHints(ans, dns.SVCB_IPV4HINT)...); len(ips) > 0 {
+		return ips[0].AsSlice()
+	}
+	t.Fatalf("alg: %s no alg ip", qname)
+	return nil
+}
+
+func TestALPNFlows(t *testing.T) {
+	cases := []struct {
+		qname string
+		alpns []string
+		want  string
+	}{
+		{"h3.example.", []string{"h3"}, "h3"},
+		{"h3h2.example.", []string{"h3", "h2"}, "h3,h2"},
+		{"h2.example.", []string{"h2", "http/1.1"}, "h2,http/1.1"},
+	}
+
+	gw := NewDNSGateway(&resolver{}, fakeNatPt{})
+	gw.translate(true)
+
+	for _, c := range cases {
+		hip := algQuery(t, gw, c.qname, dns.TypeHTTPS, func(n string) []dns.RR {
+			return []dns.RR{httpsRR(n, c.alpns...)}
+		})
+		// a flow to the alg ip from an a record of the same name
+		aip := algQuery(t, gw, c.qname, dns.TypeA, func(n string) []dns.RR {
+			return []dns.RR{xdns.MakeARecord(n, "1.1.1.1", 60)}
+		})
+		for _, ip := range [][]byte{hip, aip, net.ParseIP("1.1.1.1").To4()} {
+			if got := gw.ALPN(ip); got != c.want {
+				t.Errorf("alpn: %s: flow to %v: want %q, got %q", c.qname, ip, c.want, got)
+			}
+		}
+	}
+
+	// a name without an https answer has no alpn
+	nip := algQuery(t, gw, "none.example.", dns.TypeA, func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "9.9.9.9", 60)}
+	})
+	if got := gw.ALPN(nip); got != "" {
+		t.Errorf("alpn: none: want empty, got %q", got)
+	}
+
+	// alpn expires with the https answer
+	gw.alpn["h3.example"].ttl = time.Now().Add(-time.Second)
+	hip := algQuery(t, gw, "h3.example.", dns.TypeA, func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.1.1.1", 60)}
+	})
+	if got := gw.ALPN(hip); got != "" {
+		t.Errorf("alpn: expired: want empty, got %q", got)
+	}
+	n := len(gw.alpn)
+	gw.Trim()
+	if len(gw.alpn) != n-1 {
+		t.Errorf("alpn: trim: want %d, got %d", n-1, len(gw.alpn))
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync"
+)
+
+// max stamps whose blocklist names are remembered; all of them are
+// forgotten once full
+const maxblockcache = 64
+
+// dnlookup looks up name (normalized) in blocklists set in stamp;
+// returns true, and the keys of the blocklists, if name is blocked.
+// Implemented by trie.FrozenTrie, which remembers verdicts on names
+// (and the stamp it last decoded) on its own.
+type dnlookup interface {
+	DNlookup(name, stamp string) (bool, []string)
+}
+
+// blockcache remembers names of blocklists in stamps (as upstreams send
+// the same stamp for most answers) so a stamp is decoded once. Methods are
+// no-ops on a nil blockcache.
+type blockcache struct {
+	sync.RWMutex                   // protects m
+	m            map[string]string // stamp => csv of blocklist names
+}
+
+func newBlockCache() *blockcache {
+	return &blockcache{m: make(map[string]string)}
+}
+
+// get returns names of blocklists in stamp, if known.
+func (c *blockcache) get(stamp string) (names string, ok bool) {
+	if c == nil {
+		return
+	}
+	c.RLock()
+	defer c.RUnlock()
+	names, ok = c.m[stamp]
+	return
+}
+
+// put remembers names of blocklists in stamp.
+func (c *blockcache) put(stamp, names string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.m) >= maxblockcache {
+		clear(c.m)
+	}
+	c.m[stamp] = names
+}
+
+// len returns the number of stamps remembered.
+func (c *blockcache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.m)
+}
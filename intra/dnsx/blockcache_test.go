@@ -0,0 +1,248 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const fakeStamp = "1:fake"
+
+// fakeTrie blocks names (and their subdomains) in a set, as the trie does.
+type fakeTrie struct {
+	names   map[string]bool
+	lookups *atomic.Int32
+}
+
+func newFakeTrie(names ...string) fakeTrie {
+	t := fakeTrie{names: make(map[string]bool), lookups: new(atomic.Int32)}
+	for _, n := range names {
+		t.names[n] = true
+	}
+	return t
+}
+
+func (t fakeTrie) DNlookup(name, stamp string) (bool, []string) {
+	t.lookups.Add(1)
+	if stamp != fakeStamp {
+		return false, nil
+	}
+	for {
+		if t.names[name] {
+			return true, []string{"ads"}
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false, nil
+		}
+		name = name[i+1:]
+	}
+}
+
+func newFakeRdnsLocal(ft dnlookup) *rethinkdnslocal {
+	return &rethinkdnslocal{
+		rethinkdns: &rethinkdns{
+			tags:  map[string]string{"ads": "privacy:ads"},
+			mode:  localBlock,
+			stamp: fakeStamp,
+			named: newBlockCache(),
+		},
+		ftrie: ft,
+	}
+}
+
+func cnameAnswer(qname, target string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, dns.TypeA)
+	ans := new(dns.Msg)
+	ans.SetReply(q)
+	ans.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target},
+		xdns.MakeARecord(target, "1.2.3.4", 60),
+	}
+	return ans
+}
+
+func TestBlockLookups(t *testing.T) {
+	ft := newFakeTrie("ads.example")
+	r := newFakeRdnsLocal(ft)
+
+	// names are looked up normalized, as queried and as cname targets
+	q := new(dns.Msg)
+	q.SetQuestion("x.ADS.example.", dns.TypeA)
+	if lists, err := r.blockQuery(q); err != nil || lists != "privacy:ads" {
+		t.Fatalf("block: query: want privacy:ads, got %q; err? %v", lists, err)
+	}
+	q.SetQuestion("ok.example.", dns.TypeA)
+	if _, err := r.blockQuery(q); err == nil {
+		t.Fatal("block: ok.example blocked")
+	}
+	if lists, err := r.blockAnswer(cnameAnswer("cloak.example.", "x.ADS.example.")); err != nil || lists != "privacy:ads" {
+		t.Errorf("block: answer: want privacy:ads, got %q; err? %v", lists, err)
+	}
+	if n := ft.lookups.Load(); n != 3 {
+		t.Errorf("block: want 3 lookups, got %d", n)
+	}
+
+	// and against the stamp in use
+	r.stamp = "1:other"
+	if _, err := r.blockAnswer(cnameAnswer("cloak.example.", "x.ADS.example.")); err == nil {
+		t.Error("block: blocked for a stamp sans the list")
+	}
+}
+
+func TestBlockCacheStamps(t *testing.T) {
+	flags, tags := load1()
+	uncached := &rethinkdns{flags: flags, tags: tags, mode: remoteBlock}
+	r := &rethinkdns{flags: flags, tags: tags, mode: remoteBlock, named: newBlockCache()}
+
+	want, err := uncached.StampToNames(v1case2)
+	if err != nil || len(want) <= 0 {
+		t.Fatalf("blockcache: want names, got %q; err? %v", want, err)
+	}
+	for range 2 {
+		if got, err := r.StampToNames(v1case2); err != nil || got != want {
+			t.Errorf("blockcache: want %q, got %q; err? %v", want, got, err)
+		}
+	}
+	if n := r.named.len(); n != 1 {
+		t.Errorf("blockcache: want 1 stamp, got %d", n)
+	}
+	// stamps that fail to decode are not remembered
+	if _, err := r.StampToNames("1:!"); err == nil {
+		t.Error("blockcache: bad stamp decoded")
+	}
+	if n := r.named.len(); n != 1 {
+		t.Errorf("blockcache: bad stamp: want 1 stamp, got %d", n)
+	}
+
+	c := newBlockCache()
+	for i := range maxblockcache + 1 {
+		c.put(fmt.Sprintf("1:s%d", i), "")
+	}
+	if n := c.len(); n > maxblockcache {
+		t.Errorf("blockcache: want at most %d stamps, got %d", maxblockcache, n)
+	}
+
+	var nilc *blockcache
+	nilc.put(fakeStamp, "a")
+	if _, ok := nilc.get(fakeStamp); ok {
+		t.Error("blockcache: nil: want no names")
+	}
+}
+
+// manyLists blocks all names, by n blocklists.
+type manyLists int
+
+func (n manyLists) DNlookup(string, string) (bool, []string) {
+	lists := make([]string, n)
+	for i := range lists {
+		lists[i] = fmt.Sprintf("l%d", i)
+	}
+	return true, lists
+}
+
+func TestBlockListsCapped(t *testing.T) {
+	r := newFakeRdnsLocal(manyLists(500))
+	for i := range 500 {
+		r.tags[fmt.Sprintf("l%d", i)] = fmt.Sprintf("privacy:list%d", i)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("ads.example.", dns.TypeA)
+	lists, err := r.blockQuery(q)
+	if err != nil || len(lists) > xdns.DefaultMaxCsvLen {
+		t.Fatalf("capped: want at most %d bytes, got %d; err? %v", xdns.DefaultMaxCsvLen, len(lists), err)
+	}
+	if !strings.HasPrefix(lists, "privacy:list0,privacy:list1,") || !strings.HasSuffix(lists, " more") {
+		t.Errorf("capped: got %q", lists)
+	}
+
+	r = newFakeRdnsLocal(manyLists(2))
+	r.tags["l0"], r.tags["l1"] = "privacy:a", "privacy:b"
+	if lists, _ := r.blockQuery(q); lists != "privacy:a,privacy:b" {
+		t.Errorf("capped: 2: got %q", lists)
+	}
+}
+
+// benchmarks Forward over a blocklist of a few hundred thousand names, for
+// queries (of a few thousand names, a tenth of them blocked) answered with
+// cnames; reports p50 and p99. The fake trie is a map, and so, far cheaper
+// to walk than the trie.
+
+const (
+	blocklistBenchN = 300000
+	queryBenchN     = 2000
+)
+
+var benchTrie = sync.OnceValue(func() fakeTrie {
+	names := make([]string, 0, blocklistBenchN)
+	for i := range blocklistBenchN {
+		names = append(names, fmt.Sprintf("tracker%d.ads%d.example", i, i%100))
+	}
+	return newFakeTrie(names...)
+})
+
+func BenchmarkForwardBlocklist(b *testing.B) {
+	tr := fakeTransport{rrs: func(n string) []dns.RR {
+		return cnameAnswer(n, "cdn."+n).Answer
+	}}
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, &tidListener{tid: tr.ID()}, nil).(*resolver)
+	r.Add(tr)
+	r.setRdnsLocal(newFakeRdnsLocal(benchTrie()))
+
+	qs := make([][]byte, queryBenchN)
+	for i := range qs {
+		name := fmt.Sprintf("www%d.site.example.", i)
+		if i%10 == 0 {
+			name = fmt.Sprintf("tracker%d.ads%d.example.", i, i%100)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qs[i], _ = q.Pack()
+	}
+
+	lat := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := range b.N {
+		start := time.Now()
+		if _, err := r.Forward(qs[i%queryBenchN]); err != nil {
+			b.Fatal(err)
+		}
+		lat[i] = time.Since(start)
+	}
+	b.StopTimer()
+	slices.Sort(lat)
+	b.ReportMetric(float64(lat[len(lat)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(lat[len(lat)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func benchmarkStampToNames(b *testing.B, cached bool) {
+	flags, tags := load1()
+	r := &rethinkdns{flags: flags, tags: tags, mode: remoteBlock}
+	if cached {
+		r.named = newBlockCache()
+	}
+	b.ResetTimer()
+	for range b.N {
+		if _, err := r.StampToNames(v1case2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStampToNamesUncached(b *testing.B) { benchmarkStampToNames(b, false) }
+func BenchmarkStampToNamesCached(b *testing.B)   { benchmarkStampToNames(b, true) }
@@ -0,0 +1,187 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"container/list"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// max blocked qnames counted; the least blocked are evicted once full
+	maxblockednames = 1000
+	// top blocked qnames returned by default
+	defaultTopBlocked = 10
+)
+
+// BlockStats are blocks since start (or the last reset); serialized as json
+// for the client. Counts of qnames are approximate upper bounds once more
+// than a thousand distinct qnames are blocked; see: blockstats.
+type BlockStats struct {
+	Since      int64             `json:"since"`      // unix millis of start or reset
+	Total      uint64            `json:"total"`      // blocked queries
+	Blocklists map[string]uint64 `json:"blocklists"` // blocklist name -> hits
+	Top        []BlockedName     `json:"top"`        // most blocked qnames, most first
+}
+
+// BlockedName is a qname and the number of times it was blocked.
+type BlockedName struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// blockstats counts blocked queries, hits per blocklist, and hits per qname;
+// the latter is bounded to maxblockednames with the space-saving algorithm:
+// the least counted qname is evicted for a new one, which inherits its count.
+// Top-k qnames with counts far above those evicted are accurate. Qnames are
+// kept in buckets of the same count (a "stream summary"), ordered least
+// first, so that counting and evicting never scan all qnames.
+// ref: cs.ucsb.edu/sites/default/files/documents/2005-23.pdf
+type blockstats struct {
+	sync.Mutex                          // protects all fields
+	since      time.Time                // start or last reset
+	total      uint64                   // blocked queries
+	lists      map[string]uint64        // blocklist name -> hits
+	names      map[string]*list.Element // qname -> its *namecount in counts
+	counts     *list.List               // of *namecount, least count first
+}
+
+// namecount is a bucket of qnames blocked n times.
+type namecount struct {
+	n     uint64
+	names map[string]struct{}
+}
+
+func newBlockStats() *blockstats {
+	return &blockstats{
+		since:  time.Now(),
+		lists:  make(map[string]uint64),
+		names:  make(map[string]*list.Element),
+		counts: list.New(),
+	}
+}
+
+// add counts a block of qname by csv of blocklists, which may be empty.
+func (b *blockstats) add(qname, blocklists string) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.total++
+	for _, bl := range strings.Split(blocklists, ",") {
+		if bl = strings.TrimSpace(bl); len(bl) > 0 {
+			b.lists[bl]++
+		}
+	}
+	if len(qname) <= 0 {
+		return
+	}
+	e, ok := b.names[qname]
+	if !ok && len(b.names) < maxblockednames {
+		// counted from zero; the bucket is dropped once empty
+		if e = b.counts.Front(); e == nil || e.Value.(*namecount).n != 0 {
+			e = b.counts.PushFront(&namecount{names: make(map[string]struct{})})
+		}
+	} else if !ok {
+		// full: evict (any one of) the least blocked
+		e = b.counts.Front()
+		for evict := range e.Value.(*namecount).names {
+			delete(e.Value.(*namecount).names, evict)
+			delete(b.names, evict)
+			break
+		}
+	}
+	if !ok {
+		e.Value.(*namecount).names[qname] = struct{}{}
+	}
+	b.names[qname] = b.incrLocked(qname, e)
+}
+
+// incrLocked moves qname from its bucket e to the next count's, and
+// returns the latter.
+func (b *blockstats) incrLocked(qname string, e *list.Element) *list.Element {
+	cur := e.Value.(*namecount)
+	next := e.Next()
+	if next == nil || next.Value.(*namecount).n != cur.n+1 {
+		next = b.counts.InsertAfter(&namecount{n: cur.n + 1, names: make(map[string]struct{})}, e)
+	}
+	next.Value.(*namecount).names[qname] = struct{}{}
+	delete(cur.names, qname)
+	if len(cur.names) <= 0 {
+		b.counts.Remove(e)
+	}
+	return next
+}
+
+// get returns stats with the top k blocked qnames.
+func (b *blockstats) get(k int) BlockStats {
+	b.Lock()
+	defer b.Unlock()
+
+	s := BlockStats{
+		Since:      b.since.UnixMilli(),
+		Total:      b.total,
+		Blocklists: make(map[string]uint64, len(b.lists)),
+		Top:        make([]BlockedName, 0, min(k, len(b.names))),
+	}
+	for bl, n := range b.lists {
+		s.Blocklists[bl] = n
+	}
+	// most counted first; and within a count, by name
+	for e := b.counts.Back(); e != nil && len(s.Top) < k; e = e.Prev() {
+		nc := e.Value.(*namecount)
+		names := make([]string, 0, len(nc.names))
+		for name := range nc.names {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names[:min(len(names), k-len(s.Top))] {
+			s.Top = append(s.Top, BlockedName{Name: name, Count: nc.n})
+		}
+	}
+	return s
+}
+
+// reset zeroes all counts.
+func (b *blockstats) reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.since = time.Now()
+	b.total = 0
+	clear(b.lists)
+	clear(b.names)
+	b.counts.Init()
+}
+
+// GetBlockStats implements x.BlockStats.
+func (r *resolver) GetBlockStats(topk int) string {
+	if topk <= 0 {
+		topk = defaultTopBlocked
+	}
+	v, err := json.Marshal(r.blocks.get(topk))
+	if err != nil { // unlikely
+		log.W("dns: blockstats: %v", err)
+		return "{}"
+	}
+	return string(v)
+}
+
+// ResetBlockStats implements x.BlockStats.
+func (r *resolver) ResetBlockStats() {
+	r.blocks.reset()
+	log.I("dns: blockstats: reset")
+}
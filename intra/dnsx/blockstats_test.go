@@ -0,0 +1,116 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestBlockStatsCounts(t *testing.T) {
+	r := &resolver{blocks: newBlockStats()}
+
+	for range 5 {
+		r.blocks.add("ads.example.", "OISD,Peter Lowe")
+	}
+	for range 3 {
+		r.blocks.add("track.example.", "OISD")
+	}
+	r.blocks.add("rebound.example.", "")
+
+	var s BlockStats
+	if err := json.Unmarshal([]byte(r.GetBlockStats(2)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 9 {
+		t.Errorf("blockstats: want total 9, got %d", s.Total)
+	}
+	if s.Blocklists["OISD"] != 8 || s.Blocklists["Peter Lowe"] != 5 || len(s.Blocklists) != 2 {
+		t.Errorf("blockstats: bad blocklist hits %v", s.Blocklists)
+	}
+	want := []BlockedName{{"ads.example.", 5}, {"track.example.", 3}}
+	if fmt.Sprint(s.Top) != fmt.Sprint(want) {
+		t.Errorf("blockstats: want top %v, got %v", want, s.Top)
+	}
+
+	r.ResetBlockStats()
+	s = r.blocks.get(defaultTopBlocked)
+	if s.Total != 0 || len(s.Blocklists) != 0 || len(s.Top) != 0 {
+		t.Errorf("blockstats: not reset: %+v", s)
+	}
+}
+
+func TestBlockStatsBounded(t *testing.T) {
+	b := newBlockStats()
+
+	for range 100 {
+		b.add("heavy.example.", "x")
+	}
+	for i := range 10 * maxblockednames {
+		b.add(fmt.Sprintf("n%d.example.", i), "x")
+	}
+	if n := len(b.names); n != maxblockednames {
+		t.Errorf("blockstats: want %d names, got %d", maxblockednames, n)
+	}
+	top := b.get(1).Top
+	if len(top) != 1 || top[0].Name != "heavy.example." {
+		t.Errorf("blockstats: heavy hitter evicted; top %v", top)
+	}
+}
+
+func TestBlockStatsSpaceSaving(t *testing.T) {
+	b := newBlockStats()
+
+	adds := 0
+	for i := range 4 * maxblockednames {
+		// a few hot names, amid many cold ones
+		b.add(fmt.Sprintf("hot%d.example.", i%5), "")
+		b.add(fmt.Sprintf("cold%d.example.", i), "")
+		adds += 2
+	}
+	// each add counts one, be it for a new name or an evicted one
+	var sum uint64
+	var last uint64
+	for e := b.counts.Front(); e != nil; e = e.Next() {
+		nc := e.Value.(*namecount)
+		if len(nc.names) <= 0 || nc.n <= last {
+			t.Fatalf("blockstats: bucket %d (%d names) after %d", nc.n, len(nc.names), last)
+		}
+		for name := range nc.names {
+			if b.names[name] != e {
+				t.Fatalf("blockstats: %s not in its bucket %d", name, nc.n)
+			}
+		}
+		sum += nc.n * uint64(len(nc.names))
+		last = nc.n
+	}
+	if sum != uint64(adds) {
+		t.Errorf("blockstats: counts sum to %d; want %d", sum, adds)
+	}
+	if n := len(b.names); n != maxblockednames {
+		t.Errorf("blockstats: want %d names, got %d", maxblockednames, n)
+	}
+	top := b.get(5).Top
+	for i, bn := range top {
+		if want := fmt.Sprintf("hot%d.example.", i); bn.Name != want || bn.Count < 4*maxblockednames/5 {
+			t.Errorf("blockstats: top #%d %v; want %s", i, bn, want)
+		}
+	}
+}
+
+func BenchmarkBlockStatsFull(b *testing.B) {
+	s := newBlockStats()
+	names := make([]string, 4*maxblockednames)
+	for i := range names {
+		names[i] = fmt.Sprintf("n%d.example.", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.add(names[i%len(names)], "x")
+	}
+}
@@ -7,6 +7,7 @@
 package dnsx
 
 import (
+	"context"
 	"errors"
 	"hash/fnv"
 	"math/rand"
@@ -59,6 +60,7 @@ type cache struct {
 	bumps     int              // max bumps before we stop bumping a response
 	size      int              // max size of the cache
 	scrubtime time.Time        // last time cache was scrubbed / purged
+	ttls      *ttlclamp        // ttl bounds of answers; may be nil
 }
 
 type cres struct {
@@ -81,6 +83,7 @@ type ctransport struct {
 	size         int           // max size of a cache bucket
 	reqbarrier   *core.Barrier // coalesce requests for the same query
 	est          core.P2QuantileEstimator
+	ttls         *ttlclamp // ttl bounds of answers; may be nil
 }
 
 func NewDefaultCachingTransport(t Transport) (ct Transport) {
@@ -88,6 +91,12 @@ func NewDefaultCachingTransport(t Transport) (ct Transport) {
 }
 
 func NewCachingTransport(t Transport, ttl time.Duration) Transport {
+	return newCachingTransport(t, ttl, nil)
+}
+
+// newCachingTransport is like NewCachingTransport, but cached answers
+// expire in agreement with ttls, if set, as they do for clients.
+func newCachingTransport(t Transport, ttl time.Duration, ttls *ttlclamp) Transport {
 	if t == nil {
 		return nil
 	}
@@ -112,6 +121,7 @@ func NewCachingTransport(t Transport, ttl time.Duration) Transport {
 		size:       defsize,
 		reqbarrier: core.NewBarrier(ttl10s),
 		est:        core.NewP50Estimator(),
+		ttls:       ttls,
 	}
 	log.I("cache: (%s) setup: %s; opts: %s", ct.ID(), ct.GetAddr(), ct.str())
 	return ct
@@ -187,9 +197,11 @@ func (cb *cache) scrubCache() {
 	log.I("cache: del: %d; ref: %d; tot: %d / high? %t", j, m, i, highload)
 }
 
+// freshCopy returns a copy of the answer for key, and whether it is fresh;
+// it bumps the expiry of the answer, and so takes a write lock.
 func (cb *cache) freshCopy(key string) (v *cres, ok bool) {
-	cb.mu.RLock()
-	defer cb.mu.RUnlock()
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
 
 	if v, ok = cb.c[key]; !ok {
 		return
@@ -197,7 +209,8 @@ func (cb *cache) freshCopy(key string) (v *cres, ok bool) {
 
 	recent := v.bumps <= 2
 	alive := time.Since(v.expiry) <= 0
-	if v.bumps < cb.bumps {
+	// bumps would have answers outlive the max ttl clients see
+	if v.bumps < cb.bumps && cb.ttls.maxttl() <= 0 {
 		n := time.Duration(v.bumps) * cb.halflife
 		// if the expiry time is already n duration in the future, don't incr ttl
 		// or if the entry is already expired, don't incr ttl
@@ -211,6 +224,16 @@ func (cb *cache) freshCopy(key string) (v *cres, ok bool) {
 	return v.copy(), (r50 || recent) && alive
 }
 
+// peek returns true if key has an answer that is yet to expire; unlike
+// freshCopy, it bumps nothing.
+func (cb *cache) peek(key string) (ok bool) {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+
+	v, ok := cb.c[key]
+	return ok && time.Since(v.expiry) <= 0
+}
+
 // put caches val against key, and returns true if the cache was updated.
 // val must be a valid dns packet with successful rcode with no truncation.
 func (cb *cache) put(key string, val []byte, s *x.DNSSummary) (ok bool) {
@@ -242,13 +265,17 @@ func (cb *cache) put(key string, val []byte, s *x.DNSSummary) (ok bool) {
 		log.W("cache: put: cache overflow %d > %d", len(cb.c), cb.size)
 	}
 
-	ansttl := time.Duration(xdns.RTtl(ans)) * time.Second
+	// ttl as clients see it, which may differ from upstream's
+	ansttl := time.Duration(cb.ttls.clampttl(xdns.RTtl(ans))) * time.Second
 	if ansttl < cb.ttl {
 		ansttl = cb.ttl
 	} else {
 		// bump up a bit longer than the ttl
 		ansttl = ansttl + cb.halflife
 	}
+	if hi := cb.ttls.maxttl(); hi > 0 {
+		ansttl = min(ansttl, hi)
+	}
 	exp := time.Now().Add(ansttl)
 	v := &cres{
 		ans:    ans,
@@ -304,13 +331,15 @@ func (t *ctransport) Type() string {
 	return t.Transport.Type()
 }
 
-func (t *ctransport) fetch(network string, q []byte, msg *dns.Msg, summary *x.DNSSummary, cb *cache, key string) (r []byte, err error) {
-	sendRequest := func(fsmm *x.DNSSummary) ([]byte, error) {
+func (t *ctransport) fetch(ctx context.Context, network string, q []byte, msg *dns.Msg, summary *x.DNSSummary, cb *cache, key string) (r []byte, err error) {
+	sendRequest := func(ctx context.Context, network string, fsmm *x.DNSSummary) ([]byte, error) {
 		fsmm.ID = t.Transport.ID()
 		fsmm.Type = t.Transport.Type()
 
 		v, _ := t.reqbarrier.Do(key, func() (any, error) {
-			ans, qerr := t.Transport.Query(network, q, fsmm)
+			// queries joining this barrier share its fate; that is,
+			// they give up on q when its leader does
+			ans, qerr := queryContext(ctx, t.Transport, network, q, fsmm)
 			// cb.put no-ops when len(ans) is 0
 			cb.put(key, ans, fsmm)
 			// cres.ans may be nil
@@ -361,7 +390,17 @@ func (t *ctransport) fetch(network string, q []byte, msg *dns.Msg, summary *x.DN
 			// fallthrough to sendRequest
 		} else if cachedsummary != nil {
 			if !isfresh { // not fresh, fetch in the background
-				go sendRequest(new(x.DNSSummary))
+				l := limitOf(ctx)
+				go func() {
+					// refreshes take slots of the limit q came in on, if any
+					if l != nil {
+						if l.acquire(time.Time{}) != nil {
+							return
+						}
+						defer l.release()
+					}
+					sendRequest(context.Background(), Background(network), new(x.DNSSummary))
+				}()
 			}
 			// change summary fields to reflect cached response, except for latency
 			fillSummary(cachedsummary, summary)
@@ -371,10 +410,16 @@ func (t *ctransport) fetch(network string, q []byte, msg *dns.Msg, summary *x.DN
 		} // else: fallthrough to sendRequest
 	}
 
-	return sendRequest(summary) // summary is filled by underlying transport
+	return sendRequest(ctx, network, summary) // summary is filled by underlying transport
 }
 
+var _ ContextQuerier = (*ctransport)(nil)
+
 func (t *ctransport) Query(network string, q []byte, summary *x.DNSSummary) ([]byte, error) {
+	return t.QueryContext(context.Background(), network, q, summary)
+}
+
+func (t *ctransport) QueryContext(ctx context.Context, network string, q []byte, summary *x.DNSSummary) ([]byte, error) {
 	var response []byte
 	var err error
 	var cb *cache
@@ -392,12 +437,13 @@ func (t *ctransport) Query(network string, q []byte, summary *x.DNSSummary) ([]b
 				ttl:      t.ttl,
 				bumps:    t.bumps,
 				halflife: t.halflife,
+				ttls:     t.ttls,
 			}
 			t.store[h] = cb
 		}
 		t.Unlock()
 
-		response, err = t.fetch(network, q, msg, summary, cb, key)
+		response, err = t.fetch(ctx, network, q, msg, summary, cb, key)
 
 	} else {
 		err = errMissingQueryName // not really a transport error
@@ -406,6 +452,70 @@ func (t *ctransport) Query(network string, q []byte, summary *x.DNSSummary) ([]b
 	return response, err
 }
 
+// cached returns true if q would be answered from the cache, as-is, sans
+// a refresh; answers that expired are refreshed in the background.
+func (t *ctransport) cached(q []byte) bool {
+	key, h, ok := mkcachekey(xdns.AsMsg(q))
+	if !ok || t.Status() == SendFailed {
+		return false
+	}
+	t.RLock()
+	cb := t.store[h]
+	t.RUnlock()
+	if cb == nil {
+		return false
+	}
+	return cb.peek(key)
+}
+
+// count returns the number of cached responses across all buckets.
+func (t *ctransport) count() (n int) {
+	t.RLock()
+	defer t.RUnlock()
+
+	for _, cb := range t.store {
+		if cb != nil {
+			cb.mu.RLock()
+			n += len(cb.c)
+			cb.mu.RUnlock()
+		}
+	}
+	return
+}
+
+// trim removes expired responses, or all of them if all is set;
+// returns the number of responses removed.
+func (t *ctransport) trim(all bool) (n int) {
+	n = t.trimIf(func(v *cres, now time.Time) bool {
+		return all || now.After(v.expiry)
+	})
+	log.I("cache: (%s) trim: all? %t; removed %d", t.ID(), all, n)
+	return
+}
+
+// trimIf removes responses for which drop returns true; returns
+// the number of responses removed.
+func (t *ctransport) trimIf(drop func(v *cres, now time.Time) bool) (n int) {
+	t.RLock()
+	defer t.RUnlock()
+
+	now := time.Now()
+	for _, cb := range t.store {
+		if cb == nil {
+			continue
+		}
+		cb.mu.Lock()
+		for k, v := range cb.c {
+			if drop(v, now) {
+				delete(cb.c, k)
+				n++
+			}
+		}
+		cb.mu.Unlock()
+	}
+	return
+}
+
 func (t *ctransport) P50() int64 {
 	return t.est.Get()
 }
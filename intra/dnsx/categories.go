@@ -0,0 +1,170 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+)
+
+const (
+	// prefix of categories in domain route names
+	catprefix = "cat:"
+	// categories of a domain are cached for as long, unless set otherwise
+	catttl = 30 * time.Minute
+	// max domains cached; half of them are dropped when full
+	catmax = 4096
+	// max domains categorized at once; lookups that miss over it are
+	// categorized on a later lookup
+	catconcurrency = 4
+)
+
+// catsrc is a client-set Categorizer, and ttl of its categories.
+type catsrc struct {
+	c   x.Categorizer
+	ttl time.Duration
+}
+
+type catentry struct {
+	cats []string
+	exp  time.Time
+}
+
+// categories caches categories of domains as set by a Categorizer; lookups
+// never wait on it, and misses are filled in the background.
+type categories struct {
+	src     atomic.Pointer[catsrc] // may be nil
+	sem     chan struct{}          // bounds concurrent fills
+	mu      sync.RWMutex           // protects m, pending
+	m       map[string]catentry    // normalized name -> categories
+	pending map[string]struct{}    // names being categorized
+}
+
+func newCategories() *categories {
+	return &categories{
+		sem:     make(chan struct{}, catconcurrency),
+		m:       make(map[string]catentry),
+		pending: make(map[string]struct{}),
+	}
+}
+
+// set sets c to categorize domains with, caching its categories for ttl;
+// drops all categories cached so far.
+func (c *categories) set(cz x.Categorizer, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = catttl
+	}
+	if cz == nil {
+		c.src.Store(nil)
+	} else {
+		c.src.Store(&catsrc{c: cz, ttl: ttl})
+	}
+	c.mu.Lock()
+	clear(c.m)
+	c.mu.Unlock()
+	log.I("dns: categories: set? %t; ttl %s", cz != nil, ttl)
+}
+
+// lookup returns categories of names, as cached, sorted and without dups;
+// names not cached (or expired) are categorized in the background.
+func (c *categories) lookup(names ...string) (out []string) {
+	src := c.src.Load()
+	if src == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, name := range names {
+		k, err := xdns.NormalizeQName(name)
+		if err != nil || len(k) <= 0 || k == "." {
+			continue
+		}
+		c.mu.RLock()
+		e, ok := c.m[k]
+		c.mu.RUnlock()
+		if !ok || now.After(e.exp) {
+			c.fill(src, k)
+		}
+		if ok { // stale categories are better than none
+			out = append(out, e.cats...)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// fill categorizes name in the background, unless it is already being
+// categorized or too many names are.
+func (c *categories) fill(src *catsrc, name string) {
+	c.mu.Lock()
+	if _, ok := c.pending[name]; ok {
+		c.mu.Unlock()
+		return
+	}
+	select {
+	case c.sem <- struct{}{}:
+	default:
+		c.mu.Unlock()
+		return
+	}
+	c.pending[name] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		defer func() { <-c.sem }()
+		cats := splitCategories(src.c.Categorize(name))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.pending, name)
+		if c.src.Load() != src { // categorizer changed since
+			return
+		}
+		if len(c.m) >= catmax {
+			n := 0
+			for k := range c.m { // evicts at random
+				delete(c.m, k)
+				if n++; n >= catmax/2 {
+					break
+				}
+			}
+		}
+		c.m[name] = catentry{cats: cats, exp: time.Now().Add(src.ttl)}
+		log.V("dns: categories: %s => %v", name, cats)
+	}()
+}
+
+// splitCategories returns categories in csv, lowercased, sans empties.
+func splitCategories(csv string) (out []string) {
+	for _, s := range strings.Split(csv, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); len(s) > 0 {
+			out = append(out, s)
+		}
+	}
+	return
+}
+
+// Implements x.DomainCategorizer
+func (r *resolver) SetCategorizer(c x.Categorizer, ttlsecs int) {
+	r.cats.set(c, time.Duration(ttlsecs)*time.Second)
+}
+
+// Implements Resolver
+func (r *resolver) CategoriesOf(domains string) (cats, route string) {
+	names := strings.Split(domains, ",")
+	all := r.cats.lookup(names...)
+	if len(all) <= 0 {
+		return
+	}
+	return strings.Join(all, ","), r.routes.matchCategory(all...)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowCategorizer categorizes domains from cats, once let through.
+type slowCategorizer struct {
+	cats  map[string]string
+	gate  chan struct{} // closed to let calls through
+	calls atomic.Int32
+}
+
+func (c *slowCategorizer) Categorize(domain string) string {
+	c.calls.Add(1)
+	<-c.gate
+	return c.cats[domain]
+}
+
+// waitCategories waits for names to have categories want.
+func waitCategories(t *testing.T, c *categories, want []string, names ...string) {
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		got := c.lookup(names...)
+		if slices.Equal(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("categories: %v: want %v, got %v", names, want, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCategoriesNonBlocking(t *testing.T) {
+	cz := &slowCategorizer{
+		cats: map[string]string{
+			"casino.example": " Gambling, ads ,,",
+			"bet.example":    "gambling",
+		},
+		gate: make(chan struct{}),
+	}
+	c := newCategories()
+	if got := c.lookup("casino.example"); got != nil {
+		t.Fatalf("categories: unset: got %v", got)
+	}
+	c.set(cz, time.Hour)
+
+	// misses return right away, while the categorizer is stuck
+	start := time.Now()
+	for range 10 {
+		if got := c.lookup("casino.example.", "CASINO.example"); len(got) > 0 {
+			t.Fatalf("categories: miss: got %v", got)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("categories: miss: took %s", d)
+	}
+	for deadline := time.Now().Add(time.Second); cz.calls.Load() <= 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := cz.calls.Load(); n != 1 {
+		t.Errorf("categories: want 1 pending call, got %d", n)
+	}
+
+	close(cz.gate)
+	waitCategories(t, c, []string{"ads", "gambling"}, "casino.example", "bet.example", "none.example")
+
+	// a new categorizer drops all categories
+	c.set(nil, 0)
+	if got := c.lookup("casino.example"); got != nil {
+		t.Errorf("categories: unset: got %v", got)
+	}
+}
+
+func TestCategoryRoutes(t *testing.T) {
+	r := &resolver{routes: newDomainRoutes(), cats: newCategories()}
+	r.routes.cats = r.cats
+	for _, bad := range []string{"cat:", "cat: ", "cat:a,b"} {
+		if err := r.AddDomainRoute(bad, "wg1"); err == nil {
+			t.Errorf("route: %q: want err", bad)
+		}
+	}
+	if err := r.AddDomainRoute("cat:Gambling", "wg1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddDomainRoute("*.bet.example", "wg2"); err != nil {
+		t.Fatal(err)
+	}
+
+	gate := make(chan struct{})
+	close(gate)
+	r.SetCategorizer(&slowCategorizer{
+		cats: map[string]string{"casino.example": "gambling,ads", "www.bet.example": "gambling"},
+		gate: gate,
+	}, 0)
+
+	// uncategorized flows go without; the lookup categorizes them
+	if cats, route := r.CategoriesOf("casino.example"); cats != "" || route != "" {
+		t.Errorf("route: miss: got %q, %q", cats, route)
+	}
+	waitCategories(t, r.cats, []string{"ads", "gambling"}, "casino.example")
+	if cats, route := r.CategoriesOf("casino.example,"); cats != "ads,gambling" || route != "wg1" {
+		t.Errorf("route: cat: got %q, %q", cats, route)
+	}
+	if got := r.routeFor("casino.example."); got != "wg1" {
+		t.Errorf("route: query: want wg1, got %q", got)
+	}
+
+	// routes on names win over those on categories
+	waitCategories(t, r.cats, []string{"gambling"}, "www.bet.example")
+	if got := r.routes.match("www.bet.example."); got != "wg2" {
+		t.Errorf("route: name over cat: want wg2, got %q", got)
+	}
+
+	if got := r.ListDomainRoutes(); !slices.Contains([]string{
+		"*.bet.example=wg2\ncat:gambling=wg1",
+		"cat:gambling=wg1\n*.bet.example=wg2",
+	}, got) {
+		t.Errorf("route: list: got %q", got)
+	}
+	if !r.RemoveDomainRoute("cat:gambling") || r.RemoveDomainRoute("cat:gambling") {
+		t.Errorf("route: remove: want true, then false")
+	}
+	if got := r.routeFor("casino.example."); got != "" {
+		t.Errorf("route: removed: got %q", got)
+	}
+}
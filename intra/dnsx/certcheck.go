@@ -0,0 +1,339 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// leaf keys of a server are expected to change once its leaf is
+	// this close to expiry (ex: as it is renewed), and not before
+	keyrollover = 30 * 24 * time.Hour
+	// keys of a server not seen for this long are forgotten; servers
+	// (ex: behind load balancers) may serve leaves of different keys
+	// for as long, as they roll keys over
+	keyoverlap = 7 * 24 * time.Hour
+	// max servers whose certs are remembered, per transport
+	maxcertservers = 64
+)
+
+// stapled ocsp response of a handshake, as seen by CertChecks.
+const (
+	stapleNone    = "none"    // not stapled
+	stapleGood    = "good"    // leaf is not revoked
+	stapleRevoked = "revoked" // leaf is revoked
+	stapleUnknown = "unknown" // responder knows not of the leaf
+	stapleInvalid = "invalid" // unparsable, unsigned by the issuer, or stale
+)
+
+// ErrCertCheck is wrapped by errors of handshakes that fail CertChecks.
+var ErrCertCheck = errors.New("certcheck")
+
+var (
+	errNoStaple     = fmt.Errorf("%w: no stapled ocsp response", ErrCertCheck)
+	errBadStaple    = fmt.Errorf("%w: stapled ocsp response not good", ErrCertCheck)
+	errRevoked      = fmt.Errorf("%w: leaf cert revoked", ErrCertCheck)
+	errTooFewSCTs   = fmt.Errorf("%w: too few signed cert timestamps", ErrCertCheck)
+	errUncovered    = fmt.Errorf("%w: leaf cert covers none of the ips", ErrCertCheck)
+	errNoCertChecks = errors.New("transport does not check certs")
+)
+
+var (
+	// rfc6962 sec 3.3; in the leaf, and in ocsp responses
+	oidLeafSCTs = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	oidOCSPSCTs = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 5}
+)
+
+// CertChecker is an encrypted Transport (DoH, DoT) that checks certs of its
+// servers beyond the chain; see: CertChecks.
+type CertChecker interface {
+	// SetCertChecks sets the checks; alert is called on unexpected changes
+	// of leaf keys of its servers, if keys is set.
+	SetCertChecks(staple bool, minscts int, keys bool, alert CertAlert) error
+	// CertStatus returns what was seen of certs of its servers.
+	CertStatus() string
+	// CoverIPs fails handshakes whose leaf certs do not have any of ips
+	// as an ip address; ex: of a designated resolver, rfc9462 sec 4.2.
+	CoverIPs(ips ...netip.Addr)
+}
+
+// CertAlert is called when the leaf key of server changes from prev to
+// next (base64 sha256 of SubjectPublicKeyInfo) unexpectedly.
+type CertAlert func(server, prev, next string)
+
+// certseen is what CertChecks saw of the certs of a server.
+type certseen struct {
+	spki     string               // of the last leaf
+	notafter time.Time            // of the last leaf
+	keys     map[string]time.Time // spki => last seen
+	staple   string               // of the last handshake
+	scts     int                  // of the last handshake
+	changes  int                  // unexpected key changes
+	at       time.Time            // of the last handshake
+}
+
+// CertChecks checks certs of servers of encrypted transports on top of chain
+// validation, in tls.Config.VerifyConnection: it requires stapled ocsp, and
+// signed cert timestamps (as sent in the tls extension, stapled, or embedded in
+// the leaf; their signatures are not verified, as there is no list of logs to
+// verify them against), and remembers leaf keys of servers, to alert on keys
+// that change before their leaves near expiry, even as the chains validate.
+// The zero value checks nothing; see: NewCertChecks.
+type CertChecks struct {
+	sync.RWMutex                      // protects all fields
+	staple       bool                 // fail handshakes with no good staple
+	minscts      int                  // fail handshakes with fewer scts
+	keys         bool                 // remember leaf keys of servers
+	alert        CertAlert            // may be nil
+	covers       []netip.Addr         // leaves must have one of these ips
+	seen         map[string]*certseen // server name => certs seen
+}
+
+// NewCertChecks returns a CertChecks that checks nothing till set.
+func NewCertChecks() *CertChecks {
+	return &CertChecks{seen: make(map[string]*certseen)}
+}
+
+// Set sets the checks: if staple, handshakes with no stapled ocsp response,
+// or one that is not good, fail; if minscts > 0, those with fewer scts fail;
+// if keys, alert is called when a server's leaf key changes unexpectedly.
+func (c *CertChecks) Set(staple bool, minscts int, keys bool, alert CertAlert) {
+	c.Lock()
+	defer c.Unlock()
+	c.staple = staple
+	c.minscts = max(minscts, 0)
+	c.keys = keys
+	c.alert = alert
+	if c.seen == nil {
+		c.seen = make(map[string]*certseen)
+	}
+	log.I("dns: certcheck: staple? %t, min scts %d, keys? %t", staple, minscts, keys)
+}
+
+// Cover sets the ips, one of which leaves must have as an ip address;
+// none unsets it.
+func (c *CertChecks) Cover(ips ...netip.Addr) {
+	c.Lock()
+	defer c.Unlock()
+	c.covers = ips
+	if c.seen == nil {
+		c.seen = make(map[string]*certseen)
+	}
+	log.I("dns: certcheck: covers %v", ips)
+}
+
+func (c *CertChecks) on() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.staple || c.minscts > 0 || c.keys || len(c.covers) > 0
+}
+
+// Verify implements tls.Config.VerifyConnection.
+func (c *CertChecks) Verify(cs tls.ConnectionState) error {
+	if c == nil || len(cs.PeerCertificates) <= 0 || !c.on() {
+		return nil
+	}
+	leaf := cs.PeerCertificates[0]
+	var issuer *x509.Certificate
+	if len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 1 {
+		issuer = cs.VerifiedChains[0][1]
+	} else if len(cs.PeerCertificates) > 1 { // unverified
+		issuer = cs.PeerCertificates[1]
+	}
+	staple, resp := stapleOf(cs.OCSPResponse, leaf, issuer)
+	scts := len(cs.SignedCertificateTimestamps) + sctsIn(leaf.Extensions, oidLeafSCTs)
+	if resp != nil {
+		scts += sctsIn(resp.Extensions, oidOCSPSCTs)
+	}
+	server := cs.ServerName
+	if len(server) <= 0 {
+		server = leaf.Subject.CommonName
+	}
+
+	c.Lock()
+	prev, next := c.seenLocked(server, leaf, staple, scts)
+	wantstaple, minscts, alert, covers := c.staple, c.minscts, c.alert, c.covers
+	c.Unlock()
+
+	if len(next) > 0 {
+		log.W("dns: certcheck: %s: leaf key changed %s => %s", server, prev, next)
+		if alert != nil {
+			go alert(server, prev, next)
+		}
+	}
+	if wantstaple {
+		switch staple {
+		case stapleNone:
+			return errNoStaple
+		case stapleRevoked:
+			return errRevoked
+		case stapleGood:
+		default:
+			return errBadStaple
+		}
+	}
+	if scts < minscts {
+		return fmt.Errorf("%w: %d < %d", errTooFewSCTs, scts, minscts)
+	}
+	if len(covers) > 0 && !covered(leaf, covers) {
+		return fmt.Errorf("%w: %v of %s", errUncovered, covers, server)
+	}
+	return nil
+}
+
+// covered returns true if leaf has any of ips as an ip address.
+func covered(leaf *x509.Certificate, ips []netip.Addr) bool {
+	for _, ip := range leaf.IPAddresses {
+		if addr, ok := netip.AddrFromSlice(ip); ok && slices.Contains(ips, addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// seenLocked records the certs of server, and returns its previous and next
+// leaf keys, if it changed unexpectedly; must be called with c locked.
+func (c *CertChecks) seenLocked(server string, leaf *x509.Certificate, staple string, scts int) (prev, next string) {
+	now := time.Now()
+	spki := spkiOf(leaf)
+	s := c.seen[server]
+	if s == nil {
+		if len(c.seen) >= maxcertservers {
+			c.forgetLocked()
+		}
+		s = &certseen{keys: make(map[string]time.Time)}
+		c.seen[server] = s
+	}
+	if c.keys {
+		for k, at := range s.keys {
+			if now.Sub(at) > keyoverlap {
+				delete(s.keys, k)
+			}
+		}
+		_, known := s.keys[spki]
+		// a leaf of a key not seen of late, before the last leaf nears expiry
+		if !known && len(s.spki) > 0 && spki != s.spki && now.Add(keyrollover).Before(s.notafter) {
+			prev, next = s.spki, spki
+			s.changes++
+		}
+		s.keys[spki] = now
+	}
+	s.spki = spki
+	s.notafter = leaf.NotAfter
+	s.staple = staple
+	s.scts = scts
+	s.at = now
+	return
+}
+
+// forgetLocked forgets the server seen least recently.
+func (c *CertChecks) forgetLocked() {
+	oldest, at := "", time.Now()
+	for server, s := range c.seen {
+		if s.at.Before(at) {
+			oldest, at = server, s.at
+		}
+	}
+	delete(c.seen, oldest)
+}
+
+// Status returns "server=spki=k;notafter=t;staple=s;scts=n;changes=n;at=t"
+// of all servers seen, one per line.
+func (c *CertChecks) Status() string {
+	if c == nil {
+		return ""
+	}
+	c.RLock()
+	defer c.RUnlock()
+	servers := make([]string, 0, len(c.seen))
+	for server := range c.seen {
+		servers = append(servers, server)
+	}
+	slices.Sort(servers)
+	var b strings.Builder
+	for _, server := range servers {
+		s := c.seen[server]
+		fmt.Fprintf(&b, "%s=spki=%s;notafter=%s;staple=%s;scts=%d;changes=%d;at=%s\n",
+			server, s.spki, s.notafter.UTC().Format(time.RFC3339), s.staple, s.scts, s.changes, s.at.UTC().Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// spkiOf returns the base64 sha256 of the SubjectPublicKeyInfo of cert.
+func spkiOf(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// stapleOf returns the status of the stapled ocsp response raw for leaf,
+// and the response, if it is signed by issuer (or a responder it delegated
+// to) and is not stale.
+func stapleOf(raw []byte, leaf, issuer *x509.Certificate) (string, *ocsp.Response) {
+	if len(raw) <= 0 {
+		return stapleNone, nil
+	}
+	if issuer == nil {
+		return stapleInvalid, nil
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		log.D("dns: certcheck: staple: %v", err)
+		return stapleInvalid, nil
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return stapleInvalid, nil
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return stapleGood, resp
+	case ocsp.Revoked:
+		return stapleRevoked, resp
+	default:
+		return stapleUnknown, resp
+	}
+}
+
+// sctsIn returns the number of scts in the SignedCertificateTimestampList
+// of extension oid in exts, if any; rfc6962 sec 3.3.
+func sctsIn(exts []pkix.Extension, oid asn1.ObjectIdentifier) (n int) {
+	for _, e := range exts {
+		if !e.Id.Equal(oid) {
+			continue
+		}
+		in := cryptobyte.String(e.Value)
+		var der, list cryptobyte.String
+		if !in.ReadASN1(&der, cbasn1.OCTET_STRING) || !der.ReadUint16LengthPrefixed(&list) {
+			return 0
+		}
+		for !list.Empty() {
+			var sct cryptobyte.String
+			if !list.ReadUint16LengthPrefixed(&sct) {
+				return 0
+			}
+			n++
+		}
+	}
+	return
+}
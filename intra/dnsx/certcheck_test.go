@@ -0,0 +1,303 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ocsp"
+)
+
+const certServer = "dns.example"
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// sctList returns the SignedCertificateTimestampList extension value of
+// n fake scts; rfc6962 sec 3.3.
+func sctList(n int) []byte {
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.OCTET_STRING, func(b *cryptobyte.Builder) {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for range n {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte("fake sct"))
+				})
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// leaf returns a cert for certServer that expires in ttl, with n scts
+// embedded; of key, or a new one if nil.
+func (ca *testCA) leaf(t *testing.T, key crypto.Signer, ttl time.Duration, scts int) tls.Certificate {
+	if key == nil {
+		key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: certServer},
+		DNSNames:     []string{certServer},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if scts > 0 {
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: oidLeafSCTs, Value: sctList(scts)}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// staple returns an ocsp response for leaf, signed by ca, of status.
+func (ca *testCA) staple(t *testing.T, leaf *x509.Certificate, status int) []byte {
+	now := time.Now()
+	raw, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   now.Add(-time.Hour),
+		NextUpdate:   now.Add(time.Hour),
+		RevokedAt:    now.Add(-time.Minute),
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// handshake serves cert over a local tls server, and returns the err of a
+// client that checks it with c.
+func handshake(t *testing.T, ca *testCA, cert tls.Certificate, c *CertChecks) error {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(d, "tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:          ca.pool,
+		ServerName:       certServer,
+		VerifyConnection: c.Verify,
+	})
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestCertChecksStaple(t *testing.T) {
+	ca := newTestCA(t)
+	c := NewCertChecks()
+
+	cert := ca.leaf(t, nil, 90*24*time.Hour, 0)
+	if err := handshake(t, ca, cert, c); err != nil {
+		t.Fatalf("certcheck: off: %v", err)
+	}
+	if s := c.Status(); len(s) > 0 {
+		t.Errorf("certcheck: off: want no status, got %q", s)
+	}
+
+	c.Set(true, 0, false, nil)
+	if err := handshake(t, ca, cert, c); !errors.Is(err, errNoStaple) || !errors.Is(err, ErrCertCheck) {
+		t.Errorf("certcheck: staple missing: want %v, got %v", errNoStaple, err)
+	}
+	if s := c.Status(); !strings.Contains(s, "staple=none") {
+		t.Errorf("certcheck: staple missing: status %q", s)
+	}
+
+	cert.OCSPStaple = ca.staple(t, cert.Leaf, ocsp.Good)
+	if err := handshake(t, ca, cert, c); err != nil {
+		t.Errorf("certcheck: staple present: %v", err)
+	}
+	if s := c.Status(); !strings.HasPrefix(s, certServer+"=spki="+spkiOf(cert.Leaf)) || !strings.Contains(s, "staple=good") {
+		t.Errorf("certcheck: staple present: status %q", s)
+	}
+
+	cert.OCSPStaple = ca.staple(t, cert.Leaf, ocsp.Revoked)
+	if err := handshake(t, ca, cert, c); !errors.Is(err, errRevoked) {
+		t.Errorf("certcheck: staple revoked: want %v, got %v", errRevoked, err)
+	}
+
+	other := newTestCA(t) // not the issuer
+	cert.OCSPStaple = other.staple(t, cert.Leaf, ocsp.Good)
+	if err := handshake(t, ca, cert, c); !errors.Is(err, errBadStaple) {
+		t.Errorf("certcheck: staple forged: want %v, got %v", errBadStaple, err)
+	}
+}
+
+func TestCertChecksSCTs(t *testing.T) {
+	ca := newTestCA(t)
+	c := NewCertChecks()
+	c.Set(false, 2, false, nil)
+
+	cert := ca.leaf(t, nil, 90*24*time.Hour, 1)
+	if err := handshake(t, ca, cert, c); !errors.Is(err, errTooFewSCTs) {
+		t.Errorf("certcheck: 1 sct: want %v, got %v", errTooFewSCTs, err)
+	}
+	// scts sent in the tls extension count along with the embedded
+	cert.SignedCertificateTimestamps = [][]byte{[]byte("fake sct")}
+	if err := handshake(t, ca, cert, c); err != nil {
+		t.Errorf("certcheck: 2 scts: %v", err)
+	}
+	if s := c.Status(); !strings.Contains(s, "scts=2") {
+		t.Errorf("certcheck: 2 scts: status %q", s)
+	}
+}
+
+func TestCertChecksKeyChange(t *testing.T) {
+	ca := newTestCA(t)
+	c := NewCertChecks()
+	alerts := make(chan [3]string, 4)
+	c.Set(false, 0, true, func(server, prev, next string) {
+		alerts <- [3]string{server, prev, next}
+	})
+	expectAlert := func(what string, want [3]string, ok bool) {
+		t.Helper()
+		select {
+		case got := <-alerts:
+			if !ok || got != want {
+				t.Errorf("certcheck: %s: want alert %t %v, got %v", what, ok, want, got)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if ok {
+				t.Errorf("certcheck: %s: want alert %v, got none", what, want)
+			}
+		}
+	}
+
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert1 := ca.leaf(t, key1, 90*24*time.Hour, 0)
+	if err := handshake(t, ca, cert1, c); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert("first", [3]string{}, false)
+
+	// renewed leaves of the same key are not changes
+	if err := handshake(t, ca, ca.leaf(t, key1, 90*24*time.Hour, 0), c); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert("renewed", [3]string{}, false)
+
+	// a new key, with months left on the last leaf, goes through, with an alert
+	cert2 := ca.leaf(t, nil, 90*24*time.Hour, 0)
+	if err := handshake(t, ca, cert2, c); err != nil {
+		t.Fatalf("certcheck: key change: %v", err)
+	}
+	expectAlert("key change", [3]string{certServer, spkiOf(cert1.Leaf), spkiOf(cert2.Leaf)}, true)
+
+	// keys seen of late are known (ex: servers behind load balancers)
+	if err := handshake(t, ca, cert1, c); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert("overlap", [3]string{}, false)
+
+	// a new key once the last leaf nears expiry is a rollover
+	if err := handshake(t, ca, ca.leaf(t, key1, 10*24*time.Hour, 0), c); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, ca, ca.leaf(t, nil, 90*24*time.Hour, 0), c); err != nil {
+		t.Fatal(err)
+	}
+	expectAlert("rollover", [3]string{}, false)
+
+	if s := c.Status(); !strings.Contains(s, "changes=1") {
+		t.Errorf("certcheck: status %q", s)
+	}
+}
+
+func TestCertChecksResolver(t *testing.T) {
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, &tidListener{}, nil).(*resolver)
+	tr := fakeTransport{}
+	r.Add(tr)
+	if err := r.SetCertChecks(tr.ID(), true, 0, false); !errors.Is(err, errNoCertChecks) {
+		t.Errorf("certcheck: plain transport: want %v, got %v", errNoCertChecks, err)
+	}
+	if err := r.SetCertChecks("missing", true, 0, false); !errors.Is(err, errNoSuchTransport) {
+		t.Errorf("certcheck: missing transport: want %v, got %v", errNoSuchTransport, err)
+	}
+	if s := r.CertStatus("missing"); len(s) > 0 {
+		t.Errorf("certcheck: missing transport: status %q", s)
+	}
+}
+
+func TestCertChecksCover(t *testing.T) {
+	leaf := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: certServer},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")},
+	}
+	cs := tls.ConnectionState{ServerName: certServer, PeerCertificates: []*x509.Certificate{leaf}}
+	c := NewCertChecks()
+	if err := c.Verify(cs); err != nil {
+		t.Errorf("certcheck: no covers: %v", err)
+	}
+	c.Cover(netip.MustParseAddr("10.0.0.2"))
+	if err := c.Verify(cs); !errors.Is(err, errUncovered) || !errors.Is(err, ErrCertCheck) {
+		t.Errorf("certcheck: uncovered: want %v, got %v", errUncovered, err)
+	}
+	c.Cover(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"))
+	if err := c.Verify(cs); err != nil {
+		t.Errorf("certcheck: covered v4: %v", err)
+	}
+	c.Cover(netip.MustParseAddr("2001:db8::1"))
+	if err := c.Verify(cs); err != nil {
+		t.Errorf("certcheck: covered v6: %v", err)
+	}
+}
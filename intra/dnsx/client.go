@@ -0,0 +1,203 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// max queries a client transport answers at once; more fail right away
+const maxClientQueries = 32
+
+// queries not answered by a client transport in time fail; the query
+// holds on to its slot until the client returns, though
+var clientTimeout = 5 * time.Second
+
+var (
+	errClientTransport = errors.New("client: no transport")
+	errClientBusy      = errors.New("client: too many queries")
+	errClientTimeout   = errors.New("client: no answer in time")
+	errClientPanic     = errors.New("client: panic")
+	errClientNoAnswer  = errors.New("client: empty answer")
+)
+
+// client is a Transport that has queries answered by x.DNSClientTransport,
+// which is implemented by the client (and so, may be slow, misbehave, or
+// panic); it fills in summaries, and bounds queries in flight and their
+// wait for answers.
+type client struct {
+	ct   x.DNSClientTransport
+	id   string
+	addr string
+	sem  chan struct{} // queries in flight
+
+	mu     sync.Mutex // protects status and est
+	status int
+	est    core.P2QuantileEstimator
+}
+
+var _ Transport = (*client)(nil)
+
+// NewClientTransport returns a Transport with the id of ct that has its
+// queries answered by ct.
+func NewClientTransport(ct x.DNSClientTransport) (Transport, error) {
+	if ct == nil {
+		return nil, errClientTransport
+	}
+	id := ct.ID()
+	if len(id) <= 0 || isReserved(id) {
+		return nil, fmt.Errorf("client: bad id %q: %w", id, errClientTransport)
+	}
+	c := &client{
+		ct:     ct,
+		id:     id,
+		addr:   ct.GetAddr(),
+		sem:    make(chan struct{}, maxClientQueries),
+		status: Start,
+		est:    core.NewP50Estimator(),
+	}
+	log.I("dns: client: %s (%s): new @ %s", id, ct.Type(), c.addr)
+	return c, nil
+}
+
+// Implements Transport
+func (c *client) Query(_ string, q []byte, smm *x.DNSSummary) (r []byte, err error) {
+	start := time.Now()
+	status := Complete
+	var ans *dns.Msg
+
+	defer func() {
+		elapsed := time.Since(start)
+		c.done(status, elapsed)
+
+		smm.Latency = elapsed.Seconds()
+		smm.RData = xdns.GetInterestingRData(ans)
+		smm.RCode = xdns.Rcode(ans)
+		if ans == nil {
+			smm.RCode = dns.RcodeServerFailure
+		}
+		smm.RTtl = xdns.RTtl(ans)
+		smm.Server = c.addr
+		smm.Status = status
+		smm.Attempts = 1
+		if err == nil {
+			smm.AttemptOK = 1
+		}
+		log.V("dns: client: %s: len(res): %d, data: %s, status: %d; err? %v", c.id, len(r), smm.RData, status, err)
+	}()
+
+	select {
+	case c.sem <- struct{}{}:
+	default:
+		status = SendFailed
+		return nil, errClientBusy
+	}
+
+	type answer struct {
+		r      []byte
+		err    error
+		status int
+	}
+	ch := make(chan answer, 1) // never blocks the client
+	go func() {
+		defer func() { <-c.sem }()
+		defer func() {
+			if v := recover(); v != nil {
+				log.E("dns: client: %s: panic: %v", c.id, v)
+				ch <- answer{nil, fmt.Errorf("%w: %v", errClientPanic, v), InternalError}
+			}
+		}()
+		r, err := c.ct.Query(q)
+		if err != nil {
+			ch <- answer{nil, err, failedStatus(c.ct.Status())}
+			return
+		}
+		ch <- answer{r, nil, Complete}
+	}()
+
+	timer := time.NewTimer(clientTimeout)
+	defer timer.Stop()
+	select {
+	case a := <-ch:
+		r, err, status = a.r, a.err, a.status
+	case <-timer.C:
+		status = NoResponse
+		return nil, errClientTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(r) <= 0 {
+		status = BadResponse
+		return nil, errClientNoAnswer
+	}
+	ans = new(dns.Msg)
+	if err = ans.Unpack(r); err != nil {
+		ans = nil
+		status = BadResponse
+		return nil, err
+	}
+	return r, nil
+}
+
+// failedStatus returns status if it is one that a failed query may have;
+// or TransportError.
+func failedStatus(status int) int {
+	switch status {
+	case SendFailed, NoResponse, BadQuery, BadResponse, TransportError, ClientError:
+		return status
+	}
+	return TransportError
+}
+
+func (c *client) done(status int, elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status = status
+	if status == Complete && elapsed > 0 {
+		c.est.Add(elapsed.Seconds())
+	}
+}
+
+// Implements Transport
+func (c *client) ID() string {
+	return c.id
+}
+
+// Implements Transport
+func (c *client) Type() string {
+	return Client
+}
+
+// Implements Transport
+func (c *client) P50() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.est.Get()
+}
+
+// Implements Transport
+func (c *client) GetAddr() string {
+	return c.addr
+}
+
+// Implements Transport
+func (c *client) Status() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// enterpriseDB is a reference x.DNSClientTransport, as a client would
+// implement it: answers a queries for names it knows from an in-process db;
+// nxdomain for the rest.
+type enterpriseDB struct {
+	db     map[string]string // name -> ip4
+	wait   chan struct{}     // if set, queries block until closed
+	fail   error             // if set, queries fail with it
+	status int               // status of the previous failure
+	boom   bool              // if set, queries panic
+}
+
+func (*enterpriseDB) ID() string      { return "corp" }
+func (*enterpriseDB) Type() string    { return "enterprise-db" }
+func (*enterpriseDB) GetAddr() string { return "db.corp.internal" }
+func (e *enterpriseDB) Status() int   { return e.status }
+
+func (e *enterpriseDB) Query(q []byte) ([]byte, error) {
+	if e.wait != nil {
+		<-e.wait
+	}
+	if e.boom {
+		panic("enterprise-db: boom")
+	}
+	if e.fail != nil {
+		return nil, e.fail
+	}
+	msg := xdns.AsMsg(q)
+	if msg == nil || len(msg.Question) != 1 {
+		return nil, errors.New("enterprise-db: bad query")
+	}
+	ans := new(dns.Msg)
+	ans.SetReply(msg)
+	name := msg.Question[0].Name
+	if ip, ok := e.db[name]; ok && msg.Question[0].Qtype == dns.TypeA {
+		ans.Answer = []dns.RR{xdns.MakeARecord(name, ip, 300)}
+	} else {
+		ans.Rcode = dns.RcodeNameError
+	}
+	return ans.Pack()
+}
+
+func newEnterpriseDB() *enterpriseDB {
+	return &enterpriseDB{db: map[string]string{"intranet.corp.": "10.1.2.3"}}
+}
+
+func clientQuery(t *testing.T, tr Transport, name string) (*dns.Msg, *x.DNSSummary, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qb, _ := q.Pack()
+	smm := new(x.DNSSummary)
+	res, err := tr.Query(NetTypeUDP, qb, smm)
+	return xdns.AsMsg(res), smm, err
+}
+
+func TestClientTransportArgs(t *testing.T) {
+	if _, err := NewClientTransport(nil); err == nil {
+		t.Error("client: nil: want err")
+	}
+	if _, err := NewClientTransport(&reservedDB{}); err == nil {
+		t.Error("client: reserved id: want err")
+	}
+}
+
+type reservedDB struct{ enterpriseDB }
+
+func (*reservedDB) ID() string { return Preferred }
+
+func TestClientTransportAnswers(t *testing.T) {
+	tr, err := NewClientTransport(newEnterpriseDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans, smm, err := clientQuery(t, tr, "intranet.corp.")
+	if err != nil || ans == nil || len(ans.Answer) != 1 {
+		t.Fatalf("client: want one answer, got %v; err? %v", ans, err)
+	}
+	if smm.Status != Complete || smm.Server != "db.corp.internal" || smm.RData != "10.1.2.3" || smm.RTtl != 300 {
+		t.Errorf("client: summary: %+v", smm)
+	}
+	if tr.Status() != Complete || tr.Type() != Client {
+		t.Errorf("client: status %d, type %s", tr.Status(), tr.Type())
+	}
+
+	ans, smm, err = clientQuery(t, tr, "unknown.corp.")
+	if err != nil || ans == nil || ans.Rcode != dns.RcodeNameError || smm.Status != Complete {
+		t.Errorf("client: want nxdomain, got %v (%d); err? %v", ans, smm.Status, err)
+	}
+}
+
+func TestClientTransportMisbehaves(t *testing.T) {
+	e := newEnterpriseDB()
+	tr, _ := NewClientTransport(e)
+
+	e.boom = true
+	if _, smm, err := clientQuery(t, tr, "intranet.corp."); !errors.Is(err, errClientPanic) || smm.Status != InternalError {
+		t.Errorf("client: panic: want internal error, got %d; err? %v", smm.Status, err)
+	}
+
+	e.boom, e.fail, e.status = false, errors.New("enterprise-db: offline"), NoResponse
+	if _, smm, err := clientQuery(t, tr, "intranet.corp."); err != e.fail || smm.Status != NoResponse {
+		t.Errorf("client: fail: want no response, got %d; err? %v", smm.Status, err)
+	}
+	e.status = Complete // not a failed status
+	if _, smm, _ := clientQuery(t, tr, "intranet.corp."); smm.Status != TransportError {
+		t.Errorf("client: fail: want transport error, got %d", smm.Status)
+	}
+}
+
+func TestClientTransportBounded(t *testing.T) {
+	defer func(d time.Duration) { clientTimeout = d }(clientTimeout)
+	clientTimeout = 50 * time.Millisecond
+
+	e := newEnterpriseDB()
+	e.wait = make(chan struct{})
+	tr, _ := NewClientTransport(e)
+
+	// slow queries time out, but hold on to their slots
+	var wg sync.WaitGroup
+	for range maxClientQueries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, smm, err := clientQuery(t, tr, "intranet.corp."); !errors.Is(err, errClientTimeout) || smm.Status != NoResponse {
+				t.Errorf("client: slow: want no response, got %d; err? %v", smm.Status, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	start := time.Now()
+	if _, smm, err := clientQuery(t, tr, "intranet.corp."); !errors.Is(err, errClientBusy) || smm.Status != SendFailed {
+		t.Errorf("client: busy: want send failed, got %d; err? %v", smm.Status, err)
+	}
+	if d := time.Since(start); d >= clientTimeout {
+		t.Errorf("client: busy: want fail fast, took %s", d)
+	}
+
+	close(e.wait)
+	time.Sleep(clientTimeout) // slots are let go of
+	if _, smm, err := clientQuery(t, tr, "intranet.corp."); err != nil || smm.Status != Complete {
+		t.Errorf("client: want answer, got %d; err? %v", smm.Status, err)
+	}
+}
+
+func TestClientTransportResolves(t *testing.T) {
+	tr, _ := NewClientTransport(newEnterpriseDB())
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, &tidListener{tid: tr.ID()}, nil).(*resolver)
+	if !r.Add(tr) {
+		t.Fatal("client: not added")
+	}
+	if got, err := r.Get(tr.ID()); err != nil || got != tr {
+		t.Fatalf("client: get: %v; err? %v", got, err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("intranet.corp.", dns.TypeA)
+	qb, _ := q.Pack()
+	res, err := r.Forward(qb)
+	ans := xdns.AsMsg(res)
+	if err != nil || ans == nil || len(ans.Answer) != 1 {
+		t.Fatalf("client: forward: want one answer, got %v; err? %v", ans, err)
+	}
+	if a, ok := ans.Answer[0].(*dns.A); !ok || a.A.String() != "10.1.2.3" {
+		t.Errorf("client: forward: want 10.1.2.3, got %s", ans.Answer[0])
+	}
+}
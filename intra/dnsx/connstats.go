@@ -0,0 +1,239 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+)
+
+// reasons conns of a transport are closed; see: ConnStats.Closed
+const (
+	ConnIdle   = "idle"   // unused for long, and so, closed by its pool
+	ConnError  = "error"  // on errors of queries sent over it
+	ConnGoaway = "goaway" // by the server, while in use (ex: http2 GOAWAY)
+	ConnDone   = "done"   // after its only query, by transports that do not pool conns
+)
+
+// reuse ratios are alerted on over windows of as many queries
+const reusewindow = 64
+
+// ConnReporter is a Transport that keeps ConnStats of conns to its servers.
+type ConnReporter interface {
+	// ConnStats returns the stats of its conns; never nil.
+	ConnStats() *ConnStats
+}
+
+// ReuseAlert is called with the percent of queries sent over reused conns
+// in the window of reusewindow queries just past, and in the one before it
+// (or -1, if none).
+type ReuseAlert func(pct, prev int)
+
+// ConnStats counts conns a transport opens, reuses, and closes (by reason);
+// the zero value is ready for use.
+type ConnStats struct {
+	opened  atomic.Int64
+	reused  atomic.Int64 // queries sent over reused conns
+	queries atomic.Int64 // queries sent over any conn
+	idle    atomic.Int64
+	errs    atomic.Int64
+	goaway  atomic.Int64
+	done    atomic.Int64
+
+	mu     sync.Mutex // protects all below
+	winq   int        // queries in the current window
+	winr   int        // of which, over reused conns
+	prev   int        // reuse percent of the previous window, if primed
+	primed bool       // if a window has passed
+	onwin  ReuseAlert // may be nil
+}
+
+// OnWindow sets f to be called (in its own goroutine) once every
+// reusewindow queries; see: ReuseAlert.
+func (s *ConnStats) OnWindow(f ReuseAlert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onwin = f
+}
+
+// Got counts a query sent over a conn, which is new unless reused.
+func (s *ConnStats) Got(reused bool) {
+	s.queries.Add(1)
+	if reused {
+		s.reused.Add(1)
+	} else {
+		s.opened.Add(1)
+	}
+
+	s.mu.Lock()
+	s.winq++
+	if reused {
+		s.winr++
+	}
+	if s.winq < reusewindow {
+		s.mu.Unlock()
+		return
+	}
+	pct, prev := s.winr*100/s.winq, -1
+	if s.primed {
+		prev = s.prev
+	}
+	s.winq, s.winr, s.prev, s.primed = 0, 0, pct, true
+	f := s.onwin
+	s.mu.Unlock()
+
+	if f != nil {
+		go f(pct, prev)
+	}
+}
+
+// Closed counts a conn closed for reason (ConnIdle, ConnError, ConnGoaway,
+// ConnDone).
+func (s *ConnStats) Closed(reason string) {
+	switch reason {
+	case ConnIdle:
+		s.idle.Add(1)
+	case ConnError:
+		s.errs.Add(1)
+	case ConnGoaway:
+		s.goaway.Add(1)
+	case ConnDone:
+		s.done.Add(1)
+	default:
+		log.W("dns: conns: unknown close reason %s", reason)
+	}
+}
+
+// ReusePct returns the percent of all queries sent over reused conns, or -1
+// if none were sent.
+func (s *ConnStats) ReusePct() int {
+	q := s.queries.Load()
+	if q <= 0 {
+		return -1
+	}
+	return int(s.reused.Load() * 100 / q)
+}
+
+// String returns "opened=n;reused=n;queries=n;reusepct=p;closed=idle:n,error:n,goaway:n,done:n".
+func (s *ConnStats) String() string {
+	return fmt.Sprintf("opened=%d;reused=%d;queries=%d;reusepct=%d;closed=%s:%d,%s:%d,%s:%d,%s:%d",
+		s.opened.Load(), s.reused.Load(), s.queries.Load(), s.ReusePct(),
+		ConnIdle, s.idle.Load(), ConnError, s.errs.Load(), ConnGoaway, s.goaway.Load(), ConnDone, s.done.Load())
+}
+
+// Track returns c wrapped so that its close is counted, with the reason
+// told apart by when and how it is closed: conns unused for nearly idle
+// (the idle timeout of their pool) are ConnIdle; those that saw errors (or
+// are marked, see: MarkConnErr) are ConnError; all others, closed while in
+// use, and so, by the server (ex: after an http2 GOAWAY), are ConnGoaway.
+func (s *ConnStats) Track(c net.Conn, idle time.Duration) net.Conn {
+	if c == nil {
+		return c
+	}
+	tc := &trackedconn{Conn: c, s: s, idle: idle}
+	tc.used.Store(time.Now().UnixNano())
+	return tc
+}
+
+// MarkConnErr marks c (as got from Track; or a tls.Conn over one) as closed
+// on errors of queries sent over it, if it is not closed already.
+func MarkConnErr(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if tc, ok := c.(*trackedconn); ok {
+		tc.failed.Store(true)
+	}
+}
+
+type trackedconn struct {
+	net.Conn
+	s      *ConnStats
+	idle   time.Duration
+	used   atomic.Int64 // unix nanos of the last read or write
+	failed atomic.Bool  // saw errors
+	closed atomic.Bool
+}
+
+func (c *trackedconn) saw(err error) {
+	c.used.Store(time.Now().UnixNano())
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.failed.Store(true)
+	}
+}
+
+func (c *trackedconn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.saw(err)
+	return n, err
+}
+
+func (c *trackedconn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.saw(err)
+	return n, err
+}
+
+func (c *trackedconn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		since := time.Since(time.Unix(0, c.used.Load()))
+		if c.failed.Load() {
+			c.s.Closed(ConnError)
+		} else if c.idle > 0 && since >= c.idle*9/10 {
+			c.s.Closed(ConnIdle)
+		} else {
+			c.s.Closed(ConnGoaway)
+		}
+	}
+	return c.Conn.Close()
+}
+
+// watchConns alerts the listener on drops in reuse of conns of t, if it
+// counts them; see: SetConnReuseAlert.
+func (r *resolver) watchConns(t Transport) {
+	cr, ok := t.(ConnReporter)
+	if !ok {
+		return
+	}
+	id := t.ID()
+	cr.ConnStats().OnWindow(func(pct, prev int) {
+		below := int(r.reuse.Load())
+		if below <= 0 || pct >= below || (prev >= 0 && prev < below) {
+			return
+		}
+		log.W("dns: conns: %s: reuse %d%% < %d%%; prev %d%%", id, pct, below, prev)
+		if r.listener != nil {
+			r.listener.OnDNSConnReuse(id, pct)
+		}
+	})
+}
+
+// SetConnReuseAlert implements x.DNSConnStats.
+func (r *resolver) SetConnReuseAlert(pct int) {
+	r.reuse.Store(int32(max(pct, 0)))
+	log.I("dns: conns: reuse alert below %d%%", pct)
+}
+
+// ConnStats implements x.DNSConnStats.
+func (r *resolver) ConnStats(id string) string {
+	r.RLock()
+	t, ok := r.transports[id]
+	r.RUnlock()
+
+	if cr, ok2 := t.(ConnReporter); ok && ok2 {
+		return cr.ConnStats().String()
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// reuseTransport is a fakeTransport that counts its conns.
+type reuseTransport struct {
+	fakeTransport
+	conns *ConnStats
+}
+
+func (t reuseTransport) ID() string            { return "reuse" }
+func (t reuseTransport) ConnStats() *ConnStats { return t.conns }
+
+// reuseListener records OnDNSConnReuse.
+type reuseListener struct {
+	tidListener
+	alerts chan int
+}
+
+func (l *reuseListener) OnDNSConnReuse(_ string, pct int) { l.alerts <- pct }
+
+func TestConnStatsReuseAlert(t *testing.T) {
+	l := &reuseListener{alerts: make(chan int, 4)}
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, l, nil).(*resolver)
+	tr := reuseTransport{conns: new(ConnStats)}
+	r.Add(tr)
+	r.SetConnReuseAlert(50)
+
+	expectAlert := func(what string, want int) {
+		t.Helper()
+		select {
+		case got := <-l.alerts:
+			if want < 0 || got != want {
+				t.Errorf("conns: %s: want alert %d, got %d", what, want, got)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want >= 0 {
+				t.Errorf("conns: %s: want alert %d, got none", what, want)
+			}
+		}
+	}
+	window := func(reused int) {
+		for i := range reusewindow {
+			tr.conns.Got(i < reused)
+		}
+	}
+
+	window(reusewindow) // all reused
+	expectAlert("healthy", -1)
+	window(reusewindow / 4) // 25%
+	expectAlert("drop", 25)
+	window(0) // still low; alerted once per drop
+	expectAlert("low", -1)
+	window(reusewindow)
+	window(reusewindow / 8)
+	expectAlert("drop again", 12)
+
+	if s := r.ConnStats(tr.ID()); !strings.Contains(s, "queries=320;reusepct=") {
+		t.Errorf("conns: status %q", s)
+	}
+	if s := r.ConnStats("missing"); len(s) > 0 {
+		t.Errorf("conns: missing transport: status %q", s)
+	}
+}
+
+func TestConnStatsTrack(t *testing.T) {
+	s := new(ConnStats)
+	conn := func(idle time.Duration) net.Conn {
+		a, b := net.Pipe()
+		t.Cleanup(func() { b.Close() })
+		go func() { _, _ = b.Write([]byte("x")) }()
+		c := s.Track(a, idle)
+		_, _ = c.Read(make([]byte, 1))
+		return c
+	}
+
+	conn(time.Hour).Close() // closed while in use
+	c := conn(time.Hour)
+	MarkConnErr(c)
+	c.Close()
+	c = conn(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.Close()
+	c.Close() // counted once
+
+	want := "closed=idle:1,error:1,goaway:1,done:0"
+	if got := s.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("conns: want %s, got %s", want, got)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("conns: closed: want %v, got %v", io.ErrClosedPipe, err)
+	}
+}
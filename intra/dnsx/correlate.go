@@ -0,0 +1,99 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// answers with more records than this are taken to be from a buggy (or
+// malicious) upstream; no sane rrset is anywhere near as big
+const maxAnswerRRs = 512
+
+var (
+	errMismatchedAnswer = errors.New("answer does not match query")
+	errTooManyAnswers   = errors.New("answer has too many records")
+)
+
+// correlate returns ans as an answer to q: with q's id, opcode, and the
+// case of its question (dns 0x20), and with the response (QR) bit set;
+// whatever upstreams, caches, blocklists, alg, or dns64 did to it. ans
+// that can't be unpacked (ex: its compression pointers loop), or is for
+// some other question, is dropped, and errMismatchedAnswer is returned;
+// as is ans with more than maxAnswerRRs answers, with errTooManyAnswers.
+// ans is always re-packed, and so, its compression normalized; upstream
+// bytes are never passed through.
+func correlate(q *dns.Msg, ans []byte) ([]byte, error) {
+	if q == nil || len(ans) <= 0 {
+		return ans, nil
+	}
+	a, err := unpack(ans)
+	if err != nil {
+		log.W("dns: correlate: %d: bad answer: %v", q.Id, err)
+		return nil, errMismatchedAnswer
+	}
+	if n := len(a.Answer); n > maxAnswerRRs {
+		log.W("dns: correlate: %d: %d answers > %d", q.Id, n, maxAnswerRRs)
+		return nil, errTooManyAnswers
+	}
+	// answers to queries sans questions (FORMERR) may have none
+	if len(a.Question) > 0 && len(q.Question) > 0 {
+		aq, qq := &a.Question[0], &q.Question[0]
+		if aq.Qtype != qq.Qtype || aq.Qclass != qq.Qclass || !strings.EqualFold(aq.Name, qq.Name) {
+			log.W("dns: correlate: %d: q(%s/%d) != a(%s/%d) (id %d)",
+				q.Id, qq.Name, qq.Qtype, aq.Name, aq.Qtype, a.Id)
+			return nil, errMismatchedAnswer
+		}
+		aq.Name = qq.Name
+	}
+
+	if a.Id != q.Id {
+		log.D("dns: correlate: %s: id %d => %d", qname(q), a.Id, q.Id)
+	}
+	a.Id = q.Id
+	a.Opcode = q.Opcode
+	a.Response = true
+	a.Compress = true
+	return a.Pack()
+}
+
+// fitUDP truncates ans (setting TC) to the udp payload size q advertises
+// over edns0, or to 512 bytes, if none; and returns it as-is if it fits,
+// or if either can't be unpacked.
+func fitUDP(q, ans []byte) []byte {
+	limit := dns.MinMsgSize
+	if len(ans) <= limit {
+		return ans
+	}
+	qmsg := xdns.AsMsg(q)
+	if qmsg == nil {
+		return ans
+	}
+	if edns0 := qmsg.IsEdns0(); edns0 != nil {
+		limit = max(int(edns0.UDPSize()), dns.MinMsgSize)
+	}
+	if len(ans) <= limit {
+		return ans
+	}
+	a := xdns.AsMsg(ans)
+	if a == nil {
+		return ans
+	}
+	a.Truncate(limit) // sets TC, if it had to drop records
+	b, err := a.Pack()
+	if err != nil {
+		log.W("dns: udp: truncate %s to %d: %v", qname(qmsg), limit, err)
+		return ans
+	}
+	log.D("dns: udp: truncated %s: %d => %d (limit %d); tc? %t", qname(qmsg), len(ans), len(b), limit, a.Truncated)
+	return b
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// liar answers queries with ids, flags, and (for every 8th) questions of its own.
+type liar struct{ fakeTransport }
+
+func (liar) ID() string { return "liar" }
+
+func (liar) Query(_ string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	msg := xdns.AsMsg(q)
+	ans := new(dns.Msg)
+	ans.SetReply(msg)
+	ans.Answer = []dns.RR{xdns.MakeARecord(msg.Question[0].Name, "1.2.3.4", 60)}
+	ans.Id = msg.Id ^ 0x5a5a
+	ans.Response = msg.Id%3 != 0
+	if msg.Id%8 == 0 {
+		ans.Question[0].Name = "not." + msg.Question[0].Name
+	}
+	smm.Status = Complete
+	return ans.Pack()
+}
+
+type countingListener struct {
+	sync.Mutex
+	bad int
+}
+
+func (*countingListener) OnDNSAdded(string)                                      {}
+func (*countingListener) OnDNSRemoved(string)                                    {}
+func (*countingListener) OnDNSStopped()                                          {}
+func (*countingListener) OnRebind(string, string, bool)                          {}
+func (*countingListener) OnDNSWarmup(string, int64, bool)                        {}
+func (*countingListener) OnDNSCertChange(string, string, string, string)         {}
+func (*countingListener) OnDNSConnReuse(string, int)                             {}
+func (*countingListener) OnDNSDiscovery(string, string, string, string)          {}
+func (*countingListener) OnDNSDivergence(string, string, string, string, string) {}
+func (*countingListener) OnQuery(string, int) *x.DNSOpts                         { return &x.DNSOpts{TIDCSV: "liar"} }
+func (l *countingListener) OnResponse(smm *x.DNSSummary) {
+	if smm.Status == BadResponse {
+		l.Lock()
+		l.bad++
+		l.Unlock()
+	}
+}
+
+func (l *countingListener) badResponses() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.bad
+}
+
+func TestForwardCorrelates(t *testing.T) {
+	l := new(countingListener)
+	r := NewResolver("", settings.DefaultTunMode(), liar{}, l, nil).(*resolver)
+	r.Lock()
+	r.transports["liar"] = liar{}
+	r.Unlock()
+
+	const n = 4096
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	dropped := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("q"+strconv.Itoa(int(id))+".Example.com.", dns.TypeA)
+			q.Id = id
+			qb, _ := q.Pack()
+
+			res, err := r.Forward(qb)
+			if id%8 == 0 {
+				if len(res) > 0 || !errors.Is(err, errMismatchedAnswer) {
+					t.Errorf("correlate: %d: want drop, got %d bytes; err? %v", id, len(res), err)
+				}
+				mu.Lock()
+				dropped++
+				mu.Unlock()
+				return
+			}
+			ans := xdns.AsMsg(res)
+			if err != nil || ans == nil {
+				t.Errorf("correlate: %d: no answer; err? %v", id, err)
+				return
+			}
+			if ans.Id != id || !ans.Response || ans.Opcode != q.Opcode || ans.Question[0].Name != q.Question[0].Name {
+				t.Errorf("correlate: %d: got id %d, qr %t, op %d, %s", id, ans.Id, ans.Response, ans.Opcode, ans.Question[0].Name)
+			}
+		}(uint16(i))
+	}
+	wg.Wait()
+
+	if dropped != n/8 {
+		t.Errorf("correlate: want %d dropped, got %d", n/8, dropped)
+	}
+	// summaries are sent to the listener asynchronously
+	for i := 0; i < 100 && l.badResponses() < dropped; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bad := l.badResponses(); bad != dropped {
+		t.Errorf("correlate: want %d BadResponse summaries, got %d", dropped, bad)
+	}
+}
+
+func TestCorrelateAnswered(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("eXaMpLe.com.", dns.TypeAAAA)
+	q.Id = 4242
+
+	// ex: refused, or rcode answers synthesized from q; already apt
+	refused, _ := xdns.RefusedResponseFromMessage(q)
+	rb, _ := refused.Pack()
+	if b, err := correlate(q, rb); err != nil || xdns.AsMsg(b).Rcode != refused.Rcode || &b[0] == &rb[0] {
+		t.Errorf("correlate: want refused re-packed; err? %v", err)
+	}
+
+	// ex: cached, dns64, or alg answers for the normalized qname, with the upstream's id
+	a := new(dns.Msg)
+	a.SetQuestion("example.com.", dns.TypeAAAA)
+	a.Id = 7
+	ab, _ := a.Pack()
+	b, err := correlate(q, ab)
+	ans := xdns.AsMsg(b)
+	if err != nil || ans == nil || ans.Id != q.Id || !ans.Response || ans.Question[0].Name != q.Question[0].Name {
+		t.Errorf("correlate: want fixed answer; got %v; err? %v", ans, err)
+	}
+
+	a.SetQuestion("example.com.", dns.TypeA)
+	ab, _ = a.Pack()
+	if b, err := correlate(q, ab); len(b) > 0 || err == nil {
+		t.Errorf("correlate: want A answer to AAAA q dropped; err? %v", err)
+	}
+	if _, err := correlate(q, []byte{1, 2, 3}); err == nil {
+		t.Error("correlate: want garbage dropped")
+	}
+}
+
+// crafter answers queries for loop.* with compression pointers that loop,
+// for deep.* with names that are chains of pointers, for big.* with way
+// too many records, and for the rest, with many (but sane) records.
+type crafter struct{ fakeTransport }
+
+func (crafter) ID() string { return "crafter" }
+
+func (crafter) Query(_ string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	msg := xdns.AsMsg(q)
+	qname := msg.Question[0].Name
+	ans := new(dns.Msg)
+	ans.SetReply(msg)
+	smm.Status = Complete
+	switch {
+	case strings.HasPrefix(qname, "loop."), strings.HasPrefix(qname, "deep."):
+		return craftPointers(msg, strings.HasPrefix(qname, "loop.")), nil
+	case strings.HasPrefix(qname, "big."):
+		ans.Answer = manyA(qname, maxAnswerRRs+1)
+	default:
+		ans.Answer = manyA(qname, 100)
+	}
+	return ans.Pack()
+}
+
+func manyA(name string, n int) []dns.RR {
+	rrs := make([]dns.RR, 0, n)
+	for i := range n {
+		rrs = append(rrs, xdns.MakeARecord(name, fmt.Sprintf("10.0.%d.%d", i/256, i%256), 60))
+	}
+	return rrs
+}
+
+// craftPointers answers q with 32 A records, each owned by "a." and a
+// pointer to the name of the one before (the first, to the question); or,
+// if loop, with one owned by a pointer to itself.
+func craftPointers(q *dns.Msg, loop bool) []byte {
+	qb, _ := q.Pack()
+	b := slices.Clone(qb) // q has no edns0
+	b[2] |= 0x80          // qr
+	rdata := []byte{0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 0, 0, 1}
+	if loop {
+		at := len(b)
+		b = append(b, 0xc0|byte(at>>8), byte(at))
+		binary.BigEndian.PutUint16(b[6:], 1) // ancount
+		return append(b, rdata...)
+	}
+	prev := 12 // qname
+	for range 32 {
+		at := len(b)
+		b = append(b, 1, 'a', 0xc0|byte(prev>>8), byte(prev))
+		b = append(b, rdata...)
+		prev = at
+	}
+	binary.BigEndian.PutUint16(b[6:], 32) // ancount
+	return b
+}
+
+// wire unpacks b, so that Len and Pack match b as sent; nil if b is bad.
+func wire(b []byte) *dns.Msg {
+	m := xdns.AsMsg(b)
+	if m != nil {
+		m.Compress = true
+	}
+	return m
+}
+
+type bufwc struct{ bytes.Buffer }
+
+func (*bufwc) Close() error { return nil }
+
+func TestForwardValidates(t *testing.T) {
+	l := &tidListener{tid: "crafter"}
+	r := NewResolver("", settings.DefaultTunMode(), crafter{}, l, nil).(*resolver)
+	r.Lock()
+	r.transports["crafter"] = crafter{}
+	r.Unlock()
+
+	query := func(name string, edns uint16) []byte {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		if edns > 0 {
+			q.SetEdns0(edns, false)
+		}
+		qb, _ := q.Pack()
+		return qb
+	}
+	// udp answers as written back to the client over dnsudp; tcp over dnstcp
+	udp := func(q []byte) *dns.Msg {
+		var w bufwc
+		_ = r.dnsudp(q, "", "", &w)
+		return wire(w.Bytes())
+	}
+	tcp := func(q []byte) *dns.Msg {
+		var w bufwc
+		_ = r.dnstcp(q, "", "", &w)
+		if w.Len() < 2 {
+			return nil
+		}
+		return wire(w.Bytes()[2:])
+	}
+
+	for i, name := range []string{"loop.example.", "big.example."} {
+		if a := udp(query(name, 0)); a != nil {
+			t.Errorf("validate: udp: %s: want dropped; got %d answers", name, len(a.Answer))
+		}
+		if a := tcp(query(name, 0)); a != nil {
+			t.Errorf("validate: tcp: %s: want dropped; got %d answers", name, len(a.Answer))
+		}
+		want := 2 * (i + 1)
+		for j := 0; j < 100 && l.badResponses() < want; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if bad := l.badResponses(); bad != want {
+			t.Errorf("validate: %s: want %d BadResponse summaries, got %d", name, want, bad)
+		}
+	}
+
+	// pointers, however convoluted upstream, are re-done by miekg/dns
+	deep := query("deep.example.", 0)
+	res, err := r.Forward(deep)
+	if norm, _ := wire(res).Pack(); err != nil || !bytes.Equal(res, norm) {
+		t.Errorf("validate: deep: not normalized; err? %v", err)
+	}
+	if a := tcp(deep); a == nil || len(a.Answer) != 32 || strings.Count(a.Answer[31].Header().Name, "a.") != 32 {
+		t.Errorf("validate: tcp: deep: got %v", a)
+	}
+	if a := udp(deep); a == nil || !a.Truncated || a.Len() > dns.MinMsgSize {
+		t.Errorf("validate: udp: deep: want truncated; got %v", a)
+	}
+
+	// 100 A records need ~1.7k, and so, are truncated to fit 512 bytes
+	// (sans edns0) over udp; but not over tcp, nor if the client has room
+	if a := udp(query("fat.example.", 0)); a == nil || !a.Truncated || a.Len() > dns.MinMsgSize {
+		t.Errorf("validate: udp: want truncated to %d; got %v", dns.MinMsgSize, a)
+	}
+	if a := udp(query("fat2.example.", 1232)); a == nil || !a.Truncated || a.Len() > 1232 {
+		t.Errorf("validate: udp: want truncated to 1232; got %v", a)
+	}
+	if a := udp(query("fat3.example.", 4096)); a == nil || a.Truncated || len(a.Answer) != 100 {
+		t.Errorf("validate: udp: edns0 4096: want all 100; got %v", a)
+	}
+	if a := tcp(query("fat4.example.", 0)); a == nil || a.Truncated || len(a.Answer) != 100 {
+		t.Errorf("validate: tcp: want all 100; got %v", a)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// verdicts of designated resolvers; see: x.DNSListener.OnDNSDiscovery
+const (
+	ddrFound     = "found"
+	ddrValidated = "validated"
+	ddrRejected  = "rejected"
+)
+
+var (
+	errDDRNoServer    = errors.New("ddr: ip of system dns unknown")
+	errDDRNoAnswer    = errors.New("ddr: no designated resolvers")
+	errDDRUnsupported = errors.New("ddr: neither doh (h2, dohpath) nor dot")
+	errDDRNoCerts     = errors.New("ddr: transport does not check certs")
+)
+
+// DesignatedMaker makes an encrypted transport of id to the resolver at
+// url ("https://host:port/path" for DoH, "tls://host:port" for DoT), which
+// is reachable at ips (may be empty).
+type DesignatedMaker func(id, url string, ips []string) (Transport, error)
+
+// ddrresult is the verdict on a designated resolver.
+type ddrresult struct {
+	url     string
+	verdict string // ddrValidated, ddrRejected
+	why     string // if rejected
+}
+
+// ddr discovers designated resolvers of System; rfc9462.
+type ddr struct {
+	sync.Mutex                 // protects all fields below; serializes adds
+	off        atomic.Bool     // discovery is on by default
+	gen        core.Gen        // of discoveries; superseded as System changes
+	maker      DesignatedMaker // may be nil
+	server     netip.Addr      // of System, of the last discovery
+	results    []ddrresult     // of the last discovery
+	at         time.Time       // of the last discovery
+	err        error           // of the last discovery, if it found none
+}
+
+func newDDR() *ddr {
+	return &ddr{}
+}
+
+// Implements Resolver
+func (r *resolver) SetDesignatedMaker(m DesignatedMaker) {
+	r.ddr.Lock()
+	r.ddr.maker = m
+	r.ddr.Unlock()
+}
+
+// Implements Resolver
+func (r *resolver) SetDDR(on bool) {
+	d := r.ddr
+	prev := !d.off.Swap(!on)
+	log.I("dns: ddr: on? %t => %t", prev, on)
+	if prev == on {
+		return
+	}
+	if on {
+		go r.rediscover()
+		return
+	}
+	d.Lock()
+	d.gen.Next() // discoveries in flight must not add Designated
+	d.Unlock()
+	r.Remove(Designated)
+}
+
+// Implements Resolver
+func (r *resolver) DDRStatus() string {
+	d := r.ddr
+	d.Lock()
+	defer d.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "on=%t;server=%s;at=%s", !d.off.Load(), d.server, d.at.UTC().Format(time.RFC3339))
+	if d.err != nil {
+		fmt.Fprintf(&b, ";err=%v", d.err)
+	}
+	b.WriteString("\n")
+	for _, res := range d.results {
+		fmt.Fprintf(&b, "%s=%s;%s\n", res.url, res.verdict, res.why)
+	}
+	return b.String()
+}
+
+// designated returns Designated (or its CT) in place of System (or its
+// CT), if it was discovered and if ddr is on; nil otherwise.
+func (r *resolver) designated(id string) Transport {
+	if (id != System && id != CT+System) || r.ddr == nil || r.ddr.off.Load() {
+		return nil
+	}
+	did := Designated
+	if id == CT+System {
+		did = CT + Designated
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return r.transports[did]
+}
+
+// rediscover discovers resolvers designated by System, if any.
+func (r *resolver) rediscover() {
+	r.RLock()
+	sys := r.transports[System]
+	r.RUnlock()
+	if sys != nil {
+		r.discover(sys)
+	}
+}
+
+// discover queries sys for the resolvers it designates, and adds the first
+// one, in order of priority, that validates as Designated; rfc9462 sec 4.
+// Designated of the previous System (ex: of another network) is removed.
+func (r *resolver) discover(sys Transport) {
+	d := r.ddr
+	if d == nil || sys == nil || r.staging.Load() {
+		return // resolvers being built discover on Restart
+	}
+	d.Lock()
+	gen := d.gen.Next()
+	mk := d.maker
+	d.Unlock()
+
+	r.Remove(Designated)
+	if d.off.Load() || mk == nil {
+		return
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(xdns.DDRName, dns.TypeSVCB)
+	q, err := msg.Pack()
+	if err != nil {
+		d.note(gen, netip.Addr{}, nil, err)
+		return
+	}
+	smm := new(x.DNSSummary)
+	ans, err := sys.Query(Background(NetTypeUDP), q, smm)
+	server, ok := serverOf(smm.Server)
+	if err != nil {
+		d.note(gen, server, nil, err)
+		return
+	} else if !ok {
+		d.note(gen, server, nil, fmt.Errorf("%w: %s", errDDRNoServer, smm.Server))
+		return
+	}
+	ds := xdns.Designations(xdns.AsMsg(ans))
+	if len(ds) <= 0 {
+		d.note(gen, server, nil, errDDRNoAnswer)
+		return
+	}
+
+	results := make([]ddrresult, 0, len(ds))
+	for _, des := range ds {
+		if d.gen.Superseded(gen) {
+			log.I("dns: ddr: #%d superseded by #%d", gen, d.gen.Current())
+			return
+		}
+		url, t, err := r.validate(mk, des, server, q)
+		if len(url) > 0 {
+			r.discovered(server, url, ddrFound, "")
+		}
+		if err != nil {
+			log.W("dns: ddr: %s: %s (%s) rejected: %v", server, url, des.Target, err)
+			results = append(results, ddrresult{url: url, verdict: ddrRejected, why: err.Error()})
+			r.discovered(server, url, ddrRejected, err.Error())
+			continue
+		}
+
+		d.Lock()
+		added := !d.gen.Superseded(gen) && !d.off.Load() && r.Add(t)
+		d.Unlock()
+		if !added {
+			log.I("dns: ddr: %s: %s validated, but not added", server, url)
+			return
+		}
+		log.I("dns: ddr: %s: %s validated; added as %s", server, url, Designated)
+		results = append(results, ddrresult{url: url, verdict: ddrValidated})
+		r.discovered(server, url, ddrValidated, "")
+		break
+	}
+	d.note(gen, server, results, nil)
+}
+
+// validate makes a transport to the designated resolver des of server, and
+// has it answer q, over tls whose leaf cert must cover server's ip.
+func (r *resolver) validate(mk DesignatedMaker, des xdns.Designation, server netip.Addr, q []byte) (string, Transport, error) {
+	url, ok := des.DoH()
+	if !ok {
+		url, ok = des.DoT()
+	}
+	if !ok {
+		return des.Target, nil, errDDRUnsupported
+	}
+	ips := make([]string, 0, len(des.Hints))
+	for _, ip := range des.Hints {
+		ips = append(ips, ip.String())
+	}
+	t, err := mk(Designated, url, ips)
+	if err != nil {
+		return url, nil, err
+	}
+	cc, ok := t.(CertChecker)
+	if !ok {
+		return url, nil, errDDRNoCerts
+	}
+	// verified discovery; rfc9462 sec 4.2
+	cc.CoverIPs(server)
+	if _, err := t.Query(Background(NetTypeUDP), q, new(x.DNSSummary)); err != nil {
+		return url, nil, err
+	}
+	return url, t, nil
+}
+
+// discovered sends the verdict on url, designated by server, to the listener.
+func (r *resolver) discovered(server netip.Addr, url, verdict, why string) {
+	if r.listener != nil {
+		go r.listener.OnDNSDiscovery(server.String(), url, verdict, why)
+	}
+}
+
+// note records results of discovery gen, unless it is superseded.
+func (d *ddr) note(gen uint64, server netip.Addr, results []ddrresult, err error) {
+	if err != nil {
+		log.I("dns: ddr: #%d: %s: %v", gen, server, err)
+	}
+	d.Lock()
+	defer d.Unlock()
+	if !d.gen.Done(gen) {
+		return
+	}
+	d.server = server
+	d.results = results
+	d.at = time.Now()
+	d.err = err
+}
+
+// serverOf returns the ip in addr, as set in x.DNSSummary.Server by
+// System (ex: "system.10.0.0.1:53").
+func serverOf(addr string) (netip.Addr, bool) {
+	addr = strings.TrimPrefix(addr, PrefixFor(System))
+	if ipp, err := netip.ParseAddrPort(addr); err == nil {
+		return ipp.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
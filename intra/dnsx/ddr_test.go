@@ -0,0 +1,192 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// ddrSys is a System transport that designates resolvers in svcb.
+type ddrSys struct {
+	sysTransport
+}
+
+func (t *ddrSys) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	smm.Server = PrefixFor(System) + t.addr
+	return t.sysTransport.Query(network, q, smm)
+}
+
+func newDDRSys(t *testing.T, addr string, svcb ...string) *ddrSys {
+	rrs := make([]dns.RR, 0, len(svcb))
+	for _, s := range svcb {
+		rr, err := dns.NewRR(xdns.DDRName + " 300 IN SVCB " + s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return &ddrSys{sysTransport: sysTransport{
+		fakeTransport: fakeTransport{rrs: func(qname string) []dns.RR {
+			if qname == xdns.DDRName {
+				return rrs
+			}
+			return nil
+		}},
+		addr: addr,
+	}}
+}
+
+// ddrTransport is a designated resolver; its handshakes fail with err.
+type ddrTransport struct {
+	fakeTransport
+	url    string
+	mu     sync.Mutex
+	covers []netip.Addr
+	err    error
+}
+
+func (*ddrTransport) ID() string         { return Designated }
+func (*ddrTransport) Type() string       { return DOH }
+func (t *ddrTransport) GetAddr() string  { return t.url }
+func (*ddrTransport) CertStatus() string { return "" }
+func (t *ddrTransport) CoverIPs(ips ...netip.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.covers = ips
+}
+func (*ddrTransport) SetCertChecks(bool, int, bool, CertAlert) error { return nil }
+
+func (t *ddrTransport) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.fakeTransport.Query(network, q, smm)
+}
+
+// ddrListener records OnDNSDiscovery.
+type ddrListener struct {
+	tidListener
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *ddrListener) OnDNSDiscovery(server, url, verdict, _ string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, server+" "+url+" "+verdict)
+}
+
+func (l *ddrListener) seen() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func waitDesignated(t *testing.T, r *resolver, want bool) Transport {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		d, _ := r.transportFor(Designated)
+		// results are noted once Designated is added
+		if (d != nil) == want && (!want || strings.Contains(r.DDRStatus(), ddrValidated)) {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ddr: designated? %t; want %t", d != nil, want)
+		}
+	}
+}
+
+func TestDDR(t *testing.T) {
+	l := &ddrListener{}
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, l, new(sysNatPt)).(*resolver)
+
+	errUncoveredTest := errors.New("leaf cert covers none of the ips")
+	var mu sync.Mutex
+	made := make(map[string]*ddrTransport)
+	r.SetDesignatedMaker(func(id, url string, ips []string) (Transport, error) {
+		dt := &ddrTransport{fakeTransport: fakeTransport{rrs: func(string) []dns.RR { return nil }}, url: url}
+		if strings.Contains(url, "uncovered") {
+			dt.err = errUncoveredTest
+		}
+		mu.Lock()
+		made[url] = dt
+		mu.Unlock()
+		return dt, nil
+	})
+
+	sys := newDDRSys(t, "10.0.0.1:53",
+		`3 h3.example. alpn=h3 dohpath=/dns-query{?dns}`,
+		`1 uncovered.example. alpn=h2 dohpath=/dns-query{?dns}`,
+		`2 dot.example. alpn=dot ipv4hint=10.0.0.2`,
+	)
+	r.Add(sys)
+
+	const dotURL, badURL = "tls://dot.example:853", "https://uncovered.example:443/dns-query"
+	d := waitDesignated(t, r, true)
+	mu.Lock()
+	dt := made[dotURL]
+	_, triedh3 := made["https://h3.example:443/dns-query"]
+	mu.Unlock()
+	if d != dt || dt == nil {
+		t.Fatalf("ddr: designated %v; want %s", d, dotURL)
+	}
+	if triedh3 {
+		t.Errorf("ddr: h3 only resolver made")
+	}
+	if len(dt.covers) != 1 || dt.covers[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("ddr: covers %v; want 10.0.0.1", dt.covers)
+	}
+	if got, _ := r.transportFor(System); got != dt {
+		t.Errorf("ddr: System => %v; want designated", got)
+	}
+	if got, _ := r.transportFor(CT + System); got == nil || got.ID() != CT+Designated {
+		t.Errorf("ddr: CT+System => %v; want CT+Designated", got)
+	}
+
+	st := r.DDRStatus()
+	for _, want := range []string{"on=true;server=10.0.0.1", badURL + "=rejected;" + errUncoveredTest.Error(), dotURL + "=validated"} {
+		if !strings.Contains(st, want) {
+			t.Errorf("ddr: status %q; want %q", st, want)
+		}
+	}
+	time.Sleep(10 * time.Millisecond) // listener is called async
+	events := strings.Join(l.seen(), "\n")
+	for _, want := range []string{"10.0.0.1 " + badURL + " rejected", "10.0.0.1 " + dotURL + " found", "10.0.0.1 " + dotURL + " validated"} {
+		if !strings.Contains(events, want) {
+			t.Errorf("ddr: events %q; want %q", events, want)
+		}
+	}
+
+	// a network with no designated resolvers drops the previous one
+	r.Add(newDDRSys(t, "10.1.0.1:53"))
+	waitDesignated(t, r, false)
+
+	r.SetDDR(false)
+	r.Add(sys)
+	time.Sleep(50 * time.Millisecond)
+	if d, _ := r.transportFor(Designated); d != nil {
+		t.Errorf("ddr: off, but designated")
+	}
+	if got, _ := r.transportFor(System); got != sys {
+		t.Errorf("ddr: off: System => %v", got)
+	}
+
+	r.SetDDR(true) // rediscovers
+	waitDesignated(t, r, true)
+	r.SetDDR(false)
+	waitDesignated(t, r, false)
+}
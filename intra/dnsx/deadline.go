@@ -0,0 +1,149 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// separates transport id from its timeout hint in DNSOpts.TIDCSV
+	// ex: "Preferred|1500" is Preferred with a 1.5s deadline
+	hintsep = "|"
+	// min timeout hint; lower hints are raised to this
+	mintimeouthint = 100 * time.Millisecond
+	// max timeout hint; higher hints are lowered to this
+	maxtimeouthint = 30 * time.Second
+)
+
+var errQueryDeadline = errors.New("query deadline exceeded")
+
+// splitTimeoutHint splits tid into a transport id and a timeout hint, if any.
+func splitTimeoutHint(tid string) (id string, hint time.Duration) {
+	id, ms, ok := strings.Cut(tid, hintsep)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(ms))
+	if err != nil || n <= 0 {
+		log.W("dns: pref: bad timeout hint %s for %s", ms, id)
+		return id, 0
+	}
+	hint = time.Duration(n) * time.Millisecond
+	return id, min(max(hint, mintimeouthint), maxtimeouthint)
+}
+
+// ContextQuerier is a Transport whose queries may be cancelled.
+type ContextQuerier interface {
+	// QueryContext is Query, which gives up on q as soon as ctx is done.
+	QueryContext(ctx context.Context, network string, q []byte, summary *x.DNSSummary) ([]byte, error)
+}
+
+// queryContext sends q over t, which gives up on q once ctx is done, if t
+// is a ContextQuerier; or which sends q as-is, if not.
+func queryContext(ctx context.Context, t Transport, network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	if c, ok := t.(ContextQuerier); ok {
+		return c.QueryContext(ctx, network, q, smm)
+	}
+	return t.Query(network, q, smm)
+}
+
+// cancellable returns true if queries sent over t, and over the transports
+// it wraps, if any, give up as soon as their ctx is done.
+func cancellable(t Transport) bool {
+	for {
+		switch w := t.(type) {
+		case *faultguard:
+			t = w.Transport
+		case *limitguard:
+			t = w.Transport
+		case *ctransport:
+			t = w.Transport
+		default:
+			_, ok := t.(ContextQuerier)
+			return ok
+		}
+	}
+}
+
+// deadlineguard is a Transport that cancels queries still unanswered at
+// the deadline (or abandons them, if they cannot be cancelled; see:
+// ContextQuerier), and answers them with SERVFAIL.
+type deadlineguard struct {
+	Transport
+	deadline time.Time
+}
+
+var _ Transport = (*deadlineguard)(nil)
+
+// withDeadline returns t wrapped in a deadlineguard, or t as-is if
+// timeout is not set. The deadline is shared by all queries sent over
+// the returned transport (ex: dns64 queries), and starts counting now.
+func withDeadline(t Transport, timeout time.Duration) Transport {
+	if t == nil || timeout <= 0 {
+		return t
+	}
+	return &deadlineguard{Transport: t, deadline: time.Now().Add(timeout)}
+}
+
+// Implements Transport
+func (d *deadlineguard) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	type res struct {
+		b   []byte
+		err error
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), d.deadline)
+	defer cancel()
+
+	if smm == nil {
+		smm = new(x.DNSSummary)
+	}
+	if cancellable(d.Transport) {
+		b, err := queryContext(ctx, d.Transport, network, q, smm)
+		if err != nil && ctx.Err() != nil { // cancelled
+			return d.expired(q, smm)
+		}
+		return b, err
+	}
+
+	// abandoned queries may write to their summary well after this
+	// fn returns, and so, they are handed a copy of smm instead
+	inner := *smm
+
+	ch := make(chan res, 1)
+	go func() {
+		b, err := d.Transport.Query(network, q, &inner)
+		ch <- res{b, err}
+	}()
+
+	select {
+	case r := <-ch:
+		*smm = inner
+		return r.b, r.err
+	case <-ctx.Done():
+		log.D("dns: deadline: %s abandoned query %s", d.ID(), smm.QName)
+		return d.expired(q, smm)
+	}
+}
+
+// expired answers q, whose deadline passed, with SERVFAIL.
+func (d *deadlineguard) expired(q []byte, smm *x.DNSSummary) ([]byte, error) {
+	smm.Status = NoResponse
+	smm.RCode = dns.RcodeServerFailure
+	log.D("dns: deadline: %s gave up on %s", d.ID(), smm.QName)
+	return xdns.Servfail(q), errQueryDeadline
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// hungTransport never answers; its queries return only once their ctx
+// is done, or, if sent sans ctx, once released.
+type hungTransport struct {
+	fakeTransport
+	release   chan struct{}
+	cancelled atomic.Int32 // queries that gave up on their ctx
+	returned  atomic.Int32 // queries that returned
+}
+
+func newHungTransport() *hungTransport {
+	return &hungTransport{fakeTransport: fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}, release: make(chan struct{})}
+}
+
+func (t *hungTransport) ID() string { return "hung" }
+
+func (t *hungTransport) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	defer t.returned.Add(1)
+	<-t.release
+	return t.fakeTransport.Query(network, q, smm)
+}
+
+func (t *hungTransport) QueryContext(ctx context.Context, network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	defer t.returned.Add(1)
+	select {
+	case <-ctx.Done():
+		t.cancelled.Add(1)
+		smm.Status = NoResponse
+		return nil, ctx.Err()
+	case <-t.release:
+		return t.fakeTransport.Query(network, q, smm)
+	}
+}
+
+// plain hides the ContextQuerier impl of the transport it wraps.
+type plain struct{ Transport }
+
+func deadlineQuery(tb testing.TB, t Transport) (*x.DNSSummary, []byte, error) {
+	tb.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("deadline.example.", dns.TypeA)
+	qb, _ := q.Pack()
+	smm := &x.DNSSummary{QName: "deadline.example."}
+	ans, err := t.Query(NetTypeUDP, qb, smm)
+	return smm, ans, err
+}
+
+func TestDeadlineCancels(t *testing.T) {
+	const d = 100 * time.Millisecond
+	tr := newHungTransport()
+	defer close(tr.release)
+
+	ls := newQueryLimits()
+	ls.set(tr.ID(), 2, 4, time.Second)
+	for name, tx := range map[string]Transport{
+		"bare":    tr,
+		"limited": ls.wrap(tr, d),
+	} {
+		if !cancellable(tx) {
+			t.Fatalf("deadline: %s: not cancellable", name)
+		}
+		before := tr.cancelled.Load()
+		start := time.Now()
+		smm, ans, err := deadlineQuery(t, withDeadline(tx, d))
+		if took := time.Since(start); took < d || took > d+200*time.Millisecond {
+			t.Errorf("deadline: %s: took %s; want ~%s", name, took, d)
+		}
+		if !errors.Is(err, errQueryDeadline) {
+			t.Errorf("deadline: %s: err %v; want %v", name, err, errQueryDeadline)
+		}
+		if tr.cancelled.Load() != before+1 {
+			t.Errorf("deadline: %s: query not cancelled", name)
+		}
+		if code := ErrCode(smm.Status, smm.RCode); code != x.ErrDNSNoResponse {
+			t.Errorf("deadline: %s: code %s; want %s", name, x.ErrName(code), x.ErrName(x.ErrDNSNoResponse))
+		}
+		if msg := xdns.AsMsg(ans); msg == nil || msg.Rcode != dns.RcodeServerFailure {
+			t.Errorf("deadline: %s: ans %v; want servfail", name, msg)
+		}
+	}
+	if n := tr.returned.Load(); n != 2 {
+		t.Errorf("deadline: %d queries returned; want 2", n)
+	}
+}
+
+func TestDeadlineAbandons(t *testing.T) {
+	const d = 100 * time.Millisecond
+	tr := newHungTransport()
+	tx := plain{tr}
+	if cancellable(tx) {
+		t.Fatal("deadline: plain transport cancellable")
+	}
+
+	start := time.Now()
+	smm, _, err := deadlineQuery(t, withDeadline(tx, d))
+	if took := time.Since(start); took > d+200*time.Millisecond {
+		t.Errorf("deadline: took %s; want ~%s", took, d)
+	}
+	if !errors.Is(err, errQueryDeadline) {
+		t.Errorf("deadline: err %v; want %v", err, errQueryDeadline)
+	}
+	if tr.returned.Load() != 0 {
+		t.Error("deadline: hung query returned")
+	}
+
+	// the abandoned query writes to a copy, and not to smm
+	close(tr.release)
+	for i := 0; tr.returned.Load() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if smm.Status != NoResponse {
+		t.Errorf("deadline: status %d; want %d", smm.Status, NoResponse)
+	}
+}
+
+func TestDeadlineAnswers(t *testing.T) {
+	tr := newHungTransport()
+	close(tr.release)
+	for name, tx := range map[string]Transport{"cancellable": tr, "plain": plain{tr}} {
+		smm, ans, err := deadlineQuery(t, withDeadline(tx, time.Second))
+		if err != nil || smm.Status != Complete || xdns.AsMsg(ans) == nil {
+			t.Errorf("deadline: %s: status %d, err %v", name, smm.Status, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/miekg/dns"
+)
+
+func TestErrCode(t *testing.T) {
+	tests := []struct {
+		status, rcode, want int
+	}{
+		{Complete, dns.RcodeSuccess, x.ErrNone},
+		{Complete, dns.RcodeNameError, x.ErrNone},
+		{Complete, dns.RcodeServerFailure, x.ErrDNSServfail},
+		{SendFailed, dns.RcodeSuccess, x.ErrDNSSendFailed},
+		{NoResponse, dns.RcodeSuccess, x.ErrDNSNoResponse},
+		{BadQuery, dns.RcodeSuccess, x.ErrDNSBadQuery},
+		{BadResponse, dns.RcodeSuccess, x.ErrDNSBadResponse},
+		{InternalError, dns.RcodeSuccess, x.ErrDNSInternal},
+		{TransportError, dns.RcodeSuccess, x.ErrDNSTransport},
+		{ClientError, dns.RcodeSuccess, x.ErrDNSClient},
+		{AuthError, dns.RcodeSuccess, x.ErrDNSAuth},
+		{StrictError, dns.RcodeServerFailure, x.ErrDNSStrict},
+		{-1, dns.RcodeSuccess, x.ErrUnknown},
+	}
+	for _, tc := range tests {
+		if got := ErrCode(tc.status, tc.rcode); got != tc.want {
+			t.Errorf("ErrCode(%d, %d) = %s; want %s", tc.status, tc.rcode, x.ErrName(got), x.ErrName(tc.want))
+		}
+	}
+}
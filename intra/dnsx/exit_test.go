@@ -0,0 +1,105 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func exitQuery(t *testing.T, gw *dnsgateway, exit, qname, realip string) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, dns.TypeA)
+	qb, _ := q.Pack()
+	tr := fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, realip, 60)}
+	}}
+	res, err := gw.q(tr, nil, nil, exit, NetTypeUDP, qb, new(x.DNSSummary))
+	if err != nil {
+		t.Fatalf("exit: %s over %q err %v", qname, exit, err)
+	}
+	ips := xdns.AAnswer(xdns.AsMsg(res))
+	if len(ips) <= 0 {
+		t.Fatalf("exit: %s over %q no alg ip", qname, exit)
+	}
+	return ips[0].AsSlice()
+}
+
+func TestExitAlg(t *testing.T) {
+	gw := NewDNSGateway(&resolver{}, fakeNatPt{})
+	gw.translate(true)
+
+	// uid 10100 exits over wg1; uid 10200 over wg2; both resolve the same name
+	exits := []struct {
+		uid, pid, realip string
+	}{
+		{"10100", "wg1", "10.1.1.1"},
+		{"10200", "wg2", "10.2.2.2"},
+	}
+	algips := make([][]byte, len(exits))
+	for i, e := range exits {
+		exit := exitFor(&x.DNSOpts{UID: e.uid, PID: e.pid}, e.pid)
+		if exit != e.pid {
+			t.Fatalf("exit: uid %s: want %s, got %q", e.uid, e.pid, exit)
+		}
+		algips[i] = exitQuery(t, gw, exit, "cdn.example.", e.realip)
+	}
+	if net.IP(algips[0]).Equal(algips[1]) {
+		t.Fatalf("exit: same alg ip %v over different exits", net.IP(algips[0]))
+	}
+
+	// re-resolving over wg1 does not disturb wg2's mapping, and vice versa
+	for i, e := range exits {
+		if again := exitQuery(t, gw, e.pid, "cdn.example.", e.realip); !net.IP(again).Equal(algips[i]) {
+			t.Errorf("exit: %s: alg ip changed %v => %v", e.pid, net.IP(algips[i]), net.IP(again))
+		}
+	}
+	for i, e := range exits {
+		// realips incl those from the secondary, which is the primary here
+		for _, got := range strings.Split(gw.X(algips[i]), ",") {
+			if got != e.realip {
+				t.Errorf("exit: %s: realips want %s, got %s", e.pid, e.realip, got)
+			}
+		}
+		if got := gw.Exit(algips[i]); got != e.pid {
+			t.Errorf("exit: %s: exit want %s, got %s", e.realip, e.pid, got)
+		}
+	}
+
+	// queries not bound to an exit keep the shared mapping
+	shared := exitQuery(t, gw, "", "cdn.example.", "10.3.3.3")
+	if got := gw.Exit(shared); got != "" {
+		t.Errorf("exit: shared: want no exit, got %s", got)
+	}
+	if net.IP(shared).Equal(algips[0]) || net.IP(shared).Equal(algips[1]) {
+		t.Errorf("exit: shared alg ip %v same as an exit's", net.IP(shared))
+	}
+}
+
+func TestExitFor(t *testing.T) {
+	cases := []struct {
+		opts *x.DNSOpts
+		pid  string
+		want string
+	}{
+		{nil, "wg1", ""},
+		{&x.DNSOpts{}, "wg1", ""},                    // uid unknown
+		{&x.DNSOpts{UID: "10100"}, NetNoProxy, ""},   // local
+		{&x.DNSOpts{UID: "10100"}, NetExitProxy, ""}, // local
+		{&x.DNSOpts{UID: "10100"}, "wg1", "wg1"},
+	}
+	for _, c := range cases {
+		if got := exitFor(c.opts, c.pid); got != c.want {
+			t.Errorf("exitFor(%v, %s): want %q, got %q", c.opts, c.pid, c.want, got)
+		}
+	}
+}
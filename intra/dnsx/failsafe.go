@@ -0,0 +1,86 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	QueryFailOpen   = x.QueryFailOpen
+	QueryFailClosed = x.QueryFailClosed
+)
+
+var errListenerTimeout = errors.New("listener: no answer in time")
+
+// failsafe bounds how long queries wait on the listener's OnQuery, and
+// how those it does not answer in time are resolved; the zero value waits
+// for as long as OnQuery takes.
+type failsafe struct {
+	d      atomic.Int64 // timeout; 0 waits for as long as OnQuery takes
+	policy atomic.Int32 // QueryFailOpen, QueryFailClosed
+	n      atomic.Int64 // queries OnQuery did not answer in time
+}
+
+func (f *failsafe) set(d time.Duration, policy int) {
+	if policy != QueryFailClosed {
+		policy = QueryFailOpen
+	}
+	f.d.Store(int64(max(d, 0)))
+	f.policy.Store(int32(policy))
+	log.I("dns: failsafe: wait %s; policy %d", d, policy)
+}
+
+// adopt carries over settings, and the count, of prev.
+func (f *failsafe) adopt(prev *failsafe) {
+	f.d.Store(prev.d.Load())
+	f.policy.Store(prev.policy.Load())
+	f.n.Store(prev.n.Load())
+}
+
+// onQuery returns l's preferences for qname, and true; or, if l does not
+// answer in time, preferences of the Default transport, and false.
+func (f *failsafe) onQuery(l x.DNSListener, qname string, qtyp int) (*x.DNSOpts, bool) {
+	pref, ok := core.Await(time.Duration(f.d.Load()), func() *x.DNSOpts {
+		return l.OnQuery(qname, qtyp)
+	})
+	if ok {
+		return pref, true
+	}
+	f.n.Add(1)
+	log.W("dns: failsafe: %s: no answer from listener; %s", qname, f.why())
+	return &x.DNSOpts{TIDCSV: CT + Default}, false
+}
+
+// closed returns true if queries OnQuery does not answer in time fail.
+func (f *failsafe) closed() bool {
+	return f.policy.Load() == QueryFailClosed
+}
+
+// why returns the policy, as noted in summaries; see: RouteListenerTimeout
+func (f *failsafe) why() string {
+	if f.closed() {
+		return "servfail"
+	}
+	return "default"
+}
+
+// SetListenerTimeout implements x.DNSFailsafe.
+func (r *resolver) SetListenerTimeout(ms, policy int) {
+	r.failsafe.set(time.Duration(ms)*time.Millisecond, policy)
+}
+
+// ListenerTimeouts implements x.DNSFailsafe.
+func (r *resolver) ListenerTimeouts() int {
+	return int(r.failsafe.n.Load())
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// hungListener never answers OnQuery till released.
+type hungListener struct {
+	countingListener
+	release chan struct{}
+	smms    chan *x.DNSSummary
+}
+
+func newHungListener() *hungListener {
+	return &hungListener{release: make(chan struct{}), smms: make(chan *x.DNSSummary, 8)}
+}
+
+func (l *hungListener) OnQuery(string, int) *x.DNSOpts {
+	<-l.release
+	return &x.DNSOpts{TIDCSV: "fake"}
+}
+
+func (l *hungListener) OnResponse(smm *x.DNSSummary) { l.smms <- smm }
+
+// defaultTransport is a fakeTransport that stands in for Default.
+type defaultTransport struct{ fakeTransport }
+
+func (defaultTransport) ID() string { return Default }
+
+func failsafeQuery(t *testing.T, r *resolver) ([]byte, *x.DNSSummary, error) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("hung.example.", dns.TypeA)
+	qb, _ := q.Pack()
+	done := make(chan struct{})
+	var ans []byte
+	var err error
+	go func() {
+		defer close(done)
+		ans, err = r.Forward(qb)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failsafe: forward deadlocked")
+	}
+	smm := <-r.listener.(*hungListener).smms
+	return ans, smm, err
+}
+
+func TestFailsafeQuery(t *testing.T) {
+	l := newHungListener()
+	defer close(l.release)
+	dtr := defaultTransport{fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}}
+	r := NewResolver("", settings.DefaultTunMode(), dtr, l, nil).(*resolver)
+
+	r.SetListenerTimeout(50, QueryFailOpen)
+	ans, smm, err := failsafeQuery(t, r)
+	if err != nil || xdns.AsMsg(ans) == nil || len(xdns.AsMsg(ans).Answer) != 1 {
+		t.Errorf("failsafe: open: want an answer, got %v", err)
+	}
+	if smm.Route != RouteListenerTimeout || smm.RouteWhy != "default" || smm.Code != x.ErrNone {
+		t.Errorf("failsafe: open: route %s (%s), code %d", x.RouteName(smm.Route), smm.RouteWhy, smm.Code)
+	}
+
+	r.SetListenerTimeout(50, QueryFailClosed)
+	ans, smm, err = failsafeQuery(t, r)
+	if !errors.Is(err, errListenerTimeout) || xdns.Rcode(xdns.AsMsg(ans)) != dns.RcodeServerFailure {
+		t.Errorf("failsafe: closed: want servfail, got %v", err)
+	}
+	if smm.Route != RouteListenerTimeout || smm.RouteWhy != "servfail" || smm.Code != x.ErrListenerTimeout {
+		t.Errorf("failsafe: closed: route %s (%s), code %d", x.RouteName(smm.Route), smm.RouteWhy, smm.Code)
+	}
+	if n := r.ListenerTimeouts(); n != 2 {
+		t.Errorf("failsafe: want 2 timeouts, got %d", n)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// faultguard is a Transport that injects faults in effect on it (set with
+// core.InjectFault) into its queries, as if they were of its upstream;
+// queries answered from the cache see none.
+type faultguard struct {
+	Transport
+	f *core.Fault
+}
+
+var _ Transport = (*faultguard)(nil)
+
+// withFault returns t wrapped in a faultguard, if a fault is in effect on
+// it; t as-is otherwise.
+func withFault(t Transport) Transport {
+	if t == nil {
+		return t
+	}
+	f := core.FaultFor(core.FaultDNS, strings.TrimPrefix(t.ID(), CT))
+	if f == nil {
+		return t
+	}
+	return &faultguard{Transport: t, f: f}
+}
+
+var _ ContextQuerier = (*faultguard)(nil)
+
+// Implements Transport
+func (g *faultguard) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	return g.QueryContext(context.Background(), network, q, smm)
+}
+
+// Implements ContextQuerier
+func (g *faultguard) QueryContext(ctx context.Context, network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	if ct, ok := g.Transport.(*ctransport); ok && ct.cached(q) {
+		return queryContext(ctx, g.Transport, network, q, smm)
+	}
+	if smm == nil {
+		smm = new(x.DNSSummary)
+	}
+
+	start := time.Now()
+	if d := g.f.Delay(); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			smm.Latency = time.Since(start).Seconds()
+			smm.Status = NoResponse
+			return xdns.Servfail(q), NewNoResponseQueryError(ctx.Err())
+		}
+	}
+	if err := g.f.Fail(); err != nil {
+		log.D("dns: fault: %s: %s; %v", g.ID(), smm.QName, err)
+		smm.Latency = time.Since(start).Seconds()
+		smm.RCode = dns.RcodeServerFailure
+		if errors.Is(err, core.ErrFaultServfail) {
+			smm.Status = Complete
+			return xdns.Servfail(q), nil
+		}
+		qerr := NewSendFailedQueryError(err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			qerr = NewNoResponseQueryError(err)
+		}
+		smm.Status = qerr.Status()
+		return xdns.Servfail(q), qerr
+	}
+
+	ans, err := queryContext(ctx, g.Transport, network, q, smm)
+	if err == nil && g.f.Truncate() {
+		if tc, terr := xdns.TruncatedResponse(ans); terr == nil {
+			log.D("dns: fault: %s: %s truncated", g.ID(), smm.QName)
+			ans = tc
+		}
+	}
+	return ans, err
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func TestFaultTransport(t *testing.T) {
+	defer core.ClearFaults()
+	tr := fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}
+	q := new(dns.Msg)
+	q.SetQuestion("fault.example.", dns.TypeA)
+	qb, _ := q.Pack()
+
+	if _, ok := withFault(tr).(*faultguard); ok {
+		t.Fatal("fault: none in effect, but transport wrapped")
+	}
+
+	tests := []struct {
+		profile string
+		code    int
+		tc      bool
+	}{
+		{`{"name": "down", "errevery": 1}`, x.ErrDNSSendFailed, false},
+		{`{"name": "slow", "errevery": 1, "err": "timeout", "delayms": 20}`, x.ErrDNSNoResponse, false},
+		{`{"name": "sick", "errevery": 1, "err": "servfail"}`, x.ErrDNSServfail, false},
+		{`{"name": "trunc", "truncrate": 1}`, x.ErrNone, true},
+	}
+	for _, tc := range tests {
+		if err := core.InjectFault(core.FaultDNS, tr.ID(), tc.profile, time.Minute); err != nil {
+			t.Fatalf("fault: %s: %v", tc.profile, err)
+		}
+		smm := new(x.DNSSummary)
+		ans, _ := withFault(tr).Query(NetTypeUDP, qb, smm)
+		if code := ErrCode(smm.Status, smm.RCode); code != tc.code {
+			t.Errorf("fault: %s: want %s, got %s", tc.profile, x.ErrName(tc.code), x.ErrName(code))
+		}
+		if msg := xdns.AsMsg(ans); msg == nil || msg.Truncated != tc.tc {
+			t.Errorf("fault: %s: want truncated? %t, got %v", tc.profile, tc.tc, msg)
+		}
+	}
+
+	core.ClearFaults()
+	smm := new(x.DNSSummary)
+	if _, err := withFault(tr).Query(NetTypeUDP, qb, smm); err != nil || smm.Status != Complete {
+		t.Errorf("fault: cleared: status %d, err %v", smm.Status, err)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// weight of members whose last query failed, relative to their own
+	failedWeight = 0.1
+	// members with a p50 of this much have half their weight
+	halfWeightP50 = 100 // millis
+	// max members in a group
+	maxGroupMembers = 16
+)
+
+var (
+	errGroupArgs     = errors.New("group: members and weights mismatch")
+	errGroupMember   = errors.New("group: bad member")
+	errGroupWeight   = errors.New("group: bad weight")
+	errGroupNoMember = errors.New("group: no live members")
+)
+
+// member is a transport in a group, by id, and its weight.
+type member struct {
+	id     string
+	weight int
+}
+
+// group is a Transport that spreads queries across its members by weight,
+// skewed away from those with recent failures or high latencies; queries
+// are retried once on another member if the first fails. Members are other
+// transports added to the resolver; and are looked up on every query, so
+// members removed from the resolver are skipped till they are re-added.
+type group struct {
+	id      string
+	members []member
+	get     func(id string) Transport // looks up members
+
+	mu     sync.Mutex // protects status and est
+	status int
+	est    core.P2QuantileEstimator
+}
+
+var _ Transport = (*group)(nil)
+
+// NewTransportGroup returns a group transport with id of members in membercsv
+// (ids of other transports), each weighted as in weightcsv; all weigh the same
+// if weightcsv is empty. Members are looked up in r on every query.
+func NewTransportGroup(id, membercsv, weightcsv string, r Resolver) (Transport, error) {
+	if len(id) <= 0 || isReserved(id) || r == nil {
+		return nil, errGroupMember
+	}
+	ids := strings.Split(membercsv, ",")
+	var ws []string
+	if len(weightcsv) > 0 {
+		ws = strings.Split(weightcsv, ",")
+		if len(ws) != len(ids) {
+			return nil, errGroupArgs
+		}
+	}
+	if len(ids) > maxGroupMembers {
+		return nil, errGroupArgs
+	}
+
+	members := make([]member, 0, len(ids))
+	for i, mid := range ids {
+		mid = strings.TrimSpace(mid)
+		if len(mid) <= 0 || mid == id || slices.ContainsFunc(members, func(m member) bool { return m.id == mid }) {
+			return nil, errGroupMember
+		}
+		w := 1
+		if len(ws) > 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(ws[i]))
+			if err != nil || n <= 0 {
+				return nil, errGroupWeight
+			}
+			w = n
+		}
+		members = append(members, member{mid, w})
+	}
+
+	g := &group{
+		id:      id,
+		members: members,
+		status:  Start,
+		est:     core.NewP50Estimator(),
+		get: func(mid string) Transport {
+			dt, err := r.Get(mid)
+			if err != nil {
+				return nil
+			}
+			// Get falls back on Default for missing ids
+			if t, ok := dt.(Transport); ok && t.ID() == mid && t.Type() != Group {
+				return t
+			}
+			return nil
+		},
+	}
+	log.I("dns: group: %s: new with %v", id, members)
+	return g, nil
+}
+
+// live returns members found in the resolver, and their effective weights.
+func (g *group) live() (ts []Transport, ws []float64) {
+	for _, m := range g.members {
+		t := g.get(m.id)
+		if t == nil {
+			continue
+		}
+		w := float64(m.weight)
+		if p50 := t.P50(); p50 > 0 {
+			w /= 1 + float64(p50)/halfWeightP50
+		}
+		switch t.Status() {
+		case Start, Complete:
+		default: // recently failed
+			w *= failedWeight
+		}
+		ts = append(ts, t)
+		ws = append(ws, w)
+	}
+	return
+}
+
+// pick returns the index of a member chosen at random, weighted by ws;
+// members already tried are not picked. Returns -1 if none remain.
+func pick(ws []float64, tried []int) int {
+	total := 0.0
+	for i, w := range ws {
+		if !slices.Contains(tried, i) {
+			total += w
+		}
+	}
+	if total <= 0 {
+		return -1
+	}
+	n := rand.Float64() * total
+	last := -1
+	for i, w := range ws {
+		if slices.Contains(tried, i) {
+			continue
+		}
+		last = i
+		if n -= w; n < 0 {
+			return i
+		}
+	}
+	return last // n rounded off
+}
+
+// Implements Transport
+func (g *group) Query(network string, q []byte, smm *x.DNSSummary) (ans []byte, err error) {
+	start := time.Now()
+	ts, ws := g.live()
+	if len(ts) <= 0 {
+		smm.Status = TransportError
+		smm.RCode = dns.RcodeServerFailure
+		g.done(TransportError, 0)
+		log.W("dns: group: %s: no live members of %d", g.id, len(g.members))
+		return nil, errGroupNoMember
+	}
+
+	var tried []int
+	for attempt := 0; attempt < 2; attempt++ { // retries once
+		i := pick(ws, tried)
+		if i < 0 {
+			break
+		}
+		tried = append(tried, i)
+		t := ts[i]
+		smm.Member = t.ID()
+		ans, err = t.Query(network, q, smm)
+		if err == nil {
+			break
+		}
+		log.D("dns: group: %s: member %s failed (attempt %d): %v", g.id, t.ID(), attempt+1, err)
+	}
+
+	if err == nil {
+		g.done(Complete, time.Since(start))
+	} else {
+		g.done(smm.Status, 0)
+	}
+	return ans, err
+}
+
+func (g *group) done(status int, d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.status = status
+	if d > 0 {
+		g.est.Add(d.Seconds())
+	}
+}
+
+// Implements Transport
+func (g *group) ID() string {
+	return g.id
+}
+
+// Implements Transport
+func (g *group) Type() string {
+	return Group
+}
+
+// Implements Transport
+func (g *group) P50() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.est.Get()
+}
+
+// Implements Transport
+func (g *group) GetAddr() string {
+	ids := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		ids = append(ids, m.id)
+	}
+	return strings.Join(ids, ",")
+}
+
+// Status is Complete if any live member's last query completed, else that
+// of the group's last query; TransportError if no members are live.
+func (g *group) Status() int {
+	ts, _ := g.live()
+	if len(ts) <= 0 {
+		return TransportError
+	}
+	for _, t := range ts {
+		if t.Status() == Complete {
+			return Complete
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/miekg/dns"
+)
+
+// fakeMember answers queries, or fails them if fail is set.
+type fakeMember struct {
+	fakeTransport
+	id     string
+	fail   bool
+	status int
+	n      int // queries seen
+}
+
+func (m *fakeMember) ID() string  { return m.id }
+func (m *fakeMember) Status() int { return m.status }
+
+func (m *fakeMember) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	m.n++
+	if m.fail {
+		m.status = SendFailed
+		smm.Status = SendFailed
+		return nil, errors.New("fake: send failed")
+	}
+	m.status = Complete
+	return m.fakeTransport.Query(network, q, smm)
+}
+
+func newFakeMember(id string, fail bool) *fakeMember {
+	return &fakeMember{
+		fakeTransport: fakeTransport{rrs: func(string) []dns.RR { return nil }},
+		id:            id,
+		fail:          fail,
+		status:        Start,
+	}
+}
+
+func groupQuery(t *testing.T, g Transport) (*x.DNSSummary, error) {
+	q := new(dns.Msg)
+	q.SetQuestion("grp.example.", dns.TypeA)
+	qb, _ := q.Pack()
+	smm := new(x.DNSSummary)
+	_, err := g.Query(NetTypeUDP, qb, smm)
+	return smm, err
+}
+
+func TestGroupArgs(t *testing.T) {
+	r := &resolver{transports: map[string]Transport{}}
+	bad := []struct{ id, members, weights string }{
+		{"", "a,b", ""},
+		{Preferred, "a,b", ""}, // reserved
+		{"g", "a,b", "1"},      // mismatch
+		{"g", "a,a", ""},       // duplicate
+		{"g", "a,g", ""},       // self
+		{"g", "a,b", "1,0"},    // not positive
+		{"g", "a,", ""},        // empty
+	}
+	for _, c := range bad {
+		if _, err := NewTransportGroup(c.id, c.members, c.weights, r); err == nil {
+			t.Errorf("group: %q %q %q: want err", c.id, c.members, c.weights)
+		}
+	}
+	if _, err := NewTransportGroup("g", "a,b", "3,1", r); err != nil {
+		t.Errorf("group: want ok, got %v", err)
+	}
+}
+
+func TestGroupRetriesAndRemoval(t *testing.T) {
+	a, b := newFakeMember("a", true), newFakeMember("b", false)
+	r := &resolver{transports: map[string]Transport{a.ID(): a, b.ID(): b}}
+	g, err := NewTransportGroup("g", "a,b", "", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a always fails; queries are retried on b, which serves them all
+	for i := 0; i < 10; i++ {
+		smm, err := groupQuery(t, g)
+		if err != nil {
+			t.Fatalf("group: query %d: %v", i, err)
+		}
+		if smm.Member != "b" {
+			t.Errorf("group: query %d: want member b, got %q", i, smm.Member)
+		}
+	}
+	if a.n > 10 || b.n != 10 {
+		t.Errorf("group: want <=10 on a and 10 on b, got %d and %d", a.n, b.n)
+	}
+	if s := g.Status(); s != Complete {
+		t.Errorf("group: status: want %d, got %d", Complete, s)
+	}
+
+	// members removed from the resolver are skipped
+	delete(r.transports, "b") // as r.Remove does
+	if smm, err := groupQuery(t, g); err == nil || smm.Member != "a" {
+		t.Errorf("group: removed b: want a to fail, got %q %v", smm.Member, err)
+	}
+	delete(r.transports, "a")
+	if _, err := groupQuery(t, g); !errors.Is(err, errGroupNoMember) {
+		t.Errorf("group: no members: want %v, got %v", errGroupNoMember, err)
+	}
+	if s := g.Status(); s != TransportError {
+		t.Errorf("group: no members: status want %d, got %d", TransportError, s)
+	}
+}
+
+func TestGroupPick(t *testing.T) {
+	ws := []float64{3, 1 * failedWeight}
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if pick(ws, nil) == 0 {
+			n++
+		}
+	}
+	if n < 900 { // expected ~968
+		t.Errorf("group: pick: heavier member picked %d of 1000", n)
+	}
+	if i := pick(ws, []int{0}); i != 1 {
+		t.Errorf("group: pick: want 1 once 0 is tried, got %d", i)
+	}
+	if i := pick(ws, []int{0, 1}); i != -1 {
+		t.Errorf("group: pick: want -1 once all are tried, got %d", i)
+	}
+}
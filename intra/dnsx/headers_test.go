@@ -0,0 +1,44 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeHeaders records headers set on it.
+type fakeHeaders struct {
+	*fakeMember
+	h map[string]string
+}
+
+func (f *fakeHeaders) SetHeader(k, v string) error {
+	f.h[k] = v
+	return nil
+}
+
+func TestSetHeader(t *testing.T) {
+	hs := &fakeHeaders{newFakeMember("doh", false), make(map[string]string)}
+	r := &resolver{transports: map[string]Transport{
+		"doh":   hs,
+		"dns53": newFakeMember("dns53", false),
+	}}
+
+	if err := r.SetHeader("doh", "Authorization", "Bearer x"); err != nil {
+		t.Fatal(err)
+	}
+	if v := hs.h["Authorization"]; v != "Bearer x" {
+		t.Errorf("header = %q; want Bearer x", v)
+	}
+	if err := r.SetHeader("dns53", "k", "v"); !errors.Is(err, errNoHeaders) {
+		t.Errorf("err = %v; want %v", err, errNoHeaders)
+	}
+	if err := r.SetHeader("missing", "k", "v"); !errors.Is(err, errNoSuchTransport) {
+		t.Errorf("err = %v; want %v", err, errNoSuchTransport)
+	}
+}
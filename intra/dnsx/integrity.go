@@ -0,0 +1,337 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	IntegrityUnknown = x.IntegrityUnknown
+	IntegrityOK      = x.IntegrityOK
+	IntegritySuspect = x.IntegritySuspect
+)
+
+const (
+	// divergences in a row for a name before the listener is alerted
+	xcheckalert = 3
+	// cross-checks before the network's integrity is told
+	xcheckmin = 8
+	// max names tracked as diverging; more are counted, but not tracked
+	xcheckmaxnames = 256
+	// max cross-checks in flight; more are skipped
+	xcheckmaxinflight = 8
+	// cross-checks unanswered by the reference by then are inconclusive
+	xchecktimeout = 5 * time.Second
+)
+
+var errBadCrossCheck = errors.New("dns: xcheck: pct not in [0, 100]")
+
+// xname is a name whose answers diverge from those of the reference.
+type xname struct {
+	streak      int    // divergences in a row
+	ips, refips string // csv; of the last divergence
+}
+
+// integrity cross-checks answers against those of a reference transport, to
+// tell if answers are being forged on the current network; see: SetCrossCheck
+type integrity struct {
+	sync.Mutex                     // protects all fields
+	refid      string              // reference transport; empty if off
+	pct        int                 // of queries sampled
+	canaries   map[string]struct{} // names always cross-checked
+	names      map[string]*xname   // qname -> divergence; only those diverging
+	inflight   map[string]struct{} // qnames being cross-checked
+	checked    int                 // conclusive cross-checks
+	agreed     int                 // of checked
+	diverged   int                 // of checked
+	since      time.Time           // of the current network
+}
+
+func newIntegrity() *integrity {
+	return &integrity{
+		canaries: make(map[string]struct{}),
+		names:    make(map[string]*xname),
+		inflight: make(map[string]struct{}),
+		since:    time.Now(),
+	}
+}
+
+// Implements x.DNSIntegrity
+func (r *resolver) SetCrossCheck(refid string, pct int, canarycsv string) error {
+	if pct < 0 || pct > 100 {
+		return errBadCrossCheck
+	}
+	refid = strings.TrimSpace(refid)
+	canaries := make(map[string]struct{})
+	for _, c := range strings.Split(canarycsv, ",") {
+		if c, _ = xdns.NormalizeQName(strings.TrimSpace(c)); len(c) > 0 && c != "." {
+			canaries[c] = struct{}{}
+		}
+	}
+
+	v := r.xcheck
+	v.Lock()
+	defer v.Unlock()
+	v.refid = refid
+	v.pct = pct
+	v.canaries = canaries
+	log.I("dns: xcheck: ref %q; pct %d; canaries %d", refid, pct, len(canaries))
+	return nil
+}
+
+// Implements x.DNSIntegrity
+func (r *resolver) DNSIntegrity() string {
+	v := r.xcheck
+	v.Lock()
+	defer v.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "verdict=%s;checked=%d;agreed=%d;diverged=%d;since=%s\n",
+		v.verdictLocked(), v.checked, v.agreed, v.diverged, v.since.UTC().Format(time.RFC3339))
+	names := make([]string, 0, len(v.names))
+	for n := range v.names {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	for _, n := range names {
+		if d := v.names[n]; d.streak >= xcheckalert {
+			fmt.Fprintf(&b, "%s=%s;%s\n", n, d.ips, d.refips)
+		}
+	}
+	return b.String()
+}
+
+// verdictLocked returns the integrity of the current network; must be
+// called with v locked.
+func (v *integrity) verdictLocked() string {
+	for _, d := range v.names {
+		if d.streak >= xcheckalert {
+			return IntegritySuspect
+		}
+	}
+	if v.checked < xcheckmin {
+		return IntegrityUnknown
+	}
+	return IntegrityOK
+}
+
+// reset forgets cross-checks of the previous network, if any.
+func (v *integrity) reset() {
+	if v == nil {
+		return
+	}
+	v.Lock()
+	defer v.Unlock()
+	clear(v.names)
+	v.checked, v.agreed, v.diverged = 0, 0, 0
+	v.since = time.Now()
+}
+
+// sampled returns the reference transport id, if qname is to be
+// cross-checked; empty otherwise.
+func (v *integrity) sampled(qname string) string {
+	v.Lock()
+	defer v.Unlock()
+	if len(v.refid) <= 0 {
+		return ""
+	}
+	if _, ok := v.canaries[qname]; ok {
+		return v.refid
+	}
+	if v.pct > 0 && rand.IntN(100) < v.pct {
+		return v.refid
+	}
+	return ""
+}
+
+// begin returns true if qname is not being cross-checked already, and
+// there is room for another cross-check; end must be called if so.
+func (v *integrity) begin(qname string) bool {
+	v.Lock()
+	defer v.Unlock()
+	if _, ok := v.inflight[qname]; ok || len(v.inflight) >= xcheckmaxinflight {
+		return false
+	}
+	v.inflight[qname] = struct{}{}
+	return true
+}
+
+func (v *integrity) end(qname string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.inflight, qname)
+}
+
+// note records whether answers ips and refips for qname agree; and returns
+// true if they diverged for xcheckalert times in a row, just now.
+func (v *integrity) note(qname string, agree bool, ips, refips string) bool {
+	v.Lock()
+	defer v.Unlock()
+	v.checked++
+	if agree {
+		v.agreed++
+		delete(v.names, qname)
+		return false
+	}
+	v.diverged++
+	d := v.names[qname]
+	if d == nil {
+		if len(v.names) >= xcheckmaxnames {
+			return false
+		}
+		d = new(xname)
+		v.names[qname] = d
+	}
+	d.streak++
+	d.ips, d.refips = ips, refips
+	return d.streak == xcheckalert
+}
+
+// crosscheck returns t wrapped in an xcheckguard, if answers of t for qname
+// of type qtyp are to be cross-checked; t otherwise.
+func (r *resolver) crosscheck(t Transport, qname string, qtyp int) Transport {
+	if t == nil || r.xcheck == nil {
+		return t
+	}
+	if !xdns.IsAQType(uint16(qtyp)) && !xdns.IsAAAAQType(uint16(qtyp)) {
+		return t
+	}
+	refid := r.xcheck.sampled(qname)
+	if len(refid) <= 0 || t.ID() == refid || t.ID() == CT+refid {
+		return t
+	}
+	if len(r.requiresGoosOrLocal(qname)) > 0 {
+		return t // private names have no public answers to check against
+	}
+	return &xcheckguard{Transport: t, r: r, refid: refid, qname: qname, qtyp: uint16(qtyp)}
+}
+
+// xcheckguard is a Transport whose answers are cross-checked against those
+// of refid, in the background; see: SetCrossCheck
+type xcheckguard struct {
+	Transport
+	r     *resolver
+	refid string
+	qname string
+	qtyp  uint16
+}
+
+var _ Transport = (*xcheckguard)(nil)
+
+// Implements Transport
+func (g *xcheckguard) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	res, err := g.Transport.Query(network, q, smm)
+	if err != nil {
+		return res, err
+	}
+	ans := xdns.AsMsg(res)
+	if ans == nil || !xdns.HasRcodeSuccess(ans) {
+		return res, err
+	}
+	ips := answerIPs(ans)
+	if len(ips) <= 0 || slices.ContainsFunc(ips, netip.Addr.IsUnspecified) {
+		return res, err // no ips, or blocked upstream; nothing to compare
+	}
+	go g.r.xcheckOne(g.qname, g.qtyp, g.ID(), g.refid, ips)
+	return res, err
+}
+
+// xcheckOne resolves qname of qtyp over refid, and compares its answer with
+// ips of transport id; the listener is alerted if they diverge persistently.
+func (r *resolver) xcheckOne(qname string, qtyp uint16, id, refid string, ips []netip.Addr) {
+	v := r.xcheck
+	if !v.begin(qname) {
+		return
+	}
+	defer v.end(qname)
+
+	ref, _ := r.transportFor(refid)
+	if ref == nil {
+		log.D("dns: xcheck: %s: no ref %s", qname, refid)
+		return
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(qname), qtyp)
+	q, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	res, err := withDeadline(ref, xchecktimeout).Query(Background(NetTypeUDP), q, new(x.DNSSummary))
+	ans := xdns.AsMsg(res)
+	if err != nil || ans == nil || !xdns.HasRcodeSuccess(ans) {
+		log.D("dns: xcheck: %s: ref %s inconclusive; err? %v", qname, refid, err)
+		return
+	}
+	refips := answerIPs(ans)
+	if len(refips) <= 0 {
+		log.D("dns: xcheck: %s: ref %s has no ips", qname, refid)
+		return
+	}
+
+	agree := agrees(ips, refips)
+	csv, refcsv := ipcsv(ips), ipcsv(refips)
+	if !agree {
+		log.W("dns: xcheck: %s: %s [%s] diverges from %s [%s]", qname, id, csv, refid, refcsv)
+	}
+	if v.note(qname, agree, csv, refcsv) && r.listener != nil {
+		go r.listener.OnDNSDivergence(qname, id, csv, refid, refcsv)
+	}
+}
+
+// agrees returns true if any of ips shares an ip, or its /24 (ipv4) or /48
+// (ipv6), with any of refips; as cdns answer differently to each resolver.
+func agrees(ips, refips []netip.Addr) bool {
+	for _, a := range ips {
+		for _, b := range refips {
+			if a == b || netOf(a) == netOf(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func netOf(ip netip.Addr) netip.Prefix {
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	p, _ := ip.Prefix(bits)
+	return p
+}
+
+// answerIPs returns ips of a and aaaa records in ans, unmapped.
+func answerIPs(ans *dns.Msg) []netip.Addr {
+	var ips []netip.Addr
+	for _, ip := range append(xdns.AAnswer(ans), xdns.AAAAAnswer(ans)...) {
+		if ip != nil {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips
+}
+
+func ipcsv(ips []netip.Addr) string {
+	s := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/miekg/dns"
+)
+
+// ipTransport answers a queries with ips by qname.
+type ipTransport struct {
+	fakeTransport
+	id string
+}
+
+func (t ipTransport) ID() string { return t.id }
+
+func newIPTransport(id string, ips map[string]string) ipTransport {
+	return ipTransport{id: id, fakeTransport: fakeTransport{rrs: func(qname string) []dns.RR {
+		rr, _ := dns.NewRR(qname + " 60 IN A " + ips[qname])
+		return []dns.RR{rr}
+	}}}
+}
+
+// xcheckListener records OnDNSDivergence.
+type xcheckListener struct {
+	tidListener
+	mu     sync.Mutex
+	alerts []string
+}
+
+func (l *xcheckListener) OnDNSDivergence(qname, id, ips, refid, refips string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.alerts = append(l.alerts, strings.Join([]string{qname, id, ips, refid, refips}, " "))
+}
+
+func (l *xcheckListener) seen() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.alerts...)
+}
+
+func TestCrossCheck(t *testing.T) {
+	l := &xcheckListener{tidListener: tidListener{tid: "isp"}}
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, l, nil).(*resolver)
+	r.Lock()
+	r.transports["isp"] = newIPTransport("isp", map[string]string{
+		"forged.example.": "198.51.100.7",
+		"cdn.example.":    "93.184.216.10",
+	})
+	r.transports["ref"] = newIPTransport("ref", map[string]string{
+		"forged.example.": "93.184.216.34",
+		"cdn.example.":    "93.184.216.34",
+	})
+	r.Unlock()
+
+	checked := func() int {
+		r.xcheck.Lock()
+		defer r.xcheck.Unlock()
+		return r.xcheck.checked
+	}
+	query := func(name string) {
+		t.Helper()
+		n := checked()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		q, _ := msg.Pack()
+		if _, err := r.Forward(q); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(2 * time.Second); checked() <= n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("xcheck: %s: not cross-checked", name)
+			}
+		}
+	}
+
+	// off by default
+	msg := new(dns.Msg)
+	msg.SetQuestion("forged.example.", dns.TypeA)
+	q, _ := msg.Pack()
+	_, _ = r.Forward(q)
+	time.Sleep(10 * time.Millisecond)
+	if n := checked(); n != 0 {
+		t.Errorf("xcheck: off, but checked %d", n)
+	}
+
+	if err := r.SetCrossCheck("ref", 101, ""); err == nil {
+		t.Errorf("xcheck: want err on pct 101")
+	}
+	if err := r.SetCrossCheck("ref", 0, "Forged.Example,cdn.example."); err != nil {
+		t.Fatal(err)
+	}
+	for range xcheckalert {
+		query("forged.example.")
+		query("cdn.example.") // same /24
+	}
+	time.Sleep(10 * time.Millisecond) // listener is called async
+	want := "forged.example isp 198.51.100.7 ref 93.184.216.34"
+	if got := l.seen(); len(got) != 1 || got[0] != want {
+		t.Errorf("xcheck: alerts %q; want %q", got, want)
+	}
+	st := r.DNSIntegrity()
+	for _, s := range []string{"verdict=" + IntegritySuspect, "checked=6;agreed=3;diverged=3", "forged.example=198.51.100.7;93.184.216.34"} {
+		if !strings.Contains(st, s) {
+			t.Errorf("xcheck: status %q; want %q", st, s)
+		}
+	}
+	if strings.Contains(st, "cdn.example=") {
+		t.Errorf("xcheck: status %q; cdn.example agrees", st)
+	}
+
+	// a new network is judged anew
+	r.OnLinkChange(core.Link{L3: settings.IP46})
+	if st := r.DNSIntegrity(); !strings.HasPrefix(st, "verdict="+IntegrityUnknown+";checked=0") {
+		t.Errorf("xcheck: after link change %q", st)
+	}
+	for range xcheckmin {
+		query("cdn.example.")
+	}
+	if st := r.DNSIntegrity(); !strings.HasPrefix(st, "verdict="+IntegrityOK) {
+		t.Errorf("xcheck: want ok; got %q", st)
+	}
+}
+
+func TestCrossCheckAgrees(t *testing.T) {
+	ip := netip.MustParseAddr
+	for _, tc := range []struct {
+		ips, refips []netip.Addr
+		want        bool
+	}{
+		{[]netip.Addr{ip("1.1.1.1")}, []netip.Addr{ip("1.1.1.1")}, true},
+		{[]netip.Addr{ip("1.1.1.1")}, []netip.Addr{ip("1.1.1.200")}, true},
+		{[]netip.Addr{ip("1.1.1.1")}, []netip.Addr{ip("1.1.2.1")}, false},
+		{[]netip.Addr{ip("2001:db8:1::1")}, []netip.Addr{ip("2001:db8:1:ff::9")}, true},
+		{[]netip.Addr{ip("2001:db8:1::1")}, []netip.Addr{ip("2001:db8:2::1")}, false},
+		{[]netip.Addr{ip("10.0.0.1"), ip("2001:db8:1::1")}, []netip.Addr{ip("2001:db8:1::2")}, true},
+	} {
+		if got := agrees(tc.ips, tc.refips); got != tc.want {
+			t.Errorf("xcheck: agrees(%v, %v) = %t; want %t", tc.ips, tc.refips, got, tc.want)
+		}
+	}
+}
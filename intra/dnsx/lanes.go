@@ -0,0 +1,114 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"strings"
+	"sync"
+)
+
+// tags networks (see: xdns.NetAndProxyID) of queries sent on behalf of
+// no app, as a third part that xdns.Net2ProxyID ignores
+const netBackground = ":bg"
+
+// Background returns network tagged for queries that are not sent on behalf
+// of apps (ex: refreshes of stale answers, warmups, probes), and so, may wait
+// on those that are; see: Lanes.
+func Background(network string) string {
+	if IsBackground(network) {
+		return network
+	}
+	if strings.Count(network, ":") <= 0 { // proto only; no proxy id
+		network += ":"
+	}
+	return network + netBackground
+}
+
+// IsBackground returns true if network is tagged by Background.
+func IsBackground(network string) bool {
+	return strings.HasSuffix(network, netBackground)
+}
+
+// Lanes admits up to max queries at a time, in two lanes: interactive
+// queries go first, and background ones (see: Background) wait while any
+// interactive ones do, and never take the last reserve slots, so that a
+// burst of background queries does not hold up interactive ones.
+type Lanes struct {
+	mu      sync.Mutex
+	n       int             // admitted, in flight
+	max     int             // max in flight
+	reserve int             // of max, slots only interactive queries take
+	fg, bg  []chan struct{} // waiters, in order
+}
+
+// NewLanes returns Lanes that admit n (at least 1) queries at a time,
+// of which, reserve (less than n) are kept for interactive ones.
+func NewLanes(n, reserve int) *Lanes {
+	n = max(n, 1)
+	reserve = min(max(reserve, 0), n-1)
+	return &Lanes{max: n, reserve: reserve}
+}
+
+// Acquire waits for a slot in the lane of network (see: IsBackground), and
+// returns a func to release it with, once the query is done.
+func (l *Lanes) Acquire(network string) (release func()) {
+	bg := IsBackground(network)
+
+	l.mu.Lock()
+	if l.admits(bg) {
+		l.n++
+		l.mu.Unlock()
+		return l.release
+	}
+	ch := make(chan struct{})
+	if bg {
+		l.bg = append(l.bg, ch)
+	} else {
+		l.fg = append(l.fg, ch)
+	}
+	l.mu.Unlock()
+
+	<-ch // admitted by release, which counts it in n
+	return l.release
+}
+
+// admits returns true if a query of the lane bg can go right away;
+// must be called with l.mu held.
+func (l *Lanes) admits(bg bool) bool {
+	if len(l.fg) > 0 {
+		return false
+	}
+	if bg {
+		return len(l.bg) <= 0 && l.n < l.max-l.reserve
+	}
+	return l.n < l.max
+}
+
+func (l *Lanes) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.n--
+	if len(l.fg) > 0 {
+		ch := l.fg[0]
+		l.fg = l.fg[1:]
+		l.n++
+		close(ch)
+	} else if len(l.bg) > 0 && l.n < l.max-l.reserve {
+		ch := l.bg[0]
+		l.bg = l.bg[1:]
+		l.n++
+		close(ch)
+	}
+}
+
+// Waiting returns the number of interactive and background queries waiting.
+func (l *Lanes) Waiting() (fg, bg int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.fg), len(l.bg)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/xdns"
+)
+
+func TestBackground(t *testing.T) {
+	for _, nw := range []string{NetTypeUDP, xdns.NetAndProxyID(NetTypeTCP, NetNoProxy)} {
+		bg := Background(nw)
+		if !IsBackground(bg) || IsBackground(nw) || Background(bg) != bg {
+			t.Errorf("background %s: got %s", nw, bg)
+		}
+		proto, pid := xdns.Net2ProxyID(bg)
+		wproto, wpid := xdns.Net2ProxyID(nw)
+		if proto != wproto || pid != wpid {
+			t.Errorf("background %s: %s, %s; want %s, %s", bg, proto, pid, wproto, wpid)
+		}
+	}
+}
+
+func TestLanesNotStarved(t *testing.T) {
+	const max, reserve = 4, 1
+	l := NewLanes(max, reserve)
+	bg := Background(NetTypeUDP)
+
+	// a burst of background queries takes all but the reserve...
+	held := make([]func(), 0, max)
+	for range max - reserve {
+		held = append(held, l.Acquire(bg))
+	}
+	var bgdone atomic.Int32
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Acquire(bg)()
+			bgdone.Add(1)
+		}()
+	}
+	waitFor(t, func() bool { _, n := l.Waiting(); return n == 16 })
+
+	// ...so an interactive one goes right away
+	got := make(chan func(), 1)
+	go func() { got <- l.Acquire(NetTypeUDP) }()
+	select {
+	case rel := <-got:
+		held = append(held, rel)
+	case <-time.After(time.Second):
+		t.Fatal("lanes: interactive query starved by background burst")
+	}
+
+	// with all slots taken, interactive ones queued after the background
+	// ones still go before them
+	fgin := make(chan func(), 2)
+	for range 2 {
+		go func() { fgin <- l.Acquire(NetTypeTCP) }()
+	}
+	waitFor(t, func() bool { n, _ := l.Waiting(); return n == 2 })
+	held[0]()
+	held[1]()
+	fgrel := []func(){<-fgin, <-fgin}
+	if n := bgdone.Load(); n != 0 {
+		t.Errorf("lanes: %d background queries went before interactive ones", n)
+	}
+
+	for _, rel := range append(held[2:], fgrel...) {
+		rel()
+	}
+	wg.Wait()
+	if fg, bg := l.Waiting(); fg != 0 || bg != 0 || l.n != 0 {
+		t.Errorf("lanes: leftover %d, %d; in flight %d", fg, bg, l.n)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for range 200 {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
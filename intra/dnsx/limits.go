@@ -0,0 +1,236 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// queries wait in the queue for as long, by default
+const defaultqueuewait = 1 * time.Second
+
+var (
+	errQueueFull    = errors.New("query queue full")
+	errQueueTimeout = errors.New("query queue timeout")
+)
+
+// qlimit caps queries in flight over a transport; excess queries wait in
+// a fifo queue for a slot, till they time out.
+type qlimit struct {
+	sync.Mutex                 // protects inflight, q
+	max        int             // max queries in flight
+	cap        int             // max queries queued
+	wait       time.Duration   // max wait in the queue
+	inflight   int             // queries in flight
+	q          []chan struct{} // queued; closed when let through
+}
+
+// acquire takes a slot, waiting in the queue till the deadline (if not
+// zero) or for l.wait, whichever is sooner; release must be called if
+// acquire returns nil.
+func (l *qlimit) acquire(deadline time.Time) error {
+	l.Lock()
+	if l.inflight < l.max && len(l.q) <= 0 {
+		l.inflight++
+		l.Unlock()
+		return nil
+	}
+	if len(l.q) >= l.cap {
+		l.Unlock()
+		return errQueueFull
+	}
+	w := make(chan struct{})
+	l.q = append(l.q, w)
+	l.Unlock()
+
+	d := l.wait
+	if !deadline.IsZero() {
+		d = min(d, time.Until(deadline))
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-w:
+		return nil
+	case <-t.C:
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if i := slices.Index(l.q, w); i >= 0 {
+		l.q = slices.Delete(l.q, i, i+1)
+		return errQueueTimeout
+	}
+	return nil // let through as it timed out
+}
+
+// release hands the slot over to the query queued first, if any.
+func (l *qlimit) release() {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.q) > 0 {
+		close(l.q[0])
+		l.q = l.q[1:]
+		return
+	}
+	l.inflight--
+}
+
+// drain lets through all queued queries; ex: when l is replaced.
+func (l *qlimit) drain() {
+	l.Lock()
+	defer l.Unlock()
+	for _, w := range l.q {
+		close(w)
+	}
+	l.inflight += len(l.q)
+	l.q = nil
+}
+
+func (l *qlimit) str() string {
+	l.Lock()
+	defer l.Unlock()
+	return fmt.Sprintf("inflight=%d/%d;queued=%d/%d", l.inflight, l.max, len(l.q), l.cap)
+}
+
+// qlimits are limits of queries over transports, by id.
+type qlimits struct {
+	sync.RWMutex
+	m map[string]*qlimit // transport id => limit
+}
+
+func newQueryLimits() *qlimits {
+	return &qlimits{m: make(map[string]*qlimit)}
+}
+
+// set caps queries over id to n in flight, with up to queued waiting for
+// up to wait; an n of 0 or less removes the cap.
+func (ls *qlimits) set(id string, n, queued int, wait time.Duration) {
+	if wait <= 0 {
+		wait = defaultqueuewait
+	}
+	queued = max(queued, 0)
+	ls.Lock()
+	prev := ls.m[id]
+	if n > 0 {
+		ls.m[id] = &qlimit{max: n, cap: queued, wait: wait}
+	} else {
+		delete(ls.m, id)
+	}
+	ls.Unlock()
+
+	if prev != nil { // queries in flight release slots of prev
+		prev.drain()
+	}
+	log.I("dns: limit: %s; max %d, queued %d, wait %s", id, n, queued, wait)
+}
+
+func (ls *qlimits) get(id string) *qlimit {
+	ls.RLock()
+	defer ls.RUnlock()
+	return ls.m[strings.TrimPrefix(id, CT)]
+}
+
+// wrap returns t guarded by its limit, if any; queries queued leave the
+// queue once timeout (if set), that starts counting now, is up.
+func (ls *qlimits) wrap(t Transport, timeout time.Duration) Transport {
+	if t == nil {
+		return t
+	}
+	l := ls.get(t.ID())
+	if l == nil {
+		return t
+	}
+	g := &limitguard{Transport: t, l: l}
+	if timeout > 0 {
+		g.deadline = time.Now().Add(timeout)
+	}
+	return g
+}
+
+func (ls *qlimits) str() string {
+	ls.RLock()
+	defer ls.RUnlock()
+	ids := make([]string, 0, len(ls.m))
+	for id := range ls.m {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(id + "=" + ls.m[id].str() + "\n")
+	}
+	return b.String()
+}
+
+// SetQueryLimit implements x.DNSLimiter.
+func (r *resolver) SetQueryLimit(id string, n, queued, waitms int) {
+	r.limits.set(id, n, queued, time.Duration(waitms)*time.Millisecond)
+}
+
+// QueryLimits implements x.DNSLimiter.
+func (r *resolver) QueryLimits() string {
+	return r.limits.str()
+}
+
+type limitkey struct{}
+
+// withLimit returns ctx that carries l, for work queries over l kick off
+// in the background (ex: refreshes of stale answers) to take its slots.
+func withLimit(ctx context.Context, l *qlimit) context.Context {
+	return context.WithValue(ctx, limitkey{}, l)
+}
+
+// limitOf returns the limit ctx carries, if any.
+func limitOf(ctx context.Context) *qlimit {
+	l, _ := ctx.Value(limitkey{}).(*qlimit)
+	return l
+}
+
+// limitguard is a Transport that holds a slot of its limit while a query
+// is in flight; queries answered fresh from the cache take none.
+type limitguard struct {
+	Transport
+	l        *qlimit
+	deadline time.Time // zero if none
+}
+
+var _ Transport = (*limitguard)(nil)
+var _ ContextQuerier = (*limitguard)(nil)
+
+// Implements Transport
+func (g *limitguard) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	return g.QueryContext(context.Background(), network, q, smm)
+}
+
+// Implements ContextQuerier
+func (g *limitguard) QueryContext(ctx context.Context, network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	if ct, ok := g.Transport.(*ctransport); ok && ct.cached(q) {
+		return queryContext(withLimit(ctx, g.l), g.Transport, network, q, smm)
+	}
+	if err := g.l.acquire(g.deadline); err != nil {
+		if smm != nil {
+			smm.Status = SendFailed
+			smm.RCode = dns.RcodeServerFailure
+		}
+		log.D("dns: limit: %s; %v", g.ID(), err)
+		return xdns.Servfail(q), err
+	}
+	defer g.l.release()
+	return queryContext(withLimit(ctx, g.l), g.Transport, network, q, smm)
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// slowTransport answers queries after d, and records the most in flight.
+type slowTransport struct {
+	fakeTransport
+	d   time.Duration
+	n   atomic.Int32 // in flight
+	max atomic.Int32 // most in flight
+	all atomic.Int32 // total
+}
+
+func newSlowTransport(d time.Duration) *slowTransport {
+	return &slowTransport{fakeTransport: fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}, d: d}
+}
+
+func (t *slowTransport) ID() string { return "slow" }
+
+func (t *slowTransport) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	t.all.Add(1)
+	n := t.n.Add(1)
+	defer t.n.Add(-1)
+	for m := t.max.Load(); n > m && !t.max.CompareAndSwap(m, n); m = t.max.Load() {
+	}
+	time.Sleep(t.d)
+	return t.fakeTransport.Query(network, q, smm)
+}
+
+func limitQuery(t Transport, i int) (*x.DNSSummary, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(fmt.Sprintf("q%d.example.", i), dns.TypeA)
+	qb, _ := q.Pack()
+	smm := new(x.DNSSummary)
+	_, err := t.Query(NetTypeUDP, qb, smm)
+	return smm, err
+}
+
+func TestQueryLimitCaps(t *testing.T) {
+	tr := newSlowTransport(100 * time.Millisecond)
+	ls := newQueryLimits()
+	ls.set(tr.ID(), 2, 4, 5*time.Second)
+
+	const n = 10
+	var wg sync.WaitGroup
+	var full, ok atomic.Int32
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			smm, err := limitQuery(ls.wrap(tr, 0), i)
+			switch {
+			case err == nil:
+				ok.Add(1)
+			case errors.Is(err, errQueueFull) && smm.Status == SendFailed:
+				full.Add(1)
+			default:
+				t.Errorf("limit: q%d: status %d; err %v", i, smm.Status, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if m := tr.max.Load(); m != 2 {
+		t.Errorf("limit: want 2 in flight at most, got %d", m)
+	}
+	if ok.Load() != 6 || full.Load() != 4 {
+		t.Errorf("limit: want 6 answered, 4 refused; got %d, %d", ok.Load(), full.Load())
+	}
+	if got := ls.str(); got != "slow=inflight=0/2;queued=0/4\n" {
+		t.Errorf("limit: str: got %q", got)
+	}
+}
+
+func TestQueryLimitStaleFlood(t *testing.T) {
+	tr := newSlowTransport(50 * time.Millisecond)
+	ct := newCachingTransport(tr, time.Minute, nil).(*ctransport)
+	ct.reqbarrier = core.NewBarrier(0) // refreshes are not coalesced
+	ls := newQueryLimits()
+	ls.set(tr.ID(), 2, 64, 5*time.Second)
+
+	const n = 16
+	for i := range n { // cache answers to n names, that then expire
+		if _, err := limitQuery(ct, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expires all cached answers, if expire; returns their count, and bumps
+	each := func(expire bool) (n, bumps int) {
+		for _, cb := range ct.store {
+			if cb == nil {
+				continue
+			}
+			cb.mu.Lock()
+			for _, v := range cb.c {
+				if expire {
+					v.expiry = time.Now().Add(-time.Second)
+				}
+				n++
+				bumps += v.bumps
+			}
+			cb.mu.Unlock()
+		}
+		return
+	}
+	expired, bumps := each(true)
+	if expired != n {
+		t.Fatalf("limit: flood: %d cached; want %d", expired, n)
+	}
+	tr.max.Store(0)
+
+	// a peek at expired answers neither bumps them, nor has them skip slots
+	q := new(dns.Msg)
+	q.SetQuestion("q0.example.", dns.TypeA)
+	qb, _ := q.Pack()
+	if ct.cached(qb) {
+		t.Error("limit: flood: expired answer cached as-is")
+	}
+	if _, b := each(false); b != bumps {
+		t.Errorf("limit: flood: peek bumped answers; %d bumps, want %d", b, bumps)
+	}
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := limitQuery(ls.wrap(ct, 0), i); err != nil {
+				t.Errorf("limit: flood: q%d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	// expired answers are served as-is, and refreshed in the background
+	waitFor(t, func() bool { return tr.all.Load() >= 2*n })
+	waitFor(t, func() bool { return strings.Contains(ls.str(), "inflight=0/2") })
+	if m := tr.max.Load(); m > 2 {
+		t.Errorf("limit: flood: want 2 in flight at most, got %d", m)
+	}
+	if a := tr.all.Load(); a != 2*n {
+		t.Errorf("limit: flood: %d queries upstream; want %d", a, 2*n)
+	}
+	if !ct.cached(qb) {
+		t.Error("limit: flood: refreshed answer not cached")
+	}
+}
+
+func TestQueryLimitTimesOut(t *testing.T) {
+	tr := newSlowTransport(time.Second)
+	ls := newQueryLimits()
+	ls.set(tr.ID(), 1, 2, 100*time.Millisecond)
+
+	go limitQuery(ls.wrap(tr, 0), 0) // takes the only slot
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	smm, err := limitQuery(ls.wrap(tr, 0), 1)
+	if !errors.Is(err, errQueueTimeout) || smm.Status != SendFailed {
+		t.Errorf("limit: wait: want %v, got status %d; err %v", errQueueTimeout, smm.Status, err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("limit: wait: want ~100ms, took %s", d)
+	}
+
+	// queued queries leave the queue at their deadline, if sooner
+	start = time.Now()
+	ls.set(tr.ID(), 1, 2, 5*time.Second)
+	go limitQuery(ls.wrap(tr, 0), 2)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := limitQuery(ls.wrap(tr, 50*time.Millisecond), 3); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("limit: deadline: want %v, got %v", errQueueTimeout, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("limit: deadline: want ~70ms, took %s", d)
+	}
+	if got := ls.str(); !strings.Contains(got, "queued=0/2") {
+		t.Errorf("limit: deadline: still queued: %q", got)
+	}
+}
+
+func TestQueryLimitForward(t *testing.T) {
+	tr := newSlowTransport(50 * time.Millisecond)
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, &tidListener{tid: tr.ID()}, nil).(*resolver)
+	if !r.Add(tr) {
+		t.Fatal("limit: add")
+	}
+	r.SetQueryLimit(tr.ID(), 1, 8, 0)
+
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion(fmt.Sprintf("f%d.example.", i), dns.TypeA)
+			qb, _ := q.Pack()
+			if _, err := r.Forward(qb); err != nil {
+				t.Errorf("limit: forward f%d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if m := tr.max.Load(); m != 1 {
+		t.Errorf("limit: forward: want 1 in flight at most, got %d", m)
+	}
+
+	r.SetQueryLimit(tr.ID(), 0, 0, 0)
+	if got := r.QueryLimits(); len(got) > 0 {
+		t.Errorf("limit: unset: got %q", got)
+	}
+}
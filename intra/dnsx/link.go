@@ -0,0 +1,100 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// cached answers that outlive a link change must live at least this long
+const linkkeepttl = 5 * time.Minute
+
+var _ core.LinkObserver = (*resolver)(nil)
+
+// OnLinkChange implements core.LinkObserver. Cached answers with ips (which
+// may be specific to the previous network: cdn ips, dns64 synthesized) are
+// dropped, as are those about to expire; and so are alg mappings with no
+// realips the new link can route, and cross-checks of answers.
+func (r *resolver) OnLinkChange(l core.Link) {
+	use4, use6 := l.L3 != settings.IP6, l.L3 != settings.IP4
+
+	n := 0
+	r.RLock()
+	for _, t := range r.transports {
+		if ct, ok := t.(*ctransport); ok {
+			n += ct.trimIf(stale)
+		}
+	}
+	r.RUnlock()
+
+	m := 0
+	if gw, ok := r.Gateway().(*dnsgateway); ok {
+		m = gw.unroutable(use4, use6)
+	}
+	// cross-checks tell of the integrity of dns on the current network
+	r.xcheck.reset()
+	log.I("dns: link: %s; dropped %d cached answers, %d alg entries", l.L3, n, m)
+}
+
+// stale returns true if v is not worth keeping across link changes.
+func stale(v *cres, now time.Time) bool {
+	return v.expiry.Sub(now) < linkkeepttl || hasIPs(v.ans)
+}
+
+// hasIPs returns true if msg has any a, aaaa records or svcb / https ip hints.
+func hasIPs(msg *dns.Msg) bool {
+	return len(xdns.AAnswer(msg)) > 0 || len(xdns.AAAAAnswer(msg)) > 0 ||
+		len(xdns.IPHints(msg, dns.SVCB_IPV4HINT)) > 0 ||
+		len(xdns.IPHints(msg, dns.SVCB_IPV6HINT)) > 0
+}
+
+// unroutable removes alg, nat, and ptr entries of answers none of whose
+// realips are of a family in use4 or use6; returns the number removed.
+func (t *dnsgateway) unroutable(use4, use6 bool) (n int) {
+	t.Lock()
+	defer t.Unlock()
+
+	routable := func(v *ans) bool {
+		for _, ips := range [][]*netip.Addr{v.realips, v.secondaryips} {
+			for _, ip := range ips {
+				if ip == nil {
+					continue
+				}
+				if uip := ip.Unmap(); (uip.Is4() && use4) || (uip.Is6() && use6) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for k, v := range t.alg {
+		if !routable(v) {
+			delete(t.alg, k)
+			n++
+		}
+	}
+	for ip, v := range t.nat {
+		if !routable(v) {
+			delete(t.nat, ip)
+			n++
+		}
+	}
+	for ip, v := range t.ptr {
+		if !routable(v) {
+			delete(t.ptr, ip)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/miekg/dns"
+)
+
+func linkQuery(t *testing.T, tr Transport, qname string, qtyp uint16) {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtyp)
+	qb, _ := q.Pack()
+	if _, err := tr.Query(NetTypeUDP, qb, new(x.DNSSummary)); err != nil {
+		t.Fatalf("link: %s err %v", qname, err)
+	}
+}
+
+func TestLinkChangeCache(t *testing.T) {
+	tr := fakeTransport{rrs: func(n string) []dns.RR {
+		switch n {
+		case "long.example.":
+			return []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: n, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600}, Txt: []string{"v=1"}}}
+		case "short.example.":
+			return []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: n, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 30}, Txt: []string{"v=1"}}}
+		default:
+			rr := &dns.A{Hdr: dns.RR_Header{Name: n, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}}
+			rr.A = net.IPv4(10, 0, 0, 1)
+			return []dns.RR{rr}
+		}
+	}}
+	ct := newCachingTransport(tr, time.Minute, nil).(*ctransport)
+
+	linkQuery(t, ct, "long.example.", dns.TypeTXT)  // family-agnostic, long-lived: kept
+	linkQuery(t, ct, "short.example.", dns.TypeTXT) // family-agnostic, short-lived: dropped
+	linkQuery(t, ct, "cdn.example.", dns.TypeA)     // has ips: dropped
+	if n := ct.count(); n != 3 {
+		t.Fatalf("link: want 3 cached, got %d", n)
+	}
+
+	// v6 realips only; and v4 realips only
+	gw := NewDNSGateway(&resolver{}, fakeNatPt{})
+	gw.translate(true)
+	v6 := fakeTransport{rrs: func(n string) []dns.RR {
+		rr := &dns.A{Hdr: dns.RR_Header{Name: n, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}}
+		rr.A = net.IPv4(10, 0, 0, 2)
+		if n == "v6.example." {
+			return []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: n, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::2")}}
+		}
+		return []dns.RR{rr}
+	}}
+	q6 := new(dns.Msg)
+	q6.SetQuestion("v6.example.", dns.TypeAAAA)
+	b6, _ := q6.Pack()
+	res6, err := gw.q(v6, nil, nil, "", NetTypeUDP, b6, new(x.DNSSummary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alg6 := asAlgIP(t, res6)
+	alg4 := exitQuery(t, gw, "", "v4.example.", "10.0.0.4")
+
+	r := &resolver{
+		transports: map[string]Transport{ct.ID(): ct},
+		gateway:    gw,
+	}
+	var _ core.LinkObserver = r
+	r.OnLinkChange(core.Link{L3: settings.IP4})
+
+	if n := ct.count(); n != 1 {
+		t.Errorf("link: want 1 cached, got %d", n)
+	}
+	if got := gw.X(alg6); len(got) > 0 {
+		t.Errorf("link: v4: v6-only realips still mapped: %s", got)
+	}
+	if got := gw.X(alg4); !strings.Contains(got, "10.0.0.4") {
+		t.Errorf("link: v4: want 10.0.0.4, got %q", got)
+	}
+}
+
+func asAlgIP(t *testing.T, res []byte) []byte {
+	m := new(dns.Msg)
+	if err := m.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range m.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			return aaaa.AAAA
+		}
+	}
+	t.Fatal("link: no alg aaaa")
+	return nil
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const wildcardprefix = "*."
+
+var (
+	errBadLocalName  = errors.New("local record: invalid name")
+	errBadLocalType  = errors.New("local record: unsupported type")
+	errBadLocalValue = errors.New("local record: invalid value")
+)
+
+type localrr struct {
+	qtyp  uint16
+	value string
+	ttl   int
+}
+
+// localrecords is a table of client-set dns records, which are
+// answered as-is (without alg) before any transport is consulted.
+type localrecords struct {
+	sync.RWMutex                       // protects recs
+	names        x.RadixTree           // name or .wildcard -> name
+	recs         map[string][]*localrr // name or .wildcard -> records
+}
+
+func newLocalRecords() *localrecords {
+	return &localrecords{
+		names: x.NewRadixTree(),
+		recs:  make(map[string][]*localrr),
+	}
+}
+
+// key normalizes name; *.lab.home is keyed as .lab.home
+// which the radix tree treats as a match for all subdomains.
+func localkey(name string) (string, error) {
+	wild := strings.HasPrefix(name, wildcardprefix)
+	name = strings.TrimPrefix(name, wildcardprefix)
+	k, err := xdns.NormalizeQName(name)
+	if err != nil || len(k) <= 0 || k == "." || strings.Contains(k, "*") {
+		return "", errBadLocalName
+	}
+	if wild {
+		k = "." + k
+	}
+	return k, nil
+}
+
+func (h *localrecords) add(name, rrtype, value string, ttl int) error {
+	k, err := localkey(name)
+	if err != nil {
+		return err
+	}
+	qtyp, ok := dns.StringToType[strings.ToUpper(rrtype)]
+	if !ok {
+		return errBadLocalType
+	}
+	switch qtyp {
+	case dns.TypeA, dns.TypeAAAA:
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return errBadLocalValue
+		}
+		ip = ip.Unmap()
+		if (qtyp == dns.TypeA && !ip.Is4()) || (qtyp == dns.TypeAAAA && !ip.Is6()) {
+			return errBadLocalValue
+		}
+		value = ip.String()
+	case dns.TypeCNAME:
+		if _, ok := dns.IsDomainName(value); !ok || len(value) <= 0 {
+			return errBadLocalValue
+		}
+	case dns.TypeTXT:
+		// any value
+	default:
+		return errBadLocalType
+	}
+	if ttl <= 0 {
+		ttl = int(xdns.AnsTTL)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	// a name with a cname must not have other records; rfc1034 sec 3.6.2
+	for _, rr := range h.recs[k] {
+		if (rr.qtyp == dns.TypeCNAME) != (qtyp == dns.TypeCNAME) {
+			return errBadLocalType
+		}
+	}
+	h.recs[k] = append(h.recs[k], &localrr{qtyp, value, ttl})
+	h.names.Set(k, k)
+
+	log.I("dns: local: add %s %s %s (ttl: %d)", k, rrtype, value, ttl)
+	return nil
+}
+
+func (h *localrecords) remove(name, rrtype string) bool {
+	k, err := localkey(name)
+	if err != nil {
+		return false
+	}
+	var qtyp uint16 // dns.TypeNone; removes all
+	if len(rrtype) > 0 {
+		var ok bool
+		if qtyp, ok = dns.StringToType[strings.ToUpper(rrtype)]; !ok {
+			return false
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	recs := h.recs[k]
+	rest := make([]*localrr, 0, len(recs))
+	for _, rr := range recs {
+		if qtyp != dns.TypeNone && rr.qtyp != qtyp {
+			rest = append(rest, rr)
+		}
+	}
+	if len(rest) <= 0 {
+		delete(h.recs, k)
+		h.names.Del(k)
+	} else {
+		h.recs[k] = rest
+	}
+
+	log.I("dns: local: rm %s %s; %d/%d", k, rrtype, len(recs)-len(rest), len(recs))
+	return len(rest) < len(recs)
+}
+
+func (h *localrecords) list() string {
+	h.RLock()
+	defer h.RUnlock()
+
+	lines := make([]string, 0, len(h.recs))
+	for k, recs := range h.recs {
+		name := k
+		if strings.HasPrefix(k, ".") {
+			name = "*" + k
+		}
+		for _, rr := range recs {
+			if r := rr.make(dns.Fqdn(name)); r != nil {
+				lines = append(lines, r.String())
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// matchLocked returns the records for the most specific name or
+// wildcard that covers qname, if any. qname must be normalized.
+func (h *localrecords) matchLocked(qname string) []*localrr {
+	if h.names.Len() <= 0 {
+		return nil
+	}
+	if h.names.Has(qname) {
+		return h.recs[qname]
+	}
+	// walk up the labels: a.b.lab.home => .b.lab.home, .lab.home, .home
+	for rest := qname; ; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		parent := rest[i:] // has leading dot
+		if h.names.Has(parent) {
+			return h.recs[parent]
+		}
+		rest = rest[i+1:]
+	}
+	return nil
+}
+
+func (h *localrecords) lookup(qname string, qtyp uint16) (cname *localrr, recs []*localrr) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, rr := range h.matchLocked(qname) {
+		if rr.qtyp == dns.TypeCNAME {
+			cname = rr
+		} else if rr.qtyp == qtyp {
+			recs = append(recs, rr)
+		}
+	}
+	return
+}
+
+// answer synthesizes a response to q from local records, if any;
+// nil if there are no records for q's name and type.
+func (h *localrecords) answer(q *dns.Msg) *dns.Msg {
+	if h == nil || !xdns.HasAnyQuestion(q) {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	qname, err := xdns.NormalizeQName(question.Name)
+	if err != nil {
+		return nil
+	}
+
+	cname, recs := h.lookup(qname, question.Qtype)
+	var rrs []dns.RR
+	if cname != nil {
+		rrs = append(rrs, cname.make(question.Name))
+		if question.Qtype != dns.TypeCNAME {
+			// chase the cname only one level deep, and only among local records;
+			// clients re-query the target if the answer has no records for it
+			target := dns.Fqdn(cname.value)
+			tname, _ := xdns.NormalizeQName(target)
+			_, trecs := h.lookup(tname, question.Qtype)
+			for _, rr := range trecs {
+				rrs = append(rrs, rr.make(target))
+			}
+		}
+	} else {
+		for _, rr := range recs {
+			rrs = append(rrs, rr.make(question.Name))
+		}
+	}
+	if len(rrs) <= 0 { // no records of qtype; let it through to upstream
+		return nil
+	}
+
+	ans := xdns.EmptyResponseFromMessage(q)
+	if ans == nil {
+		return nil
+	}
+	ans.Rcode = dns.RcodeSuccess
+	ans.Authoritative = true
+	for _, rr := range rrs {
+		if rr != nil {
+			ans.Answer = append(ans.Answer, rr)
+		}
+	}
+	return ans
+}
+
+func (rr *localrr) make(name string) dns.RR {
+	switch rr.qtyp {
+	case dns.TypeA:
+		return xdns.MakeARecord(name, rr.value, rr.ttl)
+	case dns.TypeAAAA:
+		return xdns.MakeAAAARecord(name, rr.value, rr.ttl)
+	case dns.TypeCNAME:
+		return xdns.MakeCNAMERecord(name, rr.value, rr.ttl)
+	case dns.TypeTXT:
+		return xdns.MakeTXTRecord(name, rr.value, rr.ttl)
+	}
+	return nil
+}
+
+func withLocalRecsSummary(smm *x.DNSSummary) {
+	smm.ID = LocalRecs
+	smm.Type = LocalRecs
+	smm.Server = LocalRecs
+	smm.Status = Complete
+	smm.Blocklists = ""  // blocklists are not honoured
+	smm.RelayServer = "" // no relay is used
+}
+
+// Implements x.LocalRecords
+func (r *resolver) AddLocalRecord(name, rrtype, value string, ttl int) error {
+	return r.hosts.add(name, rrtype, value, ttl)
+}
+
+// Implements x.LocalRecords
+func (r *resolver) RemoveLocalRecord(name, rrtype string) bool {
+	return r.hosts.remove(name, rrtype)
+}
+
+// Implements x.LocalRecords
+func (r *resolver) ListLocalRecords() string {
+	return r.hosts.list()
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"slices"
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/miekg/dns"
+)
+
+// rdata returns the owner, type, and value of each rr in ans.
+func rdata(ans *dns.Msg) (out []string) {
+	if ans == nil {
+		return nil
+	}
+	for _, rr := range ans.Answer {
+		v := ""
+		switch r := rr.(type) {
+		case *dns.A:
+			v = r.A.String()
+		case *dns.AAAA:
+			v = r.AAAA.String()
+		case *dns.CNAME:
+			v = r.Target
+		case *dns.TXT:
+			v = r.Txt[0]
+		}
+		out = append(out, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]+" "+v)
+	}
+	return
+}
+
+func TestLocalRecordsAnswer(t *testing.T) {
+	h := newLocalRecords()
+	for _, rec := range [][3]string{
+		{"*.lab.home", "A", "10.0.0.1"},
+		{"nas.lab.home", "A", "10.0.0.2"},
+		{"nas.lab.home", "AAAA", "fd00::2"},
+		{"www.home", "CNAME", "nas.lab.home"},
+		{"ext.home", "CNAME", "example.com"},
+		{"txt.home", "TXT", "v=1"},
+	} {
+		if err := h.add(rec[0], rec[1], rec[2], 60); err != nil {
+			t.Fatalf("local: add %v: %v", rec, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		qtyp uint16
+		want []string // nil if let through to upstream
+	}{
+		// wildcards cover all subdomains, but not the name itself
+		{"a.lab.home.", dns.TypeA, []string{"a.lab.home. A 10.0.0.1"}},
+		{"x.y.lab.home.", dns.TypeA, []string{"x.y.lab.home. A 10.0.0.1"}},
+		{"lab.home.", dns.TypeA, nil},
+		// the most specific name wins over wildcards
+		{"NAS.lab.home.", dns.TypeA, []string{"NAS.lab.home. A 10.0.0.2"}},
+		{"nas.lab.home.", dns.TypeAAAA, []string{"nas.lab.home. AAAA fd00::2"}},
+		// cnames are chased a level deep, among local records only
+		{"www.home.", dns.TypeA, []string{"www.home. CNAME nas.lab.home.", "nas.lab.home. A 10.0.0.2"}},
+		{"www.home.", dns.TypeAAAA, []string{"www.home. CNAME nas.lab.home.", "nas.lab.home. AAAA fd00::2"}},
+		{"www.home.", dns.TypeCNAME, []string{"www.home. CNAME nas.lab.home."}},
+		{"ext.home.", dns.TypeA, []string{"ext.home. CNAME example.com."}},
+		// types with no records pass through
+		{"a.lab.home.", dns.TypeAAAA, nil},
+		{"txt.home.", dns.TypeA, nil},
+		{"txt.home.", dns.TypeTXT, []string{"txt.home. TXT v=1"}},
+		{"nas.lab.home.", dns.TypeMX, nil},
+		{"other.home.", dns.TypeA, nil},
+	}
+	for _, tc := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tc.name, tc.qtyp)
+		ans := h.answer(q)
+		if got := rdata(ans); !slices.Equal(got, tc.want) {
+			t.Errorf("local: %s %s: got %q; want %q", tc.name, dns.TypeToString[tc.qtyp], got, tc.want)
+		}
+		if ans != nil && (!ans.Authoritative || ans.Rcode != dns.RcodeSuccess) {
+			t.Errorf("local: %s %s: not an authoritative answer", tc.name, dns.TypeToString[tc.qtyp])
+		}
+	}
+
+	// non-internet classes pass through
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lab.home.", dns.TypeA)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	if ans := h.answer(q); ans != nil {
+		t.Errorf("local: chaos class answered: %v", rdata(ans))
+	}
+}
+
+func TestLocalRecordsAdd(t *testing.T) {
+	h := newLocalRecords()
+	if err := h.add("www.home", "CNAME", "nas.home", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, typ, value string
+		want             error
+	}{
+		{"www.home", "A", "10.0.0.1", errBadLocalType}, // cnames stand alone
+		{"nas.home", "MX", "mx.home", errBadLocalType},
+		{"nas.home", "A", "fd00::1", errBadLocalValue},
+		{"nas.home", "AAAA", "10.0.0.1", errBadLocalValue},
+		{"nas.home", "A", "nope", errBadLocalValue},
+		{"*.*.home", "A", "10.0.0.1", errBadLocalName},
+		{"*.", "A", "10.0.0.1", errBadLocalName},
+		{"nas.home", "a", "::ffff:10.0.0.1", nil}, // types in any case; ip4-mapped unmapped
+	}
+	for _, tc := range tests {
+		if err := h.add(tc.name, tc.typ, tc.value, 0); err != tc.want {
+			t.Errorf("local: add %s %s %s: got %v; want %v", tc.name, tc.typ, tc.value, err, tc.want)
+		}
+	}
+
+	if !h.remove("www.home", "") || h.remove("www.home", "") {
+		t.Errorf("local: www.home not removed just once")
+	}
+	if err := h.add("www.home", "A", "10.0.0.1", 0); err != nil {
+		t.Errorf("local: add after remove: %v", err)
+	}
+}
+
+func TestLocalRecsReserved(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{LocalRecs, true},
+		{Local, true},           // mdns
+		{"local", false},        // ids are case-sensitive
+		{CT + LocalRecs, false}, // never cached
+	}
+	for _, tc := range tests {
+		if got := isReserved(tc.id); got != tc.want {
+			t.Errorf("reserved: %s: got %t; want %t", tc.id, got, tc.want)
+		}
+	}
+	if LocalRecs == Local {
+		t.Errorf("reserved: local records and mdns share id %s", Local)
+	}
+
+	smm := new(x.DNSSummary)
+	withLocalRecsSummary(smm)
+	if smm.ID != "Local" || smm.Type != "Local" {
+		t.Errorf("local: summary id %s, type %s; want Local", smm.ID, smm.Type)
+	}
+}
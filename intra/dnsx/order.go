@@ -0,0 +1,107 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"cmp"
+	"net/netip"
+	"strings"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/dialers"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	AnswerPreserve  = x.AnswerPreserve
+	AnswerShuffle   = x.AnswerShuffle
+	AnswerByLatency = x.AnswerByLatency
+)
+
+// answer orders as noted in x.DNSSummary.Order
+const (
+	orderShuffle = "shuffle"
+	orderLatency = "latency"
+)
+
+// rttFunc returns the connect latency to ip, if known.
+type rttFunc func(ip netip.Addr) (time.Duration, bool)
+
+// SetAnswerOrder implements x.AnswerOrderer.
+func (r *resolver) SetAnswerOrder(mode int) {
+	switch mode {
+	case AnswerShuffle, AnswerByLatency:
+	default:
+		mode = AnswerPreserve
+	}
+	r.order.Store(int32(mode))
+	log.I("dns: answer order %d", mode)
+}
+
+// orderAnswer reorders ips in A and AAAA RRsets of ans, in place, as per
+// the answer order set; and notes the order in smm, if ans was reordered.
+// Cached answers are stored as sent by upstreams, and ordered on each hit,
+// as this is called on every answer just before it is sent to the client.
+func (r *resolver) orderAnswer(ans *dns.Msg, smm *x.DNSSummary) (ok bool) {
+	switch r.order.Load() {
+	case AnswerShuffle:
+		// successive queries see successive ips first
+		ok = xdns.RotateIPs(ans, int(r.rotor.Add(1)))
+		if ok {
+			smm.Order = orderShuffle
+		}
+	case AnswerByLatency:
+		ok = xdns.SortIPs(ans, byLatency(r.rttOf))
+		if ok {
+			smm.Order = orderLatency
+		}
+	}
+	return ok
+}
+
+// rttOf returns the connect latency to ip, or the least of the latencies
+// to its real ips, if ip is an alg ip.
+func (r *resolver) rttOf(ip netip.Addr) (d time.Duration, ok bool) {
+	if d, ok = dialers.RTT(ip); ok {
+		return d, ok
+	}
+	gw := r.Gateway()
+	if gw == nil {
+		return d, ok
+	}
+	for _, s := range strings.Split(gw.X(ip.AsSlice()), ",") {
+		realip, err := netip.ParseAddr(s)
+		if err != nil || realip == ip {
+			continue
+		}
+		if rd, rok := dialers.RTT(realip); rok && (!ok || rd < d) {
+			d, ok = rd, true
+		}
+	}
+	return d, ok
+}
+
+// byLatency orders ips by their latencies, lowest first; ips with no
+// latencies are placed after those with.
+func byLatency(rtt rttFunc) func(a, b netip.Addr) int {
+	return func(a, b netip.Addr) int {
+		da, oka := rtt(a)
+		db, okb := rtt(b)
+		switch {
+		case oka && okb:
+			return cmp.Compare(da, db)
+		case oka:
+			return -1
+		case okb:
+			return 1
+		}
+		return 0
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func orderQuery(t *testing.T, tr Transport) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("rr.example.", dns.TypeA)
+	qb, _ := q.Pack()
+	res, err := tr.Query(NetTypeUDP, qb, new(x.DNSSummary))
+	if err != nil {
+		t.Fatalf("order: err %v", err)
+	}
+	return xdns.AsMsg(res)
+}
+
+func firstIP(ans *dns.Msg) string {
+	if ips := xdns.AAnswer(ans); len(ips) > 0 {
+		return ips[0].String()
+	}
+	return ""
+}
+
+func TestOrderCachedAnswers(t *testing.T) {
+	tr := fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{
+			xdns.MakeARecord(n, "10.0.0.1", 60),
+			xdns.MakeARecord(n, "10.0.0.2", 60),
+			xdns.MakeARecord(n, "10.0.0.3", 60),
+		}
+	}}
+	ct := newCachingTransport(tr, time.Minute, nil)
+	r := &resolver{}
+
+	// preserve: as sent by the upstream
+	smm := new(x.DNSSummary)
+	if ans := orderQuery(t, ct); r.orderAnswer(ans, smm) || firstIP(ans) != "10.0.0.1" {
+		t.Fatalf("order: preserve: reordered %s", firstIP(ans))
+	}
+	if len(smm.Order) > 0 {
+		t.Errorf("order: preserve: noted %q", smm.Order)
+	}
+
+	// shuffle: each hit on the cache sees the next ip first
+	r.SetAnswerOrder(AnswerShuffle)
+	var firsts []string
+	for i := 0; i < 3; i++ {
+		smm := new(x.DNSSummary)
+		ans := orderQuery(t, ct)
+		r.orderAnswer(ans, smm)
+		firsts = append(firsts, firstIP(ans))
+		if i < 2 && smm.Order != orderShuffle {
+			t.Errorf("order: shuffle: noted %q", smm.Order)
+		}
+	}
+	if want := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}; !slices.Equal(firsts, want) {
+		t.Errorf("order: shuffle: want %v, got %v", want, firsts)
+	}
+	// the cache holds on to the upstream's order
+	if got := firstIP(orderQuery(t, ct)); got != "10.0.0.1" {
+		t.Errorf("order: cache: want 10.0.0.1 first, got %s", got)
+	}
+}
+
+func TestByLatency(t *testing.T) {
+	rtts := map[string]time.Duration{"10.0.0.2": 30 * time.Millisecond, "10.0.0.3": 10 * time.Millisecond}
+	rtt := func(ip netip.Addr) (d time.Duration, ok bool) {
+		d, ok = rtts[ip.String()]
+		return
+	}
+	ans := new(dns.Msg)
+	ans.Answer = []dns.RR{
+		xdns.MakeARecord("rr.example.", "10.0.0.1", 60),
+		xdns.MakeARecord("rr.example.", "10.0.0.2", 60),
+		xdns.MakeARecord("rr.example.", "10.0.0.3", 60),
+	}
+	xdns.SortIPs(ans, byLatency(rtt))
+	var got []string
+	for _, ip := range xdns.AAnswer(ans) {
+		got = append(got, ip.String())
+	}
+	if want := []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}; !slices.Equal(got, want) {
+		t.Errorf("order: latency: want %v, got %v", want, got)
+	}
+}
@@ -1,9 +1,11 @@
 package dnsx
 
 import (
+	"errors"
 	"net/netip"
 	"strings"
 
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/celzero/firestack/intra/settings"
 )
@@ -27,8 +29,26 @@ func (h *resolver) isDnsPort(addr netip.AddrPort) bool {
 	return false
 }
 
+var errBadPassthrough = errors.New("dns passthrough: invalid ip or cidr")
+
+// passes returns true if addr is allowed past DNSModePort; see: SetDnsPassthrough.
+func (h *resolver) passes(addr netip.AddrPort) bool {
+	pfxs := h.passthru.Load()
+	if pfxs == nil {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	for _, pfx := range *pfxs {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *resolver) isDns(ipport string) bool {
-	if ipp, err := netip.ParseAddrPort(ipport); err != nil {
+	// dnsaddrs are unmapped; see addDnsAddrs
+	if ipp, err := core.ParseAddrPort(ipport); err != nil {
 		return false
 	} else {
 		if !ipp.IsValid() || len(h.dnsaddrs) <= 0 {
@@ -41,13 +61,57 @@ func (h *resolver) isDns(ipport string) bool {
 			}
 		} else if h.trapPort() {
 			if yes := h.isDnsPort(ipp); yes {
-				return true
+				// fake dns addrs are never passed through
+				return h.isDnsIpPort(ipp) || !h.passes(ipp)
 			}
 		}
 		return false
 	}
 }
 
+// IsDivertedDnsAddr returns true if ipport is trapped (see: IsDnsAddr) only
+// because DNSModePort traps all dns, and is not one of the fake dns addrs.
+func (h *resolver) IsDivertedDnsAddr(ipport string) bool {
+	if !h.trapPort() || !h.isDns(ipport) {
+		return false
+	}
+	ipp, err := core.ParseAddrPort(ipport)
+	return err == nil && !h.isDnsIpPort(ipp)
+}
+
+// SetDnsPassthrough sets ips or cidrs (csv) dns to which is let through
+// as-is in DNSModePort (ex: of a router, for captive portal logins); an
+// empty csv clears them. Nothing changes on errors.
+func (h *resolver) SetDnsPassthrough(csv string) error {
+	if len(csv) <= 0 {
+		h.passthru.Store(nil)
+		log.I("dnsx: passthrough: cleared")
+		return nil
+	}
+	pfxs := make([]netip.Prefix, 0)
+	for _, v := range strings.Split(csv, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) <= 0 {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			pfx, err := netip.ParsePrefix(v)
+			if err != nil {
+				return errors.Join(errBadPassthrough, err)
+			}
+			pfxs = append(pfxs, pfx.Masked())
+		} else if ip, err := netip.ParseAddr(v); err == nil {
+			ip = ip.Unmap()
+			pfxs = append(pfxs, netip.PrefixFrom(ip, ip.BitLen()))
+		} else {
+			return errors.Join(errBadPassthrough, err)
+		}
+	}
+	h.passthru.Store(&pfxs)
+	log.I("dnsx: passthrough: %v", pfxs)
+	return nil
+}
+
 func (h *resolver) trapIP() bool {
 	return h.tunmode.DNSMode == settings.DNSModeIP
 }
@@ -64,7 +128,7 @@ func (r *resolver) addDnsAddrs(csvaddr string) {
 		return
 	}
 	for _, a := range addrs {
-		if ipp, err := netip.ParseAddrPort(a); ipp.IsValid() && err == nil {
+		if ipp, err := core.ParseAddrPort(a); ipp.IsValid() && err == nil {
 			dnsaddrs = append(dnsaddrs, ipp)
 		} else {
 			log.W("dnsx: not valid fake udpaddr(%s <=> %s): %v", ipp, a, err)
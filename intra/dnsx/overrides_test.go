@@ -0,0 +1,68 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestIsDnsPortPassthrough(t *testing.T) {
+	mode := &settings.TunMode{DNSMode: settings.DNSModeIP}
+	r := &resolver{tunmode: mode}
+	r.addDnsAddrs("10.111.222.3:53")
+
+	// narrow: only fake dns addrs
+	if r.IsDnsAddr("1.1.1.1:53") || r.IsDivertedDnsAddr("1.1.1.1:53") {
+		t.Errorf("dnsmode ip: public resolver trapped")
+	}
+	if !r.IsDnsAddr("10.111.222.3:53") || r.IsDivertedDnsAddr("10.111.222.3:53") {
+		t.Errorf("dnsmode ip: fake dns not trapped, or diverted")
+	}
+
+	// all port 53, switched at runtime
+	mode.SetMode(settings.DNSModePort, settings.BlockModeNone, settings.PtModeAuto)
+	if !r.IsDnsAddr("1.1.1.1:53") || !r.IsDivertedDnsAddr("[2606:4700::1111]:53") {
+		t.Errorf("dnsmode port: public resolver not diverted")
+	}
+	if r.IsDnsAddr("1.1.1.1:443") {
+		t.Errorf("dnsmode port: non-dns port trapped")
+	}
+	if !r.IsDnsAddr("10.111.222.3:53") || r.IsDivertedDnsAddr("10.111.222.3:53") {
+		t.Errorf("dnsmode port: fake dns not trapped, or diverted")
+	}
+
+	if err := r.SetDnsPassthrough("192.168.1.1, fd00::/8"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []string{"192.168.1.1:53", "[::ffff:192.168.1.1]:53", "[fd00::1]:53"} {
+		if r.IsDnsAddr(dst) || r.IsDivertedDnsAddr(dst) {
+			t.Errorf("dnsmode port: passthrough %s trapped", dst)
+		}
+	}
+	if !r.IsDivertedDnsAddr("192.168.1.2:53") {
+		t.Errorf("dnsmode port: 192.168.1.2 not diverted")
+	}
+	if err := r.SetDnsPassthrough("10.111.222.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsDnsAddr("10.111.222.3:53") {
+		t.Errorf("dnsmode port: fake dns passed through")
+	}
+
+	if err := r.SetDnsPassthrough("192.168.1.1,nope"); err == nil {
+		t.Errorf("passthrough: want err on bad csv")
+	}
+	if !r.passes(netip.MustParseAddrPort("10.111.222.9:53")) {
+		t.Errorf("passthrough: changed on err")
+	}
+	if err := r.SetDnsPassthrough(""); err != nil || r.passes(netip.MustParseAddrPort("10.111.222.9:53")) {
+		t.Errorf("passthrough: not cleared: %v", err)
+	}
+}
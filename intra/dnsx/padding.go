@@ -0,0 +1,101 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync/atomic"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	PadOff         = x.PadOff
+	PadFixed       = x.PadFixed
+	PadRecommended = x.PadRecommended
+
+	// block size of padded queries; rfc8467 sec 4.1
+	recommendedPadBlock = 128
+	// min and max block sizes for PadFixed
+	minPadBlock = 16
+	maxPadBlock = 4096
+)
+
+var errBadPadding = errors.New("invalid padding policy or block size")
+
+// Padding pads queries of encrypted transports (DoH, ODoH, DoT) with edns0
+// padding (rfc7830) to hide their lengths, as per the policy set, and strips
+// padding off their answers, so that stubs never see it. Plain dns is never
+// padded: it is of no use in the clear, and only makes the traffic stand out.
+// The zero value pads nothing; see: NewPadding.
+type Padding struct {
+	block atomic.Int32 // queries are padded to multiples of block; 0 disables
+}
+
+// NewPadding returns a Padding with the PadRecommended policy.
+func NewPadding() *Padding {
+	p := new(Padding)
+	p.block.Store(recommendedPadBlock)
+	return p
+}
+
+// Set sets the policy: PadOff, PadFixed (to multiples of block), or PadRecommended.
+func (p *Padding) Set(policy, block int) error {
+	switch policy {
+	case PadOff:
+		block = 0
+	case PadRecommended:
+		block = recommendedPadBlock
+	case PadFixed:
+		if block < minPadBlock || block > maxPadBlock {
+			return errBadPadding
+		}
+	default:
+		return errBadPadding
+	}
+	p.block.Store(int32(block))
+	log.I("dns: padding: policy %d; block %d", policy, block)
+	return nil
+}
+
+// Pad returns q padded to the block size set, but never past the udp size it
+// advertises (or xdns.MaxDNSPacketSize if none); q as-is, if it can't be.
+func (p *Padding) Pad(q []byte) []byte {
+	block := int(p.block.Load())
+	if block <= 0 {
+		return q
+	}
+	msg := xdns.AsMsg(q)
+	if msg == nil {
+		return q
+	}
+	limit := xdns.MaxDNSPacketSize
+	if edns0 := msg.IsEdns0(); edns0 != nil {
+		limit = max(int(edns0.UDPSize()), dns.MinMsgSize)
+	}
+	padded, err := xdns.AddEDNS0PaddingToBlock(msg, block, limit)
+	if err != nil {
+		log.D("dns: padding: %d bytes; err: %v", len(q), err)
+		return q
+	}
+	return padded
+}
+
+// Unpad returns r with its padding stripped, if any.
+func (p *Padding) Unpad(r []byte) []byte {
+	msg := xdns.AsMsg(r)
+	if msg == nil || !xdns.RemoveEDNS0Padding(msg) {
+		return r
+	}
+	if b, err := msg.Pack(); err == nil {
+		return b
+	}
+	return r
+}
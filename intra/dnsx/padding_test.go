@@ -0,0 +1,66 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadding(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	qb, _ := q.Pack()
+
+	p := NewPadding()
+	if b := p.Pad(qb); len(b)%recommendedPadBlock != 0 {
+		t.Errorf("recommended: len %d not a multiple of %d", len(b), recommendedPadBlock)
+	}
+	if err := p.Set(PadFixed, 256); err != nil {
+		t.Fatal(err)
+	}
+	if b := p.Pad(qb); len(b) != 256 {
+		t.Errorf("fixed: len %d; want 256", len(b))
+	}
+	// padded past the advertised udp size (of 512) is not
+	if err := p.Set(PadFixed, 4096); err != nil {
+		t.Fatal(err)
+	}
+	q.SetEdns0(dns.MinMsgSize, false)
+	ednsqb, _ := q.Pack()
+	if b := p.Pad(ednsqb); len(b) != dns.MinMsgSize {
+		t.Errorf("fixed: len %d; want the advertised %d", len(b), dns.MinMsgSize)
+	}
+	if err := p.Set(PadOff, 0); err != nil {
+		t.Fatal(err)
+	}
+	if b := p.Pad(qb); len(b) != len(qb) {
+		t.Errorf("off: len %d; want %d", len(b), len(qb))
+	}
+	for _, bad := range [][2]int{{PadFixed, 0}, {PadFixed, 1 << 16}, {-1, 128}, {PadRecommended + 1, 128}} {
+		if err := p.Set(bad[0], bad[1]); err == nil {
+			t.Errorf("set(%d, %d): want err", bad[0], bad[1])
+		}
+	}
+
+	// answers are unpadded
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = append(a.Answer, &dns.A{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(1, 2, 3, 4)})
+	a.SetEdns0(dns.MinMsgSize, false)
+	a.IsEdns0().Option = append(a.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+	padded, _ := a.Pack()
+	r := p.Unpad(padded)
+	if len(r) != len(padded)-104 {
+		t.Errorf("unpad: len %d; want %d", len(r), len(padded)-104)
+	}
+	if b := p.Unpad(r); len(b) != len(r) {
+		t.Errorf("unpad: unpadded len %d; want %d", len(b), len(r))
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	x "github.com/celzero/firestack/intra/backend"
+)
+
+const (
+	RouteDefault         = x.RouteDefault
+	RouteListener        = x.RouteListener
+	RouteChosen          = x.RouteChosen
+	RouteBlockAll        = x.RouteBlockAll
+	RouteUndelegated     = x.RouteUndelegated
+	RouteMDNS            = x.RouteMDNS
+	RouteAlg             = x.RouteAlg
+	RouteFallback        = x.RouteFallback
+	RouteDomain          = x.RouteDomain
+	RouteServedOver      = x.RouteServedOver
+	RouteExit            = x.RouteExit
+	RouteLocalRecords    = x.RouteLocalRecords
+	RouteUID             = x.RouteUID
+	RouteListenerTimeout = x.RouteListenerTimeout
+)
+
+// routed notes in smm that the query was sent where it was for route,
+// as why says; decisions made later in the pipeline overwrite earlier ones.
+func routed(smm *x.DNSSummary, route int, why string) {
+	if smm == nil {
+		return
+	}
+	smm.Route = route
+	smm.RouteWhy = why
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/miekg/dns"
+)
+
+func TestRouteProvenance(t *testing.T) {
+	r := &resolver{localdomains: newUndelegatedDomainsTrie(), uids: newUIDTransports()}
+	if err := r.SetUIDTransport("10100", "work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetUIDTransport(unknownuid, "work"); err == nil {
+		t.Error("route: want err for unknown uid")
+	}
+
+	cases := []struct {
+		qname  string
+		opts   *x.DNSOpts
+		uid    string
+		chosen []string
+		id     string
+		route  int
+		why    string
+	}{
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred|1500"}, "", nil, Preferred, RouteListener, "Preferred|1500"},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred"}, "", []string{CT + Goos}, CT + Goos, RouteChosen, CT + Goos},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred,BlockAll"}, "", nil, BlockAll, RouteBlockAll, BlockAll},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred", IPCSV: "0.0.0.0"}, "", nil, BlockAll, RouteBlockAll, "unspecified ips"},
+		{"printer.local", &x.DNSOpts{TIDCSV: "Preferred"}, "", nil, Local, RouteMDNS, "*.local"},
+		{"lan", &x.DNSOpts{TIDCSV: "Preferred"}, "", nil, Goos, RouteUndelegated, "lan"},
+		{"10.in-addr.arpa", &x.DNSOpts{TIDCSV: "Preferred"}, "", nil, Goos, RouteUndelegated, "10.in-addr.arpa"},
+		{"example.com", &x.DNSOpts{}, "", nil, "", RouteDefault, ""},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred"}, "10100", nil, "work", RouteUID, "10100"},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred"}, "10101", nil, Preferred, RouteListener, "Preferred"},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred"}, unknownuid, nil, Preferred, RouteListener, "Preferred"},
+		{"example.com", &x.DNSOpts{TIDCSV: "BlockAll"}, "10100", nil, BlockAll, RouteBlockAll, BlockAll},
+		{"example.com", &x.DNSOpts{TIDCSV: "Preferred"}, "10100", []string{CT + Goos}, CT + Goos, RouteChosen, CT + Goos},
+	}
+	for _, c := range cases {
+		smm := new(x.DNSSummary)
+		id, _, _, _, _ := r.preferencesFrom(c.qname, dns.TypeA, c.opts, smm, c.uid, c.chosen...)
+		if id != c.id {
+			t.Errorf("route: %s %v (uid %s): want id %s, got %s", c.qname, c.opts, c.uid, c.id, id)
+		}
+		if smm.Route != c.route || smm.RouteWhy != c.why {
+			t.Errorf("route: %s %v: want %s(%s), got %s(%s)", c.qname, c.opts,
+				x.RouteName(c.route), c.why, x.RouteName(smm.Route), smm.RouteWhy)
+		}
+	}
+	if err := r.SetUIDTransport("10100", ""); err != nil || len(r.ListUIDTransports()) > 0 {
+		t.Errorf("route: uid transports left %q; err? %v", r.ListUIDTransports(), err)
+	}
+}
+
+func TestRouteFallback(t *testing.T) {
+	sys, goos, def := newFakeMember(System, false), newFakeMember(Goos, false), newFakeMember(CT+Default, false)
+	r := &resolver{transports: map[string]Transport{Goos: goos, CT + Default: def}}
+
+	if tr, fellback := r.transportFor(System); tr != goos || !fellback {
+		t.Errorf("route: want Goos for missing System, got %v %t", tr, fellback)
+	}
+	r.transports[System] = sys
+	// Goos is resolved on System, if any; which is not a fallback
+	if tr, fellback := r.transportFor(Goos); tr != sys || fellback {
+		t.Errorf("route: want System for Goos, got %v %t", tr, fellback)
+	}
+	if tr, fellback := r.transportFor(Preferred); tr != def || !fellback {
+		t.Errorf("route: want Default for missing Preferred, got %v %t", tr, fellback)
+	}
+	if tr, fellback := r.transportFor(BlockAll); tr != nil || fellback {
+		t.Errorf("route: want nothing for missing BlockAll, got %v %t", tr, fellback)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 
 	x "github.com/celzero/firestack/intra/backend"
+	"github.com/miekg/dns"
 )
 
 const (
@@ -21,6 +22,8 @@ const (
 	InternalError  = x.InternalError
 	TransportError = x.TransportError
 	ClientError    = x.ClientError
+	AuthError      = x.AuthError
+	StrictError    = x.StrictError
 )
 
 var noerr = errors.New("no error")
@@ -65,11 +68,46 @@ func (e *QueryError) strstatus() string {
 		return "TransportError"
 	case ClientError:
 		return "ClientError"
+	case AuthError:
+		return "AuthError"
+	case StrictError:
+		return "StrictError"
 	default:
 		return "Unknown"
 	}
 }
 
+// ErrCode returns the stable code (x.ErrNone, x.ErrDNSServfail etc) for
+// query status and its response code, rcode.
+func ErrCode(status, rcode int) int {
+	switch status {
+	case Start, Complete:
+		if rcode == dns.RcodeServerFailure {
+			return x.ErrDNSServfail
+		}
+		return x.ErrNone
+	case SendFailed:
+		return x.ErrDNSSendFailed
+	case NoResponse:
+		return x.ErrDNSNoResponse
+	case BadQuery:
+		return x.ErrDNSBadQuery
+	case BadResponse:
+		return x.ErrDNSBadResponse
+	case InternalError:
+		return x.ErrDNSInternal
+	case TransportError:
+		return x.ErrDNSTransport
+	case ClientError:
+		return x.ErrDNSClient
+	case AuthError:
+		return x.ErrDNSAuth
+	case StrictError:
+		return x.ErrDNSStrict
+	}
+	return x.ErrUnknown
+}
+
 func (e *QueryError) String() string {
 	return e.strstatus() + ":" + e.Error()
 }
@@ -111,3 +149,8 @@ func NewTransportQueryError(err error) *QueryError {
 func NewClientQueryError(err error) *QueryError {
 	return newQueryError(ClientError, err)
 }
+
+// with http, for 401 and 403 errors
+func NewAuthQueryError(err error) *QueryError {
+	return newQueryError(AuthError, err)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	MultiQFirst  = x.MultiQFirst
+	MultiQRefuse = x.MultiQRefuse
+)
+
+var (
+	errManyQuestions = errors.New("many questions")
+	errNotStdQuery   = errors.New("not a standard query")
+)
+
+// SetMultiQuestion implements x.QuestionsPolicy.
+func (r *resolver) SetMultiQuestion(mode int) {
+	if mode != MultiQRefuse {
+		mode = MultiQFirst
+	}
+	r.multiq.Store(int32(mode))
+	log.I("dns: multi-question mode %d", mode)
+}
+
+// vet returns an answer for msg that must be sent back as-is instead of
+// forwarding msg, along with why; msg is answered locally if it is not a
+// standard query (NOTIMP), has no questions (FORMERR), or has many (REFUSED),
+// unless all but its first question are to be stripped, in which case,
+// msg is modified in place, and nil is returned along with stripped set.
+func (r *resolver) vet(msg *dns.Msg) (ans *dns.Msg, stripped bool, why error) {
+	switch {
+	case !xdns.IsStdQuery(msg):
+		return xdns.RcodeResponseFromMessage(msg, dns.RcodeNotImplemented), false, errNotStdQuery
+	case !xdns.HasAnyQuestion(msg):
+		return xdns.RcodeResponseFromMessage(msg, dns.RcodeFormatError), false, errNoQuestion
+	case xdns.HasManyQuestions(msg):
+		if r.multiq.Load() == MultiQRefuse {
+			return xdns.RcodeResponseFromMessage(msg, dns.RcodeRefused), false, errManyQuestions
+		}
+		return nil, xdns.StripExtraQuestions(msg) > 0, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func questionsMsg(op, nq int) *dns.Msg {
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.Opcode = op
+	m.RecursionDesired = true
+	for i := range nq {
+		qname := []string{"one.example.", "two.example.", "three.example."}[i]
+		m.Question = append(m.Question, dns.Question{Name: qname, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}
+	return m
+}
+
+func TestQuestionsVet(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       int
+		nq       int
+		mode     int
+		rcode    int  // of the local answer; -1 if forwarded
+		stripped bool // extra questions stripped
+		why      error
+	}{
+		{"query/0", dns.OpcodeQuery, 0, MultiQFirst, dns.RcodeFormatError, false, errNoQuestion},
+		{"query/1", dns.OpcodeQuery, 1, MultiQFirst, -1, false, nil},
+		{"query/1/refuse", dns.OpcodeQuery, 1, MultiQRefuse, -1, false, nil},
+		{"query/2/first", dns.OpcodeQuery, 2, MultiQFirst, -1, true, nil},
+		{"query/3/first", dns.OpcodeQuery, 3, MultiQFirst, -1, true, nil},
+		{"query/2/refuse", dns.OpcodeQuery, 2, MultiQRefuse, dns.RcodeRefused, false, errManyQuestions},
+		{"notify/0", dns.OpcodeNotify, 0, MultiQFirst, dns.RcodeNotImplemented, false, errNotStdQuery},
+		{"notify/1", dns.OpcodeNotify, 1, MultiQFirst, dns.RcodeNotImplemented, false, errNotStdQuery},
+		{"notify/2", dns.OpcodeNotify, 2, MultiQRefuse, dns.RcodeNotImplemented, false, errNotStdQuery},
+		{"update/0", dns.OpcodeUpdate, 0, MultiQFirst, dns.RcodeNotImplemented, false, errNotStdQuery},
+		{"update/1", dns.OpcodeUpdate, 1, MultiQFirst, dns.RcodeNotImplemented, false, errNotStdQuery},
+		{"status/1", dns.OpcodeStatus, 1, MultiQFirst, dns.RcodeNotImplemented, false, errNotStdQuery},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &resolver{}
+			r.SetMultiQuestion(tc.mode)
+			msg := questionsMsg(tc.op, tc.nq)
+
+			ans, stripped, why := r.vet(msg)
+			if !errors.Is(why, tc.why) {
+				t.Errorf("questions: want err %v, got %v", tc.why, why)
+			}
+			if stripped != tc.stripped {
+				t.Errorf("questions: want stripped %t, got %t", tc.stripped, stripped)
+			}
+			if tc.rcode < 0 {
+				if ans != nil {
+					t.Fatalf("questions: want forwarded, got answer %s", dns.RcodeToString[ans.Rcode])
+				}
+				if n := len(msg.Question); n != 1 {
+					t.Fatalf("questions: want 1 question forwarded, got %d", n)
+				}
+				if msg.Question[0].Name != "one.example." {
+					t.Errorf("questions: want first question kept, got %s", msg.Question[0].Name)
+				}
+				return
+			}
+			if ans == nil {
+				t.Fatalf("questions: want answer %s, got none", dns.RcodeToString[tc.rcode])
+			}
+			if ans.Rcode != tc.rcode {
+				t.Errorf("questions: want rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[ans.Rcode])
+			}
+			if !ans.Response || ans.Id != msg.Id || ans.Opcode != msg.Opcode {
+				t.Errorf("questions: answer hdr mismatch: resp? %t, id %d/%d, op %d/%d", ans.Response, ans.Id, msg.Id, ans.Opcode, msg.Opcode)
+			}
+			if _, err := ans.Pack(); err != nil {
+				t.Errorf("questions: pack answer: %v", err)
+			}
+		})
+	}
+}
+
+func TestQuestionsMode(t *testing.T) {
+	r := &resolver{}
+	r.SetMultiQuestion(MultiQRefuse)
+	r.SetMultiQuestion(42) // unknown modes fall back to the default
+	if _, stripped, why := r.vet(questionsMsg(dns.OpcodeQuery, 2)); why != nil || !stripped {
+		t.Errorf("questions: unknown mode: want stripped, got %t, %v", stripped, why)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	RebindOff   = x.RebindOff
+	RebindStrip = x.RebindStrip
+	RebindBlock = x.RebindBlock
+
+	// RebindProtection is the blocklist name recorded in summaries
+	// of answers that were stripped or blocked by rebind protection.
+	RebindProtection = "rebind-protection"
+)
+
+// rfc6598 shared address space (cgnat)
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// rebinder strips or blocks answers for public names that resolve
+// to private ips; see: en.wikipedia.org/wiki/DNS_rebinding
+type rebinder struct {
+	mode    atomic.Int32 // RebindOff, RebindStrip, RebindBlock
+	trusted x.RadixTree  // user trusted domain suffixes
+}
+
+func newRebinder() *rebinder {
+	return &rebinder{
+		trusted: x.NewRadixTree(),
+	}
+}
+
+func (b *rebinder) set(mode int, suffixes string) {
+	if mode < RebindOff || mode > RebindBlock {
+		mode = RebindOff
+	}
+	b.mode.Store(int32(mode))
+	b.trusted.Clear()
+	for _, s := range strings.Split(suffixes, ",") {
+		s, _ = xdns.NormalizeQName(strings.TrimPrefix(strings.TrimSpace(s), "."))
+		if len(s) <= 0 {
+			continue
+		}
+		b.trusted.Add(s)       // the domain itself
+		b.trusted.Add("." + s) // and all its subdomains
+	}
+	log.I("rebind: mode %d; trusted %d", mode, b.trusted.Len())
+}
+
+func (b *rebinder) on() bool {
+	return b.mode.Load() != RebindOff
+}
+
+func (b *rebinder) blockall() bool {
+	return b.mode.Load() == RebindBlock
+}
+
+func (b *rebinder) isTrusted(qname string) bool {
+	return b.trusted.HasAny(qname)
+}
+
+// rebindable returns true if ip is not meant to be reachable from the internet.
+func rebindable(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsPrivate() || // rfc1918, rfc4193 (ula)
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		cgnat.Contains(ip)
+}
+
+// strip removes a / aaaa records and svcb / https ip hints with rebindable
+// ips from ans, and returns those ips.
+func strip(ans *dns.Msg) (bad []netip.Addr) {
+	if ans == nil {
+		return
+	}
+	ans.Answer, bad = stripRRs(ans.Answer, bad)
+	ans.Extra, bad = stripRRs(ans.Extra, bad)
+	return
+}
+
+func stripRRs(rrs []dns.RR, bad []netip.Addr) ([]dns.RR, []netip.Addr) {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		var ip net.IP
+		switch rec := rr.(type) {
+		case *dns.A:
+			ip = rec.A
+		case *dns.AAAA:
+			ip = rec.AAAA
+		case *dns.SVCB:
+			rec.Value, bad = stripHints(rec.Value, bad)
+		case *dns.HTTPS:
+			rec.Value, bad = stripHints(rec.Value, bad)
+		}
+		if v, ok := netip.AddrFromSlice(ip); ok && rebindable(v) {
+			bad = append(bad, v.Unmap())
+			continue // drop rr
+		}
+		out = append(out, rr)
+	}
+	return out, bad
+}
+
+func stripHints(kvs []dns.SVCBKeyValue, bad []netip.Addr) ([]dns.SVCBKeyValue, []netip.Addr) {
+	out := make([]dns.SVCBKeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		var hints []net.IP
+		switch h := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			h.Hint, bad = stripIPs(h.Hint, bad)
+			hints = h.Hint
+		case *dns.SVCBIPv6Hint:
+			h.Hint, bad = stripIPs(h.Hint, bad)
+			hints = h.Hint
+		default:
+			out = append(out, kv)
+			continue
+		}
+		if len(hints) > 0 { // drop hint keys with no ips left
+			out = append(out, kv)
+		}
+	}
+	return out, bad
+}
+
+func stripIPs(ips []net.IP, bad []netip.Addr) ([]net.IP, []netip.Addr) {
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if v, ok := netip.AddrFromSlice(ip); ok && rebindable(v) {
+			bad = append(bad, v.Unmap())
+			continue
+		}
+		out = append(out, ip)
+	}
+	return out, bad
+}
+
+// rebindguard is a Transport that checks its answers for rebinding.
+type rebindguard struct {
+	Transport
+	b       *rebinder
+	l       x.DNSListener
+	rebound atomic.Bool // true if any answer was stripped or blocked
+}
+
+var _ Transport = (*rebindguard)(nil)
+
+// Implements x.RebindProtector
+func (r *resolver) SetRebindProtection(mode int, trustedsuffixes string) {
+	r.rebind.set(mode, trustedsuffixes)
+}
+
+// guard returns t wrapped in a rebindguard, unless rebind protection
+// is off, or qname is a private (undelegated, local) or trusted name.
+func (r *resolver) guard(t Transport, qname string) Transport {
+	if t == nil || !r.rebind.on() {
+		return t
+	}
+	if len(r.requiresGoosOrLocal(qname)) > 0 || r.rebind.isTrusted(qname) {
+		log.V("rebind: skip private or trusted %s", qname)
+		return t
+	}
+	return &rebindguard{Transport: t, b: r.rebind, l: r.listener}
+}
+
+// rebound returns true if t guarded against a rebinding answer.
+func rebound(t Transport) bool {
+	if g, ok := t.(*rebindguard); ok {
+		return g.rebound.Load()
+	}
+	return false
+}
+
+// Implements Transport
+func (g *rebindguard) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	r, err := g.Transport.Query(network, q, smm)
+	if err != nil {
+		return r, err
+	}
+	ans := xdns.AsMsg(r)
+	if ans == nil || !xdns.HasRcodeSuccess(ans) {
+		return r, err
+	}
+
+	bad := strip(ans)
+	if len(bad) <= 0 {
+		return r, err
+	}
+
+	qname, _ := xdns.NormalizeQName(xdns.QName(ans))
+	blockall := g.b.blockall()
+	if blockall {
+		if blk, berr := xdns.RefusedResponseFromMessage(ans); berr == nil {
+			ans = blk
+		} else { // send the stripped answer instead
+			log.W("rebind: %s; could not block: %v", qname, berr)
+			blockall = false
+		}
+	}
+	g.rebound.Store(true)
+
+	ips := make([]string, 0, len(bad))
+	for _, ip := range bad {
+		ips = append(ips, ip.String())
+	}
+	csv := strings.Join(ips, ",")
+	log.I("rebind: %s => %s; blocked? %t", qname, csv, blockall)
+	if g.l != nil {
+		go g.l.OnRebind(qname, csv, blockall)
+	}
+
+	if smm != nil {
+		smm.RData = xdns.GetInterestingRData(ans)
+		smm.RCode = xdns.Rcode(ans)
+		smm.RTtl = xdns.RTtl(ans)
+	}
+	return ans.Pack()
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func TestRebindStrip(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("rebind.example.com.", dns.TypeA)
+	ans := new(dns.Msg)
+	ans.SetReply(q)
+	ans.Answer = []dns.RR{
+		xdns.MakeARecord("rebind.example.com.", "192.168.1.1", 60),
+		xdns.MakeARecord("rebind.example.com.", "93.184.216.34", 60),
+		xdns.MakeARecord("rebind.example.com.", "100.64.0.1", 60),
+		xdns.MakeAAAARecord("rebind.example.com.", "fd00::1", 60),
+		xdns.MakeAAAARecord("rebind.example.com.", "fe80::1", 60),
+	}
+
+	bad := strip(ans)
+	if len(bad) != 4 {
+		t.Fatalf("want 4 stripped, got %v", bad)
+	}
+	if len(ans.Answer) != 1 {
+		t.Fatalf("want 1 answer, got %v", ans.Answer)
+	}
+	if a, ok := ans.Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("93.184.216.34")) {
+		t.Fatalf("want public ip kept, got %v", ans.Answer[0])
+	}
+}
+
+func TestRebindStripHints(t *testing.T) {
+	r := new(dns.HTTPS)
+	r.Hdr = dns.RR_Header{Name: "rebind.example.com.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300}
+	r.Priority = 1
+	r.Target = "."
+	r.Value = []dns.SVCBKeyValue{
+		&dns.SVCBAlpn{Alpn: []string{"h2"}},
+		&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("10.0.0.1").To4(), net.ParseIP("1.1.1.1").To4()}},
+		&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("::1")}},
+	}
+	ans := new(dns.Msg)
+	ans.Answer = []dns.RR{r}
+
+	bad := strip(ans)
+	if len(bad) != 2 {
+		t.Fatalf("want 2 stripped, got %v", bad)
+	}
+	if len(r.Value) != 2 { // alpn, ipv4hint; empty ipv6hint dropped
+		t.Fatalf("want 2 kvs, got %v", r.Value)
+	}
+	if h, ok := r.Value[1].(*dns.SVCBIPv4Hint); !ok || len(h.Hint) != 1 || !h.Hint[0].Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("want public hint kept, got %v", r.Value[1])
+	}
+}
+
+func TestRebindTrusted(t *testing.T) {
+	b := newRebinder()
+	b.set(RebindStrip, " home.example.net, .ddns.example.org")
+	for _, n := range []string{"home.example.net", "nas.home.example.net", "ddns.example.org", "a.ddns.example.org"} {
+		if !b.isTrusted(n) {
+			t.Errorf("want %s trusted", n)
+		}
+	}
+	for _, n := range []string{"example.net", "xhome.example.net", "example.org"} {
+		if b.isTrusted(n) {
+			t.Errorf("want %s untrusted", n)
+		}
+	}
+}
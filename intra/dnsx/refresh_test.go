@@ -0,0 +1,125 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/miekg/dns"
+)
+
+// fakeDc is a DcProxy whose refreshes wait till released, and report
+// one server that failed.
+type fakeDc struct {
+	fakeTransport
+	released  chan struct{}
+	waiting   chan struct{} // signalled as refreshes wait
+	refreshes atomic.Int32
+	starts    atomic.Int32
+}
+
+func newFakeDc() *fakeDc {
+	return &fakeDc{
+		fakeTransport: fakeTransport{rrs: func(string) []dns.RR { return nil }},
+		released:      make(chan struct{}),
+		waiting:       make(chan struct{}, 3),
+	}
+}
+
+func (*fakeDc) ID() string   { return DcProxy }
+func (*fakeDc) Type() string { return DNSCrypt }
+
+func (*fakeDc) Add(x.DNSTransport) bool            { return true }
+func (*fakeDc) Remove(string) bool                 { return true }
+func (*fakeDc) Get(string) (x.DNSTransport, error) { return nil, errNoSuchTransport }
+func (*fakeDc) Stop() error                        { return nil }
+func (*fakeDc) Refresh() (string, error)           { return "dc0", nil }
+func (*fakeDc) LiveTransports() string             { return "dc0" }
+func (d *fakeDc) RefreshReport() string            { return d.report(&d.refreshes) }
+func (d *fakeDc) Start() string                    { return d.report(&d.starts) }
+func (d *fakeDc) report(calls *atomic.Int32) string {
+	d.waiting <- struct{}{}
+	<-d.released
+	calls.Add(1)
+	b, _ := json.Marshal(x.RefreshReport{Active: "dc0", Results: []x.RefreshResult{
+		{ID: "dc0", OK: true, Code: x.ErrNone},
+		{ID: "dc1", OK: false, Code: x.ErrDNSTransport, Err: "no cert"},
+	}})
+	return string(b)
+}
+
+func TestRefreshAsync(t *testing.T) {
+	dt := fakeTransport{rrs: func(string) []dns.RR { return nil }}
+	r := NewResolver("", settings.DefaultTunMode(), dt, &tidListener{}, nil).(*resolver)
+	dc := newFakeDc()
+	r.Lock()
+	r.transports[DcProxy] = dc
+	r.Unlock()
+
+	// Refresh does not wait on DcProxy
+	done := make(chan string, 1)
+	go func() {
+		s, _ := r.Refresh()
+		done <- s
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dns: refresh: waits on transports")
+	}
+	select {
+	case <-dc.waiting:
+	case <-time.After(time.Second):
+		t.Fatal("dns: refresh: dc not refreshed")
+	}
+	close(dc.released)
+	eventuallyRefreshed(t, dc, 1)
+
+	// while RefreshReport does, and reports on its servers
+	var rpt x.RefreshReport
+	if err := json.Unmarshal([]byte(r.RefreshReport()), &rpt); err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]x.RefreshResult)
+	for _, res := range rpt.Results {
+		results[res.ID] = res
+	}
+	if res, ok := results["dc1"]; !ok || res.OK || res.Code != x.ErrDNSTransport {
+		t.Errorf("dns: refresh report: dc1: %+v; want a failure", res)
+	}
+	if res, ok := results["dc0"]; !ok || !res.OK {
+		t.Errorf("dns: refresh report: dc0: %+v; want ok", res)
+	}
+	if rpt.Gen <= 0 {
+		t.Errorf("dns: refresh report: gen %d", rpt.Gen)
+	}
+
+	// and Start starts DcProxy, instead of refreshing it
+	if err := json.Unmarshal([]byte(r.Start()), &rpt); err != nil {
+		t.Fatal(err)
+	}
+	if n := dc.starts.Load(); n != 1 {
+		t.Errorf("dns: start: %d dc starts; want 1", n)
+	}
+	eventuallyRefreshed(t, dc, 2) // one each by Refresh and RefreshReport
+}
+
+func eventuallyRefreshed(tb testing.TB, dc *fakeDc, n int32) {
+	tb.Helper()
+	deadline := time.Now().Add(time.Second)
+	for dc.refreshes.Load() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dc.refreshes.Load(); got != n {
+		tb.Errorf("dns: %d dc refreshes; want %d", got, n)
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/miekg/dns"
+)
+
+var (
+	errRestarting = errors.New("dns: restart in progress")
+	errStopped    = errors.New("dns: resolver stopped")
+)
+
+// Restarter is a Resolver that can be rebuilt while in use.
+type Restarter interface {
+	Resolver
+	// Restart builds a new resolver with fake dns addrs fakeaddrs (or the
+	// current ones, if empty) and default transport dtr (see: NewResolver),
+	// has fill add transports to it, and warms those up; all the while, the
+	// current resolver answers queries (from its caches, stale or not, where
+	// it can). The new resolver is then swapped in, in place; it keeps the
+	// settings (records, routes, rdns, clamps, etc), caches of transports of
+	// the same ids, and alg mappings of the current one. On error, the current
+	// resolver is left as-is.
+	Restart(fakeaddrs string, dtr x.DNSTransport, fill func(Resolver) error) error
+}
+
+// restartable is a Resolver whose underlying resolver is swapped on Restart.
+type restartable struct {
+	NatPt                            // same across restarts
+	cur     atomic.Pointer[resolver] // never nil
+	mu      sync.Mutex               // serializes restarts
+	pmu     sync.Mutex               // protects pending
+	pending []func(*resolver)        // transport changes to replay; nil if not restarting
+	smu     sync.Mutex               // protects stg
+	stg     *staged                  // transport changes staged; nil if not staging
+	stopped atomic.Bool
+}
+
+var _ Restarter = (*restartable)(nil)
+var _ core.LinkObserver = (*restartable)(nil)
+
+// NewRestartableResolver is NewResolver, but for a Resolver that can be
+// rebuilt while in use; see: Restarter.
+func NewRestartableResolver(fakeaddrs string, tunmode *settings.TunMode, dtr x.DNSTransport, l x.DNSListener, pt NatPt) Restarter {
+	s := &restartable{NatPt: pt}
+	s.cur.Store(NewResolver(fakeaddrs, tunmode, dtr, l, pt).(*resolver))
+	return s
+}
+
+// Implements Restarter
+func (s *restartable) Restart(fakeaddrs string, dtr x.DNSTransport, fill func(Resolver) error) error {
+	if !s.mu.TryLock() {
+		return errRestarting
+	}
+	defer s.mu.Unlock()
+	if s.stopped.Load() {
+		return errStopped
+	}
+
+	start := time.Now()
+	old := s.cur.Load()
+	nr := old.fork(fakeaddrs, dtr)
+
+	s.pmu.Lock()
+	s.pending = make([]func(*resolver), 0)
+	s.pmu.Unlock()
+
+	if err := fill(nr); err != nil {
+		s.pmu.Lock()
+		s.pending = nil
+		s.pmu.Unlock()
+		nr.retire()
+		log.W("dns: restart: fill: %v; in %s", err, time.Since(start))
+		return err
+	}
+
+	nr.staging.Store(false)
+	nr.warmup(nr.all()...)
+	go nr.rediscover()
+
+	// transports added to (or removed from) the current resolver since are
+	// carried over, along with its settings, caches, and alg mappings
+	s.pmu.Lock()
+	for _, f := range s.pending {
+		f(nr)
+	}
+	s.pending = nil
+	if s.stopped.Load() {
+		s.pmu.Unlock()
+		nr.retire()
+		return errStopped
+	}
+	nr.adopt(old)
+	s.cur.Store(nr)
+	s.pmu.Unlock()
+
+	go old.retire()
+	log.I("dns: restart: %s => %s; in %s", old.fakeaddrs(), nr.fakeaddrs(), time.Since(start))
+	return nil
+}
+
+// mutate applies f to the resolver in use, and if ok, to the one being
+// built by Restart (if any), too.
+func (s *restartable) mutate(f func(*resolver) bool) bool {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	ok := f(s.r())
+	if ok && s.pending != nil {
+		s.pending = append(s.pending, func(r *resolver) { f(r) })
+	}
+	return ok
+}
+
+// fork returns a new resolver (set up with fakeaddrs, or r's if empty, and
+// dtr) that shares settings with r, but none of its transports.
+func (r *resolver) fork(fakeaddrs string, dtr x.DNSTransport) *resolver {
+	nr := &resolver{
+		NatPt:        r.NatPt,
+		listener:     r.listener,
+		transports:   make(map[string]Transport),
+		tunmode:      r.tunmode,
+		localdomains: r.localdomains,
+		hosts:        r.hosts,
+		routes:       r.routes,
+		cats:         r.cats,
+		uids:         r.uids,
+		rebind:       r.rebind,
+		ttls:         r.ttls,
+		limits:       r.limits,
+		strict:       r.strict,
+		refreshes:    r.refreshes,
+		blocks:       r.blocks,
+		usage:        r.usage,
+		warm:         r.warm,
+		ddr:          r.ddr,
+		xcheck:       r.xcheck,
+		tset:         newTSettings(),
+	}
+	nr.staging.Store(true)
+	if len(fakeaddrs) <= 0 {
+		fakeaddrs = r.fakeaddrs()
+	}
+	nr.setup(fakeaddrs, dtr)
+	return nr
+}
+
+// adopt carries over settings of r that are not shared with it (see: fork),
+// alg mappings of its gateway, and runtime settings (retries, headers,
+// padding, cert checks) and cached answers of its transports of the same
+// ids as nr's.
+func (nr *resolver) adopt(r *resolver) {
+	nr.multiq.Store(r.multiq.Load())
+	nr.order.Store(r.order.Load())
+	nr.svcb.Store(r.svcb.Load())
+	nr.reuse.Store(r.reuse.Load())
+	nr.passthru.Store(r.passthru.Load())
+	nr.failsafe.adopt(&r.failsafe)
+	nr.setRdnsLocal(r.getRdnsLocal())
+	nr.setRdnsRemote(r.getRdnsRemote())
+
+	if gw, ok := nr.gateway.(*dnsgateway); ok {
+		if prev, ok := r.gateway.(*dnsgateway); ok {
+			gw.adopt(prev)
+		}
+	}
+
+	n := 0
+	r.RLock()
+	nr.RLock()
+	for id, t := range nr.transports {
+		ct, ok1 := t.(*ctransport)
+		prev, ok2 := r.transports[id].(*ctransport)
+		if ok1 && ok2 {
+			n += ct.adopt(prev)
+		}
+	}
+	nr.RUnlock()
+	r.RUnlock()
+	log.I("dns: restart: adopted %d cache buckets", n)
+
+	nr.tset.adopt(nr, r.tset)
+}
+
+// adopt shares alg, nat, ptr, alpn, and dual mappings of prev, as also
+// its journal of evicted alg ips and its translate setting.
+func (t *dnsgateway) adopt(prev *dnsgateway) {
+	prev.RLock()
+	defer prev.RUnlock()
+	t.Lock()
+	defer t.Unlock()
+
+	t.mod = prev.mod
+	t.alg = maps.Clone(prev.alg)
+	t.nat = maps.Clone(prev.nat)
+	t.ptr = maps.Clone(prev.ptr)
+	t.alpn = maps.Clone(prev.alpn)
+	t.dual = maps.Clone(prev.dual)
+	t.evicted = prev.evicted
+	t.octets = prev.octets
+	t.hexes = prev.hexes
+	log.I("alg: adopted %d mappings", len(t.alg)+len(t.nat)+len(t.ptr))
+}
+
+// adopt shares cache buckets of prev that t does not have yet; returns
+// the number shared.
+func (t *ctransport) adopt(prev *ctransport) (n int) {
+	if t == prev {
+		return
+	}
+	prev.RLock()
+	defer prev.RUnlock()
+	t.Lock()
+	defer t.Unlock()
+
+	for i, cb := range prev.store {
+		if cb != nil && i < len(t.store) && t.store[i] == nil {
+			t.store[i] = cb
+			n++
+		}
+	}
+	return
+}
+
+// tsettings are runtime settings of transports (by id) as set on a
+// resolver, replayed on transports of the same ids of the resolver that
+// it is restarted into.
+type tsettings struct {
+	sync.Mutex
+	m map[string][]tsetting // id -> settings, in the order first set
+}
+
+type tsetting struct {
+	what  string                  // ex: retries, padding, header:<key>
+	apply func(r *resolver) error // sets it on the same id of r
+}
+
+func newTSettings() *tsettings {
+	return &tsettings{m: make(map[string][]tsetting)}
+}
+
+// set records (or replaces) setting what of transport id.
+func (s *tsettings) set(id, what string, apply func(r *resolver) error) {
+	if s == nil { // ex: in tests
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i, x := range s.m[id] {
+		if x.what == what {
+			s.m[id][i].apply = apply
+			return
+		}
+	}
+	s.m[id] = append(s.m[id], tsetting{what, apply})
+}
+
+// forget drops settings of transport id, as it is removed or replaced.
+func (s *tsettings) forget(id string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, id)
+}
+
+// adopt applies settings of prev to transports of nr of the same ids;
+// and so, records those that take.
+func (s *tsettings) adopt(nr *resolver, prev *tsettings) {
+	prev.Lock()
+	all := make(map[string][]tsetting, len(prev.m))
+	for id, xs := range prev.m {
+		all[id] = slices.Clone(xs)
+	}
+	prev.Unlock()
+
+	n := 0
+	for id, xs := range all {
+		if !nr.has(id) {
+			continue
+		}
+		for _, x := range xs {
+			if err := x.apply(nr); err != nil {
+				log.W("dns: restart: %s: %s: %v", id, x.what, err)
+				continue
+			}
+			n++
+		}
+	}
+	log.I("dns: restart: adopted %d transport settings", n)
+}
+
+// all returns all transports of r, sans cached ones.
+func (r *resolver) all() []Transport {
+	r.RLock()
+	defer r.RUnlock()
+	ts := make([]Transport, 0, len(r.transports))
+	for _, t := range r.transports {
+		if !cachedTransport(t) {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// fakeaddrs returns fake dns addrs of r as csv.
+func (r *resolver) fakeaddrs() string {
+	addrs := make([]string, 0, len(r.dnsaddrs))
+	for _, ipp := range r.dnsaddrs {
+		addrs = append(addrs, ipp.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// retire stops r's DcProxy, once r is no longer in use; unlike Stop, it
+// leaves its gateway (which may be adopted), and listener be.
+func (r *resolver) retire() {
+	if dc, err := r.dcProxy(); err == nil {
+		if err := dc.Stop(); err != nil {
+			log.W("dns: restart: retire %s: %v", DcProxy, err)
+		}
+	}
+}
+
+// r returns the resolver in use.
+func (s *restartable) r() *resolver {
+	return s.cur.Load()
+}
+
+// Implements core.LinkObserver
+func (s *restartable) OnLinkChange(l core.Link) {
+	s.r().OnLinkChange(l)
+}
+
+// Implements Resolver
+func (s *restartable) Add(t x.DNSTransport) bool {
+	if ok, staging := s.staging(func(stg *staged) bool { return stg.add(t) }); staging {
+		return ok
+	}
+	return s.mutate(func(r *resolver) bool { return r.Add(t) })
+}
+
+// Implements Resolver
+func (s *restartable) AddAll(ts ...Transport) (err error) {
+	if _, staging := s.staging(func(stg *staged) bool {
+		err = stg.addAll(ts...)
+		return err == nil
+	}); staging {
+		return
+	}
+	s.mutate(func(r *resolver) bool {
+		err = r.AddAll(ts...)
+		return err == nil
+	})
+	return
+}
+
+// Implements Resolver
+func (s *restartable) Remove(id string) bool {
+	if ok, staging := s.staging(func(stg *staged) bool {
+		return stg.remove(id, s.r().has(id))
+	}); staging {
+		return ok
+	}
+	return s.mutate(func(r *resolver) bool { return r.Remove(id) })
+}
+
+// the rest are as implemented by the resolver in use
+
+func (s *restartable) Get(id string) (x.DNSTransport, error) { return s.r().Get(id) }
+func (s *restartable) Refresh() (string, error)              { return s.r().Refresh() }
+func (s *restartable) RefreshReport() string                 { return s.r().RefreshReport() }
+func (s *restartable) Start() string                         { return s.r().Start() }
+func (s *restartable) LiveTransports() string                { return s.r().LiveTransports() }
+func (s *restartable) Translate(b bool)                      { s.r().Translate(b) }
+
+// Implements Resolver
+func (s *restartable) Stop() error {
+	s.pmu.Lock() // a restart in progress is not swapped in
+	defer s.pmu.Unlock()
+	s.stopped.Store(true)
+	return s.r().Stop()
+}
+
+func (s *restartable) AddLocalRecord(name, typ, value string, ttlsecs int) error {
+	return s.r().AddLocalRecord(name, typ, value, ttlsecs)
+}
+func (s *restartable) RemoveLocalRecord(name, typ string) bool {
+	return s.r().RemoveLocalRecord(name, typ)
+}
+func (s *restartable) ListLocalRecords() string { return s.r().ListLocalRecords() }
+
+func (s *restartable) AddDomainRoute(name, pid string) error { return s.r().AddDomainRoute(name, pid) }
+func (s *restartable) RemoveDomainRoute(name string) bool    { return s.r().RemoveDomainRoute(name) }
+func (s *restartable) ListDomainRoutes() string              { return s.r().ListDomainRoutes() }
+
+func (s *restartable) SetUIDTransport(uid, id string) error { return s.r().SetUIDTransport(uid, id) }
+func (s *restartable) ListUIDTransports() string            { return s.r().ListUIDTransports() }
+
+func (s *restartable) SetRetries(id string, n int) error { return s.r().SetRetries(id, n) }
+func (s *restartable) SetHeader(id, key, value string) error {
+	return s.r().SetHeader(id, key, value)
+}
+func (s *restartable) SetPadding(id string, policy, block int) error {
+	return s.r().SetPadding(id, policy, block)
+}
+func (s *restartable) SetCertChecks(id string, staple bool, minscts int, keys bool) error {
+	return s.r().SetCertChecks(id, staple, minscts, keys)
+}
+func (s *restartable) CertStatus(id string) string { return s.r().CertStatus(id) }
+func (s *restartable) SetDDR(on bool)              { s.r().SetDDR(on) }
+func (s *restartable) DDRStatus() string           { return s.r().DDRStatus() }
+func (s *restartable) SetCrossCheck(refid string, pct int, canarycsv string) error {
+	return s.r().SetCrossCheck(refid, pct, canarycsv)
+}
+func (s *restartable) DNSIntegrity() string { return s.r().DNSIntegrity() }
+func (s *restartable) SetDesignatedMaker(m DesignatedMaker) {
+	s.r().SetDesignatedMaker(m)
+}
+func (s *restartable) SetRebindProtection(mode int, allowcsv string) {
+	s.r().SetRebindProtection(mode, allowcsv)
+}
+func (s *restartable) SetTTLClamp(minsecs, maxsecs int) { s.r().SetTTLClamp(minsecs, maxsecs) }
+func (s *restartable) SetDNS64TTLClamp(minsecs, maxsecs int) {
+	s.r().SetDNS64TTLClamp(minsecs, maxsecs)
+}
+func (s *restartable) SetBlockTTL(secs int)            { s.r().SetBlockTTL(secs) }
+func (s *restartable) SetMultiQuestion(policy int)     { s.r().SetMultiQuestion(policy) }
+func (s *restartable) SetSVCBBlockMode(mode int)       { s.r().SetSVCBBlockMode(mode) }
+func (s *restartable) SetAnswerOrder(policy int)       { s.r().SetAnswerOrder(policy) }
+func (s *restartable) GetBlockStats(n int) string      { return s.r().GetBlockStats(n) }
+func (s *restartable) ResetBlockStats()                { s.r().ResetBlockStats() }
+func (s *restartable) GetDNSUsage() string             { return s.r().GetDNSUsage() }
+func (s *restartable) ResetDNSUsage()                  { s.r().ResetDNSUsage() }
+func (s *restartable) SetWarmupCanary(name string)     { s.r().SetWarmupCanary(name) }
+func (s *restartable) Warmup()                         { s.r().Warmup() }
+func (s *restartable) SetAlgJournal(size, ttlsecs int) { s.r().SetAlgJournal(size, ttlsecs) }
+func (s *restartable) SetQueryLimit(id string, n, queued, waitms int) {
+	s.r().SetQueryLimit(id, n, queued, waitms)
+}
+func (s *restartable) QueryLimits() string { return s.r().QueryLimits() }
+func (s *restartable) SetListenerTimeout(ms, policy int) {
+	s.r().SetListenerTimeout(ms, policy)
+}
+func (s *restartable) ListenerTimeouts() int      { return s.r().ListenerTimeouts() }
+func (s *restartable) ConnStats(id string) string { return s.r().ConnStats(id) }
+func (s *restartable) SetConnReuseAlert(pct int)  { s.r().SetConnReuseAlert(pct) }
+func (s *restartable) SetStrictTransport(id string, strict bool, allowed string) {
+	s.r().SetStrictTransport(id, strict, allowed)
+}
+func (s *restartable) RefreshGens() string { return s.r().RefreshGens() }
+func (s *restartable) SetCategorizer(c x.Categorizer, ttlsecs int) {
+	s.r().SetCategorizer(c, ttlsecs)
+}
+
+func (s *restartable) SetRdnsLocal(t, rank, conf, filetag string) error {
+	return s.r().SetRdnsLocal(t, rank, conf, filetag)
+}
+func (s *restartable) SetRdnsRemote(filetag string) error { return s.r().SetRdnsRemote(filetag) }
+func (s *restartable) GetRdnsLocal() (x.RDNS, error)      { return s.r().GetRdnsLocal() }
+func (s *restartable) GetRdnsRemote() (x.RDNS, error)     { return s.r().GetRdnsRemote() }
+func (s *restartable) blockQ(t, t2 Transport, msg *dns.Msg) (*dns.Msg, string, error) {
+	return s.r().blockQ(t, t2, msg)
+}
+func (s *restartable) blockA(t, t2 Transport, q, ans *dns.Msg, blocklists string) (*dns.Msg, string) {
+	return s.r().blockA(t, t2, q, ans, blocklists)
+}
+
+func (s *restartable) Gateway() Gateway                         { return s.r().Gateway() }
+func (s *restartable) GetMult(id string) (TransportMult, error) { return s.r().GetMult(id) }
+func (s *restartable) IsDnsAddr(ipport string) bool             { return s.r().IsDnsAddr(ipport) }
+func (s *restartable) IsDivertedDnsAddr(ipport string) bool     { return s.r().IsDivertedDnsAddr(ipport) }
+func (s *restartable) SetDnsPassthrough(csv string) error       { return s.r().SetDnsPassthrough(csv) }
+func (s *restartable) LocalLookup(q []byte) ([]byte, error)     { return s.r().LocalLookup(q) }
+func (s *restartable) Forward(q []byte) ([]byte, error)         { return s.r().Forward(q) }
+func (s *restartable) Serve(proto string, c protect.Conn)       { s.r().Serve(proto, c) }
+func (s *restartable) ServeOver(proto string, c protect.Conn, pid string) {
+	s.r().ServeOver(proto, c, pid)
+}
+func (s *restartable) ServeFor(proto string, c protect.Conn, pid, uid string) {
+	s.r().ServeFor(proto, c, pid, uid)
+}
+func (s *restartable) StaleAlg(algip netip.Addr) (string, bool) { return s.r().StaleAlg(algip) }
+func (s *restartable) ReclaimAlg(algip netip.Addr) error        { return s.r().ReclaimAlg(algip) }
+func (s *restartable) CacheSize() int                           { return s.r().CacheSize() }
+func (s *restartable) TrimCache(all bool) int                   { return s.r().TrimCache(all) }
+func (s *restartable) CategoriesOf(domains string) (cats, route string) {
+	return s.r().CategoriesOf(domains)
+}
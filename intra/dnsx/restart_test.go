@@ -0,0 +1,230 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func newRestartable(t *testing.T) (*restartable, fakeTransport) {
+	ft := fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}
+	s := NewRestartableResolver("10.111.222.3:53", settings.DefaultTunMode(), ft, &tidListener{tid: ft.ID()}, nil).(*restartable)
+	if !s.Add(ft) {
+		t.Fatal("restart: add fake")
+	}
+	s.Translate(true)
+	return s, ft
+}
+
+func TestRestartAnswersThroughout(t *testing.T) {
+	s, ft := newRestartable(t)
+	if err := s.AddDomainRoute("app.example", "wg1"); err != nil {
+		t.Fatal(err)
+	}
+	old := s.r()
+	algip := resolveAlg(t, old, "app.example.")
+	ct, err := s.Get(CT + ft.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := clientQuery(t, ct.(Transport), "cached.example."); err != nil {
+		t.Fatal(err)
+	}
+	cached := s.CacheSize()
+
+	gate := make(chan struct{})
+	filling := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Restart("10.111.222.4:53", ft, func(r Resolver) error {
+			if !r.Add(ft) {
+				return ErrAddFailed
+			}
+			close(filling)
+			<-gate
+			return nil
+		})
+	}()
+	<-filling
+
+	// the current resolver answers, and takes changes, while the new one fills
+	if s.r() != old || !s.IsDnsAddr("10.111.222.3:53") {
+		t.Fatal("restart: swapped before filled")
+	}
+	_ = resolveAlg(t, s.r(), "other.example.")
+	var n, max atomic.Int32
+	if !s.Add(&warmTransport{id: "t2", n: &n, max: &max}) {
+		t.Fatal("restart: add t2")
+	}
+	if err := s.Restart("", ft, func(Resolver) error { return nil }); !errors.Is(err, errRestarting) {
+		t.Errorf("restart: concurrent: want %v, got %v", errRestarting, err)
+	}
+
+	close(gate)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("restart: not done")
+	}
+
+	if s.r() == old {
+		t.Fatal("restart: not swapped")
+	}
+	if !s.IsDnsAddr("10.111.222.4:53") || s.IsDnsAddr("10.111.222.3:53") {
+		t.Error("restart: fake dns addrs not swapped")
+	}
+	if _, err := s.Get("t2"); err != nil {
+		t.Errorf("restart: t2 added during restart: %v", err)
+	}
+	if got := s.ListDomainRoutes(); got != "app.example=wg1" {
+		t.Errorf("restart: routes: got %q", got)
+	}
+	if got := s.Gateway().PTR(algip.AsSlice(), false); got != "app.example" {
+		t.Errorf("restart: alg %s: want app.example, got %q", algip, got)
+	}
+	if got := s.CacheSize(); cached <= 0 || got != cached {
+		t.Errorf("restart: cache: want %d answers, got %d", cached, got)
+	}
+	_ = resolveAlg(t, s.r(), "app.example.")
+}
+
+func TestRestartFails(t *testing.T) {
+	s, ft := newRestartable(t)
+	old := s.r()
+
+	errFill := errors.New("fill")
+	if err := s.Restart("", ft, func(Resolver) error { return errFill }); !errors.Is(err, errFill) {
+		t.Errorf("restart: want %v, got %v", errFill, err)
+	}
+	if s.r() != old || !s.IsDnsAddr("10.111.222.3:53") {
+		t.Error("restart: swapped despite err")
+	}
+
+	_ = s.Stop()
+	if err := s.Restart("", ft, func(Resolver) error { return nil }); !errors.Is(err, errStopped) {
+		t.Errorf("restart: stopped: want %v, got %v", errStopped, err)
+	}
+}
+
+// knobTransport records runtime settings set on it.
+type knobTransport struct {
+	fakeTransport
+	id  string
+	mu  sync.Mutex
+	set map[string]string
+}
+
+func newKnobTransport(id string) *knobTransport {
+	return &knobTransport{fakeTransport: fakeTransport{rrs: func(string) []dns.RR { return nil }}, id: id, set: make(map[string]string)}
+}
+
+func (t *knobTransport) ID() string { return t.id }
+
+func (t *knobTransport) knob(k string, v ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.set[k] = fmt.Sprint(v...)
+}
+
+func (t *knobTransport) settings() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return maps.Clone(t.set)
+}
+
+func (t *knobTransport) SetRetries(n int)            { t.knob("retries", n) }
+func (t *knobTransport) SetHeader(k, v string) error { t.knob("header:"+k, v); return nil }
+func (t *knobTransport) SetPadding(p, b int) error   { t.knob("padding", p, " ", b); return nil }
+func (*knobTransport) CertStatus() string            { return "" }
+func (*knobTransport) CoverIPs(...netip.Addr)        {}
+func (t *knobTransport) SetCertChecks(staple bool, minscts int, keys bool, _ CertAlert) error {
+	t.knob("certs", staple, " ", minscts, " ", keys)
+	return nil
+}
+
+func TestRestartKeepsTransportSettings(t *testing.T) {
+	ft := fakeTransport{rrs: func(string) []dns.RR { return nil }}
+	s := NewRestartableResolver("10.111.222.3:53", settings.DefaultTunMode(), ft, &tidListener{tid: "k1"}, nil).(*restartable)
+	k1, gone := newKnobTransport("k1"), newKnobTransport("gone")
+	if !s.Add(k1) || !s.Add(gone) {
+		t.Fatal("restart: add")
+	}
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(s.SetRetries("k1", 2))
+	must(s.SetHeader("k1", "Authorization", "Bearer 1"))
+	must(s.SetHeader("k1", "Authorization", "Bearer 2")) // replaced
+	must(s.SetHeader("k1", "X-Gone", ""))                // removed, as set at construction
+	must(s.SetPadding("k1", PadFixed, 128))
+	must(s.SetCertChecks("k1", true, 2, true))
+	must(s.SetRetries("gone", 3))
+	want := k1.settings()
+
+	// transports replaced or removed since do not get settings of those before
+	s.Remove("gone")
+	k2, gone2, fresh := newKnobTransport("k1"), newKnobTransport("gone"), newKnobTransport("fresh")
+	filling, gate := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Restart("", ft, func(r Resolver) error {
+			if !r.Add(k2) || !r.Add(gone2) || !r.Add(fresh) {
+				return ErrAddFailed
+			}
+			close(filling)
+			<-gate
+			return nil
+		})
+	}()
+	<-filling
+	// and those set while the new resolver fills are kept, too
+	must(s.SetRetries("k1", 4))
+	want["retries"] = "4"
+	close(gate)
+	must(<-done)
+
+	if got := k2.settings(); !maps.Equal(got, want) {
+		t.Errorf("restart: settings %v; want %v", got, want)
+	}
+	for _, tr := range []*knobTransport{gone2, fresh} {
+		if got := tr.settings(); len(got) > 0 {
+			t.Errorf("restart: %s: settings %v; want none", tr.id, got)
+		}
+	}
+
+	// and across restarts
+	k3 := newKnobTransport("k1")
+	must(s.Restart("", ft, func(r Resolver) error {
+		if !r.Add(k3) {
+			return ErrAddFailed
+		}
+		return nil
+	}))
+	if got := k3.settings(); !maps.Equal(got, want) {
+		t.Errorf("restart: again: settings %v; want %v", got, want)
+	}
+}
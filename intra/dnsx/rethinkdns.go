@@ -79,11 +79,13 @@ type rethinkdns struct {
 	tags  map[string]string
 	mode  int
 	stamp string
+	// stamp => csv of blocklist names; see: StampToNames
+	named *blockcache
 }
 
 type rethinkdnslocal struct {
 	*rethinkdns
-	ftrie *trie.FrozenTrie
+	ftrie dnlookup // a *trie.FrozenTrie
 }
 
 type listinfo struct {
@@ -103,6 +105,7 @@ func newRDNSRemote(filetagjson string) (*rethinkdns, error) {
 		flags: flags,
 		tags:  tags,
 		mode:  remoteBlock,
+		named: newBlockCache(),
 	}
 	return r, nil
 }
@@ -129,8 +132,9 @@ func newRDNSLocal(t string, rank string,
 		// pos/index/value ->subgroup:vname
 		flags: flags,
 		// uname -> subgroup:vname
-		tags: tags,
-		mode: localBlock,
+		tags:  tags,
+		mode:  localBlock,
+		named: newBlockCache(),
 	}
 	rlocal := &rethinkdnslocal{
 		rethinkdns: r,
@@ -216,6 +220,10 @@ func (r *rethinkdns) StampToFlags(stamp string) (string, error) {
 }
 
 func (r *rethinkdns) StampToNames(stamp string) (string, error) {
+	// stamps sent by upstreams repeat for most answers; decode them once
+	if names, ok := r.named.get(stamp); ok {
+		return names, nil
+	}
 	blocklists, err := r.stampToBlocklist(stamp)
 	if err != nil {
 		return "", err
@@ -226,7 +234,9 @@ func (r *rethinkdns) StampToNames(stamp string) (string, error) {
 		blocklistnames = append(blocklistnames, x.name)
 	}
 
-	return strings.Join(blocklistnames[:], ","), nil
+	names := strings.Join(blocklistnames[:], ",")
+	r.named.put(stamp, names)
+	return names, nil
 }
 
 func (r *rethinkdns) stampToBlocklist(stamp string) ([]*listinfo, error) {
@@ -290,18 +300,15 @@ func (r *rethinkdnslocal) blockQuery(msg *dns.Msg) (blocklists string, err error
 		err = errNoStamps
 		return
 	}
+	qtype := msg.Question[0].Qtype
+	if !(xdns.IsAAAAQType(qtype) || xdns.IsAQType(qtype) || xdns.IsSVCBQType(qtype) || xdns.IsHTTPSQType(qtype)) {
+		err = fmt.Errorf("unsupported dns query type %v", qtype)
+		return
+	}
 	for _, quest := range msg.Question {
-		// err when incoming name != ascii, ignore
-		qname, _ := xdns.NormalizeQName(quest.Name)
-		qtype := msg.Question[0].Qtype
-		if !(xdns.IsAAAAQType(qtype) || xdns.IsAQType(qtype) || xdns.IsSVCBQType(qtype) || xdns.IsHTTPSQType(qtype)) {
-			err = fmt.Errorf("unsupported dns query type %v", qtype)
-			return
-		}
-		block, lists := r.ftrie.DNlookup(qname, stamp)
 		// TODO: handle empty lists as err?
-		if block {
-			blocklists = strings.Join(r.keyToNames(lists), ",")
+		if block, lists := r.lookup(quest.Name, stamp); block {
+			blocklists = lists
 			return
 		}
 	}
@@ -346,11 +353,8 @@ func (r *rethinkdnslocal) blockAnswer(msg *dns.Msg) (blocklists string, err erro
 			continue
 		}
 
-		// ignore err when incoming name != ascii
-		target, _ = xdns.NormalizeQName(target)
-		block, lists := r.ftrie.DNlookup(target, stamp)
-		if block { // TODO: handle empty lists as err?
-			blocklists = strings.Join(r.keyToNames(lists), ",")
+		if block, lists := r.lookup(target, stamp); block { // TODO: handle empty lists as err?
+			blocklists = lists
 			return
 		}
 	}
@@ -359,6 +363,18 @@ func (r *rethinkdnslocal) blockAnswer(msg *dns.Msg) (blocklists string, err erro
 	return
 }
 
+// lookup returns true, and csv of names of blocklists in stamp that block
+// name, if any.
+func (r *rethinkdnslocal) lookup(name, stamp string) (block bool, blocklists string) {
+	// ignore err when incoming name != ascii
+	qname, _ := xdns.NormalizeQName(name)
+	block, lists := r.ftrie.DNlookup(qname, stamp)
+	if block {
+		blocklists = xdns.CapCsv(strings.Join(r.keyToNames(lists), ","))
+	}
+	return
+}
+
 func load(configjson string) ([]string, map[string]string, error) {
 	data, err := os.ReadFile(configjson)
 	if err != nil {
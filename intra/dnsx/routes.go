@@ -0,0 +1,208 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+)
+
+var (
+	errBadRouteName = errors.New("domain route: invalid name")
+	errBadRoutePID  = errors.New("domain route: invalid proxy")
+)
+
+// domainroutes is a table of client-set domain -> proxy routes; queries
+// for a routed name are resolved over its proxy (as their exit), and
+// alg answers for it are tagged with the proxy, for flows to honor.
+// Names may also be categories (cat:gambling) of domains; see: categories.
+type domainroutes struct {
+	sync.RWMutex                   // protects names, pids, catpids
+	names        x.RadixTree       // name or .wildcard -> name
+	pids         map[string]string // name or .wildcard -> proxy id
+	catpids      map[string]string // category -> proxy id
+	cats         *categories       // may be nil
+}
+
+func newDomainRoutes() *domainroutes {
+	return &domainroutes{
+		names:   x.NewRadixTree(),
+		pids:    make(map[string]string),
+		catpids: make(map[string]string),
+	}
+}
+
+// routekey returns the key of name, a domain or a category.
+func routekey(name string) (k string, cat bool, err error) {
+	if c, ok := strings.CutPrefix(name, catprefix); ok {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if len(c) <= 0 || strings.Contains(c, ",") {
+			return "", true, errBadRouteName
+		}
+		return c, true, nil
+	}
+	if k, err = localkey(name); err != nil { // *.bbc.co.uk is keyed as .bbc.co.uk
+		return "", false, errBadRouteName
+	}
+	return k, false, nil
+}
+
+func (d *domainroutes) add(name, pid string) error {
+	k, cat, err := routekey(name)
+	if err != nil {
+		return err
+	}
+	// routes to Base or Exit are the same as no route at all; and
+	// block (or defer) is for the firewall to decide, not for a route
+	if len(pid) <= 0 || IsLocalProxy(pid) || pid == x.Block || pid == x.Defer {
+		return errBadRoutePID
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if cat {
+		d.catpids[k] = pid
+	} else {
+		d.pids[k] = pid
+		d.names.Set(k, k)
+	}
+
+	log.I("dns: route: add %s (cat? %t) => %s", k, cat, pid)
+	return nil
+}
+
+func (d *domainroutes) remove(name string) bool {
+	k, cat, err := routekey(name)
+	if err != nil {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	var ok bool
+	if cat {
+		_, ok = d.catpids[k]
+		delete(d.catpids, k)
+	} else {
+		_, ok = d.pids[k]
+		delete(d.pids, k)
+		d.names.Del(k)
+	}
+
+	log.I("dns: route: rm %s; ok? %t", k, ok)
+	return ok
+}
+
+func (d *domainroutes) list() string {
+	d.RLock()
+	defer d.RUnlock()
+
+	lines := make([]string, 0, len(d.pids)+len(d.catpids))
+	for k, pid := range d.pids {
+		name := k
+		if strings.HasPrefix(k, ".") {
+			name = "*" + k
+		}
+		lines = append(lines, name+"="+pid)
+	}
+	for c, pid := range d.catpids {
+		lines = append(lines, catprefix+c+"="+pid)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// match returns the proxy routed to for the first of names that has
+// a route (for its most specific name or wildcard), if any; or else,
+// for the categories of names, as cached (see: matchCategory).
+func (d *domainroutes) match(names ...string) (pid string) {
+	if d == nil {
+		return
+	}
+
+	d.RLock()
+	hascats := len(d.catpids) > 0
+	if d.names.Len() > 0 {
+		for _, name := range names {
+			if k, err := xdns.NormalizeQName(name); err == nil {
+				if pid = d.matchLocked(k); len(pid) > 0 {
+					d.RUnlock()
+					return
+				}
+			}
+		}
+	}
+	d.RUnlock()
+
+	if d.cats != nil {
+		// looked up regardless, so names get categorized ahead of flows
+		if cats := d.cats.lookup(names...); hascats {
+			pid = d.matchCategory(cats...)
+		}
+	}
+	return
+}
+
+// matchCategory returns the proxy routed to for the first of cats (in
+// lexical order) that has a route, if any.
+func (d *domainroutes) matchCategory(cats ...string) string {
+	if d == nil || len(cats) <= 0 {
+		return ""
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, c := range cats {
+		if pid, ok := d.catpids[c]; ok {
+			return pid
+		}
+	}
+	return ""
+}
+
+// matchLocked returns the proxy for the most specific name or
+// wildcard that covers qname, if any. qname must be normalized.
+func (d *domainroutes) matchLocked(qname string) string {
+	if d.names.Has(qname) {
+		return d.pids[qname]
+	}
+	// walk up the labels: a.b.bbc.co.uk => .b.bbc.co.uk, .bbc.co.uk, .co.uk, .uk
+	for rest := qname; ; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		parent := rest[i:] // has leading dot
+		if d.names.Has(parent) {
+			return d.pids[parent]
+		}
+		rest = rest[i+1:]
+	}
+	return ""
+}
+
+// Implements x.DomainRouter
+func (r *resolver) AddDomainRoute(name, pid string) error {
+	return r.routes.add(name, pid)
+}
+
+// Implements x.DomainRouter
+func (r *resolver) RemoveDomainRoute(name string) bool {
+	return r.routes.remove(name)
+}
+
+// Implements x.DomainRouter
+func (r *resolver) ListDomainRoutes() string {
+	return r.routes.list()
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func TestDomainRoutes(t *testing.T) {
+	d := newDomainRoutes()
+	if err := d.add("*.bbc.co.uk", "wguk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.add("iplayer.bbc.co.uk", "wguk2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range []string{"", NetNoProxy, NetExitProxy, x.Block} {
+		if err := d.add("example.com", pid); err == nil {
+			t.Errorf("route: add to %q: want err", pid)
+		}
+	}
+	if err := d.add("*", "wguk"); err == nil {
+		t.Errorf("route: add *: want err")
+	}
+
+	cases := []struct {
+		name, want string
+	}{
+		{"news.bbc.co.uk.", "wguk"},
+		{"a.b.bbc.co.uk", "wguk"},
+		{"NEWS.BBC.co.uk.", "wguk"},
+		{"iplayer.bbc.co.uk.", "wguk2"}, // most specific wins
+		{"bbc.co.uk.", ""},              // wildcards cover subdomains only
+		{"notbbc.co.uk.", ""},
+		{"example.com.", ""},
+	}
+	for _, c := range cases {
+		if got := d.match(c.name); got != c.want {
+			t.Errorf("route: %s: want %q, got %q", c.name, c.want, got)
+		}
+	}
+	// the first of names with a route wins
+	if got := d.match("example.com.", "x.bbc.co.uk."); got != "wguk" {
+		t.Errorf("route: chain: want wguk, got %q", got)
+	}
+
+	if !d.remove("*.bbc.co.uk") || d.remove("*.bbc.co.uk") {
+		t.Errorf("route: remove: want true, then false")
+	}
+	if got := d.match("news.bbc.co.uk."); got != "" {
+		t.Errorf("route: removed: got %q", got)
+	}
+	if got := d.list(); got != "iplayer.bbc.co.uk=wguk2" {
+		t.Errorf("route: list: got %q", got)
+	}
+}
+
+// cnameTransport answers with a cname from the query name to target,
+// and an A record for target.
+func cnameTransport(target, realip string) fakeTransport {
+	return fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{
+			xdns.MakeCNAMERecord(n, target, 60),
+			xdns.MakeARecord(target, realip, 60),
+		}
+	}}
+}
+
+func routeQuery(t *testing.T, gw *dnsgateway, tr Transport, exit, qname string) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, dns.TypeA)
+	qb, _ := q.Pack()
+	res, err := gw.q(tr, nil, nil, exit, NetTypeUDP, qb, new(x.DNSSummary))
+	if err != nil {
+		t.Fatalf("route: %s err %v", qname, err)
+	}
+	ips := xdns.AAnswer(xdns.AsMsg(res))
+	if len(ips) <= 0 {
+		t.Fatalf("route: %s no alg ip", qname)
+	}
+	return ips[0].AsSlice()
+}
+
+func TestRouteCNAMEChain(t *testing.T) {
+	r := &resolver{routes: newDomainRoutes()}
+	if err := r.AddDomainRoute("*.bbc.co.uk", "wguk"); err != nil {
+		t.Fatal(err)
+	}
+
+	gw := NewDNSGateway(r, fakeNatPt{})
+	gw.routes = r.routes
+	gw.translate(true)
+
+	// the queried name is routed, the canonical name is not: resolution
+	// and the flow are both routed, as decided by the queried name
+	qname := "www.bbc.co.uk."
+	exit := r.routeFor(qname)
+	if exit != "wguk" {
+		t.Fatalf("route: %s: want exit wguk, got %q", qname, exit)
+	}
+	algip := routeQuery(t, gw, cnameTransport("bbc.map.fastly.net.", "10.1.1.1"), exit, qname)
+	if got := gw.Route(algip); got != "wguk" {
+		t.Errorf("route: %s => fastly: want wguk, got %q", qname, got)
+	}
+	if got := gw.Exit(algip); got != "wguk" {
+		t.Errorf("route: %s => fastly: exit want wguk, got %q", qname, got)
+	}
+
+	// the queried name is not routed, the canonical name is: the flow is
+	// routed, though its answer came from the default resolver
+	qname = "bbc-news.example."
+	if exit := r.routeFor(qname); exit != "" {
+		t.Fatalf("route: %s: want no exit, got %q", qname, exit)
+	}
+	algip = routeQuery(t, gw, cnameTransport("edge.bbc.co.uk.", "10.2.2.2"), "", qname)
+	if got := gw.Route(algip); got != "wguk" {
+		t.Errorf("route: %s => bbc: want wguk, got %q", qname, got)
+	}
+	if got := gw.Exit(algip); got != "" {
+		t.Errorf("route: %s => bbc: want no exit, got %q", qname, got)
+	}
+	// realips are tagged, too, for when alg is off
+	if got := gw.Route(net.ParseIP("10.2.2.2").To4()); got != "wguk" {
+		t.Errorf("route: realip: want wguk, got %q", got)
+	}
+
+	// neither name is routed
+	algip = routeQuery(t, gw, cnameTransport("cdn.example.", "10.3.3.3"), "", "www.example.")
+	if got := gw.Route(algip); got != "" {
+		t.Errorf("route: unrouted: got %q", got)
+	}
+
+	// blocked and local queries are never routed
+	if got := r.routeFor("www.bbc.co.uk.", BlockAll); got != "" {
+		t.Errorf("route: blockall: got %q", got)
+	}
+	if got := r.routeFor("www.bbc.co.uk.", Local); got != "" {
+		t.Errorf("route: local: got %q", got)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"slices"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+)
+
+var (
+	errStaging    = errors.New("dns: already staging")
+	errNotStaging = errors.New("dns: not staging")
+)
+
+// Stager is a Resolver whose transport changes may be staged, and then
+// applied all at once, or discarded.
+type Stager interface {
+	// Stage has Add, AddAll, and Remove stage changes from here on, instead
+	// of applying them, till Commit or Discard; errs if already staging.
+	Stage() error
+	// Commit applies staged changes in one swap of the transports, and
+	// stops staging: transports are added (or replaced) and removed as
+	// staged last; those staged and then removed are never added. Errs if
+	// not staging.
+	Commit() error
+	// Discard drops staged changes, and stops staging; no-op if not staging.
+	Discard()
+	// Staging returns true if changes are being staged; if so, Commit
+	// does not err.
+	Staging() bool
+}
+
+var _ Stager = (*restartable)(nil)
+
+// staged are transport changes, by id; nil for those removed.
+type staged struct {
+	ts map[string]Transport
+}
+
+// Implements Stager
+func (s *restartable) Stage() error {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	if s.stg != nil {
+		return errStaging
+	}
+	s.stg = &staged{ts: make(map[string]Transport)}
+	log.I("dns: stage: begin")
+	return nil
+}
+
+// Implements Stager
+func (s *restartable) Commit() error {
+	s.smu.Lock()
+	stg := s.stg
+	s.stg = nil
+	s.smu.Unlock()
+	if stg == nil {
+		return errNotStaging
+	}
+
+	adds := make([]Transport, 0, len(stg.ts))
+	removes := make([]string, 0)
+	for id, t := range stg.ts {
+		if t != nil {
+			adds = append(adds, t)
+		} else {
+			removes = append(removes, id)
+		}
+	}
+	s.mutate(func(r *resolver) bool {
+		cts := make([]Transport, len(adds))
+		for i, t := range adds {
+			cts[i] = newCachingTransport(t, ttl10m, r.ttls)
+		}
+		r.swap(adds, cts, removes)
+		return true
+	})
+	log.I("dns: stage: commit; %d added, %d removed", len(adds), len(removes))
+	return nil
+}
+
+// Implements Stager
+func (s *restartable) Discard() {
+	s.smu.Lock()
+	stg := s.stg
+	s.stg = nil
+	s.smu.Unlock()
+	if stg == nil {
+		return
+	}
+	// DNSCrypt transports are registered with DcProxy as they are made
+	if tm, err := s.r().dcProxy(); err == nil {
+		for id, t := range stg.ts {
+			if t != nil && t.Type() == DNSCrypt {
+				if !s.r().has(id) { // not live
+					tm.Remove(id)
+				}
+			}
+		}
+	}
+	log.I("dns: stage: discard %d", len(stg.ts))
+}
+
+// Implements Stager
+func (s *restartable) Staging() bool {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	return s.stg != nil
+}
+
+// staging applies f to staged changes, if staging; and returns its
+// result, and true. Returns false, false if not staging.
+func (s *restartable) staging(f func(*staged) bool) (ok, staging bool) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	if s.stg == nil {
+		return false, false
+	}
+	return f(s.stg), true
+}
+
+// add stages dt, if it can be added; see: resolver.Add
+func (stg *staged) add(dt x.DNSTransport) bool {
+	t, ok := dt.(Transport)
+	if !ok || !addable(t) {
+		return false
+	}
+	stg.ts[t.ID()] = t
+	return true
+}
+
+// remove stages the removal of id; returns true if it is live (as per
+// live) or staged.
+func (stg *staged) remove(id string, live bool) bool {
+	t, ok := stg.ts[id]
+	if live {
+		stg.ts[id] = nil
+	} else {
+		delete(stg.ts, id) // never added
+	}
+	return live || (ok && t != nil)
+}
+
+// has returns true if r has transport id, as-is.
+func (r *resolver) has(id string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.transports[id]
+	return ok
+}
+
+// addable returns true if t can be added with Add or AddAll.
+func addable(t Transport) bool {
+	if t == nil || t.ID() == Default || cachedTransport(t) {
+		return false
+	}
+	return slices.Contains([]string{DNS53, DNSCrypt, DOH, DOT, ODOH, Group, Client}, t.Type())
+}
+
+// addAll stages ts, if all of them can be added; see: AddAll
+func (stg *staged) addAll(ts ...Transport) error {
+	for _, t := range ts {
+		if !addable(t) {
+			return ErrAddFailed
+		}
+	}
+	for _, t := range ts {
+		stg.ts[t.ID()] = t
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStageCommit(t *testing.T) {
+	s, ft := newRestartable(t)
+	var n, max atomic.Int32
+	t2 := &warmTransport{id: "t2", n: &n, max: &max}
+	t3 := &warmTransport{id: "t3", n: &n, max: &max}
+
+	if err := s.Stage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stage(); !errors.Is(err, errStaging) {
+		t.Errorf("stage: twice: want %v, got %v", errStaging, err)
+	}
+	if !s.Add(t2) || !s.Add(t3) {
+		t.Fatal("stage: add")
+	}
+	if s.Add(&warmTransport{id: Default, n: &n, max: &max}) {
+		t.Errorf("stage: default added")
+	}
+	if !s.Remove(ft.ID()) || !s.Remove(t3.ID()) {
+		t.Fatal("stage: remove")
+	}
+	if s.Remove("none") {
+		t.Errorf("stage: removed none")
+	}
+	// live transports are left as-is till commit
+	if s.r().has(t2.ID()) || !s.r().has(ft.ID()) {
+		t.Errorf("stage: applied before commit")
+	}
+
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	r := s.r()
+	if !r.has(t2.ID()) || !r.has(CT+t2.ID()) {
+		t.Errorf("stage: t2 not added")
+	}
+	if r.has(t3.ID()) || r.has(ft.ID()) || r.has(CT+ft.ID()) {
+		t.Errorf("stage: t3 added, or fake not removed")
+	}
+	if err := s.Commit(); !errors.Is(err, errNotStaging) {
+		t.Errorf("stage: commit twice: want %v, got %v", errNotStaging, err)
+	}
+
+	if err := s.Stage(); err != nil {
+		t.Fatal(err)
+	}
+	s.Add(t3)
+	s.Remove(t2.ID())
+	s.Discard()
+	if r.has(t3.ID()) || !r.has(t2.ID()) {
+		t.Errorf("stage: discarded, but applied")
+	}
+	// no longer staging
+	if !s.Add(t3) || !r.has(t3.ID()) {
+		t.Errorf("stage: add after discard not applied")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+var errStrictBound = errors.New("strict: no fallback")
+
+// stricttransports are transports queries are strictly bound to; see:
+// x.DNSStrict. Ids are sans the CT prefix.
+type stricttransports struct {
+	sync.RWMutex
+	m map[string]map[string]struct{} // id => allowed ids
+}
+
+func newStrictTransports() *stricttransports {
+	return &stricttransports{m: make(map[string]map[string]struct{})}
+}
+
+func (s *stricttransports) set(id string, strict bool, allowed string) {
+	id = strings.TrimPrefix(id, CT)
+	if len(id) <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if !strict {
+		delete(s.m, id)
+		return
+	}
+	ok := make(map[string]struct{})
+	for _, a := range strings.Split(allowed, ",") {
+		if a = strings.TrimPrefix(strings.TrimSpace(a), CT); len(a) > 0 {
+			ok[a] = struct{}{}
+		}
+	}
+	s.m[id] = ok
+}
+
+// bound returns the first of ids that is strict, if any.
+func (s *stricttransports) bound(ids ...string) string {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.m) <= 0 {
+		return ""
+	}
+	for _, id := range ids {
+		id = strings.TrimPrefix(id, CT)
+		if _, ok := s.m[id]; ok && len(id) > 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// allows returns true if queries bound to id may be sent over transport t,
+// which may be nil; true if id is not strict.
+func (s *stricttransports) allows(id string, t Transport) bool {
+	s.RLock()
+	defer s.RUnlock()
+	ok, strict := s.m[id]
+	if !strict {
+		return true
+	}
+	if t == nil {
+		return false
+	}
+	tid := strings.TrimPrefix(t.ID(), CT)
+	if tid == id {
+		return true
+	}
+	_, allowed := ok[tid]
+	return allowed
+}
+
+// strictServfail answers q bound to id with SERVFAIL, and with an extended
+// dns error that tells of code, and sets summary to match.
+func strictServfail(q []byte, id string, code uint16, summary *x.DNSSummary) []byte {
+	summary.Status = StrictError
+	summary.RCode = dns.RcodeServerFailure
+	summary.RData = ""
+	return xdns.ServfailWithEDE(q, code, "strict: "+id)
+}
+
+// SetStrictTransport implements x.DNSStrict.
+func (r *resolver) SetStrictTransport(id string, strict bool, allowed string) {
+	r.strict.set(id, strict, allowed)
+	log.I("dns: strict: %s? %t; allowed %s", id, strict, allowed)
+}
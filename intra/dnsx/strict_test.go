@@ -0,0 +1,157 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// stubTransport counts queries sent to it, and fails them all, if dead.
+type stubTransport struct {
+	fakeTransport
+	id   string
+	n    atomic.Int32
+	dead atomic.Bool
+}
+
+func newStub(id string) *stubTransport {
+	return &stubTransport{id: id, fakeTransport: fakeTransport{rrs: func(n string) []dns.RR {
+		return []dns.RR{xdns.MakeARecord(n, "1.2.3.4", 60)}
+	}}}
+}
+
+func (t *stubTransport) ID() string { return t.id }
+
+func (t *stubTransport) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	t.n.Add(1)
+	if t.dead.Load() {
+		smm.Status = SendFailed
+		return nil, errors.New("stub: dead")
+	}
+	return t.fakeTransport.Query(network, q, smm)
+}
+
+// optsListener answers OnQuery with opts, and keeps the last summary.
+type optsListener struct {
+	countingListener
+	opts x.DNSOpts
+	smms chan *x.DNSSummary
+}
+
+func (l *optsListener) OnQuery(string, int) *x.DNSOpts {
+	opts := l.opts
+	return &opts
+}
+
+func (l *optsListener) OnResponse(smm *x.DNSSummary) {
+	select {
+	case l.smms <- smm:
+	default:
+	}
+}
+
+func strictQuery(t *testing.T, r *resolver, name string) (*dns.Msg, error) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qb, _ := q.Pack()
+	res, err := r.Forward(qb)
+	return xdns.AsMsg(res), err
+}
+
+func wantStrictServfail(t *testing.T, name string, ans *dns.Msg, err error) {
+	t.Helper()
+	if err == nil || ans == nil || ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("strict: %s: want servfail; got %v, %v", name, ans, err)
+	}
+	opt := ans.IsEdns0()
+	if opt == nil {
+		t.Fatalf("strict: %s: no edns", name)
+	}
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && len(ede.ExtraText) > 0 {
+			return
+		}
+	}
+	t.Errorf("strict: %s: no extended dns error in %v", name, opt)
+}
+
+func TestStrictNoFallback(t *testing.T) {
+	def := newStub(Default)
+	wg := newStub("wg0")
+	l := &optsListener{smms: make(chan *x.DNSSummary, 1)}
+	r := NewResolver("", settings.DefaultTunMode(), def, l, nil).(*resolver)
+	r.Lock()
+	r.transports[wg.ID()] = wg
+	r.Unlock()
+
+	// apps on wg0 whose queries OnQuery sends to Preferred, which is missing,
+	// and so, Default stands in for it; with wg0's own transport killed
+	l.opts = x.DNSOpts{TIDCSV: Preferred, PID: "wg0", UID: "10100"}
+	r.Lock()
+	delete(r.transports, wg.ID())
+	r.Unlock()
+	if _, err := strictQuery(t, r, "leak.example."); err != nil || def.n.Load() != 1 {
+		t.Fatalf("strict: off: want fallback to default; got %d, %v", def.n.Load(), err)
+	}
+
+	<-l.smms
+
+	def.n.Store(0)
+	r.SetStrictTransport("wg0", true, "")
+	ans, err := strictQuery(t, r, "strict1.example.")
+	wantStrictServfail(t, "killed", ans, err)
+	select {
+	case smm := <-l.smms:
+		if smm.Status != StrictError {
+			t.Errorf("strict: killed: want status %d; got %+v", StrictError, smm)
+		}
+	case <-time.After(time.Second):
+		t.Error("strict: killed: no summary")
+	}
+
+	// wg0's transport is back, but dead; queries that OnQuery sends to
+	// Default (which otherwise go over Exit) are sent over wg0, and fail
+	// there; and the secondary, Default, is never queried either
+	r.Lock()
+	r.transports[wg.ID()] = wg
+	r.Unlock()
+	wg.dead.Store(true)
+	l.opts = x.DNSOpts{TIDCSV: Default + "," + Default, PID: "wg0", UID: "10100"}
+	ans, err = strictQuery(t, r, "strict2.example.")
+	wantStrictServfail(t, "dead", ans, err)
+	if wg.n.Load() != 1 {
+		t.Errorf("strict: dead: want 1 query over wg0, got %d", wg.n.Load())
+	}
+
+	// transports picked by OnQuery may be bound, too
+	l.opts = x.DNSOpts{TIDCSV: "wg0," + Default}
+	ans, err = strictQuery(t, r, "strict3.example.")
+	wantStrictServfail(t, "picked", ans, err)
+
+	if n := def.n.Load(); n != 0 {
+		t.Fatalf("strict: want no queries to default; got %d", n)
+	}
+
+	// unless default is allowed
+	r.SetStrictTransport("wg0", true, Default)
+	r.Lock()
+	delete(r.transports, wg.ID())
+	r.Unlock()
+	l.opts = x.DNSOpts{TIDCSV: Preferred, PID: "wg0", UID: "10100"}
+	if _, err := strictQuery(t, r, "allowed.example."); err != nil || def.n.Load() != 1 {
+		t.Errorf("strict: allowed: want fallback to default; got %d, %v", def.n.Load(), err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/miekg/dns"
+)
+
+// sysTransport is a System transport of a network, as set on network changes.
+type sysTransport struct {
+	fakeTransport
+	addr string
+}
+
+func (*sysTransport) ID() string        { return System }
+func (t *sysTransport) GetAddr() string { return t.addr }
+
+func newSysTransport(n int) *sysTransport {
+	return &sysTransport{
+		fakeTransport: fakeTransport{rrs: func(string) []dns.RR { return nil }},
+		addr:          fmt.Sprintf("10.0.%d.1:53", n%250),
+	}
+}
+
+// sysNatPt records the dns64 underlay resolver, and the transports D64 is
+// called with; registrations take a while, as they query over the network.
+type sysNatPt struct {
+	fakeNatPt
+	mu       sync.Mutex
+	underlay Transport // may be nil
+	bad      atomic.Int32
+}
+
+func (n *sysNatPt) Add64(id string, f Transport) bool {
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+	if id == UnderlayResolver {
+		n.mu.Lock()
+		n.underlay = f
+		n.mu.Unlock()
+	}
+	return true
+}
+
+func (n *sysNatPt) Remove64(id string) bool {
+	if id == UnderlayResolver {
+		n.mu.Lock()
+		n.underlay = nil
+		n.mu.Unlock()
+	}
+	return true
+}
+
+func (n *sysNatPt) D64(_ string, _ []byte, f Transport) []byte {
+	if f == nil {
+		n.bad.Add(1)
+	}
+	return nil
+}
+
+func (n *sysNatPt) get() Transport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.underlay
+}
+
+// waitUnderlay waits for the dns64 underlay to be want.
+func waitUnderlay(t *testing.T, pt *sysNatPt, want Transport) {
+	for deadline := time.Now().Add(2 * time.Second); pt.get() != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("dns64: underlay: want %v, got %v", want, pt.get())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSystemSwapAtomic(t *testing.T) {
+	pt := new(sysNatPt)
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, &tidListener{tid: System}, pt).(*resolver)
+	r.Add(newSysTransport(0))
+
+	const changes = 500
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("sys.example.", dns.TypeA)
+			qb, _ := q.Pack()
+			for !done.Load() {
+				if _, err := r.Forward(qb); err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+
+	var last *sysTransport
+	for i := range changes {
+		last = newSysTransport(i + 1)
+		r.Add(last)
+	}
+	done.Store(true)
+	wg.Wait()
+
+	if n := failed.Load(); n > 0 {
+		t.Errorf("system: %d queries failed while it was swapped", n)
+	}
+	if n := pt.bad.Load(); n > 0 {
+		t.Errorf("system: d64 called %d times without a transport", n)
+	}
+	waitUnderlay(t, pt, last)
+	if got, _ := r.Get(System); got != last {
+		t.Errorf("system: want %s, got %v", last.addr, got)
+	}
+}
+
+func TestSystemAddRemoveDNS64(t *testing.T) {
+	pt := new(sysNatPt)
+	r := NewResolver("", settings.DefaultTunMode(), fakeTransport{}, &tidListener{tid: System}, pt).(*resolver)
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%3 == 0 {
+				r.Remove(System)
+			} else {
+				r.Add(newSysTransport(i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the underlay is whatever System ended up as, or none
+	r.RLock()
+	sys := r.transports[System]
+	r.RUnlock()
+	waitUnderlay(t, pt, sys)
+
+	last := newSysTransport(1000)
+	r.Add(last)
+	waitUnderlay(t, pt, last)
+	r.Remove(System)
+	waitUnderlay(t, pt, nil)
+}
@@ -8,12 +8,16 @@ package dnsx
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/netip"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	x "github.com/celzero/firestack/intra/backend"
@@ -33,6 +37,8 @@ const (
 	DNS53    = x.DNS53
 	DOT      = x.DOT
 	ODOH     = x.ODOH
+	Group    = x.Group
+	Client   = x.Client
 
 	CT = x.CT
 
@@ -42,6 +48,7 @@ const (
 	Default   = x.Default
 	Preferred = x.Preferred
 	Preset    = x.Preset
+	LocalRecs = x.LocalRecs
 	BlockFree = x.BlockFree
 	Bootstrap = x.Bootstrap
 	BlockAll  = x.BlockAll
@@ -49,6 +56,8 @@ const (
 	DcProxy   = x.DcProxy
 	IpMapper  = x.IpMapper
 
+	Designated = x.Designated
+
 	invalidQname = "invalid.query"
 
 	// preferred network to use with t.Query
@@ -61,6 +70,11 @@ const (
 
 	ttl10m = 10 * time.Minute
 
+	// max transports re-added at once on refresh
+	maxRefreshers = 4
+	// total time to wait on all transports to refresh
+	refreshTimeout = 20 * time.Second
+
 	// pseudo transport ID to tag dns64 responses
 	AlgDNS64 = "dns64"
 )
@@ -85,6 +99,9 @@ var (
 	errNoRdns              = errors.New("no rdns")
 	errTransportNotMult    = errors.New("not a multi-transport")
 	errMissingQueryName    = errors.New("no query name")
+	errNoRetries           = errors.New("transport does not retry")
+	errNoHeaders           = errors.New("transport does not take headers")
+	errNoPadding           = errors.New("transport does not pad")
 )
 
 // Transport represents a DNS query transport.  This interface is exported by gobind,
@@ -97,6 +114,25 @@ type Transport interface {
 	Query(network string, q []byte, summary *x.DNSSummary) ([]byte, error)
 }
 
+// Retrier is a Transport that retries queries that fail to send or get no response.
+type Retrier interface {
+	// SetRetries sets the max retries after the first attempt; 0 disables retries.
+	SetRetries(n int)
+}
+
+// HeaderSetter is a Transport that sends headers with its requests (ex: DoH).
+type HeaderSetter interface {
+	// SetHeader sets header key to value; an empty value removes key.
+	SetHeader(key, value string) error
+}
+
+// Padder is an encrypted Transport that pads its queries; see: Padding.
+type Padder interface {
+	// SetPadding sets the padding policy (PadOff, PadFixed, PadRecommended),
+	// and the block size for PadFixed.
+	SetPadding(policy, block int) error
+}
+
 // TransportMult is a hybrid: transport and a multi-transport.
 type TransportMult interface {
 	x.DNSTransportMult
@@ -105,6 +141,30 @@ type TransportMult interface {
 
 type Resolver interface {
 	x.DNSTransportMult
+	x.LocalRecords
+	x.DomainRouter
+	x.UIDTransports
+	x.DNSRetrier
+	x.DNSHeaders
+	x.DNSPadding
+	x.DNSCertChecks
+	x.DNSDesignated
+	x.DNSIntegrity
+	x.RebindProtector
+	x.TTLClamper
+	x.QuestionsPolicy
+	x.AnswerOrderer
+	x.BlockStats
+	x.DNSUsage
+	x.BlockResponder
+	x.DNSWarmer
+	x.AlgJournal
+	x.DomainCategorizer
+	x.DNSLimiter
+	x.DNSFailsafe
+	x.DNSConnStats
+	x.DNSStrict
+	x.DNSRefreshGens
 	RdnsResolver
 	NatPt
 
@@ -113,14 +173,48 @@ type Resolver interface {
 	Gateway() Gateway
 	// GetMult returns multi-transport, if available
 	GetMult(id string) (TransportMult, error)
+	// AddAll adds ts at once, replacing those of the same ids, if any;
+	// none are added if any one of ts cannot be.
+	AddAll(ts ...Transport) error
 
 	IsDnsAddr(ipport string) bool
+	// IsDivertedDnsAddr returns true if ipport is trapped only because the
+	// DNSMode is DNSModePort, and is not one of the fake dns addrs.
+	IsDivertedDnsAddr(ipport string) bool
+	// SetDnsPassthrough sets ips or cidrs (csv) that dns is let through to
+	// as-is in DNSModePort; an empty csv clears them.
+	SetDnsPassthrough(csv string) error
 	// Lookup performs resolution on Default and/or Goos DNSes
 	LocalLookup(q []byte) ([]byte, error)
 	// Forward performs resolution on any DNS transport
 	Forward(q []byte) ([]byte, error)
 	// Serve reads DNS query from conn and writes DNS answer to conn
 	Serve(proto string, conn protect.Conn)
+	// ServeOver is Serve, but with queries resolved over proxy pid,
+	// by its own dns transport (see: AddProxyDNS), if any.
+	ServeOver(proto string, conn protect.Conn, pid string)
+	// ServeFor is ServeOver (if pid is set), but with queries known to be of
+	// uid, which may resolve over its transport; see: SetUIDTransport.
+	ServeFor(proto string, conn protect.Conn, pid, uid string)
+	// StaleAlg returns the domain algip was answered for, if it is an alg ip
+	// that was handed out and has since been evicted, as per the journal
+	// (see: SetAlgJournal); stale is false otherwise.
+	StaleAlg(algip netip.Addr) (qname string, stale bool)
+	// ReclaimAlg re-establishes the mapping of algip, if it is stale (see:
+	// StaleAlg), by re-resolving the domain it was evicted with; returns
+	// ErrStaleAlgIP if it can't. No-op for ips that are not stale.
+	ReclaimAlg(algip netip.Addr) error
+	// CacheSize returns the number of responses cached across all transports
+	CacheSize() int
+	// TrimCache removes expired cached responses, or all of them if all is set
+	TrimCache(all bool) int
+	// CategoriesOf returns categories (csv) of domains (csv) as cached, and
+	// the proxy any of them is routed over, if any; it never waits on the
+	// Categorizer, but has domains not cached categorized in the background.
+	CategoriesOf(domains string) (cats, route string)
+	// SetDesignatedMaker sets m to make transports of resolvers that System
+	// designates; none are discovered till it is set. See: SetDDR
+	SetDesignatedMaker(m DesignatedMaker)
 }
 
 type resolver struct {
@@ -128,16 +222,42 @@ type resolver struct {
 	NatPt
 	tunmode      *settings.TunMode
 	dnsaddrs     []netip.AddrPort
+	passthru     atomic.Pointer[[]netip.Prefix] // see: SetDnsPassthrough
 	transports   map[string]Transport
 	gateway      Gateway
 	localdomains x.RadixTree
+	hosts        *localrecords
+	routes       *domainroutes
+	cats         *categories
+	uids         *uidtransports
+	rebind       *rebinder
+	ttls         *ttlclamp
+	limits       *qlimits
+	strict       *stricttransports
+	refreshes    *core.Gen     // see: refresh
+	failsafe     failsafe      // of OnQuery
+	multiq       atomic.Int32  // MultiQFirst, MultiQRefuse
+	order        atomic.Int32  // AnswerPreserve, AnswerShuffle, AnswerByLatency
+	rotor        atomic.Uint32 // rotates answers in AnswerShuffle
+	svcb         atomic.Int32  // SVCBBlockNoData, SVCBBlockFakeTarget, SVCBBlockDotTarget
+	reuse        atomic.Int32  // percent; see: SetConnReuseAlert
+	blocks       *blockstats
+	usage        *dnsusage
+	warm         *warmer
+	ddr          *ddr
+	xcheck       *integrity
+	tset         *tsettings // runtime settings of transports; see: adopt
 	rdnsl        *rethinkdnslocal
 	rdnsr        *rethinkdns
 	rmu          sync.RWMutex // protects rdnsr and rdnsl
 	listener     x.DNSListener
+	mu64         sync.Mutex    // serializes dns64 registrations of System
+	gen64        atomic.Uint64 // latest dns64 registration of System
+	staging      atomic.Bool   // being built by Restart; not yet in use
 }
 
 var _ Resolver = (*resolver)(nil)
+var _ x.DNSResolver = (Resolver)(nil)
 
 func NewResolver(fakeaddrs string, tunmode *settings.TunMode, dtr x.DNSTransport, l x.DNSListener, pt NatPt) Resolver {
 	r := &resolver{
@@ -146,15 +266,42 @@ func NewResolver(fakeaddrs string, tunmode *settings.TunMode, dtr x.DNSTransport
 		transports:   make(map[string]Transport),
 		tunmode:      tunmode,
 		localdomains: newUndelegatedDomainsTrie(),
+		hosts:        newLocalRecords(),
+		routes:       newDomainRoutes(),
+		cats:         newCategories(),
+		uids:         newUIDTransports(),
+		rebind:       newRebinder(),
+		ttls:         newTTLClamp(),
+		limits:       newQueryLimits(),
+		strict:       newStrictTransports(),
+		refreshes:    new(core.Gen),
+		blocks:       newBlockStats(),
+		usage:        newDNSUsage(),
+		warm:         newWarmer(),
+		ddr:          newDDR(),
+		xcheck:       newIntegrity(),
+		tset:         newTSettings(),
 	}
-	r.gateway = NewDNSGateway(r, pt)
+	r.routes.cats = r.cats
+	r.setup(fakeaddrs, dtr)
+	log.I("dns: new! gw? %t; default? %s", r.gateway != nil, dtr.GetAddr())
+
+	return r
+}
+
+// setup sets up r's gateway, fake dns addrs, and its default transport dtr.
+func (r *resolver) setup(fakeaddrs string, dtr x.DNSTransport) {
+	gw := NewDNSGateway(r, r.NatPt)
+	gw.ttls = r.ttls
+	gw.routes = r.routes
+	r.gateway = gw
 	r.loadaddrs(fakeaddrs)
 	if dtr.ID() != Default {
 		log.W("dns: not default; ignoring", dtr.ID(), dtr.GetAddr())
 	} else if tr, ok := dtr.(Transport); !ok {
 		log.W("dns: not a transport; ignoring", dtr.ID(), dtr.GetAddr())
 	} else {
-		ctr := NewCachingTransport(tr, ttl10m)
+		ctr := newCachingTransport(tr, ttl10m, r.ttls)
 		r.Lock()
 		r.transports[tr.ID()] = tr // regular
 		if ctr != nil {
@@ -163,10 +310,9 @@ func NewResolver(fakeaddrs string, tunmode *settings.TunMode, dtr x.DNSTransport
 			log.W("dns: no caching transport for %s", tr.ID())
 		}
 		r.Unlock()
+		r.watchConns(tr)
+		go r.warmup(tr)
 	}
-	log.I("dns: new! gw? %t; default? %s", r.gateway != nil, dtr.GetAddr())
-
-	return r
 }
 
 func (r *resolver) Gateway() Gateway {
@@ -192,28 +338,33 @@ func (r *resolver) Add(dt x.DNSTransport) (ok bool) {
 	}
 
 	switch t.Type() {
-	case DNS53, DNSCrypt, DOH, DOT, ODOH:
+	case DNS53, DNSCrypt, DOH, DOT, ODOH, Group, Client:
+		ct := newCachingTransport(t, ttl10m, r.ttls)
+
+		if t.ID() == System {
+			// swapped in place, as System changes with every network
+			r.swapSystem(t, ct)
+			go r.listener.OnDNSAdded(t.ID())
+			go r.warmup(t)
+			go r.discover(t)
+			return true
+		}
+
 		// DNSCrypt transports are also registered with DcProxy
 		// Alg transports are also registered with Gateway
 		// Remove cleans those up
 		r.Remove(t.ID()) // also removes CT
-		if t.ID() == System {
-			go r.Remove64(UnderlayResolver)
-		}
-
-		ct := NewCachingTransport(t, ttl10m)
 
 		r.Lock()
 		r.transports[t.ID()] = t // regular
 		if ct != nil {
 			r.transports[ct.ID()] = ct // cached
 		}
-		if t.ID() == System {
-			go r.Add64(UnderlayResolver, t)
-		}
 		r.Unlock()
 
+		r.watchConns(t)
 		go r.listener.OnDNSAdded(t.ID())
+		go r.warmup(t)
 		log.I("dns: add transport %s@%s; cache? %t", t.ID(), t.GetAddr(), ct != nil)
 
 		return true
@@ -223,6 +374,84 @@ func (r *resolver) Add(dt x.DNSTransport) (ok bool) {
 	return false
 }
 
+// Implements Resolver
+func (r *resolver) AddAll(ts ...Transport) error {
+	cts := make([]Transport, len(ts))
+	for i, t := range ts {
+		if t == nil {
+			return ErrAddFailed
+		}
+		if t.ID() == Default || cachedTransport(t) {
+			return fmt.Errorf("dns: %s: %w", t.ID(), ErrAddFailed)
+		}
+		switch t.Type() {
+		case DNS53, DNSCrypt, DOH, DOT, ODOH, Group, Client:
+			cts[i] = newCachingTransport(t, ttl10m, r.ttls)
+		default:
+			return fmt.Errorf("dns: %s: %s: %w", t.ID(), t.Type(), ErrAddFailed)
+		}
+	}
+
+	r.swap(ts, cts, nil)
+	log.I("dns: added all %d transports", len(ts))
+	return nil
+}
+
+// swap adds ts (with their caching transports, cts, if any), replacing those
+// of the same ids, and removes transports of ids, all in one go; ts must be
+// addable. Listeners are told, and ts are warmed up, once swapped.
+func (r *resolver) swap(ts, cts []Transport, ids []string) {
+	var gen uint64
+	removed := make([]string, 0, len(ids))
+	r.Lock()
+	for _, id := range ids {
+		if _, ok := r.transports[id]; ok {
+			delete(r.transports, id)
+			delete(r.transports, CT+id)
+			removed = append(removed, id)
+			if id == System {
+				gen = r.gen64.Add(1)
+			}
+		}
+	}
+	for i, t := range ts {
+		// unlike Add, DcProxy is left as-is; new DNSCrypt transports
+		// are already registered with it under the same ids
+		r.transports[t.ID()] = t
+		delete(r.transports, CT+t.ID())
+		if ct := cts[i]; ct != nil {
+			r.transports[ct.ID()] = ct
+		}
+		if t.ID() == System {
+			gen = r.gen64.Add(1)
+		}
+	}
+	r.Unlock()
+
+	for _, id := range removed {
+		r.tset.forget(id)
+		if id == System {
+			r.reg64(gen, nil)
+		}
+		if tm, err := r.dcProxy(); err == nil {
+			tm.Remove(id)
+			tm.Remove(CT + id)
+		}
+		go r.listener.OnDNSRemoved(id)
+	}
+	for _, t := range ts {
+		r.tset.forget(t.ID())
+		if t.ID() == System {
+			r.reg64(gen, t)
+			go r.discover(t)
+		}
+		go r.listener.OnDNSAdded(t.ID())
+	}
+	if len(ts) > 0 {
+		go r.warmup(ts...)
+	}
+}
+
 func (r *resolver) GetMult(id string) (TransportMult, error) {
 	r.RLock()
 	t, ok := r.transports[id]
@@ -249,6 +478,93 @@ func (r *resolver) Get(id string) (x.DNSTransport, error) {
 	}
 }
 
+func (r *resolver) SetRetries(id string, n int) error {
+	r.RLock()
+	t, ok := r.transports[id]
+	r.RUnlock()
+
+	if !ok || t == nil {
+		return errNoSuchTransport
+	}
+	if rt, ok := t.(Retrier); ok {
+		rt.SetRetries(n)
+		r.tset.set(id, "retries", func(r *resolver) error { return r.SetRetries(id, n) })
+		log.I("dns: retries for %s set to %d", id, n)
+		return nil
+	}
+	return errNoRetries
+}
+
+func (r *resolver) SetHeader(id, key, value string) error {
+	r.RLock()
+	t, ok := r.transports[id]
+	r.RUnlock()
+
+	if !ok || t == nil {
+		return errNoSuchTransport
+	}
+	if hs, ok := t.(HeaderSetter); ok {
+		if err := hs.SetHeader(key, value); err != nil {
+			return err
+		}
+		r.tset.set(id, "header:"+strings.ToLower(key), func(r *resolver) error { return r.SetHeader(id, key, value) })
+		return nil
+	}
+	return errNoHeaders
+}
+
+func (r *resolver) SetPadding(id string, policy, block int) error {
+	r.RLock()
+	t, ok := r.transports[id]
+	r.RUnlock()
+
+	if !ok || t == nil {
+		return errNoSuchTransport
+	}
+	if p, ok := t.(Padder); ok {
+		if err := p.SetPadding(policy, block); err != nil {
+			return err
+		}
+		r.tset.set(id, "padding", func(r *resolver) error { return r.SetPadding(id, policy, block) })
+		return nil
+	}
+	return errNoPadding
+}
+
+func (r *resolver) SetCertChecks(id string, staple bool, minscts int, keys bool) error {
+	r.RLock()
+	t, ok := r.transports[id]
+	r.RUnlock()
+
+	if !ok || t == nil {
+		return errNoSuchTransport
+	}
+	if cc, ok := t.(CertChecker); ok {
+		err := cc.SetCertChecks(staple, minscts, keys, func(server, prev, next string) {
+			if r.listener != nil {
+				r.listener.OnDNSCertChange(id, server, prev, next)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		r.tset.set(id, "certs", func(r *resolver) error { return r.SetCertChecks(id, staple, minscts, keys) })
+		return nil
+	}
+	return errNoCertChecks
+}
+
+func (r *resolver) CertStatus(id string) string {
+	r.RLock()
+	t, ok := r.transports[id]
+	r.RUnlock()
+
+	if cc, ok2 := t.(CertChecker); ok && ok2 {
+		return cc.CertStatus()
+	}
+	return ""
+}
+
 func (r *resolver) Remove(id string) (ok bool) {
 
 	// these IDs are reserved for internal use
@@ -256,15 +572,23 @@ func (r *resolver) Remove(id string) (ok bool) {
 		log.I("dns: removing reserved transport %s", id)
 	}
 
+	r.Lock()
 	_, hasTransport := r.transports[id]
 	if hasTransport {
-		if id == System {
-			go r.Remove64(UnderlayResolver)
-		}
-		r.Lock()
 		delete(r.transports, id)
 		delete(r.transports, CT+id)
-		r.Unlock()
+	}
+	var gen uint64
+	if hasTransport && id == System {
+		gen = r.gen64.Add(1)
+	}
+	r.Unlock()
+
+	if hasTransport {
+		r.tset.forget(id)
+		if id == System {
+			r.reg64(gen, nil)
+		}
 
 		log.I("dns: removed transport %s", id)
 
@@ -281,6 +605,52 @@ func (r *resolver) Remove(id string) (ok bool) {
 	return false
 }
 
+// swapSystem replaces System and its CT with t and ct at once, so that
+// queries in flight pick either the previous System or t, and never none;
+// dns64 is then registered against t, see: reg64
+func (r *resolver) swapSystem(t, ct Transport) {
+	r.Lock()
+	prev := r.transports[System]
+	r.transports[System] = t
+	if ct != nil {
+		r.transports[ct.ID()] = ct
+	} else {
+		delete(r.transports, CT+System)
+	}
+	gen := r.gen64.Add(1)
+	r.Unlock()
+
+	r.reg64(gen, t)
+	prevaddr := ""
+	if prev != nil {
+		prevaddr = prev.GetAddr()
+	}
+	log.I("dns: swap transport %s@%s => %s; cache? %t", t.ID(), prevaddr, t.GetAddr(), ct != nil)
+}
+
+// reg64 registers t as the dns64 underlay resolver (or deregisters it, if
+// t is nil) in the background; gen must be taken from gen64 along with
+// the change to System, under lock. Registrations are run one at a time,
+// and those superseded while they wait on another are skipped; so the
+// underlay is always the System transport last added (if any).
+func (r *resolver) reg64(gen uint64, t Transport) {
+	if r.NatPt == nil {
+		return
+	}
+	go func() {
+		r.mu64.Lock()
+		defer r.mu64.Unlock()
+		if gen != r.gen64.Load() {
+			return // superseded
+		}
+		if t == nil {
+			r.Remove64(UnderlayResolver)
+		} else {
+			r.Add64(UnderlayResolver, t)
+		}
+	}()
+}
+
 func (r *resolver) IsDnsAddr(ipport string) bool {
 	if len(ipport) <= 0 {
 		return false
@@ -297,29 +667,39 @@ func (r *resolver) LocalLookup(q []byte) ([]byte, error) {
 	}
 
 	// including dns64 and/or alg
-	ans, err := r.forward(q, CT+Default)
+	ans, err := r.forward(q, "", "", CT+Default)
 	if defaultIsSystemDNS {
 		return ans, err
 	} // else: retry with Goos/System, if needed
+	if !r.strict.allows(Default, r.determineTransport(CT+Goos)) {
+		return ans, err // no retries outside of Default, which is strict
+	}
 
 	// msg may be nil
 	if msg := xdns.AsMsg(ans); err != nil || xdns.IsNXDomain(msg) || !xdns.HasRcodeSuccess(msg) {
 		log.I("dns: nxdomain via Default (err? %v); using Goos for %s", err, xdns.QName(msg))
-		return r.forward(q, CT+Goos) // Goos is System; see: determineTransport
+		return r.forward(q, "", "", CT+Goos) // Goos is System; see: determineTransport
 	} // else: rcode success and nil err; do not fallback on Goos/System
 	return ans, nil
 }
 
 func (r *resolver) Forward(q []byte) ([]byte, error) {
-	return r.forward(q)
+	return r.forward(q, "", "")
 }
 
-func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 error) {
+// forward resolves q on chosenids, if any, or as per the listener's
+// preferences (or uid's transport, if any); and over proxy over, if set,
+// whatever else is preferred.
+func (r *resolver) forward(q []byte, over, uid string, chosenids ...string) (res0 []byte, err0 error) {
 	starttime := time.Now()
 	summary := &x.DNSSummary{
 		QName:  invalidQname,
 		Status: Start,
 	}
+	if knownuid(uid) {
+		summary.UID = uid
+	}
+	var tr *core.Trace // set if qname or uid is traced
 	// always call up to the listener
 	defer func() {
 		if err0 != nil {
@@ -327,6 +707,13 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 		} else {
 			summary.Msg = noerr.Error()
 		}
+		summary.Code = ErrCode(summary.Status, summary.RCode)
+		if errors.Is(err0, errListenerTimeout) {
+			summary.Code = x.ErrListenerTimeout
+		}
+		if tr != nil {
+			tr.Event("dns-summary", "%s; msg: %s", summary.Str(), summary.Msg)
+		}
 		go r.listener.OnResponse(summary)
 	}()
 
@@ -337,6 +724,42 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 		summary.Status = BadQuery
 		return nil, err
 	}
+	// answers, however they came about (local, cached, blocked, alg, dns64),
+	// are correlated with msg right before they are sent back to the client;
+	// runs before the listener is called up, as defers run in reverse
+	defer func() {
+		if res, err := correlate(msg, res0); err != nil {
+			summary.Status = BadResponse
+			res0, err0 = res, errors.Join(err0, err)
+		} else {
+			res0 = res
+		}
+	}()
+
+	// queries that are not standard, or have no (or many) questions, are
+	// answered right here, and never forwarded; see: SetMultiQuestion
+	if ans, stripped, why := r.vet(msg); ans != nil {
+		if n := qname(msg); len(n) > 0 {
+			summary.QName = n
+		}
+		summary.QType = qtype(msg)
+		summary.Latency = time.Since(starttime).Seconds()
+		summary.Status = BadQuery
+		summary.RCode = ans.Rcode
+		log.D("dns: fwd: query %s (op: %d, qs: %d) answered %s: %v", summary.QName, msg.Opcode, len(msg.Question), dns.RcodeToString[ans.Rcode], why)
+		b, err := ans.Pack()
+		if err != nil {
+			return nil, err
+		}
+		return b, why
+	} else if stripped {
+		log.D("dns: fwd: query %s: answering only the first question", qname(msg))
+		if q, err = msg.Pack(); err != nil {
+			summary.Latency = time.Since(starttime).Seconds()
+			summary.Status = BadQuery
+			return nil, err
+		}
+	}
 
 	// figure out transport to use
 	qname := qname(msg)
@@ -350,11 +773,51 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 		return nil, errMissingQueryName
 	}
 
-	pref := r.listener.OnQuery(qname, qtyp)
-	id, sid, pid, presetIPs := r.preferencesFrom(qname, uint16(qtyp), pref, chosenids...)
-	t := r.determineTransport(id)
+	if tr = core.Traced(qname, uid); tr != nil {
+		tr.Event("dns-query", "%s (type %d) from uid %q over %q", qname, qtyp, uid, over)
+	}
 
-	log.V("dns: fwd: query %s [prefs:%v]; id? %s, sid? %s, pid? %s, ips? %v", qname, pref, id, sid, pid, presetIPs)
+	// local records override all transports, blocklists, and alg
+	if ans := r.hosts.answer(msg); ans != nil {
+		b, e := ans.Pack()
+		withLocalRecsSummary(summary)
+		summary.Latency = time.Since(starttime).Seconds()
+		summary.RData = xdns.GetInterestingRData(ans)
+		summary.RCode = xdns.Rcode(ans)
+		summary.RTtl = xdns.RTtl(ans)
+		routed(summary, RouteLocalRecords, "")
+		tr.Event("dns-local", "%s answered by local records", qname)
+		log.V("dns: fwd: query %s answered by local records", qname)
+		return b, e
+	}
+
+	pref, answered := r.failsafe.onQuery(r.listener, qname, qtyp)
+	if !answered && r.failsafe.closed() {
+		summary.Latency = time.Since(starttime).Seconds()
+		summary.Status = SendFailed
+		summary.RCode = dns.RcodeServerFailure
+		routed(summary, RouteListenerTimeout, r.failsafe.why())
+		tr.Event("dns-route", "%s: no answer from listener; servfail", qname)
+		return xdns.Servfail(q), errListenerTimeout
+	}
+	if tr == nil && pref != nil && len(pref.UID) > 0 {
+		tr = core.Traced(qname, pref.UID)
+	}
+	id, sid, pid, presetIPs, timeout := r.preferencesFrom(qname, uint16(qtyp), pref, summary, uid, chosenids...)
+	t, fellback := r.transportFor(id)
+	if !answered && len(chosenids) <= 0 {
+		routed(summary, RouteListenerTimeout, r.failsafe.why())
+	} else if id == Alg {
+		routed(summary, RouteAlg, id)
+	} else if fellback {
+		routed(summary, RouteFallback, id)
+	}
+	if tr != nil {
+		tr.Event("dns-route", "%s: onquery %+v; tr %s, sec %s, pid %s, ips %v, timeout %s; route %s (%s)",
+			qname, pref, id, sid, pid, presetIPs, timeout, x.RouteName(summary.Route), summary.RouteWhy)
+	}
+
+	log.V("dns: fwd: query %s [prefs:%v]; id? %s, sid? %s, pid? %s, ips? %v, timeout? %s", qname, pref, id, sid, pid, presetIPs, timeout)
 
 	if t == nil {
 		summary.Latency = time.Since(starttime).Seconds()
@@ -365,19 +828,69 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 	if len(sid) > 0 {
 		t2 = r.determineTransport(sid)
 	}
+	// queries bound to an exit are answered by that exit's own dns, if any;
+	// a domain route binds the query to its proxy, whatever the uid's exit
+	exit := exitFor(pref, pid)
+	if route := r.routeFor(qname, id, sid); len(route) > 0 {
+		log.V("dns: fwd: query %s routed over %s; pid %s, exit %s", qname, route, pid, exit)
+		pid, exit = route, route
+		routed(summary, RouteDomain, route)
+	}
+	// queries served over a proxy are bound to it, whatever the routes
+	if len(over) > 0 && !IsLocalProxy(over) {
+		log.V("dns: fwd: query %s served over %s; pid %s, exit %s", qname, over, pid, exit)
+		pid, exit = over, over
+		routed(summary, RouteServedOver, over)
+	}
+	if xt := r.exitTransport(exit, id, sid); xt != nil {
+		log.V("dns: fwd: query %s bound to exit %s; tr %s => %s", qname, exit, t.ID(), xt.ID())
+		t = xt
+		if summary.Route != RouteDomain && summary.Route != RouteServedOver {
+			routed(summary, RouteExit, exit)
+		}
+	}
+	// queries strictly bound to a transport, or to a proxy (of the flow, even
+	// if pid was overridden for id), are sent over it, or nowhere at all
+	var bound string
+	if !isAnyBlockAll(id, sid) && !isAnyLocal(id, sid) {
+		bound = r.strict.bound(exit, exitFor(pref, prefPID(pref)), id)
+	}
+	if len(bound) > 0 && !r.strict.allows(bound, t) {
+		if bt := r.exitTransport(bound, id, sid); bt != nil {
+			log.I("dns: fwd: strict: query %s bound to %s; tr %s => %s", qname, bound, t.ID(), bt.ID())
+			t = bt
+			if bound != id { // bound to the proxy of the flow
+				pid, exit = bound, bound
+				routed(summary, RouteExit, bound)
+			}
+		} else {
+			log.W("dns: fwd: strict: query %s bound to %s; not over %s", qname, bound, t.ID())
+			tr.Event("dns-route", "%s: strict %s; no fallback to %s", qname, bound, t.ID())
+			summary.ID = bound
+			summary.Latency = time.Since(starttime).Seconds()
+			return strictServfail(q, bound, dns.ExtendedErrorCodeNoReachableAuthority, summary), errStrictBound
+		}
+	}
+	if len(bound) > 0 && t2 != nil && !r.strict.allows(bound, t2) {
+		log.V("dns: fwd: strict: query %s bound to %s; sans secondary %s", qname, bound, t2.ID())
+		t2 = nil
+	}
 
 	gw := r.Gateway()
 
 	res1, blocklists, err := r.blockQ(t, t2, msg) // skips if the t, t2 are alg/block-free
 	if err == nil {
+		tr.Event("dns-block", "%s blocked by %s; noblock? %t", qname, blocklists, pref.NOBLOCK)
 		if pref.NOBLOCK { // only add blocklists and do not actually block
 			summary.Blocklists = blocklists
 		} else {
+			r.ttls.blocked(res1)
 			b, e := res1.Pack()
 			summary.Latency = time.Since(starttime).Seconds()
 			summary.Status = Complete
 			summary.Blocklists = blocklists
 			summary.RData = xdns.GetInterestingRData(res1)
+			r.blocks.add(qname, blocklists)
 			log.V("dns: fwd: query blocked %s by %s", qname, blocklists)
 
 			return b, e
@@ -391,9 +904,22 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 	var res2 []byte
 
 	netid := xdns.NetAndProxyID(NetTypeUDP, pid)
+	if timeout > 0 {
+		summary.Deadline = int(timeout.Milliseconds())
+	}
+	// abandon queries to t that are unanswered at the deadline, if any
+	// and check answers from t (but not t2) before alg substitutes ips
+	// and queue those over t beyond its limit, if any, till the deadline
+	// and inject faults in effect on t, if any, as if of its upstream
+	// and cross-check answers from t against the reference, if sampled
+	t = r.guard(r.crosscheck(withDeadline(r.limits.wrap(withFault(t), timeout), timeout), qname, qtyp), qname)
 
 	// with t2 as the secondary transport, which could be nil
-	res2, err = gw.q(t, t2, presetIPs, netid, q, summary)
+	res2, err = gw.q(t, t2, presetIPs, exit, netid, q, summary)
+	if tr != nil {
+		tr.Event("dns-transport", "%s over %s (%s; member %q, server %s, relay %q) exit %q: status %d, rdata %s, in %.3fs; err? %v",
+			qname, summary.ID, summary.Type, summary.Member, summary.Server, summary.RelayServer, exit, summary.Status, summary.RData, summary.Latency, err)
+	}
 
 	algerr := isAlgErr(err) // not set when gw.translate is off
 	if algerr {
@@ -402,7 +928,13 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 	// in the case of an alg transport, if there's no-alg,
 	// err is set which should be ignored if res2 is not nil
 	if err != nil && !algerr {
-		// summary latency, ips, response, status already set by transport t
+		if errors.Is(err, errQueryDeadline) {
+			summary.Latency = time.Since(starttime).Seconds()
+			summary.Status = NoResponse
+		} // else: summary latency, ips, response, status already set by transport t
+		if len(bound) > 0 { // and so, not retried elsewhere
+			return strictServfail(q, bound, dns.ExtendedErrorCodeNetworkError, summary), err
+		}
 		return res2, err
 	}
 
@@ -412,13 +944,21 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 		return res2, err
 	}
 
+	if tr != nil && id == Alg {
+		tr.Event("dns-alg", "%s answered with %s; alg err? %t", qname, xdns.GetInterestingRData(ans1), algerr)
+	}
+
 	ans2, blocklistnames := r.blockA(t, t2, msg, ans1, summary.Blocklists)
 
 	isnewans := ans2 != nil
+	if isnewans {
+		tr.Event("dns-block", "answer for %s blocked by %s; noblock? %t", qname, blocklistnames, pref.NOBLOCK)
+	}
 	// do not block, only add blocklists if NOBLOCK is set
 	if !pref.NOBLOCK && isnewans {
 		// overwrite if new answer
 		ans1 = ans2
+		r.ttls.blocked(ans1) // ans2 is a blocked answer
 		res2, err = ans1.Pack()
 		if err != nil {
 			summary.Status = BadResponse
@@ -429,11 +969,26 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 		summary.RCode = xdns.Rcode(ans2)
 		summary.RTtl = xdns.RTtl(ans2)
 		summary.Status = Complete
+		r.blocks.add(qname, blocklistnames)
 	}
 	hasblocklists := len(blocklistnames) > 0
 	if hasblocklists {
 		summary.Blocklists = blocklistnames
 	}
+	if rebound(t) {
+		if len(summary.Blocklists) > 0 {
+			summary.Blocklists += "," + RebindProtection
+		} else {
+			summary.Blocklists = RebindProtection
+		}
+	}
+	// order ips last, so that the client sees them as ordered
+	if r.orderAnswer(ans1, summary) {
+		if res2, err = ans1.Pack(); err != nil {
+			summary.Status = BadResponse
+			return res2, err
+		}
+	}
 	ansblocked := xdns.AQuadAUnspecified(ans1)
 
 	log.V("dns: fwd: query %s; new-ans? %t, blocklists? %t, blocked? %t", qname, isnewans, hasblocklists, ansblocked)
@@ -442,19 +997,39 @@ func (r *resolver) forward(q []byte, chosenids ...string) (res0 []byte, err0 err
 }
 
 func (r *resolver) Serve(proto string, c protect.Conn) {
+	r.serve(proto, c, "", "")
+}
+
+func (r *resolver) ServeOver(proto string, c protect.Conn, pid string) {
+	r.serve(proto, c, pid, "")
+}
+
+func (r *resolver) ServeFor(proto string, c protect.Conn, pid, uid string) {
+	// bytes of flows served here are not otherwise counted; see: GetDNSUsage
+	r.serve(proto, r.usage.count(c, uid), pid, uid)
+}
+
+func (r *resolver) serve(proto string, c protect.Conn, over, uid string) {
 	switch proto {
 	case NetTypeTCP:
-		r.accept(c)
+		r.accept(c, over, uid)
 	case NetTypeUDP:
-		r.reply(c)
+		r.reply(c, over, uid)
 	default:
 		log.W("dns: unknown proto: %s", proto)
 	}
 }
 
 func (r *resolver) determineTransport(id string) Transport {
+	t, _ := r.transportFor(id)
+	return t
+}
+
+// transportFor returns the transport for id, if any; and whether it stands
+// in for a missing one (ex: Goos for System, Default for Preferred).
+func (r *resolver) transportFor(id string) (t Transport, fellback bool) {
 	if len(id) <= 0 {
-		return nil
+		return nil, false
 	}
 
 	var id0, id1 string
@@ -468,6 +1043,8 @@ func (r *resolver) determineTransport(id string) Transport {
 			id0 = CT + BlockFree
 			id1 = CT + Preferred
 		}
+	} else if d := r.designated(id); d != nil {
+		return d, false
 	} else if id == System || id == CT+System || id == Goos || id == CT+Goos {
 		// fallback on Goos if System is unavailable
 		// but unlike "System", "Goos" does not support
@@ -494,19 +1071,19 @@ func (r *resolver) determineTransport(id string) Transport {
 	r.RUnlock()
 
 	if t0 != nil {
-		return t0
+		return t0, false
 	} else if t1 != nil {
-		return t1
-	} else if canUseDefaultDNS(id0) {
-		return tf
+		return t1, true
+	} else if canUseDefaultDNS(id0) && tf != nil {
+		return tf, true
 	}
 
-	return nil
+	return nil, false
 }
 
 // dnstcp queries the transport and writes answers to w, prefixed by length.
-func (r *resolver) dnstcp(q []byte, w io.WriteCloser) error {
-	ans, err := r.forward(q)
+func (r *resolver) dnstcp(q []byte, over, uid string, w io.WriteCloser) error {
+	ans, err := r.forward(q, over, uid)
 
 	rlen := len(ans)
 	if rlen <= 0 && err != nil {
@@ -524,9 +1101,11 @@ func (r *resolver) dnstcp(q []byte, w io.WriteCloser) error {
 	return nil // ok
 }
 
-// dnsudp queries the transport and writes answers to w.
-func (r *resolver) dnsudp(q []byte, w io.WriteCloser) error {
-	ans, err := r.forward(q)
+// dnsudp queries the transport and writes answers to w, truncated to fit
+// the client's edns0 udp payload size.
+func (r *resolver) dnsudp(q []byte, over, uid string, w io.WriteCloser) error {
+	ans, err := r.forward(q, over, uid)
+	ans = fitUDP(q, ans)
 
 	rlen := len(ans)
 	if rlen <= 0 && err != nil {
@@ -546,7 +1125,7 @@ func (r *resolver) dnsudp(q []byte, w io.WriteCloser) error {
 }
 
 // reply DNS-over-UDP from a stub resolver.
-func (r *resolver) reply(c protect.Conn) {
+func (r *resolver) reply(c protect.Conn, over, uid string) {
 	defer c.Close()
 
 	start := time.Now()
@@ -566,7 +1145,7 @@ func (r *resolver) reply(c protect.Conn) {
 		n, err := c.Read(q)
 
 		do := func() {
-			_ = r.dnsudp(q[:n], c)
+			_ = r.dnsudp(q[:n], over, uid, c)
 			free()
 		}
 
@@ -583,7 +1162,7 @@ func (r *resolver) reply(c protect.Conn) {
 
 // Accept a DNS-over-TCP socket from a stub resolver, and connect the socket
 // to this DNSTransport.
-func (r *resolver) accept(c io.ReadWriteCloser) {
+func (r *resolver) accept(c io.ReadWriteCloser, over, uid string) {
 	defer c.Close()
 
 	start := time.Now()
@@ -621,7 +1200,7 @@ func (r *resolver) accept(c io.ReadWriteCloser) {
 			break // close on read errs
 		}
 		do := func() {
-			_ = r.dnstcp(q[:n], c)
+			_ = r.dnstcp(q[:n], over, uid, c)
 			free()
 		}
 
@@ -651,30 +1230,148 @@ func (r *resolver) Stop() error {
 	return nil
 }
 
-func (r *resolver) refresh() {
+func (r *resolver) CacheSize() (n int) {
 	r.RLock()
 	defer r.RUnlock()
 
 	for _, t := range r.transports {
-		// skip cached transports
-		if !cachedTransport(t) {
-			// re-adding creates NEW cached transports
-			// which is akin to a cache flush
-			go r.Add(t)
+		if ct, ok := t.(*ctransport); ok {
+			n += ct.count()
 		}
 	}
+	return
 }
 
-func (r *resolver) Refresh() (string, error) {
-	go r.refresh()
-	go dialers.Clear()
-	s := map2csv(r.transports)
+func (r *resolver) TrimCache(all bool) (n int) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, t := range r.transports {
+		if ct, ok := t.(*ctransport); ok {
+			n += ct.trim(all)
+		}
+	}
+	return
+}
+
+// refresh re-adds transports, a few at a time, and refreshes (or starts,
+// if start is set) DcProxy; and returns the outcome for each, by id, and
+// its generation. Transports yet to be re-added once a newer refresh begins
+// are left to it, as are DcProxy's.
+func (r *resolver) refresh(start bool) (map[string]x.RefreshResult, uint64) {
+	gen := r.refreshes.Next()
+	r.RLock()
+	ts := make(map[string]Transport)
+	ids := make([]string, 0, len(r.transports))
+	for id, t := range r.transports {
+		// skip cached transports, and those that cannot be re-added
+		if t.ID() == Default || cachedTransport(t) {
+			continue
+		}
+		switch t.Type() {
+		case DNS53, DNSCrypt, DOH, DOT, ODOH, Group, Client:
+			ts[id] = t
+			ids = append(ids, id)
+		}
+	}
+	r.RUnlock()
+
+	errs := core.FanOut(ids, maxRefreshers, refreshTimeout, func(id string) error {
+		if r.refreshes.Superseded(gen) {
+			return core.ErrSuperseded
+		}
+		// re-adding creates NEW cached transports
+		// which is akin to a cache flush
+		if !r.Add(ts[id]) {
+			return ErrAddFailed
+		}
+		return nil
+	})
+
+	rs := make(map[string]x.RefreshResult, len(errs))
+	for id, err := range errs {
+		res := x.RefreshResult{ID: id, OK: err == nil, Code: x.ErrNone}
+		if err != nil {
+			log.W("dns: refresh %s failed: %v", id, err)
+			res.Code = x.ErrDNSTransport
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				res.Code = x.ErrTimeout
+			} else if errors.Is(err, core.ErrSuperseded) {
+				res.Code = x.ErrSuperseded
+			}
+			res.Err = err.Error()
+		}
+		rs[id] = res
+	}
+	if r.refreshes.Superseded(gen) {
+		log.I("dns: refresh #%d superseded by #%d", gen, r.refreshes.Current())
+		return rs, gen
+	}
 	if dc, err := r.dcProxy(); err == nil {
-		if x, err := dc.Refresh(); err == nil {
-			s += "," + x
+		// dnscrypt servers report on their certs, which is
+		// more telling than having been re-added
+		var rpt x.RefreshReport
+		var v string
+		if start {
+			v = dc.Start()
+		} else {
+			v = dc.RefreshReport()
 		}
+		if err := json.Unmarshal([]byte(v), &rpt); err != nil {
+			log.W("dns: refresh %s: bad report: %v", DcProxy, err)
+		}
+		for _, res := range rpt.Results {
+			rs[res.ID] = res
+		}
+	}
+	r.refreshes.Done(gen)
+	return rs, gen
+}
+
+func (r *resolver) Refresh() (string, error) {
+	go r.refresh(false)
+	go dialers.Clear()
+	return r.LiveTransports(), nil
+}
+
+func (r *resolver) RefreshReport() string {
+	return r.report(false)
+}
+
+func (r *resolver) Start() string {
+	return r.report(true)
+}
+
+// report refreshes (or starts) transports, and returns json of
+// x.RefreshReport with the outcome for each.
+func (r *resolver) report(start bool) string {
+	rs, gen := r.refresh(start)
+	go dialers.Clear()
+
+	rpt := x.RefreshReport{Active: r.LiveTransports(), Results: make([]x.RefreshResult, 0, len(rs)), Gen: int64(gen)}
+	for _, res := range rs {
+		rpt.Results = append(rpt.Results, res)
+	}
+	slices.SortFunc(rpt.Results, func(a, b x.RefreshResult) int { return strings.Compare(a.ID, b.ID) })
+	b, err := json.Marshal(rpt)
+	if err != nil {
+		log.W("dns: refresh report: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// RefreshGens implements x.DNSRefreshGens.
+func (r *resolver) RefreshGens() string {
+	b, err := json.Marshal(x.RefreshGens{
+		Current:   int64(r.refreshes.Current()),
+		Completed: int64(r.refreshes.Completed()),
+	})
+	if err != nil {
+		log.W("dns: refresh gens: %v", err)
+		return ""
 	}
-	return trimcsv(s), nil
+	return string(b)
 }
 
 func (r *resolver) LiveTransports() string {
@@ -682,19 +1379,27 @@ func (r *resolver) LiveTransports() string {
 	if dc, err := r.dcProxy(); err == nil {
 		x := dc.LiveTransports()
 		if len(x) > 0 {
-			s += x
+			s += "," + x
 		}
 	}
 	return trimcsv(s)
 }
 
-func (r *resolver) preferencesFrom(qname string, qtyp uint16, s *x.DNSOpts, chosenids ...string) (id1, id2, pid string, ips []*netip.Addr) {
+// preferencesFrom returns transport ids, proxy, preset ips, and timeout for
+// qname as per s, or uid's transport, or chosenids, if any; and notes why in smm.
+func (r *resolver) preferencesFrom(qname string, qtyp uint16, s *x.DNSOpts, smm *x.DNSSummary, uid string, chosenids ...string) (id1, id2, pid string, ips []*netip.Addr, timeout time.Duration) {
 	var x []string
 	if s == nil { // should never happen; but it has during testing
 		log.W("dns: pref: no ns opts for %s", qname)
 		x = nil
 	} else {
 		x = strings.Split(s.TIDCSV, ",")
+		for i, tid := range x { // ex: "Preferred|1500"
+			var hint time.Duration
+			if x[i], hint = splitTimeoutHint(tid); hint > 0 && timeout <= 0 {
+				timeout = hint // the first hint wins
+			}
+		}
 		if y := strings.Split(s.IPCSV, ","); len(y) > 0 {
 			ips = make([]*netip.Addr, 0, len(y))
 			for _, a := range y {
@@ -742,6 +1447,15 @@ func (r *resolver) preferencesFrom(qname string, qtyp uint16, s *x.DNSOpts, chos
 		log.W("dns: pref: too many tids; upto 2, got %d", l)
 		id1, id2 = x[0], x[1] // ids for transport t1, t2
 	}
+	if len(id1) > 0 {
+		routed(smm, RouteListener, s.TIDCSV)
+	}
+	// uid's transport stands in for the listener's, unless it blocks all
+	if uidtr := r.uids.get(uid); len(uidtr) > 0 && !isAnyBlockAll(id1, id2) {
+		log.D("dns: pref: use uid %s tr(%s) over (%s, %s) for %s", uid, uidtr, id1, id2, qname)
+		id1, id2 = uidtr, ""
+		routed(smm, RouteUID, uid)
+	}
 
 	if len(chosenids) > 0 { // chosen ID overrides all
 		if len(chosenids[0]) > 0 {
@@ -751,13 +1465,24 @@ func (r *resolver) preferencesFrom(qname string, qtyp uint16, s *x.DNSOpts, chos
 			id2 = chosenids[1]
 		}
 		log.D("dns: pref: use chosen tr(%s, %s) for %s", id1, id2, qname)
+		routed(smm, RouteChosen, strings.Join(chosenids, ","))
 	} else if isAnyBlockAll(id1, id2) || isAnyIPUnspecified(ips) { // just one transport, BlockAll, if set
+		why := BlockAll
+		if !isAnyBlockAll(id1, id2) {
+			why = "unspecified ips"
+		}
 		id1 = BlockAll
 		id2 = ""
-	} else if reqid := r.requiresGoosOrLocal(qname); len(reqid) > 0 { // use approp transport given a qname
-		log.D("dns: pref: use suggested tr(%s) for %s", reqid, qname)
+		routed(smm, RouteBlockAll, why)
+	} else if reqid, rule := r.undelegated(qname); len(reqid) > 0 { // use approp transport given a qname
+		log.D("dns: pref: use suggested tr(%s) for %s; rule %s", reqid, qname, rule)
 		id1 = reqid
 		id2 = ""
+		if reqid == Local {
+			routed(smm, RouteMDNS, rule)
+		} else {
+			routed(smm, RouteUndelegated, rule)
+		}
 	}
 	if isAnyLocal(id1, id2) { // use one transport, Local, if set
 		id1 = Local
@@ -801,9 +1526,9 @@ func IsLocalProxy(pid string) bool {
 
 func isReserved(id string) bool {
 	switch id {
-	case Default, Goos, System, Local, Alg, DcProxy, BlockAll, Preferred, Bootstrap, BlockFree:
+	case Default, Goos, System, Designated, Local, Alg, DcProxy, BlockAll, Preferred, Bootstrap, BlockFree, LocalRecs:
 		return true
-	case CT + Default, CT + Goos, CT + System, CT + Local, CT + Alg, CT + DcProxy, CT + BlockAll, CT + Bootstrap, CT + Preferred, CT + BlockFree:
+	case CT + Default, CT + Goos, CT + System, CT + Designated, CT + Local, CT + Alg, CT + DcProxy, CT + BlockAll, CT + Bootstrap, CT + Preferred, CT + BlockFree:
 		return true
 	}
 	return false
@@ -845,6 +1570,46 @@ func isAnyLocal(ids ...string) bool {
 	return isTransportID(Local, ids...)
 }
 
+// prefPID returns the proxy of the flow of the query, if known.
+func prefPID(pref *x.DNSOpts) string {
+	if pref == nil {
+		return ""
+	}
+	return pref.PID
+}
+
+// exitFor returns pid if the query is bound to it as the exit; that is,
+// when the query is from a known uid and pid is not a local proxy.
+func exitFor(pref *x.DNSOpts, pid string) string {
+	if pref == nil || len(pref.UID) <= 0 || IsLocalProxy(pid) {
+		return ""
+	}
+	return pid
+}
+
+// routeFor returns the proxy qname is routed over (see: AddDomainRoute),
+// if any; unless the query (per transport ids) is to be blocked or is local.
+func (r *resolver) routeFor(qname string, ids ...string) string {
+	if isAnyBlockAll(ids...) || isAnyLocal(ids...) {
+		return ""
+	}
+	return r.routes.match(qname)
+}
+
+// exitTransport returns the dns transport of proxy exit (see: AddProxyDNS),
+// if any; unless the query (per transport ids) is to be blocked or is local.
+func (r *resolver) exitTransport(exit string, ids ...string) Transport {
+	if len(exit) <= 0 || isAnyBlockAll(ids...) || isAnyLocal(ids...) {
+		return nil
+	}
+	r.RLock()
+	defer r.RUnlock()
+	if t := r.transports[CT+exit]; t != nil {
+		return t
+	}
+	return r.transports[exit]
+}
+
 func overrideProxyIfNeeded(pid string, ids ...string) string {
 	for _, id := range ids {
 		switch id {
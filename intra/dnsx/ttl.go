@@ -0,0 +1,132 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// max ttl any of the clamps may be set to; 1 week
+const maxclampttl = 7 * 24 * 60 * 60
+
+// ttlclamp holds bounds (in secs) for ttls of answers sent back to clients;
+// 0 unsets a bound. A nil ttlclamp clamps nothing.
+type ttlclamp struct {
+	lo, hi     atomic.Uint32 // all answers
+	lo64, hi64 atomic.Uint32 // dns64 synthesized answers
+	block      atomic.Uint32 // blocked answers; 0 is xdns.BlockTTL
+}
+
+func newTTLClamp() *ttlclamp {
+	return &ttlclamp{}
+}
+
+// clampsecs bounds n to [0, maxclampttl].
+func clampsecs(n int) uint32 {
+	return uint32(min(max(n, 0), maxclampttl))
+}
+
+func (c *ttlclamp) set(lo, hi int) {
+	c.lo.Store(clampsecs(lo))
+	c.hi.Store(clampsecs(hi))
+	log.I("dns: ttl: clamp [%d, %d]", lo, hi)
+}
+
+func (c *ttlclamp) set64(lo, hi int) {
+	c.lo64.Store(clampsecs(lo))
+	c.hi64.Store(clampsecs(hi))
+	log.I("dns: ttl: dns64 clamp [%d, %d]", lo, hi)
+}
+
+func (c *ttlclamp) setBlock(ttl int) {
+	c.block.Store(clampsecs(ttl))
+	log.I("dns: ttl: block %d", ttl)
+}
+
+// answer clamps ttls of msg, and returns true if any was changed.
+func (c *ttlclamp) answer(msg *dns.Msg) bool {
+	if c == nil {
+		return false
+	}
+	return xdns.ClampTTL(msg, c.lo.Load(), c.hi.Load())
+}
+
+// dns64 clamps ttls of the synthesized msg, and returns true if any was changed.
+func (c *ttlclamp) dns64(msg *dns.Msg) bool {
+	if c == nil {
+		return false
+	}
+	return xdns.ClampTTL(msg, c.lo64.Load(), c.hi64.Load())
+}
+
+// blocked sets ttls of the blocked msg, and returns true if any was changed.
+func (c *ttlclamp) blocked(msg *dns.Msg) bool {
+	if c == nil {
+		return false
+	}
+	if ttl := c.block.Load(); ttl > 0 {
+		return xdns.ClampTTL(msg, ttl, ttl)
+	}
+	return false
+}
+
+// clampttl returns ttl (in secs) clamped to the bounds for all answers.
+func (c *ttlclamp) clampttl(ttl int) int {
+	if c == nil {
+		return ttl
+	}
+	lo, hi := int(c.lo.Load()), int(c.hi.Load())
+	if hi > 0 && lo > hi {
+		lo = hi
+	}
+	ttl = max(ttl, lo)
+	if hi > 0 {
+		ttl = min(ttl, hi)
+	}
+	return ttl
+}
+
+// maxttl returns the upper bound on ttls of all answers; 0 if unbounded.
+func (c *ttlclamp) maxttl() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.hi.Load()) * time.Second
+}
+
+// repack packs msg into b if changed is true, and returns b as-is, otherwise.
+func repack(msg *dns.Msg, b []byte, changed bool) []byte {
+	if !changed {
+		return b
+	}
+	if out, err := msg.Pack(); err == nil {
+		return out
+	} else {
+		log.W("dns: ttl: repack %s err: %v", xdns.QName(msg), err)
+	}
+	return b
+}
+
+// Implements x.TTLClamper
+func (r *resolver) SetTTLClamp(minsecs, maxsecs int) {
+	r.ttls.set(minsecs, maxsecs)
+}
+
+// Implements x.TTLClamper
+func (r *resolver) SetDNS64TTLClamp(minsecs, maxsecs int) {
+	r.ttls.set64(minsecs, maxsecs)
+}
+
+// Implements x.TTLClamper
+func (r *resolver) SetBlockTTL(secs int) {
+	r.ttls.setBlock(secs)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+func TestTTLClampGateway(t *testing.T) {
+	gw := NewDNSGateway(&resolver{}, fakeNatPt{})
+	gw.ttls = newTTLClamp()
+	gw.ttls.set(60, 3600)
+
+	rrs := func(qname string) []dns.RR {
+		return []dns.RR{
+			xdns.MakeARecord(qname, "1.2.3.4", 5),
+			xdns.MakeARecord(qname, "1.2.3.5", 604800),
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("ttl.example.", dns.TypeA)
+	qb, _ := q.Pack()
+	smm := new(x.DNSSummary)
+	res, err := gw.q(fakeTransport{rrs: rrs}, nil, nil, "", NetTypeUDP, qb, smm)
+	if err != nil {
+		t.Fatalf("alg err %v", err)
+	}
+	for _, rr := range xdns.AsMsg(res).Answer {
+		if ttl := rr.Header().Ttl; ttl < 60 || ttl > 3600 {
+			t.Errorf("ttl %d not in [60, 3600]", ttl)
+		}
+	}
+	if smm.RTtl != 604800 {
+		t.Errorf("summary ttl %d; want upstream's 604800", smm.RTtl)
+	}
+}
+
+func TestTTLClampCache(t *testing.T) {
+	ttls := newTTLClamp()
+	cb := &cache{c: make(map[string]*cres), mu: new(sync.RWMutex), size: defsize, ttl: ttl10m, halflife: ttl10m / 2, bumps: defbumps, ttls: ttls}
+
+	a := new(dns.Msg)
+	a.SetQuestion("cache.example.", dns.TypeA)
+	a.Answer = []dns.RR{xdns.MakeARecord("cache.example.", "1.2.3.4", 86400)}
+	b, _ := a.Pack()
+
+	ttls.set(0, 60)
+	if !cb.put("k", b, new(x.DNSSummary)) {
+		t.Fatal("not cached")
+	}
+	if exp := time.Until(cb.c["k"].expiry); exp > time.Minute {
+		t.Errorf("cache expiry %s outlives max ttl 60s", exp)
+	}
+	cb.freshCopy("k")
+	if exp := time.Until(cb.c["k"].expiry); exp > time.Minute {
+		t.Errorf("bumped cache expiry %s outlives max ttl 60s", exp)
+	}
+}
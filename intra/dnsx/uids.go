@@ -0,0 +1,88 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/celzero/firestack/intra/log"
+)
+
+// uid of flows whose owner is not known; see: intra.SocketListener.Flow
+const unknownuid = "-1"
+
+var errBadUID = errors.New("uid transport: invalid uid")
+
+// uidtransports is a table of client-set uid -> transport id; queries
+// from a uid with a transport are resolved over it, in place of the
+// transports the listener picks.
+type uidtransports struct {
+	sync.RWMutex
+	ids map[string]string // uid -> transport id
+}
+
+func newUIDTransports() *uidtransports {
+	return &uidtransports{ids: make(map[string]string)}
+}
+
+func (u *uidtransports) set(uid, id string) error {
+	uid = strings.TrimSpace(uid)
+	id = strings.TrimSpace(id)
+	if !knownuid(uid) {
+		return errBadUID
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	if len(id) <= 0 {
+		delete(u.ids, uid)
+	} else {
+		u.ids[uid] = id
+	}
+	log.I("dns: uid: %s => %s; total %d", uid, id, len(u.ids))
+	return nil
+}
+
+func (u *uidtransports) list() string {
+	u.RLock()
+	defer u.RUnlock()
+
+	lines := make([]string, 0, len(u.ids))
+	for uid, id := range u.ids {
+		lines = append(lines, uid+"="+id)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// get returns the transport id for uid, if any.
+func (u *uidtransports) get(uid string) string {
+	if u == nil || !knownuid(uid) {
+		return ""
+	}
+
+	u.RLock()
+	defer u.RUnlock()
+
+	return u.ids[uid]
+}
+
+func knownuid(uid string) bool {
+	return len(uid) > 0 && uid != unknownuid
+}
+
+// Implements x.UIDTransports
+func (r *resolver) SetUIDTransport(uid, id string) error {
+	return r.uids.set(uid, id)
+}
+
+// Implements x.UIDTransports
+func (r *resolver) ListUIDTransports() string {
+	return r.uids.list()
+}
@@ -170,10 +170,40 @@ func newUndelegatedDomainsTrie() c.RadixTree {
 }
 
 func (r *resolver) requiresGoosOrLocal(qname string) (id string) {
-	if strings.HasSuffix(qname, ".local") || xdns.IsMDNSQuery(qname) {
-		id = Local
+	id, _ = r.undelegated(qname)
+	return
+}
+
+// undelegated returns the transport qname must be resolved on, if any,
+// along with the rule that says so: *.local, mdns, or the matched domain.
+func (r *resolver) undelegated(qname string) (id, rule string) {
+	if strings.HasSuffix(qname, ".local") {
+		id, rule = Local, "*.local"
+	} else if xdns.IsMDNSQuery(qname) {
+		id, rule = Local, "mdns"
 	} else if len(qname) > 0 && r.localdomains.HasAny(qname) {
 		id = Goos // system is primary; see: transport.go:determineTransports()
+		rule = r.undelegatedDomain(qname)
 	}
 	return
 }
+
+// undelegatedDomain returns the undelegated domain that covers qname,
+// as a wildcard if qname is its subdomain; or qname itself if none does.
+func (r *resolver) undelegatedDomain(qname string) string {
+	name := strings.TrimSuffix(qname, ".")
+	for rest := name; len(rest) > 0; {
+		if r.localdomains.Has(rest) {
+			if rest == name {
+				return rest
+			}
+			return "*." + rest
+		}
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		rest = rest[i+1:]
+	}
+	return qname
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+var nat64pfx = netip.MustParsePrefix("64:ff9b::/96")
+
+// fakeNatPt translates ips in 64:ff9b::/96 to ip4.
+type fakeNatPt struct{}
+
+func (fakeNatPt) Add64(string, Transport) bool         { return false }
+func (fakeNatPt) Remove64(string) bool                 { return false }
+func (fakeNatPt) ResetNat64Prefix(string) bool         { return false }
+func (fakeNatPt) D64(string, []byte, Transport) []byte { return nil }
+
+func (fakeNatPt) IsNat64(_ string, ip []byte) bool {
+	a, ok := netip.AddrFromSlice(ip)
+	return ok && nat64pfx.Contains(a)
+}
+
+func (fakeNatPt) S64(_ string, ip4 []byte) []byte {
+	if len(ip4) != net.IPv4len {
+		return nil
+	}
+	return append(nat64pfx.Addr().AsSlice()[:12], ip4...)
+}
+
+func (n fakeNatPt) X64(id string, ip []byte) []byte {
+	if len(ip) != net.IPv6len || !n.IsNat64(id, ip) {
+		return nil
+	}
+	return ip[12:]
+}
+
+// fakeTransport answers every query with rrs.
+type fakeTransport struct {
+	rrs func(qname string) []dns.RR
+}
+
+func (fakeTransport) ID() string      { return "fake" }
+func (fakeTransport) Type() string    { return DNS53 }
+func (fakeTransport) P50() int64      { return 0 }
+func (fakeTransport) GetAddr() string { return "" }
+func (fakeTransport) Status() int     { return Complete }
+
+func (t fakeTransport) Query(_ string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	msg := xdns.AsMsg(q)
+	ans := new(dns.Msg)
+	ans.SetReply(msg)
+	ans.Answer = t.rrs(msg.Question[0].Name)
+	smm.Status = Complete
+	smm.RTtl = xdns.RTtl(ans)
+	return ans.Pack()
+}
+
+func mapped(ip netip.Addr) []byte {
+	b := netip.AddrFrom16(ip.As16()).AsSlice()
+	return b
+}
+
+func TestIsDnsUnmapped(t *testing.T) {
+	for _, fake := range []string{"10.111.222.3:53", "[::ffff:10.111.222.3]:53"} {
+		r := &resolver{tunmode: &settings.TunMode{DNSMode: settings.DNSModeIP}}
+		r.addDnsAddrs(fake)
+		for _, dst := range []string{"10.111.222.3:53", "[::ffff:10.111.222.3]:53"} {
+			if !r.isDns(dst) {
+				t.Errorf("fake dns %s: %s not matched", fake, dst)
+			}
+		}
+		if r.isDns("10.111.222.4:53") {
+			t.Errorf("fake dns %s: unexpected match", fake)
+		}
+	}
+}
+
+func TestAlgUndoUnmapped(t *testing.T) {
+	real4 := netip.MustParseAddr("1.2.3.4")
+	cases := []struct {
+		name  string
+		qtype uint16
+		rr    func(qname string) dns.RR
+	}{
+		{"a", dns.TypeA, func(n string) dns.RR {
+			return xdns.MakeARecord(n, "1.2.3.4", 60)
+		}},
+		{"aaaa-4in6", dns.TypeAAAA, func(n string) dns.RR {
+			return xdns.MakeAAAARecord(n, "::ffff:1.2.3.4", 60)
+		}},
+		{"aaaa-nat64", dns.TypeAAAA, func(n string) dns.RR {
+			return xdns.MakeAAAARecord(n, "64:ff9b::102:304", 60)
+		}},
+	}
+
+	for _, c := range cases {
+		gw := NewDNSGateway(&resolver{}, fakeNatPt{})
+		gw.translate(true)
+		tr := fakeTransport{rrs: func(qname string) []dns.RR { return []dns.RR{c.rr(qname)} }}
+
+		q := new(dns.Msg)
+		q.SetQuestion(c.name+".example.", c.qtype)
+		qb, _ := q.Pack()
+		res, err := gw.q(tr, nil, nil, "", NetTypeUDP, qb, new(x.DNSSummary))
+		if err != nil {
+			t.Fatalf("%s: alg err %v", c.name, err)
+		}
+		ans := xdns.AsMsg(res)
+		algips := append(xdns.AAnswer(ans), xdns.AAAAAnswer(ans)...)
+		if len(algips) != 1 {
+			t.Fatalf("%s: want 1 alg ip, got %v", c.name, algips)
+		}
+		algip := *algips[0]
+
+		forms := [][]byte{algip.AsSlice()}
+		if algip.Is4() {
+			forms = append(forms, mapped(algip))
+		}
+		for _, b := range forms {
+			// realips repeat as secondaryips when there's no secondary transport
+			ips := gw.X(b)
+			for _, ip := range strings.Split(ips, ",") {
+				if ip != real4.String() {
+					t.Errorf("%s: X(%v) = %q; want %s", c.name, b, ips, real4)
+				}
+			}
+			if d := gw.PTR(b, false); d != c.name+".example" {
+				t.Errorf("%s: PTR(%v) = %q", c.name, b, d)
+			}
+		}
+		if c.name == "aaaa-nat64" {
+			continue // realip is the nat64 addr, not real4
+		}
+		for _, b := range [][]byte{real4.AsSlice(), mapped(real4)} {
+			if d := gw.PTR(b, true); d != c.name+".example" {
+				t.Errorf("%s: PTR(realip %v) = %q", c.name, b, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// max uids counted; bytes of those over are counted as unknownuid
+const maxusageuids = 4096
+
+// DNSUsage is bytes of dns served to apps since start (or the last reset),
+// by uid; serialized as json for the client. Uids with no bytes since the
+// last reset are left out.
+type DNSUsage struct {
+	Since int64               `json:"since"` // unix millis of start or reset
+	Uids  map[string]UidBytes `json:"uids"`  // uid -> bytes
+}
+
+// UidBytes are bytes of queries an app sent (tx) and of answers it got (rx).
+type UidBytes struct {
+	Rx int64 `json:"rx"`
+	Tx int64 `json:"tx"`
+}
+
+// dnsusage counts bytes of dns served to apps, by uid, as they are read and
+// written; and not as conns close, as answers may be written after (udp).
+type dnsusage struct {
+	sync.RWMutex                      // protects all fields
+	since        time.Time            // start or last reset
+	uids         map[string]*uidbytes // uid -> bytes; never removed
+}
+
+type uidbytes struct {
+	rx, tx atomic.Int64
+}
+
+func newDNSUsage() *dnsusage {
+	return &dnsusage{
+		since: time.Now(),
+		uids:  make(map[string]*uidbytes),
+	}
+}
+
+// of returns the counter of uid, making one if needed.
+func (u *dnsusage) of(uid string) *uidbytes {
+	if !knownuid(uid) {
+		uid = unknownuid
+	}
+	u.RLock()
+	n := u.uids[uid]
+	u.RUnlock()
+	if n != nil {
+		return n
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	if n = u.uids[uid]; n != nil {
+		return n
+	}
+	if len(u.uids) >= maxusageuids {
+		uid = unknownuid
+		if n = u.uids[uid]; n != nil {
+			return n
+		}
+	}
+	n = new(uidbytes)
+	u.uids[uid] = n
+	return n
+}
+
+// count returns c, whose bytes read and written are counted for uid.
+func (u *dnsusage) count(c protect.Conn, uid string) protect.Conn {
+	if u == nil || c == nil {
+		return c
+	}
+	return &usageconn{Conn: c, n: u.of(uid)}
+}
+
+// get returns bytes counted of all uids.
+func (u *dnsusage) get() DNSUsage {
+	u.RLock()
+	defer u.RUnlock()
+
+	s := DNSUsage{
+		Since: u.since.UnixMilli(),
+		Uids:  make(map[string]UidBytes),
+	}
+	for uid, n := range u.uids {
+		if b := (UidBytes{Rx: n.rx.Load(), Tx: n.tx.Load()}); b.Rx > 0 || b.Tx > 0 {
+			s.Uids[uid] = b
+		}
+	}
+	return s
+}
+
+// reset zeroes all counts; counters are kept, as conns being served hold them.
+func (u *dnsusage) reset() {
+	u.Lock()
+	defer u.Unlock()
+
+	u.since = time.Now()
+	for _, n := range u.uids {
+		n.rx.Store(0)
+		n.tx.Store(0)
+	}
+}
+
+// usageconn counts bytes read (queries, sent by the app) and written
+// (answers, to the app) into n.
+type usageconn struct {
+	protect.Conn
+	n *uidbytes
+}
+
+func (c *usageconn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.n.tx.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *usageconn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.n.rx.Add(int64(n))
+	}
+	return n, err
+}
+
+// GetDNSUsage implements x.DNSUsage.
+func (r *resolver) GetDNSUsage() string {
+	v, err := json.Marshal(r.usage.get())
+	if err != nil { // unlikely
+		log.W("dns: usage: %v", err)
+		return "{}"
+	}
+	return string(v)
+}
+
+// ResetDNSUsage implements x.DNSUsage.
+func (r *resolver) ResetDNSUsage() {
+	r.usage.reset()
+	log.I("dns: usage: reset")
+}
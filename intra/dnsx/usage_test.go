@@ -0,0 +1,106 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/miekg/dns"
+)
+
+func usageOf(t *testing.T, r *resolver) DNSUsage {
+	t.Helper()
+	var u DNSUsage
+	if err := json.Unmarshal([]byte(r.GetDNSUsage()), &u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// waitUsage waits for bytes of uid to be as want; bytes written are counted
+// only after the peer reads them.
+func waitUsage(t *testing.T, r *resolver, uid string, want UidBytes) {
+	t.Helper()
+	var got UidBytes
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if got = usageOf(t, r).Uids[uid]; got == want {
+			return
+		}
+	}
+	t.Errorf("usage: %s: got %+v; want %+v", uid, got, want)
+}
+
+func TestDNSUsage(t *testing.T) {
+	a, _ := dns.NewRR("usage.example. 60 IN A 10.0.0.1")
+	ft := fakeTransport{rrs: func(string) []dns.RR { return []dns.RR{a} }}
+	r := NewResolver("", settings.DefaultTunMode(), ft, &tidListener{tid: "fake"}, nil).(*resolver)
+	r.Lock()
+	r.transports["fake"] = ft
+	r.Unlock()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("usage.example.", dns.TypeA)
+	q, _ := msg.Pack()
+
+	// udp: a datagram per query, and per answer
+	app, tun := net.Pipe()
+	go r.ServeFor(NetTypeUDP, tun, "", "10001")
+	if _, err := app.Write(q); err != nil {
+		t.Fatal(err)
+	}
+	ans := make([]byte, 512)
+	n, err := app.Read(ans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+	waitUsage(t, r, "10001", UidBytes{Rx: int64(n), Tx: int64(len(q))})
+
+	// tcp: queries and answers are length prefixed
+	app, tun = net.Pipe()
+	go r.ServeFor(NetTypeTCP, tun, "", "10002")
+	pq := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+	if _, err := app.Write(append(pq, q...)); err != nil {
+		t.Fatal(err)
+	}
+	pfx := make([]byte, 2)
+	if _, err := io.ReadFull(app, pfx); err != nil {
+		t.Fatal(err)
+	}
+	tans := make([]byte, binary.BigEndian.Uint16(pfx))
+	if _, err := io.ReadFull(app, tans); err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+	waitUsage(t, r, "10002", UidBytes{Rx: int64(2 + len(tans)), Tx: int64(2 + len(q))})
+
+	// unknown uids are counted together
+	app, tun = net.Pipe()
+	go r.ServeFor(NetTypeUDP, tun, "", "")
+	if _, err := app.Write(q); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Read(ans); err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+	waitUsage(t, r, unknownuid, UidBytes{Rx: int64(n), Tx: int64(len(q))})
+	if u := usageOf(t, r); len(u.Uids) != 3 {
+		t.Errorf("usage: got uids %v; want 3", u.Uids)
+	}
+
+	r.ResetDNSUsage()
+	if u := usageOf(t, r); len(u.Uids) != 0 {
+		t.Errorf("usage: not reset: %v", u.Uids)
+	}
+}
@@ -13,6 +13,34 @@ import (
 	"github.com/miekg/dns"
 )
 
+const (
+	SVCBBlockNoData     = x.SVCBBlockNoData
+	SVCBBlockFakeTarget = x.SVCBBlockFakeTarget
+	SVCBBlockDotTarget  = x.SVCBBlockDotTarget
+)
+
+// SetSVCBBlockMode implements x.BlockResponder.
+func (r *resolver) SetSVCBBlockMode(mode int) {
+	switch mode {
+	case SVCBBlockFakeTarget, SVCBBlockDotTarget:
+	default:
+		mode = SVCBBlockNoData
+	}
+	r.svcb.Store(int32(mode))
+	log.I("dns: svcb block mode %d", mode)
+}
+
+// svcbmode returns the xdns mode of answers to blocked svcb and https queries.
+func (r *resolver) svcbmode() int {
+	switch r.svcb.Load() {
+	case SVCBBlockFakeTarget:
+		return xdns.SVCBBlockFakeTarget
+	case SVCBBlockDotTarget:
+		return xdns.SVCBBlockDotTarget
+	}
+	return xdns.SVCBBlockNoData
+}
+
 func (r *resolver) setRdnsLocal(rlocal *rethinkdnslocal) {
 	r.rmu.Lock()
 	defer r.rmu.Unlock()
@@ -97,7 +125,7 @@ func (r *resolver) blockQ(t, t2 Transport, msg *dns.Msg) (ans *dns.Msg, blocklis
 		return nil, "", errNoRdns
 	}
 	// OnDeviceBlock() is true; enforce blocklists
-	ans, blocklists, err = applyBlocklists(b, msg)
+	ans, blocklists, err = applyBlocklists(b, msg, r.svcbmode())
 	if err != nil {
 		// block skipped because err is set
 		log.D("wall: skip local for %s blockQ for %s with err %s", qname, blocklists, err)
@@ -105,7 +133,7 @@ func (r *resolver) blockQ(t, t2 Transport, msg *dns.Msg) (ans *dns.Msg, blocklis
 	return
 }
 
-func applyBlocklists(b RDNS, q *dns.Msg) (ans *dns.Msg, blocklists string, err error) {
+func applyBlocklists(b RDNS, q *dns.Msg, svcbmode int) (ans *dns.Msg, blocklists string, err error) {
 	blocklists, err = b.blockQuery(q)
 	if err != nil {
 		return
@@ -115,7 +143,7 @@ func applyBlocklists(b RDNS, q *dns.Msg) (ans *dns.Msg, blocklists string, err e
 		return
 	}
 
-	ans, err = xdns.RefusedResponseFromMessage(q)
+	ans, err = xdns.RefusedResponseWithMode(q, svcbmode)
 	return
 }
 
@@ -131,6 +159,7 @@ func (r *resolver) blockA(t, t2 Transport, q *dns.Msg, ans *dns.Msg, blocklistSt
 	if len(blocklistStamp) > 0 && br != nil { // remote block resolution, if any
 		blocklistNames, err = br.StampToNames(blocklistStamp)
 		if err == nil {
+			blocklistNames = xdns.CapCsv(blocklistNames)
 			log.D("wall: for %s blocklists %s", qname, blocklistNames)
 			return
 		} else {
@@ -165,7 +194,7 @@ func (r *resolver) blockA(t, t2 Transport, q *dns.Msg, ans *dns.Msg, blocklistSt
 		return
 	}
 
-	finalans, err = xdns.RefusedResponseFromMessage(q)
+	finalans, err = xdns.RefusedResponseWithMode(q, r.svcbmode())
 	if err != nil {
 		log.W("wall: could not pack %s blocked dns answer %v", qname, err)
 		return
@@ -0,0 +1,172 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// max transports warmed up at once, across all warmups
+	warmupconcurrency = 4
+	// time within which all transports of a warmup must be warmed up
+	warmupbudget = 10 * time.Second
+)
+
+var errWarmupTimeout = errors.New("warmup: out of time")
+
+// Warmer is a Transport that can connect to its upstream ahead of queries.
+type Warmer interface {
+	// Warmup connects to upstream (ex: tcp and tls handshakes, certs), if
+	// not connected already.
+	Warmup() error
+}
+
+type warmer struct {
+	sem    chan struct{} // bounds concurrent warmups
+	canary atomic.Value  // string; name to query once warmed up
+}
+
+func newWarmer() *warmer {
+	w := &warmer{sem: make(chan struct{}, warmupconcurrency)}
+	w.canary.Store("")
+	return w
+}
+
+// canaryQuery returns a packed A query for the canary name, if any.
+func (w *warmer) canaryQuery() []byte {
+	name, _ := w.canary.Load().(string)
+	if len(name) <= 0 {
+		return nil
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		log.W("dns: warmup: canary %s: %v", name, err)
+		return nil
+	}
+	return q
+}
+
+// Implements Resolver
+func (r *resolver) SetWarmupCanary(name string) {
+	r.warm.canary.Store(name)
+	log.I("dns: warmup: canary %s", name)
+}
+
+// Implements Resolver
+func (r *resolver) Warmup() {
+	r.RLock()
+	ts := make([]Transport, 0, len(r.transports))
+	for _, t := range r.transports {
+		ts = append(ts, t)
+	}
+	r.RUnlock()
+
+	go r.warmup(ts...)
+}
+
+// warmable returns true if t connects to an upstream.
+func warmable(t Transport) bool {
+	if t == nil || cachedTransport(t) {
+		return false
+	}
+	switch t.ID() {
+	case Local, BlockAll, LocalRecs, Preset, Alg:
+		return false
+	}
+	switch t.Type() {
+	case DNS53, DNSCrypt, DOH, DOT, ODOH:
+		return true
+	}
+	return false
+}
+
+// warmup warms up ts, a few at a time, within warmupbudget; ts that
+// neither are Warmers nor can be sent a canary query are skipped.
+func (r *resolver) warmup(ts ...Transport) {
+	w := r.warm
+	if w == nil || r.staging.Load() {
+		return // transports of a resolver being built are warmed up by Restart
+	}
+	q := w.canaryQuery()
+	deadline := time.Now().Add(warmupbudget)
+	budget := time.NewTimer(warmupbudget)
+	defer budget.Stop()
+
+	var wg sync.WaitGroup
+	for i, t := range ts {
+		if !warmable(t) {
+			continue
+		}
+		if _, ok := t.(Warmer); !ok && q == nil {
+			continue
+		}
+		select {
+		case w.sem <- struct{}{}:
+		case <-budget.C:
+			log.W("dns: warmup: out of time; skipped %d transports", len(ts)-i)
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(t Transport) {
+			defer wg.Done()
+			r.warmOne(t, q, deadline)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// warmOne warms up t, and reports how long it took, unless it takes
+// longer than deadline, in which case, t is reported to have failed.
+// Must hold a slot in r.warm.sem, which is released once t is warmed up.
+func (r *resolver) warmOne(t Transport, q []byte, deadline time.Time) {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-r.warm.sem }()
+		done <- warm(t, q)
+	}()
+
+	var err error
+	timeout := time.NewTimer(time.Until(deadline))
+	select {
+	case err = <-done:
+	case <-timeout.C:
+		err = errWarmupTimeout
+	}
+	timeout.Stop()
+
+	ms := time.Since(start).Milliseconds()
+	log.I("dns: warmup: %s@%s in %dms; err? %v", t.ID(), t.GetAddr(), ms, err)
+	if r.listener != nil {
+		go r.listener.OnDNSWarmup(t.ID(), ms, err == nil)
+	}
+}
+
+// warm connects t to its upstream, if it is a Warmer, and then sends it q, if any.
+func warm(t Transport, q []byte) error {
+	if w, ok := t.(Warmer); ok {
+		if err := w.Warmup(); err != nil {
+			return err
+		}
+	}
+	if len(q) <= 0 {
+		return nil
+	}
+	_, err := t.Query(Background(NetTypeUDP), q, new(x.DNSSummary))
+	return err
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// warmTransport is a Warmer that takes d to warm up.
+type warmTransport struct {
+	fakeTransport
+	id      string
+	d       time.Duration
+	n       *atomic.Int32 // concurrent warmups
+	max     *atomic.Int32 // max concurrent warmups
+	queried atomic.Bool
+}
+
+func (t *warmTransport) ID() string { return t.id }
+
+func (t *warmTransport) Warmup() error {
+	n := t.n.Add(1)
+	defer t.n.Add(-1)
+	for m := t.max.Load(); n > m && !t.max.CompareAndSwap(m, n); m = t.max.Load() {
+	}
+	time.Sleep(t.d)
+	return nil
+}
+
+func (t *warmTransport) Query(network string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	t.queried.Store(true)
+	return t.fakeTransport.Query(network, q, smm)
+}
+
+type warmResult struct {
+	id string
+	ok bool
+}
+
+type warmListener struct {
+	x.DNSListener // nil; only OnDNSWarmup is called
+	mu            sync.Mutex
+	res           []warmResult
+}
+
+func (l *warmListener) OnDNSWarmup(id string, _ int64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.res = append(l.res, warmResult{id, ok})
+}
+
+func (l *warmListener) results() []warmResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]warmResult(nil), l.res...)
+}
+
+func TestWarmup(t *testing.T) {
+	l := &warmListener{}
+	r := &resolver{listener: l, warm: newWarmer()}
+	r.SetWarmupCanary("canary.example")
+
+	var n, max atomic.Int32
+	noans := fakeTransport{rrs: func(string) []dns.RR { return nil }}
+	ts := make([]Transport, 0)
+	warmers := make([]*warmTransport, 0)
+	for i := 0; i < 10; i++ {
+		wt := &warmTransport{fakeTransport: noans, id: "w" + strconv.Itoa(i), d: 20 * time.Millisecond, n: &n, max: &max}
+		warmers = append(warmers, wt)
+		ts = append(ts, wt)
+	}
+	ts = append(ts, noans)
+	// never warmed up
+	ts = append(ts, &warmTransport{id: BlockAll, n: &n, max: &max})
+
+	r.warmup(ts...)
+
+	if m := max.Load(); m > warmupconcurrency {
+		t.Errorf("%d concurrent warmups; want <= %d", m, warmupconcurrency)
+	}
+	for _, wt := range warmers {
+		if !wt.queried.Load() {
+			t.Errorf("%s: canary not sent", wt.id)
+		}
+	}
+	time.Sleep(10 * time.Millisecond) // listener is called async
+	res := l.results()
+	if len(res) != len(warmers)+1 {
+		t.Fatalf("got %d warmups; want %d: %v", len(res), len(warmers)+1, res)
+	}
+	for _, x := range res {
+		if !x.ok || x.id == BlockAll {
+			t.Errorf("unexpected warmup %v", x)
+		}
+	}
+}
+
+func TestWarmupDeadline(t *testing.T) {
+	l := &warmListener{}
+	r := &resolver{listener: l, warm: newWarmer()}
+
+	var n, max atomic.Int32
+	slow := &warmTransport{id: "slow", d: 200 * time.Millisecond, n: &n, max: &max}
+
+	r.warm.sem <- struct{}{} // released by warmOne
+	start := time.Now()
+	r.warmOne(slow, nil, time.Now().Add(20*time.Millisecond))
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("warmup overran deadline by %s", d)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if res := l.results(); len(res) != 1 || res[0].ok {
+		t.Errorf("slow warmup: %v; want failed", res)
+	}
+	// slot is held till the slow warmup is done
+	if len(r.warm.sem) != 1 {
+		t.Error("warmup slot released before warmup is done")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if len(r.warm.sem) != 0 {
+		t.Error("warmup slot not released")
+	}
+	if q := r.warm.canaryQuery(); q != nil {
+		t.Errorf("canary query %v; want none", xdns.AsMsg(q))
+	}
+}
@@ -36,4 +36,7 @@ type NAT64 interface {
 	// Translates ip to IPv4 using the NAT64 prefix for transport id.
 	// As a special case, ip is zero addr, output is always IPv4 zero addr.
 	X64(id string, ip []byte) []byte
+	// Translates ip4 to IPv6 using the NAT64 prefix for transport id;
+	// returns nil if there's no such prefix.
+	S64(id string, ip4 []byte) []byte
 }
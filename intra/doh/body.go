@@ -0,0 +1,77 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/core"
+)
+
+var bodies = sync.Pool{New: func() any { return new(reqbody) }}
+
+// reqbody is the body of a doh post, over a copy of the query in a buffer
+// from the pool. The buffer is recycled once both the http client is done
+// with it (see: http.Client.Do, which closes bodies, at times in the
+// background even after it returns) and the sender is (see: release).
+type reqbody struct {
+	bytes.Reader
+	bptr   *[]byte
+	refs   atomic.Int32 // of the client and of the sender
+	closed atomic.Bool
+}
+
+var _ io.ReadCloser = (*reqbody)(nil)
+
+// newReqBody returns a reqbody over a copy of q, with its query id zeroed.
+func newReqBody(q []byte) *reqbody {
+	b := bodies.Get().(*reqbody)
+	b.bptr = core.AllocRegion(len(q))
+	*b.bptr = append((*b.bptr)[:0], q...)
+	if len(q) >= 2 {
+		binary.BigEndian.PutUint16(*b.bptr, 0)
+	}
+	b.Reader.Reset(*b.bptr)
+	b.refs.Store(2)
+	b.closed.Store(false)
+	return b
+}
+
+// query returns the query in b; valid until released.
+func (b *reqbody) query() []byte {
+	return *b.bptr
+}
+
+// get returns a fresh body of the same query, for the http client to
+// retry with (ex: on http2 GOAWAY); see: http.Request.GetBody.
+func (b *reqbody) get() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(slices.Clone(b.query()))), nil
+}
+
+// Close implements io.Closer for the http client.
+func (b *reqbody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.release()
+	}
+	return nil
+}
+
+// release is called once by the sender, after http.Client.Do returns.
+func (b *reqbody) release() {
+	if b.refs.Add(-1) != 0 {
+		return
+	}
+	core.Recycle(b.bptr)
+	b.bptr = nil
+	b.Reader.Reset(nil)
+	bodies.Put(b)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"testing"
+)
+
+var bodyQuery = []byte{
+	0xbe, 0xef, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x03, 'f', 'o', 'o', 0x03, 'b', 'a', 'r', 0x00, 0x00, 0x01, 0x00, 0x01,
+}
+
+func TestReqBody(t *testing.T) {
+	b := newReqBody(bodyQuery)
+	if binary.BigEndian.Uint16(bodyQuery) != 0xbeef {
+		t.Fatalf("body: query of the caller modified")
+	}
+	got, err := io.ReadAll(b)
+	if err != nil || binary.BigEndian.Uint16(got) != 0 || !bytes.Equal(got[2:], bodyQuery[2:]) {
+		t.Fatalf("body: got %x, %v", got, err)
+	}
+
+	retry, _ := b.get()
+	again, _ := io.ReadAll(retry)
+	if !bytes.Equal(again, got) {
+		t.Errorf("body: retry: got %x; want %x", again, got)
+	}
+
+	// recycled only once both the client and the sender are done
+	b.Close()
+	b.Close() // closed more than once, by the client
+	if b.bptr == nil {
+		t.Fatalf("body: recycled before the sender released it")
+	}
+	b.release()
+	if b.bptr != nil {
+		t.Errorf("body: not recycled")
+	}
+}
+
+// BenchmarkReqBody reports allocs of doh post bodies, pooled and not.
+func BenchmarkReqBody(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			body := newReqBody(bodyQuery)
+			_, _ = io.Copy(io.Discard, body)
+			body.Close()
+			body.release()
+		}
+	})
+	b.Run("cloned", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			q := slices.Clone(bodyQuery)
+			binary.BigEndian.PutUint16(q, 0)
+			body := io.NopCloser(bytes.NewBuffer(q))
+			_, _ = io.Copy(io.Discard, body)
+			body.Close()
+		}
+	})
+}
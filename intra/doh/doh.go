@@ -25,14 +25,20 @@ package doh
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/netip"
+	"net/textproto"
 	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -49,6 +55,11 @@ import (
 
 const dohmimetype = "application/dns-message"
 
+var (
+	errBadHeader  = errors.New("doh: bad header")
+	errShortQuery = errors.New("doh: query too short")
+)
+
 type odohtransport struct {
 	omu              sync.RWMutex // protects odohConfig
 	odohproxy        string       // proxy url
@@ -73,16 +84,44 @@ type transport struct {
 	pxcmu          sync.RWMutex // protects pxclients
 	pxclients      map[string]*proxytransport
 	dialer         *protect.RDial
-	proxies        ipn.Proxies // proxy provider, may be nil
-	relay          ipn.Proxy   // dial doh via relay, may be nil
+	proxies        ipn.Proxies  // proxy provider, may be nil
+	relay          ipn.Proxy    // dial doh via relay, may be nil
+	hmu            sync.RWMutex // protects headers
+	headers        http.Header  // sent with every request; see: SetHeader
+	pad            *dnsx.Padding
+	certs          *dnsx.CertChecks
+	conns          dnsx.ConnStats // of conns to the endpoint, and via proxies
+	lanes          *dnsx.Lanes    // admits interactive queries before background ones
 	status         int
 	est            core.P2QuantileEstimator
 }
 
 var _ dnsx.Transport = (*transport)(nil)
+var _ dnsx.Warmer = (*transport)(nil)
+var _ dnsx.HeaderSetter = (*transport)(nil)
+var _ dnsx.Padder = (*transport)(nil)
+var _ dnsx.CertChecker = (*transport)(nil)
+var _ dnsx.ConnReporter = (*transport)(nil)
+var _ dnsx.ContextQuerier = (*transport)(nil)
+
+const (
+	// idle conns to the endpoint are closed after this long
+	idletimeout = 2 * time.Minute
+	// idle conns via proxies are closed after this long
+	pxidletimeout = 5 * time.Minute
+	// max queries in flight, of which, some are only ever of interactive
+	// ones; go's http2 client sends no priority frames, so queries are
+	// instead admitted in order of their lane; see: dnsx.Lanes
+	maxinflight      = 32
+	reservedinflight = 8
+)
 
 func (t *transport) dial(network, addr string) (net.Conn, error) {
-	return dialers.SplitDial(t.dialer, network, addr)
+	c, err := dialers.SplitDial(t.dialer, network, addr)
+	if err != nil {
+		return c, err
+	}
+	return t.conns.Track(c, idletimeout), nil
 }
 
 // NewTransport returns a POST-only DoH transport.
@@ -94,6 +133,24 @@ func NewTransport(id, rawurl string, addrs []string, px ipn.Proxies, ctl protect
 	return newTransport(dnsx.DOH, id, rawurl, "", addrs, px, ctl)
 }
 
+// NewTransportWithHeaders is like NewTransport, but sends headers with every
+// request; ex: api keys or bearer tokens that private DoH servers require.
+// `headers` are "Key: Value" pairs, one per line. rawurl's path and query,
+// if any, are sent as-is (ex: /dns-query?key=...).
+func NewTransportWithHeaders(id, rawurl string, addrs []string, headers string, px ipn.Proxies, ctl protect.Controller) (dnsx.Transport, error) {
+	h, err := parseHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTransport(dnsx.DOH, id, rawurl, "", addrs, px, ctl)
+	if err != nil {
+		return nil, err
+	}
+	t.headers = h
+	log.I("doh: %s: with %d headers", id, len(h))
+	return t, nil
+}
+
 // NewTransport returns a POST-only Oblivious DoH transport.
 // `id` identifies this transport.
 // `endpoint` is the ODoH proxy that liasons with the target.
@@ -122,9 +179,13 @@ func newTransport(typ, id, rawurl, target string, addrs []string, px ipn.Proxies
 		dialer:    protect.MakeNsRDial(id, ctl), // ctl may be nil
 		proxies:   px,                           // may be nil
 		relay:     relay,                        // may be nil
+		headers:   make(http.Header),
+		pad:       dnsx.NewPadding(),
+		certs:     dnsx.NewCertChecks(),
 		status:    dnsx.Start,
 		pxclients: make(map[string]*proxytransport),
 		est:       core.NewP50Estimator(),
+		lanes:     dnsx.NewLanes(maxinflight, reservedinflight),
 	}
 	if !isodoh {
 		parsedurl, err := url.Parse(rawurl)
@@ -215,15 +276,20 @@ func newTransport(typ, id, rawurl, target string, addrs []string, px ipn.Proxies
 			// ServerName:         t.hostname,
 		}
 	}
+	// checks beyond the chain, if set; see: SetCertChecks
+	t.tlsconfig.VerifyConnection = t.certs.Verify
 	// Override the dial function.
-	t.client.Transport = &http.Transport{
+	tr := &http.Transport{
 		Dial:                  t.dial,
 		ForceAttemptHTTP2:     true,
-		IdleConnTimeout:       2 * time.Minute,
+		IdleConnTimeout:       idletimeout,
 		TLSHandshakeTimeout:   3 * time.Second,
 		ResponseHeaderTimeout: 20 * time.Second, // Same value as Android DNS-over-TLS
 		TLSClientConfig:       t.tlsconfig.Clone(),
 	}
+	// say hello as set; see: SetTLSHello
+	tr.DialTLSContext = dialers.HelloDialTLS(t.id, tr, t.dial)
+	t.client.Transport = tr
 
 	log.I("doh: new transport(%s): %s; relay? %t; addrs? %v; resolved? %t", t.typ, t.url, relay != nil, addrs, renewed)
 	return t, nil
@@ -244,17 +310,24 @@ func (t *transport) httpClientFor(p ipn.Proxy) (*http.Client, error) {
 		return pxtr.c, nil
 	}
 
-	client := &http.Client{
-		// higher timeouts for proxies
-		Transport: &http.Transport{
-			Dial:                  p.Dialer().Dial,
-			ForceAttemptHTTP2:     true,
-			IdleConnTimeout:       5 * time.Minute,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 30 * time.Second,
-			TLSClientConfig:       t.tlsconfig.Clone(),
-		},
+	dial := func(network, addr string) (net.Conn, error) {
+		c, err := p.Dialer().Dial(network, addr)
+		if err != nil || c == nil {
+			return c, err
+		}
+		return t.conns.Track(c, pxidletimeout), nil
 	}
+	// higher timeouts for proxies
+	tr := &http.Transport{
+		Dial:                  dial,
+		ForceAttemptHTTP2:     true,
+		IdleConnTimeout:       pxidletimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSClientConfig:       t.tlsconfig.Clone(),
+	}
+	tr.DialTLSContext = dialers.HelloDialTLS(t.id, tr, dial)
+	client := &http.Client{Transport: tr}
 	// last writer wins
 	t.pxcmu.Lock()
 	t.pxclients[p.ID()] = &proxytransport{p: p, c: client}
@@ -269,21 +342,20 @@ func (t *transport) httpClientFor(p ipn.Proxy) (*http.Client, error) {
 // Independent of the query's success or failure, this function also returns the
 // address of the server on a best-effort basis, or nil if the address could not
 // be determined.
-func (t *transport) doDoh(pid string, q []byte) (response []byte, blocklists string, elapsed time.Duration, qerr *dnsx.QueryError) {
+func (t *transport) doDoh(ctx context.Context, pid string, q []byte) (response []byte, blocklists string, elapsed time.Duration, qerr *dnsx.QueryError) {
 	start := time.Now()
-	q, err := AddEdnsPadding(q)
-	if err != nil {
-		log.D("doh: failed to add padding: %v", err)
+	if len(q) < 2 {
 		elapsed = time.Since(start)
-		qerr = dnsx.NewInternalQueryError(err)
+		qerr = dnsx.NewBadQueryError(errShortQuery)
 		return
 	}
-
-	// zero out the query id
 	id := binary.BigEndian.Uint16(q)
-	binary.BigEndian.PutUint16(q, 0)
+	// zero out the query id; of a copy, as q may be the caller's (if unpadded)
+	body := newReqBody(q)
+	defer body.release()
+	q = body.query()
 
-	req, err := t.asDohRequest(q)
+	req, err := t.asDohPost(body)
 	if err != nil {
 		log.D("doh: failed to create request: %v", err)
 		elapsed = time.Since(start)
@@ -291,7 +363,7 @@ func (t *transport) doDoh(pid string, q []byte) (response []byte, blocklists str
 		return
 	}
 
-	response, blocklists, elapsed, qerr = t.send(pid, req)
+	response, blocklists, elapsed, qerr = t.send(pid, req.WithContext(ctx))
 
 	if qerr == nil { // restore dns query id
 		zeroid := binary.BigEndian.Uint16(response)
@@ -367,6 +439,7 @@ func (t *transport) send(pid string, req *http.Request) (ans []byte, blocklists
 			log.E("doh: query failed: %v", qerr)
 			if conn != nil {
 				log.I("doh: close failing doh conn to %s", hostname)
+				dnsx.MarkConnErr(conn)
 				conn.Close()
 			}
 		}
@@ -383,6 +456,7 @@ func (t *transport) send(pid string, req *http.Request) (ans []byte, blocklists
 				return
 			}
 			conn = info.Conn
+			t.conns.Got(info.Reused)
 			// info.Conn is a DuplexConn, so RemoteAddr is actually a TCPAddr.
 			// if the conn is proxied, then RemoteAddr is that of the proxy
 			server = conn.RemoteAddr()
@@ -401,7 +475,10 @@ func (t *transport) send(pid string, req *http.Request) (ans []byte, blocklists
 
 	httpResponse, err := t.fetch(pid, req)
 
-	if err != nil || httpResponse == nil {
+	if errors.Is(err, dnsx.ErrCertCheck) {
+		qerr = dnsx.NewTransportQueryError(err)
+		return
+	} else if err != nil || httpResponse == nil {
 		qerr = dnsx.NewSendFailedQueryError(err)
 		return
 	}
@@ -422,8 +499,10 @@ func (t *transport) send(pid string, req *http.Request) (ans []byte, blocklists
 
 	sc := httpResponse.StatusCode
 	if sc != http.StatusOK {
-		// 4xx
-		if sc >= http.StatusBadRequest && sc < http.StatusInternalServerError {
+		if sc == http.StatusUnauthorized || sc == http.StatusForbidden {
+			// the client may prompt for new credentials; see: SetHeader
+			qerr = dnsx.NewAuthQueryError(fmt.Errorf("http-status: %d", sc))
+		} else if sc >= http.StatusBadRequest && sc < http.StatusInternalServerError { // 4xx
 			qerr = dnsx.NewClientQueryError(fmt.Errorf("http-status: %d", sc))
 		} else {
 			qerr = dnsx.NewTransportQueryError(fmt.Errorf("http-status: %d", sc))
@@ -453,12 +532,118 @@ func (t *transport) asDohRequest(q []byte) (req *http.Request, err error) {
 	if err != nil {
 		return
 	}
+	t.withHeaders(req)
 	req.Header.Set("content-type", dohmimetype)
 	req.Header.Set("accept", dohmimetype)
 	req.Header.Set("user-agent", "")
 	return
 }
 
+// asDohPost returns a doh post request with body, which it owns from here on.
+func (t *transport) asDohPost(body *reqbody) (req *http.Request, err error) {
+	req, err = http.NewRequest(http.MethodPost, t.url, nil)
+	if err != nil {
+		body.Close()
+		return
+	}
+	req.Body = body
+	req.GetBody = body.get
+	req.ContentLength = int64(body.Len())
+	t.withHeaders(req)
+	req.Header.Set("content-type", dohmimetype)
+	req.Header.Set("accept", dohmimetype)
+	req.Header.Set("user-agent", "")
+	return
+}
+
+// withHeaders adds headers set on t to req.
+func (t *transport) withHeaders(req *http.Request) {
+	t.hmu.RLock()
+	defer t.hmu.RUnlock()
+	for k, v := range t.headers {
+		req.Header[k] = slices.Clone(v)
+	}
+}
+
+// SetHeader implements dnsx.HeaderSetter. The http clients (and so,
+// their pooled conns) are left as-is, as headers are set per request.
+func (t *transport) SetHeader(key, value string) error {
+	k, ok := headerKey(key)
+	if !ok || strings.ContainsAny(value, "\r\n") {
+		return errBadHeader
+	}
+	t.hmu.Lock()
+	defer t.hmu.Unlock()
+	if len(value) <= 0 {
+		t.headers.Del(k)
+	} else {
+		t.headers.Set(k, value)
+	}
+	log.I("doh: %s: header %s set? %t", t.id, k, len(value) > 0)
+	log.V("doh: %s: header %s: %s", t.id, k, value)
+	return nil
+}
+
+// SetPadding implements dnsx.Padder.
+func (t *transport) SetPadding(policy, block int) error {
+	return t.pad.Set(policy, block)
+}
+
+// SetCertChecks implements dnsx.CertChecker; pooled conns are kept as-is.
+func (t *transport) SetCertChecks(staple bool, minscts int, keys bool, alert dnsx.CertAlert) error {
+	t.certs.Set(staple, minscts, keys, alert)
+	return nil
+}
+
+// ConnStats implements dnsx.ConnReporter.
+func (t *transport) ConnStats() *dnsx.ConnStats {
+	return &t.conns
+}
+
+// CertStatus implements dnsx.CertChecker.
+func (t *transport) CertStatus() string {
+	return t.certs.Status()
+}
+
+// CoverIPs implements dnsx.CertChecker.
+func (t *transport) CoverIPs(ips ...netip.Addr) {
+	t.certs.Cover(ips...)
+}
+
+// headerKey returns key in canonical form, and false if key is not a
+// valid header name or is one that t always sets on its own.
+func headerKey(key string) (string, bool) {
+	key = strings.TrimSpace(key)
+	if len(key) <= 0 || strings.ContainsAny(key, " \t\r\n:") {
+		return "", false
+	}
+	k := textproto.CanonicalMIMEHeaderKey(key)
+	switch k {
+	case "Content-Type", "Accept", "Content-Length", "Host":
+		return "", false
+	}
+	return k, true
+}
+
+// parseHeaders parses "Key: Value" pairs, one per line, into headers.
+func parseHeaders(lines string) (http.Header, error) {
+	h := make(http.Header)
+	for _, line := range strings.Split(lines, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) <= 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		k, kok := headerKey(key)
+		value = strings.TrimSpace(value)
+		if !ok || !kok || len(value) <= 0 {
+			return nil, errBadHeader
+		}
+		h.Add(k, value)
+	}
+	return h, nil
+}
+
 func (t *transport) ID() string {
 	return t.id
 }
@@ -468,16 +653,25 @@ func (t *transport) Type() string {
 }
 
 func (t *transport) Query(network string, q []byte, smm *x.DNSSummary) (r []byte, err error) {
+	return t.QueryContext(context.Background(), network, q, smm)
+}
+
+// QueryContext implements dnsx.ContextQuerier
+func (t *transport) QueryContext(ctx context.Context, network string, q []byte, smm *x.DNSSummary) (r []byte, err error) {
 	var blocklists string
 	var elapsed time.Duration
 	var qerr *dnsx.QueryError
 
 	_, pid := xdns.Net2ProxyID(network)
+	release := t.lanes.Acquire(network)
+	defer release()
+
+	q = t.pad.Pad(q)
 	if t.typ == dnsx.DOH {
-		r, blocklists, elapsed, qerr = t.doDoh(pid, q)
+		r, blocklists, elapsed, qerr = t.doDoh(ctx, pid, q)
 		smm.Server = t.hostname
 	} else {
-		r, elapsed, qerr = t.doOdoh(pid, q)
+		r, elapsed, qerr = t.doOdoh(ctx, pid, q)
 		smm.Server = t.odohtargetname
 		smm.RelayServer = t.odohproxyname
 	}
@@ -486,6 +680,8 @@ func (t *transport) Query(network string, q []byte, smm *x.DNSSummary) (r []byte
 	if qerr != nil {
 		status = qerr.Status()
 		err = qerr.Unwrap()
+	} else {
+		r = t.pad.Unpad(r)
 	}
 	ans := xdns.AsMsg(r)
 	t.status = status
@@ -509,6 +705,27 @@ func (t *transport) Query(network string, q []byte, smm *x.DNSSummary) (r []byte
 	return r, err
 }
 
+// Warmup implements dnsx.Warmer
+func (t *transport) Warmup() error {
+	if t.typ == dnsx.ODOH { // fetches target's keys
+		_, err := t.fetchTargetConfig()
+		return err
+	}
+	// any response means the conn (tcp, tls, h2) is up, and pooled
+	req, err := http.NewRequest(http.MethodHead, t.url, nil)
+	if err != nil {
+		return err
+	}
+	t.withHeaders(req)
+	req.Header.Set("user-agent", "")
+	res, err := t.fetch("", req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	return res.Body.Close()
+}
+
 func (t *transport) P50() int64 {
 	return t.est.Get()
 }
@@ -0,0 +1,151 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/miekg/dns"
+)
+
+// headerTripper answers all requests with status sc (and, if ok, with an
+// answer to the query), and records the headers of the last one.
+type headerTripper struct {
+	sync.Mutex
+	sc int
+	h  http.Header
+}
+
+func (rt *headerTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.Lock()
+	rt.h = req.Header.Clone()
+	sc := rt.sc
+	rt.Unlock()
+
+	b, _ := io.ReadAll(req.Body)
+	req.Body.Close()
+	if sc == http.StatusOK {
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			return nil, err
+		}
+		b, _ = new(dns.Msg).SetReply(q).Pack()
+	}
+	return &http.Response{
+		StatusCode: sc,
+		Body:       io.NopCloser(bytes.NewReader(b)),
+		Request:    req,
+	}, nil
+}
+
+func (rt *headerTripper) last() http.Header {
+	rt.Lock()
+	defer rt.Unlock()
+	return rt.h
+}
+
+func headersTransport(t *testing.T, headers string) (*transport, *headerTripper) {
+	t.Helper()
+	dt, err := NewTransportWithHeaders("h1", "https://doh.test/dns-query?key=k", nil, headers, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := dt.(*transport)
+	rt := &headerTripper{sc: http.StatusOK}
+	tr.client.Transport = rt
+	return tr, rt
+}
+
+func headersQuery(t *testing.T, tr *transport) (*x.DNSSummary, error) {
+	t.Helper()
+	q, _ := new(dns.Msg).SetQuestion("example.test.", dns.TypeA).Pack()
+	smm := new(x.DNSSummary)
+	_, err := tr.Query(dnsx.NetNoProxy, q, smm)
+	return smm, err
+}
+
+func TestHeadersSent(t *testing.T) {
+	for _, bad := range []string{"no colon", "X-Key:", "Content-Type: text/plain"} {
+		if _, err := NewTransportWithHeaders("h0", "https://doh.test/dns-query", nil, bad, nil, nil); !errors.Is(err, errBadHeader) {
+			t.Errorf("headers: %q: err %v; want %v", bad, err, errBadHeader)
+		}
+	}
+
+	tr, rt := headersTransport(t, "authorization: Bearer a\nX-Key: k1\n\nX-Key: k2")
+	if _, err := headersQuery(t, tr); err != nil {
+		t.Fatal(err)
+	}
+	h := rt.last()
+	if v := h.Get("Authorization"); v != "Bearer a" {
+		t.Errorf("headers: authorization %q; want Bearer a", v)
+	}
+	if v := h.Values("X-Key"); len(v) != 2 || v[0] != "k1" || v[1] != "k2" {
+		t.Errorf("headers: x-key %v; want [k1 k2]", v)
+	}
+	if v := h.Get("Content-Type"); v != dohmimetype {
+		t.Errorf("headers: content-type %q; want %s", v, dohmimetype)
+	}
+
+	// set at runtime, and sent with queries after
+	if err := tr.SetHeader("authorization", "Bearer b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SetHeader("x-key", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Host", "Accept", "bad key", ""} {
+		if err := tr.SetHeader(k, "v"); !errors.Is(err, errBadHeader) {
+			t.Errorf("headers: set %q: err %v; want %v", k, err, errBadHeader)
+		}
+	}
+	if err := tr.SetHeader("X-Ok", "v\r\nX-Evil: 1"); !errors.Is(err, errBadHeader) {
+		t.Errorf("headers: set a value with crlf: err %v; want %v", err, errBadHeader)
+	}
+	if _, err := headersQuery(t, tr); err != nil {
+		t.Fatal(err)
+	}
+	h = rt.last()
+	if v := h.Get("Authorization"); v != "Bearer b" {
+		t.Errorf("headers: authorization %q; want Bearer b", v)
+	}
+	if v := h.Values("X-Key"); len(v) != 0 {
+		t.Errorf("headers: x-key %v sent after removal", v)
+	}
+}
+
+func TestHeadersAuthError(t *testing.T) {
+	tr, rt := headersTransport(t, "Authorization: Bearer stale")
+	tests := []struct {
+		sc     int
+		status int
+	}{
+		{http.StatusOK, dnsx.Complete},
+		{http.StatusUnauthorized, dnsx.AuthError},
+		{http.StatusForbidden, dnsx.AuthError},
+		{http.StatusBadRequest, dnsx.ClientError},
+		{http.StatusBadGateway, dnsx.TransportError},
+	}
+	for _, tc := range tests {
+		rt.Lock()
+		rt.sc = tc.sc
+		rt.Unlock()
+		smm, err := headersQuery(t, tr)
+		if smm.Status != tc.status {
+			t.Errorf("headers: http %d: status %d; want %d", tc.sc, smm.Status, tc.status)
+		}
+		if (err != nil) != (tc.status != dnsx.Complete) {
+			t.Errorf("headers: http %d: err %v", tc.sc, err)
+		}
+	}
+}
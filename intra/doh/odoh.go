@@ -7,6 +7,7 @@ package doh
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -41,7 +42,7 @@ var (
 
 // targets:  github.com/DNSCrypt/dnscrypt-resolvers/blob/master/v3/odoh-servers.md
 // endpoints:  github.com/DNSCrypt/dnscrypt-resolvers/blob/master/v3/odoh-relays.md
-func (d *transport) doOdoh(pid string, q []byte) (res []byte, elapsed time.Duration, qerr *dnsx.QueryError) {
+func (d *transport) doOdoh(ctx context.Context, pid string, q []byte) (res []byte, elapsed time.Duration, qerr *dnsx.QueryError) {
 	viaproxy := len(d.odohproxy) > 0
 
 	odohmsg, odohctx, err := d.buildTargetQuery(q)
@@ -58,7 +59,7 @@ func (d *transport) doOdoh(pid string, q []byte) (res []byte, elapsed time.Durat
 		return
 	}
 
-	res, _, elapsed, qerr = d.send(pid, req)
+	res, _, elapsed, qerr = d.send(pid, req.WithContext(ctx))
 	log.V("odoh: send; proxy? %t, elapsed: %s; err? %v", viaproxy, elapsed, qerr)
 	if qerr != nil {
 		// datatracker.ietf.org/doc/rfc9230 section 4.3 and section 7
@@ -66,7 +67,7 @@ func (d *transport) doOdoh(pid string, q []byte) (res []byte, elapsed time.Durat
 		// 400 bad request on padding or other failures
 		// these are "transport errors", in which case we should retry
 		// but for now, invalidate cached odoh config, if any
-		if qerr.Status() == dnsx.ClientError {
+		if s := qerr.Status(); s == dnsx.ClientError || s == dnsx.AuthError {
 			d.omu.Lock()
 			d.odohConfig = nil
 			d.odohConfigExpiry = time.Now()
@@ -0,0 +1,134 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+// verdicts of flows Flow does not answer in time; see: Tunnel.SetFlowTimeout
+const (
+	FlowFailOpen      = iota // Base
+	FlowFailClosed           // Block
+	FlowFailLastKnown        // the verdict last given for the same uid and domains (or dst); else Base
+)
+
+// max verdicts remembered for FlowFailLastKnown
+const maxlastknown = 1024
+
+// prefixes cids of flows given a default verdict, as Flow gave them none
+const failsafecid = "failsafe:"
+
+var errFailsafePolicy = errors.New("failsafe: unknown policy")
+
+// failsafe is a Listener that bounds how long flows wait on its Flow, and
+// gives those it does not answer in time (or answers nil for) a verdict as
+// per its policy; the verdict's why is then errListenerTimeout.
+type failsafe struct {
+	Listener
+	d      atomic.Int64 // timeout; 0 waits for as long as Flow takes
+	policy atomic.Int32 // FlowFailOpen, FlowFailClosed, FlowFailLastKnown
+	n      atomic.Int64 // flows given a default verdict
+
+	mu   sync.Mutex        // protects last
+	last map[string]string // stallkey(uid, domains or dst) -> pid
+}
+
+var _ Listener = (*failsafe)(nil)
+
+func newFailsafe(l Listener) *failsafe {
+	return &failsafe{Listener: l, last: make(map[string]string)}
+}
+
+func (f *failsafe) set(d time.Duration, policy int) error {
+	switch policy {
+	case FlowFailOpen, FlowFailClosed, FlowFailLastKnown:
+	default:
+		return errFailsafePolicy
+	}
+	f.d.Store(int64(max(d, 0)))
+	f.policy.Store(int32(policy))
+	if policy != FlowFailLastKnown {
+		f.mu.Lock()
+		clear(f.last)
+		f.mu.Unlock()
+	}
+	log.I("failsafe: wait %s; policy %d", d, policy)
+	return nil
+}
+
+// Flow implements SocketListener.
+func (f *failsafe) Flow(protocol int32, uid int, src, dst, origdsts, domains, probableDomains, blocklists, meta string) *Mark {
+	k := dst
+	if len(domains) > 0 {
+		k = domains
+	}
+	k = stallkey(strconv.Itoa(uid), k)
+
+	var res *Mark
+	ok := f.Listener != nil // nil when torn down
+	if ok {
+		res, ok = core.Await(time.Duration(f.d.Load()), func() *Mark {
+			return f.Listener.Flow(protocol, uid, src, dst, origdsts, domains, probableDomains, blocklists, meta)
+		})
+	}
+	if ok && res != nil {
+		f.remember(k, res.PID)
+		return res
+	}
+
+	n := f.n.Add(1)
+	pid := ipn.Base
+	switch f.policy.Load() {
+	case FlowFailClosed:
+		pid = ipn.Block
+	case FlowFailLastKnown:
+		if last := f.recall(k); len(last) > 0 {
+			pid = last
+		}
+	}
+	log.W("failsafe: %s -> %s (%s) for uid %d: no verdict (timeout? %t); %s", src, dst, domains, uid, !ok, pid)
+	// summaries of flows sans a cid are never sent; see: sendNotif
+	res = &Mark{PID: pid, CID: failsafecid + strconv.FormatInt(n, 10), why: errListenerTimeout}
+	if uid >= 0 {
+		res.UID = strconv.Itoa(uid)
+	}
+	return res
+}
+
+// remember notes pid as the verdict last given for k, if it is to be
+// recalled; deferred verdicts are not.
+func (f *failsafe) remember(k, pid string) {
+	if f.policy.Load() != FlowFailLastKnown || len(pid) <= 0 || pid == ipn.Defer {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.last[k]; !ok && len(f.last) >= maxlastknown {
+		clear(f.last) // start afresh
+	}
+	f.last[k] = pid
+}
+
+func (f *failsafe) recall(k string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last[k]
+}
+
+// failsafed returns true if res is a verdict given by failsafe.
+func failsafed(res *Mark) bool {
+	return res != nil && errors.Is(res.why, errListenerTimeout)
+}
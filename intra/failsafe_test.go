@@ -0,0 +1,131 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// failwait is how long flows wait on a hanging listener
+const failwait = 100 * time.Millisecond
+
+// hangListener is a testListener whose Flow hangs (till the test ends),
+// if hang is set.
+type hangListener struct {
+	*testListener
+	hang    atomic.Bool
+	hung    atomic.Int32 // calls to Flow that hung
+	release chan struct{}
+}
+
+func (l *hangListener) Flow(protocol int32, uid int, src, dst, origdsts, domains, probableDomains, blocklists, meta string) *Mark {
+	if l.hang.Load() {
+		l.hung.Add(1)
+		<-l.release
+	}
+	return l.testListener.Flow(protocol, uid, src, dst, origdsts, domains, probableDomains, blocklists, meta)
+}
+
+// newFailsafeTunnel returns a testTunnel whose flows are decided by a
+// hangListener, wrapped in a failsafe with policy.
+func newFailsafeTunnel(tb testing.TB, pid string, policy int) (*testTunnel, *hangListener, *failsafe) {
+	tb.Helper()
+	tt := newTestTunnel(pid)
+	hl := &hangListener{testListener: tt.l, release: make(chan struct{})}
+	tb.Cleanup(func() { close(hl.release) })
+	fs := newFailsafe(hl)
+	if err := fs.set(failwait, policy); err != nil {
+		tb.Fatal(err)
+	}
+	tt.tcp.listener = fs
+	tt.udp.listener = fs
+	return tt, hl, fs
+}
+
+func TestFailsafeHangingFlow(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  int
+		learn   string // verdict the listener gives before it hangs, if any
+		want    string
+		connect bool
+	}{
+		{"fail open", FlowFailOpen, "", ipn.Base, true},
+		{"fail closed", FlowFailClosed, "", ipn.Block, false},
+		{"last known, none", FlowFailLastKnown, "", ipn.Base, true},
+		{"last known, block", FlowFailLastKnown, ipn.Block, ipn.Block, false},
+	}
+	for _, tc := range tests {
+		tt, hl, fs := newFailsafeTunnel(t, ipn.Base, tc.policy)
+		tt.px.to = map[string]string{"tcp": echoTCP(t, make(chan struct{}, 4))}
+		client := tt.up(t, settings.IP4)
+		dst := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 443}
+
+		dial := func() error {
+			c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber)
+			if err == nil {
+				c.Close()
+			}
+			return err
+		}
+		if len(tc.learn) > 0 {
+			tt.l.pid = tc.learn
+			_ = dial()
+			if s := tt.l.summaries(t, 1)[0]; s.Failsafe {
+				t.Errorf("failsafe: %s: answered verdict marked failsafe", tc.name)
+			}
+			tt.l.pid = ipn.Base
+		}
+
+		hl.hang.Store(true)
+		start := time.Now()
+		err := dial()
+		if took := time.Since(start); took > 10*failwait {
+			t.Errorf("failsafe: %s: flow waited %s on a hanging listener", tc.name, took)
+		}
+		if (err == nil) != tc.connect {
+			t.Errorf("failsafe: %s: connected? %t; err %v", tc.name, err == nil, err)
+		}
+		s := tt.l.summaries(t, 1)[0]
+		if s.PID != tc.want || !s.Failsafe || !strings.HasPrefix(s.ID, failsafecid) {
+			t.Errorf("failsafe: %s: summary %s: pid %s, failsafe? %t; want %s, true", tc.name, s.ID, s.PID, s.Failsafe, tc.want)
+		}
+		if n, h := fs.n.Load(), hl.hung.Load(); n != 1 || h != 1 {
+			t.Errorf("failsafe: %s: %d defaulted of %d hung; want 1 of 1", tc.name, n, h)
+		}
+		tt.tcp.End()
+		tt.udp.End()
+	}
+}
+
+func TestFailsafeHangingFlowUDP(t *testing.T) {
+	tt, hl, fs := newFailsafeTunnel(t, ipn.Base, FlowFailClosed)
+	client := tt.up(t, settings.IP4)
+	defer tt.udp.End()
+
+	hl.hang.Store(true)
+	sendUDP(t, client, 5000, []byte("q"))
+	s := tt.l.summaries(t, 1)[0]
+	if s.PID != ipn.Block || !s.Failsafe || !strings.HasPrefix(s.ID, failsafecid) {
+		t.Errorf("failsafe: udp: summary %s: pid %s, failsafe? %t; want %s, true", s.ID, s.PID, s.Failsafe, ipn.Block)
+	}
+	if n := fs.n.Load(); n != 1 {
+		t.Errorf("failsafe: udp: %d defaulted; want 1", n)
+	}
+	if d := tt.px.dials.Load(); d != 0 {
+		t.Errorf("failsafe: udp: %d dials of a flow failed closed", d)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+	"golang.org/x/sys/unix"
+)
+
+// tag in Flow's meta for flows to the device's own addresses
+const hairpintag = "hairpin"
+
+var errHairpinAddr = errors.New("hairpin: invalid ip")
+
+var (
+	lo4    = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	lo6    = netip.IPv6Loopback()
+	bcast4 = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+)
+
+// hairpin matches flows to the device's own addresses: those configured on
+// the tun interface, and those set as its own (ex: its public ip, as
+// advertised by self-hosted apps); flows to them are dialed on loopback
+// instead, over Base, lest they loop out of the tunnel and back into it.
+type hairpin struct {
+	sync.RWMutex                         // protects all fields
+	tun          []netip.Addr            // of the tun interface
+	mine         map[netip.Addr]struct{} // set with Tunnel.SetOwnAddrs
+}
+
+func newHairpin() *hairpin {
+	return &hairpin{mine: make(map[netip.Addr]struct{})}
+}
+
+// setMine replaces the device's own addresses with csv of ips; an empty
+// csv unsets them all. Addresses of the tun are always its own.
+func (h *hairpin) setMine(csv string) error {
+	mine := make(map[netip.Addr]struct{})
+	for _, s := range strings.Split(csv, ",") {
+		if s = strings.TrimSpace(s); len(s) <= 0 {
+			continue
+		}
+		ip, err := netip.ParseAddr(s)
+		if err != nil || !hairpinnable(ip) {
+			return errHairpinAddr
+		}
+		mine[ip.Unmap()] = struct{}{}
+	}
+	h.Lock()
+	h.mine = mine
+	h.Unlock()
+	log.I("hairpin: own addrs %d; %s", len(mine), csv)
+	return nil
+}
+
+// hairpinnable returns true if ip may be one of the device's own.
+func hairpinnable(ip netip.Addr) bool {
+	return ip.IsValid() && !ip.IsUnspecified() && !ip.IsLoopback() &&
+		!ip.IsMulticast() && ip != bcast4
+}
+
+// setTun replaces addresses of the tun with those of its interface.
+func (h *hairpin) setTun(addrs []netip.Addr) {
+	tun := make([]netip.Addr, 0, len(addrs))
+	for _, ip := range addrs {
+		if ip = ip.Unmap(); hairpinnable(ip) && !slices.Contains(tun, ip) {
+			tun = append(tun, ip)
+		}
+	}
+	h.Lock()
+	h.tun = tun
+	h.Unlock()
+	log.I("hairpin: tun addrs %v", tun)
+}
+
+// tunAddrs returns addresses configured on the tun interface whose fd is
+// fd; these are unknown to the netstack, which accepts flows from any src.
+func tunAddrs(fd int) ([]netip.Addr, error) {
+	ifr, err := unix.NewIfreq("")
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.IoctlIfreq(fd, unix.TUNGETIFF, ifr); err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(ifr.Name())
+	if err != nil {
+		return nil, err
+	}
+	ifaddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.Addr, 0, len(ifaddrs))
+	for _, a := range ifaddrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// match returns the loopback address (with the port of dst) to dial
+// instead of dst, and true, if dst is one of the device's own addresses.
+func (h *hairpin) match(dst netip.AddrPort) (netip.AddrPort, bool) {
+	ip := dst.Addr()
+	if !hairpinnable(ip) {
+		return dst, false
+	}
+	h.RLock()
+	_, mine := h.mine[ip]
+	mine = mine || slices.Contains(h.tun, ip)
+	h.RUnlock()
+	if !mine {
+		return dst, false
+	}
+	if ip.Is4() {
+		return netip.AddrPortFrom(lo4, dst.Port()), true
+	}
+	return netip.AddrPortFrom(lo6, dst.Port()), true
+}
+
+// withHairpin returns res over Base, if on, unless res blocks or defers.
+func withHairpin(res *Mark, on bool) *Mark {
+	if res == nil || !on {
+		return res
+	}
+	switch res.PID {
+	case ipn.Base, ipn.Block, ipn.Defer:
+		return res
+	}
+	return &Mark{PID: ipn.Base, CID: res.CID, UID: res.UID}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestHairpinMatch(t *testing.T) {
+	h := newHairpin()
+	if err := h.setMine("203.0.113.1, 2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setMine("127.0.0.1"); err != errHairpinAddr {
+		t.Errorf("hairpin: loopback as own: err %v", err)
+	}
+	h.setTun([]netip.Addr{
+		netip.MustParseAddr("::ffff:10.111.222.1"),
+		netip.MustParseAddr("fd66:f83a:c650::1"),
+		netip.MustParseAddr("10.111.222.1"), // dup
+		netip.IPv4Unspecified(),
+		lo4,
+	})
+	if n := len(h.tun); n != 2 {
+		t.Errorf("hairpin: %d tun addrs %v; want 2", n, h.tun)
+	}
+
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		{"203.0.113.1:8080", "127.0.0.1:8080"},
+		{"[2001:db8::1]:443", "[::1]:443"},
+		{"10.111.222.1:22", "127.0.0.1:22"},
+		{"[fd66:f83a:c650::1]:53", "[::1]:53"},
+		{"10.111.222.3:443", ""},
+		{"203.0.113.2:8080", ""},
+		{"255.255.255.255:67", ""},
+	}
+	for _, tc := range tests {
+		lo, ok := h.match(netip.MustParseAddrPort(tc.dst))
+		if got := lo.String(); ok != (len(tc.want) > 0) || ok && got != tc.want {
+			t.Errorf("hairpin: match(%s) = %s, %t; want %q", tc.dst, got, ok, tc.want)
+		}
+	}
+
+	// addrs of the tun are replaced, not added to
+	h.setTun([]netip.Addr{netip.MustParseAddr("10.111.222.9")})
+	if _, ok := h.match(netip.MustParseAddrPort("10.111.222.1:22")); ok {
+		t.Error("hairpin: addr of the previous tun matched")
+	}
+	if _, ok := h.match(netip.MustParseAddrPort("203.0.113.1:1")); !ok {
+		t.Error("hairpin: own addr not matched once the tun changed")
+	}
+}
+
+func TestHairpinTunAddrsOfNonTun(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if addrs, err := tunAddrs(int(r.Fd())); err == nil {
+		t.Errorf("hairpin: addrs of a pipe: %v", addrs)
+	}
+	if _, err := tunAddrs(-1); err == nil {
+		t.Error("hairpin: addrs of a bad fd")
+	}
+}
+
+// srcs of flows are not taken to be addrs of the tun; only those it is
+// configured with are
+func TestHairpinFlows(t *testing.T) {
+	tt := newTestTunnel(ipn.Base)
+	tt.px.to = map[string]string{"tcp": echoTCP(t, make(chan struct{}, 4))}
+	client := tt.up(t, settings.IP4)
+	defer tt.tcp.End()
+
+	dial := func() {
+		dst := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 443}
+		c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	src := netip.AddrFrom4(testClient.As4())
+
+	dial()
+	if s := tt.l.summaries(t, 1)[0]; s.Hairpin {
+		t.Error("hairpin: flow to a remote addr hairpinned")
+	}
+	if _, ok := tt.tcp.hairpin.match(netip.AddrPortFrom(src, 443)); ok {
+		t.Errorf("hairpin: src %s of a flow taken to be the tun's", src)
+	}
+
+	tt.tcp.hairpin.setTun([]netip.Addr{netip.AddrFrom4(testServer.As4())})
+	dial()
+	if s := tt.l.summaries(t, 1)[0]; !s.Hairpin {
+		t.Error("hairpin: flow to an addr of the tun not hairpinned")
+	}
+	want := []string{"10.111.222.3:443", "127.0.0.1:443"}
+	if got := tt.px.dialed(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("hairpin: dialed %v; want %v", got, want)
+	}
+}
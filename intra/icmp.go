@@ -7,8 +7,11 @@
 package intra
 
 import (
+	"errors"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -24,11 +27,15 @@ import (
 )
 
 type icmpHandler struct {
-	resolver dnsx.Resolver
-	tunMode  *settings.TunMode
-	prox     ipn.Proxies
-	listener Listener
-	status   int
+	resolver    dnsx.Resolver
+	tunMode     *settings.TunMode
+	prox        ipn.Proxies
+	listener    Listener
+	procs       *netstat.ProcNet     // uids of sockets, for BlockModeFilterProc
+	conntracker core.ConnMapper      // connid -> [icmpflow]
+	fmu         sync.Mutex           // protects flows
+	flows       map[string]*icmpflow // src->dst => echo flow
+	status      atomic.Int32         // ICMPOK or ICMPEND
 }
 
 const (
@@ -41,22 +48,26 @@ const (
 	icmptimeout = 10 * time.Second
 )
 
+var errIcmpFirewalled = errors.New("icmp: firewalled")
+
 var _ netstack.GICMPHandler = (*icmpHandler)(nil)
 
-func NewICMPHandler(resolver dnsx.Resolver, prox ipn.Proxies, tunMode *settings.TunMode, listener Listener) netstack.GICMPHandler {
+func NewICMPHandler(resolver dnsx.Resolver, prox ipn.Proxies, tunMode *settings.TunMode, procs *netstat.ProcNet, conns core.ConnMapper, listener Listener) netstack.GICMPHandler {
 	h := &icmpHandler{
-		resolver: resolver,
-		tunMode:  tunMode,
-		prox:     prox,
-		listener: listener,
-		status:   ICMPOK,
+		resolver:    resolver,
+		tunMode:     tunMode,
+		prox:        prox,
+		listener:    listener,
+		procs:       procs,
+		conntracker: conns.Proto(ProtoTypeICMP),
+		flows:       make(map[string]*icmpflow),
 	}
 
 	log.I("icmp: new handler created")
 	return h
 }
 
-func (h *icmpHandler) onFlow(source, target netip.AddrPort, realips, domains, probableDomains, blocklists string) (pid, cid string, block bool) {
+func (h *icmpHandler) onFlow(source, target netip.AddrPort, realips, domains, probableDomains, blocklists, meta string) (pid, cid, uid string, block bool) {
 	// BlockModeNone returns false, BlockModeSink returns true
 	if h.tunMode.BlockMode == settings.BlockModeSink {
 		pid = ipn.Block
@@ -70,34 +81,102 @@ func (h *icmpHandler) onFlow(source, target netip.AddrPort, realips, domains, pr
 		return
 	}
 
-	uid := -1
+	uidn := -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
-		procEntry := netstat.FindProcNetEntry("icmp", source, target)
+		procEntry := h.procs.Find("icmp", source, target)
 		if procEntry != nil {
-			uid = procEntry.UserID
+			uidn = procEntry.UserID
 		}
 	}
 
 	var proto int32 = 1 // icmp
+	if target.Addr().Is6() {
+		proto = 58 // icmpv6
+	}
 	src := source.String()
 	dst := target.String()
 	// todo: handle forwarding icmp to appropriate proxy?
-	res := h.listener.Flow(proto, uid, src, dst, realips, domains, probableDomains, blocklists)
+	res := h.listener.Flow(proto, uidn, src, dst, realips, domains, probableDomains, blocklists, meta)
 
-	cid, pid, _ = splitCidPidUid(res)
+	cid, pid, uid = splitCidPidUid(res)
+	if pid == ipn.Defer { // pings are not held
+		pid = ipn.Block
+	}
 	block = pid == ipn.Block
 	return
 }
 
 // End implements netstack.GICMPHandler.
 func (h *icmpHandler) End() error {
-	h.status = ICMPEND
+	h.status.Store(ICMPEND)
 	h.CloseConns(nil)
+	// flows sans cids are not tracked by conntracker
+	h.fmu.Lock()
+	flows := make([]*icmpflow, 0, len(h.flows))
+	for _, f := range h.flows {
+		flows = append(flows, f)
+	}
+	h.fmu.Unlock()
+	for _, f := range flows {
+		f.Close()
+	}
 	return nil
 }
 
 // CloseConns implements netstack.GICMPHandler.
-func (h *icmpHandler) CloseConns(cids []string) []string { return nil }
+func (h *icmpHandler) CloseConns(cids []string) []string {
+	return closeconns(h.conntracker, cids)
+}
+
+func (h *icmpHandler) conns() core.ConnMapper {
+	return h.conntracker
+}
+
+// flow returns the echo flow from source to target, if any; or a new one,
+// with the listener's verdict on it, tracked till it idles out.
+func (h *icmpHandler) flow(source, target netip.AddrPort) *icmpflow {
+	key := icmpkey(source, target)
+	h.fmu.Lock()
+	f := h.flows[key]
+	h.fmu.Unlock()
+	if f != nil {
+		return f
+	}
+
+	realips, domains, probableDomains, blocklists, meta := undoAlg(h.resolver, target.Addr())
+	// flow is alg/nat-aware, do not change target or any addrs
+	pid, cid, uid, block := h.onFlow(source, target, realips, domains, probableDomains, blocklists, meta)
+	if !block {
+		pid = routeOf(h.prox, pid, meta)
+	}
+	to := oneRealIp(realips, target)
+	smm := icmpSummary(cid, pid, uid, to.Addr())
+	nf := newIcmpFlow(source, target, to, block, smm, func(f *icmpflow) {
+		h.fmu.Lock()
+		if h.flows[key] == f {
+			delete(h.flows, key)
+		}
+		h.fmu.Unlock()
+		if len(f.smm.ID) > 0 {
+			h.conntracker.Untrack(f.smm.ID)
+		}
+		go h.sendNotif(f.smm)
+	})
+
+	h.fmu.Lock()
+	if f = h.flows[key]; f == nil { // not raced by another echo
+		h.flows[key] = nf
+	}
+	h.fmu.Unlock()
+	if f != nil { // nf is discarded, and not summarized
+		nf.idle.Stop()
+		return f
+	}
+	if len(cid) > 0 { // not set in BlockModeNone and BlockModeSink
+		h.conntracker.TrackTuple(smm.tuple(), smm.start, cid, nf)
+	}
+	return nf
+}
 
 // PingOnce implements netstack.GICMPHandler.
 func (h *icmpHandler) PingOnce(src, dst netip.AddrPort, msg []byte) bool {
@@ -114,39 +193,46 @@ func (h *icmpHandler) PingOnce(src, dst netip.AddrPort, msg []byte) bool {
 // see: sturmflut.github.io/linux/ubuntu/2015/01/17/unprivileged-icmp-sockets-on-linux/
 // ex: github.com/prometheus-community/pro-bing/blob/0bacb2d5e/ping.go#L703
 func (h *icmpHandler) Ping(source, target netip.AddrPort, msg []byte, pong netstack.Pong) (open bool) {
-	if h.status == ICMPEND {
+	if h.status.Load() == ICMPEND {
 		log.D("t.icmp: handler ended")
 		return
 	}
 	var px ipn.Proxy
 	var err error
 
-	realips, domains, probableDomains, blocklists := undoAlg(h.resolver, target.Addr())
+	source, _ = core.UnmapAddrPort(source)
+	target, _ = core.UnmapAddrPort(target)
 
-	// flow is alg/nat-aware, do not change target or any addrs
-	pid, cid, block := h.onFlow(source, target, realips, domains, probableDomains, blocklists)
-	summary := icmpSummary(cid, pid)
+	// echoes are summarized per flow, when it idles out; see: icmpflow
+	f := h.flow(source, target)
+	f.sent(len(msg))
+	pid := f.smm.PID
 
 	defer func() {
-		if !open {
-			summary.done(err)
-			go h.sendNotif(summary)
-		}
+		f.fail(err)
 	}()
 
-	if block {
+	if f.block {
 		log.I("t.icmp: egress: firewalled %s -> %s", source, target)
+		err = errIcmpFirewalled
+		f.fail(err) // as f may be closed, and summarized, while asleep
 		// sleep for a while to avoid busy conns
 		time.Sleep(blocktime)
 		return false // denied
 	}
 
+	if h.prox.KillSwitched(pid) {
+		log.I("t.icmp: egress: killswitched %s -> %s via %s", source, target, pid)
+		err = errKillSwitch
+		return false // denied
+	}
+
 	if px, err = h.prox.ProxyFor(pid); err != nil {
 		log.E("t.icmp: egress: no proxy(%s); err %v", pid, err)
 		return false // denied
 	}
 
-	dst := oneRealIp(realips, target)
+	dst := f.to
 	uc, err := px.Dialer().Dial("udp", dst.String())
 	if err != nil || uc == nil { // nilaway: tx.socks5 returns nil conn even if err == nil
 		if err == nil {
@@ -155,33 +241,37 @@ func (h *icmpHandler) Ping(source, target netip.AddrPort, msg []byte, pong netst
 		log.E("t.icmp: egress: dial(%s); hasConn? %s(%t); err %v", dst, pid, uc != nil, err)
 		return false // denied
 	}
-	defer clos(uc)
+	f.add(uc)
 
 	uc.SetDeadline(time.Now().Add(icmptimeout))
 	if _, err = uc.Write(msg); err != nil {
 		log.E("t.icmp: egress:  write(%v) ping; err %v", target, err)
+		f.remove(uc)
+		clos(uc)
 		return false // denied
 	}
 	log.I("t.icmp: egress: writeTo(%v) ping; done %d", target, len(msg))
 
 	if pong == nil {
 		// single ping, block until done
-		return h.fetch(uc, nil, summary)
+		return h.fetch(uc, nil, f)
 	} else {
 		// multi ping, non-blocking
-		go h.fetch(uc, pong, summary)
+		go h.fetch(uc, pong, f)
 		return true
 	}
 }
 
-func (h *icmpHandler) fetch(c net.Conn, pong netstack.Pong, summary *SocketSummary) (success bool) {
+func (h *icmpHandler) fetch(c net.Conn, pong netstack.Pong, f *icmpflow) (success bool) {
 	var err error
 	var n int
 
 	defer func() {
+		f.remove(c)
 		clos(c)
-		summary.done(err)
-		go h.sendNotif(summary)
+		if !success {
+			f.fail(err)
+		}
 	}()
 
 	bptr := core.Alloc()
@@ -195,7 +285,7 @@ func (h *icmpHandler) fetch(c net.Conn, pong netstack.Pong, summary *SocketSumma
 	src := c.LocalAddr()
 	dst := c.RemoteAddr()
 	for {
-		if h.status == ICMPEND {
+		if h.status.Load() == ICMPEND {
 			log.D("icmp: handler ended")
 			return
 		}
@@ -205,7 +295,9 @@ func (h *icmpHandler) fetch(c net.Conn, pong netstack.Pong, summary *SocketSumma
 			log.E("t.icmp: ingress: read(%v <- %v) ping err %v", src, dst, err)
 			success = success || false
 			break // on error, stop
-		} else if pong != nil { // process multiple pings
+		}
+		f.recv(n)
+		if pong != nil { // process multiple pings
 			if err = pong(b[:n]); err != nil {
 				if err != unix.ENETUNREACH {
 					log.E("t.icmp: ingress: write(%v <- %v) pong err %v", src, dst, err)
@@ -226,7 +318,7 @@ func (h *icmpHandler) fetch(c net.Conn, pong netstack.Pong, summary *SocketSumma
 
 func (h *icmpHandler) sendNotif(s *SocketSummary) {
 	l := h.listener
-	if l == nil || s == nil || h.status == ICMPEND {
+	if l == nil || s == nil || h.status.Load() == ICMPEND {
 		return
 	}
 	l.OnSocketClosed(s)
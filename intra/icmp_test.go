@@ -0,0 +1,169 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+)
+
+// src of echoes, as seen on the tun device
+var icmpsrc = netip.AddrPortFrom(netip.AddrFrom4(testClient.As4()), 0)
+
+// echoServer echoes datagrams back to their senders, as unprivileged
+// icmp sockets would echo replies; returns its addr, which echoes are
+// sent to (see: icmpHandler.Ping).
+func echoServer(tb testing.TB) netip.AddrPort {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(b[:n], from)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// byID returns summaries in smms by their ids.
+func byID(smms []*SocketSummary) map[string]*SocketSummary {
+	out := make(map[string]*SocketSummary, len(smms))
+	for _, s := range smms {
+		out[s.ID] = s
+	}
+	return out
+}
+
+// noMoreSummaries fails tb if l sends a summary within d.
+func noMoreSummaries(tb testing.TB, l *testListener, d time.Duration) {
+	tb.Helper()
+	select {
+	case s := <-l.smms:
+		tb.Errorf("summaries: unexpected %s", s.str())
+	case <-time.After(d):
+	}
+}
+
+func TestICMPEchoes(t *testing.T) {
+	tt := newTestTunnel(ipn.Base)
+	defer tt.icmp.End()
+	h := tt.icmp
+	dst1, dst2 := echoServer(t), echoServer(t)
+
+	// echoes to the same dst make up one flow
+	for _, sz := range []int{8, 16, 24} {
+		if !h.PingOnce(icmpsrc, dst1, make([]byte, sz)) {
+			t.Fatalf("icmp: echo of %d to %s: no reply", sz, dst1)
+		}
+	}
+	pongs := make(chan int, 4)
+	pong := func(b []byte) error {
+		pongs <- len(b)
+		return nil
+	}
+	if !h.Ping(icmpsrc, dst2, make([]byte, 32), pong) {
+		t.Fatalf("icmp: echo to %s not sent", dst2)
+	}
+	select {
+	case n := <-pongs:
+		if n != 32 {
+			t.Errorf("icmp: reply from %s: got %d bytes; want 32", dst2, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("icmp: no reply from %s", dst2)
+	}
+
+	if n := tt.conns.Len(); n != 2 {
+		t.Fatalf("icmp: %d flows tracked; want 2", n)
+	}
+	if closed := h.CloseConns(nil); len(closed) != 2 {
+		t.Errorf("icmp: closed %v; want 2 flows", closed)
+	}
+
+	smms := byID(tt.l.summaries(t, 2))
+	want := map[string]int64{"t1": 8 + 16 + 24, "t2": 32}
+	for cid, n := range want {
+		s := smms[cid]
+		if s == nil {
+			t.Errorf("icmp: %s: no summary", cid)
+			continue
+		}
+		if s.Proto != ProtoTypeICMP || s.PID != ipn.Base {
+			t.Errorf("icmp: %s: proto %s pid %s", cid, s.Proto, s.PID)
+		}
+		if s.Tx != n || s.Rx != n {
+			t.Errorf("icmp: %s: tx %d rx %d; want %d", cid, s.Tx, s.Rx, n)
+		}
+		if s.Msg != errNone.Error() {
+			t.Errorf("icmp: %s: msg %q", cid, s.Msg)
+		}
+	}
+	noMoreSummaries(t, tt.l, 100*time.Millisecond) // one per flow
+	if n := tt.conns.Len(); n != 0 {
+		t.Errorf("icmp: %d flows tracked after close", n)
+	}
+	h.fmu.Lock()
+	n := len(h.flows)
+	h.fmu.Unlock()
+	if n != 0 {
+		t.Errorf("icmp: %d flows left after close", n)
+	}
+}
+
+func TestICMPBlockedEcho(t *testing.T) {
+	tt := newTestTunnel(ipn.Block)
+	defer tt.icmp.End()
+	h := tt.icmp
+	dst := echoServer(t)
+
+	// blocked echoes go unanswered for blocktime, which is not waited on
+	go h.PingOnce(icmpsrc, dst, make([]byte, 16))
+
+	failed := func() bool {
+		h.fmu.Lock()
+		f := h.flows[icmpkey(icmpsrc, dst)]
+		h.fmu.Unlock()
+		if f == nil {
+			return false
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.err != nil
+	}
+	eventually(t, 5*time.Second, failed, "icmp: blocked echo to %s not seen", dst)
+	if closed := h.CloseConns(nil); len(closed) != 1 {
+		t.Errorf("icmp: closed %v; want 1 flow", closed)
+	}
+
+	s := tt.l.summaries(t, 1)[0]
+	if s.PID != ipn.Block {
+		t.Errorf("icmp: %s: pid %s; want %s", s.ID, s.PID, ipn.Block)
+	}
+	if s.Tx != 16 || s.Rx != 0 {
+		t.Errorf("icmp: %s: tx %d rx %d; want 16, 0", s.ID, s.Tx, s.Rx)
+	}
+	if !strings.Contains(s.Msg, errIcmpFirewalled.Error()) {
+		t.Errorf("icmp: %s: msg %q; want %q", s.ID, s.Msg, errIcmpFirewalled)
+	}
+	if d := tt.px.dials.Load(); d != 0 {
+		t.Errorf("icmp: %d dials for a blocked echo", d)
+	}
+	noMoreSummaries(t, tt.l, 100*time.Millisecond)
+}
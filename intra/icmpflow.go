@@ -0,0 +1,148 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+)
+
+// echo flows idle for this long are done, and summarized
+const icmpidle = 30 * time.Second
+
+// icmpflow is a run of echoes from src to dst with the same ident (the
+// port of dst), summarized once it idles out, or is closed. It is tracked
+// as a net.Conn (see: core.ConnMapper), of which only Close is of use.
+type icmpflow struct {
+	src, dst netip.AddrPort
+	to       netip.AddrPort // dialed; a realip of dst, if any
+	block    bool           // verdict on the first echo; sticks
+	smm      *SocketSummary // sent once done
+	last     atomic.Int64   // unix nanos of the last echo or reply
+	tx, rx   atomic.Int64   // bytes of echoes, replies
+
+	mu   sync.Mutex            // protects ucs, err
+	ucs  map[net.Conn]struct{} // upstream sockets of echoes in flight
+	err  error                 // first err, if any
+	idle *time.Timer
+	once sync.Once
+	fin  func(*icmpflow) // called once, when done
+}
+
+var _ net.Conn = (*icmpflow)(nil)
+var _ core.Idler = (*icmpflow)(nil)
+
+func newIcmpFlow(src, dst, to netip.AddrPort, block bool, smm *SocketSummary, fin func(*icmpflow)) *icmpflow {
+	f := &icmpflow{
+		src:   src,
+		dst:   dst,
+		to:    to,
+		block: block,
+		smm:   smm,
+		ucs:   make(map[net.Conn]struct{}),
+		fin:   fin,
+	}
+	f.stamp()
+	f.idle = time.AfterFunc(icmpidle, f.idled)
+	return f
+}
+
+func icmpkey(src, dst netip.AddrPort) string {
+	return src.String() + "->" + dst.String()
+}
+
+func (f *icmpflow) stamp() {
+	f.last.Store(time.Now().UnixNano())
+}
+
+// sent accounts for an echo of n bytes.
+func (f *icmpflow) sent(n int) {
+	f.tx.Add(int64(n))
+	f.stamp()
+}
+
+// recv accounts for a reply of n bytes.
+func (f *icmpflow) recv(n int) {
+	f.rx.Add(int64(n))
+	f.stamp()
+}
+
+// fail records err, if it is the first.
+func (f *icmpflow) fail(err error) {
+	if err == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// add tracks uc of an echo in flight, until it is removed.
+func (f *icmpflow) add(uc net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ucs[uc] = struct{}{}
+}
+
+func (f *icmpflow) remove(uc net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.ucs, uc)
+}
+
+// idled closes f if it has been idle for icmpidle, or checks back later.
+func (f *icmpflow) idled() {
+	if d := f.IdleFor(); d < icmpidle {
+		f.idle.Reset(icmpidle - d)
+		return
+	}
+	f.Close()
+}
+
+// IdleFor implements core.Idler.
+func (f *icmpflow) IdleFor() time.Duration {
+	return time.Since(time.Unix(0, f.last.Load()))
+}
+
+// Close implements net.Conn; closes echoes in flight, and summarizes f.
+func (f *icmpflow) Close() error {
+	f.once.Do(func() {
+		f.idle.Stop()
+		f.mu.Lock()
+		for uc := range f.ucs {
+			clos(uc)
+		}
+		clear(f.ucs)
+		err := f.err
+		f.mu.Unlock()
+
+		f.smm.Tx = f.tx.Load()
+		f.smm.Rx = f.rx.Load()
+		f.smm.done(err)
+		f.fin(f)
+	})
+	return nil
+}
+
+// Read implements net.Conn; echoes are not read from f.
+func (f *icmpflow) Read([]byte) (int, error) { return 0, net.ErrClosed }
+
+// Write implements net.Conn; echoes are not written to f.
+func (f *icmpflow) Write([]byte) (int, error) { return 0, net.ErrClosed }
+
+func (f *icmpflow) LocalAddr() net.Addr              { return net.UDPAddrFromAddrPort(f.src) }
+func (f *icmpflow) RemoteAddr() net.Addr             { return net.UDPAddrFromAddrPort(f.dst) }
+func (f *icmpflow) SetDeadline(time.Time) error      { return nil }
+func (f *icmpflow) SetReadDeadline(time.Time) error  { return nil }
+func (f *icmpflow) SetWriteDeadline(time.Time) error { return nil }
@@ -74,6 +74,10 @@ func (h *base) DNS() string {
 	return nodns
 }
 
+func (h *base) MTU() (int, error) {
+	return nomtu, nil
+}
+
 func (h *base) fetch(req *http.Request) (*http.Response, error) {
 	stopped := h.status == END
 	log.V("proxy: base: fetch(%s); ok? %t", req.URL, !stopped)
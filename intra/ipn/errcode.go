@@ -0,0 +1,72 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn/h1"
+	tx "github.com/txthinking/socks5"
+)
+
+// ErrCode returns the stable code (x.ErrNone, x.ErrNoProxy etc) for err
+// from proxies and their dialers; x.ErrUnknown if it has none.
+func ErrCode(err error) int {
+	switch {
+	case err == nil:
+		return x.ErrNone
+	case errors.Is(err, core.ErrSuperseded):
+		return x.ErrSuperseded
+	case errors.Is(err, ErrFirewalled):
+		return x.ErrFirewalled
+	case errors.Is(err, errProxyNotFound), errors.Is(err, errMissingProxyOpt),
+		errors.Is(err, errProxyConfig):
+		return x.ErrNoProxy
+	case errors.Is(err, errProxyStopped), errors.Is(err, errNoProxyResponse):
+		return x.ErrProxyDown
+	case errors.Is(err, errNoSig), errors.Is(err, h1.ErrProxyAuth),
+		errors.Is(err, tx.ErrUserPassAuth):
+		return x.ErrProxyAuthFailed
+	case errors.Is(err, errAnnounceNotSupported), errors.Is(err, errProxyScheme),
+		errors.Is(err, errNoProxyConn):
+		return x.ErrProxyUnsupported
+	case errors.Is(err, errNoSecret), errors.Is(err, errNoSecretProvider):
+		return x.ErrProxySecret
+	}
+	return netErrCode(err)
+}
+
+// netErrCode returns the stable code for err from sockets.
+func netErrCode(err error) int {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+		return x.ErrNone // conn ended
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return x.ErrDialRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return x.ErrConnReset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.EADDRNOTAVAIL):
+		return x.ErrUnreachable
+	}
+	var ne net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "dial" {
+			return x.ErrDialTimeout
+		}
+		return x.ErrTimeout
+	}
+	return x.ErrUnknown
+}
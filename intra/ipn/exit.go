@@ -82,6 +82,10 @@ func (h *exit) DNS() string {
 	return nodns
 }
 
+func (h *exit) MTU() (int, error) {
+	return nomtu, nil
+}
+
 func (h *exit) fetch(req *http.Request) (*http.Response, error) {
 	stopped := h.status == END
 	log.V("proxy: base: fetch(%s); ok? %t", req.URL, !stopped)
@@ -0,0 +1,132 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// faultyProxy is a Proxy that injects faults in effect on it (set with
+// core.InjectFault) into its dials, as if they were of its upstream.
+type faultyProxy struct {
+	Proxy
+	f *core.Fault
+}
+
+var _ Proxy = (*faultyProxy)(nil)
+
+// WithFault returns p wrapped in a faultyProxy, if a fault is in effect on
+// it; p as-is otherwise.
+func WithFault(p Proxy) Proxy {
+	if p == nil {
+		return p
+	}
+	f := core.FaultFor(core.FaultProxy, p.ID())
+	if f == nil {
+		return p
+	}
+	return &faultyProxy{Proxy: p, f: f}
+}
+
+// inject delays, and returns the error to fail a dial with, if any.
+func (p *faultyProxy) inject(network, addr string) error {
+	if d := p.f.Delay(); d > 0 {
+		time.Sleep(d)
+	}
+	err := p.f.Fail()
+	if errors.Is(err, core.ErrFaultServfail) { // not of proxies
+		err = fmt.Errorf("%w: %w", err, syscall.ECONNREFUSED)
+	}
+	if err != nil {
+		log.D("proxy: fault: %s: %s %s; %v", p.ID(), network, addr, err)
+	}
+	return err
+}
+
+// Dial implements Proxy.
+func (p *faultyProxy) Dial(network, addr string) (protect.Conn, error) {
+	if err := p.inject(network, addr); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	c, err := p.Proxy.Dial(network, addr)
+	if err != nil || p.f.ResetAfter <= 0 {
+		return c, err
+	}
+	switch uc := c.(type) {
+	case core.TCPConn:
+		return &resettcp{TCPConn: uc, rst: newResetter(uc, p.f.ResetAfter)}, nil
+	case core.UDPConn:
+		return &resetudp{UDPConn: uc, rst: newResetter(uc, p.f.ResetAfter)}, nil
+	}
+	return c, nil
+}
+
+// Announce implements Proxy.
+func (p *faultyProxy) Announce(network, local string) (protect.PacketConn, error) {
+	if err := p.inject(network, local); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	return p.Proxy.Announce(network, local)
+}
+
+// resetter closes c once left bytes are read from it.
+type resetter struct {
+	left atomic.Int64 // bytes till reset
+	c    interface{ Close() error }
+}
+
+func newResetter(c interface{ Close() error }, left int64) *resetter {
+	r := &resetter{c: c}
+	r.left.Store(left)
+	return r
+}
+
+// read accounts for n bytes read, and returns syscall.ECONNRESET once
+// they are more than those left, after closing its conn.
+func (r *resetter) read(n int, err error) (int, error) {
+	if err != nil || n <= 0 {
+		return n, err
+	}
+	if left := r.left.Add(-int64(n)); left < 0 {
+		_ = r.c.Close()
+		return max(n+int(left), 0), fmt.Errorf("fault: %w", syscall.ECONNRESET)
+	}
+	return n, err
+}
+
+type resettcp struct {
+	core.TCPConn
+	rst *resetter
+}
+
+func (c *resettcp) Read(b []byte) (int, error) {
+	return c.rst.read(c.TCPConn.Read(b))
+}
+
+type resetudp struct {
+	core.UDPConn
+	rst *resetter
+}
+
+func (c *resetudp) Read(b []byte) (int, error) {
+	return c.rst.read(c.UDPConn.Read(b))
+}
+
+func (c *resetudp) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	n, err = c.rst.read(n, err)
+	return n, addr, err
+}
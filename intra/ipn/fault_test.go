@@ -0,0 +1,94 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// loopProxy dials over the loopback, as is.
+type loopProxy struct {
+	Proxy // unused
+	id    string
+}
+
+func (p *loopProxy) ID() string { return p.id }
+
+func (p *loopProxy) Dial(network, addr string) (protect.Conn, error) {
+	return net.Dial(network, addr)
+}
+
+func TestFaultResetAfter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write(make([]byte, 64))
+		_, _ = io.Copy(io.Discard, c) // till closed by the reset
+	}()
+
+	const id = "rst0"
+	defer core.ClearFaults()
+	if err := core.InjectFault(core.FaultProxy, id, `{"name": "rst", "resetafter": 10}`, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	p := WithFault(&loopProxy{id: id})
+	if _, ok := p.(*faultyProxy); !ok {
+		t.Fatalf("fault: not in effect on %s", id)
+	}
+	c, err := p.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*resettcp); !ok {
+		t.Fatalf("fault: conn %T not reset", c)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got int
+	b := make([]byte, 4)
+	for {
+		n, err := c.Read(b)
+		got += n
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("fault: want %v, got %v after %d bytes", syscall.ECONNRESET, err, got)
+		}
+		break
+	}
+	if got != 10 {
+		t.Errorf("fault: read %d bytes before the reset; want 10", got)
+	}
+	if _, err := c.Write([]byte{1}); err == nil {
+		t.Error("fault: conn open after the reset")
+	}
+
+	// conns of proxies sans faults are not wrapped
+	if q := WithFault(&loopProxy{id: "rst1"}); q == p {
+		t.Error("fault: in effect on rst1")
+	} else if _, ok := q.(*faultyProxy); ok {
+		t.Error("fault: rst1 wrapped")
+	}
+}
@@ -7,12 +7,18 @@
 package ipn
 
 import (
+	"errors"
 	"net/http"
 
 	x "github.com/celzero/firestack/intra/backend"
 	"github.com/celzero/firestack/intra/protect"
 )
 
+// ErrFirewalled is returned right away by the Block proxy for every
+// dial, announce, accept, and fetch.
+var ErrFirewalled = errors.New("proxy: firewalled")
+
+// ground refuses everything, and never waits on anything to do so.
 type ground struct {
 	addr string
 }
@@ -26,31 +32,35 @@ func NewGroundProxy() Proxy {
 
 // Dial implements Proxy.
 func (h *ground) Dial(network, addr string) (c protect.Conn, err error) {
-	return nil, errNoProxyResponse
+	return nil, ErrFirewalled
 }
 
 // Announce implements Proxy.
 func (h *ground) Announce(network, local string) (protect.PacketConn, error) {
-	return nil, errNoProxyResponse
+	return nil, ErrFirewalled
 }
 
 // Accept implements Proxy.
 func (h *ground) Accept(network, local string) (protect.Listener, error) {
-	return nil, errNoProxyResponse
+	return nil, ErrFirewalled
 }
 
 func (h *ground) Dialer() *protect.RDial {
-	return &protect.RDial{Owner: h.ID()} // no-op dialer
+	return &protect.RDial{Owner: h.ID(), RDialer: h} // refuses, as h does
 }
 
 func (h *ground) fetch(req *http.Request) (*http.Response, error) {
-	return nil, errNoProxyResponse
+	return nil, ErrFirewalled
 }
 
 func (h *ground) DNS() string {
 	return nodns
 }
 
+func (h *ground) MTU() (int, error) {
+	return nomtu, nil
+}
+
 func (h *ground) ID() string {
 	return Block
 }
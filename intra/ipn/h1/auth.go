@@ -63,3 +63,30 @@ func (b *basicAuth) authString() string {
 	resp := b.username + ":" + b.password
 	return base64.StdEncoding.EncodeToString([]byte(resp))
 }
+
+type basicAuthFunc struct {
+	username string
+	password func() string
+}
+
+// AuthBasicFunc is AuthBasic, but with the password had from password as each
+// request is made, so that it need not be retained.
+func AuthBasicFunc(username string, password func() string) ProxyAuthorization {
+	return &basicAuthFunc{username: username, password: password}
+}
+
+func (b *basicAuthFunc) Type() string {
+	return "Basic"
+}
+
+func (b *basicAuthFunc) InitialResponse() string {
+	return b.authString()
+}
+
+func (b *basicAuthFunc) ChallengeResponse(challenge string) string {
+	return b.authString()
+}
+
+func (b *basicAuthFunc) authString() string {
+	return (&basicAuth{username: b.username, password: b.password()}).authString()
+}
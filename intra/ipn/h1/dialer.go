@@ -14,6 +14,7 @@ package h1
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -28,6 +29,9 @@ import (
 
 // code adopted from github.com/mwitkow/go-http-dialer/blob/378f744fb2/dialer.go#L1
 
+// ErrProxyAuth is returned when the proxy rejects (or wants) credentials.
+var ErrProxyAuth = errors.New("http1: tunnel: proxy auth required")
+
 type Opt func(*HttpTunnel)
 
 func New(proxyUrl *url.URL, opts ...Opt) *HttpTunnel {
@@ -71,6 +75,14 @@ func WithProxyAuth(auth ProxyAuthorization) Opt {
 	}
 }
 
+// WithTLSHello has TLS connections to the HTTP proxy say hello as per the
+// profile set for id; see: dialers.HelloClient
+func WithTLSHello(id string) Opt {
+	return func(t *HttpTunnel) {
+		t.helloID = id
+	}
+}
+
 // HttpTunnel represents a configured HTTP Connect Tunnel dialer.
 type HttpTunnel struct {
 	parentDialer *net.Dialer
@@ -78,6 +90,7 @@ type HttpTunnel struct {
 	hostname     string
 	proxyAddr    string
 	tlsConfig    *tls.Config
+	helloID      string
 	auth         ProxyAuthorization
 }
 
@@ -105,6 +118,9 @@ func (t *HttpTunnel) dialProxy() (net.Conn, error) {
 		NetDialer: t.parentDialer,
 		Config:    t.tlsConfig.Clone(),
 	}
+	if len(t.helloID) > 0 {
+		return dialers.HelloTlsDial(t.helloID, td, "tcp", t.proxyAddr)
+	}
 	return dialers.TlsDial(td, "tcp", t.proxyAddr)
 }
 
@@ -115,7 +131,7 @@ func (t *HttpTunnel) Dial(network string, address string) (net.Conn, error) {
 	}
 	conn, err := t.dialProxy()
 	if err != nil {
-		return nil, fmt.Errorf("http1: tunnel: failed dialing to proxy: %v", err)
+		return nil, fmt.Errorf("http1: tunnel: failed dialing to proxy: %w", err)
 	}
 	req := &http.Request{
 		Method: "CONNECT",
@@ -146,6 +162,10 @@ func (t *HttpTunnel) Dial(network string, address string) (net.Conn, error) {
 		}
 	}
 
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		clos(conn)
+		return nil, fmt.Errorf("%w: %s", ErrProxyAuth, resp.Status)
+	}
 	if resp.StatusCode != 200 {
 		clos(conn)
 		return nil, fmt.Errorf("http1: tunnel: failed proxying %d: %s", resp.StatusCode, resp.Status)
@@ -30,9 +30,16 @@ type http1 struct {
 	opts     *settings.ProxyOptions
 	lastdial time.Time
 	status   int
+	pwd      secretfn // password, if held by the client; may be nil
 }
 
 func NewHTTPProxy(id string, c protect.Controller, po *settings.ProxyOptions) (Proxy, error) {
+	return newHTTPProxy(id, c, po, nil)
+}
+
+// newHTTPProxy is NewHTTPProxy, but with the password, if pwd is not nil,
+// had from pwd as each request to the proxy is made, instead of from po.
+func newHTTPProxy(id string, c protect.Controller, po *settings.ProxyOptions, pwd secretfn) (Proxy, error) {
 	var err error
 	if po == nil {
 		log.W("proxy: err setting up http1 w(%v): %v", po, err)
@@ -54,9 +61,15 @@ func NewHTTPProxy(id string, c protect.Controller, po *settings.ProxyOptions) (P
 		opttls := tx.WithTls(&tls.Config{
 			ServerName: po.Host,
 		})
-		opts = append(opts, opttls)
+		opts = append(opts, opttls, tx.WithTLSHello(id))
 	}
-	if po.HasAuth() {
+	if pwd != nil {
+		optauth := tx.WithProxyAuth(tx.AuthBasicFunc(po.Auth.User, func() string {
+			v, _ := pwd() // on errs, the proxy rejects the empty password
+			return v
+		}))
+		opts = append(opts, optauth)
+	} else if po.HasAuth() {
 		optauth := tx.WithProxyAuth(tx.AuthBasic(po.Auth.User, po.Auth.Password))
 		opts = append(opts, optauth)
 	}
@@ -67,6 +80,7 @@ func NewHTTPProxy(id string, c protect.Controller, po *settings.ProxyOptions) (P
 		outbound: hp, // does not support udp
 		id:       id,
 		opts:     po,
+		pwd:      pwd,
 	}
 	h.rd = newRDial(h)
 	h.hc = newHTTPClient(h.rd)
@@ -82,6 +96,14 @@ func (h *http1) Dial(network, addr string) (c protect.Conn, err error) {
 		return nil, errProxyStopped
 	}
 
+	if h.pwd != nil {
+		if _, err = h.pwd(); err != nil {
+			h.status = TSK
+			log.W("proxy: http1: dial(%s) to %s; no password: %v", network, addr, err)
+			return nil, err
+		}
+	}
+
 	h.lastdial = time.Now()
 	// dialers.ProxyDial not needed, because
 	// tx.HttpTunnel.Dial() supports dialing into hostnames
@@ -111,6 +133,10 @@ func (h *http1) DNS() string {
 	return nodns
 }
 
+func (h *http1) MTU() (int, error) {
+	return nomtu, nil
+}
+
 func (h *http1) ID() string {
 	return h.id
 }
@@ -128,7 +154,7 @@ func (h *http1) GetAddr() string {
 }
 
 func (h *http1) Status() int {
-	if h.status != END && idling(h.lastdial) {
+	if h.status != END && h.status != TSK && idling(h.lastdial) {
 		return TZZ
 	}
 	return h.status
@@ -140,4 +166,17 @@ func (h *http1) Stop() error {
 	return nil
 }
 
-func (h *http1) Refresh() error { return nil }
+func (h *http1) Refresh() error {
+	if h.pwd == nil || h.status == END {
+		return nil
+	}
+	// the password may have been rotated by the client
+	if _, err := h.pwd(); err != nil {
+		h.status = TSK
+		return err
+	}
+	if h.status == TSK {
+		h.status = TUP
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"errors"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+)
+
+var errKillSwitchLocal = errors.New("killswitch: not for local proxies")
+
+// killswitch tracks proxies that must blackhole their flows when they
+// are down, instead of letting them fall back to any other proxy.
+// Precedence: kill switch wins over any fallback or failover choice.
+// While engaged, no flow is let through: proxies are probed instead (see:
+// prober), which dial over them, and so bring them back up (TOK).
+type killswitch struct {
+	on      map[string]bool      // proxy id -> kill switch set
+	engaged map[string]time.Time // proxy id -> since, if flows are blackholed
+}
+
+func newKillSwitch() *killswitch {
+	return &killswitch{
+		on:      make(map[string]bool),
+		engaged: make(map[string]time.Time),
+	}
+}
+
+// down returns true if p is missing, stopped, failing, or without its secrets.
+func down(p Proxy) bool {
+	if p == nil {
+		return true
+	}
+	s := p.Status()
+	return s == TKO || s == END || s == TSK
+}
+
+// SetKillSwitch implements x.Proxies.
+func (px *proxifier) SetKillSwitch(id string, on bool) error {
+	if len(id) <= 0 {
+		return errProxyNotFound
+	}
+	if local(id) {
+		return errKillSwitchLocal
+	}
+
+	px.Lock()
+	_, was := px.ks.engaged[id]
+	if on {
+		px.ks.on[id] = true
+	} else {
+		delete(px.ks.on, id)
+		delete(px.ks.engaged, id)
+	}
+	px.Unlock()
+
+	log.I("proxy: killswitch: %s set? %t", id, on)
+	if !on && was { // lifted along with the kill switch
+		go px.obs.OnKillSwitch(id, false)
+	}
+	// re-evaluate right away, if set
+	px.evalKillSwitch(id)
+	return nil
+}
+
+// KillSwitched implements Proxies.
+func (px *proxifier) KillSwitched(id string) bool {
+	return px.evalKillSwitch(id)
+}
+
+// evalKillSwitch engages or lifts the kill switch for proxy id, if set,
+// and returns true if it is engaged. An engaged kill switch is lifted once
+// the proxy is up, or once a probe over it succeeds, whichever is first.
+func (px *proxifier) evalKillSwitch(id string) bool {
+	px.RLock()
+	on := px.ks.on[id]
+	p := px.p[id]
+	since, engaged := px.ks.engaged[id]
+	px.RUnlock()
+
+	if !on {
+		return false
+	}
+
+	engage := down(p) // missing proxies are considered down
+	if engage && engaged && p != nil && px.pb.okSince(id, since) {
+		engage = false // probed ok since, though yet to be marked up
+	}
+
+	px.Lock()
+	// kill switch may have been unset since
+	_, engaged = px.ks.engaged[id]
+	changed := px.ks.on[id] && engaged != engage
+	if changed && engage {
+		px.ks.engaged[id] = time.Now()
+	} else if changed {
+		delete(px.ks.engaged, id)
+	}
+	px.Unlock()
+
+	if changed {
+		log.I("proxy: killswitch: %s engaged? %t", id, engage)
+		go px.obs.OnKillSwitch(id, engage)
+	}
+	if changed && engage && p != nil { // probe for recovery
+		go px.kickProbes()
+	}
+	return engage
+}
+
+// reevalKillSwitches re-evaluates all kill switches, which
+// engages or lifts them as proxies go down or recover.
+func (px *proxifier) reevalKillSwitches() {
+	px.RLock()
+	ids := make([]string, 0, len(px.ks.on))
+	for id := range px.ks.on {
+		ids = append(ids, id)
+	}
+	px.RUnlock()
+
+	for _, id := range ids {
+		px.evalKillSwitch(id)
+	}
+}
+
+// KillSwitches implements Proxies.
+func (px *proxifier) KillSwitches() []string {
+	px.RLock()
+	defer px.RUnlock()
+
+	ids := make([]string, 0, len(px.ks.on))
+	for id := range px.ks.on {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ValidKillSwitches returns an error if the kill switch cannot be set
+// for any of ids; see: Proxies.SetKillSwitches.
+func ValidKillSwitches(ids []string) error {
+	for _, id := range ids {
+		if len(id) <= 0 {
+			return errProxyNotFound
+		}
+		if local(id) {
+			return errKillSwitchLocal
+		}
+	}
+	return nil
+}
+
+// SetKillSwitches implements Proxies.
+func (px *proxifier) SetKillSwitches(ids []string) error {
+	if err := ValidKillSwitches(ids); err != nil {
+		return err
+	}
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	for _, id := range px.KillSwitches() {
+		if !set[id] {
+			_ = px.SetKillSwitch(id, false)
+		}
+	}
+	for id := range set {
+		_ = px.SetKillSwitch(id, true)
+	}
+	return nil
+}
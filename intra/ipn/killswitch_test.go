@@ -0,0 +1,184 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+)
+
+// statusProxy is a proxy whose status is set as needed.
+type statusProxy struct {
+	Proxy // unused
+	id    string
+	st    atomic.Int32
+}
+
+func newStatusProxy(id string, st int) *statusProxy {
+	p := &statusProxy{id: id}
+	p.st.Store(int32(st))
+	return p
+}
+
+func (p *statusProxy) ID() string  { return p.id }
+func (p *statusProxy) Status() int { return int(p.st.Load()) }
+
+// ksEvent is a call to OnKillSwitch.
+type ksEvent struct {
+	id      string
+	engaged bool
+}
+
+// ksListener sends kill switch events on ch.
+type ksListener struct {
+	x.ProxyListener // unused
+	ch              chan ksEvent
+}
+
+func (l *ksListener) OnKillSwitch(id string, engaged bool) {
+	l.ch <- ksEvent{id, engaged}
+}
+
+func newKillSwitchProxifier(ps ...Proxy) (*proxifier, *ksListener) {
+	l := &ksListener{ch: make(chan ksEvent, 8)}
+	px := &proxifier{
+		p:   make(map[string]Proxy),
+		ks:  newKillSwitch(),
+		pb:  newProber(),
+		obs: l,
+	}
+	px.pb.paused.Store(true) // probes are recorded by tests, as needed
+	for _, p := range ps {
+		px.p[p.ID()] = p
+	}
+	return px, l
+}
+
+func (l *ksListener) want(tb testing.TB, id string, engaged bool) {
+	tb.Helper()
+	select {
+	case ev := <-l.ch:
+		if ev.id != id || ev.engaged != engaged {
+			tb.Errorf("killswitch: got %s engaged? %t; want %s engaged? %t", ev.id, ev.engaged, id, engaged)
+		}
+	case <-time.After(time.Second):
+		tb.Errorf("killswitch: no event for %s engaged? %t", id, engaged)
+	}
+}
+
+func (l *ksListener) none(tb testing.TB) {
+	tb.Helper()
+	select {
+	case ev := <-l.ch:
+		tb.Errorf("killswitch: unexpected: %s engaged? %t", ev.id, ev.engaged)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestKillSwitchTripHoldRecover(t *testing.T) {
+	const id = "wg1"
+	p := newStatusProxy(id, TOK)
+	px, l := newKillSwitchProxifier(p)
+
+	if err := px.SetKillSwitch(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if px.KillSwitched(id) {
+		t.Error("killswitch: engaged while the proxy is up")
+	}
+	l.none(t)
+
+	// trip
+	p.st.Store(TKO)
+	if !px.KillSwitched(id) {
+		t.Fatal("killswitch: not engaged while the proxy is down")
+	}
+	l.want(t, id, true)
+
+	// hold: no flow is let through, however many
+	for range 3 {
+		if !px.KillSwitched(id) {
+			t.Error("killswitch: flow let through while the proxy is down")
+		}
+	}
+	// nor do probes lift it, unless they succeed after it engaged
+	px.pb.record(id, 0, 0, "", errProbeNoReply)
+	if !px.KillSwitched(id) {
+		t.Error("killswitch: lifted on a failed probe")
+	}
+	px.Lock()
+	px.ks.engaged[id] = time.Now().Add(time.Second)
+	px.Unlock()
+	px.pb.record(id, time.Millisecond, 0, "", nil)
+	if !px.KillSwitched(id) {
+		t.Error("killswitch: lifted on a probe from before it engaged")
+	}
+	l.none(t)
+	px.Lock()
+	px.ks.engaged[id] = time.Now().Add(-time.Second)
+	px.Unlock()
+	if px.KillSwitched(id) {
+		t.Error("killswitch: engaged after the proxy probed ok")
+	}
+	l.want(t, id, false)
+
+	// trips again, as the proxy is yet to be marked up
+	if !px.KillSwitched(id) {
+		t.Error("killswitch: not engaged while the proxy is down")
+	}
+	l.want(t, id, true)
+
+	// recover
+	p.st.Store(TOK)
+	if px.KillSwitched(id) {
+		t.Error("killswitch: engaged after the proxy recovered")
+	}
+	l.want(t, id, false)
+	if ids := px.KillSwitches(); len(ids) != 1 || ids[0] != id {
+		t.Errorf("killswitch: set %v; want [%s]", ids, id)
+	}
+}
+
+func TestKillSwitchUnset(t *testing.T) {
+	const id = "wg2"
+	px, l := newKillSwitchProxifier() // missing proxies are down
+
+	if err := px.SetKillSwitch(id, true); err != nil {
+		t.Fatal(err)
+	}
+	l.want(t, id, true)
+	if !px.KillSwitched(id) {
+		t.Error("killswitch: not engaged for a missing proxy")
+	}
+
+	// unset lifts it, and it stays lifted
+	if err := px.SetKillSwitch(id, false); err != nil {
+		t.Fatal(err)
+	}
+	l.want(t, id, false)
+	if px.KillSwitched(id) {
+		t.Error("killswitch: engaged after it was unset")
+	}
+	l.none(t)
+
+	// proxies without a kill switch are never blocked
+	if px.KillSwitched("wg3") {
+		t.Error("killswitch: engaged for wg3, which has none")
+	}
+	if err := px.SetKillSwitch(Base, true); err != errKillSwitchLocal {
+		t.Errorf("killswitch: %s: want %v, got %v", Base, errKillSwitchLocal, err)
+	}
+	if err := px.SetKillSwitches([]string{"wg4", Exit}); err != errKillSwitchLocal {
+		t.Errorf("killswitch: %s: want %v, got %v", Exit, errKillSwitchLocal, err)
+	}
+	if ids := px.KillSwitches(); len(ids) != 0 {
+		t.Errorf("killswitch: set %v; want none", ids)
+	}
+}
@@ -11,35 +11,36 @@ import (
 	"net"
 	"net/netip"
 	"strings"
+	"sync"
 
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/dialers"
 	"github.com/celzero/firestack/intra/log"
 )
 
 var errNoIps error = errors.New("multihost: no ips")
 
-// nooplock is a no-op lock.
-type nooplock struct{}
+// resolve resolves hostnames to ips; stubbed out in tests.
+var resolve = dialers.Resolve
 
 // MH is a list of hostnames and/or ip addresses for one endpoint.
 type MH struct {
-	nooplock // todo: replace with sync.RWMutex
-	id       string
-	names    []string
-	addrs    []netip.Addr
+	sync.RWMutex // protects names, addrs, lits
+	id           string
+	names        []string
+	addrs        []netip.Addr
+	lits         []netip.Addr // ips added as-is, and not resolved from names
+	gen          core.Gen     // of refreshes; see: Refresh
 }
 
-func (nooplock) Lock()    {}
-func (nooplock) Unlock()  {}
-func (nooplock) RLock()   {}
-func (nooplock) RUnlock() {}
-
 // New returns a new multihost with the given id.
 func New(id string) *MH {
 	return &MH{id: id}
 }
 
 func (h *MH) String() string {
+	h.RLock()
+	defer h.RUnlock()
 	return h.id + ":" + strings.Join(h.straddrs(), ",")
 }
 
@@ -55,14 +56,20 @@ func (h *MH) straddrs() []string {
 }
 
 func (h *MH) Names() []string {
+	h.RLock()
+	defer h.RUnlock()
 	return h.names
 }
 
 func (h *MH) Addrs() []netip.Addr {
+	h.RLock()
+	defer h.RUnlock()
 	return h.addrs
 }
 
 func (h *MH) AnyAddr() string {
+	h.RLock()
+	defer h.RUnlock()
 	if len(h.addrs) <= 0 {
 		return ""
 	}
@@ -77,15 +84,44 @@ func (h *MH) Len() int {
 }
 
 func (h *MH) addrlen() int {
+	h.RLock()
+	defer h.RUnlock()
 	return len(h.addrs)
 }
 
 // Refresh re-adds the list of IPs, hostnames, and re-resolves the hostname.
+// A refresh superseded by another (ex: as the network changed again) before
+// it is done leaves h as is, so that the latest network's ips stick.
 func (h *MH) Refresh() int {
-	// resolve ip from domain names
-	n := h.With(h.names)
-	// re-add existing ips, if any
-	return n + h.Add(h.straddrs())
+	gen := h.gen.Next()
+
+	h.RLock()
+	dips := make([]string, 0, len(h.names)+len(h.lits))
+	dips = append(dips, h.names...)
+	for _, ip := range h.lits {
+		dips = append(dips, ip.String())
+	}
+	h.RUnlock()
+
+	names, addrs, lits := h.resolve(dips)
+
+	h.Lock()
+	if ok := h.gen.Done(gen); !ok {
+		h.Unlock()
+		log.D("multihost: %s refresh #%d superseded by #%d", h.id, gen, h.gen.Current())
+		return h.Len()
+	}
+	h.names, h.addrs, h.lits = names, addrs, lits
+	h.Unlock()
+
+	log.D("multihost: %s refresh #%d => %s", h.id, gen, addrs)
+	return h.Len()
+}
+
+// Gens returns the generation of the latest refresh begun, and of the
+// latest one completed.
+func (h *MH) Gens() (cur, done uint64) {
+	return h.gen.Current(), h.gen.Completed()
 }
 
 // Add appends the list of IPs, hostnames, and hostname's IPs as resolved.
@@ -95,22 +131,45 @@ func (h *MH) Add(domainsOrIps []string) int {
 		return 0
 	}
 
+	names, addrs, lits := h.resolve(domainsOrIps)
+
 	h.Lock()
-	if h.names == nil {
-		h.names = make([]string, 0)
-	}
-	if h.addrs == nil {
-		h.addrs = make([]netip.Addr, 0)
-	}
+	h.names = append(h.names, names...)
+	h.addrs = append(h.addrs, addrs...)
+	h.lits = append(h.lits, lits...)
+	h.Unlock()
+
+	// TODO: remove dups from h.addrs and h.names
+
+	log.D("multihost: %s with %s => %s", h.id, names, addrs)
+	return h.Len()
+}
+
+// With sets the list of IPs, hostnames, and hostname's IPs as resolved.
+func (h *MH) With(domainsOrIps []string) int {
+	h.Lock()
+	h.names = make([]string, 0)
+	h.addrs = make([]netip.Addr, 0)
+	h.lits = make([]netip.Addr, 0)
+	h.Unlock()
+	return h.Add(domainsOrIps)
+}
+
+// resolve splits domainsOrIps into hostnames and ips, and resolves the
+// hostnames; addrs has all ips, and lits only those in domainsOrIps.
+func (h *MH) resolve(domainsOrIps []string) (names []string, addrs, lits []netip.Addr) {
+	names = make([]string, 0)
+	addrs = make([]netip.Addr, 0)
+	lits = make([]netip.Addr, 0)
 	for _, dip := range domainsOrIps {
 		dip = h.normalize(dip) // host or ip or host:port or ip:port
 		if len(dip) <= 0 {
 			continue
 		}
 		if ip, err := netip.ParseAddr(dip); err != nil { // may be hostname
-			h.names = append(h.names, dip) // add hostname regardless of resolution
-			if resolvedips, err := dialers.Resolve(dip); err == nil && len(resolvedips) > 0 {
-				h.addrs = append(h.addrs, resolvedips...)
+			names = append(names, dip) // add hostname regardless of resolution
+			if resolvedips, err := resolve(dip); err == nil && len(resolvedips) > 0 {
+				addrs = append(addrs, resolvedips...)
 			} else {
 				if err == nil { // err may be nil even on zero answers
 					err = errNoIps
@@ -118,24 +177,11 @@ func (h *MH) Add(domainsOrIps []string) int {
 				log.W("multihost: %s no ips for %q; err? %v", h.id, dip, err)
 			}
 		} else { // may be ip
-			h.addrs = append(h.addrs, ip)
+			addrs = append(addrs, ip)
+			lits = append(lits, ip)
 		}
 	}
-	h.Unlock()
-
-	// TODO: remove dups from h.addrs and h.names
-
-	log.D("multihost: %s with %s => %s", h.id, h.names, h.addrs)
-	return h.Len()
-}
-
-// With sets the list of IPs, hostnames, and hostname's IPs as resolved.
-func (h *MH) With(domainsOrIps []string) int {
-	h.Lock()
-	h.names = make([]string, 0)
-	h.addrs = make([]netip.Addr, 0)
-	h.Unlock()
-	return h.Add(domainsOrIps)
+	return
 }
 
 func (h *MH) normalize(dip string) string {
@@ -0,0 +1,64 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multihost
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRefreshLatestSticks refreshes h on three back-to-back network
+// changes, of which the earlier ones resolve slower than the last; only
+// the last network's ips must stick.
+func TestRefreshLatestSticks(t *testing.T) {
+	nets := []struct {
+		ip   string
+		wait time.Duration
+	}{
+		{"10.0.0.1", 150 * time.Millisecond},  // wifi
+		{"100.64.0.1", 75 * time.Millisecond}, // cell
+		{"10.0.0.2", 0},                       // wifi, again
+	}
+	var cur atomic.Int32 // network resolve sees
+	defer func(r func(string) ([]netip.Addr, error)) { resolve = r }(resolve)
+	resolve = func(string) ([]netip.Addr, error) {
+		n := nets[cur.Load()]
+		time.Sleep(n.wait)
+		return []netip.Addr{netip.MustParseAddr(n.ip)}, nil
+	}
+
+	h := New("test")
+	cur.Store(0)
+	h.With([]string{"dns.example", "9.9.9.9"})
+
+	var wg sync.WaitGroup
+	for i := range nets {
+		cur.Store(int32(i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Refresh()
+		}()
+		time.Sleep(10 * time.Millisecond) // each change begins its refresh
+	}
+	wg.Wait()
+
+	want := []netip.Addr{netip.MustParseAddr(nets[2].ip), netip.MustParseAddr("9.9.9.9")}
+	if got := h.Addrs(); !slices.Equal(got, want) {
+		t.Errorf("refresh: got %v; want %v", got, want)
+	}
+	if got := h.Names(); !slices.Equal(got, []string{"dns.example"}) {
+		t.Errorf("refresh: names: %v", got)
+	}
+	if cur, done := h.Gens(); cur != 3 || done != 3 {
+		t.Errorf("refresh: gens: %d, %d; want 3, 3", cur, done)
+	}
+}
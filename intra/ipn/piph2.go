@@ -107,11 +107,6 @@ func SetReadDeadline(t time.Time) error          { return nil }
 func SetWriteDeadline(t time.Time) error         { return nil }
 
 func (t *piph2) dialtls(network, addr string, cfg *tls.Config) (net.Conn, error) {
-	rawConn, err := t.dial(network, addr)
-	if err != nil {
-		return nil, err
-	}
-
 	colonPos := strings.LastIndex(addr, ":")
 	if colonPos == -1 {
 		colonPos = len(addr)
@@ -126,10 +121,12 @@ func (t *piph2) dialtls(network, addr string, cfg *tls.Config) (net.Conn, error)
 		}
 	}
 
-	conn := tls.Client(rawConn, cfg)
-	if err := conn.HandshakeContext(context.Background()); err != nil {
+	// say hello as set; see: SetTLSHello
+	conn, err := dialers.HelloClient(context.Background(), t.id, cfg, func() (net.Conn, error) {
+		return t.dial(network, addr)
+	})
+	if err != nil {
 		log.D("piph2: dialtls(%s) handshake error: %v", addr, err)
-		clos(rawConn)
 		return nil, err
 	}
 	return conn, nil
@@ -441,6 +438,10 @@ func (h *piph2) DNS() string {
 	return nodns
 }
 
+func (h *piph2) MTU() (int, error) {
+	return nomtu, nil
+}
+
 func closePipe(c ...io.Closer) {
 	for _, x := range c {
 		clos(x)
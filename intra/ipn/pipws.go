@@ -143,11 +143,14 @@ func NewPipWsProxy(id string, ctl protect.Controller, po *settings.ProxyOptions)
 		log.W("pipws: zero bootstrap ips %s", t.hostname)
 	}
 
-	t.client.Transport = &http.Transport{
+	tr := &http.Transport{
 		Dial:                  t.dial,
 		TLSHandshakeTimeout:   writeTimeout,
 		ResponseHeaderTimeout: writeTimeout,
 	}
+	// say hello as set; see: SetTLSHello
+	tr.DialTLSContext = dialers.HelloDialTLS(t.id, tr, t.dial)
+	t.client.Transport = tr
 	return t, nil
 }
 
@@ -252,3 +255,7 @@ func (h *pipws) Dialer() *protect.RDial {
 func (h *pipws) DNS() string {
 	return nodns
 }
+
+func (h *pipws) MTU() (int, error) {
+	return nomtu, nil
+}
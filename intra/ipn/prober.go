@@ -0,0 +1,379 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// proxies are probed this often, while there are any to probe
+	probeEvery = 1 * time.Minute
+	// a proxy is never probed more often than this
+	probeMinGap = 15 * time.Second
+	// latencies of the last these many probes are kept
+	probeWindow = 10
+	// weight of a new sample in the moving average
+	probeWeight = 0.3
+	// tls canary reached over socks5, http1, and pip proxies
+	probeCanary    = "1.1.1.1:443"
+	probeCanarySNI = "one.one.one.one"
+)
+
+var (
+	// icmp canaries pinged from within wg tunnels
+	probePing4 = netip.MustParseAddr("1.1.1.1")
+	probePing6 = netip.MustParseAddr("2606:4700:4700::1111")
+
+	errProbeNoReply = errors.New("probe: no echo reply")
+)
+
+// ProxyLatency is the latency of a proxy, as measured by periodic probes
+// over its own dialer; serialized as json for the client.
+type ProxyLatency struct {
+	EWMA      int64   `json:"ewma"`                // moving average (ms) of samples
+	Last      int64   `json:"last"`                // last sample (ms); 0 if the last probe failed
+	Samples   []int64 `json:"samples"`             // last few samples (ms), oldest first
+	LastError string  `json:"lasterror,omitempty"` // err of the last probe, if it failed
+	At        int64   `json:"at"`                  // unix millis of the last probe
+	// secs since the last handshake with any peer; wg only
+	HandshakeAge int64 `json:"handshakeage,omitempty"`
+	// endpoint (ip:port) in use as of the last probe; wg only, as its
+	// endpoints may be failed over to one another
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// latency tracks probes of a proxy.
+type latency struct {
+	ewma    time.Duration
+	samples []time.Duration // oldest first
+	err     error           // of the last probe
+	at      time.Time       // of the last probe
+	hsage   time.Duration   // wg only
+	ep      string          // wg only
+}
+
+// prober periodically probes proxies of a proxifier.
+type prober struct {
+	sync.RWMutex                     // protects lat
+	lat          map[string]*latency // proxy id -> latencies
+	running      atomic.Bool         // probe loop is running
+	paused       atomic.Bool         // probes are paused
+	kickc        chan struct{}       // wakes up the probe loop
+}
+
+func newProber() *prober {
+	return &prober{
+		lat:   make(map[string]*latency),
+		kickc: make(chan struct{}, 1),
+	}
+}
+
+// record adds a sample d, or err, to the latencies of proxy id.
+func (pb *prober) record(id string, d time.Duration, hsage time.Duration, ep string, err error) {
+	pb.Lock()
+	defer pb.Unlock()
+
+	l := pb.lat[id]
+	if l == nil {
+		l = new(latency)
+		pb.lat[id] = l
+	}
+	l.at = time.Now()
+	l.err = err
+	l.hsage = hsage
+	l.ep = ep
+	if err != nil {
+		return
+	}
+	if len(l.samples) <= 0 {
+		l.ewma = d
+	} else {
+		l.ewma = time.Duration(probeWeight*float64(d) + (1-probeWeight)*float64(l.ewma))
+	}
+	l.samples = append(l.samples, d)
+	if n := len(l.samples); n > probeWindow {
+		l.samples = append(l.samples[:0], l.samples[n-probeWindow:]...)
+	}
+}
+
+// due returns true if proxy id has not been probed in a while.
+func (pb *prober) due(id string) bool {
+	pb.RLock()
+	defer pb.RUnlock()
+
+	l := pb.lat[id]
+	return l == nil || time.Since(l.at) >= probeMinGap
+}
+
+// okSince returns true if the last probe of proxy id succeeded after t.
+func (pb *prober) okSince(id string, t time.Time) bool {
+	pb.RLock()
+	defer pb.RUnlock()
+
+	l := pb.lat[id]
+	return l != nil && l.err == nil && l.at.After(t)
+}
+
+// forget drops latencies of proxy id; or of all proxies, if id is empty.
+func (pb *prober) forget(id string) {
+	pb.Lock()
+	defer pb.Unlock()
+
+	if len(id) <= 0 {
+		clear(pb.lat)
+	} else {
+		delete(pb.lat, id)
+	}
+}
+
+// all returns latencies of all probed proxies.
+func (pb *prober) all() map[string]ProxyLatency {
+	pb.RLock()
+	defer pb.RUnlock()
+
+	m := make(map[string]ProxyLatency, len(pb.lat))
+	for id, l := range pb.lat {
+		m[id] = l.export()
+	}
+	return m
+}
+
+func (l *latency) export() ProxyLatency {
+	v := ProxyLatency{
+		EWMA:         l.ewma.Milliseconds(),
+		Samples:      make([]int64, 0, len(l.samples)),
+		At:           l.at.UnixMilli(),
+		HandshakeAge: int64(l.hsage.Seconds()),
+		Endpoint:     l.ep,
+	}
+	for _, d := range l.samples {
+		v.Samples = append(v.Samples, d.Milliseconds())
+	}
+	if l.err != nil {
+		v.LastError = l.err.Error()
+	} else if n := len(l.samples); n > 0 {
+		v.Last = l.samples[n-1].Milliseconds()
+	}
+	return v
+}
+
+// kickProbes (re)starts the probe loop, unless paused, or wakes it up.
+func (px *proxifier) kickProbes() {
+	pb := px.pb
+	if pb.paused.Load() {
+		return
+	}
+	if pb.running.CompareAndSwap(false, true) {
+		go px.probeLoop()
+		return
+	}
+	select {
+	case pb.kickc <- struct{}{}:
+	default: // already kicked
+	}
+}
+
+// probeLoop probes all probe-able proxies every probeEvery; and exits
+// once paused, or once there are none left to probe.
+func (px *proxifier) probeLoop() {
+	pb := px.pb
+	t := time.NewTicker(probeEvery)
+	defer t.Stop()
+
+	for {
+		ps := px.probeable()
+		if pb.paused.Load() || len(ps) <= 0 {
+			break
+		}
+		for _, p := range ps {
+			if pb.due(p.ID()) {
+				px.measure(p)
+			}
+		}
+		// probes dial over proxies, which then go up (or down)
+		px.reevalKillSwitches()
+
+		select {
+		case <-t.C:
+		case <-pb.kickc:
+		}
+	}
+
+	pb.running.Store(false)
+	log.D("proxy: probe: loop done; paused? %t", pb.paused.Load())
+	// a kick may have raced with the loop's exit
+	select {
+	case <-pb.kickc:
+		px.kickProbes()
+	default:
+	}
+}
+
+// probeable returns proxies that may be probed; that is, those that
+// are not local and are not stopped.
+func (px *proxifier) probeable() []Proxy {
+	px.RLock()
+	defer px.RUnlock()
+
+	ps := make([]Proxy, 0, len(px.p))
+	for id, p := range px.p {
+		if local(id) || p.Status() == END {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// measure measures the latency of p over its own dialer, and records it.
+func (px *proxifier) measure(p Proxy) {
+	var d, hsage time.Duration
+	var ep string
+	var err error
+	if w, ok := p.(*wgproxy); ok {
+		hsage = wgHandshakeAge(w)
+		d, err = probePing(w)
+		ep = w.GetAddr()
+	} else {
+		d, err = probeTLS(p)
+	}
+	px.pb.record(p.ID(), d, hsage, ep, err)
+	log.V("proxy: probe: %s: %s; handshake %s ago; err? %v", p.ID(), d, hsage, err)
+}
+
+// probeTLS times a tcp connect and a tls handshake with the canary over p.
+func probeTLS(p Proxy) (time.Duration, error) {
+	start := time.Now()
+	c, err := p.Dial("tcp", probeCanary)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(start.Add(probeTimeout))
+	tc := tls.Client(c, &tls.Config{
+		ServerName: probeCanarySNI,
+		MinVersion: tls.VersionTLS12,
+	})
+	if err := tc.Handshake(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// probePing times an icmp echo to the canary from within w's tunnel.
+func probePing(w *wgproxy) (time.Duration, error) {
+	dst := probePing4
+	var req icmp.Type = ipv4.ICMPTypeEcho
+	var res icmp.Type = ipv4.ICMPTypeEchoReply
+	proto := 1 // icmp
+	if !w.hasV4 && w.hasV6 {
+		dst = probePing6
+		req, res = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = 58 // icmpv6
+	}
+
+	pc, err := w.DialPingAddr(netip.Addr{}, dst)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	seq := int(time.Now().UnixNano() & 0xffff)
+	msg, err := (&icmp.Message{
+		Type: req,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("firestack")},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	_ = pc.SetDeadline(start.Add(probeTimeout))
+	if _, err := pc.Write(msg); err != nil {
+		return 0, err
+	}
+	b := make([]byte, 1500)
+	for {
+		n, err := pc.Read(b)
+		if err != nil {
+			return 0, err
+		}
+		// the netstack sets the echo id; match on type and seq
+		if m, err := icmp.ParseMessage(proto, b[:n]); err == nil && m.Type == res {
+			if echo, ok := m.Body.(*icmp.Echo); ok && echo.Seq == seq {
+				return time.Since(start), nil
+			}
+		}
+		if time.Since(start) > probeTimeout {
+			return 0, errProbeNoReply
+		}
+	}
+}
+
+// wgHandshakeAge returns time since w's most recent handshake with any
+// peer; or zero, if it never completed one.
+func wgHandshakeAge(w *wgproxy) time.Duration {
+	cfg, err := w.IpcGet()
+	if err != nil {
+		return 0
+	}
+	var last int64
+	for _, line := range strings.Split(cfg, "\n") {
+		k, val, ok := strings.Cut(line, "=")
+		if !ok || k != "last_handshake_time_sec" {
+			continue
+		}
+		if secs, err := strconv.ParseInt(val, 10, 64); err == nil && secs > last {
+			last = secs
+		}
+	}
+	if last <= 0 {
+		return 0
+	}
+	return time.Since(time.Unix(last, 0))
+}
+
+// GetProxyLatencies implements x.Proxies.
+func (px *proxifier) GetProxyLatencies() string {
+	b, err := json.Marshal(px.pb.all())
+	if err != nil { // unlikely
+		log.W("proxy: probe: latencies: %v", err)
+		return "{}"
+	}
+	return string(b)
+}
+
+// PauseProxyProbes implements x.Proxies.
+func (px *proxifier) PauseProxyProbes(pause bool) {
+	pb := px.pb
+	pb.paused.Store(pause)
+	log.I("proxy: probe: paused? %t", pause)
+	if !pause {
+		px.kickProbes()
+		return
+	}
+	select { // wake up the probe loop, if running, to exit
+	case pb.kickc <- struct{}{}:
+	default:
+	}
+}
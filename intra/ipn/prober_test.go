@@ -0,0 +1,142 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// probeProxy is a statusProxy that dials all addrs to, and is up (TOK)
+// once a dial succeeds, as proxies are.
+type probeProxy struct {
+	*statusProxy
+	to    string
+	dials atomic.Int32
+}
+
+func (p *probeProxy) Dial(network, _ string) (protect.Conn, error) {
+	p.dials.Add(1)
+	c, err := net.Dial(network, p.to)
+	if err == nil {
+		p.st.Store(TOK)
+	}
+	return c, err
+}
+
+// hangup accepts conns and closes them right away.
+func hangup(tb testing.TB) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProberRecord(t *testing.T) {
+	pb := newProber()
+	const id = "s5"
+	if !pb.due(id) {
+		t.Error("probe: not due before any probe")
+	}
+
+	pb.record(id, 100*time.Millisecond, 0, "", nil)
+	pb.record(id, 200*time.Millisecond, 0, "", nil)
+	if pb.due(id) {
+		t.Error("probe: due right after a probe")
+	}
+	l := pb.all()[id]
+	if l.EWMA != 130 || l.Last != 200 || !slices.Equal(l.Samples, []int64{100, 200}) {
+		t.Errorf("probe: got ewma %d, last %d, samples %v; want 130, 200, [100 200]", l.EWMA, l.Last, l.Samples)
+	}
+	if !pb.okSince(id, time.Now().Add(-time.Second)) || pb.okSince(id, time.Now().Add(time.Second)) {
+		t.Error("probe: ok since")
+	}
+
+	// failures are noted, but are not samples
+	pb.record(id, 0, 0, "", errProbeNoReply)
+	l = pb.all()[id]
+	if l.Last != 0 || l.LastError != errProbeNoReply.Error() || len(l.Samples) != 2 || l.EWMA != 130 {
+		t.Errorf("probe: after a failure: %+v", l)
+	}
+	if pb.okSince(id, time.Time{}) {
+		t.Error("probe: ok after a failure")
+	}
+
+	// only the last few samples are kept
+	for i := range 2 * probeWindow {
+		pb.record(id, time.Duration(i)*time.Millisecond, 0, "", nil)
+	}
+	if l = pb.all()[id]; len(l.Samples) != probeWindow || l.Samples[0] != probeWindow {
+		t.Errorf("probe: samples %v; want the last %d", l.Samples, probeWindow)
+	}
+
+	pb.forget(id)
+	if len(pb.all()) != 0 || !pb.due(id) {
+		t.Error("probe: latencies not forgotten")
+	}
+}
+
+func TestProbeLoopLiftsKillSwitch(t *testing.T) {
+	const id = "s5"
+	p := &probeProxy{statusProxy: newStatusProxy(id, TKO), to: hangup(t)}
+	base := &probeProxy{statusProxy: newStatusProxy(Base, TOK), to: p.to}
+	px, l := newKillSwitchProxifier(p, base)
+
+	if err := px.SetKillSwitch(id, true); err != nil {
+		t.Fatal(err)
+	}
+	l.want(t, id, true)
+	if !px.KillSwitched(id) {
+		t.Fatal("killswitch: not engaged while the proxy is down")
+	}
+
+	// probes dial over the proxy, which brings it back up, and the kill
+	// switch is lifted without any flow let through
+	px.pb.paused.Store(false)
+	px.kickProbes()
+	l.want(t, id, false)
+	if px.KillSwitched(id) {
+		t.Error("killswitch: engaged after a probe brought the proxy up")
+	}
+	if n := p.dials.Load(); n != 1 {
+		t.Errorf("probe: %d dials over %s; want 1", n, id)
+	}
+	if n := base.dials.Load(); n != 0 {
+		t.Errorf("probe: %d dials over %s; local proxies are never probed", n, Base)
+	}
+	lat := px.pb.all()[id]
+	if lat.At <= 0 || len(lat.LastError) <= 0 { // no tls over a hangup
+		t.Errorf("probe: %s: %+v; want a failed probe", id, lat)
+	}
+
+	// probes stop once paused
+	px.PauseProxyProbes(true)
+	deadline := time.Now().Add(time.Second)
+	for px.pb.running.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if px.pb.running.Load() {
+		t.Error("probe: loop running while paused")
+	}
+}
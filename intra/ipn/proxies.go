@@ -7,13 +7,16 @@
 package ipn
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/celzero/firestack/intra/protect"
 )
@@ -22,6 +25,7 @@ const (
 	Block   = x.Block
 	Base    = x.Base
 	Exit    = x.Exit
+	Defer   = x.Defer
 	OrbotS5 = x.OrbotS5
 	OrbotH1 = x.OrbotH1
 
@@ -41,6 +45,10 @@ const (
 
 	// DNS addrs, urls, or stamps
 	nodns = "" // no DNS
+
+	// mtu of proxies that carry streams (and not packets), whose
+	// segments are sized by the os, and so, are never clamped
+	nomtu = 0
 )
 
 var (
@@ -63,9 +71,13 @@ var (
 const (
 	tlsHandshakeTimeout   time.Duration = 30 * time.Second // some proxies take a long time to handshake
 	responseHeaderTimeout time.Duration = 60 * time.Second
-	tzzTimeout            time.Duration = 2 * time.Minute // time between new connections before proxies transition to idle
+	tzzTimeout            time.Duration = 2 * time.Minute  // time between new connections before proxies transition to idle
+	refreshTimeout        time.Duration = 20 * time.Second // total time to wait on all proxies to refresh
 )
 
+// max proxies refreshed at once
+const maxRefreshers = 4
+
 // type checks
 var _ Proxy = (*base)(nil)
 var _ Proxy = (*exit)(nil)
@@ -100,13 +112,33 @@ type Proxies interface {
 	x.Proxies
 	// Get returns a transport from this multi-transport.
 	ProxyFor(id string) (Proxy, error)
+	// KillSwitched returns true if flows to proxy id must be blocked,
+	// as its kill switch is set and it is down (or missing).
+	KillSwitched(id string) bool
+	// NewProxy creates, but does not add, a proxy from its config txt.
+	NewProxy(id, txt string) (Proxy, error)
+	// AddAll adds ps (id -> proxy) along with their txts (id -> config),
+	// at once; proxies are replaced by those of the same id, if any.
+	AddAll(ps map[string]Proxy, txts map[string]string)
+	// Configs returns configs (id -> txt) of proxies added with AddProxy.
+	Configs() map[string]string
+	// KillSwitches returns ids of proxies with their kill switch set.
+	KillSwitches() []string
+	// SetKillSwitches sets the kill switch for ids, and unsets it for the rest.
+	SetKillSwitches(ids []string) error
 }
 
 type proxifier struct {
 	sync.RWMutex
 	p   map[string]Proxy
+	ks  *killswitch       // guarded by the embedded mutex
+	pb  *prober           // latencies of proxies
+	txt map[string]string // id -> config, as added; guarded by the embedded mutex
 	ctl protect.Controller
 	obs x.ProxyListener
+	gen core.Gen // of refreshes; see: refresh
+	stg *staged  // nil if not staging; guarded by the embedded mutex
+	sec *secrets // of proxies, as had from the client
 }
 
 type gw struct{ ok bool }
@@ -146,8 +178,12 @@ func NewProxifier(c protect.Controller, o x.ProxyListener) Proxies {
 
 	pxr := &proxifier{
 		p:   make(map[string]Proxy),
+		ks:  newKillSwitch(),
+		pb:  newProber(),
+		txt: make(map[string]string),
 		ctl: c,
 		obs: o,
+		sec: newSecrets(),
 	}
 	pxr.add(NewExitProxy(c))  // fixed
 	pxr.add(NewBaseProxy(c))  // fixed
@@ -161,15 +197,24 @@ func (px *proxifier) add(p Proxy) (ok bool) {
 	px.Lock()
 	defer px.Unlock()
 
+	return px.addLocked(p)
+}
+
+func (px *proxifier) addLocked(p Proxy) (ok bool) {
 	if pp := px.p[p.ID()]; pp != nil {
 		// new proxy, invoke Stop on old proxy
 		if pp != p {
 			go pp.Stop()
+			px.pb.forget(p.ID())
 		}
 	}
 
 	px.p[p.ID()] = p
 	go px.obs.OnProxyAdded(p.ID())
+	go px.reevalKillSwitches()
+	if !local(p.ID()) {
+		go px.kickProbes()
+	}
 	return true
 }
 
@@ -177,16 +222,54 @@ func (px *proxifier) RemoveProxy(id string) bool {
 	px.Lock()
 	defer px.Unlock()
 
+	if px.stg != nil {
+		_, live := px.p[id]
+		return px.stg.remove(id, live)
+	}
+	return px.removeLocked(id)
+}
+
+func (px *proxifier) removeLocked(id string) bool {
 	if p, ok := px.p[id]; ok {
 		go p.Stop()
 		delete(px.p, id)
+		delete(px.txt, id)
+		px.pb.forget(id)
+		px.sec.invalidate(id)
 		go px.obs.OnProxyRemoved(id)
+		go px.reevalKillSwitches()
 		log.I("proxy: removed %s", id)
 		return true
 	}
 	return false
 }
 
+// AddAll implements Proxies.
+func (px *proxifier) AddAll(ps map[string]Proxy, txts map[string]string) {
+	px.Lock()
+	defer px.Unlock()
+
+	for id, p := range ps {
+		px.addLocked(p)
+		px.txt[id] = txts[id]
+	}
+	log.I("proxy: added all %d", len(ps))
+}
+
+// Configs implements Proxies.
+func (px *proxifier) Configs() map[string]string {
+	px.RLock()
+	defer px.RUnlock()
+
+	c := make(map[string]string, len(px.txt))
+	for id, txt := range px.txt {
+		if _, ok := px.p[id]; ok {
+			c[id] = txt
+		}
+	}
+	return c
+}
+
 func (px *proxifier) ProxyFor(id string) (Proxy, error) {
 	if len(id) <= 0 {
 		return nil, errProxyNotFound
@@ -218,6 +301,9 @@ func (px *proxifier) StopProxies() error {
 		go p.Stop()
 	}
 	px.p = make(map[string]Proxy)
+	clear(px.txt)
+	px.pb.forget("")
+	px.sec.invalidate("")
 
 	go px.obs.OnProxiesStopped()
 	log.I("proxy: all(%d) stopped and removed", l)
@@ -225,18 +311,100 @@ func (px *proxifier) StopProxies() error {
 }
 
 func (px *proxifier) RefreshProxies() (string, error) {
-	px.Lock()
-	defer px.Unlock()
+	active, _, _ := px.refresh()
+	return active, nil
+}
+
+func (px *proxifier) RefreshProxiesReport() string {
+	active, rs, gen := px.refresh()
+	b, err := json.Marshal(x.RefreshReport{Active: active, Results: rs, Gen: int64(gen)})
+	if err != nil {
+		log.W("proxy: refresh report: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+func (px *proxifier) RefreshProxiesGens() string {
+	b, err := json.Marshal(x.RefreshGens{
+		Current:   int64(px.gen.Current()),
+		Completed: int64(px.gen.Completed()),
+	})
+	if err != nil {
+		log.W("proxy: refresh gens: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// GetProxySockMarks implements x.Proxies.
+func (px *proxifier) GetProxySockMarks() string {
+	px.RLock()
+	ids := make([]string, 0, len(px.p))
+	for id := range px.p {
+		ids = append(ids, id)
+	}
+	px.RUnlock()
+
+	if len(ids) <= 0 {
+		return "{}"
+	}
+	b, err := json.Marshal(protect.SockMarks(ids...))
+	if err != nil { // unlikely
+		log.W("proxy: sockmarks: %v", err)
+		return "{}"
+	}
+	return string(b)
+}
+
+// refresh refreshes all proxies, a few at a time, and returns a csv of
+// those that refreshed ok, the outcome for each, and its generation.
+// Proxies yet to be done when refreshTimeout is up are reported as timed
+// out; and those yet to be done once a newer refresh begins, as superseded.
+func (px *proxifier) refresh() (string, []x.RefreshResult, uint64) {
+	gen := px.gen.Next()
+	px.sec.invalidate("") // secrets may have been rotated
+
+	px.RLock()
+	ps := make(map[string]Proxy, len(px.p))
+	ids := make([]string, 0, len(px.p))
+	for id, p := range px.p {
+		ps[id] = p
+		ids = append(ids, id)
+	}
+	px.RUnlock()
+	slices.Sort(ids)
+
+	errs := core.FanOut(ids, maxRefreshers, refreshTimeout, func(id string) error {
+		if px.gen.Superseded(gen) {
+			return core.ErrSuperseded // left to the newer refresh
+		}
+		return ps[id].Refresh()
+	})
 
 	var active []string
-	for _, p := range px.p {
-		if err := p.Refresh(); err != nil {
-			log.E("proxy: refresh (%s/%s/%s) failed: %v", p.ID(), p.Type(), p.GetAddr(), err)
-			continue
+	rs := make([]x.RefreshResult, 0, len(ids))
+	for _, id := range ids {
+		err := errs[id]
+		r := x.RefreshResult{ID: id, OK: err == nil, Code: ErrCode(err)}
+		if err != nil {
+			p := ps[id]
+			log.E("proxy: refresh (%s/%s/%s) failed: %v", id, p.Type(), p.GetAddr(), err)
+			r.Err = err.Error()
+			if r.Code == x.ErrNone { // ex: io.EOF
+				r.Code = x.ErrUnknown
+			}
+		} else {
+			active = append(active, id)
 		}
-		active = append(active, p.ID())
+		rs = append(rs, r)
+	}
+	if px.gen.Done(gen) {
+		go px.reevalKillSwitches()
+	} else {
+		log.I("proxy: refresh #%d superseded by #%d", gen, px.gen.Current())
 	}
-	return strings.Join(active, ","), nil
+	return strings.Join(active, ","), rs, gen
 }
 
 // Implements Router.
@@ -291,7 +459,7 @@ func (px *proxifier) Contains(ipprefix string) bool {
 }
 
 func local(id string) bool {
-	return id == Base || id == Block || id == Exit
+	return id == Base || id == Block || id == Exit || id == Defer
 }
 
 func idling(t time.Time) bool {
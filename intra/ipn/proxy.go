@@ -24,10 +24,27 @@ func (pxr *proxifier) NewSocks5Proxy(id, user, pwd, ip, port string) (p Proxy, e
 }
 
 func (pxr *proxifier) AddProxy(id, txt string) (x.Proxy, error) {
+	if pxr.Staging() {
+		return pxr.stageProxy(id, txt)
+	}
 	return pxr.addProxy(id, txt)
 }
 
 func (pxr *proxifier) addProxy(id, txt string) (p Proxy, err error) {
+	cfg := txt // as-is; txt is modified by wg updates
+	// reject bad configs before touching any existing proxy
+	if err = validateProxy(id, txt).err(); err != nil {
+		log.W("proxy: add %s invalid; err: %v", id, err)
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			pxr.Lock()
+			pxr.txt[id] = cfg
+			pxr.Unlock()
+		}
+	}()
+
 	// wireguard proxies have IDs starting with "wg"
 	if strings.HasPrefix(id, WG) {
 		if p, _ = pxr.ProxyFor(id); p != nil {
@@ -42,7 +59,10 @@ func (pxr *proxifier) addProxy(id, txt string) (p Proxy, err error) {
 					log.V("proxy: updating wg(%s); ifaddrs(%v), dns(%v), mtu(%d)", id, ifaddrs, dnsh, mtu)
 				}
 
-				err1 := wgp.IpcSet(txt)
+				uapi, err1 := pxr.sec.inject(id, txt) // private_key may be held by the client
+				if err1 == nil {
+					err1 = wgp.IpcSet(uapi)
+				}
 				if err1 != nil {
 					log.W("proxy: err1 updating wg(%s); %v", id, err1)
 					return nil, err1
@@ -50,6 +70,14 @@ func (pxr *proxifier) addProxy(id, txt string) (p Proxy, err error) {
 					// sensitive log: peercfg contains private key
 					log.P("proxy: updating wg(%s) len(peercfg(%d))", id, len(txt))
 				}
+				if w, ok := wgp.(*wgproxy); ok {
+					w.key = nil
+					if hasWgSecretRef(txt) {
+						w.key = pxr.sec.fresh(id, SecretWgKey)
+					}
+				}
+				// endpoints of peers may have changed
+				wgp.failover(txt, pxr.obs)
 
 				err2 := wgp.Refresh()
 				if err2 != nil {
@@ -59,8 +87,36 @@ func (pxr *proxifier) addProxy(id, txt string) (p Proxy, err error) {
 				return
 			} // else: create anew
 		}
+	}
+
+	if p, err = pxr.NewProxy(id, txt); err != nil {
+		log.W("proxy: add %s/%s failed; err: %v", id, txt, err)
+		return nil, err
+	} else if ok := pxr.add(p); !ok {
+		_ = p.Stop() // unregistered
+		return nil, errAddProxy
+	}
+
+	log.I("proxy: added %s/%s/%s", p.ID(), p.Type(), p.GetAddr())
+	return
+}
+
+// NewProxy implements Proxies.
+func (pxr *proxifier) NewProxy(id, txt string) (p Proxy, err error) {
+	if strings.HasPrefix(id, WG) {
 		// txt is both wg ifconfig and peercfg
-		p, err = NewWgProxy(id, pxr.ctl, txt)
+		var uapi string
+		if uapi, err = pxr.sec.inject(id, txt); err != nil {
+			return nil, err
+		}
+		var w WgProxy
+		if w, err = NewWgProxy(id, pxr.ctl, uapi); err == nil {
+			if wgp, ok := w.(*wgproxy); ok && hasWgSecretRef(txt) {
+				wgp.key = pxr.sec.fresh(id, SecretWgKey)
+			}
+			w.failover(txt, pxr.obs)
+			p = w
+		}
 	} else {
 		var strurl string
 		var usr string
@@ -80,14 +136,18 @@ func (pxr *proxifier) addProxy(id, txt string) (p Proxy, err error) {
 		addrs := strings.Split(u.Fragment, ",")
 		// opts may be nil
 		opts := settings.NewAuthProxyOptions(u.Scheme, usr, pwd, strurl, u.Port(), addrs)
+		var sec secretfn // password held by the client, if any
+		if pwd == SecretRef {
+			sec = pxr.sec.of(id, SecretPassword)
+		}
 
 		switch u.Scheme {
 		case "socks5":
-			p, err = NewSocks5Proxy(id, pxr.ctl, opts)
+			p, err = newSocks5Proxy(id, pxr.ctl, opts, sec)
 		case "http":
 			fallthrough
 		case "https":
-			p, err = NewHTTPProxy(id, pxr.ctl, opts)
+			p, err = newHTTPProxy(id, pxr.ctl, opts, sec)
 		case "piph2":
 			p, err = NewPipProxy(id, pxr.ctl, opts)
 		case "pipws":
@@ -100,15 +160,10 @@ func (pxr *proxifier) addProxy(id, txt string) (p Proxy, err error) {
 	}
 
 	if err != nil {
-		log.W("proxy: add %s/%s failed; err: %v", id, txt, err)
 		return nil, err
 	} else if p == nil {
 		return nil, errAddProxy
-	} else if ok := pxr.add(p); !ok {
-		return nil, errAddProxy
 	}
-
-	log.I("proxy: added %s/%s/%s", p.ID(), p.Type(), p.GetAddr())
 	return
 }
 
@@ -0,0 +1,206 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	TSK = x.TSK
+
+	SecretRef      = x.SecretRef
+	SecretPassword = x.SecretPassword
+	SecretWgKey    = x.SecretWgKey
+
+	// secrets are cached for as long, so that dials do not each cross
+	// over to the client (over jni) for them
+	secretttl = 30 * time.Second
+	// failed lookups are cached for as long (ex: keystore locked)
+	secretfailttl = 5 * time.Second
+)
+
+var (
+	errNoSecretProvider = errors.New("proxy: no secret provider")
+	errNoSecret         = errors.New("proxy: secret unavailable")
+)
+
+// secretfn returns a secret, as had from x.SecretProvider.
+type secretfn func() (string, error)
+
+// secret is a cached lookup; done is closed once v is had.
+type secret struct {
+	done chan struct{}
+	v    string
+	exp  time.Time // zero while in flight
+}
+
+// secrets fetches secrets of proxies from x.SecretProvider, and caches them
+// briefly; concurrent lookups of the same secret share one fetch.
+type secrets struct {
+	sync.Mutex                    // protects p, m
+	p          x.SecretProvider   // may be nil
+	m          map[string]*secret // id/field -> secret
+}
+
+func newSecrets() *secrets {
+	return &secrets{m: make(map[string]*secret)}
+}
+
+func secretkey(id, field string) string {
+	return id + "/" + field
+}
+
+// set sets p as the provider, and drops cached secrets.
+func (s *secrets) set(p x.SecretProvider) {
+	s.Lock()
+	defer s.Unlock()
+	s.p = p
+	clear(s.m)
+}
+
+// get returns secret field of proxy id, from the cache, if not expired.
+func (s *secrets) get(id, field string) (string, error) {
+	k := secretkey(id, field)
+
+	s.Lock()
+	p := s.p
+	if c := s.m[k]; c != nil && (c.exp.IsZero() || time.Now().Before(c.exp)) {
+		s.Unlock()
+		<-c.done
+		return c.result(id, field)
+	}
+	if p == nil {
+		s.Unlock()
+		return "", errNoSecretProvider
+	}
+	c := &secret{done: make(chan struct{})}
+	s.m[k] = c
+	s.Unlock()
+
+	s.fetch(p, c, id, field)
+	return c.result(id, field)
+}
+
+// fetch fetches secret field of proxy id from p into c; c.done is closed
+// even if p panics, lest lookups waiting on c hang.
+func (s *secrets) fetch(p x.SecretProvider, c *secret, id, field string) {
+	var v string
+	defer func() {
+		ttl := secretttl
+		if len(v) <= 0 {
+			ttl = secretfailttl
+			log.W("proxy: secret: %s: %s unavailable", id, field)
+		}
+		s.Lock()
+		c.v = v
+		c.exp = time.Now().Add(ttl)
+		s.Unlock()
+		close(c.done)
+	}()
+
+	v = p.GetSecret(id, field) // crosses over to the client
+}
+
+func (c *secret) result(id, field string) (string, error) {
+	if len(c.v) <= 0 {
+		return "", fmt.Errorf("%w: %s of %s", errNoSecret, field, id)
+	}
+	return c.v, nil
+}
+
+// invalidate drops cached secrets of proxy id, or of all if id is empty.
+func (s *secrets) invalidate(id string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(id) <= 0 {
+		clear(s.m)
+		return
+	}
+	for k := range s.m {
+		if strings.HasPrefix(k, id+"/") {
+			delete(s.m, k)
+		}
+	}
+}
+
+// drop drops cached secret field of proxy id.
+func (s *secrets) drop(id, field string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, secretkey(id, field))
+}
+
+// of returns a secretfn for secret field of proxy id.
+func (s *secrets) of(id, field string) secretfn {
+	return func() (string, error) {
+		return s.get(id, field)
+	}
+}
+
+// fresh returns a secretfn for secret field of proxy id that drops it from
+// the cache before it is fetched; ex: as it may have been rotated since.
+func (s *secrets) fresh(id, field string) secretfn {
+	return func() (string, error) {
+		s.drop(id, field)
+		return s.get(id, field)
+	}
+}
+
+// hasWgSecretRef returns true if wg config txt has SecretRef as its private_key.
+func hasWgSecretRef(txt string) bool {
+	_, ok := wgSecretRefLine(txt)
+	return ok
+}
+
+// wgSecretRefLine returns the line in wg config txt with SecretRef as its
+// private_key, if any.
+func wgSecretRefLine(txt string) (string, bool) {
+	r := bufio.NewScanner(strings.NewReader(txt))
+	for r.Scan() {
+		k, v, ok := strings.Cut(r.Text(), "=")
+		if ok && strings.ToLower(strings.TrimSpace(k)) == SecretWgKey && strings.TrimSpace(v) == SecretRef {
+			return r.Text(), true
+		}
+	}
+	return "", false
+}
+
+// inject returns wg config txt of proxy id with its private_key, if it is
+// SecretRef, as had from the provider; txt as-is otherwise. The config
+// returned must only ever be passed on to the wg device.
+func (s *secrets) inject(id, txt string) (string, error) {
+	ref, ok := wgSecretRefLine(txt)
+	if !ok {
+		return txt, nil
+	}
+	key, err := s.get(id, SecretWgKey)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(txt, ref, SecretWgKey+"="+key, 1), nil
+}
+
+// SetSecretProvider implements x.Proxies.
+func (px *proxifier) SetSecretProvider(p x.SecretProvider) {
+	px.sec.set(p)
+	log.I("proxy: secret provider set? %t", p != nil)
+}
+
+// InvalidateSecrets implements x.Proxies.
+func (px *proxifier) InvalidateSecrets(id string) {
+	px.sec.invalidate(id)
+	log.I("proxy: secrets of %q invalidated", id)
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// testSecrets hands out secrets from v; its lookups wait on gate, if set,
+// and panic if panics is set.
+type testSecrets struct {
+	mu     sync.Mutex
+	v      map[string]string // id/field -> secret
+	n      atomic.Int32      // lookups
+	gate   chan struct{}
+	panics atomic.Bool
+}
+
+func newTestSecrets(kv ...string) *testSecrets {
+	p := &testSecrets{v: make(map[string]string)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		p.v[kv[i]] = kv[i+1]
+	}
+	return p
+}
+
+func (p *testSecrets) GetSecret(id, field string) string {
+	p.n.Add(1)
+	if p.gate != nil {
+		<-p.gate
+	}
+	if p.panics.Load() {
+		panic("keystore gone")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.v[secretkey(id, field)]
+}
+
+func (p *testSecrets) rotate(k, v string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.v[k] = v
+}
+
+func TestSecretsCache(t *testing.T) {
+	s := newSecrets()
+	if _, err := s.get("wg1", SecretWgKey); err != errNoSecretProvider {
+		t.Errorf("secrets: sans provider: err %v", err)
+	}
+
+	p := newTestSecrets("wg1/"+SecretWgKey, "k1", "socks5/"+SecretPassword, "p1")
+	s.set(p)
+	for range 3 {
+		if v, err := s.get("wg1", SecretWgKey); v != "k1" || err != nil {
+			t.Errorf("secrets: get: %q; err? %v", v, err)
+		}
+	}
+	if n := p.n.Load(); n != 1 {
+		t.Errorf("secrets: %d lookups of a cached secret; want 1", n)
+	}
+
+	// failed lookups are cached, too
+	for range 2 {
+		if _, err := s.get("wg2", SecretWgKey); !errors.Is(err, errNoSecret) {
+			t.Errorf("secrets: missing: err %v; want %v", err, errNoSecret)
+		}
+	}
+	if n := p.n.Load(); n != 2 {
+		t.Errorf("secrets: %d lookups after a failed one; want 2", n)
+	}
+
+	// expired secrets are fetched anew
+	s.Lock()
+	s.m[secretkey("wg1", SecretWgKey)].exp = time.Now().Add(-time.Second)
+	s.Unlock()
+	p.rotate("wg1/"+SecretWgKey, "k2")
+	if v, _ := s.get("wg1", SecretWgKey); v != "k2" {
+		t.Errorf("secrets: expired: %q; want k2", v)
+	}
+	if n := p.n.Load(); n != 3 {
+		t.Errorf("secrets: %d lookups after expiry; want 3", n)
+	}
+}
+
+func TestSecretsInvalidate(t *testing.T) {
+	p := newTestSecrets("wg1/"+SecretWgKey, "k1", "wg10/"+SecretWgKey, "k10", "socks5/"+SecretPassword, "p1")
+	s := newSecrets()
+	s.set(p)
+	get := func(id, field, want string) {
+		t.Helper()
+		if v, err := s.get(id, field); v != want || err != nil {
+			t.Errorf("secrets: %s: %q; want %q; err? %v", id, v, want, err)
+		}
+	}
+	get("wg1", SecretWgKey, "k1")
+	get("wg10", SecretWgKey, "k10")
+	get("socks5", SecretPassword, "p1")
+
+	p.rotate("wg1/"+SecretWgKey, "k2")
+	p.rotate("wg10/"+SecretWgKey, "k20")
+	s.invalidate("wg1")
+	get("wg1", SecretWgKey, "k2")
+	get("wg10", SecretWgKey, "k10") // not of wg1
+	if n := p.n.Load(); n != 4 {
+		t.Errorf("secrets: %d lookups; want 4", n)
+	}
+
+	s.invalidate("")
+	get("wg10", SecretWgKey, "k20")
+	get("socks5", SecretPassword, "p1")
+	if n := p.n.Load(); n != 6 {
+		t.Errorf("secrets: %d lookups; want 6", n)
+	}
+
+	// a new provider drops secrets of the previous one
+	s.set(newTestSecrets())
+	if _, err := s.get("socks5", SecretPassword); !errors.Is(err, errNoSecret) {
+		t.Errorf("secrets: new provider: err %v", err)
+	}
+}
+
+func TestSecretsFresh(t *testing.T) {
+	p := newTestSecrets("wg1/"+SecretWgKey, "k1")
+	s := newSecrets()
+	s.set(p)
+	cached, fresh := s.of("wg1", SecretWgKey), s.fresh("wg1", SecretWgKey)
+	if v, _ := cached(); v != "k1" {
+		t.Fatalf("secrets: of: %q", v)
+	}
+
+	p.rotate("wg1/"+SecretWgKey, "k2")
+	if v, _ := cached(); v != "k1" {
+		t.Errorf("secrets: of, once rotated: %q; want the cached k1", v)
+	}
+	if v, _ := fresh(); v != "k2" {
+		t.Errorf("secrets: fresh, once rotated: %q; want k2", v)
+	}
+	if v, _ := cached(); v != "k2" {
+		t.Errorf("secrets: of, once refetched: %q; want k2", v)
+	}
+	if n := p.n.Load(); n != 2 {
+		t.Errorf("secrets: %d lookups; want 2", n)
+	}
+}
+
+func TestSecretsDedup(t *testing.T) {
+	p := newTestSecrets("wg1/"+SecretWgKey, "k1")
+	p.gate = make(chan struct{})
+	s := newSecrets()
+	s.set(p)
+
+	const n = 8
+	vs := make(chan string, n)
+	for range n {
+		go func() {
+			v, _ := s.get("wg1", SecretWgKey)
+			vs <- v
+		}()
+	}
+	// all but the one fetching wait on it
+	for deadline := time.Now().Add(5 * time.Second); p.n.Load() < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("secrets: not fetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(p.gate)
+	for range n {
+		if v := <-vs; v != "k1" {
+			t.Errorf("secrets: dedup: %q; want k1", v)
+		}
+	}
+	if x := p.n.Load(); x != 1 {
+		t.Errorf("secrets: %d lookups of %d concurrent gets; want 1", x, n)
+	}
+}
+
+func TestSecretsProviderPanics(t *testing.T) {
+	p := newTestSecrets("wg1/"+SecretWgKey, "k1")
+	p.gate = make(chan struct{})
+	p.panics.Store(true)
+	s := newSecrets()
+	s.set(p)
+
+	recovered := make(chan any, 1)
+	go func() {
+		defer func() { recovered <- recover() }()
+		_, _ = s.get("wg1", SecretWgKey)
+	}()
+	for p.n.Load() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := s.get("wg1", SecretWgKey)
+		waiter <- err
+	}()
+	close(p.gate)
+
+	if r := <-recovered; r == nil {
+		t.Error("secrets: provider did not panic")
+	}
+	select {
+	case err := <-waiter:
+		if !errors.Is(err, errNoSecret) {
+			t.Errorf("secrets: waiter: err %v; want %v", err, errNoSecret)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("secrets: waiter hangs on a fetch that panicked")
+	}
+	if n := p.n.Load(); n != 1 {
+		t.Errorf("secrets: %d lookups; want 1", n)
+	}
+}
+
+func TestSecretsInject(t *testing.T) {
+	p := newTestSecrets("wg1/"+SecretWgKey, "k1")
+	s := newSecrets()
+	s.set(p)
+
+	plain := "private_key=aa\nlisten_port=0\n"
+	if got, err := s.inject("wg1", plain); got != plain || err != nil {
+		t.Errorf("secrets: inject sans ref: %q; err? %v", got, err)
+	}
+	if n := p.n.Load(); n != 0 {
+		t.Errorf("secrets: %d lookups sans ref", n)
+	}
+
+	ref := "listen_port=0\nprivate_key = " + SecretRef + "\npublic_key=ab\n"
+	want := "listen_port=0\nprivate_key=k1\npublic_key=ab\n"
+	if got, err := s.inject("wg1", ref); got != want || err != nil {
+		t.Errorf("secrets: inject: %q; want %q; err? %v", got, want, err)
+	}
+	if got, err := s.inject("wg2", ref); len(got) > 0 || !errors.Is(err, errNoSecret) {
+		t.Errorf("secrets: inject, unavailable: %q; err %v", got, err)
+	}
+}
+
+func TestSecretsTSK(t *testing.T) {
+	p := newTestSecrets()
+	s := newSecrets()
+	s.set(p)
+
+	opts := settings.NewAuthProxyOptions("http", "usr", SecretRef, "127.0.0.1", "1", nil)
+	px, err := newHTTPProxy("http1", nil, opts, s.of("http1", SecretPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := px.(*http1)
+
+	if _, err := h.Dial("tcp", "192.0.2.1:443"); !errors.Is(err, errNoSecret) {
+		t.Errorf("secrets: dial sans password: err %v", err)
+	}
+	if h.status != TSK {
+		t.Errorf("secrets: status %d sans password; want TSK", h.status)
+	}
+	if err := h.Refresh(); err == nil || h.status != TSK {
+		t.Errorf("secrets: refresh sans password: status %d; err? %v", h.status, err)
+	}
+
+	p.rotate("http1/"+SecretPassword, "pwd")
+	s.invalidate("http1")
+	if err := h.Refresh(); err != nil || h.status != TUP {
+		t.Errorf("secrets: refresh with password: status %d; want TUP; err? %v", h.status, err)
+	}
+}
@@ -34,6 +34,8 @@ type socks5 struct {
 	hc       *http.Client           // this transport as a http client
 	lastdial time.Time              // last time this transport attempted a connection
 	status   int                    // status of this transport
+	addrs    []netip.AddrPort       // of the upstream proxy
+	pwd      secretfn               // password, if held by the client; may be nil
 }
 
 type socks5tcpconn struct {
@@ -80,6 +82,12 @@ func (c *socks5udpconn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 }
 
 func NewSocks5Proxy(id string, ctl protect.Controller, po *settings.ProxyOptions) (Proxy, error) {
+	return newSocks5Proxy(id, ctl, po, nil)
+}
+
+// newSocks5Proxy is NewSocks5Proxy, but with the password, if pwd is not nil,
+// had from pwd as each conn is dialed, instead of from po.
+func newSocks5Proxy(id string, ctl protect.Controller, po *settings.ProxyOptions, pwd secretfn) (Proxy, error) {
 	var err error
 	if po == nil {
 		log.W("proxy: err setting up socks5(%v): %v", po, err)
@@ -93,23 +101,16 @@ func NewSocks5Proxy(id string, ctl protect.Controller, po *settings.ProxyOptions
 	mh := multihost.New(id)
 	mh.With([]string{po.Host, po.IP}) // resolves if ip is name
 
-	var clients []proxy.Dialer
-	// x.net.proxy doesn't yet support udp
-	// github.com/golang/net/blob/62affa334/internal/socks/socks.go#L233
-	// if po.Auth.User and po.Auth.Password are empty strings, the upstream
-	// socks5 server may throw err when dialing with golang/net/x/proxy;
-	// although, txthinking/socks5 deals gracefully with empty auth strings
-	// fproxy, err = proxy.SOCKS5("udp", po.IPPort, po.Auth, proxy.Direct)
+	var addrs []netip.AddrPort
 	for _, ip := range mh.Addrs() {
-		ipport := netip.AddrPortFrom(ip, uint16(portnumber))
-		c, cerr := tx.NewClient(ipport.String(), po.Auth.User, po.Auth.Password, tcptimeoutsec, udptimeoutsec)
-		if cerr != nil {
-			err = errors.Join(err, cerr)
-		} else {
-			clients = append(clients, c)
-		}
+		addrs = append(addrs, netip.AddrPortFrom(ip, uint16(portnumber)))
 	}
 
+	var clients []proxy.Dialer
+	if pwd == nil {
+		clients, err = socks5clients(addrs, po.Auth.User, po.Auth.Password)
+	} // else: clients are made as conns are dialed; see: Dial
+
 	if len(clients) == 0 && err != nil {
 		log.W("proxy: err creating socks5 for %v (opts: %v): %v", mh, po, err)
 		return nil, err
@@ -119,6 +120,8 @@ func NewSocks5Proxy(id string, ctl protect.Controller, po *settings.ProxyOptions
 		outbound: clients,
 		id:       id,
 		opts:     po,
+		addrs:    addrs,
+		pwd:      pwd,
 	}
 	h.rd = newRDial(h)
 	h.hc = newHTTP1Client(h.rd)
@@ -128,16 +131,59 @@ func NewSocks5Proxy(id string, ctl protect.Controller, po *settings.ProxyOptions
 	return h, nil
 }
 
+// socks5clients returns a client for each of addrs, authenticating as usr
+// with pwd.
+func socks5clients(addrs []netip.AddrPort, usr, pwd string) (clients []proxy.Dialer, err error) {
+	// x.net.proxy doesn't yet support udp
+	// github.com/golang/net/blob/62affa334/internal/socks/socks.go#L233
+	// if po.Auth.User and po.Auth.Password are empty strings, the upstream
+	// socks5 server may throw err when dialing with golang/net/x/proxy;
+	// although, txthinking/socks5 deals gracefully with empty auth strings
+	// fproxy, err = proxy.SOCKS5("udp", po.IPPort, po.Auth, proxy.Direct)
+	for _, ipport := range addrs {
+		c, cerr := tx.NewClient(ipport.String(), usr, pwd, tcptimeoutsec, udptimeoutsec)
+		if cerr != nil {
+			err = errors.Join(err, cerr)
+		} else {
+			clients = append(clients, c)
+		}
+	}
+	return
+}
+
+// clients returns clients to dial with; made anew if the password is had
+// from the client, which is never retained.
+func (h *socks5) clients() ([]proxy.Dialer, error) {
+	if h.pwd == nil {
+		return h.outbound, nil
+	}
+	pwd, err := h.pwd()
+	if err != nil {
+		h.status = TSK
+		return nil, err
+	}
+	return socks5clients(h.addrs, h.opts.Auth.User, pwd)
+}
+
 // Dial implements Proxy.
 func (h *socks5) Dial(network, addr string) (c protect.Conn, err error) {
 	if h.status == END {
 		return nil, errProxyStopped
 	}
 
+	outbound, err := h.clients()
+	if len(outbound) <= 0 {
+		log.W("proxy: socks5: %s dial(%s) no clients for %s; err? %v", h.ID(), network, addr, err)
+		if err == nil {
+			err = errNoProxyConn
+		}
+		return nil, err
+	}
+
 	h.lastdial = time.Now()
 	// todo: tx.Client can only dial in to ip:port and not host:port even for server addr
 	// tx.Client.Dial does not support dialing into client addr as hostnames
-	if c, err = dialers.ProxyDials(h.outbound, network, addr); err == nil {
+	if c, err = dialers.ProxyDials(outbound, network, addr); err == nil {
 		// github.com/txthinking/socks5/blob/39268fae/client.go#L15
 		if uc, ok := c.(*tx.Client); ok {
 			if uc.UDPConn != nil { // a udp conn will always have an embedded tcp conn
@@ -180,6 +226,10 @@ func (h *socks5) DNS() string {
 	return nodns
 }
 
+func (h *socks5) MTU() (int, error) {
+	return nomtu, nil
+}
+
 func (h *socks5) fetch(req *http.Request) (*http.Response, error) {
 	stopped := h.status == END
 	log.V("proxy: socks5: %s; fetch(%s); ended? %t", h.id, req.URL, stopped)
@@ -206,7 +256,7 @@ func (h *socks5) GetAddr() string {
 }
 
 func (h *socks5) Status() int {
-	if h.status != END && idling(h.lastdial) {
+	if h.status != END && h.status != TSK && idling(h.lastdial) {
 		return TZZ
 	}
 	return h.status
@@ -218,4 +268,17 @@ func (h *socks5) Stop() error {
 	return nil
 }
 
-func (h *socks5) Refresh() error { return nil }
+func (h *socks5) Refresh() error {
+	if h.pwd == nil || h.status == END {
+		return nil
+	}
+	// the password may have been rotated by the client
+	if _, err := h.pwd(); err != nil {
+		h.status = TSK
+		return err
+	}
+	if h.status == TSK {
+		h.status = TUP
+	}
+	return nil
+}
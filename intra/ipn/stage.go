@@ -0,0 +1,151 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"errors"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+)
+
+var (
+	errStaging    = errors.New("proxy: already staging")
+	errNotStaging = errors.New("proxy: not staging")
+)
+
+// Stager is Proxies whose proxy changes may be staged, and then applied
+// all at once, or discarded.
+type Stager interface {
+	// Stage has AddProxy and RemoveProxy stage changes from here on,
+	// instead of applying them, till Commit or Discard; errs if already
+	// staging. Proxies are made as they are staged (and are stopped, if
+	// discarded); wireguard proxies are made anew, not updated in place.
+	Stage() error
+	// Commit applies staged changes at once, and stops staging: proxies
+	// are added (or replaced) and removed as staged last. Errs if not
+	// staging.
+	Commit() error
+	// Discard stops proxies staged, drops staged changes, and stops
+	// staging; no-op if not staging.
+	Discard()
+	// Staging returns true if changes are being staged; if so, Commit
+	// does not err.
+	Staging() bool
+}
+
+var _ Stager = (*proxifier)(nil)
+
+// staged are proxy changes, by id; nil for those removed.
+type staged struct {
+	ps   map[string]Proxy
+	txts map[string]string // id -> config of ps
+}
+
+// Implements Stager
+func (px *proxifier) Stage() error {
+	px.Lock()
+	defer px.Unlock()
+	if px.stg != nil {
+		return errStaging
+	}
+	px.stg = &staged{ps: make(map[string]Proxy), txts: make(map[string]string)}
+	log.I("proxy: stage: begin")
+	return nil
+}
+
+// Implements Stager
+func (px *proxifier) Commit() error {
+	px.Lock()
+	defer px.Unlock()
+
+	stg := px.stg
+	if stg == nil {
+		return errNotStaging
+	}
+	px.stg = nil
+	added, removed := 0, 0
+	for id, p := range stg.ps {
+		if p == nil {
+			if px.removeLocked(id) {
+				removed++
+			}
+		} else {
+			px.addLocked(p)
+			px.txt[id] = stg.txts[id]
+			added++
+		}
+	}
+	log.I("proxy: stage: commit; %d added, %d removed", added, removed)
+	return nil
+}
+
+// Implements Stager
+func (px *proxifier) Discard() {
+	px.Lock()
+	stg := px.stg
+	px.stg = nil
+	px.Unlock()
+
+	if stg == nil {
+		return
+	}
+	for _, p := range stg.ps {
+		if p != nil {
+			go p.Stop()
+		}
+	}
+	log.I("proxy: stage: discard %d", len(stg.ps))
+}
+
+// Implements Stager
+func (px *proxifier) Staging() bool {
+	px.RLock()
+	defer px.RUnlock()
+	return px.stg != nil
+}
+
+// stageProxy makes proxy id from txt, and stages it; see: AddProxy
+func (px *proxifier) stageProxy(id, txt string) (x.Proxy, error) {
+	if err := validateProxy(id, txt).err(); err != nil {
+		log.W("proxy: stage %s invalid; err: %v", id, err)
+		return nil, err
+	}
+	p, err := px.NewProxy(id, txt)
+	if err != nil {
+		return nil, err
+	}
+
+	px.Lock()
+	defer px.Unlock()
+	if px.stg == nil { // committed or discarded since
+		go p.Stop()
+		return nil, errNotStaging
+	}
+	if prev := px.stg.ps[id]; prev != nil {
+		go prev.Stop()
+	}
+	px.stg.ps[id] = p
+	px.stg.txts[id] = txt
+	return p, nil
+}
+
+// remove stages the removal of id; returns true if it is live (as per
+// live) or staged. Proxies staged before are stopped.
+func (stg *staged) remove(id string, live bool) bool {
+	p, ok := stg.ps[id]
+	if p != nil {
+		go p.Stop()
+	}
+	if live {
+		stg.ps[id] = nil
+	} else {
+		delete(stg.ps, id) // never added
+	}
+	delete(stg.txts, id)
+	return live || (ok && p != nil)
+}
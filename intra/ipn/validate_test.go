@@ -0,0 +1,126 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	wgtestkey  = strings.Repeat("ab", wgkeylen)
+	wgtestkey2 = strings.Repeat("cd", wgkeylen)
+)
+
+func wgtestcfg(lines ...string) string {
+	cfg := []string{
+		"address=10.0.0.2/32,fd00::2/128",
+		"dns=1.1.1.1",
+		"mtu=1280",
+		"private_key=" + wgtestkey,
+		"public_key=" + wgtestkey2,
+	}
+	return strings.Join(append(cfg, lines...), "\n") + "\n"
+}
+
+// problems returns fields with problems in v, in order.
+func problems(v *ProxyValidation) string {
+	var fields []string
+	for _, p := range v.Problems {
+		fields = append(fields, p.Field)
+	}
+	return strings.Join(fields, ",")
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		id, txt string
+		want    string // fields with problems
+	}{
+		{"s5", "socks5://u:p@example.test:1080", ""},
+		{"s5", "socks5://192.0.2.1", ""},  // no port, as NewSocks5Proxy
+		{"s5", "socks5://:1080", ""},      // wildcard addr
+		{"h1", "http://example.test", ""}, // no port
+		{"h1", "HTTPS://example.test:8443/", ""},
+		{"p2", "piph2://example.test/h2/sig", ""},
+		{"p2", "piph2://example.test/h3/sig/more", ""},
+		{"pw", "pipws://example.test/ws/sig", ""},
+		{"s5", "socks5://", "host"},
+		{"s5", "socks5://example.test:0", "port"},
+		{"s5", "socks5://example.test:70000", "port"},
+		{"h1", "example.test:8080", "scheme"},
+		{"h1", "ftp://example.test", "scheme"},
+		{"h1", "wg://example.test", "id"},
+		{"p2", "piph2://example.test/ws/sig", "path"},
+		{"p2", "piph2://example.test/h2", "path"},
+		{"pw", "pipws://example.test/ws/", "path"},
+		{"", "http://example.test", "id"},
+		{Base, "http://example.test", "id"},
+		{"h1", "", "config"},
+	}
+	for _, tc := range tests {
+		v := validateProxy(tc.id, tc.txt)
+		if got := problems(v); got != tc.want {
+			t.Errorf("validate: %s %q: problems %q; want %q", tc.id, tc.txt, got, tc.want)
+		}
+		if v.OK != (len(tc.want) <= 0) {
+			t.Errorf("validate: %s %q: ok? %t", tc.id, tc.txt, v.OK)
+		}
+	}
+}
+
+func TestValidateWg(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString(make([]byte, wgkeylen))
+	tests := []struct {
+		name string
+		txt  string
+		want string // fields with problems
+	}{
+		{"ok", wgtestcfg(), ""},
+		{"ip:port", wgtestcfg("endpoint=192.0.2.1:51820"), ""},
+		{"host:port", wgtestcfg("endpoint=wg.example.test:51820"), ""},
+		{"[ip6]:port", wgtestcfg("endpoint=[2001:db8::1]:51820"), ""},
+		{"ip", wgtestcfg("endpoint=192.0.2.1"), ""},
+		{"host", wgtestcfg("endpoint=wg.example.test"), ""},
+		{"ip6", wgtestcfg("endpoint=2001:db8::1"), ""},
+		{"csv", wgtestcfg("endpoint=192.0.2.1:51820, wg.example.test,"), ""},
+		{"upper", strings.ToUpper(wgtestcfg()), ""},
+		{"secret ref", strings.Replace(wgtestcfg(), wgtestkey, SecretRef, 1), ""},
+		{"ends at blank", wgtestcfg() + "\nnot a line\n", ""},
+		{"port range", wgtestcfg("endpoint=192.0.2.1:0"), "endpoint"},
+		{"bad ip6", wgtestcfg("endpoint=2001:db8::zz"), "endpoint"},
+		{"no host", wgtestcfg("endpoint=:51820"), "endpoint"},
+		{"ep sans peer", "endpoint=192.0.2.1:51820\n" + wgtestcfg(), "endpoint"},
+		{"base64 key", wgtestcfg("preshared_key=" + b64), "preshared_key"},
+		{"short key", wgtestcfg("preshared_key=" + hex.EncodeToString(make([]byte, 16))), "preshared_key"},
+		{"bad allowed_ip", wgtestcfg("allowed_ip=0.0.0.0/99"), "allowed_ip"},
+		{"not kv", wgtestcfg("nope"), "line"},
+		{"missing", "mtu=x\n", "mtu,address,dns,private_key,public_key"},
+	}
+	for _, tc := range tests {
+		v := validateProxy(WG+"1", tc.txt)
+		if got := problems(v); got != tc.want {
+			t.Errorf("validate: wg: %s: problems %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateErr(t *testing.T) {
+	if err := validateProxy("s5", "socks5://example.test").err(); err != nil {
+		t.Errorf("validate: ok config: err %v", err)
+	}
+	err := validateProxy("s5", "ftp://example.test").err()
+	if !errors.Is(err, errProxyConfig) {
+		t.Fatalf("validate: want %v, got %v", errProxyConfig, err)
+	}
+	if !strings.Contains(err.Error(), `"field":"scheme"`) {
+		t.Errorf("validate: err sans problems: %s", err)
+	}
+}
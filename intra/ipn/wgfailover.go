@@ -0,0 +1,323 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"bufio"
+	"cmp"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/dialers"
+	"github.com/celzero/firestack/intra/ipn/multihost"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// endpoints of peers are checked this often
+	wgFailoverEvery = 15 * time.Second
+	// wg discards session keys this old (reject-after-time); a peer that
+	// is sent to, but has not handshaked in as long, is not reachable
+	wgStaleHandshake = 3 * time.Minute
+	// a peer that is sent to, but not heard from in as long, has stalled
+	wgRxStall = 30 * time.Second
+	// bytes sent before a peer is considered stalled; more than a few
+	// persistent keepalives, which peers do not respond to
+	wgRxStallBytes = 1024
+	// endpoints of a peer are switched at most this often
+	wgSwitchMinGap = 2 * time.Minute
+	// endpoints switched away from are tried last for as long
+	wgBadFor = 10 * time.Minute
+)
+
+// reasons endpoints are switched; see: x.ProxyListener
+const (
+	wgSwitchStaleHandshake = "stale-handshake"
+	wgSwitchRxStall        = "rx-stall"
+)
+
+// wgpeer tracks a peer with more than one endpoint.
+type wgpeer struct {
+	pk        string                       // public key, hex
+	endpoints []string                     // host:port, as configured
+	cur       netip.AddrPort               // in use; may be invalid
+	rx, tx    uint64                       // bytes, as of the last check
+	txSince   time.Time                    // sends began with no rx since; zero if none
+	txAt      uint64                       // tx as of txSince
+	switched  time.Time                    // of the last switch
+	bad       map[netip.AddrPort]time.Time // endpoints switched away from
+}
+
+// wgpeerstat is the state of a peer as reported by the wg device.
+type wgpeerstat struct {
+	endpoint netip.AddrPort
+	hs       time.Time // last handshake; zero if never
+	rx, tx   uint64
+}
+
+// wgfailover switches endpoints of peers of w (those with more than one)
+// as they degrade, without touching the device or its flows.
+type wgfailover struct {
+	w     *wgproxy
+	obs   x.ProxyListener    // may be nil
+	peers map[string]*wgpeer // public key -> peer; only touched by run
+	done  chan struct{}
+	once  sync.Once
+
+	mu    sync.Mutex     // protects inuse
+	inuse netip.AddrPort // endpoint switched to last; may be invalid
+}
+
+// failover (re)starts endpoint failover for peers in txt (a wg config)
+// that have more than one endpoint; stops it if there are none.
+func (w *wgproxy) failover(txt string, obs x.ProxyListener) {
+	peers := make(map[string]*wgpeer)
+	for pk, eps := range wgPeerEndpoints(txt) {
+		if len(eps) > 1 {
+			peers[pk] = &wgpeer{pk: pk, endpoints: eps, bad: make(map[netip.AddrPort]time.Time)}
+		}
+	}
+	var f *wgfailover
+	if len(peers) > 0 {
+		f = &wgfailover{w: w, obs: obs, done: make(chan struct{}), peers: peers}
+	}
+	if prev := w.fo.Swap(f); prev != nil {
+		prev.stop()
+	}
+	if f != nil {
+		go f.run()
+	}
+	log.I("proxy: wg: %s failover: peers %d", w.id, len(peers))
+}
+
+// endpoint returns the endpoint switched to last, if any.
+func (f *wgfailover) endpoint() netip.AddrPort {
+	if f == nil {
+		return netip.AddrPort{}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inuse
+}
+
+func (f *wgfailover) stop() {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() { close(f.done) })
+}
+
+func (f *wgfailover) run() {
+	t := time.NewTicker(wgFailoverEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+		}
+		if f.w.status == END {
+			f.stop()
+			return
+		}
+		f.check()
+	}
+}
+
+// check switches endpoints of peers that degraded since the last check.
+func (f *wgfailover) check() {
+	cfg, err := f.w.IpcGet()
+	if err != nil {
+		log.W("proxy: wg: %s failover: ipc-get: %v", f.w.id, err)
+		return
+	}
+	stats := wgPeerStats(cfg)
+	now := time.Now()
+
+	for pk, p := range f.peers {
+		st, ok := stats[pk]
+		if !ok {
+			continue
+		}
+		why := p.degraded(st, now)
+		if len(why) <= 0 || now.Sub(p.switched) < wgSwitchMinGap {
+			continue
+		}
+		from := p.cur
+		to, ok := p.next(now)
+		if !ok {
+			log.W("proxy: wg: %s failover: %s: %s; no other endpoint", f.w.id, pk, why)
+			continue
+		}
+		if err := f.w.IpcSet("public_key=" + pk + "\nupdate_only=true\nendpoint=" + to.String() + "\n"); err != nil {
+			log.W("proxy: wg: %s failover: %s: %s => %s; err: %v", f.w.id, pk, from, to, err)
+			continue
+		}
+		if from.IsValid() {
+			p.bad[from] = now
+		}
+		p.cur, p.switched = to, now
+		p.txSince = time.Time{}
+		f.mu.Lock()
+		f.inuse = to
+		f.mu.Unlock()
+		log.I("proxy: wg: %s failover: %s: %s => %s; %s", f.w.id, pk, from, to, why)
+		if f.obs != nil {
+			go f.obs.OnProxyEndpointChanged(f.w.id, from.String(), to.String(), why)
+		}
+	}
+}
+
+// degraded returns why p's current endpoint degraded, if it did.
+func (p *wgpeer) degraded(st wgpeerstat, now time.Time) (why string) {
+	if st.endpoint.IsValid() {
+		p.cur = st.endpoint
+	}
+	if st.rx != p.rx {
+		p.txSince = time.Time{}
+	} else if st.tx != p.tx && p.txSince.IsZero() {
+		p.txSince, p.txAt = now, p.tx
+	}
+	p.rx, p.tx = st.rx, st.tx
+
+	if p.txSince.IsZero() || now.Sub(p.txSince) < wgRxStall {
+		return // idle, or heard from
+	}
+	if st.hs.IsZero() || now.Sub(st.hs) > wgStaleHandshake {
+		return wgSwitchStaleHandshake
+	}
+	if st.tx-p.txAt >= wgRxStallBytes {
+		return wgSwitchRxStall
+	}
+	return
+}
+
+// next returns the endpoint to switch p to: those with lower connect
+// times (as measured by dialers) first, then those not measured, in the
+// order configured; and those switched away from recently, last.
+func (p *wgpeer) next(now time.Time) (netip.AddrPort, bool) {
+	var all []netip.AddrPort
+	for _, ep := range p.endpoints {
+		for _, ipp := range resolveEndpoint(ep) {
+			if ipp != p.cur && !slices.Contains(all, ipp) {
+				all = append(all, ipp)
+			}
+		}
+	}
+	if len(all) <= 0 {
+		return netip.AddrPort{}, false
+	}
+	bad := func(ipp netip.AddrPort) bool {
+		at, ok := p.bad[ipp]
+		return ok && now.Sub(at) < wgBadFor
+	}
+	slices.SortStableFunc(all, func(a, b netip.AddrPort) int {
+		if ba, bb := bad(a), bad(b); ba != bb {
+			if ba {
+				return 1
+			}
+			return -1
+		}
+		da, oka := dialers.RTT(a.Addr())
+		db, okb := dialers.RTT(b.Addr())
+		switch {
+		case oka && okb:
+			return cmp.Compare(da, db)
+		case oka:
+			return -1
+		case okb:
+			return 1
+		}
+		return 0
+	})
+	return all[0], true
+}
+
+// resolveEndpoint returns ip:ports of ep, a host:port or ip:port.
+func resolveEndpoint(ep string) (out []netip.AddrPort) {
+	host, portstr, err := net.SplitHostPort(ep)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return
+	}
+	mh := multihost.New("failover[" + ep + "]")
+	mh.With([]string{host}) // resolves host if needed
+	for _, ip := range mh.Addrs() {
+		if ip.IsValid() && !ip.IsUnspecified() {
+			out = append(out, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+		}
+	}
+	return
+}
+
+// wgPeerEndpoints returns endpoints (host:port) of each peer (public key,
+// hex) in txt, in the order configured.
+func wgPeerEndpoints(txt string) map[string][]string {
+	m := make(map[string][]string)
+	var pk string
+	r := bufio.NewScanner(strings.NewReader(txt))
+	for r.Scan() {
+		k, v, ok := strings.Cut(r.Text(), "=")
+		if !ok {
+			continue
+		}
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		switch k {
+		case "public_key":
+			pk = strings.ToLower(v)
+		case "endpoint": // may exist more than once
+			if len(pk) > 0 && len(v) > 0 && !slices.Contains(m[pk], v) {
+				m[pk] = append(m[pk], v)
+			}
+		}
+	}
+	return m
+}
+
+// wgPeerStats returns stats of each peer (public key, hex) in cfg, as
+// returned by IpcGet.
+func wgPeerStats(cfg string) map[string]wgpeerstat {
+	m := make(map[string]wgpeerstat)
+	var pk string
+	var st wgpeerstat
+	for _, line := range strings.Split(cfg, "\n") {
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "public_key":
+			if len(pk) > 0 {
+				m[pk] = st
+			}
+			pk, st = v, wgpeerstat{}
+		case "endpoint":
+			st.endpoint, _ = netip.ParseAddrPort(v)
+		case "last_handshake_time_sec":
+			if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs > 0 {
+				st.hs = time.Unix(secs, 0)
+			}
+		case "rx_bytes":
+			st.rx, _ = strconv.ParseUint(v, 10, 64)
+		case "tx_bytes":
+			st.tx, _ = strconv.ParseUint(v, 10, 64)
+		}
+	}
+	if len(pk) > 0 {
+		m[pk] = st
+	}
+	return m
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipn
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWgPeerEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		txt  string
+		want map[string][]string
+	}{
+		{"none", "private_key=aa\nlisten_port=0\n", map[string][]string{}},
+		{"one", "public_key=AB\nendpoint=192.0.2.1:51820\n", map[string][]string{
+			"ab": {"192.0.2.1:51820"},
+		}},
+		{"many, in order, sans dups", "public_key=ab\nendpoint = b.test:1\nendpoint=192.0.2.1:2\nendpoint=b.test:1\n", map[string][]string{
+			"ab": {"b.test:1", "192.0.2.1:2"},
+		}},
+		{"per peer", "public_key=ab\nendpoint=192.0.2.1:1\npublic_key=cd\nallowed_ip=0.0.0.0/0\nEndpoint=[2001:db8::1]:2\n", map[string][]string{
+			"ab": {"192.0.2.1:1"},
+			"cd": {"[2001:db8::1]:2"},
+		}},
+		{"sans a peer", "endpoint=192.0.2.1:1\npublic_key=ab\nendpoint=\n", map[string][]string{}},
+	}
+	for _, tc := range tests {
+		if got := wgPeerEndpoints(tc.txt); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("failover: %s: endpoints %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWgPeerStats(t *testing.T) {
+	ep := netip.MustParseAddrPort("192.0.2.1:51820")
+	tests := []struct {
+		name string
+		cfg  string
+		want map[string]wgpeerstat
+	}{
+		{"none", "private_key=aa\nlisten_port=1\n", map[string]wgpeerstat{}},
+		{"one", "public_key=ab\nendpoint=192.0.2.1:51820\nlast_handshake_time_sec=100\nrx_bytes=1\ntx_bytes=2\n", map[string]wgpeerstat{
+			"ab": {endpoint: ep, hs: time.Unix(100, 0), rx: 1, tx: 2},
+		}},
+		{"never handshaked", "public_key=ab\nlast_handshake_time_sec=0\ntx_bytes=2\n", map[string]wgpeerstat{
+			"ab": {tx: 2},
+		}},
+		{"per peer", "public_key=ab\nrx_bytes=1\npublic_key=cd\nendpoint=192.0.2.1:51820\ntx_bytes=3\nerrno=0\n", map[string]wgpeerstat{
+			"ab": {rx: 1},
+			"cd": {endpoint: ep, tx: 3},
+		}},
+		{"bad values", "public_key=ab\nendpoint=b.test:1\nrx_bytes=x\n", map[string]wgpeerstat{
+			"ab": {},
+		}},
+	}
+	for _, tc := range tests {
+		if got := wgPeerStats(tc.cfg); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("failover: %s: stats %+v; want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWgPeerDegraded(t *testing.T) {
+	ep := netip.MustParseAddrPort("192.0.2.1:51820")
+	t0 := time.Unix(1_000_000, 0)
+	hs := t0.Add(-time.Minute)
+	later := t0.Add(wgRxStall + time.Second)
+	type check struct {
+		at   time.Time
+		st   wgpeerstat
+		want string
+	}
+	tests := []struct {
+		name   string
+		checks []check
+	}{
+		{"idle", []check{
+			{t0, wgpeerstat{endpoint: ep, hs: hs, rx: 10, tx: 10}, ""},
+			{later, wgpeerstat{endpoint: ep, hs: hs, rx: 10, tx: 10}, ""},
+		}},
+		{"heard from", []check{
+			{t0, wgpeerstat{hs: hs, rx: 10, tx: 10}, ""},
+			{t0.Add(time.Second), wgpeerstat{hs: hs, rx: 10, tx: 5000}, ""},
+			{later, wgpeerstat{hs: hs, rx: 20, tx: 9000}, ""},
+		}},
+		{"sent to, not for long", []check{
+			{t0, wgpeerstat{hs: hs, rx: 10, tx: 10}, ""},
+			{t0.Add(time.Second), wgpeerstat{hs: hs, rx: 10, tx: 5000}, ""},
+			{t0.Add(wgRxStall / 2), wgpeerstat{hs: hs, rx: 10, tx: 9000}, ""},
+		}},
+		{"rx stall", []check{
+			{t0, wgpeerstat{hs: hs, rx: 10, tx: 10}, ""},
+			{t0.Add(time.Second), wgpeerstat{hs: hs, rx: 10, tx: 20}, ""},
+			{later, wgpeerstat{hs: hs, rx: 10, tx: 20 + wgRxStallBytes}, wgSwitchRxStall},
+		}},
+		{"keepalives only", []check{
+			{t0, wgpeerstat{hs: hs, rx: 10, tx: 10}, ""},
+			{t0.Add(time.Second), wgpeerstat{hs: hs, rx: 10, tx: 42}, ""},
+			{later, wgpeerstat{hs: hs, rx: 10, tx: 74}, ""},
+		}},
+		{"stale handshake", []check{
+			{t0, wgpeerstat{hs: hs, rx: 10, tx: 10}, ""},
+			{t0.Add(time.Second), wgpeerstat{hs: hs, rx: 10, tx: 42}, ""},
+			{hs.Add(wgStaleHandshake + time.Second), wgpeerstat{hs: hs, rx: 10, tx: 74}, wgSwitchStaleHandshake},
+		}},
+		{"never handshaked", []check{
+			{t0, wgpeerstat{tx: 10}, ""},
+			{t0.Add(time.Second), wgpeerstat{tx: 42}, ""},
+			{later, wgpeerstat{tx: 74}, wgSwitchStaleHandshake},
+		}},
+	}
+	for _, tc := range tests {
+		p := &wgpeer{pk: "ab"}
+		for i, c := range tc.checks {
+			if got := p.degraded(c.st, c.at); got != c.want {
+				t.Errorf("failover: %s: check#%d: %q; want %q", tc.name, i, got, c.want)
+			}
+		}
+	}
+
+	// the endpoint in use is as reported, if any
+	p := &wgpeer{pk: "ab"}
+	p.degraded(wgpeerstat{endpoint: ep}, t0)
+	p.degraded(wgpeerstat{}, t0)
+	if p.cur != ep {
+		t.Errorf("failover: endpoint in use %s; want %s", p.cur, ep)
+	}
+}
+
+func TestWgPeerNext(t *testing.T) {
+	now := time.Now()
+	a := netip.MustParseAddrPort("192.0.2.1:1")
+	b := netip.MustParseAddrPort("192.0.2.2:1")
+	c := netip.MustParseAddrPort("[2001:db8::1]:1")
+	eps := []string{a.String(), b.String(), c.String(), "bad", "192.0.2.9:x"}
+	tests := []struct {
+		name      string
+		endpoints []string
+		cur       netip.AddrPort
+		bad       map[netip.AddrPort]time.Time
+		want      netip.AddrPort
+		ok        bool
+	}{
+		{"none other", []string{a.String()}, a, nil, netip.AddrPort{}, false},
+		{"unresolvable", []string{"bad", "192.0.2.9:x"}, netip.AddrPort{}, nil, netip.AddrPort{}, false},
+		{"in order", eps, netip.AddrPort{}, nil, a, true},
+		{"not the one in use", eps, a, nil, b, true},
+		{"bad last", eps, c, map[netip.AddrPort]time.Time{a: now}, b, true},
+		{"bad for long, but not forever", eps, c, map[netip.AddrPort]time.Time{a: now.Add(-wgBadFor - time.Second)}, a, true},
+		{"all bad", eps, c, map[netip.AddrPort]time.Time{a: now, b: now.Add(-time.Second)}, a, true},
+	}
+	for _, tc := range tests {
+		p := &wgpeer{pk: "ab", endpoints: tc.endpoints, cur: tc.cur, bad: tc.bad}
+		if p.bad == nil {
+			p.bad = make(map[netip.AddrPort]time.Time)
+		}
+		got, ok := p.next(now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("failover: %s: next %s, %t; want %s, %t", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
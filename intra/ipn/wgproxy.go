@@ -26,6 +26,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	x "github.com/celzero/firestack/intra/backend"
@@ -98,14 +99,17 @@ type wgproxy struct {
 	*wgtun
 	*device.Device
 	wgep wgconn
-	hc   *http.Client   // exported http client
-	rd   *protect.RDial // exported rdialer
+	hc   *http.Client               // exported http client
+	rd   *protect.RDial             // exported rdialer
+	fo   atomic.Pointer[wgfailover] // endpoint failover; may be nil
+	key  secretfn                   // private key, if held by the client; refetched on refresh; may be nil
 }
 
 type WgProxy interface {
 	Proxy
 	tun.Device
 	canUpdate(id, txt string) bool
+	failover(txt string, obs x.ProxyListener)
 	IpcSet(txt string) error
 }
 
@@ -122,6 +126,7 @@ func (w *wgproxy) BatchSize() int {
 
 // Close implements WgProxy
 func (w *wgproxy) Close() error {
+	w.fo.Swap(nil).stop()
 	// w.wgtun.Close() called by device.Close()?
 	w.Device.Close()
 	return nil
@@ -135,6 +140,10 @@ func (w *wgproxy) Stop() error {
 
 // GetAddr implements ipn.Proxy
 func (h *wgproxy) GetAddr() string {
+	// the endpoint failed over to is sent to (from) the next write on
+	if ep := h.fo.Load().endpoint(); ep.IsValid() {
+		return ep.String()
+	}
 	dst := h.wgep.RemoteAddr()
 	if !dst.IsValid() {
 		return noaddr
@@ -148,6 +157,21 @@ func (w *wgproxy) Refresh() (err error) {
 	if peers := w.remote; peers != nil {
 		peers.Refresh() // peers are also refreshed by w.Device.Up()
 	}
+	if w.key != nil { // the key may have been rotated by the client
+		var k string
+		if k, err = w.key(); err != nil {
+			w.status = TSK
+			log.E("proxy: wg: !refresh(%s): key: %v", w.id, err)
+			return
+		}
+		if err = w.Device.IpcSet(SecretWgKey + "=" + k + "\n"); err != nil {
+			log.E("proxy: wg: !refresh(%s): set key: %v", w.id, err)
+			return
+		}
+		if w.status == TSK {
+			w.status = TUP
+		}
+	}
 	if err = w.Device.Down(); err != nil {
 		log.E("proxy: wg: !refresh(%s): down: %v", w.id, err)
 		return
@@ -399,6 +423,7 @@ func NewWgProxy(id string, ctl protect.Controller, cfg string) (WgProxy, error)
 	err = wgdev.IpcSet(uapicfg)
 	if err != nil {
 		log.E("proxy: wg: %s failed to ipc-set %v", id, err)
+		wgdev.Close()
 		return nil, err
 	}
 
@@ -408,6 +433,7 @@ func NewWgProxy(id string, ctl protect.Controller, cfg string) (WgProxy, error)
 	err = wgdev.Up()
 	if err != nil {
 		log.E("proxy: wg: %s failed init %v", id, err)
+		wgdev.Close()
 		return nil, err
 	}
 
@@ -416,12 +442,10 @@ func NewWgProxy(id string, ctl protect.Controller, cfg string) (WgProxy, error)
 	// bindok := bindWgSockets(id, endpointh.AnyAddr(), wgdev, ctl)
 
 	w := &wgproxy{
-		nofwd{},
-		wgtun, // stack
-		wgdev, // device
-		wgep,  // endpoint
-		nil,   // rdial
-		nil,   // http-client
+		nofwd:  nofwd{},
+		wgtun:  wgtun, // stack
+		Device: wgdev, // device
+		wgep:   wgep,  // endpoint
 	}
 	w.rd = newRDial(w)
 	w.hc = newHTTPClient(w.rd)
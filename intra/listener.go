@@ -12,28 +12,68 @@ import (
 	"net/netip"
 	"time"
 
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dnsx"
 	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/netstack"
 )
 
 // SocketSummary reports information about each TCP socket
-// or a non-DNS UDP association, or ICMP echo when it is closed.
+// or a non-DNS UDP association, or ICMP echo flow when it is closed.
 type SocketSummary struct {
-	Proto    string    // tcp, udp, icmp, etc.
-	ID       string    // Unique ID for this socket.
-	PID      string    // Proxy ID that handled this socket.
-	UID      string    // UID of the app that owns this socket (sans ICMP).
-	Target   string    // Remote IP, if dialed in.
-	Rx       int64     // Total bytes downloaded (sans ICMP).
-	Tx       int64     // Total bytes uploaded (sans ICMP).
-	Duration int32     // Duration in seconds.
-	start    time.Time // Tracks start time; unexported.
-	Rtt      int32     // Round-trip time (ms); (sans ICMP).
-	Msg      string    // Err or other messages, if any.
+	Proto    string `json:"proto"`              // tcp, udp, icmp, etc.
+	ID       string `json:"id"`                 // Unique ID for this socket.
+	PID      string `json:"pid,omitempty"`      // Proxy ID that handled this socket.
+	UID      string `json:"uid,omitempty"`      // UID of the app that owns this socket.
+	Target   string `json:"target,omitempty"`   // Remote IP, if dialed in.
+	Rx       int64  `json:"rx,omitempty"`       // Total bytes downloaded; of echo replies, for ICMP.
+	Tx       int64  `json:"tx,omitempty"`       // Total bytes uploaded; of echo requests, for ICMP.
+	Duration int32  `json:"duration,omitempty"` // Duration in seconds.
+	Rtt      int32  `json:"rtt,omitempty"`      // Round-trip time (ms); (sans ICMP).
+	Msg      string `json:"msg,omitempty"`      // Err or other messages, if any; human-readable, may change.
+	Code     int    `json:"code"`               // Stable code for Msg; see: backend.ErrNone and backend.ErrName.
+	// True if dst is a known public resolver (sans ICMP); see: Tunnel.SetDNSBypassList.
+	DNSBypass bool `json:"dnsbypass,omitempty"`
+	// IPv4 that Target was translated from with 464xlat on ip6-only networks, if any.
+	Target4 string `json:"target4,omitempty"`
+	// True if dst is the device's own, and so, Target is loopback, dialed over Base; see: Tunnel.SetOwnAddrs.
+	Hairpin bool `json:"hairpin,omitempty"`
+	// True if Flow did not answer in time (or at all), and the verdict is a default; see: Tunnel.SetFlowTimeout.
+	Failsafe bool `json:"failsafe,omitempty"`
+	// True if Target is the realip last dialed for this uid and domain; false if freshly picked.
+	Sticky bool `json:"sticky,omitempty"`
+	// TLS version (ex: "TLS 1.3") the server picked, if observed; see: Tunnel.SetCertObservation.
+	TLSVersion string `json:"tlsversion,omitempty"`
+	// Of the server's leaf cert, if observed (TLS 1.2 and older; 1.3 encrypts certs): base64
+	// sha256 of its SubjectPublicKeyInfo, its subject, its issuer, and its expiry (unix secs).
+	CertSPKI     string `json:"certspki,omitempty"`
+	CertSubject  string `json:"certsubject,omitempty"`
+	CertIssuer   string `json:"certissuer,omitempty"`
+	CertNotAfter int64  `json:"certnotafter,omitempty"`
+	// True if the first segment (a tls ClientHello, usually) was split to evade dpi; see: Tunnel.SetSplitPorts.
+	Split bool `json:"split,omitempty"`
+	// Of blocked flows, if captured (see: Tunnel.SetBlockCapture): base64 of the first bytes
+	// the app sent (credentials in plaintext http redacted), their protocol guessed (tls,
+	// http, quic), and the host (tls sni or http host header) those bytes name, if any.
+	Capture      string `json:"capture,omitempty"`
+	CaptureProto string `json:"captureproto,omitempty"`
+	CaptureHost  string `json:"capturehost,omitempty"`
+	// Csv of proxies over which flows of this uid to Target (its domain) failed to dial within
+	// the retry window, as told to Flow (see: SocketListener.Flow); if any, this flow is a retry.
+	Retry string `json:"retry,omitempty"`
+	// True if PID is an alternate picked natively for the proxy that failed; see: Tunnel.SetRetryProxies.
+	Alternate bool `json:"alternate,omitempty"`
+
+	start time.Time     // Tracks start time; unexported.
+	stall time.Duration // Blocked flows are held for as long; unexported.
+	trace *core.Trace   // Set if the flow is traced; see: Tunnel.Trace; unexported.
 }
 
 type SocketListener interface {
 	// Flow is called on a new connection; return "proxyid,connid" to forward the connection
-	// to a pre-registered proxy; "Base" to allow the connection; "Block" to block the connection.
+	// to a pre-registered proxy; "Base" to allow the connection; "Block" to block the connection;
+	// "Defer" to hold the connection until its verdict is set with Tunnel.ResolveFlow.
 	// "connid" is used to uniquely identify a connection across all proxies, and a summary of the
 	// connection is sent back to a pre-registered listener.
 	// protocol is 6 for TCP, 17 for UDP, 1 for ICMP.
@@ -42,18 +82,53 @@ type SocketListener interface {
 	// origdsts is a comma-separated list of original source IPs, this may be same as dst.
 	// domains is a comma-separated list of domain names associated with origsrcs, if any.
 	// probableDomains is a comma-separated list of probable domain names associated with origsrcs, if any.
-	// blocklists is a comma-separated list of blocklist names, if any.
-	Flow(protocol int32, uid int, src, dst, origdsts, domains, probableDomains, blocklists string) *Mark
+	// blocklists is a comma-separated list of blocklist names, if any; and of categories of
+	// domains, as "cat:<category>", if categorized already (see: SetCategorizer).
+	// meta is a comma-separated list of tags about dst, if any; ex: "alpn:h3,alpn:h2" when
+	// https / svcb answers for its domains advertise those alpn ids (and haven't expired),
+	// "dnsbypass" when dst is a known public resolver (see: Tunnel.SetDNSBypassList),
+	// "hairpin" when dst is the device's own (see: Tunnel.SetOwnAddrs), and
+	// "exit:<pid>" when dst's realips were resolved over proxy pid (see: DNSOpts.UID), in
+	// which case, the flow must be forwarded over pid for those realips to be apt.
+	// "route:<pid>" when dst's domains are routed over proxy pid (see: AddDomainRoute), in
+	// which case, the returned PID is overridden with pid, unless it is Block; precedence:
+	// Block > Defer (the route applies once resolved) > route > returned PID. A route's
+	// proxy that is missing is ignored, unless its kill switch is set (then, it blocks).
+	// "failed:<pid>" for each proxy pid over which flows of uid to dst (its domain) failed
+	// to dial of late (see: Tunnel.SetFlowRetry), so that the retry may go elsewhere; the
+	// returned (or routed) PID is overridden with an alternate of pid, if set natively (see:
+	// Tunnel.SetRetryProxies), unless pid is kill switched.
+	Flow(protocol int32, uid int, src, dst, origdsts, domains, probableDomains, blocklists, meta string) *Mark
 	// OnSocketClosed reports summary after a socket closes.
 	OnSocketClosed(*SocketSummary)
 }
 
+type TraceListener interface {
+	// OnTraceEvent is called with each event (a one-line json) of trace id,
+	// in order; see: Tunnel.Trace.
+	OnTraceEvent(id, event string)
+}
+
 type Mark struct {
 	PID string // PID of the proxy to forward the socket over.
 	CID string // CID identifies this socket.
 	UID string // UID of the app which owns this socket.
+
+	why error // Why the verdict was set natively, if it was; ex: errMetered; unexported.
 }
 
+// prefix for alpn tags in Flow's meta
+const alpnprefix = "alpn:"
+
+// prefix for the exit tag in Flow's meta
+const exitprefix = "exit:"
+
+// prefix for the route tag in Flow's meta
+const routeprefix = "route:"
+
+// prefix for categories in Flow's blocklists
+const catprefix = "cat:"
+
 const (
 	ProtoTypeUDP  = "udp"
 	ProtoTypeTCP  = "tcp"
@@ -64,17 +139,62 @@ var (
 	optionsBlock = &Mark{PID: ipn.Block}
 	optionsBase  = &Mark{PID: ipn.Base}
 
-	errNone = errors.New("no error")
+	errNone        = errors.New("no error")
+	errKillSwitch  = errors.New("killswitch")   // see: ipn.Proxies.KillSwitched
+	errPurged      = errors.New("uid purged")   // see: Tunnel.PurgeUid
+	errAuditedLeak = errors.New("audited-leak") // see: Tunnel.AuditConns
+	errPeerDead    = errors.New("peer-dead")    // see: Tunnel.SetPeerDeadCheck
+	errCircuitOpen = errors.New("circuit-open") // see: Tunnel.SetCircuitBreaker
+	errMetered     = errors.New("metered")      // see: Tunnel.SetMetered
+
+	errListenerTimeout = errors.New("listener-timeout") // see: Tunnel.SetFlowTimeout
+	errRouteChanged    = errors.New("route-changed")    // see: Tunnel.SetRouteChangeDrain
+	errDNSDiverted     = errors.New("dns-diverted")     // see: settings.DNSModePort
 )
 
-func icmpSummary(id, pid string) *SocketSummary {
-	return &SocketSummary{
-		Proto: ProtoTypeICMP,
-		ID:    id,
-		PID:   pid,
-		start: time.Now(),
-		Msg:   errNone.Error(),
+// errcode returns the stable code for err; see: x.ErrNone
+func errcode(err error) int {
+	switch {
+	case err == nil:
+		return x.ErrNone
+	case errors.Is(err, errMetered): // firewalled, too
+		return x.ErrMetered
+	case errors.Is(err, errListenerTimeout): // firewalled, too
+		return x.ErrListenerTimeout
+	case errors.Is(err, errTcpFirewalled), errors.Is(err, errUdpFirewalled),
+		errors.Is(err, errIcmpFirewalled):
+		return x.ErrFirewalled
+	case errors.Is(err, errKillSwitch):
+		return x.ErrKillSwitch
+	case errors.Is(err, errPurged):
+		return x.ErrPurged
+	case errors.Is(err, errAuditedLeak):
+		return x.ErrAuditedLeak
+	case errors.Is(err, errPeerDead):
+		return x.ErrPeerDead
+	case errors.Is(err, errCircuitOpen):
+		return x.ErrCircuitOpen
+	case errors.Is(err, errRouteChanged):
+		return x.ErrRouteChanged
+	case errors.Is(err, dnsx.ErrStaleAlgIP):
+		return x.ErrStaleAlgIP
+	case errors.Is(err, errDNSBypassBlocked):
+		return x.ErrDNSBypassBlocked
+	case errors.Is(err, errDNSBypassRedirect):
+		return x.ErrDNSBypassRedirected
+	case errors.Is(err, errDNSDiverted):
+		return x.ErrDNSDiverted
+	case errors.Is(err, errProxyDNS):
+		return x.ErrDNSProxied
+	case errors.Is(err, netstack.ErrEndpoint):
+		return x.ErrEndpoint
+	case errors.Is(err, errTcpSetupConn), errors.Is(err, errUdpSetupConn),
+		errors.Is(err, errUdpNotReady):
+		return x.ErrConnSetup
+	case errors.Is(err, errClosed):
+		return x.ErrTunnelClosed
 	}
+	return ipn.ErrCode(err)
 }
 
 func tcpSummary(id, pid, uid string, dst netip.Addr) *SocketSummary {
@@ -95,9 +215,26 @@ func udpSummary(id, pid, uid string, dst netip.Addr) *SocketSummary {
 	return s
 }
 
+func icmpSummary(id, pid, uid string, dst netip.Addr) *SocketSummary {
+	s := tcpSummary(id, pid, uid, dst)
+	s.Proto = ProtoTypeICMP
+	return s
+}
+
+// tuple tags the flow of s, as tracked; see: core.ConnMapper.Find
+func (s *SocketSummary) tuple() core.ConnTuple {
+	dst, _ := netip.ParseAddr(s.Target) // zero if not dialed in
+	return core.ConnTuple{Proto: s.Proto, Uid: s.UID, Pid: s.PID, Dst: dst, Start: s.start}
+}
+
 func (s *SocketSummary) str() string {
-	return fmt.Sprintf("socket-summary: id=%s pid=%s uid=%s down=%d up=%d dur=%d synack=%d msg=%s",
-		s.ID, s.PID, s.UID, s.Rx, s.Tx, s.Duration, s.Rtt, s.Msg)
+	return fmt.Sprintf("socket-summary: id=%s pid=%s uid=%s down=%d up=%d dur=%d synack=%d sticky=%t msg=%s code=%s",
+		s.ID, s.PID, s.UID, s.Rx, s.Tx, s.Duration, s.Rtt, s.Sticky, s.Msg, x.ErrName(s.Code))
+}
+
+// mark returns the verdict s was created with.
+func (s *SocketSummary) mark() *Mark {
+	return &Mark{PID: s.PID, CID: s.ID, UID: s.UID}
 }
 
 func (s *SocketSummary) elapsed() {
@@ -119,6 +256,9 @@ func (s *SocketSummary) done(errs ...error) {
 
 	err := errors.Join(errs...) // errs may be nil
 	if err != nil {
+		if s.Code == x.ErrNone { // the first error sticks
+			s.Code = errcode(err)
+		}
 		if s.Msg == errNone.Error() {
 			s.Msg = err.Error()
 		} else {
@@ -0,0 +1,233 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/log"
+)
+
+// approx bytes held per entry of each tracking structure; these are
+// coarse estimates, and only meant to be compared against the budget.
+const (
+	tcpflowsz  = 64 << 10 // netstack endpoint, pipes, and goroutines
+	udpflowsz  = 16 << 10 // netstack endpoint, socket, and goroutines
+	icmpflowsz = 512      // echo flow, sans sockets of echoes in flight
+	algsz      = 256      // alg, nat, ptr entry
+	stallsz    = 64       // fwtracker entry
+	cachesz    = 1 << 10  // cached dns response
+)
+
+const (
+	// how often the memory footprint is estimated
+	memgovfreq = 30 * time.Second
+	// udp flows idle for this long are evicted when over budget
+	udpidle = 30 * time.Second
+)
+
+// MemorySummary reports the estimated footprint of conn tracking
+// structures, and what was shed, if anything, to get under budget.
+type MemorySummary struct {
+	Budget     int64 // Memory budget in bytes; 0 if unbounded.
+	Estimate   int64 // Estimated footprint in bytes before shedding.
+	Remain     int64 // Estimated footprint in bytes after shedding.
+	TCP        int   // Tracked TCP flows.
+	UDP        int   // Tracked UDP flows.
+	ICMP       int   // Tracked ICMP echo flows.
+	Alg        int   // ALG, NAT, PTR entries.
+	Stalls     int   // Firewall stall entries (TCP and UDP).
+	Cache      int   // Cached DNS responses.
+	ShedUDP    int   // Idle UDP flows closed.
+	ShedAlg    int   // ALG, NAT, PTR entries removed.
+	ShedStalls int   // Firewall stall entries removed.
+	ShedCache  int   // Cached DNS responses removed.
+}
+
+type MemoryListener interface {
+	// OnMemoryShed reports what was shed to keep conn tracking
+	// structures under the memory budget.
+	OnMemoryShed(*MemorySummary)
+}
+
+// flowtracker is implemented by flow handlers that track conns.
+type flowtracker interface {
+	conns() core.ConnMapper
+}
+
+// tracker is implemented by flow handlers that track conns and stalls.
+type tracker interface {
+	flowtracker
+	stalls() *core.ExpMap
+}
+
+// memgov periodically estimates the memory held by conn tracking
+// structures, and sheds load when it exceeds the budget.
+type memgov struct {
+	budget   atomic.Int64 // bytes; 0 disables enforcement
+	tcp      tracker      // may be nil
+	udp      tracker      // may be nil
+	icmp     flowtracker  // may be nil
+	resolver dnsx.Resolver
+	listener MemoryListener
+	sigterm  context.CancelFunc
+}
+
+func newMemGov(r dnsx.Resolver, l MemoryListener, tcph, udph, icmph any) *memgov {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &memgov{
+		resolver: r,
+		listener: l,
+		sigterm:  cancel,
+	}
+	g.tcp, _ = tcph.(tracker)
+	g.udp, _ = udph.(tracker)
+	g.icmp, _ = icmph.(flowtracker)
+	go g.run(ctx)
+	return g
+}
+
+func (g *memgov) run(ctx context.Context) {
+	tick := time.NewTicker(memgovfreq)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.I("memgov: stopped")
+			return
+		case <-tick.C:
+			g.enforce()
+		}
+	}
+}
+
+func (g *memgov) stop() {
+	g.sigterm()
+}
+
+func (g *memgov) setBudget(b int64) {
+	if b < 0 {
+		b = 0
+	}
+	g.budget.Store(b)
+	log.I("memgov: budget %d bytes", b)
+}
+
+// estimate returns the current footprint of all tracking structures.
+func (g *memgov) estimate() *MemorySummary {
+	s := &MemorySummary{
+		Budget: g.budget.Load(),
+	}
+	if g.tcp != nil {
+		s.TCP = g.tcp.conns().Len()
+		s.Stalls += g.tcp.stalls().Len()
+	}
+	if g.udp != nil {
+		s.UDP = g.udp.conns().Len()
+		s.Stalls += g.udp.stalls().Len()
+	}
+	if g.icmp != nil {
+		s.ICMP = g.icmp.conns().Len()
+	}
+	if g.resolver != nil {
+		if gw := g.resolver.Gateway(); gw != nil {
+			s.Alg = gw.Len()
+		}
+		s.Cache = g.resolver.CacheSize()
+	}
+	s.Estimate = s.bytes()
+	s.Remain = s.Estimate
+	return s
+}
+
+// enforce sheds load in order of priority until under budget:
+// idle udp flows, then expired alg and stall entries, then dns caches.
+func (g *memgov) enforce() {
+	s := g.estimate()
+	if s.Budget <= 0 || s.Estimate <= s.Budget {
+		log.V("memgov: ok; %s", s.str())
+		return
+	}
+
+	over := func() bool {
+		s.Remain = s.bytes() - s.shed()
+		return s.Remain > s.Budget
+	}
+
+	if g.udp != nil && over() {
+		n := int((s.Remain-s.Budget)/udpflowsz) + 1
+		s.ShedUDP = len(g.udp.conns().UntrackIdle(udpidle, n))
+	}
+	if over() && g.resolver != nil {
+		if gw := g.resolver.Gateway(); gw != nil {
+			s.ShedAlg = gw.Trim()
+		}
+	}
+	if over() {
+		s.ShedStalls = g.trimStalls(false)
+	}
+	if over() {
+		s.ShedStalls += g.trimStalls(true)
+	}
+	if over() && g.resolver != nil {
+		s.ShedCache = g.resolver.TrimCache(false)
+	}
+	if over() && g.resolver != nil {
+		s.ShedCache += g.resolver.TrimCache(true)
+	}
+	over() // update s.Remain
+
+	log.I("memgov: shed; %s", s.str())
+	if g.listener != nil {
+		go g.listener.OnMemoryShed(s)
+	}
+}
+
+// trimStalls removes expired stall entries, or all of them if all is set.
+func (g *memgov) trimStalls(all bool) (n int) {
+	for _, t := range []tracker{g.tcp, g.udp} {
+		if t == nil {
+			continue
+		}
+		if all {
+			n += t.stalls().Clear()
+		} else {
+			n += t.stalls().Trim()
+		}
+	}
+	return
+}
+
+// bytes returns the estimated footprint in bytes before shedding.
+func (s *MemorySummary) bytes() int64 {
+	return int64(s.TCP)*tcpflowsz +
+		int64(s.UDP)*udpflowsz +
+		int64(s.ICMP)*icmpflowsz +
+		int64(s.Alg)*algsz +
+		int64(s.Stalls)*stallsz +
+		int64(s.Cache)*cachesz
+}
+
+// shed returns the estimated bytes freed by shedding.
+func (s *MemorySummary) shed() int64 {
+	return int64(s.ShedUDP)*udpflowsz +
+		int64(s.ShedAlg)*algsz +
+		int64(s.ShedStalls)*stallsz +
+		int64(s.ShedCache)*cachesz
+}
+
+func (s *MemorySummary) str() string {
+	return fmt.Sprintf("budget=%d est=%d remain=%d tcp=%d udp=%d/%d icmp=%d alg=%d/%d stalls=%d/%d cache=%d/%d",
+		s.Budget, s.Estimate, s.Remain, s.TCP, s.ShedUDP, s.UDP, s.ICMP, s.ShedAlg, s.Alg,
+		s.ShedStalls, s.Stalls, s.ShedCache, s.Cache)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// uids of android users are this far apart; uid = user * peruser + appid
+	peruseruids = 100000
+	// appids below are of the system, which data saver spares
+	firstappid = 10000
+)
+
+// uidset is a sorted set of uids; never modified once made.
+type uidset []int
+
+// newUidSet returns uids in csv; errs on any that is not a number.
+func newUidSet(csv string) (uidset, error) {
+	s := make(uidset, 0)
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); len(v) <= 0 {
+			continue
+		}
+		uid, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, uid)
+	}
+	slices.Sort(s)
+	return slices.Compact(s), nil
+}
+
+func (s uidset) has(uid int) bool {
+	_, ok := slices.BinarySearch(s, uid)
+	return ok
+}
+
+// metered restricts background flows of apps on metered networks, as
+// android's data saver expects: flows of apps that are neither exempt nor
+// in the foreground are blocked, while on.
+type metered struct {
+	on     atomic.Bool
+	exempt atomic.Pointer[uidset] // never nil
+	fg     atomic.Pointer[uidset] // foreground uids; never nil
+}
+
+func newMetered() *metered {
+	m := &metered{}
+	m.exempt.Store(&uidset{})
+	m.fg.Store(&uidset{})
+	return m
+}
+
+// set turns restrictions on or off.
+func (m *metered) set(on bool) {
+	m.on.Store(on)
+	log.I("metered: on? %t; exempt %d, fg %d", on, len(*m.exempt.Load()), len(*m.fg.Load()))
+}
+
+// setExempt sets uids (csv) that are never restricted.
+func (m *metered) setExempt(csv string) error {
+	s, err := newUidSet(csv)
+	if err != nil {
+		return err
+	}
+	m.exempt.Store(&s)
+	log.I("metered: exempt %d", len(s))
+	return nil
+}
+
+// setForeground sets uids (csv) in the foreground.
+func (m *metered) setForeground(csv string) error {
+	s, err := newUidSet(csv)
+	if err != nil {
+		return err
+	}
+	m.fg.Store(&s)
+	log.V("metered: fg %v", s)
+	return nil
+}
+
+// restricts returns true if flows of uid must be blocked; never for
+// uids of the system, nor for unknown (negative) uids.
+func (m *metered) restricts(uid int) bool {
+	if !m.on.Load() || uid < 0 || uid%peruseruids < firstappid {
+		return false
+	}
+	return !m.exempt.Load().has(uid) && !m.fg.Load().has(uid)
+}
+
+// restrictsUid is restricts for uid as a string; ex: SocketSummary.UID.
+func (m *metered) restrictsUid(uid string) bool {
+	n, err := strconv.Atoi(uid)
+	return err == nil && m.restricts(n)
+}
+
+// verdict returns res as is, or a Block for uid (or, if unknown, the uid
+// res is for) if it is restricted.
+func (m *metered) verdict(uid int, res *Mark) *Mark {
+	if res == nil || res.PID == ipn.Block {
+		return res
+	}
+	if n, err := strconv.Atoi(res.UID); uid < 0 && err == nil {
+		uid = n
+	}
+	if !m.restricts(uid) {
+		return res
+	}
+	return &Mark{PID: ipn.Block, CID: res.CID, UID: res.UID, why: errMetered}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/netstack"
+	"github.com/celzero/firestack/intra/protect"
+)
+
+const (
+	metricsPath = "/metrics"
+	// slow scrapers are not waited on for longer
+	metricsTimeout = 10 * time.Second
+)
+
+var errMetricsNotLoopback = errors.New("metrics: not a loopback addr")
+
+// meter is a Listener that counts summaries of flows and of dns queries
+// into metrics, if on; all calls pass through to Listener.
+type meter struct {
+	Listener
+	metrics *core.Metrics
+}
+
+var _ Listener = (*meter)(nil)
+
+func newMeter(l Listener) *meter {
+	m := core.NewMetrics()
+	m.Register("firestack_flows_total", core.MetricCounter, "Flows closed, by protocol, proxy, and app uid.", "proto", "pid", "uid")
+	m.Register("firestack_flow_bytes_total", core.MetricCounter, "Bytes of flows closed, by protocol, proxy, and direction.", "proto", "pid", "dir")
+	m.Register("firestack_flow_errors_total", core.MetricCounter, "Flows closed with errors (ex: blocked, dropped, unreachable), by protocol and error code.", "proto", "code")
+	m.Register("firestack_dns_queries_total", core.MetricCounter, "DNS queries, by transport and outcome.", "transport", "code")
+	m.Register("firestack_dns_latency_seconds", core.MetricSummary, "Latency of DNS queries, by transport.", "transport")
+	m.Register("firestack_conns", core.MetricGauge, "Flows tracked, by protocol.", "proto")
+	m.Register("firestack_alg_entries", core.MetricGauge, "ALG, NAT, and PTR entries.")
+	m.Register("firestack_stall_entries", core.MetricGauge, "Firewall stall entries.")
+	m.Register("firestack_dns_cache_entries", core.MetricGauge, "Cached DNS responses.")
+	m.Register("firestack_dns_conn_reuse_percent", core.MetricGauge, "Percent of DNS queries sent over reused conns, by encrypted transport.", "transport")
+	m.Register("firestack_memory_estimate_bytes", core.MetricGauge, "Estimated memory footprint of conn tracking structures.")
+	m.Register("firestack_tun_writes_total", core.MetricCounter, "Writes (batches of packets) to the tun device.")
+	m.Register("firestack_tun_packets_total", core.MetricCounter, "Packets written to the tun device.")
+	m.Register("firestack_tun_bytes_total", core.MetricCounter, "Bytes written to the tun device.")
+	m.Register("firestack_tun_write_errors_total", core.MetricCounter, "Writes to the tun device that failed with EAGAIN or ENOBUFS, and so were retried (transient); or were given up on (exhausted).", "kind")
+	m.Register("firestack_endpoint_errors_total", core.MetricCounter, "New flows netstack could not create endpoints for, by category (ex: no-route).", "category")
+	m.Register("firestack_udp_retransmits_dropped_total", core.MetricCounter, "Retransmits (exact duplicates) of datagrams of blocked udp flows, dropped unjudged.")
+	m.Register("firestack_listener_timeouts_total", core.MetricCounter, "Flows and dns queries the listener did not answer in time (or at all), and so, were given a default.", "kind")
+	return &meter{Listener: l, metrics: m}
+}
+
+// OnSocketClosed implements SocketListener.
+func (m *meter) OnSocketClosed(s *SocketSummary) {
+	if m.metrics.On() && s != nil {
+		// uids are unbounded; their series are capped, see: core.MaxSeries
+		m.metrics.Add("firestack_flows_total", 1, s.Proto, s.PID, s.UID)
+		m.metrics.Add("firestack_flow_bytes_total", float64(s.Rx), s.Proto, s.PID, "rx")
+		m.metrics.Add("firestack_flow_bytes_total", float64(s.Tx), s.Proto, s.PID, "tx")
+		if s.Code != x.ErrNone {
+			m.metrics.Add("firestack_flow_errors_total", 1, s.Proto, x.ErrName(s.Code))
+		}
+	}
+	m.Listener.OnSocketClosed(s)
+}
+
+// OnResponse implements x.DNSListener.
+func (m *meter) OnResponse(s *x.DNSSummary) {
+	if m.metrics.On() && s != nil {
+		m.metrics.Add("firestack_dns_queries_total", 1, s.ID, x.ErrName(s.Code))
+		m.metrics.Observe("firestack_dns_latency_seconds", s.Latency, s.ID)
+	}
+	m.Listener.OnResponse(s)
+}
+
+// collect sets gauges (and counters kept elsewhere) of t on every scrape.
+func (t *rtunnel) collect(m *core.Metrics) {
+	if t.closed.Load() {
+		return
+	}
+	s := t.memgov.estimate()
+	m.Set("firestack_conns", float64(s.TCP), "tcp")
+	m.Set("firestack_conns", float64(s.UDP), "udp")
+	m.Set("firestack_alg_entries", float64(s.Alg))
+	m.Set("firestack_stall_entries", float64(s.Stalls))
+	m.Set("firestack_dns_cache_entries", float64(s.Cache))
+	m.Set("firestack_memory_estimate_bytes", float64(s.Estimate))
+	if u, ok := t.udp.(*udpHandler); ok {
+		m.Set("firestack_udp_retransmits_dropped_total", float64(u.dups.Dups()))
+	}
+	m.Set("firestack_listener_timeouts_total", float64(t.failsafe.n.Load()), "flow")
+	m.Set("firestack_listener_timeouts_total", float64(t.resolver.ListenerTimeouts()), "query")
+	for _, id := range strings.Split(t.resolver.LiveTransports(), ",") {
+		if tr, err := t.resolver.Get(id); err == nil {
+			if cr, ok := tr.(dnsx.ConnReporter); ok {
+				if pct := cr.ConnStats().ReusePct(); pct >= 0 {
+					m.Set("firestack_dns_conn_reuse_percent", float64(pct), id)
+				}
+			}
+		}
+	}
+
+	var w netstack.WriteStats
+	if err := json.Unmarshal([]byte(t.WriteStats(false)), &w); err == nil {
+		m.Set("firestack_tun_writes_total", float64(w.Batches))
+		m.Set("firestack_tun_packets_total", float64(w.Packets))
+		m.Set("firestack_tun_bytes_total", float64(w.Bytes))
+		m.Set("firestack_tun_write_errors_total", float64(w.Transient), "transient")
+		m.Set("firestack_tun_write_errors_total", float64(w.Exhausted), "exhausted")
+	}
+	var ep netstack.EndpointErrs
+	if err := json.Unmarshal([]byte(t.EndpointErrors(false)), &ep); err == nil {
+		m.Set("firestack_endpoint_errors_total", float64(ep.NoRoute), netstack.EpNoRoute)
+		m.Set("firestack_endpoint_errors_total", float64(ep.NoPort), netstack.EpNoPort)
+		m.Set("firestack_endpoint_errors_total", float64(ep.Resources), netstack.EpResources)
+		m.Set("firestack_endpoint_errors_total", float64(ep.State), netstack.EpState)
+		m.Set("firestack_endpoint_errors_total", float64(ep.Other), netstack.EpOther)
+	}
+}
+
+// metricsrv serves metrics over http at metricsPath, if on.
+type metricsrv struct {
+	sync.Mutex                    // protects srv
+	m          *core.Metrics      // served; on only while srv is
+	ctl        protect.Controller // protects the listener
+	srv        *http.Server       // may be nil
+}
+
+func newMetricsServer(m *core.Metrics, ctl protect.Controller) *metricsrv {
+	return &metricsrv{m: m, ctl: ctl}
+}
+
+// listen serves metrics on addr (ip:port), which must be a loopback addr
+// unless nonlocal is set; or stops serving them, if addr is empty.
+func (s *metricsrv) listen(addr string, nonlocal bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stopLocked()
+	if len(addr) <= 0 {
+		return nil
+	}
+	ipp, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return err
+	}
+	if !nonlocal && !ipp.Addr().IsLoopback() {
+		return errMetricsNotLoopback
+	}
+
+	lc := protect.MakeNsListener("metrics", s.ctl)
+	ln, err := lc.Listen(context.Background(), "tcp", ipp.String())
+	if err != nil {
+		log.W("metrics: listen %s: %v", ipp, err)
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, s.m)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: metricsTimeout,
+		WriteTimeout:      metricsTimeout,
+	}
+	s.srv = srv
+	s.m.Enable(true)
+	go func(ln net.Listener) {
+		err := srv.Serve(ln)
+		log.I("metrics: serve %s done; err? %v", ipp, err)
+	}(ln)
+	log.I("metrics: serving at http://%s%s", ipp, metricsPath)
+	return nil
+}
+
+func (s *metricsrv) stop() {
+	s.Lock()
+	defer s.Unlock()
+	s.stopLocked()
+}
+
+func (s *metricsrv) stopLocked() {
+	s.m.Enable(false)
+	if s.srv != nil {
+		_ = s.srv.Close()
+		s.srv = nil
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/log"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// max packets in a batch
+	maxBatchPkts = 64
+	// max bytes in a batch
+	maxBatchBytes = 256 << 10
+	// pending packets past which writers flush themselves
+	maxPendingPkts = 4 * maxBatchPkts
+	// max time the first packet of a batch waits on others
+	flushDelay = 250 * time.Microsecond
+	// max time a batch waits on the tun device to drain, before the rest
+	// of it is dropped
+	flushWait = 5 * time.Millisecond
+)
+
+// coalescing is on unless turned off with CoalesceWrites(false).
+var coalesceOff atomic.Bool
+
+// WriteStats are batch-size statistics of writes to the tun device, across
+// links, since the last reset.
+type WriteStats struct {
+	Coalesce bool  `json:"coalesce"` // coalescing is on
+	Batches  int64 `json:"batches"`  // writes to the tun device
+	Packets  int64 `json:"packets"`  // packets written
+	Bytes    int64 `json:"bytes"`    // bytes written
+	Max      int64 `json:"max"`      // packets in the biggest batch
+	// flushes when the batch was full (in packets or bytes), when its
+	// timer was up, or when writers had to flush it themselves
+	ByCount   int64 `json:"bycount"`
+	ByBytes   int64 `json:"bybytes"`
+	ByTimer   int64 `json:"bytimer"`
+	ByWriters int64 `json:"bywriters"`
+	// batches of 1, 2-4, 5-16, 17-64, and 65+ packets
+	Hist [5]int64 `json:"hist"`
+	// writes to the tun device that failed with EAGAIN or ENOBUFS, and so
+	// were retried; and those given up on as all retries failed, too
+	Transient int64 `json:"transient"`
+	Exhausted int64 `json:"exhausted"`
+}
+
+type flushReason int
+
+const (
+	byTimer flushReason = iota
+	byCount
+	byBytes
+	byWriters // also: coalescing is off, or the link is going away
+)
+
+type writestats struct {
+	batches, pkts, bytes, max        atomic.Int64
+	bycount, bybytes, bytimer, bywri atomic.Int64
+	hist                             [5]atomic.Int64
+	transient, exhausted             atomic.Int64
+}
+
+var wstats writestats
+
+func (s *writestats) add(why flushReason, pkts, bytes int) {
+	if pkts <= 0 {
+		return
+	}
+	n := int64(pkts)
+	s.batches.Add(1)
+	s.pkts.Add(n)
+	s.bytes.Add(int64(bytes))
+	for {
+		m := s.max.Load()
+		if n <= m || s.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	switch why {
+	case byCount:
+		s.bycount.Add(1)
+	case byBytes:
+		s.bybytes.Add(1)
+	case byTimer:
+		s.bytimer.Add(1)
+	default:
+		s.bywri.Add(1)
+	}
+	switch {
+	case n <= 1:
+		s.hist[0].Add(1)
+	case n <= 4:
+		s.hist[1].Add(1)
+	case n <= 16:
+		s.hist[2].Add(1)
+	case n <= 64:
+		s.hist[3].Add(1)
+	default:
+		s.hist[4].Add(1)
+	}
+}
+
+func (s *writestats) get() WriteStats {
+	w := WriteStats{
+		Coalesce:  !coalesceOff.Load(),
+		Batches:   s.batches.Load(),
+		Packets:   s.pkts.Load(),
+		Bytes:     s.bytes.Load(),
+		Max:       s.max.Load(),
+		ByCount:   s.bycount.Load(),
+		ByBytes:   s.bybytes.Load(),
+		ByTimer:   s.bytimer.Load(),
+		ByWriters: s.bywri.Load(),
+		Transient: s.transient.Load(),
+		Exhausted: s.exhausted.Load(),
+	}
+	for i := range s.hist {
+		w.Hist[i] = s.hist[i].Load()
+	}
+	return w
+}
+
+func (s *writestats) reset() {
+	for _, a := range []*atomic.Int64{&s.batches, &s.pkts, &s.bytes, &s.max,
+		&s.bycount, &s.bybytes, &s.bytimer, &s.bywri, &s.transient, &s.exhausted} {
+		a.Store(0)
+	}
+	for i := range s.hist {
+		s.hist[i].Store(0)
+	}
+}
+
+// CoalesceWrites turns on (or off, ex: to debug latency) the batching of
+// packets written to socket-backed links; applies to existing links, too.
+// Tun devices take one packet per write, and so are never batched.
+func CoalesceWrites(y bool) (ok bool) {
+	ok = coalesceOff.CompareAndSwap(y, !y)
+	log.I("netstack: coalesce writes(%t): done?(%t)", y, ok)
+	return
+}
+
+// GetWriteStats returns json of WriteStats; and resets them if reset is set.
+func GetWriteStats(reset bool) string {
+	w := wstats.get()
+	if reset {
+		wstats.reset()
+	}
+	b, err := json.Marshal(w)
+	if err != nil {
+		log.W("netstack: write stats: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// coalescer sits in front of a link endpoint and writes packets sent to it
+// in batches of up to maxBatchPkts or maxBatchBytes, waiting no more than
+// flushDelay on a batch to fill up. Packets are written in the order they
+// were sent, which keeps them in order within each flow, too. Endpoints
+// that wrap a coalescer (ex: sniffer) see each packet as it is sent.
+// Unless batch is set, packets are written as they are sent, and only
+// counted in WriteStats.
+type coalescer struct {
+	nested.Endpoint
+	w     waitWriter // child, if it can wait to write; may be nil
+	batch bool       // child writes batches in one go (ex: sendmmsg)
+
+	wmu sync.Mutex // serializes writes to the child endpoint
+
+	mu      sync.Mutex             // protects pending & pbytes
+	pending stack.PacketBufferList // refs held till written
+	pbytes  int                    // bytes in pending
+
+	kick chan struct{} // pending was empty
+	full chan struct{} // pending is full
+	stop chan struct{} // closed when detached; nil if not attached
+	wg   sync.WaitGroup
+}
+
+// waitWriter is a link endpoint that can, instead of dropping packets when
+// it is not writable, wait for a while for it to be.
+type waitWriter interface {
+	writePacketsWait(pkts stack.PacketBufferList, d time.Duration) (int, tcpip.Error)
+}
+
+var _ stack.LinkEndpoint = (*coalescer)(nil)
+var _ waitWriter = (*endpoint)(nil)
+
+func newCoalescer(child stack.LinkEndpoint, batch bool) *coalescer {
+	w, _ := child.(waitWriter)
+	c := &coalescer{
+		w:     w,
+		batch: batch,
+		kick:  make(chan struct{}, 1),
+		full:  make(chan struct{}, 1),
+	}
+	c.Endpoint.Init(child, c)
+	return c
+}
+
+// Attach implements stack.LinkEndpoint.
+func (c *coalescer) Attach(d stack.NetworkDispatcher) {
+	c.mu.Lock()
+	if d != nil && c.stop == nil && c.batch {
+		c.stop = make(chan struct{})
+		c.wg.Add(1)
+		go c.flusher(c.stop)
+	} else if d == nil && c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mu.Unlock()
+
+	c.Endpoint.Attach(d)
+}
+
+// Wait implements stack.LinkEndpoint.
+func (c *coalescer) Wait() {
+	c.wg.Wait()
+	c.Endpoint.Wait()
+}
+
+// WritePackets implements stack.LinkEndpoint. Packets are taken as written
+// as soon as they are queued.
+func (c *coalescer) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	n := pkts.Len()
+	if n <= 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	if coalesceOff.Load() || c.stop == nil {
+		c.mu.Unlock()
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		c.flushLocked(byWriters) // those queued before go first
+		wstats.add(byWriters, n, size(pkts.AsSlice()))
+		return c.Endpoint.WritePackets(pkts)
+	}
+	wasempty := c.pending.Len() <= 0
+	for _, pkt := range pkts.AsSlice() {
+		c.pending.PushBack(pkt.IncRef())
+		c.pbytes += pkt.Size()
+	}
+	queued, qbytes := c.pending.Len(), c.pbytes
+	c.mu.Unlock()
+
+	switch {
+	case queued >= maxPendingPkts: // flusher is falling behind
+		c.flush(byWriters)
+	case queued >= maxBatchPkts || qbytes >= maxBatchBytes:
+		signal(c.full)
+	case wasempty:
+		signal(c.kick)
+	}
+	return n, nil
+}
+
+// flusher writes out pending packets when a batch is full, or flushDelay
+// after the first packet of a batch is queued, till stop is closed.
+func (c *coalescer) flusher(stop <-chan struct{}) {
+	defer c.wg.Done()
+	defer c.flush(byWriters)
+
+	t := time.NewTimer(flushDelay)
+	t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.full:
+			c.flush(byCount)
+			continue
+		case <-c.kick:
+		}
+		t.Reset(flushDelay)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-c.full:
+			t.Stop()
+			c.flush(byCount)
+		case <-t.C:
+			c.flush(byTimer)
+		}
+	}
+}
+
+func (c *coalescer) flush(why flushReason) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.flushLocked(why)
+}
+
+// flushLocked writes out pending packets in batches; must hold wmu.
+func (c *coalescer) flushLocked(why flushReason) {
+	c.mu.Lock()
+	pkts := c.pending
+	c.pending = stack.PacketBufferList{}
+	c.pbytes = 0
+	c.mu.Unlock()
+
+	all := pkts.AsSlice()
+	for len(all) > 0 {
+		var batch stack.PacketBufferList
+		bytes := 0
+		for len(all) > 0 && batch.Len() < maxBatchPkts && bytes < maxBatchBytes {
+			batch.PushBack(all[0])
+			bytes += all[0].Size()
+			all = all[1:]
+		}
+		r := why
+		if r == byCount && bytes >= maxBatchBytes {
+			r = byBytes
+		}
+		wstats.add(r, batch.Len(), bytes)
+		var n int
+		var err tcpip.Error
+		if c.w != nil && why != byWriters { // flusher can afford to wait
+			n, err = c.w.writePacketsWait(batch, flushWait)
+		} else {
+			n, err = c.Endpoint.WritePackets(batch)
+		}
+		if err != nil {
+			log.V("netstack: coalesce: wrote %d/%d; err %v", n, batch.Len(), err)
+		}
+	}
+	pkts.Reset() // drop refs taken by WritePackets
+}
+
+func size(pkts []*stack.PacketBuffer) (n int) {
+	for _, pkt := range pkts {
+		n += pkt.Size()
+	}
+	return
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// sourceTCP accepts all conns, and writes n bytes (0, 1, 2 ... 255, 0, 1
+// and so on) to each before closing it (after the client does).
+type sourceTCP struct {
+	n int
+}
+
+func (h *sourceTCP) Proxy(conn *GTCPConn, _, _ netip.AddrPort) bool {
+	if open, err := conn.Connect(false); !open || err != nil {
+		return false
+	}
+	defer conn.Close()
+	b := make([]byte, 64<<10) // a multiple of 256
+	for i := range b {
+		b[i] = byte(i)
+	}
+	for sent := 0; sent < h.n; {
+		sz := min(len(b), h.n-sent)
+		if _, err := conn.Write(b[:sz]); err != nil {
+			return false
+		}
+		sent += sz
+	}
+	_ = conn.CloseWrite()
+	_, _ = io.Copy(io.Discard, conn) // as Close aborts
+	return true
+}
+func (h *sourceTCP) CloseConns([]string) []string { return nil }
+func (h *sourceTCP) End() error                   { return nil }
+
+// pcapCounter counts pcap records of packets sent to dst.
+type pcapCounter struct {
+	sync.Mutex
+	dst     [4]byte
+	hdr     bool // pcap file header seen
+	records int
+}
+
+func (p *pcapCounter) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.hdr { // sniffer writes the file header on its own
+		p.hdr = true
+		return len(b), nil
+	}
+	// record: ts sec, ts usec, incl len, orig len; then the ip packet
+	if len(b) >= 16+20 && [4]byte(b[16+16:16+20]) == p.dst {
+		p.records++
+	}
+	return len(b), nil
+}
+func (p *pcapCounter) Close() error { return nil }
+
+func (p *pcapCounter) count() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.records
+}
+
+// fdPair is tunPair over a socketpair, with the tun side an endpoint from
+// NewEndpoint (sniffer, coalescer, fdbased) that writes pcap to sink. The
+// client reads packets off its end in order, as the kernel does from tun.
+func fdPair(tb testing.TB, sink io.WriteCloser, h GTCPConnHandler) (client *stack.Stack) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, fd := range fds {
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, 4<<20)
+	}
+	if sniffer.LogPackets.Load() == 1 { // on by default; slows things down
+		LogPcap(false)
+		tb.Cleanup(func() { LogPcap(true) })
+	}
+	sep, err := NewEndpoint(fds[0], 1500, sink)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	cfd := fds[1]
+	cep := channel.New(1024, 1500, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { // tun -> client
+		b := make([]byte, 1500)
+		for {
+			n, err := unix.Read(cfd, b)
+			if err != nil || n <= 0 {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(slices.Clone(b[:n])),
+			})
+			cep.InjectInbound(ipv4.ProtocolNumber, pkt)
+			pkt.DecRef()
+		}
+	}()
+	go func() { // client -> tun
+		for {
+			pkt := cep.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			_, _ = unix.Write(cfd, pkt.ToView().AsSlice())
+			pkt.DecRef()
+		}
+	}()
+	tb.Cleanup(func() { // after stacks are destroyed
+		cancel()
+		_ = unix.Shutdown(cfd, unix.SHUT_RDWR)
+		unix.Close(fds[0])
+		unix.Close(cfd)
+	})
+	return linkPair(tb, sep, cep, func(s *stack.Stack) {
+		setupTcpHandler(s, h)
+	})
+}
+
+// download reads from a new conn from client till eof, and returns bytes
+// read, or -1 if they are not in order (checked only if verify is set).
+func download(tb testing.TB, client *stack.Stack, verify bool) int {
+	c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 5201}, ipv4.ProtocolNumber)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer c.Close()
+	b := make([]byte, 64<<10)
+	got := 0
+	for {
+		n, err := c.Read(b)
+		for i := range b[:n] {
+			if !verify {
+				break
+			}
+			if b[i] != byte(got+i) {
+				return -1
+			}
+		}
+		got += n
+		if err == io.EOF {
+			return got
+		} else if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func writeStats(tb testing.TB) (w WriteStats) {
+	if err := json.Unmarshal([]byte(GetWriteStats(true)), &w); err != nil {
+		tb.Fatal(err)
+	}
+	return
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	pcap := &pcapCounter{dst: iperfClient.As4()}
+	FilePcap(true)
+	defer FilePcap(false)
+	defer SetTCPOptions(nil, nil)
+
+	const n = 4 << 20
+	client := fdPair(t, pcap, &sourceTCP{n: n})
+
+	for _, on := range []bool{true, false} {
+		CoalesceWrites(on)
+		_ = writeStats(t) // reset
+		before := pcap.count()
+
+		if got := download(t, client, true); got != n {
+			t.Fatalf("coalesce(%t): want %d bytes in order, got %d", on, n, got)
+		}
+		w := writeStats(t)
+		if w.Coalesce != on || w.Batches <= 0 {
+			t.Fatalf("coalesce(%t): bad stats %+v", on, w)
+		}
+		// every packet written to the tun device is seen by the sniffer
+		if seen := pcap.count() - before; int64(seen) < w.Packets {
+			t.Errorf("coalesce(%t): pcap saw %d of %d packets", on, seen, w.Packets)
+		}
+		if !on && w.Max > 1 { // tcp sends one segment per write
+			t.Errorf("coalesce(%t): batched %d packets", on, w.Max)
+		}
+		t.Logf("coalesce(%t): %d pkts in %d batches; max %d, hist %v", on, w.Packets, w.Batches, w.Max, w.Hist)
+	}
+	CoalesceWrites(true)
+	if sniffer.LogPacketsToPCAP.Load() != 1 {
+		t.Errorf("coalesce: pcap unset")
+	}
+}
+
+// throughput of downloads over a socketpair standing in for the tun
+// device, with and without coalescing; go test -bench TunWrite
+
+func benchmarkTunWrite(b *testing.B, coalesce bool) {
+	CoalesceWrites(coalesce)
+	defer CoalesceWrites(true)
+	if err := SetTCPOptions(nil, settings.DefaultTCPOptions()); err != nil {
+		b.Fatal(err)
+	}
+	defer SetTCPOptions(nil, nil)
+
+	client := fdPair(b, &pcapCounter{}, &sourceTCP{n: iperfBytes})
+	_ = writeStats(b) // reset
+	b.SetBytes(iperfBytes)
+	b.ResetTimer()
+	for range b.N {
+		if got := download(b, client, false); got != iperfBytes {
+			b.Fatalf("coalesce(%t): want %d bytes, got %d", coalesce, iperfBytes, got)
+		}
+	}
+	b.StopTimer()
+	if w := writeStats(b); w.Batches > 0 {
+		b.ReportMetric(float64(w.Packets)/float64(w.Batches), "pkts/batch")
+	}
+}
+
+func BenchmarkTunWriteCoalesced(b *testing.B) {
+	benchmarkTunWrite(b, true)
+}
+
+func BenchmarkTunWriteUncoalesced(b *testing.B) {
+	benchmarkTunWrite(b, false)
+}
+
+var (
+	tunLocal = netip.MustParseAddr("10.111.223.1") // kernel's end of the tun
+	tunPeer  = netip.MustParseAddrPort("10.111.223.3:5201")
+)
+
+// openTun creates a tun device at tunLocal/24, or skips tb if it cannot
+// (ex: sans CAP_NET_ADMIN). The device goes away once its fd is closed.
+func openTun(tb testing.TB) int {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		tb.Skipf("tun: %v", err)
+	}
+	ifr, _ := unix.NewIfreq("fstest%d")
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		tb.Skipf("tun: setiff: %v", err)
+	}
+	s, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		unix.Close(fd)
+		tb.Fatal(err)
+	}
+	defer unix.Close(s)
+
+	name := ifr.Name()
+	up := func() error {
+		r, _ := unix.NewIfreq(name)
+		if err := r.SetInet4Addr(tunLocal.AsSlice()); err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(s, unix.SIOCSIFADDR, r); err != nil {
+			return err
+		}
+		_ = r.SetInet4Addr([]byte{255, 255, 255, 0})
+		if err := unix.IoctlIfreq(s, unix.SIOCSIFNETMASK, r); err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(s, unix.SIOCGIFFLAGS, r); err != nil {
+			return err
+		}
+		r.SetUint16(r.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+		return unix.IoctlIfreq(s, unix.SIOCSIFFLAGS, r)
+	}
+	if err := up(); err != nil {
+		unix.Close(fd)
+		tb.Skipf("tun: %s: up: %v", name, err)
+	}
+	return fd
+}
+
+// realTun serves h on a tun device, over the endpoint NewEndpoint makes of
+// it, but one that batches writes if batch is set.
+func realTun(tb testing.TB, h GTCPConnHandler, batch bool) {
+	fd := openTun(tb)
+	if sniffer.LogPackets.Load() == 1 {
+		LogPcap(false)
+		tb.Cleanup(func() { LogPcap(true) })
+	}
+	if sock, _ := isSocketFD(fd); sock {
+		tb.Fatal("tun: is a socket")
+	}
+	ep, err := NewFdbasedInjectableEndpoint(&Options{FDs: []int{fd}, MTU: 1500})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ep = newCoalescer(newRetrier(ep), batch)
+	if ep, err = sniffer.NewWithWriter(ep, &pcapCounter{}, 1500); err != nil {
+		tb.Fatal(err)
+	}
+
+	s := NewNetstack()
+	setupTcpHandler(s, h)
+	if err := applyTCPOptions(s, tcpopts.Load()); err != nil {
+		tb.Fatal(err)
+	}
+	if err := e(s.CreateNIC(settings.NICID, newClamper(ep))); err != nil {
+		tb.Fatal(err)
+	}
+	_ = s.SetSpoofing(settings.NICID, true)
+	_ = s.SetPromiscuousMode(settings.NICID, true)
+	Route(s, settings.IP4)
+	tb.Cleanup(func() {
+		s.Destroy()
+		unix.Close(fd)
+	})
+}
+
+// download over the kernel's tcp from tunPeer till eof; returns bytes read.
+func kdownload(tb testing.TB) int {
+	c, err := net.DialTimeout("tcp", tunPeer.String(), 5*time.Second)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer c.Close()
+	n, err := io.Copy(io.Discard, c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return int(n)
+}
+
+func TestCoalesceSkipsTun(t *testing.T) {
+	defer SetTCPOptions(nil, nil)
+	const n = 1 << 20
+	fd := openTun(t)
+	ep, err := NewEndpoint(fd, 1500, &pcapCounter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewNetstack()
+	setupTcpHandler(s, &sourceTCP{n: n})
+	if err := e(s.CreateNIC(settings.NICID, ep)); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.SetSpoofing(settings.NICID, true)
+	_ = s.SetPromiscuousMode(settings.NICID, true)
+	Route(s, settings.IP4)
+	defer func() {
+		s.Destroy()
+		unix.Close(fd)
+	}()
+
+	CoalesceWrites(true)
+	_ = writeStats(t) // reset
+	if got := kdownload(t); got != n {
+		t.Fatalf("tun: want %d bytes, got %d", n, got)
+	}
+	// each packet is written as it is sent, yet counted
+	if w := writeStats(t); w.Batches <= 0 || w.Max != 1 || w.Batches != w.Packets {
+		t.Errorf("tun: batched writes: %+v", w)
+	}
+}
+
+// throughput of downloads over a real tun device (needs CAP_NET_ADMIN),
+// with writes batched as they would be for sockets, and as they are for
+// tun devices; go test -bench RealTun
+
+func benchmarkRealTun(b *testing.B, batch bool) {
+	if err := SetTCPOptions(nil, settings.DefaultTCPOptions()); err != nil {
+		b.Fatal(err)
+	}
+	defer SetTCPOptions(nil, nil)
+
+	realTun(b, &sourceTCP{n: iperfBytes}, batch)
+	_ = writeStats(b) // reset
+	b.SetBytes(iperfBytes)
+	b.ResetTimer()
+	for range b.N {
+		if got := kdownload(b); got != iperfBytes {
+			b.Fatalf("tun: batch(%t): want %d bytes, got %d", batch, iperfBytes, got)
+		}
+	}
+	b.StopTimer()
+	if w := writeStats(b); w.Batches > 0 {
+		b.ReportMetric(float64(w.Packets)/float64(w.Batches), "pkts/batch")
+	}
+}
+
+func BenchmarkRealTunBatched(b *testing.B) {
+	benchmarkRealTun(b, true)
+}
+
+func BenchmarkRealTunUnbatched(b *testing.B) {
+	benchmarkRealTun(b, false)
+}
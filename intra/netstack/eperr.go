@@ -0,0 +1,176 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/log"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// Categories of errors creating netstack endpoints for new flows.
+const (
+	EpNoRoute   = "no-route"  // no route for the flow's family
+	EpNoPort    = "no-port"   // ports exhausted, or in use
+	EpResources = "resources" // stack out of buffers, or at its limits
+	EpState     = "state"     // syn gone stale, or its flow torn down
+	EpOther     = "other"
+)
+
+var epcats = []string{EpNoRoute, EpNoPort, EpResources, EpState, EpOther}
+
+// ErrEndpoint is what all EndpointErrors are; see: errors.Is
+var ErrEndpoint = errors.New("ns: endpoint")
+
+// fwdreq is the part of tcp.ForwarderRequest that GTCPConn uses; so that
+// tests may stub it out.
+type fwdreq interface {
+	ID() stack.TransportEndpointID
+	CreateEndpoint(*waiter.Queue) (tcpip.Endpoint, tcpip.Error)
+	Complete(rst bool)
+}
+
+// EndpointError is returned when netstack can't create an endpoint for a
+// new flow; Cat is one of the Ep* categories. Routed lists families ("v4",
+// "v6") the stack had routes for, if Cat is EpNoRoute.
+type EndpointError struct {
+	Cat    string
+	Routed string
+	Err    tcpip.Error
+}
+
+var _ error = (*EndpointError)(nil)
+
+func (e *EndpointError) Error() string {
+	if e.Cat == EpNoRoute {
+		return "ns: endpoint: " + e.Cat + ": " + e.Err.String() + "; routes: " + e.Routed
+	}
+	return "ns: endpoint: " + e.Cat + ": " + e.Err.String()
+}
+
+func (e *EndpointError) Unwrap() error { return ErrEndpoint }
+
+// EndpointErrCat returns the category of err, if it is an EndpointError.
+func EndpointErrCat(err error) (cat string, ok bool) {
+	var ee *EndpointError
+	if errors.As(err, &ee) {
+		return ee.Cat, true
+	}
+	return "", false
+}
+
+// epCat classifies err returned by CreateEndpoint.
+func epCat(err tcpip.Error) string {
+	switch err.(type) {
+	case *tcpip.ErrNetworkUnreachable, *tcpip.ErrHostUnreachable,
+		*tcpip.ErrNoNet, *tcpip.ErrAddressFamilyNotSupported, *tcpip.ErrBadLocalAddress:
+		return EpNoRoute
+	case *tcpip.ErrNoPortAvailable, *tcpip.ErrPortInUse, *tcpip.ErrDuplicateAddress,
+		*tcpip.ErrAlreadyBound:
+		return EpNoPort
+	case *tcpip.ErrNoBufferSpace, *tcpip.ErrWouldBlock, *tcpip.ErrQueueSizeNotSupported:
+		return EpResources
+	case *tcpip.ErrInvalidEndpointState, *tcpip.ErrConnectionAborted, *tcpip.ErrConnectionReset,
+		*tcpip.ErrConnectionRefused, *tcpip.ErrAborted, *tcpip.ErrTimeout:
+		return EpState
+	}
+	return EpOther
+}
+
+// routedFamilies returns families s has routes for, as csv; "none" if none.
+func routedFamilies(s *stack.Stack) string {
+	if s == nil {
+		return "unknown"
+	}
+	var v4, v6 bool
+	for _, r := range s.GetRouteTable() {
+		switch r.Destination.ID().Len() {
+		case 4:
+			v4 = true
+		case 16:
+			v6 = true
+		}
+	}
+	switch {
+	case v4 && v6:
+		return "v4,v6"
+	case v4:
+		return "v4"
+	case v6:
+		return "v6"
+	}
+	return "none"
+}
+
+// endpointErr classifies err, counts it, and returns it as an EndpointError.
+func endpointErr(s *stack.Stack, err tcpip.Error) error {
+	ee := &EndpointError{Cat: epCat(err), Err: err}
+	if ee.Cat == EpNoRoute {
+		ee.Routed = routedFamilies(s)
+	}
+	epstats.add(ee.Cat)
+	return ee
+}
+
+// EndpointErrs are counts of endpoints netstack failed to create, by
+// category, since the last reset.
+type EndpointErrs struct {
+	NoRoute   int64 `json:"noroute"`
+	NoPort    int64 `json:"noport"`
+	Resources int64 `json:"resources"`
+	State     int64 `json:"state"`
+	Other     int64 `json:"other"`
+}
+
+type endpointstats [5]atomic.Int64 // indexed as epcats
+
+var epstats endpointstats
+
+func (s *endpointstats) add(cat string) {
+	for i, c := range epcats {
+		if c == cat {
+			s[i].Add(1)
+			return
+		}
+	}
+}
+
+func (s *endpointstats) get() EndpointErrs {
+	return EndpointErrs{
+		NoRoute:   s[0].Load(),
+		NoPort:    s[1].Load(),
+		Resources: s[2].Load(),
+		State:     s[3].Load(),
+		Other:     s[4].Load(),
+	}
+}
+
+func (s *endpointstats) reset() {
+	for i := range s {
+		s[i].Store(0)
+	}
+}
+
+// GetEndpointErrors returns json of EndpointErrs; and resets them if reset
+// is set.
+func GetEndpointErrors(reset bool) string {
+	w := epstats.get()
+	if reset {
+		epstats.reset()
+	}
+	b, err := json.Marshal(w)
+	if err != nil {
+		log.W("netstack: endpoint errs: %v", err)
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// failreq fails CreateEndpoint with err, as tcp.ForwarderRequest would.
+type failreq struct {
+	err tcpip.Error
+	rst bool
+}
+
+func (r *failreq) ID() stack.TransportEndpointID { return stack.TransportEndpointID{} }
+func (r *failreq) Complete(rst bool)             { r.rst = rst }
+func (r *failreq) CreateEndpoint(*waiter.Queue) (tcpip.Endpoint, tcpip.Error) {
+	return nil, r.err
+}
+
+func TestEndpointErrors(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+	})
+	defer s.Destroy()
+	Route(s, settings.IP6) // a v6-only device
+
+	tests := []struct {
+		err tcpip.Error
+		cat string
+	}{
+		{&tcpip.ErrHostUnreachable{}, EpNoRoute},
+		{&tcpip.ErrNetworkUnreachable{}, EpNoRoute},
+		{&tcpip.ErrNoPortAvailable{}, EpNoPort},
+		{&tcpip.ErrNoBufferSpace{}, EpResources},
+		{&tcpip.ErrInvalidEndpointState{}, EpState},
+		{&tcpip.ErrNotSupported{}, EpOther},
+	}
+
+	GetEndpointErrors(true)
+	for _, tc := range tests {
+		req := &failreq{err: tc.err}
+		g := &GTCPConn{req: req, s: s, src: netip.MustParseAddrPort("10.1.1.1:4000"),
+			dst: netip.MustParseAddrPort("1.1.1.1:443")}
+		open, err := g.Connect(false)
+		if open || !req.rst {
+			t.Errorf("%s: open? %t, rst? %t", tc.cat, open, req.rst)
+		}
+		// as intra wraps it, before it sets it on the flow's summary
+		err = fmt.Errorf("tcp: connect err %w", err)
+		if !errors.Is(err, ErrEndpoint) {
+			t.Errorf("%T: not an endpoint err: %v", tc.err, err)
+		}
+		cat, ok := EndpointErrCat(err)
+		if !ok || cat != tc.cat {
+			t.Errorf("%T: got %s (%t); want %s", tc.err, cat, ok, tc.cat)
+		}
+		var ee *EndpointError
+		if errors.As(err, &ee) && ee.Cat == EpNoRoute && ee.Routed != "v6" {
+			t.Errorf("no-route: want routed families v6 in %q", err)
+		}
+	}
+
+	// stacks are not known to all callers
+	if err := endpointErr(nil, &tcpip.ErrHostUnreachable{}); !strings.HasSuffix(err.Error(), "routes: unknown") {
+		t.Errorf("no-route: sans stack: %q", err)
+	}
+
+	var got EndpointErrs
+	if err := json.Unmarshal([]byte(GetEndpointErrors(true)), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := EndpointErrs{NoRoute: 3, NoPort: 1, Resources: 1, State: 1, Other: 1}
+	if got != want {
+		t.Errorf("stats: got %+v; want %+v", got, want)
+	}
+	if GetEndpointErrors(false) != `{"noroute":0,"noport":0,"resources":0,"state":0,"other":0}` {
+		t.Errorf("stats: not reset")
+	}
+}
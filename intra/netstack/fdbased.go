@@ -31,6 +31,7 @@ package netstack
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/celzero/firestack/intra/log"
 	"golang.org/x/sys/unix"
@@ -53,7 +54,8 @@ type linkDispatcher interface {
 }
 
 type fdInfo struct {
-	fd int
+	fd       int
+	isSocket bool
 }
 
 type endpoint struct {
@@ -196,7 +198,11 @@ func NewFdbasedInjectableEndpoint(opts *Options) (stack.LinkEndpoint, error) {
 			return nil, fmt.Errorf("unix.SetNonblock(%v) failed: %v", fd, err)
 		}
 
-		e.fds = append(e.fds, fdInfo{fd: fd})
+		isSocket, err := isSocketFD(fd)
+		if err != nil {
+			return nil, err
+		}
+		e.fds = append(e.fds, fdInfo{fd: fd, isSocket: isSocket})
 
 		d, err := createInboundDispatcher(e, fd)
 		if err != nil {
@@ -208,6 +214,14 @@ func NewFdbasedInjectableEndpoint(opts *Options) (stack.LinkEndpoint, error) {
 	return e, nil
 }
 
+func isSocketFD(fd int) (bool, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return false, fmt.Errorf("unix.Fstat(%v,...) failed: %v", fd, err)
+	}
+	return (stat.Mode & unix.S_IFSOCK) == unix.S_IFSOCK, nil
+}
+
 func createInboundDispatcher(e *endpoint, fd int) (linkDispatcher, error) {
 	// By default use the readv() dispatcher as it works with all kinds of
 	// FDs (tap/tun/unix domain sockets and af_packet).
@@ -328,47 +342,102 @@ func (e *endpoint) logPacketIfNeeded(dir sniffer.Direction, pkt *stack.PacketBuf
 	}
 }
 
-// writePackets writes outbound packets to the file descriptor. If it is not
-// currently writable, the packet is dropped.
-// Way more simplified than og impl, ref: github.com/google/gvisor/issues/7125
-func (e *endpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
-	// Preallocate to avoid repeated reallocation as we append to batch.
-	// batchSz is 47 because when SWGSO is in use then a single 65KB TCP
-	// segment can get split into 46 segments of 1420 bytes and a single 216
-	// byte segment.
-	const batchSz = 47
-	fd := e.fds[0].fd
-	batch := make([]unix.Iovec, 0, batchSz)
-	packets, written := 0, 0
-	total := pkts.Len()
-	for _, pkt := range pkts.AsSlice() {
-		e.logPacketIfNeeded(sniffer.DirectionSend, pkt)
-		views := pkt.AsSlices()
-		numIovecs := len(views)
-		if len(batch)+numIovecs > rawfile.MaxIovs {
-			// writes in to fd, up to len(batch) not cap(batch)
-			if err := rawfile.NonBlockingWriteIovec(fd, batch); err != nil {
-				log.W("ns: WritePackets (to tun): err(%v), sent(%d)/total(%d)", err, written, total)
+// writePacket writes pkt to fd in one writev, which a tun device (or any
+// boundary-preserving fd) sees as one packet.
+func (e *endpoint) writePacket(fd int, pkt *stack.PacketBuffer) tcpip.Error {
+	views := pkt.AsSlices()
+	batch := make([]unix.Iovec, 0, len(views))
+	for _, v := range views {
+		batch = rawfile.AppendIovecFromBytes(batch, v, e.writevMaxIovs)
+	}
+	return rawfile.NonBlockingWriteIovec(fd, batch)
+}
+
+// sendBatch writes pkts to fd; in one sendmmsg if fd is a socket, or else
+// in one writev for each packet, as tun devices take only one per write.
+// If fd is not writable, waits on it for up to wait in all, if positive.
+// ref: github.com/google/gvisor/blob/ee1e1f607/pkg/tcpip/link/fdbased/endpoint.go#L597
+func (e *endpoint) sendBatch(fdi fdInfo, pkts []*stack.PacketBuffer, wait time.Duration) (int, tcpip.Error) {
+	deadline := time.Now().Add(wait)
+	// waitable returns true if fd turned writable before deadline
+	waitable := func(err tcpip.Error) bool {
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok || wait <= 0 {
+			return false
+		}
+		ms := time.Until(deadline).Milliseconds()
+		if ms <= 0 {
+			return false
+		}
+		pfd := []unix.PollFd{{Fd: int32(fdi.fd), Events: unix.POLLOUT}}
+		n, perr := unix.Poll(pfd, int(ms))
+		return perr == nil && n > 0
+	}
+
+	written := 0
+	if !fdi.isSocket || len(pkts) == 1 {
+		for written < len(pkts) {
+			if err := e.writePacket(fdi.fd, pkts[written]); err != nil {
+				if waitable(err) {
+					continue
+				}
 				return written, err
 			}
-			// mark processed packets as written
-			written += packets
-			// truncate batch
-			batch = batch[:0]
-			// reset processed packets count
-			packets = 0
+			written++
 		}
+		return written, nil
+	}
+
+	mmsgHdrs := make([]rawfile.MMsgHdr, 0, len(pkts))
+	for _, pkt := range pkts {
+		views := pkt.AsSlices()
+		numIovecs := min(len(views), rawfile.MaxIovs)
+		// iovecs escape this iteration via mmsgHdrs
+		iovecs := make([]unix.Iovec, 0, numIovecs)
 		for _, v := range views {
-			batch = rawfile.AppendIovecFromBytes(batch, v, rawfile.MaxIovs)
+			iovecs = rawfile.AppendIovecFromBytes(iovecs, v, numIovecs)
 		}
-		packets += 1
+		var mmsgHdr rawfile.MMsgHdr
+		mmsgHdr.Msg.Iov = &iovecs[0]
+		mmsgHdr.Msg.SetIovlen(len(iovecs))
+		mmsgHdrs = append(mmsgHdrs, mmsgHdr)
 	}
-	if len(batch) > 0 {
-		if err := rawfile.NonBlockingWriteIovec(fd, batch); err != nil {
-			log.W("ns: WritePackets (to tun): err(%v), sent(%d)/total(%d)", err, packets, total)
+	for len(mmsgHdrs) > 0 {
+		sent, err := rawfile.NonBlockingSendMMsg(fdi.fd, mmsgHdrs)
+		if err != nil {
+			if waitable(err) {
+				continue
+			}
 			return written, err
 		}
-		written += packets
+		written += sent
+		mmsgHdrs = mmsgHdrs[sent:]
+	}
+	return written, nil
+}
+
+// WritePackets writes outbound packets to the file descriptor. If it is not
+// currently writable, the packet is dropped.
+// Way more simplified than og impl, ref: github.com/google/gvisor/issues/7125
+func (e *endpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	return e.writePackets(pkts, 0)
+}
+
+// writePacketsWait implements waitWriter. It is WritePackets that waits
+// up to d for the file descriptor to be writable, before dropping packets.
+func (e *endpoint) writePacketsWait(pkts stack.PacketBufferList, d time.Duration) (int, tcpip.Error) {
+	return e.writePackets(pkts, d)
+}
+
+func (e *endpoint) writePackets(pkts stack.PacketBufferList, wait time.Duration) (int, tcpip.Error) {
+	total := pkts.Len()
+	all := pkts.AsSlice()
+	for _, pkt := range all {
+		e.logPacketIfNeeded(sniffer.DirectionSend, pkt)
+	}
+	written, err := e.sendBatch(e.fds[0], all, wait)
+	if err != nil {
+		log.W("ns: WritePackets (to tun): err(%v), sent(%d)/total(%d)", err, written, total)
+		return written, err
 	}
 
 	log.V("ns: WritePackets (to tun): written(%d)/total(%d)", written, total)
@@ -398,7 +467,9 @@ func (e *endpoint) ARPHardwareType() header.ARPHardwareType {
 // InjectInbound ingresses a netstack-inbound packet.
 func (e *endpoint) InjectInbound(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
 	log.V("ns: inject-inbound (from tun) %d", protocol)
-	d := e.dispatcher // TODO: read lock?
+	e.RLock()
+	d := e.dispatcher
+	e.RUnlock()
 	if d != nil && pkt != nil {
 		e.logPacketIfNeeded(sniffer.DirectionRecv, pkt)
 		d.DeliverNetworkPacket(protocol, pkt)
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sync/atomic"
+	"time"
 
 	"github.com/celzero/firestack/intra/log"
 	neticmp "golang.org/x/net/icmp"
@@ -44,15 +46,25 @@ const (
 	// ...
 )
 
+const (
+	// max echoes queued per ip family; more are dropped
+	icmpqlen = 64
+	// max echoes in-flight upstream across ip families
+	icmpmaxinflight = 64
+	// max wait for an upstream ping to complete
+	icmptimeout = 10 * time.Second
+)
+
 // from: github.com/sandialabs/wiretap/blob/3ba102719/src/transport/icmp/icmp.go
 
 type icmpv2 struct {
 	*preroutingMatch
-	ep    stack.LinkEndpoint
-	s     *stack.Stack
-	h     GICMPHandler
-	rule4 stack.Rule
-	rule6 stack.Rule
+	ep       stack.LinkEndpoint
+	s        *stack.Stack
+	h        GICMPHandler
+	rule4    stack.Rule
+	rule6    stack.Rule
+	inflight chan struct{} // semaphore for upstream pings
 }
 
 // preroutingMatch matches packets in the prerouting stage and clones:
@@ -60,6 +72,7 @@ type icmpv2 struct {
 type preroutingMatch struct {
 	msgs4 chan *stack.PacketBuffer
 	msgs6 chan *stack.PacketBuffer
+	drops *atomic.Uint64 // echoes dropped as msgs4 / msgs6 were full
 }
 
 // When a new ICMP message hits the prerouting stage, the packet is cloned
@@ -75,10 +88,10 @@ func (m preroutingMatch) Match(hook stack.Hook, packet *stack.PacketBuffer, inpu
 		// only drop if the packet is an ICMP echo request.
 		m4, m6 := isIcmpEcho(packet)
 		if m4 {
-			m.msgs4 <- packet.Clone()
+			m.enqueue(m.msgs4, packet)
 			return !ok, drop
 		} else if m6 {
-			m.msgs6 <- packet.Clone()
+			m.enqueue(m.msgs6, packet)
 			return !ok, drop
 		} else {
 			log.D("icmpv2: not an echo request; let netstack handle it...")
@@ -87,6 +100,19 @@ func (m preroutingMatch) Match(hook stack.Hook, packet *stack.PacketBuffer, inpu
 	return !ok, !drop
 }
 
+// enqueue sends a clone of packet to msgs, or drops it if msgs is full;
+// Match runs within netstack's packet processing, and must never block.
+func (m preroutingMatch) enqueue(msgs chan<- *stack.PacketBuffer, packet *stack.PacketBuffer) {
+	clone := packet.Clone()
+	select {
+	case msgs <- clone:
+	default:
+		clone.DecRef()
+		n := m.drops.Add(1)
+		log.W("icmpv2: queue full; dropped echo; total drops: %d", n)
+	}
+}
+
 // handleICMP proxies ICMP messages using whatever means it can with the permissions this binary
 // has on the system.
 func setupIcmpHandlerV2(s *stack.Stack, ep stack.LinkEndpoint, icmpHandler GICMPHandler) {
@@ -102,8 +128,9 @@ func setupIcmpHandlerV2(s *stack.Stack, ep stack.LinkEndpoint, icmpHandler GICMP
 	}
 
 	match := preroutingMatch{
-		msgs4: make(chan *stack.PacketBuffer),
-		msgs6: make(chan *stack.PacketBuffer),
+		msgs4: make(chan *stack.PacketBuffer, icmpqlen),
+		msgs6: make(chan *stack.PacketBuffer, icmpqlen),
+		drops: new(atomic.Uint64),
 	}
 
 	rule4 := stack.Rule{
@@ -129,6 +156,7 @@ func setupIcmpHandlerV2(s *stack.Stack, ep stack.LinkEndpoint, icmpHandler GICMP
 		h:               icmpHandler,
 		rule4:           rule4,
 		rule6:           rule6,
+		inflight:        make(chan struct{}, icmpmaxinflight),
 	}
 
 	tr.trap()
@@ -150,25 +178,42 @@ func (tr *icmpv2) trap() {
 	table6.Rules = append([]stack.Rule{tr.rule6}, table6.Rules...)
 	// replace the existing rules table
 	tr.s.IPTables().ReplaceTable(tid, table4, for4)
-	tr.s.IPTables().ReplaceTable(tid, table4, for6)
+	tr.s.IPTables().ReplaceTable(tid, table6, for6)
 }
 
+// serve4 handles echoes from msgs4 until ep detaches; ep may not be
+// attached yet when serve4 starts, but it is by the time echoes arrive.
 func (tr *icmpv2) serve4() {
-	for tr.ep.IsAttached() {
-		pkt := <-tr.msgs4
+	for pkt := range tr.msgs4 {
+		if !tr.ep.IsAttached() {
+			pkt.DecRef()
+			break
+		}
+		// waits for a slot; Match drops echoes as msgs4 fills up
+		tr.inflight <- struct{}{}
 		go tr.handleEcho4(pkt)
 	}
 	log.I("icmpv2: serve4: stop; ep detached")
 }
 
+// serve6 is serve4 for msgs6.
 func (tr *icmpv2) serve6() {
-	for tr.ep.IsAttached() {
-		pkt := <-tr.msgs6
+	for pkt := range tr.msgs6 {
+		if !tr.ep.IsAttached() {
+			pkt.DecRef()
+			break
+		}
+		tr.inflight <- struct{}{}
 		go tr.handleEcho6(pkt)
 	}
 	log.I("icmpv2: serve6: stop; ep detached")
 }
 
+// done releases a slot taken by serve4 / serve6.
+func (tr *icmpv2) done() {
+	<-tr.inflight
+}
+
 // handleICMPMessage parses ICMP packets and proxies them if possible.
 func isIcmpEcho(pkt *stack.PacketBuffer) (y4, y6 bool) {
 	if pkt == nil {
@@ -209,6 +254,7 @@ func isIcmpEcho(pkt *stack.PacketBuffer) (y4, y6 bool) {
 func (tr *icmpv2) handleEcho4(pkt *stack.PacketBuffer) {
 	if pkt == nil {
 		log.W("icmpv2: echo4 packet nil")
+		tr.done()
 		return
 	}
 
@@ -223,9 +269,10 @@ func (tr *icmpv2) handleEcho4(pkt *stack.PacketBuffer) {
 	tr.handleEcho(src, dst, pkt)
 }
 
-func (tr icmpv2) handleEcho6(pkt *stack.PacketBuffer) {
+func (tr *icmpv2) handleEcho6(pkt *stack.PacketBuffer) {
 	if pkt == nil {
 		log.W("icmpv2: echo6 packet nil")
+		tr.done()
 		return
 	}
 
@@ -241,15 +288,30 @@ func (tr icmpv2) handleEcho6(pkt *stack.PacketBuffer) {
 }
 
 // handleICMPEcho tries to send ICMP echo requests to the true destination however it can.
-// If successful, it sends an echo response to the peer.
+// If successful, it sends an echo response to the peer. Releases the slot taken by serve.
 func (tr *icmpv2) handleEcho(src, dst netip.AddrPort, pkt *stack.PacketBuffer) {
 	if pkt == nil {
 		log.W("icmpv2: ICMP echo request packet is nil")
+		tr.done()
 		return
 	}
 
+	msg := tr.pkt2bytes(pkt)
+	pong := make(chan bool, 1)
+	go func() {
+		// the slot is held until the upstream ping returns, and so,
+		// wedged pings eventually stall serve instead of piling up
+		defer tr.done()
+		pong <- tr.h.PingOnce(src, dst, msg)
+	}()
+
 	var ok bool
-	if ok = tr.h.PingOnce(src, dst, tr.pkt2bytes(pkt)); !ok {
+	select {
+	case ok = <-pong:
+	case <-time.After(icmptimeout):
+		log.W("icmpv2: ICMP echo ping timed out for %v -> %v", src, dst)
+	}
+	if !ok {
 		log.W("icmpv2: ICMP echo ping failed for %v -> %v", src, dst)
 		tr.sendUnreachable(dst, src, pkt)
 	} else {
@@ -364,7 +426,7 @@ func (tr *icmpv2) sendUnreachable(src, dst netip.AddrPort, pkt *stack.PacketBuff
 	const code = NetworkUnreachable
 	netHeader := pkt.Network()
 
-	isip4 := !is4(netHeader.DestinationAddress().String())
+	isip4 := is4(netHeader.DestinationAddress().String())
 
 	if isip4 {
 		l4 := header.ICMPv4(netHeader.Payload())
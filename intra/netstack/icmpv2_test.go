@@ -0,0 +1,146 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+)
+
+type fakePinger struct {
+	pings chan netip.AddrPort // dst of each ping
+}
+
+func (h *fakePinger) Ping(_, _ netip.AddrPort, _ []byte, _ Pong) bool { return false }
+func (h *fakePinger) CloseConns([]string) []string                    { return nil }
+func (h *fakePinger) End() error                                      { return nil }
+
+func (h *fakePinger) PingOnce(_, dst netip.AddrPort, _ []byte) bool {
+	h.pings <- dst
+	return true
+}
+
+func echo6(src, dst tcpip.Address) *stack.PacketBuffer {
+	const payload = "icmpv2"
+	l4 := header.ICMPv6(make([]byte, header.ICMPv6EchoMinimumSize+len(payload)))
+	l4.SetType(header.ICMPv6EchoRequest)
+	l4.SetIdent(7)
+	l4.SetSequence(1)
+	copy(l4.Payload(), payload)
+	l4.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: l4, Src: src, Dst: dst}))
+
+	b := make([]byte, header.IPv6MinimumSize+len(l4))
+	header.IPv6(b).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(l4)),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	copy(b[header.IPv6MinimumSize:], l4)
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+}
+
+// ICMPv6 echoes must be trapped by the v6 table, and answered on behalf of dst.
+func TestIcmpv2Echo6(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	defer s.Close()
+	ep := channel.New(8, 1500, "")
+	h := &fakePinger{pings: make(chan netip.AddrPort, 1)}
+
+	setupIcmpHandlerV2(s, ep, h)
+
+	const nic = 1
+	if err := s.CreateNIC(nic, ep); err != nil {
+		t.Fatal(err)
+	}
+	s.SetPromiscuousMode(nic, true)
+	s.SetSpoofing(nic, true)
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv6EmptySubnet, NIC: nic}})
+
+	src := tcpip.AddrFrom16Slice(netip.MustParseAddr("fd00::2").AsSlice())
+	dst := tcpip.AddrFrom16Slice(netip.MustParseAddr("2001:db8::1").AsSlice())
+	pkt := echo6(src, dst)
+	ep.InjectInbound(header.IPv6ProtocolNumber, pkt)
+	pkt.DecRef()
+
+	select {
+	case got := <-h.pings:
+		if got.Addr() != netip.MustParseAddr("2001:db8::1") {
+			t.Fatalf("icmpv2: ping to %v, want 2001:db8::1", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("icmpv2: echo6 not trapped")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := ep.ReadContext(ctx)
+	if res == nil {
+		t.Fatal("icmpv2: no echo6 reply")
+	}
+	defer res.DecRef()
+	b := res.ToView().AsSlice()
+	ip6 := header.IPv6(b)
+	if ip6.SourceAddress() != dst || ip6.DestinationAddress() != src {
+		t.Errorf("icmpv2: reply %v -> %v; want %v -> %v", ip6.SourceAddress(), ip6.DestinationAddress(), dst, src)
+	}
+	if typ := header.ICMPv6(ip6.Payload()).Type(); typ != header.ICMPv6EchoReply {
+		t.Errorf("icmpv2: reply type %v; want echo reply", typ)
+	}
+}
+
+// Match must not block netstack when echoes are not being served.
+func TestIcmpv2QueueFull(t *testing.T) {
+	m := preroutingMatch{
+		msgs4: make(chan *stack.PacketBuffer, 1),
+		msgs6: make(chan *stack.PacketBuffer, 1),
+		drops: new(atomic.Uint64),
+	}
+	src := tcpip.AddrFrom16Slice(netip.MustParseAddr("fd00::2").AsSlice())
+	dst := tcpip.AddrFrom16Slice(netip.MustParseAddr("2001:db8::1").AsSlice())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			pkt := echo6(src, dst)
+			pkt.NetworkProtocolNumber = header.IPv6ProtocolNumber
+			if _, ok := pkt.NetworkHeader().Consume(header.IPv6MinimumSize); !ok {
+				t.Error("icmpv2: cannot parse ip6 header")
+			}
+			if _, drop := m.Match(stack.Prerouting, pkt, "", ""); !drop {
+				t.Error("icmpv2: echo6 not dropped")
+			}
+			pkt.DecRef()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("icmpv2: Match blocked on a full queue")
+	}
+	if n := m.drops.Load(); n != 2 {
+		t.Errorf("icmpv2: drops %d; want 2", n)
+	}
+	(<-m.msgs6).DecRef()
+}
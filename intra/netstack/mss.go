@@ -0,0 +1,343 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+const (
+	// mss is never clamped below the one that every ip4 host must accept
+	minmss = 536
+	// ip and tcp headers, sans options
+	tcphdr4 = header.IPv4MinimumSize + header.TCPMinimumSize
+	tcphdr6 = header.IPv6MinimumSize + header.TCPMinimumSize
+	// ip and udp headers
+	udphdr4 = header.IPv4MinimumSize + header.UDPMinimumSize
+	udphdr6 = header.IPv6MinimumSize + header.UDPMinimumSize
+)
+
+// mss (by flow) that syn-acks sent to the tun device advertise, at most;
+// a flow is keyed by its id as netstack sees it (local is the dst).
+var clamps = &mssclamps{m: make(map[stack.TransportEndpointID]uint16)}
+
+type mssclamps struct {
+	sync.RWMutex
+	m map[stack.TransportEndpointID]uint16
+	n atomic.Int32 // len(m); skips lookups if 0
+}
+
+func (c *mssclamps) add(id stack.TransportEndpointID, mss uint16) {
+	c.Lock()
+	defer c.Unlock()
+	c.m[id] = mss
+	c.n.Store(int32(len(c.m)))
+}
+
+func (c *mssclamps) remove(id stack.TransportEndpointID) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.m, id)
+	c.n.Store(int32(len(c.m)))
+}
+
+func (c *mssclamps) get(id stack.TransportEndpointID) (uint16, bool) {
+	if c.n.Load() <= 0 {
+		return 0, false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	mss, ok := c.m[id]
+	return mss, ok
+}
+
+// mssFor returns the mss of segments (sans options) that fit into mtu.
+func mssFor(mtu int, ip4 bool) uint16 {
+	hdr := tcphdr6
+	if ip4 {
+		hdr = tcphdr4
+	}
+	return uint16(min(max(mtu-hdr, minmss), 0xffff))
+}
+
+// ClampMSS has the syn-ack sent to the app advertise an mss that fits
+// segments into mtu (ex: of the proxy the flow is sent over), if the mss
+// netstack advertises does not; a no-op if mtu is not positive. Must be
+// called before Connect, since the mss is only ever sent in the syn-ack.
+func (g *GTCPConn) ClampMSS(mtu int) {
+	if mtu <= 0 || g.ok() {
+		return
+	}
+	g.mss = mssFor(mtu, g.dst.Addr().Is4())
+	log.D("ns: tcp: clamp mss %v => %v; mtu %d, mss %d", g.src, g.dst, mtu, g.mss)
+}
+
+// clamp has syn-acks of g clamped to its mss, if any, till unclamp. Must
+// be called before g.req is completed, as its id is gone thereafter.
+func (g *GTCPConn) clamp() {
+	if g.mss > 0 && g.req != nil && !g.clamped.Load() {
+		g.mssid = g.req.ID()
+		clamps.add(g.mssid, g.mss)
+		g.clamped.Store(true)
+	}
+}
+
+// unclamp undoes clamp, if clamped; safe to call after g.req is completed.
+func (g *GTCPConn) unclamp() {
+	if g.clamped.Swap(false) {
+		clamps.remove(g.mssid)
+	}
+}
+
+// clamper sits in front of a link endpoint and rewrites the mss option of
+// syn-acks sent to flows that are clamped (see: GTCPConn.ClampMSS), as
+// routers clamp mss of flows over links with smaller mtus. Endpoints it
+// wraps (ex: sniffer) see clamped syn-acks.
+type clamper struct {
+	nested.Endpoint
+}
+
+var _ stack.LinkEndpoint = (*clamper)(nil)
+
+func newClamper(child stack.LinkEndpoint) *clamper {
+	c := &clamper{}
+	c.Endpoint.Init(child, c)
+	return c
+}
+
+// WritePackets implements stack.LinkEndpoint.
+func (c *clamper) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if clamps.n.Load() > 0 {
+		// checksums are left to the child, if it offloads them
+		csum := c.Capabilities()&stack.CapabilityTXChecksumOffload == 0
+		for _, pkt := range pkts.AsSlice() {
+			clampSynAck(pkt, csum)
+		}
+	}
+	return c.Endpoint.WritePackets(pkts)
+}
+
+// clampSynAck rewrites the mss option of pkt, if it is a syn-ack of a
+// clamped flow that advertises a greater mss; and if csum is set, updates
+// its checksum.
+func clampSynAck(pkt *stack.PacketBuffer, csum bool) {
+	if pkt.TransportProtocolNumber != tcp.ProtocolNumber {
+		return
+	}
+	switch pkt.NetworkProtocolNumber {
+	case ipv4.ProtocolNumber, ipv6.ProtocolNumber:
+	default:
+		return
+	}
+	th := header.TCP(pkt.TransportHeader().Slice())
+	if len(th) < header.TCPMinimumSize || !th.Flags().Contains(header.TCPFlagSyn|header.TCPFlagAck) {
+		return
+	}
+	nh := pkt.Network()
+	id := stack.TransportEndpointID{
+		LocalPort:     th.SourcePort(),
+		LocalAddress:  nh.SourceAddress(),
+		RemotePort:    th.DestinationPort(),
+		RemoteAddress: nh.DestinationAddress(),
+	}
+	mss, ok := clamps.get(id)
+	if !ok {
+		return
+	}
+	off := mssOptionOffset(th)
+	if off <= 0 {
+		return
+	}
+	if cur := binary.BigEndian.Uint16(th[off:]); cur <= mss {
+		return
+	}
+	// a 16-bit aligned word (or two) of the header that holds the mss
+	lo := off &^ 1
+	hi := min(off+4, len(th))
+	old := append([]byte(nil), th[lo:hi]...)
+	binary.BigEndian.PutUint16(th[off:], mss)
+	if csum {
+		th.SetChecksum(updateChecksum(th.Checksum(), old, th[lo:hi]))
+	}
+}
+
+// mssOptionOffset returns the offset of the mss value in th; or 0, if
+// th has no mss option.
+func mssOptionOffset(th header.TCP) int {
+	end := min(int(th.DataOffset()), len(th))
+	for i := header.TCPMinimumSize; i < end; {
+		switch th[i] {
+		case header.TCPOptionEOL:
+			return 0
+		case header.TCPOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= end {
+			return 0
+		}
+		sz := int(th[i+1])
+		if sz < 2 || i+sz > end {
+			return 0
+		}
+		if th[i] == header.TCPOptionMSS && sz == header.TCPOptionMSSLength {
+			return i + 2
+		}
+		i += sz
+	}
+	return 0
+}
+
+// updateChecksum updates checksum hc of a header whose (16-bit aligned)
+// bytes old were changed to new, as in rfc1624 eqn 3.
+func updateChecksum(hc uint16, old, new []byte) uint16 {
+	sum := uint32(^hc)
+	for i := 0; i+1 < len(old) && i+1 < len(new); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// ClampMTU has datagrams from the app that do not fit into mtu (ex: of the
+// proxy the flow is sent over) dropped, and answered with an icmp packet
+// too big (fragmentation needed, for ip4); a no-op if mtu is not positive.
+func (g *GUDPConn) ClampMTU(mtu int) {
+	if mtu <= 0 {
+		return
+	}
+	g.mtu.Store(int32(mtu))
+	log.D("ns: udp: clamp mtu %v => %v; mtu %d", g.src, g.dst, mtu)
+}
+
+// tooBig returns true if a datagram of n bytes from the app does not fit
+// into g's mtu; and if so, sends an icmp packet too big to the app. Only
+// connected flows (whose dst is known) are clamped.
+func (g *GUDPConn) tooBig(n int) bool {
+	mtu := int(g.mtu.Load())
+	if mtu <= 0 || !g.dst.IsValid() || g.dst.Addr().IsUnspecified() {
+		return false
+	}
+	hdr := udphdr6
+	if g.src.Addr().Is4() {
+		hdr = udphdr4
+	}
+	if n+hdr <= mtu {
+		return false
+	}
+	if g.s == nil {
+		return true
+	}
+	var err tcpip.Error
+	if pkt, proto := packetTooBig(g.src, g.dst, n, mtu); len(pkt) > 0 {
+		err = g.s.WriteRawPacket(settings.NICID, proto, buffer.MakeWithData(pkt))
+	}
+	log.D("ns: udp: too big %v => %v; sz %d, mtu %d; err? %v", g.src, g.dst, n, mtu, err)
+	return true
+}
+
+// packetTooBig returns an icmp packet too big (or an icmp4 fragmentation
+// needed) from dst to src, for a datagram of n bytes that did not fit
+// into mtu; it quotes the datagram's ip and udp headers, but not its data.
+func packetTooBig(src, dst netip.AddrPort, n, mtu int) ([]byte, tcpip.NetworkProtocolNumber) {
+	if !src.IsValid() || !dst.IsValid() || src.Addr().Is4() != dst.Addr().Is4() {
+		return nil, 0
+	}
+	saddr := tcpip.AddrFromSlice(src.Addr().AsSlice())
+	daddr := tcpip.AddrFromSlice(dst.Addr().AsSlice())
+
+	uh := make(header.UDP, header.UDPMinimumSize)
+	uh.Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(min(n+header.UDPMinimumSize, 0xffff)),
+	})
+
+	if src.Addr().Is4() {
+		quote := make(header.IPv4, header.IPv4MinimumSize)
+		quote.Encode(&header.IPv4Fields{
+			TotalLength: uint16(min(n+udphdr4, 0xffff)),
+			TTL:         64,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     saddr,
+			DstAddr:     daddr,
+		})
+		quote.SetChecksum(^quote.CalculateChecksum())
+
+		sz := header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(quote) + len(uh)
+		b := make([]byte, sz)
+		ih := header.IPv4(b)
+		ih.Encode(&header.IPv4Fields{
+			TotalLength: uint16(sz),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     daddr,
+			DstAddr:     saddr,
+		})
+		ih.SetChecksum(^ih.CalculateChecksum())
+		icmp := header.ICMPv4(b[header.IPv4MinimumSize:])
+		icmp.SetType(header.ICMPv4DstUnreachable)
+		icmp.SetCode(header.ICMPv4FragmentationNeeded)
+		icmp.SetMTU(uint16(min(mtu, 0xffff)))
+		copy(icmp[header.ICMPv4MinimumSize:], quote)
+		copy(icmp[header.ICMPv4MinimumSize+len(quote):], uh)
+		icmp.SetChecksum(0)
+		icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+		return b, ipv4.ProtocolNumber
+	}
+
+	quote := make(header.IPv6, header.IPv6MinimumSize)
+	quote.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(min(n+header.UDPMinimumSize, 0xffff)),
+		TransportProtocol: header.UDPProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           saddr,
+		DstAddr:           daddr,
+	})
+
+	plen := header.ICMPv6MinimumSize + len(quote) + len(uh)
+	b := make([]byte, header.IPv6MinimumSize+plen)
+	ih := header.IPv6(b)
+	ih.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(plen),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           daddr,
+		DstAddr:           saddr,
+	})
+	icmp := header.ICMPv6(b[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6PacketTooBig)
+	icmp.SetCode(0)
+	icmp.SetMTU(uint32(mtu))
+	copy(icmp[header.ICMPv6MinimumSize:], quote)
+	copy(icmp[header.ICMPv6MinimumSize+len(quote):], uh)
+	icmp.SetChecksum(0)
+	icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: icmp,
+		Src:    daddr,
+		Dst:    saddr,
+	}))
+	return b, ipv6.ProtocolNumber
+}
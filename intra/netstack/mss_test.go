@@ -0,0 +1,197 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// clampTCP accepts all conns, as intra does those over a proxy of mtu.
+type clampTCP struct {
+	mtu  int
+	done chan struct{} // signalled once a conn is closed
+}
+
+func (h *clampTCP) Proxy(conn *GTCPConn, _, _ netip.AddrPort) bool {
+	defer func() {
+		select {
+		case h.done <- struct{}{}:
+		default:
+		}
+	}()
+	conn.ClampMSS(h.mtu)
+	if open, err := conn.Connect(false); !open || err != nil {
+		return false
+	}
+	// till the app closes, lest a rst race its connect
+	_, _ = io.Copy(io.Discard, conn)
+	conn.Close()
+	return true
+}
+func (h *clampTCP) CloseConns([]string) []string { return nil }
+func (h *clampTCP) End() error                   { return nil }
+
+// synacks records the mss of syn-acks written to the tun device.
+type synacks struct {
+	nested.Endpoint
+	mu  sync.Mutex
+	mss []uint16
+}
+
+func newSynAcks(child stack.LinkEndpoint) *synacks {
+	s := &synacks{}
+	s.Endpoint.Init(child, s)
+	return s
+}
+
+func (s *synacks) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pkt := range pkts.AsSlice() {
+		if pkt.TransportProtocolNumber != tcp.ProtocolNumber {
+			continue
+		}
+		th := header.TCP(pkt.TransportHeader().Slice())
+		if !th.Flags().Contains(header.TCPFlagSyn | header.TCPFlagAck) {
+			continue
+		}
+		opts := header.ParseSynOptions(th.Options(), true)
+		s.mu.Lock()
+		s.mss = append(s.mss, opts.MSS)
+		s.mu.Unlock()
+	}
+	return s.Endpoint.WritePackets(pkts)
+}
+
+func (s *synacks) all() []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint16(nil), s.mss...)
+}
+
+func dialClamped(t *testing.T, mtu int) []uint16 {
+	cep, sep := pipe.New("", "", 1500)
+	rec := newSynAcks(sep)
+	h := &clampTCP{mtu: mtu, done: make(chan struct{}, 1)}
+	client := linkPair(t, newClamper(rec), cep, func(s *stack.Stack) {
+		setupTcpHandler(s, h)
+	})
+
+	// a syn-ack with a bad checksum would have the client time out
+	c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 443}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("mss: mtu %d: dial: %v", mtu, err)
+	}
+	c.Close()
+	select { // the handler closes its end, too
+	case <-h.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("mss: mtu %d: handler not done", mtu)
+	}
+	return rec.all()
+}
+
+func TestClampMSSSynAck(t *testing.T) {
+	const wgmtu = 1420 - 80 // as wgproxy reports it
+	mss := dialClamped(t, wgmtu)
+	if len(mss) <= 0 {
+		t.Fatal("mss: no syn-ack")
+	}
+	want := uint16(wgmtu - header.IPv4MinimumSize - header.TCPMinimumSize)
+	for _, got := range mss {
+		if got != want {
+			t.Errorf("mss: syn-ack: want %d, got %d", want, got)
+		}
+	}
+	if n := clamps.n.Load(); n != 0 {
+		t.Errorf("mss: %d clamps left behind", n)
+	}
+
+	// flows over proxies with no mtu, or one larger than the tun's, are
+	// left as they are
+	for _, mtu := range []int{0, 9000} {
+		for _, got := range dialClamped(t, mtu) {
+			if got != 1500-header.IPv4MinimumSize-header.TCPMinimumSize {
+				t.Errorf("mss: mtu %d: syn-ack: got %d", mtu, got)
+			}
+		}
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	b := []byte{0x45, 0x00, 0x05, 0xb4, 0x01, 0x02, 0x03, 0x04, 0xfe, 0xdc}
+	csum := ^checksum.Checksum(b, 0)
+	old := append([]byte(nil), b[2:6]...)
+	b[3], b[4] = 0x1c, 0x7f // unaligned, as mss options may be
+	got := updateChecksum(csum, old, b[2:6])
+	if want := ^checksum.Checksum(b, 0); got != want {
+		t.Errorf("checksum: want %#x, got %#x", want, got)
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	app := netip.MustParseAddrPort("10.111.222.1:41641")
+	dst := netip.MustParseAddrPort("10.111.222.3:443")
+	b, proto := packetTooBig(app, dst, 1400, 1340)
+	if proto != ipv4.ProtocolNumber {
+		t.Fatalf("ptb: want ip4, got %d", proto)
+	}
+	ih := header.IPv4(b)
+	if !ih.IsValid(len(b)) || ih.CalculateChecksum() != 0xffff {
+		t.Fatalf("ptb: bad ip4 header")
+	}
+	if ih.SourceAddress() != tcpip.AddrFrom4(dst.Addr().As4()) || ih.DestinationAddress() != tcpip.AddrFrom4(app.Addr().As4()) {
+		t.Errorf("ptb: want %s => %s, got %s => %s", dst, app, ih.SourceAddress(), ih.DestinationAddress())
+	}
+	icmp := header.ICMPv4(ih.Payload())
+	if icmp.Type() != header.ICMPv4DstUnreachable || icmp.Code() != header.ICMPv4FragmentationNeeded || icmp.MTU() != 1340 {
+		t.Errorf("ptb: type %d, code %d, mtu %d", icmp.Type(), icmp.Code(), icmp.MTU())
+	}
+	if checksum.Checksum(icmp, 0) != 0xffff {
+		t.Errorf("ptb: bad icmp checksum")
+	}
+	quote := header.IPv4(icmp[header.ICMPv4MinimumSize:])
+	uh := header.UDP(quote[header.IPv4MinimumSize:])
+	if quote.TotalLength() != 1400+udphdr4 || uh.SourcePort() != app.Port() || uh.DestinationPort() != dst.Port() {
+		t.Errorf("ptb: quote: len %d, ports %d => %d", quote.TotalLength(), uh.SourcePort(), uh.DestinationPort())
+	}
+
+	app6 := netip.MustParseAddrPort("[fd66:f83a:c650::1]:41641")
+	dst6 := netip.MustParseAddrPort("[2606:4700::1111]:443")
+	b, proto = packetTooBig(app6, dst6, 1400, 1340)
+	ih6 := header.IPv6(b)
+	if proto == ipv4.ProtocolNumber || !ih6.IsValid(len(b)) {
+		t.Fatalf("ptb: bad ip6 header")
+	}
+	icmp6 := header.ICMPv6(ih6.Payload())
+	if icmp6.Type() != header.ICMPv6PacketTooBig || icmp6.MTU() != 1340 {
+		t.Errorf("ptb: type %d, mtu %d", icmp6.Type(), icmp6.MTU())
+	}
+	if want := header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: icmp6,
+		Src:    ih6.SourceAddress(),
+		Dst:    ih6.DestinationAddress(),
+	}); icmp6.Checksum() != want {
+		t.Errorf("ptb: icmp6 checksum: want %#x, got %#x", want, icmp6.Checksum())
+	}
+
+	if b, _ := packetTooBig(app, dst6, 1400, 1340); len(b) > 0 {
+		t.Errorf("ptb: mixed families: want nothing")
+	}
+}
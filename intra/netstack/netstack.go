@@ -47,8 +47,19 @@ func NewEndpoint(dev, mtu int, sink io.WriteCloser) (ep stack.LinkEndpoint, err
 	if ep, err = NewFdbasedInjectableEndpoint(&opt); err != nil {
 		return nil, err
 	}
+	// retries writes the tun device is too busy for; see: retryTun
+	ep = newRetrier(ep)
+	// batches writes to the tun device, if it is a socket, as only then
+	// are batches written in one sendmmsg; see: CoalesceWrites
+	sock, _ := isSocketFD(dev)
+	ep = newCoalescer(ep, sock)
+	// sniffer sees packets before they are batched
 	// ref: github.com/google/gvisor/blob/aeabb785278/pkg/tcpip/link/sniffer/sniffer.go#L111-L131
-	return sniffer.NewWithWriter(ep, sink, umtu)
+	if ep, err = sniffer.NewWithWriter(ep, sink, umtu); err != nil {
+		return nil, err
+	}
+	// sniffer sees syn-acks as clamped; see: GTCPConn.ClampMSS
+	return newClamper(ep), nil
 }
 
 func LogPcap(y bool) (ok bool) {
@@ -92,15 +103,10 @@ func Up(s *stack.Stack, ep stack.LinkEndpoint, h GConnHandler) error {
 	//	defer s.Resume()
 	// }
 
-	// TODO: setup protocol opts?
-	// github.com/google/gvisor/blob/ef9e8d91/test/benchmarks/tcp/tcp_proxy.go#L233
-	sack := tcpip.TCPSACKEnabled(true)
-	_ = s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
-
-	// from: github.com/telepresenceio/telepresence/blob/ab7dda7d55/pkg/vif/stack.go#L232
-	// Enable Receive Buffer Auto-Tuning, see: github.com/google/gvisor/issues/1666
-	bufauto := tcpip.TCPModerateReceiveBufferOption(true)
-	s.SetTransportProtocolOption(tcp.ProtocolNumber, &bufauto)
+	// sack, buffer sizes & auto-tuning, congestion control; see: SetTCPOptions
+	if err := applyTCPOptions(s, tcpopts.Load()); err != nil {
+		log.W("netstack: tcpopts not applied; err(%v)", err)
+	}
 
 	ttl := tcpip.DefaultTTLOption(64)
 	s.SetNetworkProtocolOption(ipv4.ProtocolNumber, &ttl)
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/celzero/firestack/intra/core"
@@ -21,7 +22,6 @@ import (
 )
 
 // ref: github.com/tailscale/tailscale/blob/cfb5bd0559/wgengine/netstack/netstack.go#L236-L237
-const rcvwnd = 0
 const maxInFlight = 128
 
 type GTCPConnHandler interface {
@@ -36,20 +36,27 @@ type GTCPConnHandler interface {
 var _ core.TCPConn = (*GTCPConn)(nil)
 
 type GTCPConn struct {
-	conn *gonet.TCPConn
-	ep   tcpip.Endpoint
-	src  netip.AddrPort
-	dst  netip.AddrPort
-	req  *tcp.ForwarderRequest
+	conn   *gonet.TCPConn
+	ep     tcpip.Endpoint
+	src    netip.AddrPort
+	dst    netip.AddrPort
+	req    fwdreq
+	s      *stack.Stack // may be nil; see: EndpointError
+	mss    uint16       // see: ClampMSS
+	closed atomic.Bool  // see: Alive
+	// id of the flow whose syn-acks are clamped, if clamped; see: clamp
+	mssid   stack.TransportEndpointID
+	clamped atomic.Bool
 }
 
 func setupTcpHandler(s *stack.Stack, h GTCPConnHandler) {
-	s.SetTransportProtocolHandler(tcp.ProtocolNumber, NewTCPForwarder(s, h).HandlePacket)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, newTCPForwarder(s, h).HandlePacket)
 }
 
 // nic.deliverNetworkPacket -> no existing matching endpoints -> NewTCPForwarder.HandlePacket
 // ref: github.com/google/gvisor/blob/e89e736f1/pkg/tcpip/adapters/gonet/gonet_test.go#L189
-func NewTCPForwarder(s *stack.Stack, h GTCPConnHandler) *tcp.Forwarder {
+// rcvwnd is the receive window advertised to new conns; 0 for the default.
+func NewTCPForwarder(s *stack.Stack, h GTCPConnHandler, rcvwnd int) *tcp.Forwarder {
 	return tcp.NewForwarder(s, rcvwnd, maxInFlight, func(request *tcp.ForwarderRequest) {
 		if request == nil {
 			log.E("ns: tcp: forwarder: nil request")
@@ -65,6 +72,7 @@ func NewTCPForwarder(s *stack.Stack, h GTCPConnHandler) *tcp.Forwarder {
 		// demuxer.handlePacket -> find matching endpoint -> queue-packet -> send/recv conn (ep)
 		// ref: github.com/google/gvisor/blob/be6ffa7/pkg/tcpip/stack/transport_demuxer.go#L180
 		gtcp := MakeGTCPConn(request, src, dst)
+		gtcp.s = s
 		go h.Proxy(gtcp, src, dst)
 	})
 }
@@ -84,6 +92,37 @@ func (g *GTCPConn) ok() bool {
 	return g.conn != nil
 }
 
+// Alive returns true if g is connected to its netstack endpoint and has
+// not been closed; implements core.Liveness.
+func (g *GTCPConn) Alive() bool {
+	return g.ok() && !g.closed.Load()
+}
+
+// TCPHealth returns retransmits (and rto timeouts), segments received, and
+// whether data is unacked, of g's netstack endpoint; implements core.TCPProber.
+func (g *GTCPConn) TCPHealth() (h core.TCPHealth, ok bool) {
+	ep := g.ep
+	if ep == nil {
+		return
+	}
+	s, ok := ep.Stats().(*tcp.Stats)
+	if !ok || s == nil {
+		return h, false
+	}
+	h.Retrans = s.SendErrors.Retransmits.Value() + s.SendErrors.Timeouts.Value()
+	h.SegsIn = s.SegmentsReceived.Value()
+	var info tcpip.TCPInfoOption
+	if err := ep.GetSockOpt(&info); err == nil {
+		switch info.CcState {
+		case tcpip.RTORecovery, tcpip.FastRecovery, tcpip.SACKRecovery:
+			// netstack does not tell how many segments are in flight, but
+			// there is at least one till it is acked, and recovery ends
+			h.Unacked = 1
+		}
+	}
+	return h, true
+}
+
 func (g *GTCPConn) StatefulTeardown() (rst bool) {
 	if g.ok() {
 		g.Close() // g.TCPConn.Close error always nil
@@ -104,7 +143,11 @@ func (g *GTCPConn) Connect(rst bool) (open bool, err error) {
 		return true, nil // open
 	}
 
+	g.clamp() // syn-ack is sent by synack
 	rst, err = g.synack()
+	if rst {
+		g.unclamp()
+	}
 	g.req.Complete(rst)
 
 	log.V("ns: tcp: forwarder: proxy src(%v) => dst(%v); fin? %t", g.LocalAddr(), g.RemoteAddr(), rst)
@@ -115,12 +158,13 @@ func (g *GTCPConn) synack() (rst bool, err error) {
 	wq := new(waiter.Queue)
 	// the passive-handshake (SYN) may not successful for a non-existent route (say, ipv6)
 	if ep, err := g.req.CreateEndpoint(wq); err != nil {
+		err := endpointErr(g.s, err)
 		log.E("ns: tcp: forwarder: data src(%v) => dst(%v); err(%v)", g.LocalAddr(), g.RemoteAddr(), err)
 		// prevent potential half-open TCP connection leak.
 		// hopefully doesn't break happy-eyeballs datatracker.ietf.org/doc/html/rfc8305#section-5
 		// ie, apps that expect network-unreachable ICMP msgs instead of TCP RSTs?
 		// TCP RST here is indistinguishable to an app from being firewalled.
-		return true, e(err)
+		return true, err
 	} else {
 		g.ep = ep
 		g.conn = gonet.NewTCPConn(wq, ep)
@@ -204,6 +248,7 @@ func (g *GTCPConn) SetWriteDeadline(t time.Time) error {
 
 // Abort aborts the connection by sending a RST segment.
 func (g *GTCPConn) Abort() {
+	g.unclamp()
 	ep := g.ep
 	c := g.conn
 	if ep != nil {
@@ -214,7 +259,9 @@ func (g *GTCPConn) Abort() {
 	}
 }
 
-func (g GTCPConn) Close() error {
+func (g *GTCPConn) Close() error {
+	g.closed.Store(true)
+	g.unclamp() // syn-acks may be resent till the handshake is done
 	ep := g.ep
 	c := g.conn
 	if ep != nil {
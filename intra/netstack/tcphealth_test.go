@@ -0,0 +1,151 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"io"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// holdTCP accepts all conns, and hands them out till the test is done.
+type holdTCP struct {
+	conns chan *GTCPConn
+	done  chan struct{}
+}
+
+func (h *holdTCP) Proxy(conn *GTCPConn, _, _ netip.AddrPort) bool {
+	if open, err := conn.Connect(false); !open || err != nil {
+		return false
+	}
+	h.conns <- conn
+	<-h.done
+	conn.Close()
+	return true
+}
+func (h *holdTCP) CloseConns([]string) []string { return nil }
+func (h *holdTCP) End() error                   { return nil }
+
+// cutLink drops all packets written to the tun device while cut, as if the
+// app (the peer of conns handed to intra) vanished.
+type cutLink struct {
+	nested.Endpoint
+	cut atomic.Bool
+}
+
+func newCutLink(child stack.LinkEndpoint) *cutLink {
+	l := &cutLink{}
+	l.Endpoint.Init(child, l)
+	return l
+}
+
+func (l *cutLink) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if l.cut.Load() {
+		return pkts.Len(), nil
+	}
+	return l.Endpoint.WritePackets(pkts)
+}
+
+func TestTCPHealth(t *testing.T) {
+	cep, sep := pipe.New("", "", 1500)
+	link := newCutLink(sep)
+	h := &holdTCP{conns: make(chan *GTCPConn, 1), done: make(chan struct{})}
+	defer close(h.done)
+	client := linkPair(t, link, cep, func(s *stack.Stack) {
+		setupTcpHandler(s, h)
+	})
+
+	c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 443}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var g *GTCPConn
+	select {
+	case g = <-h.conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health: no conn")
+	}
+
+	health := func() core.TCPHealth {
+		hh, ok := g.TCPHealth()
+		if !ok {
+			t.Fatal("health: unknown")
+		}
+		return hh
+	}
+	eventually := func(ok func(core.TCPHealth) bool, msg string) core.TCPHealth {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if hh := health(); ok(hh) {
+				return hh
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("health: %s: %+v", msg, health())
+		return core.TCPHealth{}
+	}
+	send := func() {
+		if _, err := g.Write(make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := core.NewPeerWatch()
+	dead := func(hh core.TCPHealth) bool {
+		return w.Dead("t1", []core.TCPHealth{hh}, 0)
+	}
+
+	// acked as the app reads
+	h0 := health()
+	send()
+	if _, err := io.ReadFull(c, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	h1 := eventually(func(hh core.TCPHealth) bool {
+		return hh.SegsIn > h0.SegsIn && hh.Unacked == 0
+	}, "no acks")
+	if h1.Retrans != 0 || dead(h1) {
+		t.Errorf("health: %+v; want alive", h1)
+	}
+
+	// unacked, and retransmitted, once the app vanishes
+	link.cut.Store(true)
+	send()
+	h2 := eventually(func(hh core.TCPHealth) bool {
+		return hh.Retrans > h1.Retrans && hh.Unacked > 0
+	}, "no retransmits")
+	if h2.SegsIn != h1.SegsIn {
+		t.Errorf("health: segs in %d; want %d, as none got through", h2.SegsIn, h1.SegsIn)
+	}
+	h3 := eventually(func(hh core.TCPHealth) bool {
+		return hh.Retrans > h2.Retrans
+	}, "retransmits not climbing")
+	if !dead(h3) {
+		t.Errorf("health: %+v; want dead", h3)
+	}
+
+	// and acked once it is back
+	link.cut.Store(false)
+	h4 := eventually(func(hh core.TCPHealth) bool {
+		return hh.SegsIn > h3.SegsIn && hh.Unacked == 0
+	}, "no acks after the app is back")
+	if dead(h4) {
+		t.Errorf("health: %+v; want alive", h4)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// tcp opts applied to stacks brought Up, and to conns they accept
+var tcpopts atomic.Pointer[settings.TCPOptions]
+
+func init() {
+	tcpopts.Store(settings.DefaultTCPOptions())
+}
+
+// SetTCPOptions validates and applies o to s, if not nil, and to stacks
+// brought Up later; applies only to conns made after. Resets to defaults
+// if o is nil.
+func SetTCPOptions(s *stack.Stack, o *settings.TCPOptions) error {
+	if o == nil {
+		o = settings.DefaultTCPOptions()
+	}
+	if err := o.Valid(); err != nil {
+		log.W("netstack: tcpopts: %v", err)
+		return err
+	}
+	c := *o // copy, since o is owned by the caller
+	tcpopts.Store(&c)
+	if s == nil {
+		return nil
+	}
+	return applyTCPOptions(s, &c)
+}
+
+// applyTCPOptions sets stack-wide tcp opts of s to o.
+// github.com/google/gvisor/blob/ef9e8d91/test/benchmarks/tcp/tcp_proxy.go#L233
+func applyTCPOptions(s *stack.Stack, o *settings.TCPOptions) error {
+	// socket buffers are clamped to these stack-wide limits, which
+	// must at least be as large as tcp's own; see: ep.ops.SetReceiveBufferSize
+	sndmax := max(o.SendBufMax, stack.DefaultMaxBufferSize)
+	rcvmax := max(o.RecvBufMax, stack.DefaultMaxBufferSize)
+	sndsz := tcpip.SendBufferSizeOption{Min: stack.MinBufferSize, Default: stack.DefaultBufferSize, Max: sndmax}
+	rcvsz := tcpip.ReceiveBufferSizeOption{Min: stack.MinBufferSize, Default: stack.DefaultBufferSize, Max: rcvmax}
+	if err := e(s.SetOption(sndsz)); err != nil {
+		return err
+	}
+	if err := e(s.SetOption(rcvsz)); err != nil {
+		return err
+	}
+
+	snd := tcpip.TCPSendBufferSizeRangeOption{Min: o.SendBufMin, Default: o.SendBufDefault, Max: o.SendBufMax}
+	rcv := tcpip.TCPReceiveBufferSizeRangeOption{Min: o.RecvBufMin, Default: o.RecvBufDefault, Max: o.RecvBufMax}
+	sack := tcpip.TCPSACKEnabled(o.SACK)
+	cc := tcpip.CongestionControlOption(o.CongestionControl)
+	// from: github.com/telepresenceio/telepresence/blob/ab7dda7d55/pkg/vif/stack.go#L232
+	// Enable Receive Buffer Auto-Tuning, see: github.com/google/gvisor/issues/1666
+	bufauto := tcpip.TCPModerateReceiveBufferOption(true)
+	for _, opt := range []tcpip.SettableTransportProtocolOption{&snd, &rcv, &sack, &cc, &bufauto} {
+		if err := e(s.SetTransportProtocolOption(tcp.ProtocolNumber, opt)); err != nil {
+			log.W("netstack: tcpopts: %T: %v", opt, err)
+			return err
+		}
+	}
+	log.I("netstack: tcpopts: %s", o)
+	return nil
+}
+
+// tcpForwarder hands conns over to a tcp.Forwarder made with the current
+// rcvwnd; which, since a tcp.Forwarder's rcvwnd is fixed, is re-made
+// whenever rcvwnd changes.
+type tcpForwarder struct {
+	s *stack.Stack
+	h GTCPConnHandler
+
+	mu  sync.Mutex     // protects wnd, fwd
+	wnd int            // rcvwnd of fwd
+	fwd *tcp.Forwarder // current forwarder
+}
+
+func newTCPForwarder(s *stack.Stack, h GTCPConnHandler) *tcpForwarder {
+	return &tcpForwarder{s: s, h: h, wnd: -1}
+}
+
+// HandlePacket implements stack.TransportProtocolHandler; only ever called
+// for packets that do not belong to any existing conn.
+func (t *tcpForwarder) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	return t.forwarder().HandlePacket(id, pkt)
+}
+
+func (t *tcpForwarder) forwarder() *tcp.Forwarder {
+	wnd := tcpopts.Load().RcvWnd
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.fwd == nil || t.wnd != wnd {
+		log.I("netstack: tcp: forwarder: rcvwnd %d => %d", t.wnd, wnd)
+		t.fwd = NewTCPForwarder(t.s, t.h, wnd)
+		t.wnd = wnd
+	}
+	return t.fwd
+}
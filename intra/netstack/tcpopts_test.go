@@ -0,0 +1,218 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// sinkTCP accepts all conns, and reads them till eof.
+type sinkTCP struct {
+	done chan int64 // bytes read from each conn
+}
+
+func (h *sinkTCP) Proxy(conn *GTCPConn, _, _ netip.AddrPort) bool {
+	if open, err := conn.Connect(false); !open || err != nil {
+		h.done <- -1
+		return false
+	}
+	n, _ := io.Copy(io.Discard, conn)
+	conn.Close()
+	h.done <- n
+	return true
+}
+func (h *sinkTCP) CloseConns([]string) []string { return nil }
+func (h *sinkTCP) End() error                   { return nil }
+
+var (
+	iperfClient = tcpip.AddrFrom4([4]byte{10, 111, 222, 1})
+	iperfServer = tcpip.AddrFrom4([4]byte{10, 111, 222, 3})
+)
+
+// iperfPair returns a client stack linked to a stack that forwards tcp
+// conns (as from a tun device) to h; both tuned by o.
+func iperfPair(tb testing.TB, o *settings.TCPOptions, h GTCPConnHandler) (client *stack.Stack) {
+	if err := SetTCPOptions(nil, o); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = SetTCPOptions(nil, nil) })
+
+	return tunPair(tb, func(s *stack.Stack) {
+		setupTcpHandler(s, h)
+	})
+}
+
+// tunPair returns a client stack (at iperfClient) linked to a stack that,
+// as if it were reading from a tun device, sees all of the client's flows;
+// setup installs its handlers.
+func tunPair(tb testing.TB, setup func(*stack.Stack)) (client *stack.Stack) {
+	cep, sep := pipe.New("", "", 1500)
+	return linkPair(tb, sep, cep, setup)
+}
+
+// linkPair is tunPair over link endpoints sep (of the tun device) and cep
+// (of the client).
+func linkPair(tb testing.TB, sep, cep stack.LinkEndpoint, setup func(*stack.Stack)) (client *stack.Stack) {
+	s := NewNetstack()
+	setup(s)
+	if err := applyTCPOptions(s, tcpopts.Load()); err != nil {
+		tb.Fatal(err)
+	}
+	if err := e(s.CreateNIC(settings.NICID, sep)); err != nil {
+		tb.Fatal(err)
+	}
+	_ = s.SetSpoofing(settings.NICID, true)
+	_ = s.SetPromiscuousMode(settings.NICID, true)
+	Route(s, settings.IP4)
+
+	client = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := applyTCPOptions(client, tcpopts.Load()); err != nil {
+		tb.Fatal(err)
+	}
+	if err := e(client.CreateNIC(1, cep)); err != nil {
+		tb.Fatal(err)
+	}
+	addr := tcpip.ProtocolAddress{Protocol: ipv4.ProtocolNumber, AddressWithPrefix: iperfClient.WithPrefix()}
+	if err := e(client.AddProtocolAddress(1, addr, stack.AddressProperties{})); err != nil {
+		tb.Fatal(err)
+	}
+	client.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+	tb.Cleanup(func() {
+		client.Destroy()
+		s.Destroy()
+	})
+	return client
+}
+
+// iperf sends n bytes in chunks of sz over a new conn from client, and
+// returns bytes received by h.
+func iperf(tb testing.TB, client *stack.Stack, h *sinkTCP, n, sz int) int64 {
+	c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 5201}, ipv4.ProtocolNumber)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b := make([]byte, sz)
+	for sent := 0; sent < n; sent += sz {
+		if _, err := c.Write(b); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	c.Close()
+	return <-h.done
+}
+
+func tunedTCPOptions() *settings.TCPOptions {
+	o := settings.DefaultTCPOptions()
+	o.SendBufDefault = 4 << 20
+	o.SendBufMax = 16 << 20
+	o.RecvBufDefault = 4 << 20
+	o.RecvBufMax = 16 << 20
+	o.CongestionControl = settings.CCCubic
+	o.RcvWnd = 4 << 20
+	return o
+}
+
+func TestTCPOptionsValid(t *testing.T) {
+	defer func() { _ = SetTCPOptions(nil, nil) }()
+
+	bad := []func(*settings.TCPOptions){
+		func(o *settings.TCPOptions) { o.SendBufMin = 0 },
+		func(o *settings.TCPOptions) { o.SendBufDefault = o.SendBufMax + 1 },
+		func(o *settings.TCPOptions) { o.RecvBufDefault = o.RecvBufMin - 1 },
+		func(o *settings.TCPOptions) { o.CongestionControl = "bbr" },
+		func(o *settings.TCPOptions) { o.RcvWnd = -1 },
+	}
+	for i, f := range bad {
+		o := tunedTCPOptions()
+		f(o)
+		if err := SetTCPOptions(nil, o); err == nil {
+			t.Errorf("tcpopts: %d: want err for %s", i, o)
+		}
+		if tcpopts.Load().RcvWnd != 0 {
+			t.Errorf("tcpopts: %d: invalid opts applied", i)
+		}
+	}
+
+	s := NewNetstack()
+	defer s.Destroy()
+	o := tunedTCPOptions()
+	if err := SetTCPOptions(s, o); err != nil {
+		t.Fatal(err)
+	}
+	o.RcvWnd = 1 // opts are copied
+	if tcpopts.Load().RcvWnd != 4<<20 {
+		t.Errorf("tcpopts: caller's opts not copied")
+	}
+
+	var rcv tcpip.TCPReceiveBufferSizeRangeOption
+	var cc tcpip.CongestionControlOption
+	var sack tcpip.TCPSACKEnabled
+	_ = s.TransportProtocolOption(tcp.ProtocolNumber, &rcv)
+	_ = s.TransportProtocolOption(tcp.ProtocolNumber, &cc)
+	_ = s.TransportProtocolOption(tcp.ProtocolNumber, &sack)
+	if rcv.Max != 16<<20 || cc != settings.CCCubic || !bool(sack) {
+		t.Errorf("tcpopts: not applied; rcv %v, cc %s, sack %t", rcv, cc, sack)
+	}
+}
+
+func TestTCPOptionsForwarder(t *testing.T) {
+	h := &sinkTCP{done: make(chan int64, 1)}
+	client := iperfPair(t, settings.DefaultTCPOptions(), h)
+
+	const n = 1 << 20
+	if got := iperf(t, client, h, n, 32<<10); got != n {
+		t.Fatalf("tcpopts: default: want %d bytes, got %d", n, got)
+	}
+	// a new rcvwnd applies to new conns, over a new forwarder
+	if err := SetTCPOptions(nil, tunedTCPOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if got := iperf(t, client, h, n, 32<<10); got != n {
+		t.Fatalf("tcpopts: tuned: want %d bytes, got %d", n, got)
+	}
+}
+
+// iperf-style throughput of a conn forwarded from the tun device, with
+// netstack's defaults versus tuned opts; go test -bench TCPThroughput
+
+const iperfBytes = 64 << 20
+
+func benchmarkTCPThroughput(b *testing.B, o *settings.TCPOptions) {
+	h := &sinkTCP{done: make(chan int64, 1)}
+	client := iperfPair(b, o, h)
+	b.SetBytes(iperfBytes)
+	b.ResetTimer()
+	for range b.N {
+		if got := iperf(b, client, h, iperfBytes, 64<<10); got != iperfBytes {
+			b.Fatalf("tcpopts: want %d bytes, got %d", iperfBytes, got)
+		}
+	}
+}
+
+func BenchmarkTCPThroughputDefault(b *testing.B) {
+	benchmarkTCPThroughput(b, settings.DefaultTCPOptions())
+}
+
+func BenchmarkTCPThroughputTuned(b *testing.B) {
+	benchmarkTCPThroughput(b, tunedTCPOptions())
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// tries, incl the first, of a tun write that fails with EAGAIN or ENOBUFS
+	tunWriteTries = 4
+	// wait before the first retry; doubles with every retry after
+	tunWriteBackoff = 500 * time.Microsecond
+)
+
+var (
+	// as gonet reports tcpip errors: errors.New(tcpip.Error.String())
+	errWouldBlockMsg = (&tcpip.ErrWouldBlock{}).String()
+	errNoBufsMsg     = (&tcpip.ErrNoBufferSpace{}).String()
+)
+
+// transient returns true if err is one that a busy tun device (or kernel)
+// returns, and which goes away as it drains: EAGAIN and ENOBUFS.
+func transient(err tcpip.Error) bool {
+	switch err.(type) {
+	case *tcpip.ErrWouldBlock, *tcpip.ErrNoBufferSpace:
+		return true
+	}
+	return false
+}
+
+// transientErr is transient for errors as returned by gonet conns or the os.
+func transientErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.ENOBUFS) {
+		return true
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Err != nil {
+		err = oe.Err
+	}
+	s := err.Error()
+	return s == errWouldBlockMsg || s == errNoBufsMsg
+}
+
+// retryTun calls write for as long as it fails transiently (returns true),
+// up to tunWriteTries in all, backing off in between; counted in WriteStats.
+func retryTun(write func() (transient bool)) {
+	wait := tunWriteBackoff
+	for i := 1; write(); i++ {
+		wstats.transient.Add(1)
+		if i >= tunWriteTries {
+			wstats.exhausted.Add(1)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// retrier sits in front of the tun's link endpoint and retries writes to it
+// that fail as it is busy; see: retryTun. Netstack retransmits tcp, but not
+// udp or icmp, which it drops on ENOBUFS (and does not report to the writer,
+// unless it asks for it; see: GUDPConn.Connect). Endpoints that wrap a
+// retrier (ex: coalescer) see each write succeed, or fail for good.
+type retrier struct {
+	nested.Endpoint
+	w waitWriter // child, if it can wait to write; may be nil
+}
+
+var _ stack.LinkEndpoint = (*retrier)(nil)
+var _ waitWriter = (*retrier)(nil)
+
+func newRetrier(child stack.LinkEndpoint) *retrier {
+	w, _ := child.(waitWriter)
+	r := &retrier{w: w}
+	r.Endpoint.Init(child, r)
+	return r
+}
+
+// WritePackets implements stack.LinkEndpoint.
+func (r *retrier) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	return r.write(pkts, r.Endpoint.WritePackets)
+}
+
+// writePacketsWait implements waitWriter.
+func (r *retrier) writePacketsWait(pkts stack.PacketBufferList, d time.Duration) (int, tcpip.Error) {
+	if r.w == nil {
+		return r.WritePackets(pkts)
+	}
+	return r.write(pkts, func(p stack.PacketBufferList) (int, tcpip.Error) {
+		return r.w.writePacketsWait(p, d)
+	})
+}
+
+// write writes pkts with wr, retrying those yet to be written for as long
+// as wr fails transiently; see: retryTun.
+func (r *retrier) write(pkts stack.PacketBufferList, wr func(stack.PacketBufferList) (int, tcpip.Error)) (n int, err tcpip.Error) {
+	rest := pkts
+	retryTun(func() bool {
+		var m int
+		m, err = wr(rest)
+		n += m
+		if !transient(err) || m >= rest.Len() {
+			return false
+		}
+		var next stack.PacketBufferList // refs are held by the caller
+		for _, pkt := range rest.AsSlice()[m:] {
+			next.PushBack(pkt)
+		}
+		rest = next
+		return true
+	})
+	return
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// busyTun rejects every nth write to the tun device with ENOBUFS, as a
+// busy tun device would; or all of them, if n is 1.
+type busyTun struct {
+	nested.Endpoint
+	n      int32
+	writes atomic.Int32
+}
+
+func newBusyTun(child stack.LinkEndpoint, n int32) *busyTun {
+	b := &busyTun{n: n}
+	b.Endpoint.Init(child, b)
+	return b
+}
+
+func (b *busyTun) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if b.writes.Add(1)%b.n == 0 {
+		return 0, &tcpip.ErrNoBufferSpace{}
+	}
+	return b.Endpoint.WritePackets(pkts)
+}
+
+// echoUDP echoes datagrams back to the app, and reports the write error
+// that ends the flow, if any.
+type echoUDP struct {
+	errs chan error
+}
+
+func (h *echoUDP) Proxy(gconn *GUDPConn, _, _ netip.AddrPort) bool {
+	if err := gconn.Connect(false); err != nil {
+		return false
+	}
+	go func() {
+		defer gconn.Close()
+		b := make([]byte, 1500)
+		for {
+			_ = gconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := gconn.Read(b)
+			if err != nil {
+				return
+			}
+			if _, err := gconn.Write(b[:n]); err != nil {
+				h.errs <- err
+				return
+			}
+		}
+	}()
+	return true
+}
+
+func (h *echoUDP) ProxyMux(gconn *GUDPConn, _ netip.AddrPort) bool {
+	gconn.Close()
+	return false
+}
+func (h *echoUDP) CloseConns([]string) []string { return nil }
+func (h *echoUDP) End() error                   { return nil }
+
+func dialBusy(t *testing.T, n int32) (*gonet.UDPConn, *echoUDP) {
+	h := &echoUDP{errs: make(chan error, 1)}
+	cep, sep := pipe.New("", "", 1500)
+	client := linkPair(t, newRetrier(newBusyTun(sep, n)), cep, func(s *stack.Stack) {
+		setupUdpHandler(s, h)
+	})
+	raddr := &tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 5353}
+	c, err := gonet.DialUDP(client, nil, raddr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, h
+}
+
+func TestTransientErr(t *testing.T) {
+	for err, want := range map[error]bool{
+		unix.EAGAIN:                           true,
+		unix.ENOBUFS:                          true,
+		fmt.Errorf("write: %w", unix.ENOBUFS): true,
+		&net.OpError{Op: "write", Err: e(&tcpip.ErrNoBufferSpace{})}:       true,
+		&net.OpError{Op: "write", Err: e(&tcpip.ErrWouldBlock{})}:          true,
+		&net.OpError{Op: "write", Err: e(&tcpip.ErrConnectionRefused{})}:   false,
+		errors.New("write: " + (&tcpip.ErrNoBufferSpace{}).String() + "!"): false,
+		unix.ECONNRESET: false,
+	} {
+		if got := transientErr(err); got != want {
+			t.Errorf("transient: %v: want %t, got %t", err, want, got)
+		}
+	}
+	if transientErr(nil) || transient(nil) || !transient(&tcpip.ErrWouldBlock{}) {
+		t.Error("transient: nil, or tcpip")
+	}
+}
+
+// Replies written to a tun device that intermittently rejects writes with
+// ENOBUFS are retried (and reach the app), and do not close the flow.
+func TestUDPWriteRetriesBusyTun(t *testing.T) {
+	c, h := dialBusy(t, 2)
+	_ = writeStats(t) // reset
+
+	const n = 16
+	b := make([]byte, 1500)
+	for i := range n {
+		msg := fmt.Sprintf("q%d", i)
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		m, err := c.Read(b)
+		if err != nil {
+			t.Fatalf("busy: %s: no reply; err: %v", msg, err)
+		}
+		if string(b[:m]) != msg {
+			t.Errorf("busy: want %q, got %q", msg, b[:m])
+		}
+	}
+	select {
+	case err := <-h.errs:
+		t.Fatalf("busy: flow closed: %v", err)
+	default:
+	}
+	w := writeStats(t)
+	if w.Transient <= 0 || w.Exhausted != 0 {
+		t.Errorf("busy: want transient errs and none exhausted, got %d, %d", w.Transient, w.Exhausted)
+	}
+}
+
+// A tun device that rejects every write closes the flow, once the retries
+// run out.
+func TestUDPWriteExhaustsBusyTun(t *testing.T) {
+	c, h := dialBusy(t, 1)
+	_ = writeStats(t) // reset
+
+	if _, err := c.Write([]byte("q")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-h.errs:
+		if !transientErr(err) {
+			t.Errorf("exhausted: want a transient err, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("exhausted: flow not closed")
+	}
+	w := writeStats(t)
+	if w.Transient != tunWriteTries || w.Exhausted != 1 {
+		t.Errorf("exhausted: want %d transient errs, 1 exhausted; got %d, %d", tunWriteTries, w.Transient, w.Exhausted)
+	}
+}
@@ -7,8 +7,11 @@ package netstack
 
 import (
 	"errors"
+	"hash/maphash"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/celzero/firestack/intra/core"
@@ -38,13 +41,22 @@ type GUDPConnHandler interface {
 var _ core.UDPConn = (*GUDPConn)(nil)
 
 type GUDPConn struct {
-	conn *gonet.UDPConn
-	ep   tcpip.Endpoint
-	src  netip.AddrPort
-	dst  netip.AddrPort
-	req  *udp.ForwarderRequest
+	conn    *gonet.UDPConn
+	ep      tcpip.Endpoint
+	src     netip.AddrPort
+	dst     netip.AddrPort
+	req     *udp.ForwarderRequest
+	s       *stack.Stack // sends icmp packet too big; may be nil
+	mtu     atomic.Int32 // see: ClampMTU
+	refused atomic.Bool  // see: Refuse
+	closed  atomic.Bool  // see: Alive
+	sum     uint64       // see: Sum
+	early   *early       // datagrams that beat the endpoint; may be nil
 }
 
+// seeds hashes of datagrams; see: GUDPConn.Sum
+var dgramseed = maphash.MakeSeed()
+
 // ref: github.com/google/gvisor/blob/e89e736f1/pkg/tcpip/adapters/gonet/gonet_test.go#L373
 func MakeGUDPConn(r *udp.ForwarderRequest, src, dst netip.AddrPort) *GUDPConn {
 	return &GUDPConn{
@@ -56,7 +68,124 @@ func MakeGUDPConn(r *udp.ForwarderRequest, src, dst netip.AddrPort) *GUDPConn {
 }
 
 func setupUdpHandler(s *stack.Stack, h GUDPConnHandler) {
-	s.SetTransportProtocolHandler(udp.ProtocolNumber, NewUDPForwarder(s, h).HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpPacketHandler(s, h))
+}
+
+// udpPacketHandler is NewUDPForwarder's HandlePacket, except that datagrams
+// of flows h refuses (see: GUDPConn.Refuse) are left unhandled, which has
+// the stack answer them with an icmp port unreachable; and that datagrams
+// of a flow that arrive while it is being forwarded are held till its
+// endpoint is made (see: early), instead of being forwarded as new flows.
+func udpPacketHandler(s *stack.Stack, h GUDPConnHandler) func(stack.TransportEndpointID, *stack.PacketBuffer) bool {
+	fwd := &inflight{m: make(map[stack.TransportEndpointID]*early)}
+	return func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		e, first := fwd.get(id)
+		if !first {
+			e.hold(id, pkt)
+			return true
+		}
+		defer fwd.done(id, e)
+
+		refused := false
+		udp.NewForwarder(s, func(request *udp.ForwarderRequest) {
+			refused = forwardUDP(s, h, request, dgramsum(pkt), e)
+		}).HandlePacket(id, pkt)
+		return !refused
+	}
+}
+
+// max datagrams held per flow while its endpoint is being made
+const maxEarly = 8
+
+// inflight tracks flows being forwarded; see: udpPacketHandler
+type inflight struct {
+	sync.Mutex
+	m map[stack.TransportEndpointID]*early
+}
+
+// get returns datagrams held for the flow id, and true if id is not
+// being forwarded already (and is from here on).
+func (f *inflight) get(id stack.TransportEndpointID) (*early, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if e, ok := f.m[id]; ok {
+		return e, false
+	}
+	e := new(early)
+	f.m[id] = e
+	return e, true
+}
+
+// done forgets flow id, and drops datagrams held for it, if any; as the
+// flow was refused, or its endpoint could not be made.
+func (f *inflight) done(id stack.TransportEndpointID, e *early) {
+	f.Lock()
+	delete(f.m, id)
+	f.Unlock()
+
+	e.drop()
+}
+
+// early holds datagrams of a flow that arrive (ex: from other tun queues)
+// while its first datagram is being forwarded, and so before its endpoint
+// is registered with the stack; the first datagrams matter to protocols
+// (dns, quic, wireguard), which otherwise retry after hundreds of ms.
+type early struct {
+	sync.Mutex
+	ep      stack.TransportEndpoint // set once the flow's endpoint is made
+	q       []*stack.PacketBuffer   // held till ep is set
+	dropped int                     // datagrams not held
+}
+
+// hold holds pkt till the flow's endpoint is made; or delivers it
+// right away, if it has been.
+func (e *early) hold(id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.ep != nil {
+		e.ep.HandlePacket(id, pkt)
+		return
+	}
+	if len(e.q) >= maxEarly {
+		e.dropped++
+		return
+	}
+	e.q = append(e.q, pkt.IncRef())
+}
+
+// ready delivers datagrams held, in order, to ep, the flow's endpoint.
+func (e *early) ready(id stack.TransportEndpointID, ep stack.TransportEndpoint) {
+	if e == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+
+	e.ep = ep
+	for _, pkt := range e.q {
+		ep.HandlePacket(id, pkt)
+		pkt.DecRef()
+	}
+	if len(e.q) > 0 || e.dropped > 0 {
+		log.D("ns: udp: early: %d held, %d dropped for %v", len(e.q), e.dropped, id)
+	}
+	e.q = nil
+}
+
+// drop drops datagrams held, if any.
+func (e *early) drop() {
+	e.Lock()
+	defer e.Unlock()
+
+	if n := len(e.q) + e.dropped; e.ep == nil && n > 0 {
+		log.D("ns: udp: early: %d dropped; no endpoint", n)
+	}
+	for _, pkt := range e.q {
+		pkt.DecRef()
+	}
+	e.q = nil
 }
 
 // Perhaps udp conns shouldn't be closed as eagerly as its tcp counterpart
@@ -72,35 +201,75 @@ func setupUdpHandler(s *stack.Stack, h GUDPConnHandler) {
 // but: github.com/google/gvisor/blob/be6ffa7/pkg/tcpip/transport/udp/endpoint.go#L180
 func NewUDPForwarder(s *stack.Stack, h GUDPConnHandler) *udp.Forwarder {
 	return udp.NewForwarder(s, func(request *udp.ForwarderRequest) {
-		if request == nil {
-			log.E("ns: udp: forwarder: nil request")
-			return
-		}
-		id := request.ID()
-
-		// src 10.111.222.1:20716; same as endpoint.GetRemoteAddress
-		src := remoteAddrPort(id)
-		// dst 10.111.222.3:53; same as endpoint.GetLocalAddress
-		// but it may not always be the true dst (for now it is),
-		// especially if the resulting udp-conn is setup to handle
-		// multiple dst in the unconnected udp case.
-		dst := localAddrPort(id)
-
-		gc := MakeGUDPConn(request, src, dst)
-
-		// if gc is a connected udp socket; proxy it like a stream
-		if !dst.Addr().IsUnspecified() {
-			h.Proxy(gc, src, dst)
-		} else {
-			h.ProxyMux(gc, src)
-		}
+		_ = forwardUDP(s, h, request, 0, nil)
 	})
 }
 
+// dgramsum hashes the payload of pkt, which is left as-is; never 0.
+func dgramsum(pkt *stack.PacketBuffer) uint64 {
+	var h maphash.Hash
+	h.SetSeed(dgramseed)
+	if _, err := pkt.Data().ReadTo(&h, true /*peek*/); err != nil {
+		return 0
+	}
+	return max(h.Sum64(), 1)
+}
+
+// forwardUDP hands the flow of request, made for a datagram that hashes to
+// sum (0 if unknown), over to h; and returns true if h refused it; see:
+// GUDPConn.Refuse. Datagrams held in e, if any, are delivered to the flow
+// once connected.
+func forwardUDP(s *stack.Stack, h GUDPConnHandler, request *udp.ForwarderRequest, sum uint64, e *early) (refused bool) {
+	if request == nil {
+		log.E("ns: udp: forwarder: nil request")
+		return
+	}
+	id := request.ID()
+
+	// src 10.111.222.1:20716; same as endpoint.GetRemoteAddress
+	src := remoteAddrPort(id)
+	// dst 10.111.222.3:53; same as endpoint.GetLocalAddress
+	// but it may not always be the true dst (for now it is),
+	// especially if the resulting udp-conn is setup to handle
+	// multiple dst in the unconnected udp case.
+	dst := localAddrPort(id)
+
+	gc := MakeGUDPConn(request, src, dst)
+	gc.s = s
+	gc.sum = sum
+	gc.early = e
+
+	// if gc is a connected udp socket; proxy it like a stream
+	if !dst.Addr().IsUnspecified() {
+		h.Proxy(gc, src, dst)
+	} else {
+		h.ProxyMux(gc, src)
+	}
+	return gc.refused.Load()
+}
+
 func (g *GUDPConn) ok() bool {
 	return g.ep != nil && g.conn != nil
 }
 
+// Sum returns a hash of the datagram g was made for; 0 if unknown.
+// Exact duplicates of a datagram (ex: retransmits) hash the same.
+func (g *GUDPConn) Sum() uint64 {
+	return g.sum
+}
+
+// Ready returns true if g is connected to its netstack endpoint;
+// that is, if datagrams can be read from and written to it.
+func (g *GUDPConn) Ready() bool {
+	return g.ok()
+}
+
+// Alive returns true if g is connected to its netstack endpoint and has
+// not been closed; implements core.Liveness.
+func (g *GUDPConn) Alive() bool {
+	return g.ok() && !g.closed.Load()
+}
+
 func (g *GUDPConn) StatefulTeardown() (fin bool) {
 	if !g.ok() {
 		g.Connect(false) // establish circuit then teardown
@@ -109,6 +278,17 @@ func (g *GUDPConn) StatefulTeardown() (fin bool) {
 	return g.Close() == nil // then fin
 }
 
+// Refuse closes g, and has the stack answer the datagram g was made for
+// with an icmp port unreachable, as if nothing was bound to its dst; so
+// that apps fail right away instead of waiting on a reply. The icmp is
+// sent only if Refuse is called before the handler's Proxy (or ProxyMux)
+// returns.
+func (g *GUDPConn) Refuse() {
+	g.refused.Store(true)
+	_ = g.Close()
+	log.D("ns: udp: refused %v => %v", g.src, g.dst)
+}
+
 func (g *GUDPConn) Connect(fin bool) error {
 	if fin {
 		return e(&tcpip.ErrHostUnreachable{})
@@ -118,11 +298,19 @@ func (g *GUDPConn) Connect(fin bool) error {
 	// use gonet.DialUDP instead?
 	if endpoint, err := g.req.CreateEndpoint(wq); err != nil {
 		// ex: CONNECT endpoint for [fd66:f83a:c650::1]:15753 => [fd66:f83a:c650::3]:53; err(no route to host)
+		err := endpointErr(g.s, err)
 		log.E("ns: udp: connect: endpoint for %v => %v; err(%v)", g.src, g.dst, err)
-		return e(err)
+		return err
 	} else {
+		// have writes that the tun device was too busy for (ENOBUFS) fail,
+		// and not be dropped silently; see: retrier
+		endpoint.SocketOptions().SetIPv4RecvError(true)
+		endpoint.SocketOptions().SetIPv6RecvError(true)
 		g.ep = endpoint
 		g.conn = gonet.NewUDPConn(wq, endpoint)
+		if tep, ok := endpoint.(stack.TransportEndpoint); ok {
+			g.early.ready(g.req.ID(), tep)
+		}
 	}
 	return nil
 }
@@ -147,7 +335,12 @@ func (g *GUDPConn) RemoteAddr() (addr net.Addr) {
 	return
 }
 
-func (g *GUDPConn) Write(data []byte) (int, error) {
+// Write writes data to the app (src), from the dst it sent datagrams to.
+// The endpoint is bound to dst as seen on the tun device (and so, before
+// alg or nat64 rewrites the dst, if at all), and not to the dst dialed
+// upstream; which keeps the app-visible 5-tuple symmetric, as apps (dns
+// clients, quic stacks) that check the source of replies expect.
+func (g *GUDPConn) Write(data []byte) (n int, err error) {
 	if !g.ok() {
 		return 0, errMissingEp
 	}
@@ -156,28 +349,57 @@ func (g *GUDPConn) Write(data []byte) (int, error) {
 	// ep(state 3 / info &{2048 17 {53 10.111.222.3 17711 10.111.222.1} 1 10.111.222.3 1} / stats &{{{1}} {{0}} {{{0}} {{0}} {{0}} {{0}}} {{{0}} {{0}} {{0}}} {{{0}} {{0}}} {{{0}} {{0}} {{0}}}})
 	// 3: status:datagram-connected / {2048=>proto, 17=>transport, {53=>local-port localip 17711=>remote-port remoteip}=>endpoint-id, 1=>bind-nic-id, ip=>bind-addr, 1=>registered-nic-id}
 	// g.ep may be nil: log.V("ns: writeFrom: from(%v) / ep(state %v / info %v / stats %v)", addr, g.ep.State(), g.ep.Info(), g.ep.Stats())
-	return g.conn.Write(data)
+	// writes the tun device was too busy for were retried; see: retrier
+	n, err = g.conn.Write(data)
+	if err != nil && transientErr(err) {
+		log.D("ns: udp: write %v => %v; tun busy, retries exhausted", g.dst, g.src)
+	}
+	g.dropErrs()
+	return
 }
 
-func (g *GUDPConn) Read(data []byte) (int, error) {
-	if !g.ok() {
-		return 0, errMissingEp
+// dropErrs drops icmp errors (ex: port unreachable, from the app) that
+// netstack queued on g's endpoint, as it was asked to report errors; see:
+// Connect. They are of no use, and would otherwise pile up.
+func (g *GUDPConn) dropErrs() {
+	so := g.ep.SocketOptions()
+	for so.PeekErr() != nil {
+		so.DequeueErr()
 	}
-	return g.conn.Read(data)
 }
 
-func (g *GUDPConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+// Read reads datagrams from the app; those that do not fit into the
+// mtu g is clamped to, if any, are dropped; see: ClampMTU
+func (g *GUDPConn) Read(data []byte) (int, error) {
 	if !g.ok() {
 		return 0, errMissingEp
 	}
-	return g.conn.WriteTo(data, addr)
+	for {
+		n, err := g.conn.Read(data)
+		if err != nil || !g.tooBig(n) {
+			return n, err
+		}
+	}
 }
 
+// WriteTo implements core.UDPConn.WriteTo; writes to the app, as with
+// Write, since g is connected; addr, which may be that of the upstream
+// (a realip, say), is never the app's and so is ignored.
+func (g *GUDPConn) WriteTo(data []byte, _ net.Addr) (int, error) {
+	return g.Write(data)
+}
+
+// ReadFrom is Read, but also returns the addr of the app.
 func (g *GUDPConn) ReadFrom(data []byte) (int, net.Addr, error) {
 	if !g.ok() {
 		return 0, nil, errMissingEp
 	}
-	return g.conn.ReadFrom(data)
+	for {
+		n, addr, err := g.conn.ReadFrom(data)
+		if err != nil || !g.tooBig(n) {
+			return n, addr, err
+		}
+	}
 }
 
 func (g *GUDPConn) SetDeadline(t time.Time) error {
@@ -203,6 +425,7 @@ func (g *GUDPConn) SetWriteDeadline(t time.Time) error {
 
 // Close closes the connection.
 func (g *GUDPConn) Close() error {
+	g.closed.Store(true)
 	if !g.ok() {
 		_ = g.Connect(true)
 		return nil
@@ -0,0 +1,292 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstack
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// algUDP relays flows to alg ips to their realips, as intra's udp handler
+// does: the upstream conn (here, an echo over net.Pipe) is to the realip,
+// and replies are written back into the flow's GUDPConn.
+type algUDP struct {
+	realips map[netip.Addr]netip.Addr // alg ip -> realip
+	flows   chan [2]netip.AddrPort    // src, dst as seen by Proxy
+}
+
+func (h *algUDP) Proxy(gconn *GUDPConn, src, dst netip.AddrPort) bool {
+	if err := gconn.Connect(false); err != nil {
+		return false
+	}
+	h.flows <- [2]netip.AddrPort{src, dst}
+	realip, ok := h.realips[dst.Addr()]
+	if !ok {
+		gconn.Close()
+		return false
+	}
+
+	local, remote := net.Pipe()
+	go func() { // the realip echoes back whatever it gets
+		defer remote.Close()
+		b := make([]byte, 1500)
+		for {
+			n, err := remote.Read(b)
+			if err != nil {
+				return
+			}
+			// replies are from the realip, and say so
+			reply := append([]byte(realip.String()+":"), b[:n]...)
+			if _, err := remote.Write(reply); err != nil {
+				return
+			}
+		}
+	}()
+	go func() { // upload; local is closed by download, after the reply
+		b := make([]byte, 1500)
+		_ = gconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := gconn.Read(b)
+		if err != nil {
+			return
+		}
+		_, _ = local.Write(b[:n])
+	}()
+	go func() { // download; addressed to the upstream, as muxed conns do
+		defer gconn.Close()
+		defer local.Close()
+		_ = local.SetReadDeadline(time.Now().Add(2 * time.Second))
+		up := net.UDPAddrFromAddrPort(netip.AddrPortFrom(realip, dst.Port()))
+		b := make([]byte, 1500)
+		for {
+			n, err := local.Read(b)
+			if err != nil {
+				return
+			}
+			if _, err := gconn.WriteTo(b[:n], up); err != nil {
+				return
+			}
+		}
+	}()
+	return true
+}
+
+func (h *algUDP) ProxyMux(gconn *GUDPConn, _ netip.AddrPort) bool {
+	gconn.Close()
+	return false
+}
+func (h *algUDP) CloseConns([]string) []string { return nil }
+func (h *algUDP) End() error                   { return nil }
+
+// Replies to flows to alg ips must come from the very alg ip the app
+// sent to (and not from its realip), or apps that check (dns clients,
+// quic) drop them; that is, the app-visible 5-tuple must be symmetric.
+func TestUDPReplySourceIsDialedDst(t *testing.T) {
+	alg1 := netip.MustParseAddrPort("100.64.0.5:53")
+	alg2 := netip.MustParseAddrPort("100.64.0.6:443")
+	h := &algUDP{
+		realips: map[netip.Addr]netip.Addr{
+			alg1.Addr(): netip.MustParseAddr("93.184.216.34"),
+			alg2.Addr(): netip.MustParseAddr("1.1.1.1"),
+		},
+		flows: make(chan [2]netip.AddrPort, 2),
+	}
+	client := tunPair(t, func(s *stack.Stack) {
+		setupUdpHandler(s, h)
+	})
+
+	// one unconnected socket sends to both alg ips
+	laddr := &tcpip.FullAddress{NIC: 1, Addr: iperfClient, Port: 40000}
+	c, err := gonet.DialUDP(client, laddr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, dst := range []netip.AddrPort{alg1, alg2} {
+		if _, err := c.WriteTo([]byte("q"), net.UDPAddrFromAddrPort(dst)); err != nil {
+			t.Fatal(err)
+		}
+		flow := <-h.flows
+		if flow[1] != dst {
+			t.Errorf("udp: handler saw dst %s, want %s", flow[1], dst)
+		}
+
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b := make([]byte, 1500)
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("udp: %s: no reply; err: %v", dst, err)
+		}
+		realip := h.realips[dst.Addr()]
+		if want := realip.String() + ":q"; string(b[:n]) != want {
+			t.Errorf("udp: %s: want reply %q, got %q", dst, want, b[:n])
+		}
+		got := from.(*net.UDPAddr).AddrPort()
+		got = netip.AddrPortFrom(got.Addr().Unmap(), got.Port())
+		if got != dst {
+			t.Errorf("udp: reply from %s; want %s (not realip %s)", got, dst, realip)
+		}
+	}
+}
+
+// sumUDP reads the datagram each flow was made for, and records its sum.
+type sumUDP struct {
+	sums chan uint64
+	data chan string
+}
+
+func (h *sumUDP) Proxy(gconn *GUDPConn, _, _ netip.AddrPort) bool {
+	defer gconn.Close()
+	h.sums <- gconn.Sum()
+	if err := gconn.Connect(false); err != nil {
+		h.data <- err.Error()
+		return false
+	}
+	b := make([]byte, 64)
+	n, err := gconn.Read(b)
+	if err != nil {
+		h.data <- err.Error()
+		return false
+	}
+	h.data <- string(b[:n])
+	return true
+}
+func (h *sumUDP) ProxyMux(gconn *GUDPConn, src netip.AddrPort) bool {
+	return h.Proxy(gconn, src, netip.AddrPort{})
+}
+func (*sumUDP) CloseConns([]string) []string { return nil }
+func (*sumUDP) End() error                   { return nil }
+
+func TestUDPSumOfRetransmits(t *testing.T) {
+	h := &sumUDP{sums: make(chan uint64, 3), data: make(chan string, 3)}
+	client := tunPair(t, func(s *stack.Stack) {
+		setupUdpHandler(s, h)
+	})
+
+	var sums []uint64
+	for _, q := range []string{"query", "query", "other"} {
+		// retransmits, as by dns stubs, from a new port each
+		dst := &tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 53}
+		c, err := gonet.DialUDP(client, nil, dst, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(q)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case sum := <-h.sums:
+			sums = append(sums, sum)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("sum: %s: no flow", q)
+		}
+		// hashing the datagram leaves it be
+		if got := <-h.data; got != q {
+			t.Errorf("sum: %s: read %q", q, got)
+		}
+		c.Close()
+	}
+	if sums[0] == 0 || sums[0] != sums[1] || sums[0] == sums[2] {
+		t.Errorf("sum: %x; want first two the same, and non-zero", sums)
+	}
+}
+
+// slowUDP connects the first flow it sees only once let go, as if its
+// upstream takes a while; and records flows seen after it.
+type slowUDP struct {
+	entered chan struct{}
+	letgo   chan struct{}
+	data    chan string
+	flows   atomic.Int32
+}
+
+func (h *slowUDP) Proxy(gconn *GUDPConn, _, _ netip.AddrPort) bool {
+	if h.flows.Add(1) > 1 { // must not happen
+		gconn.Close()
+		return false
+	}
+	close(h.entered)
+	<-h.letgo
+	if err := gconn.Connect(false); err != nil {
+		close(h.data)
+		return false
+	}
+	go func() {
+		defer gconn.Close()
+		defer close(h.data)
+		b := make([]byte, 64)
+		for {
+			_ = gconn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := gconn.Read(b)
+			if err != nil {
+				return
+			}
+			h.data <- string(b[:n])
+		}
+	}()
+	return true
+}
+func (h *slowUDP) ProxyMux(gconn *GUDPConn, src netip.AddrPort) bool {
+	return h.Proxy(gconn, src, netip.AddrPort{})
+}
+func (*slowUDP) CloseConns([]string) []string { return nil }
+func (*slowUDP) End() error                   { return nil }
+
+// Datagrams of a flow that arrive while its first one is being forwarded
+// (and so, before its endpoint is made) must neither be lost nor seen as
+// new flows.
+func TestUDPEarlyDatagrams(t *testing.T) {
+	h := &slowUDP{
+		entered: make(chan struct{}),
+		letgo:   make(chan struct{}),
+		data:    make(chan string, maxEarly+2),
+	}
+	client := tunPair(t, func(s *stack.Stack) {
+		setupUdpHandler(s, h)
+	})
+
+	dst := &tcpip.FullAddress{NIC: 1, Addr: iperfServer, Port: 443}
+	c, err := gonet.DialUDP(client, nil, dst, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the pipe link delivers in the writer's goroutine; so the first
+	// datagram, held up in Proxy, is sent from another
+	go c.Write([]byte("0"))
+	<-h.entered
+
+	const n = 5
+	for i := 1; i < n; i++ {
+		if _, err := c.Write([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(h.letgo)
+
+	var got []string
+	for d := range h.data {
+		got = append(got, d)
+	}
+	if want := []string{"0", "1", "2", "3", "4"}; !slices.Equal(got, want) {
+		t.Errorf("early: got %v; want %v", got, want)
+	}
+	if f := h.flows.Load(); f != 1 {
+		t.Errorf("early: %d flows; want 1", f)
+	}
+}
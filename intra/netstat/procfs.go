@@ -11,6 +11,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"os"
@@ -234,8 +235,17 @@ func ParseProcNet(protocol string) ([]ProcNetEntry, error) {
 	}
 	defer fd.Close()
 
+	entries := parseProcNet(protocol, filename, fd)
+
+	go cleanupPool()
+
+	return entries, nil
+}
+
+// parseProcNet parses lines of /proc/net/protocol (named filename) from r.
+func parseProcNet(protocol, filename string, r io.Reader) []ProcNetEntry {
 	entries := make([]ProcNetEntry, 0)
-	scanner := bufio.NewScanner(fd)
+	scanner := bufio.NewScanner(r)
 	for lineno := 0; scanner.Scan(); lineno++ {
 		// skip column names
 		if lineno == 0 {
@@ -259,10 +269,7 @@ func ParseProcNet(protocol string) ([]ProcNetEntry, error) {
 			decToInt(m[6]),
 		))
 	}
-
-	go cleanupPool()
-
-	return entries, nil
+	return entries
 }
 
 func cleanupPool() {
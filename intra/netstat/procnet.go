@@ -0,0 +1,236 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstat
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// default max age of tables that lookups are served from
+	DefaultStaleness = 2 * time.Second
+	// tables are re-read at most once in this long on lookup misses
+	rescangap = 50 * time.Millisecond
+	// tables not looked up in this long are no longer refreshed
+	procnetidle = 1 * time.Minute
+)
+
+// procnettab is a snapshot of a /proc/net/* table.
+type procnettab struct {
+	byport map[int][]*ProcNetEntry // src port -> entries
+	at     time.Time               // when read
+	used   atomic.Int64            // unix nano of the last lookup
+}
+
+// ProcNet serves lookups of /proc/net/* entries (and so, the uid that owns
+// a socket) from snapshots of its tables, indexed by src port; which are
+// refreshed in the background, once looked up, so that they are never
+// older than its staleness. Lookups that miss re-read the tables, once.
+type ProcNet struct {
+	sync.RWMutex                        // protects tabs, sigterm, stopped
+	tabs         map[string]*procnettab // protocol -> table
+	stale        atomic.Int64           // max age (ns) of tables
+	scans        *core.Barrier          // coalesces reads of a table
+	read         func(protocol string) ([]ProcNetEntry, error)
+	started      atomic.Bool        // refresher started
+	sigterm      context.CancelFunc // stops the refresher
+	stopped      bool               // refresher stopped
+}
+
+// NewProcNet returns a ProcNet with its staleness bound to d, or to
+// DefaultStaleness if d is not positive. Its refresher starts on the
+// first lookup, and must be stopped with Stop.
+func NewProcNet(d time.Duration) *ProcNet {
+	return newProcNet(d, ParseProcNet)
+}
+
+func newProcNet(d time.Duration, read func(string) ([]ProcNetEntry, error)) *ProcNet {
+	p := &ProcNet{
+		tabs:  make(map[string]*procnettab),
+		scans: core.NewBarrier(rescangap),
+		read:  read,
+	}
+	p.SetStaleness(d)
+	return p
+}
+
+// SetStaleness bounds the age of tables lookups are served from to d,
+// or to DefaultStaleness if d is not positive.
+func (p *ProcNet) SetStaleness(d time.Duration) {
+	if d <= 0 {
+		d = DefaultStaleness
+	}
+	p.stale.Store(int64(d))
+	log.I("procnet: staleness %s", d)
+}
+
+func (p *ProcNet) staleness() time.Duration {
+	return time.Duration(p.stale.Load())
+}
+
+// Find returns the entry of protocol (tcp, udp, icmp) matching src and dst
+// from its v4 or v6 table, if any; see: FindProcNetEntry.
+func (p *ProcNet) Find(protocol string, src, dst netip.AddrPort) *ProcNetEntry {
+	p.start()
+
+	protos := []string{protocol}
+	if !strings.HasSuffix(protocol, "6") {
+		protos = append(protos, protocol+"6")
+	}
+	q := NewProcNetEntry(protocol, src.Addr().Unmap(), int(src.Port()), dst.Addr().Unmap(), int(dst.Port()), 0, 0)
+
+	for _, rescan := range []bool{false, true} {
+		for _, proto := range protos {
+			q.Protocol = proto
+			if e := p.lookup(&q, rescan); e != nil {
+				return e
+			}
+		}
+	}
+	log.V("procnet: %s %s -> %s: not found", protocol, src, dst)
+	return nil
+}
+
+// lookup returns the entry matching q from its protocol's table; which
+// is re-read if it is too old, or if rescan is set.
+func (p *ProcNet) lookup(q *ProcNetEntry, rescan bool) *ProcNetEntry {
+	t := p.table(q.Protocol, rescan)
+	if t == nil {
+		return nil
+	}
+	t.used.Store(time.Now().UnixNano())
+	// return on first match since q.Same is pretty lax and deliberately
+	// not exact at matching the various procnet entries
+	for _, e := range t.byport[q.SrcPort] {
+		if q.Same(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+// table returns the table of protocol, reading it if it is missing,
+// is older than the staleness bound, or if rescan is set.
+func (p *ProcNet) table(protocol string, rescan bool) *procnettab {
+	p.RLock()
+	t := p.tabs[protocol]
+	p.RUnlock()
+
+	if t != nil && !rescan && time.Since(t.at) <= p.staleness() {
+		return t
+	}
+	v, _ := p.scans.Do(protocol, func() (any, error) {
+		return p.scan(protocol)
+	})
+	if nt, ok := v.Val.(*procnettab); ok && nt != nil {
+		return nt
+	}
+	return t // may be nil
+}
+
+// scan reads the table of protocol, and replaces the one held, if any.
+func (p *ProcNet) scan(protocol string) (*procnettab, error) {
+	entries, err := p.read(protocol)
+	if err != nil {
+		log.W("procnet: read %s: %v", protocol, err)
+		return nil, err
+	}
+
+	t := &procnettab{
+		byport: make(map[int][]*ProcNetEntry, len(entries)),
+		at:     time.Now(),
+	}
+	for i := range entries {
+		e := &entries[i]
+		t.byport[e.SrcPort] = append(t.byport[e.SrcPort], e)
+	}
+
+	p.Lock()
+	if old := p.tabs[protocol]; old != nil {
+		t.used.Store(old.used.Load())
+	} else {
+		t.used.Store(t.at.UnixNano())
+	}
+	p.tabs[protocol] = t
+	p.Unlock()
+	return t, nil
+}
+
+// start starts the refresher, unless it was started (or stopped) before.
+func (p *ProcNet) start() {
+	if p.started.Load() {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stopped || p.started.Load() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.sigterm = cancel
+	p.started.Store(true)
+	go p.run(ctx)
+}
+
+func (p *ProcNet) run(ctx context.Context) {
+	t := time.NewTimer(p.staleness())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.I("procnet: stopped")
+			return
+		case <-t.C:
+			p.refresh()
+			t.Reset(p.staleness())
+		}
+	}
+}
+
+// refresh re-reads tables looked up recently, and drops the rest.
+func (p *ProcNet) refresh() {
+	p.Lock()
+	protos := make([]string, 0, len(p.tabs))
+	for proto, t := range p.tabs {
+		if time.Since(time.Unix(0, t.used.Load())) > procnetidle {
+			delete(p.tabs, proto)
+			continue
+		}
+		protos = append(protos, proto)
+	}
+	p.Unlock()
+
+	for _, proto := range protos {
+		_, _ = p.scans.Do(proto, func() (any, error) {
+			return p.scan(proto)
+		})
+	}
+}
+
+// Stop stops the refresher; lookups continue to be served, but from
+// tables re-read on lookup, as needed.
+func (p *ProcNet) Stop() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.stopped = true
+	if p.sigterm != nil {
+		p.sigterm()
+	}
+	clear(p.tabs)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package netstat
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const procnethdr = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// procnetLine formats a /proc/net/tcp line for 10.0.x.y:sport -> 1.1.1.1:443.
+func procnetLine(i, sport, uid int) string {
+	// ips are in host (little endian) byte order
+	src := fmt.Sprintf("%02X%02X000A", i&0xff, (i>>8)&0xff)
+	return fmt.Sprintf("%4d: %s:%04X 01010101:01BB 01 00000000:00000000 00:00000000 00000000 %5d        0 %d 1 0000000000000000 20 4 30 10 -1\n",
+		i, src, sport, uid, 100000+i)
+}
+
+func procnetSrc(i, sport int) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), uint16(sport))
+}
+
+var procnetDst = netip.MustParseAddrPort("1.1.1.1:443")
+
+// fakeProcNet is an in-memory /proc/net/tcp of n sockets; tcp6 is empty.
+type fakeProcNet struct {
+	sync.Mutex
+	txt   strings.Builder
+	n     int
+	reads atomic.Int32
+}
+
+func newFakeProcNet(n int) *fakeProcNet {
+	f := new(fakeProcNet)
+	f.txt.WriteString(procnethdr)
+	for range n {
+		f.add()
+	}
+	return f
+}
+
+// add adds a socket with src port 10000+i, owned by uid 10000+i.
+func (f *fakeProcNet) add() (i int) {
+	f.Lock()
+	defer f.Unlock()
+	i = f.n
+	f.txt.WriteString(procnetLine(i, 10000+i, 10000+i))
+	f.n++
+	return
+}
+
+func (f *fakeProcNet) read(protocol string) ([]ProcNetEntry, error) {
+	f.reads.Add(1)
+	if protocol != "tcp" {
+		return parseProcNet(protocol, protocol, strings.NewReader(procnethdr)), nil
+	}
+	f.Lock()
+	txt := f.txt.String()
+	f.Unlock()
+	return parseProcNet(protocol, protocol, strings.NewReader(txt)), nil
+}
+
+func TestProcNetFind(t *testing.T) {
+	f := newFakeProcNet(100)
+	p := newProcNet(time.Hour, f.read)
+	defer p.Stop()
+
+	e := p.Find("tcp", procnetSrc(42, 10042), procnetDst)
+	if e == nil || e.UserID != 10042 {
+		t.Fatalf("procnet: want uid 10042, got %v", e)
+	}
+	reads := f.reads.Load()
+	if e = p.Find("tcp", procnetSrc(7, 10007), procnetDst); e == nil || e.UserID != 10007 {
+		t.Fatalf("procnet: want uid 10007, got %v", e)
+	}
+	if n := f.reads.Load(); n != reads {
+		t.Errorf("procnet: hit re-read the table; reads %d => %d", reads, n)
+	}
+
+	// a socket newer than the snapshot is found by the re-scan on miss
+	time.Sleep(2 * rescangap) // past coalesced reads
+	i := f.add()
+	if e = p.Find("tcp", procnetSrc(i, 10000+i), procnetDst); e == nil || e.UserID != 10000+i {
+		t.Fatalf("procnet: new socket: want uid %d, got %v", 10000+i, e)
+	}
+
+	// unknown sockets re-scan once, then give up
+	if e = p.Find("tcp", procnetSrc(1, 9), procnetDst); e != nil {
+		t.Errorf("procnet: unknown socket: got %v", e)
+	}
+}
+
+func TestProcNetStaleness(t *testing.T) {
+	f := newFakeProcNet(10)
+	p := newProcNet(20*time.Millisecond, f.read)
+	defer p.Stop()
+
+	if e := p.Find("tcp", procnetSrc(1, 10001), procnetDst); e == nil {
+		t.Fatal("procnet: want entry")
+	}
+	// the refresher keeps tables in use fresh
+	reads := f.reads.Load()
+	time.Sleep(100 * time.Millisecond)
+	if n := f.reads.Load(); n <= reads {
+		t.Errorf("procnet: not refreshed; reads %d => %d", reads, n)
+	}
+
+	p.Stop()
+	reads = f.reads.Load()
+	time.Sleep(100 * time.Millisecond)
+	if n := f.reads.Load(); n != reads {
+		t.Errorf("procnet: refreshed after stop; reads %d => %d", reads, n)
+	}
+	// lookups continue to be served once stopped
+	if e := p.Find("tcp", procnetSrc(2, 10002), procnetDst); e == nil {
+		t.Fatal("procnet: stopped: want entry")
+	}
+}
+
+// benchmarks per-flow uid lookups over a few thousand sockets: parsing
+// the table on every flow (as FindProcNetEntry does), versus ProcNet.
+
+const procnetBenchN = 4000
+
+func BenchmarkProcNetFindUncached(b *testing.B) {
+	f := newFakeProcNet(procnetBenchN)
+	b.ResetTimer()
+	for i := range b.N {
+		j := i % procnetBenchN
+		q := NewProcNetEntry("tcp", procnetSrc(j, 10000+j).Addr(), 10000+j, procnetDst.Addr(), int(procnetDst.Port()), 0, 0)
+		entries, _ := f.read("tcp")
+		var found *ProcNetEntry
+		for k := range entries {
+			if q.Same(&entries[k]) {
+				found = &entries[k]
+				break
+			}
+		}
+		if found == nil {
+			b.Fatalf("procnet: %d not found", j)
+		}
+	}
+}
+
+func BenchmarkProcNetFindCached(b *testing.B) {
+	f := newFakeProcNet(procnetBenchN)
+	p := newProcNet(DefaultStaleness, f.read)
+	defer p.Stop()
+	b.ResetTimer()
+	for i := range b.N {
+		j := i % procnetBenchN
+		if p.Find("tcp", procnetSrc(j, 10000+j), procnetDst) == nil {
+			b.Fatalf("procnet: %d not found", j)
+		}
+	}
+}
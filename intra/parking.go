@@ -0,0 +1,230 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// default duration a deferred flow is held for
+	defparktimeout = 20 * time.Second
+	// max duration a deferred flow may be held for; tcp clients
+	// retransmit syns for about as long before giving up
+	maxparktimeout = 60 * time.Second
+	// max flows held at once; must be well under netstack's tcp
+	// forwarder maxInFlight (128) as held syns count against it
+	maxparked = 64
+)
+
+var (
+	errFlowNotParked = errors.New("flow: not parked")
+	errFlowNoVerdict = errors.New("flow: invalid verdict")
+)
+
+// parking holds flows for which the client deferred its verdict (ipn.Defer),
+// until the client resolves them (Tunnel.ResolveFlow) or they time out.
+type parking struct {
+	sync.Mutex                    // protects flows
+	flows      map[string]*parked // cid -> held flow
+	timeout    atomic.Int64       // time.Duration
+	fallback   atomic.Value       // string; pid on timeout
+}
+
+// parked is a flow held by parking.
+type parked struct {
+	ch  chan string // verdict (pid)
+	uid string      // owner of the flow
+}
+
+// parkedconn stands in for a parked flow in conntrackers, so that parked
+// flows are seen along with active ones; closing it blocks the flow.
+type parkedconn struct {
+	net.Conn // unused; parked flows have no conns yet
+	p        *parking
+	cid      string
+}
+
+var _ core.Liveness = (*parkedconn)(nil)
+
+// Close implements net.Conn.
+func (c *parkedconn) Close() error {
+	_ = c.p.resolve(c.cid, ipn.Block) // errs if resolved since
+	return nil
+}
+
+// Alive implements core.Liveness; parked flows are never leaked.
+func (c *parkedconn) Alive() bool { return true }
+
+func newParking() *parking {
+	p := &parking{
+		flows: make(map[string]*parked),
+	}
+	p.timeout.Store(int64(defparktimeout))
+	p.fallback.Store(ipn.Block)
+	return p
+}
+
+// setPolicy sets how long flows are held for, and the pid
+// they are resolved to, if the client doesn't resolve them in time.
+func (p *parking) setPolicy(timeout time.Duration, fallback string) {
+	if timeout <= 0 {
+		timeout = defparktimeout
+	} else if timeout > maxparktimeout {
+		timeout = maxparktimeout
+	}
+	if len(fallback) <= 0 || fallback == ipn.Defer {
+		fallback = ipn.Block
+	}
+	p.timeout.Store(int64(timeout))
+	p.fallback.Store(fallback)
+	log.I("flow: park: timeout %s; fallback %s", timeout, fallback)
+}
+
+// policy returns how long flows are held for, and the pid they are
+// resolved to, if the client doesn't resolve them in time.
+func (p *parking) policy() (timeout time.Duration, fallback string) {
+	fallback, _ = p.fallback.Load().(string)
+	return time.Duration(p.timeout.Load()), fallback
+}
+
+func (p *parking) fallbackFor(res *Mark) *Mark {
+	pid, _ := p.fallback.Load().(string)
+	return &Mark{PID: pid, CID: res.CID, UID: res.UID}
+}
+
+// wait holds the deferred flow res until it is resolved or times out,
+// and returns res with the resolved pid; or blocked, if done is closed
+// (ex: as the handler ends) before then. While held, the flow is tracked
+// in cm tagged with t; and is blocked, if closed there. Must be called from
+// a goroutine that may block for as long as the park timeout.
+func (p *parking) wait(res *Mark, cm core.ConnMapper, t core.ConnTuple, done <-chan struct{}) *Mark {
+	cid := res.CID
+	ch := make(chan string, 1)
+
+	p.Lock()
+	_, dup := p.flows[cid]
+	full := len(p.flows) >= maxparked
+	if ok := len(cid) > 0 && !dup && !full; ok {
+		p.flows[cid] = &parked{ch: ch, uid: res.UID}
+	}
+	p.Unlock()
+
+	if len(cid) <= 0 || dup || full {
+		log.W("flow: park: %s not parked; dup? %t full? %t", cid, dup, full)
+		return p.fallbackFor(res)
+	}
+
+	start := time.Now()
+	tracked := cm.TrackTuple(t, start, cid, &parkedconn{p: p, cid: cid}) > 0
+	defer func() {
+		p.Lock()
+		delete(p.flows, cid)
+		p.Unlock()
+		if tracked { // closes parkedconn, as cid is no longer parked
+			cm.Untrack(cid)
+		}
+	}()
+
+	if !tracked {
+		log.I("flow: park: %s blocked; uid %s purged", cid, res.UID)
+		return &Mark{PID: ipn.Block, CID: res.CID, UID: res.UID}
+	}
+
+	timeout := time.Duration(p.timeout.Load())
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case pid := <-ch:
+		log.I("flow: park: %s resolved to %s in %s", cid, pid, time.Since(start))
+		return &Mark{PID: pid, CID: res.CID, UID: res.UID}
+	case <-timer.C:
+		out := p.fallbackFor(res)
+		log.I("flow: park: %s timed out after %s; fallback %s", cid, timeout, out.PID)
+		return out
+	case <-done:
+		log.I("flow: park: %s blocked; ended after %s", cid, time.Since(start))
+		return &Mark{PID: ipn.Block, CID: res.CID, UID: res.UID}
+	}
+}
+
+// resolve releases the flow cid to the proxy pid, or blocks it.
+func (p *parking) resolve(cid, pid string) error {
+	if len(pid) <= 0 || pid == ipn.Defer {
+		return errFlowNoVerdict
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	f, ok := p.flows[cid]
+	if !ok {
+		return errFlowNotParked
+	}
+	delete(p.flows, cid) // a flow is resolved at most once
+	f.ch <- pid          // never blocks; ch is buffered
+	return nil
+}
+
+// release blocks flows in cids, or all flows if cids is empty,
+// and returns the cids of the flows that were blocked.
+func (p *parking) release(cids []string) (out []string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(cids) <= 0 {
+		for cid := range p.flows {
+			cids = append(cids, cid)
+		}
+	}
+	for _, cid := range cids {
+		if f, ok := p.flows[cid]; ok {
+			delete(p.flows, cid)
+			f.ch <- ipn.Block
+			out = append(out, cid)
+		}
+	}
+	return
+}
+
+// releaseUid blocks all flows owned by uid, and
+// returns the cids of the flows that were blocked.
+func (p *parking) releaseUid(uid string) (out []string) {
+	p.Lock()
+	defer p.Unlock()
+
+	for cid, f := range p.flows {
+		if f.uid == uid {
+			delete(p.flows, cid)
+			f.ch <- ipn.Block
+			out = append(out, cid)
+		}
+	}
+	return
+}
+
+// list returns a csv of cids of all held flows.
+func (p *parking) list() string {
+	p.Lock()
+	defer p.Unlock()
+
+	cids := make([]string, 0, len(p.flows))
+	for cid := range p.flows {
+		cids = append(cids, cid)
+	}
+	return strings.Join(cids, ",")
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+)
+
+func TestParkingWait(t *testing.T) {
+	p := newParking()
+	p.setPolicy(maxparktimeout, ipn.Base)
+	cm := core.NewConnMap().Proto(ProtoTypeTCP)
+	tup := core.ConnTuple{Uid: "10001"}
+	never := make(chan struct{})
+
+	// resolved
+	go func() {
+		for p.resolve("c1", ipn.Exit) != nil {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if res := p.wait(&Mark{PID: ipn.Defer, CID: "c1"}, cm, tup, never); res.PID != ipn.Exit {
+		t.Errorf("park: c1 resolved to %s; want %s", res.PID, ipn.Exit)
+	}
+
+	// ended, while parked; blocked, and not let through to the fallback
+	done := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+	start := time.Now()
+	if res := p.wait(&Mark{PID: ipn.Defer, CID: "c2"}, cm, tup, done); res.PID != ipn.Block {
+		t.Errorf("park: c2 ended as %s; want %s", res.PID, ipn.Block)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("park: c2 held for %s after end", d)
+	}
+	if l := p.list(); len(l) > 0 {
+		t.Errorf("park: %s still parked", l)
+	}
+
+	// released, as the flow closed
+	go func() {
+		for len(p.release([]string{"c4"})) <= 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if res := p.wait(&Mark{PID: ipn.Defer, CID: "c4"}, cm, tup, never); res.PID != ipn.Block {
+		t.Errorf("park: c4 released as %s; want %s", res.PID, ipn.Block)
+	}
+	if l := p.list(); len(l) > 0 {
+		t.Errorf("park: %s still parked", l)
+	}
+	if err := p.resolve("c4", ipn.Exit); err != errFlowNotParked {
+		t.Errorf("park: c4 resolved once released; err %v", err)
+	}
+
+	// timed out
+	p.setPolicy(10*time.Millisecond, ipn.Base)
+	if res := p.wait(&Mark{PID: ipn.Defer, CID: "c3"}, cm, tup, never); res.PID != ipn.Base {
+		t.Errorf("park: c3 timed out as %s; want %s", res.PID, ipn.Base)
+	}
+	// no cid; not parked
+	if res := p.wait(&Mark{PID: ipn.Defer}, cm, tup, never); res.PID != ipn.Base {
+		t.Errorf("park: sans cid as %s; want %s", res.PID, ipn.Base)
+	}
+	if err := p.resolve("c3", ipn.Defer); err != errFlowNoVerdict {
+		t.Errorf("park: resolved to %s; err %v", ipn.Defer, err)
+	}
+	if n := cm.Len(); n != 0 {
+		t.Errorf("park: %d flows tracked once resolved", n)
+	}
+}
+
+func TestParkingTracked(t *testing.T) {
+	p := newParking()
+	p.setPolicy(maxparktimeout, ipn.Base)
+	cm := core.NewConnMap()
+	tcp := cm.Proto(ProtoTypeTCP)
+	never := make(chan struct{})
+	dst := netip.MustParseAddr("192.0.2.1")
+
+	park := func(cid, uid string) <-chan *Mark {
+		out := make(chan *Mark, 1)
+		go func() {
+			out <- p.wait(&Mark{PID: ipn.Defer, CID: cid, UID: uid}, tcp, core.ConnTuple{Uid: uid, Dst: dst}, never)
+		}()
+		eventually(t, 5*time.Second, func() bool { _, ok := tcp.Tuple(cid); return ok },
+			"park: %s not tracked", cid)
+		return out
+	}
+	verdict := func(cid string, ch <-chan *Mark, want string) {
+		t.Helper()
+		select {
+		case res := <-ch:
+			if res.PID != want {
+				t.Errorf("park: %s: got %s; want %s", cid, res.PID, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("park: %s still held", cid)
+		}
+	}
+
+	// parked flows are seen along with active ones
+	c1, c2, c3 := park("c1", "10001"), park("c2", "10001"), park("c3", "10002")
+	if got := cm.Find(core.ConnTuple{Proto: ProtoTypeTCP, Uid: "10001"}); len(got) != 2 {
+		t.Errorf("park: found %v; want c1, c2", got)
+	}
+	if got, _ := cm.Audit(0, 0, nil); len(got) != 0 {
+		t.Errorf("park: %v audited as leaks", got)
+	}
+
+	// closing a parked flow blocks it
+	tcp.UntrackBatch([]string{"c1"})
+	verdict("c1", c1, ipn.Block)
+	// resolved flows are no longer tracked as parked
+	if err := p.resolve("c2", ipn.Exit); err != nil {
+		t.Fatal(err)
+	}
+	verdict("c2", c2, ipn.Exit)
+	if _, ok := tcp.Tuple("c2"); ok {
+		t.Error("park: c2 tracked once resolved")
+	}
+	// so are flows of uids purged
+	tcp.UntrackUid("10002")
+	verdict("c3", c3, ipn.Block)
+	if n := cm.Len(); n != 0 {
+		t.Errorf("park: %d flows tracked", n)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// how often tcp flows are checked for dead peers
+	peerdeadfreq = 15 * time.Second
+	// tcp flows checked per pass; so that a pass never holds up
+	// the data path for long, see: core.ConnMapper.Reap
+	peerdeadn = 128
+)
+
+// peerdead periodically checks established tcp flows for peers that have
+// vanished without a fin or rst (ex: wifi ap rebooted, carrier nat dropped
+// the mapping), which the copy loops would only notice on their next write,
+// and closes both ends of those found dead; see: core.PeerWatch
+type peerdead struct {
+	tcp     tracker // may be nil
+	watch   *core.PeerWatch
+	after   atomic.Int64 // time.Duration a flow must be stuck for; 0 disables
+	sigterm context.CancelFunc
+}
+
+func newPeerDead(tcph any) *peerdead {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &peerdead{
+		watch:   core.NewPeerWatch(),
+		sigterm: cancel,
+	}
+	p.tcp, _ = tcph.(tracker)
+	go p.run(ctx)
+	return p
+}
+
+func (p *peerdead) run(ctx context.Context) {
+	tick := time.NewTicker(peerdeadfreq)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.I("peerdead: stopped")
+			return
+		case <-tick.C:
+			p.pass()
+		}
+	}
+}
+
+func (p *peerdead) stop() {
+	p.sigterm()
+}
+
+// set sets how long flows must be stuck for to be deemed dead; 0 disables.
+func (p *peerdead) set(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	p.after.Store(int64(d))
+	log.I("peerdead: after %s", d)
+}
+
+// pass checks up to peerdeadn tcp flows, and returns those reaped.
+func (p *peerdead) pass() []string {
+	d := time.Duration(p.after.Load())
+	if d <= 0 || p.tcp == nil {
+		return nil
+	}
+	hs := make([]core.TCPHealth, 0, 2)
+	dead := func(cid string, v []net.Conn) bool {
+		hs = hs[:0]
+		known := false
+		for _, c := range v { // zero health for conns of unknown health
+			h, ok := core.HealthOf(c)
+			hs = append(hs, h)
+			known = known || ok
+		}
+		return known && p.watch.Dead(cid, hs, d)
+	}
+	out := p.tcp.conns().Reap(peerdeadn, errPeerDead, dead)
+	for _, cid := range out {
+		p.watch.Forget(cid)
+	}
+	// flows closed since are forgotten; all flows are checked at
+	// least every (flows / peerdeadn) passes
+	n := p.watch.Prune(peerdeadfreq * time.Duration(p.tcp.conns().Len()/peerdeadn+2))
+	if len(out) > 0 {
+		log.I("peerdead: reaped %d: %v; watching %d", len(out), out, n)
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// SockMark is the outcome of marking the latest socket of an owner with the
+// SO_MARK set for it; see: settings.SetSockMark
+type SockMark struct {
+	// Mark is the SO_MARK set for the owner.
+	Mark uint32 `json:"mark"`
+	// Active is true if the owner's latest socket was marked with Mark.
+	Active bool `json:"active"`
+	// Err is why the owner's latest socket was not marked, if so.
+	Err string `json:"err,omitempty"`
+}
+
+// outcomes of marking sockets, by owner
+var marked = struct {
+	sync.RWMutex
+	m map[string]SockMark
+}{m: make(map[string]SockMark)}
+
+// logged once, on the first eperm (or on platforms sans SO_MARK)
+var markdenied atomic.Bool
+
+// markfd sets SO_MARK on sock, if one is set for who; skipping it with
+// a log (just the once) if not permitted or supported.
+func markfd(who string, sock int) {
+	mark, ok := settings.SockMark(who)
+	if !ok {
+		return
+	}
+	err := setmark(sock, mark)
+	if err != nil && (errors.Is(err, syscall.EPERM) || errors.Is(err, errors.ErrUnsupported)) {
+		if markdenied.CompareAndSwap(false, true) {
+			log.W("control: mark: %s: %d on %d skipped; err: %v", who, mark, sock, err)
+		}
+	} else if err != nil {
+		log.E("control: mark: %s: %d on %d; err: %v", who, mark, sock, err)
+	}
+	m := SockMark{Mark: mark, Active: err == nil}
+	if err != nil {
+		m.Err = err.Error()
+	}
+	marked.Lock()
+	marked.m[who] = m
+	marked.Unlock()
+}
+
+// marker marks sockets of who; see: markfd
+func marker(who string) ControlFn {
+	return func(network, addr string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			markfd(who, int(fd))
+		})
+	}
+}
+
+// SockMarks returns SO_MARKs set (see: settings.SetSockMark) for owners in
+// whos, or all if none, and whether their latest sockets were marked.
+// Owners yet to make a socket are not Active.
+func SockMarks(whos ...string) map[string]SockMark {
+	all := settings.SockMarks()
+	out := make(map[string]SockMark, len(all))
+
+	marked.RLock()
+	defer marked.RUnlock()
+	for who, mark := range all {
+		m, ok := marked.m[who]
+		if !ok || m.Mark != mark {
+			m = SockMark{Mark: mark}
+		}
+		out[who] = m
+	}
+	if len(whos) <= 0 {
+		return out
+	}
+	sub := make(map[string]SockMark, len(whos))
+	for _, who := range whos {
+		if m, ok := out[who]; ok {
+			sub[who] = m
+		}
+	}
+	return sub
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import "golang.org/x/sys/unix"
+
+// setmark sets SO_MARK on sock; needs CAP_NET_ADMIN, or fails with EPERM.
+func setmark(sock int, mark uint32) error {
+	return unix.SetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/celzero/firestack/intra/settings"
+	"golang.org/x/sys/unix"
+)
+
+func getmark(t *testing.T, conn hasSyscallConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		mark, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return mark
+}
+
+func TestSockMark(t *testing.T) {
+	const who, mark = "mark.test", 0x1f2e
+	if err := settings.SetSockMark(who, mark); err != nil {
+		t.Fatal(err)
+	}
+	defer settings.SetSockMark(who, 0)
+
+	// probe for CAP_NET_ADMIN
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setmark(fd, mark)
+	unix.Close(fd)
+	if errors.Is(err, syscall.EPERM) {
+		c, err := MakeNsListener(who, nil).ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if m := SockMarks(who)[who]; m.Active || m.Err == "" {
+			t.Errorf("mark: eperm: got %+v; want inactive", m)
+		}
+		t.Skip("mark: not permitted")
+	}
+
+	l, err := MakeNsListener(who, nil).Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := getmark(t, l.(*net.TCPListener)); got != mark {
+		t.Errorf("mark: listener: got %#x; want %#x", got, mark)
+	}
+
+	c, err := MakeNsDialer(who, nil).Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := getmark(t, c.(*net.TCPConn)); got != mark {
+		t.Errorf("mark: dialer: got %#x; want %#x", got, mark)
+	}
+
+	var ext bool // ext control fns run prior to marking
+	lc := MakeNsListenConfigExt(who, nil, []ControlFn{func(string, string, syscall.RawConn) error {
+		ext = true
+		return nil
+	}})
+	u, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if got := getmark(t, u.(*net.UDPConn)); !ext || got != mark {
+		t.Errorf("mark: listen ext: got %#x (ext? %t); want %#x", got, ext, mark)
+	}
+
+	if m := SockMarks(who)[who]; !m.Active || m.Mark != mark {
+		t.Errorf("mark: got %+v; want active %#x", m, mark)
+	}
+	if _, ok := SockMarks("unmarked")["unmarked"]; ok {
+		t.Errorf("mark: unmarked owner in sockmarks")
+	}
+
+	// unmarked owners make unmarked sockets
+	d, err := MakeNsDialer("unmarked", nil).Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := getmark(t, d.(*net.TCPConn)); got != 0 {
+		t.Errorf("mark: unmarked: got %#x", got)
+	}
+
+	if err := settings.SetSockMark(who, -1); err == nil {
+		t.Errorf("mark: -1 accepted")
+	}
+}
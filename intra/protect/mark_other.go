@@ -0,0 +1,16 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+
+package protect
+
+import "errors"
+
+// setmark is a no-op sans SO_MARK.
+func setmark(sock int, mark uint32) error {
+	return errors.ErrUnsupported
+}
@@ -59,13 +59,14 @@ func maybeGlobalUnicast(addr string, yn bool) bool {
 	return yn
 }
 
-// Binds a socket to a particular network interface.
+// Binds a socket to a particular network interface, after marking it.
 func ifbind(who string, ctl Controller) func(string, string, syscall.RawConn) error {
 	return func(network, addr string, c syscall.RawConn) (err error) {
 		// addr may be a wildcard aka ":<port>", in which case dst is a zero address.
 		log.D("control: netbinder: %s: %s(%s); err? %v", who, network, addr, err)
 		return c.Control(func(fd uintptr) {
 			sock := int(fd)
+			markfd(who, sock) // alongside bind; see: settings.SetSockMark
 			if !maybeGlobalUnicast(addr, true) {
 				ctl.Protect(who, sock)
 				return
@@ -147,9 +148,7 @@ func MakeListenConfig(p Protector) *net.ListenConfig {
 // Creates a net.Dialer that can bind to any active interface.
 func MakeNsDialer(who string, c Controller) *net.Dialer {
 	x := netdialer()
-	if c != nil {
-		x.Control = ifbind(who, c)
-	}
+	x.Control = nscontrol(who, c)
 	return x
 }
 
@@ -165,9 +164,7 @@ func MakeNsRDial(who string, c Controller) *RDial {
 // Creates a listener that can bind to any active interface.
 func MakeNsListener(who string, c Controller) *net.ListenConfig {
 	x := netlistener()
-	if c != nil {
-		x.Control = ifbind(who, c)
-	}
+	x.Control = nscontrol(who, c)
 	return x
 }
 
@@ -180,16 +177,19 @@ func MakeNsListenConfigExt(who string, ctl Controller, ext []ControlFn) *net.Lis
 				return err
 			}
 		}
-		if ctl != nil {
-			if err := ifbind(who, ctl)(network, address, c); err != nil {
-				return err
-			}
-		}
-		return nil
+		return nscontrol(who, ctl)(network, address, c)
 	}
 	return x
 }
 
+// Marks sockets of who, and binds them to any active interface if ctl is not nil.
+func nscontrol(who string, ctl Controller) ControlFn {
+	if ctl == nil {
+		return marker(who)
+	}
+	return ifbind(who, ctl)
+}
+
 // Creates a plain old dialer
 func netdialer() *net.Dialer {
 	return &net.Dialer{}
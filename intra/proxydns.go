@@ -0,0 +1,112 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+var errProxyDNS = errors.New("dns: served over proxy")
+
+// proxydns decides which plain dns (port 53) flows assigned to a proxy
+// are served by the tunnel's resolver over that proxy, instead of being
+// relayed as-is; see: Tunnel.SetProxyDNS
+type proxydns struct {
+	sync.RWMutex                     // protects all fields
+	on           bool                // serve port 53 flows assigned to proxies
+	optout       map[string]struct{} // uids whose flows are relayed as-is
+}
+
+func newPxDNS() *proxydns {
+	return &proxydns{optout: make(map[string]struct{})}
+}
+
+// set turns serving dns of flows assigned to proxies on or off.
+func (p *proxydns) set(on bool) {
+	p.Lock()
+	p.on = on
+	p.Unlock()
+
+	log.I("proxydns: on? %t", on)
+}
+
+// setOptOut opts uid out of (or back into) having its dns served.
+func (p *proxydns) setOptOut(uid string, optout bool) {
+	if len(uid) <= 0 {
+		return
+	}
+
+	p.Lock()
+	if optout {
+		p.optout[uid] = struct{}{}
+	} else {
+		delete(p.optout, uid)
+	}
+	p.Unlock()
+
+	log.I("proxydns: uid %s opt out? %t", uid, optout)
+}
+
+// rules returns whether it is on, and uids that opted out, sorted.
+func (p *proxydns) rules() (on bool, optout []string) {
+	p.RLock()
+	defer p.RUnlock()
+
+	optout = make([]string, 0, len(p.optout))
+	for uid := range p.optout {
+		optout = append(optout, uid)
+	}
+	slices.Sort(optout)
+	return p.on, optout
+}
+
+// setRules replaces both, whether it is on and uids that opted out, at once.
+func (p *proxydns) setRules(on bool, optout []string) {
+	m := make(map[string]struct{}, len(optout))
+	for _, uid := range optout {
+		if len(uid) > 0 {
+			m[uid] = struct{}{}
+		}
+	}
+
+	p.Lock()
+	p.on = on
+	p.optout = m
+	p.Unlock()
+
+	log.I("proxydns: rules: on? %t, %d opted out", on, len(m))
+}
+
+// serves returns true if the flow of uid to target, assigned to proxy
+// pid, is dns that must be served over pid.
+func (p *proxydns) serves(uid, pid string, target netip.AddrPort) bool {
+	if target.Port() != 53 || !proxied(pid) {
+		return false
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	_, out := p.optout[uid]
+	return p.on && !out
+}
+
+// proxied returns true if pid is a proxy (and not one of ipn's
+// pseudo-proxies) that flows are forwarded over.
+func proxied(pid string) bool {
+	switch pid {
+	case "", ipn.Base, ipn.Exit, ipn.Block, ipn.Defer:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"fmt"
+
+	"github.com/celzero/firestack/intra/log"
+)
+
+// separates uid from the target or domains in fwtracker keys
+const stallsep = "/"
+
+// PurgeSummary reports what was removed for a uid by Tunnel.PurgeUid.
+type PurgeSummary struct {
+	UID    string // UID that was purged.
+	TCP    int    // TCP flows closed.
+	UDP    int    // UDP flows closed.
+	ICMP   int    // ICMP echo flows closed.
+	Parked int    // Deferred flows blocked.
+	Stalls int    // Firewall stall entries removed.
+}
+
+func (s *PurgeSummary) str() string {
+	return fmt.Sprintf("purge-summary: uid=%s tcp=%d udp=%d icmp=%d parked=%d stalls=%d",
+		s.UID, s.TCP, s.UDP, s.ICMP, s.Parked, s.Stalls)
+}
+
+// purge drops all state held for uid by hold, and by tcp, udp, and icmp (if
+// not nil). ALG entries are not tracked by uid, and so, are left as-is.
+func purge(uid string, hold *parking, tcp, udp tracker, icmp flowtracker) *PurgeSummary {
+	s := &PurgeSummary{UID: uid}
+	if len(uid) <= 0 {
+		return s
+	}
+
+	// parked flows are blocked first, as they'd otherwise
+	// go on to be tracked by tcp or udp once released
+	if hold != nil {
+		s.Parked = len(hold.releaseUid(uid))
+	}
+	k := stallkey(uid, "")
+	if tcp != nil {
+		s.TCP = len(tcp.conns().UntrackUid(uid))
+		s.Stalls += tcp.stalls().DeletePrefix(k)
+	}
+	if udp != nil {
+		s.UDP = len(udp.conns().UntrackUid(uid))
+		s.Stalls += udp.stalls().DeletePrefix(k)
+	}
+	if icmp != nil {
+		s.ICMP = len(icmp.conns().UntrackUid(uid))
+	}
+
+	log.I("tun: purge: %s", s.str())
+	return s
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+const staleDomain = "stale.test"
+
+// staleResolver has all ips be stale alg ips, evicted with staleDomain,
+// that fail to be reclaimed.
+type staleResolver struct {
+	testResolver
+	reclaims atomic.Int32
+}
+
+func (*staleResolver) StaleAlg(netip.Addr) (string, bool) { return staleDomain, true }
+
+func (r *staleResolver) ReclaimAlg(netip.Addr) error {
+	r.reclaims.Add(1)
+	return dnsx.ErrStaleAlgIP
+}
+
+// stale alg ips are judged by the domain they were evicted with, and
+// re-resolved only if let through
+func TestReclaimAfterVerdict(t *testing.T) {
+	for _, proto := range []string{ProtoTypeTCP, ProtoTypeUDP} {
+		for _, pid := range []string{ipn.Block, ipn.Base} {
+			r := &staleResolver{}
+			tt := newTestTunnelWith(pid, r)
+			tt.l.doms = make(chan string, 8)
+			client := tt.up(t, settings.IP4)
+
+			dst := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 443}
+			if proto == ProtoTypeTCP {
+				if c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber); err == nil {
+					c.Close()
+					t.Fatalf("%s: %s: stale alg ip connected", proto, pid)
+				}
+			} else {
+				c, err := gonet.DialUDP(client, nil, &dst, ipv4.ProtocolNumber)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c.Write([]byte("q")); err != nil {
+					t.Fatal(err)
+				}
+				c.Close()
+			}
+
+			select {
+			case d := <-tt.l.doms:
+				if d != staleDomain {
+					t.Errorf("%s: %s: flow domains %q; want %s", proto, pid, d, staleDomain)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: %s: no flow", proto, pid)
+			}
+			s := tt.l.summaries(t, 1)[0]
+			want := int32(0) // blocked flows are not re-resolved
+			if pid != ipn.Block {
+				want = 1
+				if !strings.Contains(s.Msg, dnsx.ErrStaleAlgIP.Error()) {
+					t.Errorf("%s: %s: summary msg %q; want %q", proto, pid, s.Msg, dnsx.ErrStaleAlgIP)
+				}
+			}
+			if n := r.reclaims.Load(); n != want {
+				t.Errorf("%s: %s: %d reclaims; want %d", proto, pid, n, want)
+			}
+			if d := tt.px.dials.Load(); d != 0 {
+				t.Errorf("%s: %s: %d dials to stale alg ips", proto, pid, d)
+			}
+			tt.tcp.End()
+			tt.udp.End()
+		}
+	}
+}
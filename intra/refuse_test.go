@@ -0,0 +1,95 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// blocked apps must fail about as fast as the round trip over the tun
+// device, and never on a timeout
+const refuseWithin = 50 * time.Millisecond
+
+func TestRefuseTCP(t *testing.T) {
+	const n = 3
+	tt := newTestTunnel(ipn.Block)
+	client := tt.up(t, settings.IP4)
+	defer tt.tcp.End()
+
+	for i := range n {
+		// to a new dst each time, as repeated blocks of a dst stall
+		dst := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: uint16(443 + i)}
+		start := time.Now()
+		c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber)
+		took := time.Since(start)
+		if err == nil {
+			c.Close()
+			t.Fatalf("tcp#%d: blocked conn connected", i)
+		}
+		if took > refuseWithin {
+			t.Errorf("tcp#%d: refused in %s; want < %s; err: %v", i, took, refuseWithin, err)
+		}
+	}
+
+	for _, s := range tt.l.summaries(t, n) {
+		if s.PID != ipn.Block || !strings.Contains(s.Msg, errTcpFirewalled.Error()) {
+			t.Errorf("tcp: %s: pid %s, msg %q; want %s, %q", s.ID, s.PID, s.Msg, ipn.Block, errTcpFirewalled)
+		}
+	}
+	if d := tt.px.dials.Load(); d != 0 {
+		t.Errorf("tcp: %d dials for blocked conns", d)
+	}
+}
+
+func TestRefuseUDP(t *testing.T) {
+	const n = 3
+	tt := newTestTunnel(ipn.Block)
+	client := tt.up(t, settings.IP4)
+	defer tt.udp.End()
+
+	for i := range n {
+		dst := &tcpip.FullAddress{NIC: 1, Addr: testServer, Port: uint16(53 + i)}
+		c, err := gonet.DialUDP(client, nil, dst, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, err := c.Write([]byte("q")); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = c.Read(make([]byte, 1500))
+		took := time.Since(start)
+		c.Close()
+		if err == nil {
+			t.Fatalf("udp#%d: blocked flow got a reply", i)
+		}
+		// refused with an icmp port unreachable, and not timed out
+		if errors.Is(err, os.ErrDeadlineExceeded) || took > refuseWithin {
+			t.Errorf("udp#%d: refused in %s; want < %s; err: %v", i, took, refuseWithin, err)
+		}
+	}
+
+	for _, s := range tt.l.summaries(t, n) {
+		if s.PID != ipn.Block || !strings.Contains(s.Msg, errUdpFirewalled.Error()) {
+			t.Errorf("udp: %s: pid %s, msg %q; want %s, %q", s.ID, s.PID, s.Msg, ipn.Block, errUdpFirewalled)
+		}
+	}
+	if d := tt.px.dials.Load(); d != 0 {
+		t.Errorf("udp: %d dials for blocked flows", d)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// reroute closes flows whose upstream sockets are of a family the link no
+// longer routes (ex: as the route goes from dual-stack to v4-only), as soon
+// as it stops routing it, lest they hang till they time out; unless set to
+// let them drain. Caches of realips, answers, and such are dropped by their
+// own observers of the link; see: observeLink
+type reroute struct {
+	drain atomic.Bool     // leave flows be
+	flows core.ConnMapper // of tcp, udp, icmp
+}
+
+var _ core.LinkObserver = (*reroute)(nil)
+
+func newReroute(flows core.ConnMapper) *reroute {
+	return &reroute{flows: flows}
+}
+
+// set lets flows of unrouted families drain, if drain; or closes them.
+func (r *reroute) set(drain bool) {
+	r.drain.Store(drain)
+	log.I("reroute: drain? %t", drain)
+}
+
+// OnLinkChange implements core.LinkObserver.
+func (r *reroute) OnLinkChange(l core.Link) {
+	use4, use6 := l.L3 != settings.IP6, l.L3 != settings.IP4
+	if use4 && use6 {
+		return
+	}
+	if r.drain.Load() {
+		log.I("reroute: %s; draining flows", l.L3)
+		return
+	}
+	unrouted := func(_ string, v []net.Conn) bool {
+		return core.Unrouted(use4, use6, v...)
+	}
+	out := r.flows.ReapAll(errRouteChanged, unrouted)
+	log.I("reroute: %s; closed %d: %v", l.L3, len(out), out)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// flows to these ports are dialed over upstream sockets of the family
+const (
+	port4 = 4
+	port6 = 6
+)
+
+// rerouteFlows opens a tcp and then a udp flow to each of port4 and port6,
+// in that order (as cids t1 to t4), and returns them once they echo.
+func rerouteFlows(tb testing.TB, tt *testTunnel, client *stack.Stack) (flows []net.Conn) {
+	tb.Helper()
+	tt.px.to = map[string]string{"tcp": echoTCP(tb, make(chan struct{}, 8)), "udp": echoUDP(tb)}
+	tt.px.remotes = map[uint16]string{port4: "192.0.2.1:4", port6: "[2001:db8::1]:6"}
+
+	for _, port := range []uint16{port4, port6} {
+		dst := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: port}
+		c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		flows = append(flows, c)
+		mustEcho(tb, c)
+		u, err := gonet.DialUDP(client, nil, &dst, ipv4.ProtocolNumber)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		flows = append(flows, u)
+		mustEcho(tb, u)
+	}
+	tb.Cleanup(func() {
+		for _, c := range flows {
+			c.Close()
+		}
+	})
+	return
+}
+
+// mustEcho fails tb if c does not echo back what is sent on it.
+func mustEcho(tb testing.TB, c net.Conn) {
+	tb.Helper()
+	if err := echoed(c); err != nil {
+		tb.Fatalf("reroute: %s: no echo; err? %v", c.RemoteAddr(), err)
+	}
+}
+
+func echoed(c net.Conn) error {
+	b := make([]byte, 4)
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := c.Read(b)
+	return err
+}
+
+func TestRerouteClosesUnroutedFlows(t *testing.T) {
+	tests := []struct {
+		l3     string
+		closed []string // cids
+	}{
+		{settings.IP4, []string{"t3", "t4"}},
+		{settings.IP6, []string{"t1", "t2"}},
+		{settings.IP46, nil},
+	}
+	for _, tc := range tests {
+		tt := newTestTunnel(ipn.Base)
+		client := tt.up(t, settings.IP4)
+		flows := rerouteFlows(t, tt, client)
+		r := newReroute(tt.conns)
+
+		r.OnLinkChange(core.Link{L3: tc.l3})
+
+		var closed []string
+		for _, s := range tt.l.summaries(t, len(tc.closed)) {
+			closed = append(closed, s.ID)
+			if !strings.Contains(s.Msg, errRouteChanged.Error()) {
+				t.Errorf("reroute: %s: %s: msg %q; want %q", tc.l3, s.ID, s.Msg, errRouteChanged)
+			}
+		}
+		slices.Sort(closed)
+		if !slices.Equal(closed, tc.closed) {
+			t.Errorf("reroute: %s: closed %v; want %v", tc.l3, closed, tc.closed)
+		}
+		// flows of the family still routed go on as before
+		for i, c := range flows {
+			cid := "t" + string(rune('1'+i))
+			if slices.Contains(tc.closed, cid) {
+				if _, isudp := c.(*gonet.UDPConn); !isudp && echoed(c) == nil {
+					t.Errorf("reroute: %s: %s echoed once closed", tc.l3, cid)
+				}
+				continue
+			}
+			if err := echoed(c); err != nil {
+				t.Errorf("reroute: %s: %s: no echo; err? %v", tc.l3, cid, err)
+			}
+		}
+		if n, want := tt.conns.Len(), len(flows)-len(tc.closed); n != want {
+			t.Errorf("reroute: %s: %d flows tracked; want %d", tc.l3, n, want)
+		}
+		tt.tcp.End()
+		tt.udp.End()
+	}
+}
+
+func TestRerouteDrains(t *testing.T) {
+	tt := newTestTunnel(ipn.Base)
+	client := tt.up(t, settings.IP4)
+	flows := rerouteFlows(t, tt, client)
+	defer tt.tcp.End()
+	defer tt.udp.End()
+	r := newReroute(tt.conns)
+	r.set(true)
+
+	for _, l3 := range []string{settings.IP4, settings.IP6} {
+		r.OnLinkChange(core.Link{L3: l3})
+		for i, c := range flows {
+			if err := echoed(c); err != nil {
+				t.Errorf("reroute: drain: %s: t%d: no echo; err? %v", l3, i+1, err)
+			}
+		}
+	}
+	if n := tt.conns.Len(); n != len(flows) {
+		t.Errorf("reroute: drain: %d flows tracked; want %d", n, len(flows))
+	}
+	select {
+	case s := <-tt.l.smms:
+		t.Errorf("reroute: drain: flow %s closed; %s", s.ID, s.Msg)
+	default:
+	}
+}
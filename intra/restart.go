@@ -0,0 +1,116 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/celzero/firestack/intra/dnscrypt"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/log"
+)
+
+var errNotRestartable = errors.New("tun: resolver not restartable")
+
+// RestartResolver rebuilds the resolver with transports as they were added
+// (see: remember), and a new default transport set up as the current one is.
+func (t *rtunnel) RestartResolver(fakedns string) error {
+	r, rerr := t.internalResolver()
+	pxr, perr := t.internalProxies()
+	if rerr != nil || perr != nil {
+		return errors.Join(rerr, perr)
+	}
+	rr, ok := r.(dnsx.Restarter)
+	if !ok {
+		return errNotRestartable
+	}
+	g := t.getBridge()
+
+	start := time.Now()
+	// the new default (bootstrap) transport is set up before anything else,
+	// as other transports may need it to resolve their hostnames
+	tr, err := r.Get(dnsx.Default)
+	if err != nil {
+		return err
+	}
+	def, ok := tr.(DefaultDNS)
+	if !ok {
+		return dnsx.ErrNotDefaultTransport
+	}
+	ndef, err := def.renew()
+	if err != nil {
+		return err
+	}
+
+	l3, _ := t.l3.Load().(string)
+	specs := t.specs.all()
+	err = rr.Restart(fakedns, ndef, func(nr dnsx.Resolver) error {
+		nr.Add(newGoosTransport(g, pxr))     // os-resolver; fixed
+		nr.Add(newBlockAllTransport())       // fixed
+		nr.Add(newDNSCryptTransport(pxr, g)) // fixed
+		nr.Add(newMDNSTransport(l3))         // fixed
+
+		var dcm *dnscrypt.DcMulti
+		if tm, err := nr.GetMult(dnsx.DcProxy); err == nil {
+			dcm, _ = tm.(*dnscrypt.DcMulti)
+		}
+		var errs []error
+		fail := func(id string, err error) {
+			errs = append(errs, fmt.Errorf("transport %s: %w", id, err))
+		}
+		ts := make([]dnsx.Transport, 0, len(specs))
+		relays := make([]string, 0)
+		for _, s := range specs {
+			if !s.present(r) { // removed since
+				continue
+			}
+			switch s.Kind {
+			case specDefault: // set up as ndef
+			case specRelay:
+				relays = append(relays, s.ID)
+			case specSystem:
+				ipcsv := s.Args[0]
+				if strings.HasPrefix(ipcsv, "localhost") {
+					ipcsv = localip4 + "," + localip6
+				}
+				if sdns, err := newSystemDNSProxy(g, pxr, ipcsv); err != nil {
+					fail(s.ID, err)
+				} else {
+					ts = append(ts, sdns)
+				}
+			default:
+				if dns, err := s.build(nr, pxr, g, pxr.GetProxy); err != nil {
+					fail(s.ID, err)
+				} else {
+					ts = append(ts, dns)
+				}
+			}
+		}
+		if len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+		if err := nr.AddAll(ts...); err != nil {
+			return err
+		}
+		for _, relay := range relays {
+			if err := dnscrypt.AddRelayTransport(dcm, relay); err != nil {
+				fail(relay, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+	if err != nil {
+		log.W("tun: restart resolver: %s; err: %v", fakedns, err)
+		return err
+	}
+
+	log.I("tun: restart resolver: %s; %d transports; in %s", fakedns, len(specs), time.Since(start))
+	return nil
+}
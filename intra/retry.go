@@ -0,0 +1,252 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// how long a failed flow is remembered, by default
+	retryttl = 30 * time.Second
+	// max (uid, destination) entries remembered
+	retrymax = 512
+	// max proxies remembered per (uid, destination)
+	retrymaxpids = 4
+)
+
+// prefix for tags of proxies that failed in Flow's meta
+const failedprefix = "failed:"
+
+var errBadRetryProxy = errors.New("retry: pid or alternates invalid")
+
+// retries remembers proxies over which flows of an app to a destination
+// failed to dial of late, so that retries of those flows are decided knowing
+// so: by Flow (see: failedprefix), and, if alternates are set, natively.
+type retries struct {
+	sync.Mutex                                 // protects all fields
+	ttl        time.Duration                   // how long failures are remembered; 0 if off
+	alts       map[string][]string             // pid -> alternates, in order
+	m          map[string]map[string]time.Time // retrykey -> pid -> expiry
+}
+
+func newRetries() *retries {
+	return &retries{
+		ttl:  retryttl,
+		alts: make(map[string][]string),
+		m:    make(map[string]map[string]time.Time),
+	}
+}
+
+// retrykey returns the key for uid and the first of domains (csv); or for
+// dst, if there are no domains.
+func retrykey(uid, domains string, dst netip.Addr) string {
+	d, _, _ := strings.Cut(domains, ",")
+	d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if len(d) > 0 {
+		return uid + ":" + d
+	}
+	if !dst.IsValid() || dst.IsUnspecified() {
+		return ""
+	}
+	return uid + ":" + dst.String()
+}
+
+// set remembers failures for ttl; a ttl of 0 (or less) forgets all, and
+// remembers none.
+func (r *retries) set(ttl time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	if ttl <= 0 {
+		ttl = 0
+		clear(r.m)
+	}
+	r.ttl = ttl
+	log.I("retry: ttl %s", ttl)
+}
+
+// setAlternates sets alts (csv) as proxies, in order, to send flows meant
+// for pid over, if it failed; an empty alts unsets.
+func (r *retries) setAlternates(pid, alts string) error {
+	pid = strings.TrimSpace(pid)
+	if len(pid) <= 0 || pid == ipn.Block || pid == ipn.Defer {
+		return errBadRetryProxy
+	}
+	var ids []string
+	for _, id := range strings.Split(alts, ",") {
+		if id = strings.TrimSpace(id); len(id) <= 0 {
+			continue
+		}
+		if id == pid || id == ipn.Block || id == ipn.Defer {
+			return errBadRetryProxy
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if len(ids) <= 0 {
+		delete(r.alts, pid)
+	} else {
+		r.alts[pid] = ids
+	}
+	log.I("retry: %s alternates %v", pid, ids)
+	return nil
+}
+
+// failedLocked returns proxies that failed for k, and have not expired;
+// must be called with r locked.
+func (r *retries) failedLocked(k string) []string {
+	v, ok := r.m[k]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	pids := make([]string, 0, len(v))
+	for pid, exp := range v {
+		if now.After(exp) {
+			delete(v, pid)
+		} else {
+			pids = append(pids, pid)
+		}
+	}
+	if len(v) <= 0 {
+		delete(r.m, k)
+	}
+	slices.Sort(pids)
+	return pids
+}
+
+// failed returns a csv of proxies that failed for k; empty if none.
+func (r *retries) failed(k string) string {
+	if len(k) <= 0 {
+		return ""
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	return strings.Join(r.failedLocked(k), ",")
+}
+
+// tag returns meta with tags of proxies that failed for k, if any.
+func (r *retries) tag(meta, k string) string {
+	if csv := r.failed(k); len(csv) > 0 {
+		return withTag(meta, tagsOf(failedprefix, csv))
+	}
+	return meta
+}
+
+// alternate returns a copy of res with its PID swapped for the first of its
+// alternates that has not failed for k, is not missing, and is not kill
+// switched, if its PID failed for k; and true if so. PIDs that are kill
+// switched, Block, and Defer are never swapped.
+func (r *retries) alternate(prox ipn.Proxies, k string, res *Mark) (*Mark, bool) {
+	if res == nil || len(k) <= 0 || res.PID == ipn.Block || res.PID == ipn.Defer {
+		return res, false
+	}
+
+	r.Lock()
+	alts := r.alts[res.PID]
+	var failed []string
+	if len(alts) > 0 {
+		failed = r.failedLocked(k)
+	}
+	r.Unlock()
+
+	if len(alts) <= 0 || !slices.Contains(failed, res.PID) || prox.KillSwitched(res.PID) {
+		return res, false
+	}
+	for _, alt := range alts {
+		if slices.Contains(failed, alt) {
+			continue
+		}
+		if _, err := prox.ProxyFor(alt); err != nil {
+			continue
+		}
+		log.I("retry: %s: %s failed; retry over %s", k, res.PID, alt)
+		return &Mark{PID: alt, CID: res.CID, UID: res.UID}, true
+	}
+	log.D("retry: %s: %s and its alternates %v failed", k, res.PID, alts)
+	return res, false
+}
+
+// done reports the outcome of dials over pid for k; err is that of the last
+// dial. Flows that were blocked, or that end sans error, are not failures.
+func (r *retries) done(k, pid string, err error) {
+	if len(k) <= 0 || len(pid) <= 0 {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	v, ok := r.m[k]
+	if err == nil || errors.Is(err, ipn.ErrFirewalled) || ipn.ErrCode(err) == x.ErrNone {
+		if ok {
+			delete(v, pid)
+			if len(v) <= 0 {
+				delete(r.m, k)
+			}
+		}
+		return
+	}
+	if r.ttl <= 0 {
+		return
+	}
+	if !ok {
+		if len(r.m) >= retrymax {
+			r.evictLocked()
+		}
+		v = make(map[string]time.Time)
+		r.m[k] = v
+	}
+	if _, seen := v[pid]; !seen && len(v) >= retrymaxpids {
+		return // failures over this many proxies say more of the destination
+	}
+	v[pid] = time.Now().Add(r.ttl)
+	log.D("retry: %s: %s failed; err: %v", k, pid, err)
+}
+
+// OnLinkChange implements core.LinkObserver; proxies that failed on the
+// previous link may not on the new one.
+func (r *retries) OnLinkChange(l core.Link) {
+	r.Lock()
+	defer r.Unlock()
+
+	log.D("retry: link: %s; forget %d", l.L3, len(r.m))
+	clear(r.m)
+}
+
+// evictLocked removes expired entries; or, if none are, an arbitrary one.
+func (r *retries) evictLocked() {
+	n := len(r.m)
+	for k := range r.m {
+		r.failedLocked(k) // removes k if all of its proxies expired
+	}
+	if len(r.m) < n {
+		return
+	}
+	for k := range r.m {
+		delete(r.m, k)
+		return
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+var errTestDial = errors.New("test: dial failed")
+
+// killProxies are testProxies, some of which are kill switched.
+type killProxies struct {
+	*testProxies
+	killed []string
+}
+
+func (p *killProxies) KillSwitched(id string) bool { return slices.Contains(p.killed, id) }
+
+func TestRetryKey(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	tests := []struct {
+		uid, domains string
+		dst          netip.Addr
+		want         string
+	}{
+		{"10", "A.test.,b.test", ip, "10:a.test"},
+		{"10", " a.test ", netip.Addr{}, "10:a.test"},
+		{"10", "", ip, "10:192.0.2.1"},
+		{"10", "", netip.IPv4Unspecified(), ""},
+		{"10", "", netip.Addr{}, ""},
+	}
+	for _, tc := range tests {
+		if got := retrykey(tc.uid, tc.domains, tc.dst); got != tc.want {
+			t.Errorf("retry: key(%s, %q, %s) = %q; want %q", tc.uid, tc.domains, tc.dst, got, tc.want)
+		}
+	}
+}
+
+func TestRetrySetAlternates(t *testing.T) {
+	r := newRetries()
+	tests := []struct {
+		pid, alts string
+		want      []string
+		err       error
+	}{
+		{"", "p2", nil, errBadRetryProxy},
+		{ipn.Block, "p2", nil, errBadRetryProxy},
+		{ipn.Defer, "p2", nil, errBadRetryProxy},
+		{"p1", "p2,p1", nil, errBadRetryProxy},
+		{"p1", "p2," + ipn.Block, nil, errBadRetryProxy},
+		{"p1", " p2, ,p3,p2 ", []string{"p2", "p3"}, nil},
+		{"p1", "", nil, nil}, // unsets
+	}
+	for _, tc := range tests {
+		if err := r.setAlternates(tc.pid, tc.alts); err != tc.err {
+			t.Errorf("retry: alts(%q, %q): err %v; want %v", tc.pid, tc.alts, err, tc.err)
+			continue
+		}
+		if tc.err == nil && !slices.Equal(r.alts[tc.pid], tc.want) {
+			t.Errorf("retry: alts(%q, %q) = %v; want %v", tc.pid, tc.alts, r.alts[tc.pid], tc.want)
+		}
+	}
+}
+
+func TestRetryDone(t *testing.T) {
+	r := newRetries()
+	k := retrykey("10", "a.test", netip.Addr{})
+
+	r.done(k, "p1", ipn.ErrFirewalled)
+	r.done(k, "p2", nil)
+	if csv := r.failed(k); len(csv) > 0 {
+		t.Errorf("retry: blocked or ok flows failed over %s", csv)
+	}
+
+	r.done(k, "p2", errTestDial)
+	r.done(k, "p1", errTestDial)
+	if csv := r.failed(k); csv != "p1,p2" {
+		t.Errorf("retry: failed over %q; want p1,p2", csv)
+	}
+	if meta := r.tag("x", k); meta != "x,failed:p1,failed:p2" {
+		t.Errorf("retry: tagged %q", meta)
+	}
+	if meta := r.tag("x", retrykey("11", "a.test", netip.Addr{})); meta != "x" {
+		t.Errorf("retry: other uid tagged %q", meta)
+	}
+
+	// an ok dial forgets the failure
+	r.done(k, "p1", nil)
+	if csv := r.failed(k); csv != "p2" {
+		t.Errorf("retry: failed over %q once p1 dialed ok; want p2", csv)
+	}
+
+	// failures over too many proxies are not all remembered
+	for i := range retrymaxpids + 2 {
+		r.done(k, "q"+strconv.Itoa(i), errTestDial)
+	}
+	if n := len(r.m[k]); n != retrymaxpids {
+		t.Errorf("retry: %d failed proxies remembered; want %d", n, retrymaxpids)
+	}
+
+	// failures expire
+	r.Lock()
+	for pid := range r.m[k] {
+		r.m[k][pid] = time.Now().Add(-time.Second)
+	}
+	r.Unlock()
+	if csv := r.failed(k); len(csv) > 0 {
+		t.Errorf("retry: expired failures over %s", csv)
+	}
+	if _, ok := r.m[k]; ok {
+		t.Error("retry: key of expired failures not removed")
+	}
+
+	// and are forgotten on link changes, or if off
+	r.done(k, "p1", errTestDial)
+	r.OnLinkChange(core.Link{L3: settings.IP4})
+	if csv := r.failed(k); len(csv) > 0 {
+		t.Errorf("retry: failed over %s on the previous link", csv)
+	}
+	r.done(k, "p1", errTestDial)
+	r.set(0)
+	r.done(k, "p2", errTestDial)
+	if csv := r.failed(k); len(csv) > 0 {
+		t.Errorf("retry: off, but failed over %s", csv)
+	}
+}
+
+func TestRetryEvicts(t *testing.T) {
+	r := newRetries()
+	for i := range retrymax {
+		r.done("10:"+strconv.Itoa(i), "p1", errTestDial)
+	}
+	r.done("10:new", "p1", errTestDial)
+	if n := len(r.m); n != retrymax {
+		t.Errorf("retry: %d keys; want %d", n, retrymax)
+	}
+	if csv := r.failed("10:new"); csv != "p1" {
+		t.Errorf("retry: newest failed over %q; want p1", csv)
+	}
+}
+
+func TestRetryAlternate(t *testing.T) {
+	prox := &killProxies{testProxies: &testProxies{
+		px:     &testProxy{id: "p1"},
+		others: map[string]*testProxy{"p2": {id: "p2"}, "p3": {id: "p3"}},
+	}}
+	r := newRetries()
+	k := retrykey("10", "a.test", netip.Addr{})
+	res := &Mark{PID: "p1", CID: "c1", UID: "10"}
+
+	pick := func(want string, wantalt bool) {
+		t.Helper()
+		got, alt := r.alternate(prox, k, res)
+		if got.PID != want || alt != wantalt || got.CID != res.CID || got.UID != res.UID {
+			t.Errorf("retry: alternate: %+v, %t; want %s, %t", got, alt, want, wantalt)
+		}
+	}
+
+	pick("p1", false) // no alternates
+	r.done(k, "p1", errTestDial)
+	pick("p1", false) // failed, but no alternates
+
+	if err := r.setAlternates("p1", "p9,p2,p3"); err != nil {
+		t.Fatal(err)
+	}
+	pick("p2", true) // p9 is missing
+	if res.PID != "p1" {
+		t.Errorf("retry: alternate: res modified: %s", res.PID)
+	}
+	r.done(k, "p2", errTestDial)
+	pick("p3", true)
+	r.done(k, "p3", errTestDial)
+	pick("p1", false) // all failed
+
+	// kill switched pids are never swapped
+	r.done(k, "p3", nil)
+	prox.killed = []string{"p1"}
+	pick("p1", false)
+	prox.killed = nil
+	pick("p3", true)
+
+	for _, pid := range []string{ipn.Block, ipn.Defer} {
+		if got, alt := r.alternate(prox, k, &Mark{PID: pid}); got.PID != pid || alt {
+			t.Errorf("retry: alternate for %s: %s", pid, got.PID)
+		}
+	}
+	if _, alt := r.alternate(prox, "", res); alt {
+		t.Error("retry: alternate sans key")
+	}
+}
+
+// a flow that failed to dial over its proxy is retried over an alternate;
+// and is told to Flow as failed over the proxy
+func TestRetryFlows(t *testing.T) {
+	tt := newTestTunnel("p1")
+	tt.l.metas = make(chan string, 4)
+	tt.px.to = map[string]string{"tcp": closedTCP(t)}
+	alt := &testProxy{id: "p2", to: map[string]string{"tcp": echoTCP(t, make(chan struct{}, 4))}}
+	tt.tcp.prox.(*testProxies).others = map[string]*testProxy{alt.id: alt}
+	if err := tt.tcp.retries.setAlternates("p1", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	client := tt.up(t, settings.IP4)
+	defer tt.tcp.End()
+	dst := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 443}
+
+	if c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber); err == nil {
+		c.Close()
+	}
+	if meta := <-tt.l.metas; len(meta) > 0 {
+		t.Errorf("retry: first flow: meta %q", meta)
+	}
+	s := tt.l.summaries(t, 1)[0]
+	if s.PID != "p1" || s.Alternate || len(s.Retry) > 0 {
+		t.Errorf("retry: first flow: pid %s, alternate? %t, retry %q", s.PID, s.Alternate, s.Retry)
+	}
+
+	c, err := gonet.DialTCP(client, dst, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEcho(t, c)
+	c.Close()
+	if meta := <-tt.l.metas; meta != failedprefix+"p1" {
+		t.Errorf("retry: retried flow: meta %q; want %s", meta, failedprefix+"p1")
+	}
+	s = tt.l.summaries(t, 1)[0]
+	if s.PID != "p2" || !s.Alternate || s.Retry != "p1" {
+		t.Errorf("retry: retried flow: pid %s, alternate? %t, retry %q; want p2, true, p1", s.PID, s.Alternate, s.Retry)
+	}
+	if n := alt.dials.Load(); n != 1 {
+		t.Errorf("retry: %d dials over the alternate; want 1", n)
+	}
+}
+
+// closedTCP returns the addr of a tcp port on the loopback no one listens on.
+func closedTCP(tb testing.TB) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
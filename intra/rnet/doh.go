@@ -0,0 +1,341 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package rnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	// rfc8484 path
+	dohpath = "/dns-query"
+	// rfc8484 media type
+	dohmime = "application/dns-message"
+	// max concurrent conns, unless set
+	dohmaxconns = 64
+	// dns header size; min size of a query
+	dohminq = 12
+	// validity of self-signed certs
+	dohcertvalidity = 365 * 24 * time.Hour
+	// time to answer a query
+	dohtimeout = 15 * time.Second
+)
+
+var (
+	errDoHQuery   = errors.New("doh: bad query")
+	errDoHNoCert  = errors.New("doh: cert without key, or key without cert")
+	errDoHNoHop   = errors.New("doh: server does not hop")
+	errDoHBlocked = errors.New("doh: client blocked")
+)
+
+// Resolver serves dns queries; ex: dnsx.Resolver
+type Resolver interface {
+	// ServeFor reads queries from conn and writes answers back to it,
+	// as if they were sent by uid over proto.
+	ServeFor(proto string, conn protect.Conn, pid, uid string)
+}
+
+type dohsvc struct {
+	sync.Mutex // guards svc and status
+	id         string
+	addr       string // listen address
+	cert       tls.Certificate
+	maxconns   int
+	lc         *net.ListenConfig
+	r          Resolver
+	listener   ServerListener
+	svc        *http.Server // nil when stopped
+	status     int
+}
+
+var _ Server = (*dohsvc)(nil)
+
+// newDoHServer creates a DoH server listening at addr (host:port) with
+// certpem and keypem, or with a self-signed cert for addr's host, if both
+// are empty; maxconns caps concurrent conns (dohmaxconns, if <= 0).
+func newDoHServer(id, addr, certpem, keypem string, maxconns int, r Resolver, ctl protect.Controller, listener ServerListener) (*dohsvc, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var cert tls.Certificate
+	if len(certpem) > 0 && len(keypem) > 0 {
+		cert, err = tls.X509KeyPair([]byte(certpem), []byte(keypem))
+	} else if len(certpem) > 0 || len(keypem) > 0 {
+		err = errDoHNoCert
+	} else {
+		cert, err = selfSignedCert(host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if maxconns <= 0 {
+		maxconns = dohmaxconns
+	}
+
+	log.I("svcdoh: new %s listening at %s; self-signed? %t; max conns %d", id, addr, len(certpem) <= 0, maxconns)
+	return &dohsvc{
+		id:       id,
+		addr:     addr,
+		cert:     cert,
+		maxconns: maxconns,
+		lc:       protect.MakeNsListener(id, ctl),
+		r:        r,
+		listener: listener,
+		status:   END,
+	}, nil
+}
+
+// selfSignedCert generates an ecdsa cert for host (ip or name), if any,
+// and for localhost.
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"firestack"}, CommonName: "svcdoh"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(dohcertvalidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.IsUnspecified() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	} else if len(host) > 0 {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (h *dohsvc) Hop(p x.Proxy) error {
+	if p != nil { // queries are sent to Resolver
+		return errDoHNoHop
+	}
+	return nil
+}
+
+func (h *dohsvc) Start() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.status != END {
+		return errSvcRunning
+	}
+	ln, err := h.lc.Listen(context.Background(), "tcp", h.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohpath, h.serveHTTP)
+	svc := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{h.cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	h.svc = svc
+	h.status = SOK
+
+	go func() {
+		// h2 is negotiated as TLSConfig has no NextProtos of its own
+		err := svc.ServeTLS(netutil.LimitListener(ln, h.maxconns), "", "")
+		log.I("svcdoh: %s exited; err? %v", h.id, err)
+	}()
+	log.I("svcdoh: %s started at %s", h.id, ln.Addr())
+	return nil
+}
+
+func (h *dohsvc) Stop() error {
+	h.Lock()
+	svc := h.svc
+	h.svc = nil
+	h.status = END
+	h.Unlock()
+
+	var err error
+	if svc != nil {
+		err = svc.Close()
+	}
+	log.I("svcdoh: %s stopped; err? %v", h.id, err)
+	return err
+}
+
+func (h *dohsvc) Refresh() error {
+	err1 := h.Stop()
+	err2 := h.Start()
+
+	log.I("svcdoh: %s refreshed; errs? %v; %v", h.id, err1, err2)
+
+	if err2 != nil {
+		return err2
+	}
+	return err1
+}
+
+func (h *dohsvc) ID() string {
+	return h.id
+}
+
+func (h *dohsvc) GetAddr() string {
+	return h.addr
+}
+
+func (h *dohsvc) Status() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.status
+}
+
+func (h *dohsvc) Type() string {
+	return SVCDOH
+}
+
+// serveHTTP answers rfc8484 GET and POST queries.
+func (h *dohsvc) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	tab := h.listener.Route(h.id, "", "tcp", req.RemoteAddr, h.addr)
+	smm := serverSummary(SVCDOH, h.id, "", tab.CID)
+
+	var err error
+	defer func() {
+		smm.done(err)
+		go h.listener.OnComplete(smm)
+	}()
+
+	if tab.Block {
+		err = errDoHBlocked
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var q []byte
+	switch req.Method {
+	case http.MethodGet:
+		// base64url sans padding; though some clients pad
+		b64 := strings.TrimRight(req.URL.Query().Get("dns"), "=")
+		q, err = base64.RawURLEncoding.DecodeString(b64)
+	case http.MethodPost:
+		if ct := req.Header.Get("Content-Type"); ct != dohmime {
+			err = errDoHQuery
+			http.Error(w, "unsupported content-type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		q, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	default:
+		err = errDoHQuery
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	if err == nil && len(q) < dohminq {
+		err = errDoHQuery
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	smm.Tx = len(q)
+
+	ans, err := h.resolve(q)
+	if len(ans) <= 0 { // answers (ex: servfail) are sent even on errors
+		log.W("svcdoh: %s: %s no answer; err: %v", h.id, smm.CID, err)
+		http.Error(w, "no answer", http.StatusBadGateway)
+		return
+	}
+	smm.Rx = len(ans)
+
+	w.Header().Set("Content-Type", dohmime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(ans)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(minttl(ans)))
+	if _, werr := w.Write(ans); werr != nil {
+		err = errors.Join(err, werr)
+	}
+}
+
+// resolve serves q over tcp (length-prefixed) as if it were sent by a
+// client of h.id, and not by the tunnel itself; so that queries from this
+// server are told apart in summaries, usage, and per-uid transports.
+func (h *dohsvc) resolve(q []byte) ([]byte, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go h.r.ServeFor("tcp", s, "", h.id)
+
+	_ = c.SetDeadline(time.Now().Add(dohtimeout))
+	b := make([]byte, 2, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	// two writes, as the resolver reads the length, and then the query
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	ans := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(c, ans); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+// minttl returns the smallest ttl among answer records in ans, if any.
+func minttl(ans []byte) int {
+	msg := xdns.AsMsg(ans)
+	if msg == nil || len(msg.Answer) <= 0 {
+		return 0
+	}
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return int(ttl)
+}
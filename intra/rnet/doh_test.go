@@ -0,0 +1,140 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package rnet
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/miekg/dns"
+)
+
+// dohResolver answers A queries with 192.0.2.1, and records whom it
+// served them for.
+type dohResolver struct {
+	sync.Mutex
+	served []string // proto:pid:uid
+}
+
+func (r *dohResolver) ServeFor(proto string, c protect.Conn, pid, uid string) {
+	defer c.Close()
+	r.Lock()
+	r.served = append(r.served, proto+":"+pid+":"+uid)
+	r.Unlock()
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return
+	}
+	q := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(c, q); err != nil {
+		return
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return
+	}
+	ans := new(dns.Msg).SetReply(msg)
+	rr, _ := dns.NewRR(msg.Question[0].Name + " 300 IN A 192.0.2.1")
+	ans.Answer = append(ans.Answer, rr)
+	a, _ := ans.Pack()
+	binary.BigEndian.PutUint16(b, uint16(len(a)))
+	_, _ = c.Write(append(b, a...))
+}
+
+func (r *dohResolver) all() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.served...)
+}
+
+func freeAddr(tb testing.TB) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestDoHServerServesFor(t *testing.T) {
+	r := &dohResolver{}
+	l := newFwdListener()
+	h, err := newDoHServer(SVCDOH, freeAddr(t), "", "", 0, r, nil, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	c := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	url := "https://" + h.addr + dohpath
+	q, _ := new(dns.Msg).SetQuestion("example.test.", dns.TypeA).Pack()
+
+	get := func() (*http.Response, error) {
+		return c.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(q))
+	}
+	post := func() (*http.Response, error) {
+		return c.Post(url, dohmime, bytes.NewReader(q))
+	}
+	for what, do := range map[string]func() (*http.Response, error){"get": get, "post": post} {
+		res, err := do()
+		if err != nil {
+			t.Fatalf("svcdoh: %s: %v", what, err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("svcdoh: %s: status %d; %s", what, res.StatusCode, b)
+		}
+		ans := new(dns.Msg)
+		if err := ans.Unpack(b); err != nil || len(ans.Answer) != 1 {
+			t.Errorf("svcdoh: %s: bad answer %v; err: %v", what, ans, err)
+		}
+		if cc := res.Header.Get("Cache-Control"); cc != "max-age=300" {
+			t.Errorf("svcdoh: %s: cache-control %q", what, cc)
+		}
+		<-l.smms
+	}
+
+	// served as the server's, and not as the tunnel's own queries
+	want := "tcp::" + SVCDOH
+	for _, s := range r.all() {
+		if s != want {
+			t.Errorf("svcdoh: served %s; want %s", s, want)
+		}
+	}
+	if n := len(r.all()); n != 2 {
+		t.Errorf("svcdoh: served %d queries; want 2", n)
+	}
+
+	// short queries never reach the resolver
+	res, err := c.Post(url, dohmime, bytes.NewReader(q[:4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("svcdoh: short query: status %d", res.StatusCode)
+	}
+	if n := len(r.all()); n != 2 {
+		t.Errorf("svcdoh: served %d queries; want 2", n)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package rnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// idle udp mappings expire after this long; same as the tunnel's udp nat.
+const fwdudptimeout = 2 * time.Minute
+
+// datagrams queued per udp mapping, as it dials or writes; more are dropped.
+const fwdudpqueue = 32
+
+var errFwdDisabled = errors.New("forward disabled")
+
+// Forward pipes tcp conns and udp datagrams accepted at an address on the
+// device to a target address, directly or over a proxy (see: Server.Hop).
+type Forward interface {
+	Server
+	// Target returns the address conns are forwarded to.
+	Target() string
+	// Enable enables (or disables) the forward; when disabled, new
+	// conns are refused, while those already forwarded are left be.
+	Enable(yes bool)
+	// Enabled returns true if the forward is enabled.
+	Enabled() bool
+	// Conns returns the number of forwarded tcp conns and udp mappings.
+	Conns() int
+}
+
+var _ Forward = (*forward)(nil)
+
+type forward struct {
+	sync.Mutex // guards all fields below, except immutable id, listen, target
+
+	id       string
+	listen   string // listen address on the device
+	target   string // forward address
+	rdial    *protect.RDial
+	listener ServerListener
+
+	px      ipn.Proxy              // may be nil
+	tl      *net.TCPListener       // nil when stopped
+	uc      *net.UDPConn           // nil when stopped
+	conns   map[net.Conn]net.Conn  // forwarded tcp conns; ingress to egress
+	nat     map[string]*fwdmapping // udp mappings by client addr
+	enabled bool
+	status  int
+}
+
+// fwdmapping maps an udp client to its egress conn.
+type fwdmapping struct {
+	egress net.Conn       // nil until dialed
+	smm    *ServerSummary // nil until dialed
+	in     chan []byte    // datagrams from the client, to send to egress
+	done   chan struct{}  // closed once the mapping ends
+}
+
+func fwdid(listen string) string {
+	return SVCFWD + ":" + listen
+}
+
+func newForward(listen, target string, ctl protect.Controller, listener ServerListener) (*forward, error) {
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, err
+	}
+	id := fwdid(listen)
+	log.I("svcfwd: new %s forwarding %s to %s", id, listen, target)
+	return &forward{
+		id:       id,
+		listen:   listen,
+		target:   target,
+		rdial:    protect.MakeNsRDial(id, ctl),
+		listener: listener,
+		conns:    make(map[net.Conn]net.Conn),
+		nat:      make(map[string]*fwdmapping),
+		enabled:  true,
+		status:   END,
+	}, nil
+}
+
+func (f *forward) Hop(p x.Proxy) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if p == nil {
+		f.px = nil
+	} else if pp, ok := p.(ipn.Proxy); ok {
+		f.px = pp
+	} else {
+		log.E("svcfwd: hop: %s; failed: %T not ipn.Proxy", f.id, p)
+		return errNotProxy
+	}
+	log.D("svcfwd: hop: %s over proxy? %t to %s", f.id, p != nil, f.target)
+	return nil
+}
+
+func (f *forward) Start() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.status != END {
+		return errSvcRunning
+	}
+	tl, err := f.rdial.AcceptTCP("tcp", f.listen)
+	if err != nil {
+		return err
+	}
+	uc, err := f.rdial.AnnounceUDP("udp", f.listen)
+	if err != nil {
+		tl.Close()
+		return err
+	}
+	f.tl = tl
+	f.uc = uc
+	f.status = SOK
+
+	go f.acceptTCP(tl)
+	go f.serveUDP(uc)
+
+	log.I("svcfwd: %s started at %s", f.id, f.listen)
+	return nil
+}
+
+func (f *forward) Stop() error {
+	f.Lock()
+	tl, uc := f.tl, f.uc
+	f.tl, f.uc = nil, nil
+	conns := make([]io.Closer, 0, 2*len(f.conns)+len(f.nat))
+	for in, eg := range f.conns {
+		conns = append(conns, in, eg)
+	}
+	for _, m := range f.nat {
+		if m.egress != nil { // those still dialing end on their own
+			conns = append(conns, m.egress)
+		}
+	}
+	f.nat = make(map[string]*fwdmapping)
+	f.status = END
+	f.Unlock()
+
+	var err error
+	if tl != nil {
+		err = tl.Close()
+	}
+	if uc != nil {
+		err = errors.Join(err, uc.Close())
+	}
+	for _, c := range conns {
+		c.Close() // accounting is done by the pipes
+	}
+	log.I("svcfwd: %s stopped; closed %d conns; err? %v", f.id, len(conns), err)
+	return err
+}
+
+func (f *forward) Refresh() error {
+	err1 := f.Stop()
+	err2 := f.Start()
+
+	log.I("svcfwd: %s refreshed; errs? %v; %v", f.id, err1, err2)
+
+	if err2 != nil {
+		return err2
+	}
+	return err1
+}
+
+func (f *forward) ID() string {
+	return f.id
+}
+
+func (f *forward) GetAddr() string {
+	return f.listen
+}
+
+func (f *forward) Target() string {
+	return f.target
+}
+
+func (f *forward) Status() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.status
+}
+
+func (f *forward) Type() string {
+	f.Lock()
+	defer f.Unlock()
+	if f.px != nil {
+		return PXFWD
+	}
+	return SVCFWD
+}
+
+func (f *forward) Enable(yes bool) {
+	f.Lock()
+	f.enabled = yes
+	f.Unlock()
+	log.I("svcfwd: %s enabled? %t", f.id, yes)
+}
+
+func (f *forward) Enabled() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.enabled
+}
+
+func (f *forward) Conns() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.conns) + len(f.nat)
+}
+
+func (f *forward) pid() (id string) {
+	f.Lock()
+	defer f.Unlock()
+	if f.px != nil {
+		id = f.px.ID()
+	}
+	return
+}
+
+// dial routes and dials the target for client src over network.
+func (f *forward) dial(network, src string) (cid string, conn net.Conn, err error) {
+	f.Lock()
+	px := f.px
+	enabled := f.enabled
+	f.Unlock()
+
+	if !enabled {
+		err = errFwdDisabled
+		return
+	}
+	if px != nil && px.Status() == ipn.END {
+		err = errProxyEnd
+		return
+	}
+	pid := ""
+	if px != nil {
+		pid = px.ID()
+	}
+	tab := f.listener.Route(f.id, pid, network, src, f.target)
+	cid = tab.CID
+	if tab.Block {
+		err = errBlocked
+		return
+	}
+	if px != nil {
+		conn, err = px.Dialer().Dial(network, f.target)
+	} else {
+		conn, err = f.rdial.Dial(network, f.target)
+	}
+	return
+}
+
+func (f *forward) track(ingress, egress net.Conn) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.status == END {
+		return false
+	}
+	f.conns[ingress] = egress
+	return true
+}
+
+func (f *forward) untrack(ingress net.Conn) {
+	f.Lock()
+	delete(f.conns, ingress)
+	f.Unlock()
+}
+
+func (f *forward) acceptTCP(tl *net.TCPListener) {
+	for {
+		c, err := tl.AcceptTCP()
+		if err != nil {
+			log.I("svcfwd: tcp: %s; accept exited; err? %v", f.id, err)
+			return
+		}
+		go f.serveTCP(c)
+	}
+}
+
+func (f *forward) serveTCP(ingress *net.TCPConn) {
+	defer ingress.Close()
+
+	src := ingress.RemoteAddr().String()
+	cid, egress, err := f.dial("tcp", src)
+	if errors.Is(err, errFwdDisabled) {
+		log.D("svcfwd: tcp: %s; %s refused; disabled", f.id, src)
+		return
+	}
+	smm := serverSummary(f.Type(), f.id, f.pid(), cid)
+	defer func() {
+		smm.done(err)
+		go f.listener.OnComplete(smm)
+	}()
+	if err != nil {
+		log.W("svcfwd: tcp: %s; dial %s for %s; err: %v", cid, f.target, src, err)
+		return
+	}
+	defer egress.Close()
+
+	if !f.track(ingress, egress) {
+		err = errServerEnd
+		return
+	}
+	defer f.untrack(ingress)
+
+	log.D("svcfwd: tcp: %s; %s -> %s", cid, src, f.target)
+
+	finrxch := make(chan pipefin, 1)
+	fintxch := make(chan pipefin, 1)
+	go fwdpipe(egress, ingress, finrxch) // read from egress, write to ingress
+	go fwdpipe(ingress, egress, fintxch) // read from ingress, write to egress
+	finrx := <-finrxch
+	fintx := <-fintxch
+
+	smm.Rx = finrx.ex
+	smm.Tx = fintx.ex
+	err = errors.Join(finrx.err, fintx.err)
+}
+
+// fwdpipe copies r to w, and then closes r's read side and w's write side.
+func fwdpipe(r, w net.Conn, finch chan<- pipefin) {
+	bptr := core.Alloc()
+	bf := *bptr
+	bf = bf[:cap(bf)]
+	defer func() {
+		*bptr = bf
+		core.Recycle(bptr)
+	}()
+	n, err := io.CopyBuffer(w, r, bf)
+	if cr, ok := r.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
+	}
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	finch <- pipefin{int(n), err}
+}
+
+func (f *forward) serveUDP(uc *net.UDPConn) {
+	bptr := core.Alloc()
+	b := *bptr
+	b = b[:cap(b)]
+	defer func() {
+		*bptr = b
+		core.Recycle(bptr)
+	}()
+
+	for {
+		n, src, err := uc.ReadFromUDP(b)
+		if err != nil {
+			log.I("svcfwd: udp: %s; read exited; err? %v", f.id, err)
+			return
+		}
+		m := f.mapping(uc, src)
+		if m == nil {
+			continue // refused
+		}
+		select { // never block the read loop on a mapping that dials or writes
+		case m.in <- append([]byte(nil), b[:n]...):
+		default:
+			log.D("svcfwd: udp: %s; %s queue full; dropped %d bytes", f.id, src, n)
+		}
+	}
+}
+
+// mapping returns the existing mapping for src, or creates a new one
+// which dials the target in the background; nil if src must not be
+// forwarded.
+func (f *forward) mapping(uc *net.UDPConn, src *net.UDPAddr) *fwdmapping {
+	k := src.String()
+	f.Lock()
+	defer f.Unlock()
+
+	if m := f.nat[k]; m != nil {
+		return m
+	}
+	if !f.enabled {
+		log.D("svcfwd: udp: %s; %s refused; disabled", f.id, k)
+		return nil
+	}
+	if f.status == END {
+		return nil
+	}
+	m := &fwdmapping{
+		in:   make(chan []byte, fwdudpqueue),
+		done: make(chan struct{}),
+	}
+	f.nat[k] = m
+	go f.forwardUDP(uc, src, m)
+	return m
+}
+
+// unmap removes m, if it is (still) the mapping for client k.
+func (f *forward) unmap(k string, m *fwdmapping) {
+	f.Lock()
+	if f.nat[k] == m {
+		delete(f.nat, k)
+	}
+	f.Unlock()
+}
+
+// forwardUDP dials the target for m, and sends datagrams queued on m to
+// it, until m ends.
+func (f *forward) forwardUDP(uc *net.UDPConn, src *net.UDPAddr, m *fwdmapping) {
+	k := src.String()
+	cid, egress, err := f.dial("udp", k)
+	if errors.Is(err, errFwdDisabled) {
+		log.D("svcfwd: udp: %s; %s refused; disabled", f.id, k)
+		f.unmap(k, m)
+		return
+	}
+	smm := serverSummary(f.Type(), f.id, f.pid(), cid)
+	if err != nil {
+		log.W("svcfwd: udp: %s; dial %s for %s; err: %v", cid, f.target, k, err)
+		f.unmap(k, m)
+		smm.done(err)
+		go f.listener.OnComplete(smm)
+		return
+	}
+
+	f.Lock()
+	if f.status == END || f.nat[k] != m { // stopped, or restarted, since
+		f.Unlock()
+		egress.Close()
+		smm.done(errServerEnd)
+		go f.listener.OnComplete(smm)
+		return
+	}
+	m.egress = egress
+	m.smm = smm
+	f.Unlock()
+
+	log.D("svcfwd: udp: %s; %s -> %s", cid, k, f.target)
+	go f.reply(uc, src, m)
+
+	for {
+		select {
+		case pkt := <-m.in:
+			egress.SetDeadline(time.Now().Add(fwdudptimeout))
+			wn, err := egress.Write(pkt)
+			f.Lock()
+			smm.Tx += wn
+			f.Unlock()
+			if err != nil {
+				log.W("svcfwd: udp: %s; write %s; err: %v", cid, f.target, err)
+				egress.Close() // mapping is removed by its reader
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// reply copies datagrams from m's egress back to src, until m idles out.
+func (f *forward) reply(uc *net.UDPConn, src *net.UDPAddr, m *fwdmapping) {
+	bptr := core.Alloc()
+	b := *bptr
+	b = b[:cap(b)]
+
+	var err error
+	defer func() {
+		*bptr = b
+		core.Recycle(bptr)
+
+		m.egress.Close()
+		// a new mapping for src may have replaced m since; see: Stop
+		f.unmap(src.String(), m)
+		close(m.done)
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = nil // idle timeout
+		}
+		m.smm.done(err)
+		go f.listener.OnComplete(m.smm)
+	}()
+
+	for {
+		m.egress.SetDeadline(time.Now().Add(fwdudptimeout))
+		var n int
+		if n, err = m.egress.Read(b); err != nil {
+			log.D("svcfwd: udp: %s; reply from %s ended; err? %v", m.smm.CID, f.target, err)
+			return
+		}
+		f.Lock()
+		m.smm.Rx += n
+		f.Unlock()
+		if _, err = uc.WriteToUDP(b[:n], src); err != nil {
+			log.W("svcfwd: udp: %s; reply to %s; err: %v", m.smm.CID, src, err)
+			return
+		}
+	}
+}
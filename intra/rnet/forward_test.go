@@ -0,0 +1,187 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package rnet
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fwdListener routes all conns, but holds those of held srcs until
+// released; and sends summaries on smms.
+type fwdListener struct {
+	n    atomic.Int32
+	held map[string]chan struct{} // src -> released when closed
+	smms chan *ServerSummary
+}
+
+func newFwdListener(held ...string) *fwdListener {
+	l := &fwdListener{held: make(map[string]chan struct{}), smms: make(chan *ServerSummary, 16)}
+	for _, src := range held {
+		l.held[src] = make(chan struct{})
+	}
+	return l
+}
+
+func (l *fwdListener) Route(_, _, _, src, _ string) *Tab {
+	if ch, ok := l.held[src]; ok {
+		<-ch
+	}
+	return &Tab{CID: "f" + strconv.Itoa(int(l.n.Add(1)))}
+}
+
+func (l *fwdListener) OnComplete(s *ServerSummary) { l.smms <- s }
+
+// udpEcho echoes datagrams back to their sender.
+func udpEcho(tb testing.TB) string {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(b[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func startForward(tb testing.TB, target string, l ServerListener) *forward {
+	tb.Helper()
+	f, err := newForward("127.0.0.1:0", target, nil, l)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := f.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { f.Stop() })
+	return f
+}
+
+func udpClient(tb testing.TB, f *forward) *net.UDPConn {
+	tb.Helper()
+	c, err := net.DialUDP("udp", nil, f.uc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
+
+func roundtrip(tb testing.TB, c *net.UDPConn, msg string, wait time.Duration) bool {
+	tb.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		tb.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	return err == nil && string(b[:n]) == msg
+}
+
+func TestForwardUDPDialsOffReadLoop(t *testing.T) {
+	echo := udpEcho(t)
+	slow, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	l := newFwdListener(slow.LocalAddr().String())
+	f := startForward(t, echo, l)
+
+	// the slow client's mapping dials (routes) for as long as it is held
+	if _, err := slow.WriteToUDP([]byte("held"), f.uc.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	// while others are forwarded all the same
+	fast := udpClient(t, f)
+	if !roundtrip(t, fast, "fast", time.Second) {
+		t.Fatal("forward: udp: fast client blocked by a dialing one")
+	}
+
+	// queued datagrams of the slow client go out once it is dialed
+	close(l.held[slow.LocalAddr().String()])
+	_ = slow.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 64)
+	if n, _, err := slow.ReadFromUDP(b); err != nil || string(b[:n]) != "held" {
+		t.Errorf("forward: udp: held datagram; got %q, err %v", b[:n], err)
+	}
+	if n := f.Conns(); n != 2 {
+		t.Errorf("forward: udp: %d mappings; want 2", n)
+	}
+}
+
+func TestForwardUDPRestart(t *testing.T) {
+	echo := udpEcho(t)
+	l := newFwdListener()
+	f := startForward(t, echo, l)
+	c := udpClient(t, f)
+	if !roundtrip(t, c, "one", time.Second) {
+		t.Fatal("forward: udp: no echo")
+	}
+
+	// replies of a mapping that ends must not unmap its successor
+	k := c.LocalAddr().String()
+	f.Lock()
+	old := f.nat[k]
+	f.Unlock()
+	if old == nil {
+		t.Fatalf("forward: udp: no mapping for %s", k)
+	}
+	next := &fwdmapping{in: make(chan []byte, 1), done: make(chan struct{})}
+	f.Lock()
+	f.nat[k] = next
+	f.Unlock()
+	old.egress.Close() // ends old's reply
+	select {
+	case <-old.done:
+	case <-time.After(time.Second):
+		t.Fatal("forward: udp: old mapping did not end")
+	}
+	f.Lock()
+	got := f.nat[k]
+	f.Unlock()
+	if got != next {
+		t.Error("forward: udp: ended mapping removed its successor")
+	}
+	f.unmap(k, next)
+
+	select {
+	case s := <-l.smms:
+		if s.Tx != 3 || s.Rx != 3 {
+			t.Errorf("forward: udp: summary tx %d rx %d; want 3, 3", s.Tx, s.Rx)
+		}
+	case <-time.After(time.Second):
+		t.Error("forward: udp: no summary")
+	}
+
+	// and a new mapping is dialed after a refresh
+	if err := f.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	c = udpClient(t, f)
+	if !roundtrip(t, c, "two", time.Second) {
+		t.Error("forward: udp: no echo after refresh")
+	}
+
+	f.Enable(false)
+	d := udpClient(t, f)
+	if roundtrip(t, d, "three", 200*time.Millisecond) {
+		t.Error("forward: udp: forwarded while disabled")
+	}
+}
@@ -23,6 +23,9 @@ const (
 	SVCHTTP   = "svchttp"   // HTTP
 	PXSOCKS5  = "pxsocks5"  // SOCKS5 with forwarding proxy
 	PXHTTP    = "pxhttp"    // HTTP with forwarding proxy
+	SVCFWD    = "svcfwd"    // TCP and UDP port forward
+	PXFWD     = "pxfwd"     // TCP and UDP port forward over a proxy
+	SVCDOH    = "svcdoh"    // DNS over HTTPS
 
 	// status of proxies
 	SUP = 0  // svc UP
@@ -41,6 +44,7 @@ var (
 	errProxyEnd   = errors.New("proxy stopped")
 	errNotProxy   = errors.New("not a proxy")
 	errBlocked    = errors.New("blocked")
+	errNotFwd     = errors.New("not a forward")
 
 	udptimeoutsec = 5 * 60                    // 5m
 	tcptimeoutsec = (2 * 60 * 60) + (40 * 60) // 2h40m
@@ -82,6 +86,16 @@ type Services interface {
 	StopServers() (n int)
 	// Refresh re-registers servces and returns a csv of active ones.
 	RefreshServers() (active string)
+	// AddForward forwards tcp and udp from listenAddr on the device to
+	// targetAddr over proxyid, if any, or directly, if empty. Forwards
+	// are stopped and removed just like servers, by their IDs.
+	AddForward(listenAddr, targetAddr, proxyid string) (Forward, error)
+	// GetForward returns a Forward.
+	GetForward(id string) (Forward, error)
+	// AddDoHServer adds and starts a DNS over HTTPS server at addr serving
+	// /dns-query (rfc8484) with certpem and keypem, or with a self-signed
+	// cert, if both are empty; up to maxconns (if > 0) conns at once.
+	AddDoHServer(addr, certpem, keypem string, maxconns int) (Server, error)
 }
 
 var _ Server = (*socks5)(nil)
@@ -90,18 +104,20 @@ type services struct {
 	sync.RWMutex
 	servers  map[string]Server
 	proxies  ipn.Proxies
+	r        Resolver
 	listener ServerListener
 	ctl      protect.Controller
 }
 
-func NewServices(proxies ipn.Proxies, ctl protect.Controller, listener ServerListener) Services {
-	if listener == nil || ctl == nil {
+func NewServices(proxies ipn.Proxies, r Resolver, ctl protect.Controller, listener ServerListener) Services {
+	if listener == nil || ctl == nil || r == nil {
 		return nil
 	}
 	return &services{
 		servers:  make(map[string]Server),
 		ctl:      ctl,
 		proxies:  proxies,
+		r:        r,
 		listener: listener,
 	}
 }
@@ -132,6 +148,60 @@ func (s *services) AddServer(id, url string) (svc Server, err error) {
 	return svc, nil
 }
 
+func (s *services) AddForward(listen, target, proxyid string) (Forward, error) {
+	s.RemoveServer(fwdid(listen))
+
+	fwd, err := newForward(listen, target, s.ctl, s.listener)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.servers[fwd.ID()] = fwd
+	s.Unlock()
+
+	if len(proxyid) > 0 {
+		if err := s.Bridge(fwd.ID(), proxyid); err != nil {
+			s.RemoveServer(fwd.ID())
+			return nil, err
+		}
+	}
+	if err := fwd.Start(); err != nil {
+		s.RemoveServer(fwd.ID())
+		return nil, err
+	}
+	return fwd, nil
+}
+
+func (s *services) AddDoHServer(addr, certpem, keypem string, maxconns int) (Server, error) {
+	s.RemoveServer(SVCDOH)
+
+	svc, err := newDoHServer(SVCDOH, addr, certpem, keypem, maxconns, s.r, s.ctl, s.listener)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.Start(); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.servers[svc.ID()] = svc
+	s.Unlock()
+
+	return svc, nil
+}
+
+func (s *services) GetForward(id string) (Forward, error) {
+	svc, err := s.GetServer(id)
+	if err != nil {
+		return nil, err
+	}
+	if fwd, ok := svc.(Forward); ok {
+		return fwd, nil
+	}
+	return nil, errNotFwd
+}
+
 func (s *services) Bridge(serverid, proxyid string) error {
 	svc, err := s.GetServer(serverid)
 
@@ -0,0 +1,56 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package settings
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// marks of sockets by their owners (proxy ids, dns transport ids, or
+// handlers like Base and Exit); see: SetSockMark
+var marks = struct {
+	sync.RWMutex
+	m map[string]uint32
+}{m: make(map[string]uint32)}
+
+// SetSockMark sets SO_MARK (fwmark; linux only, needs CAP_NET_ADMIN) of
+// sockets owner who makes from here on; mark 0 unsets it. Sockets made
+// prior are left as they are.
+func SetSockMark(who string, mark int64) error {
+	if mark < 0 || mark > math.MaxUint32 {
+		return fmt.Errorf("sockmark: %s: mark %d not in [0, %d]", who, mark, uint32(math.MaxUint32))
+	}
+	marks.Lock()
+	defer marks.Unlock()
+	if mark == 0 {
+		delete(marks.m, who)
+	} else {
+		marks.m[who] = uint32(mark)
+	}
+	return nil
+}
+
+// SockMark returns the SO_MARK set for sockets of owner who, if any.
+func SockMark(who string) (mark uint32, ok bool) {
+	marks.RLock()
+	defer marks.RUnlock()
+	mark, ok = marks.m[who]
+	return
+}
+
+// SockMarks returns a copy of SO_MARKs set, by owner.
+func SockMarks() map[string]uint32 {
+	marks.RLock()
+	defer marks.RUnlock()
+	m := make(map[string]uint32, len(marks.m))
+	for who, mark := range marks.m {
+		m[who] = mark
+	}
+	return m
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package settings
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TCP congestion control algorithms supported by netstack.
+const (
+	CCReno  = "reno"
+	CCCubic = "cubic"
+)
+
+// netstack's defaults for tcp buffers (in bytes);
+// from: github.com/google/gvisor/blob/ee1e1f607/pkg/tcpip/transport/tcp/protocol.go#L41-L53
+const (
+	TCPMinBufSize     = 4 << 10 // 4KiB
+	TCPDefaultBufSize = 1 << 20 // 1MiB
+	TCPMaxBufSize     = 4 << 20 // 4MiB
+)
+
+var errTCPOptsBufs = errors.New("tcpopts: bufs must be 0 < min <= default <= max")
+
+// TCPOptions tune netstack's tcp; they apply to conns made after they are
+// set, and are retained across links; see: Tunnel.SetTCPOptions
+type TCPOptions struct {
+	// SendBufMin, SendBufDefault, SendBufMax bound (in bytes) the send
+	// buffers of conns, which are auto-tuned within these limits.
+	SendBufMin     int
+	SendBufDefault int
+	SendBufMax     int
+	// RecvBufMin, RecvBufDefault, RecvBufMax bound (in bytes) the receive
+	// buffers of conns, which are auto-tuned within these limits.
+	RecvBufMin     int
+	RecvBufDefault int
+	RecvBufMax     int
+	// SACK enables selective acks.
+	SACK bool
+	// CongestionControl is either CCReno or CCCubic.
+	CongestionControl string
+	// RcvWnd is the receive window (in bytes) advertised on accepting
+	// conns from the tun device; 0 for RecvBufDefault.
+	RcvWnd int
+}
+
+// DefaultTCPOptions returns netstack's defaults, with SACK enabled.
+func DefaultTCPOptions() *TCPOptions {
+	return &TCPOptions{
+		SendBufMin:        TCPMinBufSize,
+		SendBufDefault:    TCPDefaultBufSize,
+		SendBufMax:        TCPMaxBufSize,
+		RecvBufMin:        TCPMinBufSize,
+		RecvBufDefault:    TCPDefaultBufSize,
+		RecvBufMax:        TCPMaxBufSize,
+		SACK:              true,
+		CongestionControl: CCReno,
+		RcvWnd:            0,
+	}
+}
+
+// Valid returns an error if o has buffers out of order, an unknown
+// congestion control algorithm, or a negative receive window.
+func (o *TCPOptions) Valid() error {
+	if o.SendBufMin <= 0 || o.SendBufDefault < o.SendBufMin || o.SendBufDefault > o.SendBufMax {
+		return fmt.Errorf("%w; send: %d/%d/%d", errTCPOptsBufs, o.SendBufMin, o.SendBufDefault, o.SendBufMax)
+	}
+	if o.RecvBufMin <= 0 || o.RecvBufDefault < o.RecvBufMin || o.RecvBufDefault > o.RecvBufMax {
+		return fmt.Errorf("%w; recv: %d/%d/%d", errTCPOptsBufs, o.RecvBufMin, o.RecvBufDefault, o.RecvBufMax)
+	}
+	if o.CongestionControl != CCReno && o.CongestionControl != CCCubic {
+		return fmt.Errorf("tcpopts: unknown congestion control %q", o.CongestionControl)
+	}
+	if o.RcvWnd < 0 {
+		return fmt.Errorf("tcpopts: negative rcvwnd %d", o.RcvWnd)
+	}
+	return nil
+}
+
+func (o *TCPOptions) String() string {
+	return fmt.Sprintf("send: %d/%d/%d, recv: %d/%d/%d, sack? %t, cc: %s, rcvwnd: %d",
+		o.SendBufMin, o.SendBufDefault, o.SendBufMax,
+		o.RecvBufMin, o.RecvBufDefault, o.RecvBufMax,
+		o.SACK, o.CongestionControl, o.RcvWnd)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package settings
+
+import "sync"
+
+// TLSHello is how tls dials of a transport (or a proxy) say hello; see:
+// SetTLSHello
+type TLSHello struct {
+	// Profile of the ClientHello sent (ex: dialers.HelloChrome); empty
+	// for crypto/tls as-is.
+	Profile string
+	// Fallback, if set, retries handshakes that fail with Profile, once,
+	// over a new conn with crypto/tls as-is.
+	Fallback bool
+}
+
+// hellos by ids of transports or proxies
+var hellos = struct {
+	sync.RWMutex
+	m map[string]TLSHello
+}{m: make(map[string]TLSHello)}
+
+// SetTLSHello sets the ClientHello profile of tls dials of transport (or
+// proxy) id from here on; an empty profile unsets it. Profiles are not
+// validated here; see: dialers.HasHello
+func SetTLSHello(id, profile string, fallback bool) {
+	hellos.Lock()
+	defer hellos.Unlock()
+	if len(profile) <= 0 {
+		delete(hellos.m, id)
+	} else {
+		hellos.m[id] = TLSHello{Profile: profile, Fallback: fallback}
+	}
+}
+
+// TLSHelloOf returns the ClientHello profile set for id; zero if unset.
+func TLSHelloOf(id string) TLSHello {
+	hellos.RLock()
+	defer hellos.RUnlock()
+	return hellos.m[id]
+}
@@ -0,0 +1,517 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/dnscrypt"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// version of the blob from Tunnel.Export; bumped on incompatible changes.
+const snapshotv = 1
+
+// kinds of transportspec; one per Add*Transport (see: dns.go)
+const (
+	specDNS53      = "dns53"
+	specSystem     = "system"
+	specDefault    = "default"
+	specProxyDNS   = "proxydns"
+	specDoH        = "doh"
+	specDoHHeaders = "dohheaders"
+	specODoH       = "odoh"
+	specDoT        = "dot"
+	specDNSCrypt   = "dnscrypt"
+	specRelay      = "relay"
+	specGroup      = "group"
+)
+
+var (
+	errSpecKind        = errors.New("snapshot: unknown transport kind")
+	errSpecArgs        = errors.New("snapshot: bad transport args")
+	errSnapshotVersion = errors.New("snapshot: unsupported version")
+	errSnapshotID      = errors.New("snapshot: missing id")
+	errSnapshotRef     = errors.New("snapshot: referenced proxy missing")
+	errSnapshotRdns    = errors.New("snapshot: no rdns to set stamp on")
+)
+
+// transportspec is how a dns transport was added; see: addTransport.
+type transportspec struct {
+	Kind string   `json:"kind"`
+	ID   string   `json:"id"` // relay stamp, for specRelay
+	Args []string `json:"args,omitempty"`
+	Ref  bool     `json:"ref,omitempty"` // args are not exported
+}
+
+// proxyspec is a proxy's config as added with AddProxy, or
+// a reference (by id) to a proxy that must already exist.
+type proxyspec struct {
+	ID  string `json:"id"`
+	Txt string `json:"txt,omitempty"` // has secrets, if any
+	Ref bool   `json:"ref,omitempty"` // txt is not exported
+}
+
+// snapshot is the declarative part of a Tunnel's state.
+type snapshot struct {
+	Version      int             `json:"v"`
+	Transports   []transportspec `json:"transports,omitempty"`
+	Proxies      []proxyspec     `json:"proxies,omitempty"`
+	KillSwitches []string        `json:"killswitches,omitempty"`
+	RdnsStamp    string          `json:"rdnsstamp,omitempty"` // local blockstamp
+	// rules for flows to known public resolvers; see: dnsbypass
+	DNSBypassList     string         `json:"dnsbypasslist,omitempty"`
+	DNSBypassDefault  int            `json:"dnsbypassdefault"`
+	DNSBypassPolicies map[string]int `json:"dnsbypasspolicies,omitempty"`
+	// rules for dns flows assigned to proxies; see: proxydns
+	ProxyDNS       bool     `json:"proxydns,omitempty"`
+	ProxyDNSOptOut []string `json:"proxydnsoptout,omitempty"`
+	// policy for flows with deferred verdicts; see: parking
+	DeferTimeoutSecs int    `json:"defertimeoutsecs"`
+	DeferFallback    string `json:"deferfallback,omitempty"`
+}
+
+func (s transportspec) key() string {
+	if s.Kind == specRelay {
+		return specRelay + ":" + s.ID
+	}
+	return s.ID
+}
+
+func (s transportspec) equal(o transportspec) bool {
+	return s.Kind == o.Kind && s.ID == o.ID && slices.Equal(s.Args, o.Args)
+}
+
+// redacted returns s as a reference (by kind and id) to the transport it
+// specifies, if its args may have secrets (ex: urls, headers); or s as-is.
+func (s transportspec) redacted() transportspec {
+	switch s.Kind {
+	case specDoH, specDoHHeaders, specODoH, specDoT:
+	case specDefault: // urls only for doh
+		if len(s.Args) <= 0 || s.Args[0] != dnsx.DOH {
+			return s
+		}
+	default:
+		return s
+	}
+	return transportspec{Kind: s.Kind, ID: s.ID, Ref: true}
+}
+
+// withHeader returns s with header key set to value (or removed, if value
+// is empty), as DNSResolver.SetHeader does on the doh transport s specifies.
+// A specDoH becomes a specDoHHeaders. ok is false if s is not for doh.
+func (s transportspec) withHeader(key, value string) (_ transportspec, ok bool) {
+	switch s.Kind {
+	case specDoH: // url, ips
+		if len(s.Args) != 2 {
+			return s, false
+		}
+		s.Kind = specDoHHeaders
+		s.Args = append(slices.Clone(s.Args), "")
+	case specDoHHeaders: // url, ips, headers
+		if len(s.Args) != 3 {
+			return s, false
+		}
+		s.Args = slices.Clone(s.Args)
+	default:
+		return s, false
+	}
+
+	canon := func(k string) string {
+		return textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(k))
+	}
+	k := canon(key)
+	lines := make([]string, 0)
+	for _, line := range strings.Split(s.Args[2], "\n") {
+		hk, _, _ := strings.Cut(line, ":")
+		if len(strings.TrimSpace(line)) <= 0 || canon(hk) == k {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(value) > 0 {
+		lines = append(lines, k+": "+value)
+	}
+	s.Args[2] = strings.Join(lines, "\n")
+	return s, true
+}
+
+// present returns true if the transport s specifies is in r.
+func (s transportspec) present(r dnsx.Resolver) bool {
+	switch s.Kind {
+	case specDefault, specRelay: // never removed
+		return true
+	}
+	t, err := r.Get(s.ID)
+	// replaced by a client transport (see: AddClientTransport), if so
+	return err == nil && t.Type() != dnsx.Client
+}
+
+// tunspecs remembers how dns transports were added to a Tunnel.
+type tunspecs struct {
+	sync.RWMutex
+	m map[string]transportspec // key -> spec
+}
+
+func newTunSpecs() *tunspecs {
+	return &tunspecs{m: make(map[string]transportspec)}
+}
+
+func (ts *tunspecs) put(s ...transportspec) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, v := range s {
+		ts.m[v.key()] = v
+	}
+}
+
+// swap puts s, and returns a func that undoes it.
+func (ts *tunspecs) swap(s ...transportspec) (undo func()) {
+	ts.Lock()
+	defer ts.Unlock()
+	prev := make(map[string]*transportspec, len(s)) // key -> spec; nil if none
+	for _, v := range s {
+		k := v.key()
+		if _, seen := prev[k]; !seen {
+			if p, ok := ts.m[k]; ok {
+				prev[k] = &p
+			} else {
+				prev[k] = nil
+			}
+		}
+		ts.m[k] = v
+	}
+	return func() {
+		ts.Lock()
+		defer ts.Unlock()
+		for k, p := range prev {
+			if p == nil {
+				delete(ts.m, k)
+			} else {
+				ts.m[k] = *p
+			}
+		}
+	}
+}
+
+// setHeader updates the spec of doh transport id, if any, with header key
+// set to value; see: transportspec.withHeader
+func (ts *tunspecs) setHeader(id, key, value string) {
+	ts.Lock()
+	defer ts.Unlock()
+	if s, ok := ts.m[id]; ok {
+		if s, ok = s.withHeader(key, value); ok {
+			ts.m[id] = s
+		}
+	}
+}
+
+// all returns remembered specs sorted by their keys.
+func (ts *tunspecs) all() []transportspec {
+	ts.RLock()
+	defer ts.RUnlock()
+
+	s := make([]transportspec, 0, len(ts.m))
+	for _, v := range ts.m {
+		s = append(s, v)
+	}
+	slices.SortFunc(s, func(a, b transportspec) int {
+		return strings.Compare(a.key(), b.key())
+	})
+	return s
+}
+
+func (ts *tunspecs) get(s transportspec) (transportspec, bool) {
+	ts.RLock()
+	defer ts.RUnlock()
+	v, ok := ts.m[s.key()]
+	return v, ok
+}
+
+// specResolver is the resolver as GetResolver hands it out; it remembers
+// headers set on doh transports (ex: rotated tokens), so that they are
+// exported, and are not lost as transports are rebuilt from their specs
+// (ex: RestartResolver).
+type specResolver struct {
+	dnsx.Resolver
+	specs *tunspecs
+}
+
+func (r specResolver) SetHeader(id, key, value string) error {
+	if err := r.Resolver.SetHeader(id, key, value); err != nil {
+		return err
+	}
+	r.specs.setHeader(id, key, value)
+	return nil
+}
+
+// remember remembers s, or stages it, if a config is open.
+func (t *rtunnel) remember(s transportspec) {
+	if t.cfg.stage(func() { t.cfg.specs = append(t.cfg.specs, s) }) {
+		return
+	}
+	t.specs.put(s)
+}
+
+func (t *rtunnel) Export(withSecrets bool) ([]byte, error) {
+	r, rerr := t.internalResolver()
+	pxr, perr := t.internalProxies()
+	if rerr != nil || perr != nil {
+		return nil, errors.Join(rerr, perr)
+	}
+
+	snap := &snapshot{Version: snapshotv}
+	for _, s := range t.specs.all() {
+		if s.present(r) { // transports removed since are skipped
+			if !withSecrets {
+				s = s.redacted()
+			}
+			snap.Transports = append(snap.Transports, s)
+		}
+	}
+	cfgs := pxr.Configs()
+	ids := make([]string, 0, len(cfgs))
+	for id := range cfgs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if withSecrets {
+			snap.Proxies = append(snap.Proxies, proxyspec{ID: id, Txt: cfgs[id]})
+		} else {
+			snap.Proxies = append(snap.Proxies, proxyspec{ID: id, Ref: true})
+		}
+	}
+	snap.KillSwitches = pxr.KillSwitches()
+	slices.Sort(snap.KillSwitches)
+
+	if rdns, err := r.GetRdnsLocal(); err == nil {
+		snap.RdnsStamp, _ = rdns.GetStamp()
+	}
+	snap.DNSBypassList, snap.DNSBypassDefault, snap.DNSBypassPolicies = t.bypass.rules()
+	snap.ProxyDNS, snap.ProxyDNSOptOut = t.pxdns.rules()
+	timeout, fallback := t.hold.policy()
+	snap.DeferTimeoutSecs = int(timeout / time.Second)
+	snap.DeferFallback = fallback
+
+	log.I("tun: export: %d transports, %d proxies; secrets? %t", len(snap.Transports), len(snap.Proxies), withSecrets)
+	return json.Marshal(snap)
+}
+
+// Restore validates and builds everything in blob before applying any
+// of it; on error, which names each failed entry, nothing is applied.
+// Transports and proxies in blob replace those of the same ids, if any,
+// and are left as-is if unchanged; rules and policies are replaced.
+func (t *rtunnel) Restore(blob []byte) error {
+	r, rerr := t.internalResolver()
+	pxr, perr := t.internalProxies()
+	if rerr != nil || perr != nil {
+		return errors.Join(rerr, perr)
+	}
+	g := t.getBridge()
+
+	snap := new(snapshot)
+	if err := json.Unmarshal(blob, snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotv {
+		return fmt.Errorf("%w: %d", errSnapshotVersion, snap.Version)
+	}
+
+	var errs []error
+	fail := func(what, id string, err error) {
+		errs = append(errs, fmt.Errorf("%s %s: %w", what, id, err))
+	}
+
+	// proxies
+	cfgs := pxr.Configs()
+	pxs := make(map[string]ipn.Proxy)
+	txts := make(map[string]string)
+	for _, ps := range snap.Proxies {
+		if len(ps.ID) <= 0 {
+			fail("proxy", ps.ID, errSnapshotID)
+		} else if ps.Ref {
+			if _, err := pxr.ProxyFor(ps.ID); err != nil {
+				fail("proxy", ps.ID, errSnapshotRef)
+			}
+		} else if txt, ok := cfgs[ps.ID]; ok && txt == ps.Txt {
+			continue // unchanged
+		} else if p, err := pxr.NewProxy(ps.ID, ps.Txt); err != nil {
+			fail("proxy", ps.ID, err)
+		} else {
+			pxs[ps.ID] = p
+			txts[ps.ID] = ps.Txt
+		}
+	}
+	proxy := func(id string) (x.Proxy, error) {
+		if p, ok := pxs[id]; ok {
+			return p, nil
+		}
+		return pxr.GetProxy(id)
+	}
+	if err := ipn.ValidKillSwitches(snap.KillSwitches); err != nil {
+		fail("killswitches", strings.Join(snap.KillSwitches, ","), err)
+	}
+
+	// transports
+	var dcm *dnscrypt.DcMulti
+	if tm, err := r.GetMult(dnsx.DcProxy); err == nil {
+		dcm, _ = tm.(*dnscrypt.DcMulti)
+	}
+	ts := make([]dnsx.Transport, 0)
+	dcs := make([]string, 0)    // dnscrypt transports, registered with dcm
+	relays := make([]string, 0) // relay stamps
+	var def, ndef *bootstrap    // default transport, and its fork, if changed
+	specs := make([]transportspec, 0)
+	for _, s := range snap.Transports {
+		if s.Ref { // must be as exported, sans secrets
+			if prev, ok := t.specs.get(s); !ok || prev.Kind != s.Kind || !prev.present(r) {
+				fail("transport", s.ID, errSnapshotRef)
+			}
+			continue
+		}
+		if prev, ok := t.specs.get(s); ok && prev.equal(s) && s.present(r) {
+			continue // unchanged
+		}
+		switch s.Kind {
+		case specDefault:
+			if len(s.Args) != 3 {
+				fail("transport", s.ID, errSpecArgs)
+			} else if tr, err := r.Get(dnsx.Default); err != nil {
+				fail("transport", s.ID, err)
+			} else if b, ok := tr.(*bootstrap); !ok {
+				fail("transport", s.ID, dnsx.ErrNotDefaultTransport)
+			} else if nb, err := b.fork(s.Args[0], s.Args[1], s.Args[2]); err != nil {
+				fail("transport", s.ID, err)
+			} else {
+				def, ndef = b, nb
+			}
+		case specRelay:
+			if _, err := stamps.NewServerStampFromString(s.ID); err != nil {
+				fail("relay", s.ID, err)
+			} else if dcm == nil {
+				fail("relay", s.ID, dnsx.ErrNoDcProxy)
+			} else {
+				relays = append(relays, s.ID)
+			}
+		case specSystem:
+			if len(s.Args) != 1 || len(s.Args[0]) <= 0 {
+				fail("transport", s.ID, errSpecArgs)
+				continue
+			}
+			ipcsv := s.Args[0]
+			if strings.HasPrefix(ipcsv, "localhost") {
+				ipcsv = localip4 + "," + localip6
+			}
+			if sdns, err := newSystemDNSProxy(g, pxr, ipcsv); err != nil {
+				fail("transport", s.ID, err)
+			} else {
+				ts = append(ts, sdns)
+			}
+		default:
+			if dns, err := s.build(r, pxr, g, proxy); err != nil {
+				fail("transport", s.ID, err)
+			} else {
+				ts = append(ts, dns)
+				if s.Kind == specDNSCrypt {
+					dcs = append(dcs, s.ID)
+				}
+			}
+		}
+		specs = append(specs, s)
+	}
+
+	// rdns
+	var rdns x.RDNS
+	var prevstamp string
+	if len(snap.RdnsStamp) > 0 {
+		var err error
+		if rdns, err = r.GetRdnsLocal(); err != nil {
+			fail("rdns", "local", errSnapshotRdns)
+		} else if _, err := rdns.StampToFlags(snap.RdnsStamp); err != nil {
+			fail("rdns", "local", err)
+		} else if prevstamp, err = rdns.GetStamp(); err != nil {
+			fail("rdns", "local", err)
+		}
+	} else if rl, err := r.GetRdnsLocal(); err == nil {
+		rdns = rl // stamp, if any, is unset
+		prevstamp, _ = rl.GetStamp()
+	}
+
+	// rules
+	if _, _, err := parseDNSBypassList(snap.DNSBypassList); err != nil {
+		fail("dnsbypass", "list", err)
+	}
+
+	rollback := func() {
+		for _, p := range pxs {
+			go p.Stop()
+		}
+		if dcm != nil {
+			for _, id := range dcs {
+				dcm.Remove(id)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		rollback()
+		log.W("tun: restore: %d failed; rolled back", len(errs))
+		return errors.Join(errs...)
+	}
+
+	// all valid; swap in what may still fail first, and undo it if it does
+	if rdns != nil {
+		if err := rdns.SetStamp(snap.RdnsStamp); err != nil {
+			rollback()
+			log.W("tun: restore: rdns stamp: %v; rolled back", err)
+			return fmt.Errorf("rdns local: %w", err)
+		}
+	}
+	if err := r.AddAll(ts...); err != nil { // adds all or none
+		rollback()
+		if rdns != nil {
+			_ = rdns.SetStamp(prevstamp)
+		}
+		log.W("tun: restore: add transports: %v; rolled back", err)
+		return err
+	}
+
+	// and then, the rest, which is all set to not fail
+	pxr.AddAll(pxs, txts)
+	if err := pxr.SetKillSwitches(snap.KillSwitches); err != nil { // validated
+		log.E("tun: restore: killswitches: %v", err)
+	}
+	for _, relay := range relays {
+		if err := dnscrypt.AddRelayTransport(dcm, relay); err != nil { // validated
+			log.E("tun: restore: relay %s: %v", relay, err)
+		}
+	}
+	if def != nil {
+		def.adopt(ndef)
+	}
+	if err := t.bypass.setRules(snap.DNSBypassList, snap.DNSBypassDefault, snap.DNSBypassPolicies); err != nil { // validated
+		log.E("tun: restore: dnsbypass: %v", err)
+	}
+	t.pxdns.setRules(snap.ProxyDNS, snap.ProxyDNSOptOut)
+	t.hold.setPolicy(time.Duration(snap.DeferTimeoutSecs)*time.Second, snap.DeferFallback)
+	t.specs.put(specs...)
+
+	log.I("tun: restore: %d proxies, %d transports, %d relays; default? %t",
+		len(pxs), len(ts), len(relays), def != nil)
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+const (
+	// unrelated flows must be established well before any stall ends
+	establishWithin = 500 * time.Millisecond
+	// flows to this port are blocked
+	stalledPort = 53
+)
+
+// echoUDP echoes datagrams back; returns its addr.
+func echoUDP(tb testing.TB) string {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestStallDoesNotDelayTCP(t *testing.T) {
+	tt := newTestTunnel(ipn.Base)
+	tt.l.pids = map[uint16]string{stalledPort: ipn.Block}
+	tt.px.to = map[string]string{"tcp": echoTCP(t, make(chan struct{}, 4))}
+	client := tt.up(t, settings.IP4)
+	defer tt.tcp.End()
+
+	blocked := tcpip.FullAddress{NIC: 1, Addr: testServer, Port: stalledPort}
+	// repeated blocks of a dst are stalled; the first is not
+	if c, err := gonet.DialTCP(client, blocked, ipv4.ProtocolNumber); err == nil {
+		c.Close()
+		t.Fatal("tcp: blocked conn connected")
+	}
+	stalled := make(chan error, 1)
+	go func() {
+		c, err := gonet.DialTCP(client, blocked, ipv4.ProtocolNumber)
+		if err == nil {
+			c.Close()
+		}
+		stalled <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let the stalled flow reach the handler
+
+	start := time.Now()
+	c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 443}, ipv4.ProtocolNumber)
+	took := time.Since(start)
+	if err != nil {
+		t.Fatalf("tcp: unrelated conn: %v", err)
+	}
+	c.Close()
+	if took > establishWithin {
+		t.Errorf("tcp: unrelated conn established in %s; want < %s", took, establishWithin)
+	}
+
+	select {
+	case err := <-stalled:
+		t.Errorf("tcp: stalled conn done before its stall; err? %v", err)
+	default:
+	}
+	select {
+	case err := <-stalled:
+		if err == nil {
+			t.Error("tcp: stalled conn connected")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("tcp: stalled conn not failed after its stall")
+	}
+	if d := tt.px.dials.Load(); d != 1 {
+		t.Errorf("tcp: %d dials; want 1, for the unrelated conn", d)
+	}
+}
+
+func TestStallDoesNotDelayUDP(t *testing.T) {
+	tt := newTestTunnel(ipn.Base)
+	tt.l.pids = map[uint16]string{stalledPort: ipn.Block}
+	tt.px.to = map[string]string{"udp": echoUDP(t)}
+	client := tt.up(t, settings.IP4)
+	defer tt.udp.End()
+
+	dial := func(port uint16) *gonet.UDPConn {
+		c, err := gonet.DialUDP(client, nil, &tcpip.FullAddress{NIC: 1, Addr: testServer, Port: port}, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	b := make([]byte, 1500)
+
+	// repeated blocks of a dst are stalled; the first is not
+	first := dial(stalledPort)
+	if _, err := first.Write([]byte("q")); err != nil {
+		t.Fatal(err)
+	}
+	_ = first.SetReadDeadline(time.Now().Add(establishWithin))
+	if _, err := first.Read(b); err == nil || timedout(err) {
+		t.Fatalf("udp: blocked flow: err %v; want refused", err)
+	}
+	blocked := dial(stalledPort)
+	if _, err := blocked.Write([]byte("q")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(443)
+	start := time.Now()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(b)
+	took := time.Since(start)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("udp: unrelated flow: got %q; err? %v", b[:n], err)
+	}
+	if took > establishWithin {
+		t.Errorf("udp: unrelated flow replied in %s; want < %s", took, establishWithin)
+	}
+
+	// the stalled flow goes unanswered, and is not refused
+	_ = blocked.SetReadDeadline(time.Now().Add(establishWithin))
+	if _, err := blocked.Read(b); !timedout(err) {
+		t.Errorf("udp: stalled flow: err %v; want a timeout", err)
+	}
+	if d := tt.px.dials.Load(); d != 1 {
+		t.Errorf("udp: %d dials; want 1, for the unrelated flow", d)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// how long a realip stays sticky since it was last dialed ok
+	stickyttl = 10 * time.Minute
+	// consecutive dial failures before a sticky realip is demoted
+	stickymaxfails = 2
+	// max (uid, domain) entries remembered
+	stickymax = 2048
+)
+
+// sticky remembers the realip last dialed ok per (uid, domain), so that
+// consecutive flows from an app to a service land on the same server;
+// some services tie sessions (and tls session resumption) to the server.
+type sticky struct {
+	sync.Mutex                      // protects m
+	m          map[string]*stickyip // stickykey -> realip
+}
+
+type stickyip struct {
+	ip     netip.Addr
+	fails  int // consecutive dial failures
+	expiry time.Time
+}
+
+func newSticky() *sticky {
+	return &sticky{
+		m: make(map[string]*stickyip),
+	}
+}
+
+// stickykey returns the key for uid and the first of domains (csv);
+// empty if there are no domains, as realips are then not shared.
+func stickykey(uid, domains string) string {
+	d, _, _ := strings.Cut(domains, ",")
+	d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if len(d) <= 0 {
+		return ""
+	}
+	return uid + ":" + d
+}
+
+// pick moves the realip remembered for k to the front of ipps, if it is
+// among ipps; and returns true if so. An ip missing from ipps is forgotten,
+// as the domain's current answers no longer include it.
+func (s *sticky) pick(k string, ipps []netip.AddrPort) bool {
+	if len(k) <= 0 || len(ipps) <= 0 {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.m[k]
+	if !ok {
+		return false
+	}
+	if time.Now().After(v.expiry) {
+		delete(s.m, k)
+		return false
+	}
+	for i, ipp := range ipps {
+		if ipp.Addr() == v.ip {
+			ipps[0], ipps[i] = ipps[i], ipps[0]
+			return true
+		}
+	}
+	log.V("sticky: %s: %s not among realips; forget", k, v.ip)
+	delete(s.m, k)
+	return false
+}
+
+// ok remembers ip as the realip for k.
+func (s *sticky) ok(k string, ip netip.Addr) {
+	if len(k) <= 0 || !ip.IsValid() {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.m[k]; !ok && len(s.m) >= stickymax {
+		s.evictLocked()
+	}
+	s.m[k] = &stickyip{
+		ip:     ip,
+		expiry: time.Now().Add(stickyttl),
+	}
+}
+
+// fail notes a failed dial to ip for k; the realip remembered for k is
+// demoted (flows fall back to shuffled realips) after stickymaxfails.
+func (s *sticky) fail(k string, ip netip.Addr) {
+	if len(k) <= 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.m[k]
+	if !ok || v.ip != ip {
+		return
+	}
+	v.fails++
+	if v.fails >= stickymaxfails {
+		log.D("sticky: %s: demote %s after %d failures", k, ip, v.fails)
+		delete(s.m, k)
+	}
+}
+
+// OnLinkChange implements core.LinkObserver; realips dialed ok on the
+// previous link may not be reachable (or be the closest) on the new one.
+func (s *sticky) OnLinkChange(l core.Link) {
+	s.Lock()
+	defer s.Unlock()
+
+	log.D("sticky: link: %s; forget %d", l.L3, len(s.m))
+	clear(s.m)
+}
+
+// evictLocked removes expired entries; or, if none are, an arbitrary one.
+func (s *sticky) evictLocked() {
+	now := time.Now()
+	n := len(s.m)
+	for k, v := range s.m {
+		if now.After(v.expiry) {
+			delete(s.m, k)
+		}
+	}
+	if len(s.m) < n {
+		return
+	}
+	for k := range s.m {
+		delete(s.m, k)
+		return
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func stickyipps() []netip.AddrPort {
+	return []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:443"),
+		netip.MustParseAddrPort("192.0.2.2:443"),
+		netip.MustParseAddrPort("192.0.2.3:443"),
+	}
+}
+
+func TestStickyKey(t *testing.T) {
+	tests := []struct {
+		uid, domains, want string
+	}{
+		{"10", "Example.COM.", "10:example.com"},
+		{"10", " a.test , b.test", "10:a.test"},
+		{"10", "", ""},
+		{"10", ",b.test", ""},
+	}
+	for _, tc := range tests {
+		if got := stickykey(tc.uid, tc.domains); got != tc.want {
+			t.Errorf("sticky: key(%s, %q): got %q; want %q", tc.uid, tc.domains, got, tc.want)
+		}
+	}
+}
+
+func TestStickyHit(t *testing.T) {
+	s := newSticky()
+	k := stickykey("10", "a.test")
+	ip := netip.MustParseAddr("192.0.2.3")
+
+	ipps := stickyipps()
+	if s.pick(k, ipps) {
+		t.Error("sticky: hit before any dial")
+	}
+	s.ok(k, ip)
+	if !s.pick(k, ipps) || ipps[0].Addr() != ip {
+		t.Errorf("sticky: %s not picked first: %v", ip, ipps)
+	}
+	// other uids and domains are not affected
+	ipps = stickyipps()
+	if s.pick(stickykey("11", "a.test"), ipps) || s.pick(stickykey("10", "b.test"), ipps) {
+		t.Error("sticky: hit for another uid or domain")
+	}
+	if !slices.Equal(ipps, stickyipps()) {
+		t.Errorf("sticky: realips reordered on a miss: %v", ipps)
+	}
+	// nor do flows without domains share realips
+	s.ok("", ip)
+	if s.pick("", ipps) {
+		t.Error("sticky: hit sans a domain")
+	}
+
+	// realips missing from the answers are forgotten
+	if s.pick(k, stickyipps()[:2]) {
+		t.Error("sticky: hit for a realip not among answers")
+	}
+	if s.pick(k, stickyipps()) {
+		t.Error("sticky: hit after the realip was forgotten")
+	}
+}
+
+func TestStickyDemote(t *testing.T) {
+	s := newSticky()
+	k := stickykey("10", "a.test")
+	ip := netip.MustParseAddr("192.0.2.2")
+	s.ok(k, ip)
+
+	// failures of other realips do not count
+	s.fail(k, netip.MustParseAddr("192.0.2.1"))
+	s.fail(k, netip.MustParseAddr("192.0.2.1"))
+	if !s.pick(k, stickyipps()) {
+		t.Fatal("sticky: demoted on others' failures")
+	}
+
+	s.fail(k, ip)
+	if !s.pick(k, stickyipps()) {
+		t.Fatalf("sticky: demoted after 1 of %d failures", stickymaxfails)
+	}
+	// a dial ok in between resets the count
+	s.ok(k, ip)
+	s.fail(k, ip)
+	if !s.pick(k, stickyipps()) {
+		t.Fatal("sticky: failures not reset on ok")
+	}
+	s.fail(k, ip)
+	if s.pick(k, stickyipps()) {
+		t.Errorf("sticky: not demoted after %d failures", stickymaxfails)
+	}
+}
+
+func TestStickyExpiry(t *testing.T) {
+	s := newSticky()
+	k := stickykey("10", "a.test")
+	ip := netip.MustParseAddr("192.0.2.2")
+	s.ok(k, ip)
+
+	s.Lock()
+	s.m[k].expiry = time.Now().Add(-time.Second)
+	s.Unlock()
+	if s.pick(k, stickyipps()) {
+		t.Error("sticky: hit after expiry")
+	}
+	s.Lock()
+	n := len(s.m)
+	s.Unlock()
+	if n != 0 {
+		t.Errorf("sticky: %d entries after expiry", n)
+	}
+
+	// expired entries are evicted first, when full
+	for i := range stickymax {
+		s.ok(stickykey("10", "d"+strconv.Itoa(i)+".test"), ip)
+	}
+	s.Lock()
+	for _, v := range s.m {
+		v.expiry = time.Now().Add(-time.Second)
+	}
+	s.Unlock()
+	s.ok(k, ip)
+	s.Lock()
+	n = len(s.m)
+	s.Unlock()
+	if n != 1 {
+		t.Errorf("sticky: %d entries after evicting expired ones; want 1", n)
+	}
+	if !s.pick(k, stickyipps()) {
+		t.Error("sticky: new entry not remembered when full")
+	}
+}
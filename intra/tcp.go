@@ -30,6 +30,8 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/celzero/firestack/intra/dnsx"
@@ -50,8 +52,21 @@ type tcpHandler struct {
 	listener    SocketListener
 	prox        ipn.Proxies
 	fwtracker   *core.ExpMap
-	status      int
-	conntracker core.ConnMapper // connid -> [local,remote]
+	status      atomic.Int32     // TCPOK or TCPEND
+	td          *core.Teardown   // goroutines of flows; see: End
+	conntracker core.ConnMapper  // connid -> [local,remote]
+	hold        *parking         // flows with deferred verdicts
+	bypass      *dnsbypass       // flows to known public resolvers
+	hairpin     *hairpin         // flows to the device's own addresses
+	pxdns       *proxydns        // dns flows served over their proxy
+	sticky      *sticky          // realips last dialed per uid and domain
+	breaker     *breaker         // destinations whose dials keep failing
+	retries     *retries         // proxies that failed flows of late, per uid and destination
+	fair        *core.Fair       // schedules uploads of flows, if on
+	certs       *certobs         // tls handshakes observed, and pins
+	capture     *capture         // first payloads of blocked flows
+	metered     *metered         // background flows blocked on metered networks
+	procs       *netstat.ProcNet // uids of sockets, for BlockModeFilterProc
 }
 
 type ioinfo struct {
@@ -77,22 +92,34 @@ var _ netstack.GTCPConnHandler = (*tcpHandler)(nil)
 // Connections to `fakedns` are redirected to DOH.
 // All other traffic is forwarded using `dialer`.
 // `listener` is provided with a summary of each socket when it is closed.
-func NewTCPHandler(resolver dnsx.Resolver, prox ipn.Proxies, tunMode *settings.TunMode, ctl protect.Controller, listener SocketListener) netstack.GTCPConnHandler {
+func NewTCPHandler(resolver dnsx.Resolver, prox ipn.Proxies, tunMode *settings.TunMode, hold *parking, bypass *dnsbypass, hairpin *hairpin, pxdns *proxydns, sticky *sticky, breaker *breaker, retries *retries, fair *core.Fair, certs *certobs, capture *capture, metered *metered, procs *netstat.ProcNet, conns core.ConnMapper, ctl protect.Controller, listener SocketListener) netstack.GTCPConnHandler {
 	h := &tcpHandler{
 		resolver:    resolver,
 		tunMode:     tunMode,
 		listener:    listener,
 		prox:        prox,
 		fwtracker:   core.NewExpiringMap(),
-		conntracker: core.NewConnMap(),
-		status:      TCPOK,
+		conntracker: conns.Proto(ProtoTypeTCP),
+		hold:        hold,
+		bypass:      bypass,
+		hairpin:     hairpin,
+		pxdns:       pxdns,
+		sticky:      sticky,
+		breaker:     breaker,
+		retries:     retries,
+		fair:        fair,
+		certs:       certs,
+		capture:     capture,
+		metered:     metered,
+		procs:       procs,
+		td:          core.NewTeardown(),
 	}
 
 	log.I("tcp: new handler created")
 	return h
 }
 
-func (h *tcpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains, probableDomains, blocklists string) *Mark {
+func (h *tcpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains, probableDomains, blocklists, meta string) *Mark {
 	// BlockModeNone returns false, BlockModeSink returns true
 	if h.tunMode.BlockMode == settings.BlockModeSink {
 		return optionsBlock
@@ -108,16 +135,19 @@ func (h *tcpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains,
 	// Implict: BlockModeFilter or BlockModeFilterProc
 	uid := -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
-		procEntry := netstat.FindProcNetEntry("tcp", localaddr, target)
+		procEntry := h.procs.Find("tcp", localaddr, target)
 		if procEntry != nil {
 			uid = procEntry.UserID
 		}
 	}
 
+	// retries of flows that failed of late are decided knowing so
+	meta = h.retries.tag(meta, retrykey(strconv.Itoa(uid), domains, target.Addr()))
+
 	var proto int32 = 6 // tcp
 	src := localaddr.String()
 	dst := target.String()
-	res := h.listener.Flow(proto, uid, src, dst, realips, domains, probableDomains, blocklists)
+	res := h.listener.Flow(proto, uid, src, dst, realips, domains, probableDomains, blocklists, meta)
 
 	if res == nil {
 		log.W("tcp: onFlow: empty res from kt; using base")
@@ -127,18 +157,54 @@ func (h *tcpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains,
 		res.PID = ipn.Base
 	}
 
-	return res
+	return h.metered.verdict(uid, res)
 }
 
+// End stops h from handling new flows, closes those in flight, and waits
+// (up to endtimeout) for their goroutines to return.
 func (h *tcpHandler) End() error {
-	h.status = TCPEND
-	h.CloseConns(nil)
+	h.status.Store(TCPEND)
+	if !h.td.End(endtimeout, func() { h.CloseConns(nil) }) {
+		log.W("tcp: end: %d flows still running", h.td.Running())
+		return errEndTimeout
+	}
+	log.I("tcp: end: done")
 	return nil
 }
 
 // CloseConns implements netstack.GTCPConnHandler
 func (h *tcpHandler) CloseConns(cids []string) (closed []string) {
-	return closeconns(h.conntracker, cids)
+	return append(closeconns(h.conntracker, cids), h.hold.release(cids)...)
+}
+
+// conns implements tracker
+func (h *tcpHandler) conns() core.ConnMapper {
+	return h.conntracker
+}
+
+// stalls implements tracker
+func (h *tcpHandler) stalls() *core.ExpMap {
+	return h.fwtracker
+}
+
+// firewall resets gconn of a blocked flow; or, if flows of uid are
+// captured, completes its handshake and reads the first bytes the client
+// sends. gconn is then closed, and smm sent.
+func (h *tcpHandler) firewall(gconn *netstack.GTCPConn, uid string, smm *SocketSummary, err error) {
+	const rst bool = true // tear down conn
+	const ack bool = !rst // send synack
+
+	if h.capture.on(uid) {
+		// complete the handshake, so that the client sends its first payload
+		if open, _ := gconn.Connect(ack); open {
+			h.capture.read(gconn, captureWaitTCP, smm)
+		} // else: already reset
+	} else {
+		gconn.Connect(rst) // fin
+	}
+	gconn.Close()
+	smm.done(err)
+	sendNotif(h.listener, smm)
 }
 
 // Proxy implements netstack.GTCPConnHandler
@@ -160,12 +226,14 @@ func (h *tcpHandler) Proxy(gconn *netstack.GTCPConn, src, target netip.AddrPort)
 		}
 	}()
 
-	if h.status == TCPEND {
+	if h.status.Load() == TCPEND {
 		log.D("tcp: proxy: end")
 		gconn.Connect(rst) // fin
 		return deny
 	}
 
+	src, _ = core.UnmapAddrPort(src)
+	target, _ = core.UnmapAddrPort(target)
 	if !src.IsValid() || !target.IsValid() {
 		log.E("tcp: nil addr %v -> %v", src, target)
 		gconn.Connect(rst) // fin
@@ -174,55 +242,191 @@ func (h *tcpHandler) Proxy(gconn *netstack.GTCPConn, src, target netip.AddrPort)
 
 	// alg happens after nat64, and so, alg knows nat-ed ips
 	// that is, realips are un-nated
-	realips, domains, probableDomains, blocklists := undoAlg(h.resolver, target.Addr())
+	realips, domains, probableDomains, blocklists, meta := undoAlg(h.resolver, target.Addr())
+	// alg ips apps held on to past their ttls, if evicted of late, are judged
+	// by the domain they were answered for; and re-resolved once let through
+	evicted, stale := h.resolver.StaleAlg(target.Addr())
+	if stale && len(domains) <= 0 {
+		domains = evicted
+	}
+
+	bypass := h.bypass.match(target, realips)
+	if bypass {
+		meta = withTag(meta, dnsbypasstag)
+	}
+	lo, hairpin := h.hairpin.match(target)
+	if hairpin {
+		meta = withTag(meta, hairpintag)
+	}
 
 	// flow/dns-override are nat-aware, as in, they can deal with
 	// nat-ed ips just fine, and so, use target as-is instead of ipx4
-	res := h.onFlow(src, target, realips, domains, probableDomains, blocklists)
+	res := h.onFlow(src, target, realips, domains, probableDomains, blocklists, meta)
+	defaulted := failsafed(res)
+
+	if res.PID == ipn.Defer {
+		// hold on to the syn; gconn is neither acked nor reset until
+		// the client resolves the verdict, or the park timeout fires
+		res = h.hold.wait(res, h.conntracker, core.ConnTuple{Uid: res.UID, Dst: target.Addr()}, h.td.Done())
+	}
+	// domain routes apply to the final verdict
+	res = withRoute(h.prox, res, meta)
+	// flows to the device's own addresses are never sent over proxies
+	res = withHairpin(res, hairpin)
+	// retries of flows whose proxy failed of late go over its alternate, if set
+	retryk := retrykey(res.UID, domains, target.Addr())
+	res, alt := h.retries.alternate(h.prox, retryk, res)
 
 	cid, pid, uid := splitCidPidUid(res)
 	s = tcpSummary(cid, pid, uid, target.Addr())
+	s.DNSBypass = bypass
+	s.Hairpin = hairpin
+	s.Failsafe = defaulted
+	s.Retry = h.retries.failed(retryk)
+	s.Alternate = alt
+	if s.trace = core.Traced(domains, uid); s.trace != nil {
+		s.trace.Event("flow", "tcp %s: %s -> %s (dom: %s + %s / real: %s / blocklists: %s / meta: %s) for uid %s; verdict %s",
+			cid, src, target, domains, probableDomains, realips, blocklists, meta, uid, pid)
+		if alt {
+			s.trace.Event("flow-retry", "tcp %s: failed of late over %s; retry over %s", cid, s.Retry, pid)
+		}
+	}
 
 	if pid == ipn.Block {
-		var secs uint32
-		k := uid + target.String()
+		k := stallkey(uid, target.String())
 		if len(domains) > 0 { // probableDomains are not reliable to use for firewalling
-			k = uid + domains
-		}
-		if secs = stall(h.fwtracker, k); secs > 0 {
-			waittime := time.Duration(secs) * time.Second
-			time.Sleep(waittime)
+			k = stallkey(uid, domains)
 		}
+		secs := stall(h.fwtracker, k, stallmaxtcp)
+		s.trace.Event("flow-block", "tcp %s: firewalled; stall %ds", cid, secs)
 		log.I("tcp: gconn %s firewalled from %s -> %s (dom: %s + %s/ real: %s) for %s; stall? %ds", cid, src, target, domains, probableDomains, realips, uid, secs)
 		err = errTcpFirewalled
+		if res.why != nil { // blocked natively; ex: metered
+			err = errors.Join(err, res.why)
+		}
+		if secs <= 0 && !h.capture.on(uid) {
+			gconn.Connect(rst) // fin
+			return deny
+		}
+		// the syn goes unanswered until then; without holding up this goroutine
+		time.AfterFunc(time.Duration(secs)*time.Second, func() {
+			h.firewall(gconn, uid, s, err)
+		})
+		return allow // gconn closed and summary sent by h.firewall
+	}
+
+	// flows meant for a proxy that is down and has its kill switch
+	// set must not be sent anywhere else; reset them right away
+	if h.prox.KillSwitched(pid) {
+		log.I("tcp: gconn %s killswitched from %s -> %s via %s for %s", cid, src, target, pid, uid)
+		err = errKillSwitch
+		s.trace.Event("flow-block", "tcp %s: kill switched %s", cid, pid)
 		gconn.Connect(rst) // fin
 		return deny
 	}
 
+	// apps sending dns straight to public resolvers bypass the tunnel's
+	// resolver; block or redirect them per their uid's policy, if any
+	var redirect bool
+	if bypass && pid != ipn.Exit {
+		if redirect, err = h.bypass.verdict(uid, dnsx.NetTypeTCP, target); err != nil {
+			log.I("tcp: gconn %s dns bypass blocked from %s -> %s for %s", cid, src, target, uid)
+			s.trace.Event("flow-block", "tcp %s: dns bypass blocked", cid)
+			gconn.Connect(rst) // fin
+			return deny
+		}
+	}
+
+	// alg ips that lead nowhere are not dialed, lest the flow time out
+	if stale {
+		if err = h.resolver.ReclaimAlg(target.Addr()); err != nil {
+			log.I("tcp: gconn %s stale alg ip %s -> %s for %s", cid, src, target, uid)
+			s.trace.Event("flow-block", "tcp %s: stale alg ip %s", cid, target)
+			gconn.Connect(rst) // fin
+			return deny
+		}
+		realips, _, _, _, _ = undoAlg(h.resolver, target.Addr())
+	}
+
+	var px ipn.Proxy
+	if px, err = h.prox.ProxyFor(pid); err != nil {
+		s.trace.Event("flow-proxy", "tcp %s: no proxy %s: %v", cid, pid, err)
+		gconn.Connect(rst) // fin
+		return deny
+	}
+	px = ipn.WithFault(px) // as-is, unless a fault is in effect on it
+	if s.trace != nil {
+		s.trace.Event("flow-proxy", "tcp %s: proxy %s (mtu %d)", cid, px.ID(), mtuOf(px))
+	}
+
+	// segments of flows over proxies with smaller mtus (ex: wireguard) are
+	// clamped to fit, as the mss is only ever advertised in the syn-ack
+	gconn.ClampMSS(mtuOf(px))
+
 	// handshake; since we assume a duplex-stream from here on
 	if open, err = gconn.Connect(ack); !open {
-		err = fmt.Errorf("tcp: %s connect err %v; %s -> %s for %s", cid, err, src, target, uid)
+		err = fmt.Errorf("tcp: %s connect err %w; %s -> %s for %s", cid, err, src, target, uid)
 		log.E("%v", err)
 		return deny // == !open
 	}
 
-	var px ipn.Proxy
-	if px, err = h.prox.ProxyFor(pid); err != nil {
-		return deny
+	// plain dns, to the tunnel's resolver or not, of flows assigned to a
+	// proxy is served by the tunnel's resolver over that proxy, if so set
+	if h.pxdns.serves(uid, pid, target) {
+		log.I("tcp: gconn %s dns from %s -> %s served over %s for %s", cid, src, target, pid, uid)
+		h.resolver.ServeFor(dnsx.NetTypeTCP, gconn, pid, uid)
+		s.done(errProxyDNS)
+		go sendNotif(h.listener, s)
+		return allow
 	}
 
 	if pid != ipn.Exit { // see udp.go Connect
-		if dnsOverride(h.resolver, dnsx.NetTypeTCP, gconn, target) {
-			// SocketSummary not sent; x.DNSSummary supercedes it
+		if ok, diverted := dnsOverride(h.resolver, dnsx.NetTypeTCP, gconn, target, redirect, uid); ok {
+			if redirect { // SocketSummary marks the redirected flow
+				s.done(errDNSBypassRedirect)
+				go sendNotif(h.listener, s)
+			} else if diverted { // as also the one trapped by DNSModePort
+				s.done(errDNSDiverted)
+				go sendNotif(h.listener, s)
+			} // else: SocketSummary not sent; x.DNSSummary supercedes it
 			return allow
 		} // else not a dns request
 	} // if ipn.Exit then let it connect as-is (aka exit)
 
-	// pick all realips to connect to
-	for i, dstipp := range makeIPPorts(realips, target, 0) {
-		if err = h.handle(px, gconn, dstipp, s); err == nil {
+	// destinations whose realips all failed to dial of late are not redialed
+	breakk := breakerkey(domains, target.Addr())
+	if !h.breaker.allow(breakk) {
+		log.I("tcp: gconn %s circuit open for %s -> %s (%s) for %s", cid, src, target, breakk, uid)
+		err = errCircuitOpen
+		s.trace.Event("flow-block", "tcp %s: circuit open for %s", cid, breakk)
+		return deny
+	}
+	defer func() { h.breaker.done(breakk, err) }()
+	defer func() { h.retries.done(retryk, pid, err) }()
+
+	// pick all realips to connect to; the one last dialed ok first, if any
+	stickyk := stickykey(uid, domains)
+	ipps := makeIPPorts(realips, target, 0)
+	if hairpin { // dialed on loopback, lest the flow loop back into the tunnel
+		ipps = []netip.AddrPort{lo}
+	}
+	hit := h.sticky.pick(stickyk, ipps)
+	for i, dstipp := range ipps {
+		dialstart := time.Now()
+		s.Sticky = hit && i == 0 // set before handle, which forwards (and summarizes) in the bg
+		err = h.handle(px, gconn, dstipp, domains, s)
+		if s.trace != nil {
+			s.trace.Event("flow-dial", "tcp %s: #%d %s over %s (sticky? %t) in %s; err? %v", cid, i, dstipp, px.ID(), hit && i == 0, time.Since(dialstart), err)
+		}
+		if err == nil {
+			h.sticky.ok(stickyk, dstipp.Addr())
 			return allow
 		} // else try the next realip
+		h.sticky.fail(stickyk, dstipp.Addr())
+		s.Sticky = false
+		if errors.Is(err, ipn.ErrFirewalled) || errors.Is(err, errEnded) { // other realips are as good
+			break
+		}
 		end := time.Since(s.start)
 		elapsed := int32(end.Seconds() * 1000)
 		log.W("tcp: dial: #%d: %s failed; addr(%s); for uid %s (%d); w err(%v)", i, cid, dstipp, uid, elapsed, err)
@@ -233,12 +437,19 @@ func (h *tcpHandler) Proxy(gconn *netstack.GTCPConn, src, target netip.AddrPort)
 	return deny
 }
 
-func (h *tcpHandler) handle(px ipn.Proxy, src net.Conn, target netip.AddrPort, smm *SocketSummary) (err error) {
+func (h *tcpHandler) handle(px ipn.Proxy, src net.Conn, target netip.AddrPort, domains string, smm *SocketSummary) (err error) {
 	var pc protect.Conn
 
 	start := time.Now()
 	var dst net.Conn
 
+	// ip4 literals are unreachable on ip6-only networks sans 464xlat
+	target4 := ""
+	if ipp6, ok := xlat464(h.resolver, px.ID(), target); ok {
+		target4 = target.Addr().String()
+		target = ipp6
+	}
+
 	// TODO: handle wildcard addrs?
 	// github.com/google/gvisor/blob/5ba35f516b5c2/test/benchmarks/tcp/tcp_proxy.go#L359
 	// ref: stackoverflow.com/questions/63656117
@@ -248,6 +459,7 @@ func (h *tcpHandler) handle(px ipn.Proxy, src net.Conn, target netip.AddrPort, s
 		// pc.RemoteAddr may be that of the proxy, not the actual dst
 		// ex: pc.RemoteAddr is 127.0.0.1 for Orbot
 		smm.Target = target.Addr().String()
+		smm.Target4 = target4
 
 		switch uc := pc.(type) {
 		case *net.TCPConn: // usual
@@ -268,7 +480,10 @@ func (h *tcpHandler) handle(px ipn.Proxy, src net.Conn, target netip.AddrPort, s
 		return err
 	}
 
-	go func() {
+	// observe the server's tls handshake, if so set, for its cert
+	w := h.certs.watch(smm.PID, target.Port(), domains, smm)
+
+	ok := h.td.Go(func() {
 		cm := h.conntracker
 		l := h.listener
 		defer func() {
@@ -276,8 +491,12 @@ func (h *tcpHandler) handle(px ipn.Proxy, src net.Conn, target netip.AddrPort, s
 				log.W("tcp: forward: panic %v", r)
 			}
 		}()
-		forward(src, dst, cm, l, smm) // src always *gonet.TCPConn
-	}()
+		forward(src, dst, cm, l, smm, w, h.fair) // src always *gonet.TCPConn
+	})
+	if !ok {
+		clos(dst)
+		return errEnded
+	}
 
 	log.I("tcp: new conn %s via proxy(%s); src(%s) -> dst(%s) for %s", smm.ID, px.ID(), src.LocalAddr(), target, smm.UID)
 	return nil // handled; takes ownership of src
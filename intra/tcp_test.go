@@ -0,0 +1,92 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// echoTCP echoes conns back till they are closed, and sends on closed
+// once each is; returns its addr.
+func echoTCP(tb testing.TB, closed chan<- struct{}) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTCPEnd(t *testing.T) {
+	const n = 4
+	closed := make(chan struct{}, n)
+	tt := newTestTunnel(ipn.Base)
+	tt.px.to = map[string]string{"tcp": echoTCP(t, closed)}
+	client := tt.up(t, settings.IP4)
+
+	for i := range n {
+		c, err := gonet.DialTCP(client, tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 80}, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		b := []byte{byte(i)}
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatalf("tcp: flow %d not echoed: %v", i, err)
+		}
+	}
+	if r := tt.tcp.td.Running(); r != n {
+		t.Fatalf("tcp: %d flows running; want %d", r, n)
+	}
+
+	if err := tt.tcp.End(); err != nil {
+		t.Fatal(err)
+	}
+	if r := tt.tcp.td.Running(); r != 0 {
+		t.Errorf("tcp: %d flows running after end", r)
+	}
+	if m := tt.px.open(); m != 0 {
+		t.Errorf("tcp: %d upstream conns open after end", m)
+	}
+	for i := range n {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tcp: %d of %d upstream conns seen closed", i, n)
+		}
+	}
+	if m := tt.conns.Len(); m != 0 {
+		t.Errorf("tcp: %d conns tracked after end", m)
+	}
+}
@@ -24,8 +24,10 @@
 package intra
 
 import (
+	"fmt"
 	"runtime/debug"
 
+	"github.com/celzero/firestack/intra/dialers"
 	"github.com/celzero/firestack/intra/settings"
 
 	"github.com/celzero/firestack/intra/log"
@@ -76,3 +78,30 @@ func LogLevel(level int) {
 	log.SetLevel(dlvl)
 	settings.Debug = dbg
 }
+
+// SetSockMark sets SO_MARK (fwmark) of sockets owner who (a proxy id, like
+// ipn.Base or ipn.Exit; or a dns transport id) makes from here on, to have
+// them policy routed; mark 0 unsets it. Needs root (CAP_NET_ADMIN) on Linux
+// (and Android), without which, sockets go unmarked. See: GetProxySockMarks
+func SetSockMark(who string, mark int64) error {
+	return settings.SetSockMark(who, mark)
+}
+
+// SetTLSHello sets how tls dials of dns transport (or proxy) id say hello
+// from here on, as one of "go" (the default), "randomized", "chrome" or
+// "firefox" (the last two need a build with the utls tag); an empty profile
+// unsets it. If fallback is set, handshakes that fail are retried once with
+// "go". See: TLSHelloStatus
+func SetTLSHello(id, profile string, fallback bool) error {
+	if len(profile) > 0 && !dialers.HasHello(profile) {
+		return fmt.Errorf("tls hello: unknown profile %s", profile)
+	}
+	settings.SetTLSHello(id, profile, fallback)
+	return nil
+}
+
+// TLSHelloStatus returns how tls dials of dns transport (or proxy) id say
+// hello, and the profile the last handshake was made with.
+func TLSHelloStatus(id string) string {
+	return dialers.HelloStatus(id)
+}
@@ -26,17 +26,22 @@ package intra
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/dialers"
 	"github.com/celzero/firestack/intra/dnsx"
 	"github.com/celzero/firestack/intra/ipn"
 	"github.com/celzero/firestack/intra/log"
+	"github.com/celzero/firestack/intra/netstat"
 	"github.com/celzero/firestack/intra/rnet"
 	"github.com/celzero/firestack/intra/settings"
 	"github.com/celzero/firestack/intra/x64"
+	"github.com/celzero/firestack/intra/xdns"
 	"github.com/celzero/firestack/tunnel"
 )
 
@@ -51,9 +56,13 @@ type Bridge interface {
 // or a DNS query is completed.
 type Listener interface {
 	SocketListener
+	SocketBatchListener
 	x.DNSListener
 	rnet.ServerListener
 	x.ProxyListener
+	MemoryListener
+	CertListener
+	TraceListener
 }
 
 // Tunnel represents an Intra session.
@@ -69,6 +78,8 @@ type Tunnel interface {
 	internalProxies() (ipn.Proxies, error)
 	// A bridge to the client code.
 	getBridge() Bridge
+	// Remembers how a dns transport was added, for Export.
+	remember(s transportspec)
 	// Sets new default routes for the given engine, where engine is
 	// one of the constants (Ns4, Ns6, Ns46) defined in package settings.
 	SetRoute(engine int) error
@@ -77,8 +88,262 @@ type Tunnel interface {
 	// If len(fpcap) is 0, no PCAP file will be written.
 	// If len(fpcap) is 1, PCAP be written to stdout.
 	SetPcap(fpcap string) error
-	// Set DNSMode, BlockMode, PtMode.
+	// Set DNSMode, BlockMode, PtMode; in effect for new flows. In DNSModeIP,
+	// only dns to the fake dns addrs is answered by the tunnel's resolver; in
+	// DNSModePort, dns (udp and tcp on port 53) to any addr is, save those let
+	// through (see: SetDnsPassthrough), and summaries of such flows to addrs
+	// other than the fake dns addrs are sent with ErrDNSDiverted as the code.
 	SetTunMode(dnsmode, blockmode, ptmode int)
+	// Lets dns to ips or cidrs in csv (ex: "192.168.1.1,fd00::/8") through
+	// as-is in DNSModePort, as for a router's resolver that captive portals
+	// rely on; an empty csv (the default) lets none through.
+	SetDnsPassthrough(csv string) error
+	// Rebuilds the resolver (its transports, gateway, and caches) with fake
+	// dns addrs fakedns (csv ip:ports), or the current ones, if empty; ex: for
+	// changes to the fake dns prefix or to DNSMode. The current resolver answers
+	// queries until the new one is built and warmed up, and is then swapped for
+	// it in place; flows, handlers, and settings of the resolver are left as-is.
+	// Returns once swapped, or on error, in which case nothing changes.
+	RestartResolver(fakedns string) error
+	// Sets the memory budget (in bytes) for conn tracking structures;
+	// idle flows, alg entries, and dns caches are shed when over budget.
+	// A budget of 0 (the default) disables enforcement.
+	SetMemoryBudget(bytes int64)
+	// Get the estimated memory footprint of conn tracking structures.
+	MemoryEstimate() *MemorySummary
+	// Holds socket summaries back, and delivers them in batches of up to size
+	// (max 10000) to SocketBatchListener.OnSocketsClosed instead of one by one to
+	// SocketListener.OnSocketClosed; a batch is delivered when full, or millis
+	// (30s, if not positive) after its first summary, or on FlushSummaries, or
+	// on Disconnect. A size of 0 (the default) turns batching off.
+	SetSummaryBatching(size, millis int)
+	// Delivers socket summaries held back, if any, as a batch right away;
+	// ex: when the UI opens. Returns the number of summaries delivered.
+	FlushSummaries() int
+	// Audits all tracked flows right away for leaks (flows that are closed
+	// or dead, yet tracked), reaps them with an "audited-leak" summary, and
+	// returns how many were reaped. Flows are also audited periodically.
+	AuditConns() int
+	// Get the total number of leaked flows reaped by audits.
+	AuditedLeaks() int64
+	// Closes tcp flows whose peers vanished without a fin or rst (ex: wifi ap
+	// rebooted), as told by retransmits that climb with data unacked, or probes
+	// of zero windows, of either end, that persist for secs; such flows are sent
+	// a "peer-dead" summary. Flows are checked in turns, a few every 15s. A secs
+	// of 0 (the default) turns the check off.
+	SetPeerDeadCheck(secs int)
+	// Releases a flow held by a "Defer" verdict from Flow to proxy pid,
+	// or blocks it if pid is "Block".
+	ResolveFlow(cid, pid string) error
+	// Sets how long flows are held for (in secs) on a "Defer" verdict,
+	// and the pid they are released to if not resolved in time.
+	SetFlowDeferral(timeoutsecs int, fallbackpid string)
+	// Get a csv of cids of flows held by a "Defer" verdict. Held flows are
+	// also tracked along with active flows, and are blocked, if closed.
+	ParkedFlows() string
+	// Closes all flows of uid, blocks its deferred flows, and drops its
+	// firewall stalls; ex: when the app is uninstalled or force-stopped.
+	// Flows admitted before but tracked after the purge are closed, too.
+	PurgeUid(uid string) *PurgeSummary
+	// Replaces known public resolvers with csv of ips, cidrs, or ip:ports
+	// (ips and cidrs match ports 53, 443, 853); flows to them are tagged
+	// "dnsbypass" in Flow's meta. An empty csv restores the built-in list.
+	SetDNSBypassList(csv string) error
+	// Sets policy (DNSBypassAllow, DNSBypassBlock, DNSBypassRedirect) for
+	// flows of uid to known public resolvers; or for all uids sans a policy
+	// of their own, if uid is empty.
+	SetDNSBypassPolicy(uid string, policy int)
+	// Sets csv of ips as the device's own (ex: its public ip, which self-hosted
+	// apps advertise), besides those of the tun; flows to the device's own ips
+	// are tagged "hairpin" in Flow's meta, and unless blocked (or deferred), are
+	// dialed on loopback (127.0.0.1 or ::1, on the same port) over Base, whatever
+	// the verdict, instead of out to the network; see: SocketSummary.Hairpin.
+	// An empty csv unsets them; ips configured on the tun interface are always
+	// the device's own, if they can be had (see: SetLinkAndRoutes).
+	SetOwnAddrs(ipcsv string) error
+	// Serves plain dns (port 53) flows assigned to a proxy, whatever their
+	// dst, with the tunnel's resolver over that proxy (by its own dns, see:
+	// AddProxyDNS, if any) instead of relaying them as-is, if on. Off by
+	// default.
+	SetProxyDNS(on bool)
+	// Relays plain dns flows of uid as-is, even if SetProxyDNS is on; ex:
+	// for apps that must reach a particular server on port 53.
+	SetProxyDNSOptOut(uid string, optout bool)
+	// Bounds how old (in millis) the snapshot of /proc/net/* that uids of
+	// flows are looked up from may be, in BlockModeFilterProc; or resets it
+	// to the default (2s), if not positive.
+	SetProcNetStaleness(millis int)
+	// Fails new flows to a destination (its domain; or, sans domains, the /24
+	// or /64 its ip is in) right away for cooldownsecs, with a "circuit-open"
+	// summary, once dials to all its ips fail fails times within windowsecs,
+	// over any proxy; after which, a flow is let through as a probe, and if it
+	// dials ok, flows are dialed as usual again. Blocked flows do not count.
+	// A fails of 0 (the default) turns the breaker off.
+	SetCircuitBreaker(fails, windowsecs, cooldownsecs int)
+	// Get "destination=state:fails" (state is one of closed, open, half-open)
+	// of destinations the breaker tracks, one per line.
+	CircuitBreakers() string
+	// Remembers, for windowsecs, proxies over which flows of an app to a destination
+	// (its domain; or, sans domains, its ip) failed to dial; retries of those flows
+	// are told to Flow in meta as "failed:<pid>", and in SocketSummary.Retry. Blocked
+	// flows do not count. A windowsecs of 0 turns it off; it is 30s by default.
+	SetFlowRetry(windowsecs int)
+	// Sets proxies (csv), in order, to send flows meant for pid over instead, if pid
+	// failed for those flows' app and destination within the retry window; those that
+	// failed too, or are missing, are skipped. Applies to verdicts of Flow and of domain
+	// routes alike; summaries of such flows have SocketSummary.Alternate set. An empty
+	// csv unsets. Errs if pid or any of csv is Block or Defer, or if csv has pid.
+	SetRetryProxies(pid, csv string) error
+	// Schedules uploads of flows (tcp, udp) in favor of interactive flows over bulk
+	// ones, while the link is saturated (as told by writes of many flows that block), with
+	// deficit round robin; flows are bulk if their uid is set so (see: SetBulkUid),
+	// or once they upload a lot in large writes. No-op while the link is not
+	// saturated. Off by default.
+	SetFairScheduler(on bool)
+	// Sets flows of uid to be bulk, if bulk, for the fair scheduler; or to be
+	// classified as usual, if not. See: SetFairScheduler.
+	SetBulkUid(uid string, bulk bool)
+	// Get "on=bool;saturated=bool;saturations=n;interactive=bytes;bulk=bytes" of
+	// the fair scheduler; bytes are of uploads, while on, since the tunnel began.
+	FairScheduler() string
+	// Observes the server's side of tls handshakes of flows to port 443 that
+	// are not sent over proxies (Base, Exit), and reports the version and leaf
+	// cert (TLS 1.2 and older) seen in SocketSummary, if on. Off by default.
+	SetCertObservation(on bool)
+	// Pins domain to csv of base64 sha256 hashes of SubjectPublicKeyInfo;
+	// flows to domain whose observed leaf cert matches none of them are
+	// reported to CertListener.OnCertPinMismatch as soon as seen. Pins are
+	// checked only if SetCertObservation is on. An empty csv unpins domain.
+	SetCertPins(domain, csv string) error
+	// Sets ports (csv) whose first segments are always split (allow), or never
+	// (deny), to evade dpi, whatever they look like; ports in both are denied.
+	// First segments to all other ports are split only if they look like a tls
+	// ClientHello. Applies to flows not sent over proxies (Base, Exit).
+	SetSplitPorts(allowcsv, denycsv string) error
+	// Caps ips in DNSSummary.RData to the first ips (16, by default), followed by
+	// "+k more" for the k left out; and csvs of blocklists, domains, and ips in
+	// summaries and flows to csvlen bytes (1024, by default), keeping as many
+	// leading values as fit, followed by "+k more". Not positive resets to default.
+	SetSummaryCaps(ips, csvlen int)
+	// Captures the first bytes apps of uid send on flows that are blocked, if
+	// on, and reports them in SocketSummary, along with the protocol (tls, http,
+	// quic) and host (tls sni, http host) they look like; credentials in plaintext
+	// http are redacted. Blocked tcp flows are then not reset right away, but
+	// let through the handshake and closed after the first read (or 3s). Off by
+	// default for all uids.
+	SetBlockCapture(uid string, on bool)
+	// Sets the bytes captured per blocked flow; or resets it to the default (128),
+	// if not positive. Capped at 1024.
+	SetBlockCaptureLen(n int)
+	// Restricts background flows on metered networks, as data saver does, if
+	// metered: tcp and udp flows of apps that are neither exempt (see:
+	// SetMeteredExempt) nor in the foreground (see: SetForegroundUids) are
+	// blocked, with ErrMetered as the summary's code. Flows of the system
+	// (appid < 10000) and of unknown uids are spared; icmp is not restricted.
+	// If closeExisting, tracked flows of restricted uids are closed right away;
+	// returns the number closed. Off by default.
+	SetMetered(metered, closeExisting bool) int
+	// Sets uids (csv) never restricted by SetMetered; errs on any that is not
+	// a number, leaving the prior set as is.
+	SetMeteredExempt(uidcsv string) error
+	// Sets uids (csv) currently in the foreground, replacing the prior set;
+	// cheap enough to call on every change.
+	SetForegroundUids(uidcsv string) error
+	// Waits up to ms for SocketListener.Flow to answer; flows it does not answer
+	// in time (or answers nil for, or when the listener is gone) get a verdict as
+	// per policy: FlowFailOpen (Base; the default), FlowFailClosed (Block, with
+	// ErrListenerTimeout as the summary's code), or FlowFailLastKnown (the verdict
+	// last given for the same uid and domains, or dst; else Base). Summaries of
+	// such flows have Failsafe set, and ids prefixed "failsafe:". An ms of 0 (the default) or less waits for as
+	// long as Flow takes. Errs on unknown policies. For dns queries, see:
+	// backend.DNSFailsafe.
+	SetFlowTimeout(ms, policy int) error
+	// Lets flows whose upstream sockets are of a family the link no longer
+	// routes (ex: v6 flows, once SetRoute goes from dual-stack to v4-only) drain
+	// till they end on their own, if drain; else (the default), they are closed
+	// as soon as the route changes, with ErrRouteChanged as the summary's code.
+	// Flows over proxies are left be, unless the proxy itself is dialed over
+	// the family; realips, answers, and such are forgotten either way.
+	SetRouteChangeDrain(drain bool)
+	// Bounds buffers flows copy over to [minkb, maxkb] KiB (rounded down to
+	// 2, 4, 8, 16, 32, or 64), which start at minkb, grow toward maxkb as a
+	// flow keeps them full, and shrink (or are given back) as it idles; not
+	// positive resets to the default (4, 64). Low-ram devices may lower maxkb.
+	SetCopyBufs(minkb, maxkb int)
+	// Serves metrics (flows by proxy and uid, dns queries and latencies by
+	// transport, reuse of conns of encrypted dns transports, flow errors,
+	// tracked conns, tun writes) in the prometheus
+	// text format over http at addr (ip:port) + "/metrics", which must be a
+	// loopback addr unless nonlocal is set; series (ex: of uids) beyond the
+	// first 256 of a metric are counted as one, labelled "other". An empty
+	// addr (the default) stops serving them, and they are then not kept.
+	SetMetricsServer(addr string, nonlocal bool) error
+	// Watches uid for changes in its native state, and delivers them to
+	// UidListener.OnUidEvent (which Bridge must implement) as a one-line json
+	// of UidEvent, in order: flows let through (UidFlowOpen; incl deferred
+	// ones) or blocked (UidVerdictBlock) by Flow's verdict, flows let through
+	// over a proxy other than the one before (UidProxyChange), flows closed
+	// (UidFlowClose; with the code, ex: when closed by a purge or a kill
+	// switch), and per-uid policies set with PurgeUid, SetDNSBypassPolicy,
+	// SetProxyDNSOptOut, SetBlockCapture (UidPolicyChange). Each watch queues up to 64 events, and drops the
+	// oldest if the listener falls behind; UidEvent.Dropped counts those. At
+	// most 4 watches (of any uids) may be on at once; see: UidWatch.Unwatch.
+	WatchUid(uid string) (*UidWatch, error)
+	// Traces every stage of queries and flows that match selector, either
+	// "dom:<domain>" (incl its subdomains) or "uid:<uid>", for secs (capped
+	// at 30m): dns routing (OnQuery, uid's transport, domain routes), blocks,
+	// transport used, alg, verdicts, proxy picked, dial attempts per ip, and
+	// summaries. Events (one-line json, tagged with the returned trace id)
+	// are sent to TraceListener.OnTraceEvent as they happen, and kept in
+	// memory (the first 2048) for TraceEvents. Only one trace runs at a
+	// time; a new one ends the previous, and secs <= 0 ends it.
+	Trace(selector string, secs int) (id string, err error)
+	// Get events (one per line) of trace id, if it is the one in progress,
+	// or the one that ended last.
+	TraceEvents(id string) string
+	// Injects faults into dns transport (kind "dns") or proxy (kind "proxy")
+	// id for ttlsecs (capped at 1h), to test how clients fare when they fail;
+	// profile is json, ex: {"name": "flaky", "errrate": 0.2, "err": "timeout",
+	// "delayms": 500, "jitterms": 1000}: errrate (fraction) and errevery (nth)
+	// of queries or dials fail with err (refused, the default; timeout; reset;
+	// servfail, answered as such by dns transports), all of them are delayed
+	// by delayms plus up to jitterms, truncrate (fraction) of dns answers are
+	// truncated, and conns are reset once resetafter bytes are read. Faults
+	// look like those of the network to the tunnel, and so, summaries report
+	// them as such. A new profile for the same id replaces its prior one.
+	InjectFault(kind, id, profile string, ttlsecs int) error
+	// Clears all faults.
+	ClearFaults()
+	// Get "kind:id=name;hits=n/m;ttl=d" of faults in effect, one per line.
+	Faults() string
+	// Export serializes dns transports (as added), proxies, kill switches,
+	// the rdns blockstamp, dns bypass and proxy dns rules, and flow deferral
+	// policy into a versioned blob. Proxy configs and DoH headers (which may
+	// have secrets) are included if withSecrets is set, or else proxies are
+	// referenced by their ids, and headers are left out.
+	Export(withSecrets bool) ([]byte, error)
+	// Restore applies blob from Export all at once, after validating it and
+	// creating everything it has; if any entry fails, the error names each
+	// failed entry, and the current config is left as-is.
+	Restore(blob []byte) error
+	// Opens a config, and returns its token; from here on, till it is
+	// committed or aborted, SetTunMode, SetRoute, dns transports added (see:
+	// dns.go) or removed (see: DNSResolver), and proxies added or removed
+	// (see: Proxies) are staged, and are not applied; all other settings are
+	// applied as usual. Only one config may be open at a time.
+	BeginConfig() (token int64, err error)
+	// Applies changes staged in config token at once, or none of them: tun
+	// mode, routes, proxies, and then dns transports; only the last change
+	// staged for the same proxy or transport (by id) is applied. Changes
+	// staged and then undone are never applied. Increments ConfigVersion on
+	// success; on error, changes applied thus far are rolled back, the rest
+	// are discarded, and ConfigVersion is left as-is.
+	CommitConfig(token int64) error
+	// Discards changes staged in config token.
+	AbortConfig(token int64) error
+	// Get the version of the live config; 0 at start, and incremented on
+	// every CommitConfig that succeeds.
+	ConfigVersion() int64
 }
 
 type rtunnel struct {
@@ -88,6 +353,32 @@ type rtunnel struct {
 	proxies  ipn.Proxies
 	resolver dnsx.Resolver
 	services rnet.Services
+	memgov   *memgov
+	audit    *auditor
+	batch    *batcher
+	peers    *peerdead
+	hold     *parking
+	bypass   *dnsbypass
+	hairpin  *hairpin
+	pxdns    *proxydns
+	breaker  *breaker
+	retries  *retries
+	fair     *core.Fair
+	certs    *certobs
+	capture  *capture
+	metered  *metered
+	procs    *netstat.ProcNet
+	metrics  *metricsrv
+	watch    *uidwatches
+	failsafe *failsafe
+	reroute  *reroute
+	specs    *tunspecs    // how dns transports were added
+	cfg      *txconfig    // staged since BeginConfig
+	tcp      tracker      // may be nil
+	udp      tracker      // may be nil
+	icmp     flowtracker  // may be nil
+	unlink   func()       // stops observing link changes
+	l3       atomic.Value // string; settings.IP4, IP6, or IP46 of the link
 	closed   atomic.Bool
 	once     sync.Once
 }
@@ -99,10 +390,9 @@ func NewTunnel(fd, mtu int, fakedns string, tunmode *settings.TunMode, dtr Defau
 
 	natpt := x64.NewNatPt(tunmode)
 	proxies := ipn.NewProxifier(bdg, bdg)
-	services := rnet.NewServices(proxies, bdg, bdg)
 
-	if proxies == nil || services == nil {
-		return nil, fmt.Errorf("tun: no proxies? %t or services? %t", proxies == nil, services == nil)
+	if proxies == nil {
+		return nil, fmt.Errorf("tun: no proxies")
 	}
 
 	if err := dtr.kickstart(proxies, bdg); err != nil {
@@ -110,17 +400,42 @@ func NewTunnel(fd, mtu int, fakedns string, tunmode *settings.TunMode, dtr Defau
 		return nil, err
 	}
 
-	resolver := dnsx.NewResolver(fakedns, tunmode, dtr, bdg, natpt)
+	batch := newBatcher(bdg) // socket summaries go through batch
+	meter := newMeter(batch) // and summaries of flows and queries through meter
+	resolver := dnsx.NewRestartableResolver(fakedns, tunmode, dtr, meter, natpt)
 	resolver.Add(newGoosTransport(bdg, proxies))     // os-resolver; fixed
 	resolver.Add(newBlockAllTransport())             // fixed
 	resolver.Add(newDNSCryptTransport(proxies, bdg)) // fixed
 	resolver.Add(newMDNSTransport(settings.IP46))    // fixed
+	resolver.SetDesignatedMaker(newDesignatedMaker(proxies, bdg))
+
+	services := rnet.NewServices(proxies, resolver, bdg, bdg)
+	if services == nil {
+		return nil, fmt.Errorf("tun: no services")
+	}
 
 	addIPMapper(resolver, settings.IP46) // namespace aware os-resolver for pkg dialers
 
-	tcph := NewTCPHandler(resolver, proxies, tunmode, bdg, bdg)
-	udph := NewUDPHandler(resolver, proxies, tunmode, bdg, bdg)
-	icmph := NewICMPHandler(resolver, proxies, tunmode, bdg)
+	hold := newParking()
+	bypass := newDNSBypass()
+	hairpin := newHairpin()
+	pxdns := newPxDNS()
+	sticky := newSticky()
+	breaker := newBreaker()
+	retries := newRetries()
+	fair := core.NewFair()
+	certs := newCertObs(bdg)
+	capture := newCapture()
+	metered := newMetered()
+	procs := netstat.NewProcNet(netstat.DefaultStaleness)
+	failsafe := newFailsafe(meter) // and verdicts of flows through failsafe
+	uidl, _ := bdg.(UidListener)
+	watch := newUidWatches(failsafe, uidl) // and flows of watched uids through watch
+	conns := core.NewConnMap()             // flows of all handlers, each in its own view
+	tcph := NewTCPHandler(resolver, proxies, tunmode, hold, bypass, hairpin, pxdns, sticky, breaker, retries, fair, certs, capture, metered, procs, conns, bdg, watch)
+	udph := NewUDPHandler(resolver, proxies, tunmode, hold, bypass, hairpin, pxdns, sticky, breaker, retries, fair, capture, metered, procs, conns, bdg, watch)
+	icmph := NewICMPHandler(resolver, proxies, tunmode, procs, conns, watch)
+	reroute := newReroute(conns)
 
 	gt, err := tunnel.NewGTunnel(fd, mtu, tcph, udph, icmph)
 
@@ -136,12 +451,59 @@ func NewTunnel(fd, mtu int, fakedns string, tunmode *settings.TunMode, dtr Defau
 		proxies:  proxies,
 		resolver: resolver,
 		services: services,
+		memgov:   newMemGov(resolver, bdg, tcph, udph, icmph),
+		audit:    newAuditor(meter, tcph, udph),
+		batch:    batch,
+		peers:    newPeerDead(tcph),
+		hold:     hold,
+		bypass:   bypass,
+		hairpin:  hairpin,
+		pxdns:    pxdns,
+		breaker:  breaker,
+		retries:  retries,
+		fair:     fair,
+		certs:    certs,
+		capture:  capture,
+		metered:  metered,
+		procs:    procs,
+		specs:    newTunSpecs(),
+		cfg:      newTxConfig(),
+		metrics:  newMetricsServer(meter.metrics, bdg),
+		watch:    watch,
+		failsafe: failsafe,
+		reroute:  reroute,
 	}
+	t.tcp, _ = tcph.(tracker)
+	t.udp, _ = udph.(tracker)
+	t.icmp, _ = icmph.(flowtracker)
+	t.l3.Store(settings.IP46)
+	meter.metrics.Collect(t.collect)
+	// conclusions drawn on the current link are dropped when it is swapped
+	// and flows of families it no longer routes are closed (or left to drain)
+	t.unlink = observeLink(resolver, natpt, sticky, breaker, retries, udph, reroute)
+	t.setTunAddrs(fd)
 
 	log.I("tun: <<< new >>>; ok")
 	return t, nil
 }
 
+// observeLink adds those of xs that are core.LinkObserver(s) as observers
+// of link changes; the returned func removes them all.
+func observeLink(xs ...any) (cancel func()) {
+	var cancels []func()
+	for _, x := range xs {
+		if o, ok := x.(core.LinkObserver); ok {
+			cancels = append(cancels, core.ObserveLink(o))
+		}
+	}
+	log.D("tun: link observers: %d", len(cancels))
+	return func() {
+		for _, c := range cancels {
+			c()
+		}
+	}
+}
+
 func (t *rtunnel) getBridge() Bridge {
 	return t.bridge // may return nil, esp after Disconnect()
 }
@@ -152,9 +514,20 @@ func (t *rtunnel) Disconnect() {
 		return
 	}
 	t.once.Do(func() {
+		t.discardConfig() // staged, if any
 		t.closed.Store(true)
 
 		removeIPMapper()
+		t.unlink()
+		t.memgov.stop()
+		t.metrics.stop()
+		t.watch.stop()
+		core.StopTrace()
+		core.ClearFaults()
+		t.audit.stop()
+		t.peers.stop()
+		t.batch.set(0, 0) // delivers held back summaries
+		t.procs.Stop()
 		err0 := t.resolver.Stop()
 		err1 := t.proxies.StopProxies()
 		n := t.services.StopServers()
@@ -170,8 +543,24 @@ func (t *rtunnel) SetRoute(engine int) error {
 		log.W("tun: <<< set route >>>; already closed")
 		return errClosed
 	}
+	if t.cfg.stage(func() { t.cfg.engine = &engine }) {
+		return nil
+	}
+	return t.setRoute(engine)
+}
 
-	return t.Tunnel.SetRoute(engine)
+func (t *rtunnel) setRoute(engine int) error {
+	l3 := settings.L3(engine)
+	if err := t.Tunnel.SetRoute(engine); err != nil {
+		return err
+	}
+	if prev := t.l3.Swap(l3); prev != l3 {
+		// dialers, the resolver, natpt, flow caches, and flows of families
+		// no longer routed observe the change in families; see: observeLink
+		n := core.LinkChanged(core.Link{L3: l3})
+		log.I("tun: <<< set route >>>; %s => %s; observers %d", prev, l3, n)
+	}
+	return nil
 }
 
 func (t *rtunnel) SetLinkAndRoutes(fd, mtu, engine int) error {
@@ -181,13 +570,34 @@ func (t *rtunnel) SetLinkAndRoutes(fd, mtu, engine int) error {
 	}
 
 	l3 := settings.L3(engine)
-	dialers.IPProtos(l3)
+	t.l3.Store(l3)
 	t.resolver.Add(newMDNSTransport(l3))
-	return t.Tunnel.SetLink(fd, mtu) // route is always dual-stack
+	// dialers, the resolver, natpt, and flow caches observe the link change;
+	// see: observeLink and core.LinkObserver
+	if err := t.Tunnel.SetLinkAndRoutes(fd, mtu, engine); err != nil { // route is always dual-stack
+		return err
+	}
+	t.setTunAddrs(fd)
+	return nil
+}
+
+// setTunAddrs has flows to addresses of the tun at fd be hairpinned; these
+// are unset if they can't be had (ex: netlink is off limits to the app), but
+// may be set with SetOwnAddrs, instead.
+func (t *rtunnel) setTunAddrs(fd int) {
+	addrs, err := tunAddrs(fd)
+	if err != nil {
+		log.W("tun: addrs of tun(%d) unknown; err? %v", fd, err)
+	}
+	t.hairpin.setTun(addrs)
 }
 
 func (t *rtunnel) GetResolver() (x.DNSResolver, error) {
-	return t.internalResolver()
+	r, err := t.internalResolver()
+	if err != nil {
+		return nil, err
+	}
+	return specResolver{r, t.specs}, nil
 }
 
 func (t *rtunnel) internalResolver() (dnsx.Resolver, error) {
@@ -226,5 +636,229 @@ func (t *rtunnel) GetServices() (rnet.Services, error) {
 }
 
 func (t *rtunnel) SetTunMode(dnsmode, blockmode, ptmode int) {
+	if t.cfg.stage(func() { t.cfg.mode = &[3]int{dnsmode, blockmode, ptmode} }) {
+		return
+	}
 	t.tunmode.SetMode(dnsmode, blockmode, ptmode)
 }
+
+func (t *rtunnel) SetDnsPassthrough(csv string) error {
+	return t.resolver.SetDnsPassthrough(csv)
+}
+
+func (t *rtunnel) SetMemoryBudget(bytes int64) {
+	t.memgov.setBudget(bytes)
+}
+
+func (t *rtunnel) MemoryEstimate() *MemorySummary {
+	return t.memgov.estimate()
+}
+
+func (t *rtunnel) SetSummaryBatching(size, millis int) {
+	t.batch.set(size, millis)
+}
+
+func (t *rtunnel) FlushSummaries() int {
+	return t.batch.flush()
+}
+
+func (t *rtunnel) AuditConns() int {
+	return t.audit.sweep()
+}
+
+func (t *rtunnel) AuditedLeaks() int64 {
+	return t.audit.reaped.Load()
+}
+
+func (t *rtunnel) SetPeerDeadCheck(secs int) {
+	t.peers.set(time.Duration(secs) * time.Second)
+}
+
+func (t *rtunnel) SetCircuitBreaker(fails, windowsecs, cooldownsecs int) {
+	t.breaker.set(fails, time.Duration(windowsecs)*time.Second, time.Duration(cooldownsecs)*time.Second)
+}
+
+func (t *rtunnel) CircuitBreakers() string {
+	return t.breaker.list()
+}
+
+func (t *rtunnel) SetFlowRetry(windowsecs int) {
+	t.retries.set(time.Duration(windowsecs) * time.Second)
+}
+
+func (t *rtunnel) SetRetryProxies(pid, csv string) error {
+	return t.retries.setAlternates(pid, csv)
+}
+
+func (t *rtunnel) SetFairScheduler(on bool) {
+	t.fair.Set(on)
+	log.I("tun: fair scheduler? %t", on)
+}
+
+func (t *rtunnel) SetBulkUid(uid string, bulk bool) {
+	t.fair.Hint(uid, bulk)
+}
+
+func (t *rtunnel) FairScheduler() string {
+	return t.fair.String()
+}
+
+func (t *rtunnel) ResolveFlow(cid, pid string) error {
+	return t.hold.resolve(cid, pid)
+}
+
+func (t *rtunnel) SetFlowDeferral(timeoutsecs int, fallbackpid string) {
+	t.hold.setPolicy(time.Duration(timeoutsecs)*time.Second, fallbackpid)
+}
+
+func (t *rtunnel) ParkedFlows() string {
+	return t.hold.list()
+}
+
+func (t *rtunnel) PurgeUid(uid string) *PurgeSummary {
+	t.watch.policy(uid, "PurgeUid", "")
+	return purge(uid, t.hold, t.tcp, t.udp, t.icmp)
+}
+
+func (t *rtunnel) SetDNSBypassList(csv string) error {
+	return t.bypass.setList(csv)
+}
+
+func (t *rtunnel) SetOwnAddrs(ipcsv string) error {
+	return t.hairpin.setMine(ipcsv)
+}
+
+func (t *rtunnel) SetDNSBypassPolicy(uid string, policy int) {
+	t.bypass.setPolicy(uid, policy)
+	t.watch.policy(uid, "SetDNSBypassPolicy", strconv.Itoa(policy))
+}
+
+func (t *rtunnel) SetProxyDNS(on bool) {
+	t.pxdns.set(on)
+}
+
+func (t *rtunnel) SetProxyDNSOptOut(uid string, optout bool) {
+	t.pxdns.setOptOut(uid, optout)
+	t.watch.policy(uid, "SetProxyDNSOptOut", strconv.FormatBool(optout))
+}
+
+func (t *rtunnel) SetProcNetStaleness(millis int) {
+	t.procs.SetStaleness(time.Duration(millis) * time.Millisecond)
+}
+
+func (t *rtunnel) SetCertObservation(on bool) {
+	t.certs.set(on)
+}
+
+func (t *rtunnel) SetCertPins(domain, csv string) error {
+	return t.certs.setPins(domain, csv)
+}
+
+func (t *rtunnel) SetSplitPorts(allowcsv, denycsv string) error {
+	return dialers.SplitPorts(allowcsv, denycsv)
+}
+
+func (t *rtunnel) SetSummaryCaps(ips, csvlen int) {
+	xdns.SetSummaryCaps(ips, csvlen)
+}
+
+func (t *rtunnel) SetBlockCapture(uid string, on bool) {
+	t.capture.set(uid, on)
+	t.watch.policy(uid, "SetBlockCapture", strconv.FormatBool(on))
+}
+
+func (t *rtunnel) SetBlockCaptureLen(n int) {
+	t.capture.setLen(n)
+}
+
+func (t *rtunnel) SetMetered(metered, closeExisting bool) (n int) {
+	t.metered.set(metered)
+	if !metered || !closeExisting {
+		return 0
+	}
+	for _, tr := range []tracker{t.tcp, t.udp} {
+		if tr != nil {
+			n += len(tr.conns().ReapUids(errMetered, t.metered.restrictsUid))
+		}
+	}
+	log.I("tun: metered; closed %d flows", n)
+	return n
+}
+
+func (t *rtunnel) SetFlowTimeout(ms, policy int) error {
+	return t.failsafe.set(time.Duration(ms)*time.Millisecond, policy)
+}
+
+func (t *rtunnel) SetRouteChangeDrain(drain bool) {
+	t.reroute.set(drain)
+}
+
+func (t *rtunnel) SetCopyBufs(minkb, maxkb int) {
+	core.SetCopyBufs(minkb*1024, maxkb*1024)
+	lo, hi := core.CopyBufs()
+	log.I("tun: copy bufs: [%d, %d]", lo, hi)
+}
+
+func (t *rtunnel) SetMeteredExempt(uidcsv string) error {
+	return t.metered.setExempt(uidcsv)
+}
+
+func (t *rtunnel) SetForegroundUids(uidcsv string) error {
+	return t.metered.setForeground(uidcsv)
+}
+
+func (t *rtunnel) WatchUid(uid string) (*UidWatch, error) {
+	if t.closed.Load() {
+		return nil, errClosed
+	}
+	return t.watch.watch(uid)
+}
+
+func (t *rtunnel) Trace(selector string, secs int) (string, error) {
+	if t.closed.Load() {
+		return "", errClosed
+	}
+	if secs <= 0 {
+		core.StopTrace()
+		return "", nil
+	}
+	bdg := t.getBridge()
+	tr, err := core.StartTrace(selector, time.Duration(secs)*time.Second, func(id, ev string) {
+		if bdg != nil {
+			bdg.OnTraceEvent(id, ev)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	log.I("tun: trace %s: %s for %ds", tr.ID, selector, secs)
+	return tr.ID, nil
+}
+
+func (t *rtunnel) TraceEvents(id string) string {
+	return core.LastTrace(id).Events()
+}
+
+func (t *rtunnel) InjectFault(kind, id, profile string, ttlsecs int) error {
+	if t.closed.Load() {
+		return errClosed
+	}
+	if err := core.InjectFault(kind, id, profile, time.Duration(ttlsecs)*time.Second); err != nil {
+		return err
+	}
+	log.W("tun: fault: %s:%s for %ds; %s", kind, id, ttlsecs, profile)
+	return nil
+}
+
+func (t *rtunnel) ClearFaults() {
+	core.ClearFaults()
+	log.I("tun: fault: cleared")
+}
+
+func (t *rtunnel) Faults() string {
+	return core.FaultsStatus()
+}
+
+func (t *rtunnel) SetMetricsServer(addr string, nonlocal bool) error {
+	return t.metrics.listen(addr, nonlocal)
+}
@@ -30,6 +30,8 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/celzero/firestack/intra/dnsx"
@@ -50,13 +52,31 @@ type udpHandler struct {
 	listener    SocketListener
 	prox        ipn.Proxies
 	fwtracker   *core.ExpMap
-	status      int
+	hold        *parking         // flows with deferred verdicts
+	bypass      *dnsbypass       // flows to known public resolvers
+	hairpin     *hairpin         // flows to the device's own addresses
+	pxdns       *proxydns        // dns flows served over their proxy
+	sticky      *sticky          // realips last dialed per uid and domain
+	breaker     *breaker         // destinations whose dials keep failing
+	retries     *retries         // proxies that failed flows of late, per uid and destination
+	fair        *core.Fair       // schedules uploads of flows, if on
+	eim         *eim             // upstream sockets shared by flows from a src
+	capture     *capture         // first payloads of blocked flows
+	metered     *metered         // background flows blocked on metered networks
+	procs       *netstat.ProcNet // uids of sockets, for BlockModeFilterProc
+	dups        *core.DupFilter  // retransmits of datagrams of blocked flows
+	clock       core.Clock       // for nat timeouts, stalls
+	status      atomic.Int32     // UDPOK or UDPEND
+	td          *core.Teardown   // goroutines of flows; see: End
 }
 
 // rwext wraps net.Conn and extends deadline by
 // udptimeout on read and write.
 type rwext struct {
 	core.UDPConn
+	clock  core.Clock
+	last   atomic.Int64 // unix nano of the last read or write
+	closed atomic.Bool  // see: Alive
 }
 
 const (
@@ -67,6 +87,8 @@ const (
 var (
 	errUdpFirewalled = errors.New("udp: firewalled")
 	errUdpSetupConn  = errors.New("udp: could not create conn")
+	errUdpDeferred   = errors.New("udp: verdict deferred")
+	errUdpNotReady   = errors.New("ns-not-ready")
 )
 
 var (
@@ -75,39 +97,102 @@ var (
 	udptimeout, _ = time.ParseDuration("2m")
 )
 
+// retransmits of the datagram of a blocked flow seen within this long of
+// it (or of a retransmit of it) are dropped; see: udpHandler.proxy
+const dupwindow = 500 * time.Millisecond
+
 var _ netstack.GUDPConnHandler = (*udpHandler)(nil)
 
+func newRwExt(c core.UDPConn, clock core.Clock) *rwext {
+	rw := &rwext{UDPConn: c, clock: clock}
+	rw.last.Store(clock.Now().UnixNano())
+	return rw
+}
+
 func (rw *rwext) Read(b []byte) (n int, err error) {
-	rw.UDPConn.SetDeadline(time.Now().Add(udptimeout))
+	rw.extend()
 	return rw.UDPConn.Read(b)
 }
 
 func (rw *rwext) Write(b []byte) (n int, err error) {
-	rw.UDPConn.SetDeadline(time.Now().Add(udptimeout))
+	rw.extend()
 	return rw.UDPConn.Write(b)
 }
 
+func (rw *rwext) extend() {
+	now := rw.clock.Now()
+	rw.last.Store(now.UnixNano())
+	rw.UDPConn.SetDeadline(now.Add(udptimeout))
+}
+
+// awaitRx implements rxwaiter: it waits, holding no buffer, till remote has
+// a datagram to read; send-only flows (ex: syslog, statsd, telemetry) thus
+// never pin one for as long as they last. Reads (and writes) extend the wait.
+func (rw *rwext) awaitRx() error {
+	rw.extend()
+	_, err := core.AwaitRx(rw.UDPConn)
+	return err
+}
+
+// Unwrap implements core.ConnWrapper
+func (rw *rwext) Unwrap() net.Conn {
+	if c, ok := rw.UDPConn.(net.Conn); ok {
+		return c
+	}
+	return nil
+}
+
+// IdleFor implements core.Idler
+func (rw *rwext) IdleFor() time.Duration {
+	return rw.clock.Since(time.Unix(0, rw.last.Load()))
+}
+
+func (rw *rwext) Close() error {
+	rw.closed.Store(true)
+	return rw.UDPConn.Close()
+}
+
+// Alive implements core.Liveness
+func (rw *rwext) Alive() bool {
+	return !rw.closed.Load()
+}
+
 // NewUDPHandler makes a UDP handler with Intra-style DNS redirection:
 // All packets are routed directly to their destination.
 // `timeout` controls the effective NAT mapping lifetime.
 // `config` is used to bind new external UDP ports.
 // `listener` receives a summary about each UDP binding when it expires.
-func NewUDPHandler(resolver dnsx.Resolver, prox ipn.Proxies, tunMode *settings.TunMode, ctl protect.Controller, listener SocketListener) netstack.GUDPConnHandler {
+func NewUDPHandler(resolver dnsx.Resolver, prox ipn.Proxies, tunMode *settings.TunMode, hold *parking, bypass *dnsbypass, hairpin *hairpin, pxdns *proxydns, sticky *sticky, breaker *breaker, retries *retries, fair *core.Fair, capture *capture, metered *metered, procs *netstat.ProcNet, conns core.ConnMapper, ctl protect.Controller, listener SocketListener) netstack.GUDPConnHandler {
+	clock := core.RealClock
 	h := &udpHandler{
 		resolver:    resolver,
 		tunMode:     tunMode,
 		listener:    listener,
 		prox:        prox,
-		fwtracker:   core.NewExpiringMap(),
-		conntracker: core.NewConnMap(),
-		status:      UDPOK,
+		fwtracker:   core.NewExpiringMapWithClock(clock),
+		conntracker: conns.Proto(ProtoTypeUDP),
+		hold:        hold,
+		bypass:      bypass,
+		hairpin:     hairpin,
+		pxdns:       pxdns,
+		sticky:      sticky,
+		breaker:     breaker,
+		retries:     retries,
+		fair:        fair,
+		eim:         newEim(),
+		capture:     capture,
+		metered:     metered,
+		procs:       procs,
+		dups:        core.NewDupFilter(dupwindow, clock),
+		clock:       clock,
+		td:          core.NewTeardown(),
 	}
 
 	log.I("udp: new handler created")
 	return h
 }
 
-func (h *udpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains, probableDomains, blocklists string) *Mark {
+func (h *udpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains, probableDomains, blocklists, meta string) *Mark {
 	// BlockModeNone returns false, BlockModeSink returns true
 	if h.tunMode.BlockMode == settings.BlockModeSink {
 		return optionsBlock
@@ -129,14 +214,17 @@ func (h *udpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains,
 	// Implict: BlockModeFilter or BlockModeFilterProc
 	uid := -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
-		procEntry := netstat.FindProcNetEntry("udp", localaddr, target)
+		procEntry := h.procs.Find("udp", localaddr, target)
 		if procEntry != nil {
 			uid = procEntry.UserID
 		}
 	}
 
+	// retries of flows that failed of late are decided knowing so
+	meta = h.retries.tag(meta, retrykey(strconv.Itoa(uid), domains, target.Addr()))
+
 	var proto int32 = 17 // udp
-	res := h.listener.Flow(proto, uid, src, dst, realips, domains, probableDomains, blocklists)
+	res := h.listener.Flow(proto, uid, src, dst, realips, domains, probableDomains, blocklists, meta)
 
 	if res == nil {
 		log.W("udp: onFlow: empty res from kt; optbase")
@@ -146,7 +234,12 @@ func (h *udpHandler) onFlow(localaddr, target netip.AddrPort, realips, domains,
 		res.PID = ipn.Base
 	}
 
-	return res
+	return h.metered.verdict(uid, res)
+}
+
+// OnLinkChange implements core.LinkObserver.
+func (h *udpHandler) OnLinkChange(l core.Link) {
+	h.eim.forget()
 }
 
 // ProxyMux implements netstack.GUDPConnHandler
@@ -157,7 +250,7 @@ func (h *udpHandler) ProxyMux(gconn *netstack.GUDPConn, src netip.AddrPort) (ok
 	const ack = false // connect
 	var invalidaddr = netip.AddrPort{}
 
-	if h.status == UDPEND {
+	if h.status.Load() == UDPEND {
 		log.D("udp: connect: end")
 		gconn.Connect(fin) // disconnect, no nat
 		return             // not ok
@@ -167,23 +260,44 @@ func (h *udpHandler) ProxyMux(gconn *netstack.GUDPConn, src netip.AddrPort) (ok
 	// handled / assumed as a new conn (endpoint) by netstack
 	gerr := gconn.Connect(ack)
 
-	l := h.listener
 	local, smm, err := h.Connect(gconn, src, invalidaddr) // local may be nil; smm is never nil
 
-	if err != nil || gerr != nil || local == nil {
+	if err == errUdpDeferred && gerr == nil {
+		// do not hold up netstack; incoming datagrams queue up in gconn
+		res, t := smm.mark(), smm.tuple()
+		if !h.td.Go(func() {
+			local, smm, err := h.connect(gconn, src, invalidaddr, h.hold.wait(res, h.conntracker, t, h.td.Done()))
+			h.mux(gconn, src, local, smm, err)
+		}) {
+			clos(gconn) // ended
+			return      // not ok
+		}
+		return true // ok
+	}
+	return h.mux(gconn, src, local, smm, errors.Join(err, gerr))
+}
+
+func (h *udpHandler) mux(gconn *netstack.GUDPConn, src netip.AddrPort, local core.UDPConn, smm *SocketSummary, err error) (ok bool) {
+	l := h.listener
+	if err != nil || local == nil {
+		if h.linger(smm, func() { h.mux(gconn, src, local, smm, err) }) {
+			return // not ok
+		}
+		refuse(gconn, err)
 		clos(gconn, local)
 		if smm != nil { // smm is never nil; but nilaway complains
 			smm.done(err)
 			go sendNotif(l, smm)
 		} else {
-			log.W("udp: proxy: unexpected %s -> [unconnected]; netstack err: %v; dst err: %v", src, gerr, err)
+			log.W("udp: proxy: unexpected %s -> [unconnected]; err: %v", src, err)
 		}
 		return // not ok
 	}
 	mxr := newMuxer(local)
-	go func() {
+	ok = h.td.Go(func() {
+		defer mxr.stop() // no-op unless h ended
 		for {
-			dxconn, err := mxr.vend()
+			dxconn, err := mxr.vend(h.td.Done())
 			if err != nil {
 				log.I("udp: proxy: %s vend for %s done; err? %v", smm.ID, src, err)
 				break
@@ -191,14 +305,20 @@ func (h *udpHandler) ProxyMux(gconn *netstack.GUDPConn, src netip.AddrPort) (ok
 			if dst, err := ipp(dxconn.RemoteAddr()); err != nil || dst.Addr().IsUnspecified() || !dst.IsValid() {
 				log.W("udp: proxy: %s bad dst ipport %s -> %s; err: %v", smm.ID, src, dst, err)
 				clos(dxconn)
-			} else {
+			} else { // replies from 464xlat-ed dsts are seen as from their ip4; see: xlatconn
 				log.I("udp: proxy: %s mux for %s -> %s", smm.ID, src, dst)
 				h.proxy(dxconn, src, dst)
 			}
 		}
 		log.I("udp: proxy: %s mux for %s done", smm.ID, mxr.stats)
-	}()
-	return true // ok
+	})
+	if !ok {
+		clos(gconn)
+		mxr.stop()
+		smm.done(errEnded)
+		go sendNotif(l, smm)
+	}
+	return ok
 }
 
 // Proxy implements netstack.GUDPConnHandler
@@ -209,12 +329,21 @@ func (h *udpHandler) Proxy(gconn *netstack.GUDPConn, src, dst netip.AddrPort) (o
 func (h *udpHandler) proxy(gconn net.Conn, src, dst netip.AddrPort) (ok bool) {
 	// const fin = true  // disconnect
 	const ack = false // connect
-	if h.status == UDPEND {
+	if h.status.Load() == UDPEND {
 		log.D("udp: connect: end")
 		clos(gconn) // disconnect, no nat
 		return      // not ok
 	}
 
+	// apps retransmit datagrams of blocked flows, as they go unanswered
+	// while stalled (ex: dns stubs, from a new port each); which are dropped
+	// as-is, lest they be judged anew and escalate stalls; see: h.connect
+	if gc, isg := gconn.(*netstack.GUDPConn); isg && h.dups.Dup(dupkey(src, dst), gc.Sum()) {
+		log.V("udp: connect: %s -> %s; dropped retransmit", src, dst)
+		clos(gconn) // unanswered, as the flow it duplicates
+		return      // not ok
+	}
+
 	// if gconn is a netstack.GUDPConn, then it is not connected.
 	// connect right away, since we assume a duplex-stream from here on
 	// see: h.Connect -> dnsOverride
@@ -223,23 +352,43 @@ func (h *udpHandler) proxy(gconn net.Conn, src, dst netip.AddrPort) (ok bool) {
 		gerr = gc.Connect(ack)
 	} // not a *netstack.GUDPConn, may be *demuxconn
 
-	l := h.listener
 	remote, smm, err := h.Connect(gconn, src, dst) // remote may be nil; smm is never nil
 
-	if err != nil || gerr != nil {
+	if err == errUdpDeferred && gerr == nil {
+		// do not hold up netstack; incoming datagrams queue up in gconn
+		res, t := smm.mark(), smm.tuple()
+		if !h.td.Go(func() {
+			remote, smm, err := h.connect(gconn, src, dst, h.hold.wait(res, h.conntracker, t, h.td.Done()))
+			h.relay(gconn, src, dst, remote, smm, err)
+		}) {
+			clos(gconn) // ended
+			return      // not ok
+		}
+		return true // ok
+	}
+	return h.relay(gconn, src, dst, remote, smm, errors.Join(err, gerr))
+}
+
+func (h *udpHandler) relay(gconn net.Conn, src, dst netip.AddrPort, remote core.UDPConn, smm *SocketSummary, err error) (ok bool) {
+	l := h.listener
+	if err != nil {
+		if h.linger(smm, func() { h.relay(gconn, src, dst, remote, smm, err) }) {
+			return // not ok
+		}
+		refuse(gconn, err)
 		clos(gconn, remote)
 		if smm != nil { // smm is never nil; but nilaway complains
 			smm.done(err)
 			go sendNotif(l, smm)
 		} else {
-			log.W("udp: proxy: unexpected %s -> %s; netstack err: %v; dst err: %v", src, dst, gerr, err)
+			log.W("udp: proxy: unexpected %s -> %s; err: %v", src, dst, err)
 		}
 		return // not ok
 	} else if remote == nil { // dnsOverride?
-		// no summary for dns queries
+		// no summary for dns queries; bytes counted by h.resolver
 		return true // ok
 	}
-	go func() {
+	ok = h.td.Go(func() {
 		cm := h.conntracker
 		defer func() {
 			if r := recover(); r != nil {
@@ -247,37 +396,142 @@ func (h *udpHandler) proxy(gconn net.Conn, src, dst netip.AddrPort) (ok bool) {
 			}
 		}()
 
-		forward(gconn, &rwext{remote}, cm, l, smm)
-	}()
-	return true // ok
+		forward(gconn, newRwExt(remote, h.clock), cm, l, smm, nil, h.fair)
+	})
+	if !ok {
+		clos(gconn, remote)
+		smm.done(errEnded)
+		go sendNotif(l, smm)
+	}
+	return ok
+}
+
+// dupkey keys datagrams from the ip of src (as apps retransmit from a new
+// port, too) to dst; see: core.DupFilter
+func dupkey(src, dst netip.AddrPort) string {
+	src, _ = core.UnmapAddrPort(src)
+	dst, _ = core.UnmapAddrPort(dst)
+	return src.Addr().String() + stallsep + dst.String()
+}
+
+// linger schedules fin after smm.stall, if blocked flows of smm are to be
+// stalled; their datagrams go unanswered (instead of refused) until then,
+// which keeps apps from retrying right away.
+func (h *udpHandler) linger(smm *SocketSummary, fin func()) bool {
+	if smm == nil || smm.stall <= 0 {
+		return false
+	}
+	d := smm.stall
+	smm.stall = 0 // fin does not stall again
+	h.clock.AfterFunc(d, fin)
+	return true
+}
+
+// refuse has netstack answer the datagram of a firewalled flow with an
+// icmp port unreachable, so that apps fail right away instead of waiting
+// on a reply; see: netstack.GUDPConn.Refuse
+func refuse(gconn net.Conn, err error) {
+	if !errors.Is(err, errUdpFirewalled) && !errors.Is(err, ipn.ErrFirewalled) {
+		return
+	}
+	if gc, ok := gconn.(*netstack.GUDPConn); ok {
+		gc.Refuse()
+	} // else: a *demuxconn of an unconnected socket, which is not refused
 }
 
 // Connect connects the proxy server.
 // Note, target may be nil in lwip (deprecated) while it is always specified in netstack
 func (h *udpHandler) Connect(gconn net.Conn, src, target netip.AddrPort) (dst core.UDPConn, smm *SocketSummary, err error) {
+	return h.connect(gconn, src, target, nil)
+}
+
+// connect connects src to target as per verdict res; or as per
+// the listener's verdict, if res is nil.
+func (h *udpHandler) connect(gconn net.Conn, src, target netip.AddrPort, res *Mark) (dst core.UDPConn, smm *SocketSummary, err error) {
 	var px ipn.Proxy
 	var pc io.Closer
 
-	realips, domains, probableDomains, blocklists := undoAlg(h.resolver, target.Addr())
+	src, _ = core.UnmapAddrPort(src)
+	target, _ = core.UnmapAddrPort(target) // target may be invalid
+	realips, domains, probableDomains, blocklists, meta := undoAlg(h.resolver, target.Addr())
+	// alg ips apps held on to past their ttls, if evicted of late, are judged
+	// by the domain they were answered for; and re-resolved once let through
+	evicted, stale := h.resolver.StaleAlg(target.Addr())
+	if stale && len(domains) <= 0 {
+		domains = evicted
+	}
 
-	// flow is alg/nat-aware, do not change target or any addrs
-	res := h.onFlow(src, target, realips, domains, probableDomains, blocklists)
+	bypass := h.bypass.match(target, realips)
+	if bypass {
+		meta = withTag(meta, dnsbypasstag)
+	}
+	lo, hairpin := h.hairpin.match(target) // target may be invalid
+	if hairpin {
+		meta = withTag(meta, hairpintag)
+	}
+
+	if res == nil {
+		// flow is alg/nat-aware, do not change target or any addrs
+		res = h.onFlow(src, target, realips, domains, probableDomains, blocklists, meta)
+	}
+	defaulted := failsafed(res)
+	// domain routes apply to the final verdict; deferred flows come back here
+	res = withRoute(h.prox, res, meta)
+	// flows to the device's own addresses are never sent over proxies
+	res = withHairpin(res, hairpin)
+	// retries of flows whose proxy failed of late go over its alternate, if set
+	retryk := retrykey(res.UID, domains, target.Addr())
+	res, alt := h.retries.alternate(h.prox, retryk, res)
 	cid, pid, uid := splitCidPidUid(res)
 	smm = udpSummary(cid, pid, uid, target.Addr())
+	smm.DNSBypass = bypass
+	smm.Hairpin = hairpin
+	smm.Failsafe = defaulted
+	smm.Retry = h.retries.failed(retryk)
+	smm.Alternate = alt
+	if smm.trace = core.Traced(domains, uid); smm.trace != nil {
+		smm.trace.Event("flow", "udp %s: %s -> %s (dom: %s + %s / real: %s / blocklists: %s / meta: %s) for uid %s; verdict %s",
+			cid, src, target, domains, probableDomains, realips, blocklists, meta, uid, pid)
+		if alt {
+			smm.trace.Event("flow-retry", "udp %s: failed of late over %s; retry over %s", cid, smm.Retry, pid)
+		}
+	}
+
+	// nothing (upstream conns, trackers) must be committed to a flow
+	// that cannot be relayed back to its src in the first place
+	if gc, ok := gconn.(*netstack.GUDPConn); ok && !gc.Ready() {
+		log.W("udp: %s netstack not ready for %s -> %s; uid %s", res.CID, src, target, res.UID)
+		return nil, smm, errUdpNotReady // disconnect
+	}
+
+	if res.PID == ipn.Defer {
+		// caller parks the flow and connects again with the final verdict
+		return nil, smm, errUdpDeferred
+	}
 
 	if res.PID == ipn.Block {
-		var secs uint32
-		k := res.UID + target.String() // UID may be unknown and target may be invalid addr
-		if len(domains) > 0 {          // probableDomains are not reliable for firewalling
-			k = res.UID + domains
+		k := stallkey(res.UID, target.String()) // UID may be unknown and target may be invalid addr
+		if len(domains) > 0 {                   // probableDomains are not reliable for firewalling
+			k = stallkey(res.UID, domains)
 		}
-		if secs = stall(h.fwtracker, k); secs > 0 {
-			waittime := time.Duration(secs) * time.Second
-			time.Sleep(waittime)
+		if gc, ok := gconn.(*netstack.GUDPConn); ok { // retransmits of it are dropped
+			h.dups.See(dupkey(src, target), gc.Sum())
 		}
+		// not slept on here, as this is on netstack's path; see: h.linger
+		secs := stall(h.fwtracker, k, stallmaxudp)
+		smm.stall = time.Duration(secs) * time.Second
+		smm.trace.Event("flow-block", "udp %s: firewalled; stall %ds", res.CID, secs)
 		log.I("udp: %s conn firewalled from %s -> %s (dom: %s + %s/ real: %s); stall? %ds for uid %s", res.CID, src, target, domains, probableDomains, realips, secs, res.UID)
+		if h.capture.on(uid) { // the first datagram is already queued in gconn
+			h.capture.read(gconn, captureWaitUDP, smm)
+		}
+		if res.why != nil { // blocked natively; ex: metered
+			return nil, smm, errors.Join(errUdpFirewalled, res.why) // disconnect
+		}
 		return nil, smm, errUdpFirewalled // disconnect
 	}
+	// retransmits of allowed flows may be legit (ex: quic), and not dropped
+	h.dups.Forget(dupkey(src, target))
 
 	// requests meant for ipn.Exit are always routed to it
 	// and never to whatever is set as DNS upstream.
@@ -297,17 +551,72 @@ func (h *udpHandler) Connect(gconn net.Conn, src, target netip.AddrPort) (dst co
 	// as seen (with Flow) is owned by Rethink, then expect the conn
 	// to be marked ipn.Base for queries sent to tunnel's fake DNS addr
 	// and ipn.Exit for anywhere else.
+	// apps sending dns straight to public resolvers bypass the tunnel's
+	// resolver; refuse or redirect them per their uid's policy, if any
+	var redirect bool
+	if bypass && res.PID != ipn.Exit {
+		if redirect, err = h.bypass.verdict(res.UID, dnsx.NetTypeUDP, target); err != nil {
+			log.I("udp: %s dns bypass blocked from %s -> %s for uid %s", res.CID, src, target, res.UID)
+			smm.trace.Event("flow-block", "udp %s: dns bypass blocked", res.CID)
+			return nil, smm, err // disconnect
+		}
+	}
+
+	// plain dns, to the tunnel's resolver or not, of flows assigned to a
+	// proxy is served by the tunnel's resolver over that proxy, if so set;
+	// unless the proxy is kill switched, which disconnects the flow below
+	if h.pxdns.serves(res.UID, res.PID, target) && !h.prox.KillSwitched(res.PID) {
+		log.I("udp: %s dns from %s -> %s served over %s for uid %s", res.CID, src, target, res.PID, res.UID)
+		h.resolver.ServeFor(dnsx.NetTypeUDP, gconn, res.PID, res.UID)
+		smm.done(errProxyDNS)
+		go sendNotif(h.listener, smm)
+		return nil, smm, nil // connect, no dst
+	}
+
 	if res.PID != ipn.Exit {
-		if dnsOverride(h.resolver, dnsx.NetTypeUDP, gconn, target) {
-			// SocketSummary is not sent to listener; x.DNSSummary is
+		if ok, diverted := dnsOverride(h.resolver, dnsx.NetTypeUDP, gconn, target, redirect, res.UID); ok {
+			if redirect { // SocketSummary marks the redirected flow
+				smm.done(errDNSBypassRedirect)
+				go sendNotif(h.listener, smm)
+			} else if diverted { // as also the one trapped by DNSModePort
+				smm.done(errDNSDiverted)
+				go sendNotif(h.listener, smm)
+			} // else: SocketSummary is not sent to listener; x.DNSSummary is
 			return nil, smm, nil // connect, no dst
 		} // else: not a dns query
 	} // else: proxy src to dst
 
+	if h.prox.KillSwitched(res.PID) {
+		log.I("udp: %s conn killswitched from %s -> %s via %s for uid %s", res.CID, src, target, res.PID, res.UID)
+		smm.trace.Event("flow-block", "udp %s: kill switched %s", res.CID, res.PID)
+		return nil, smm, errKillSwitch // disconnect
+	}
+
+	// alg ips that lead nowhere are not dialed
+	if stale {
+		if err = h.resolver.ReclaimAlg(target.Addr()); err != nil {
+			log.I("udp: %s stale alg ip %s -> %s for uid %s", res.CID, src, target, res.UID)
+			smm.trace.Event("flow-block", "udp %s: stale alg ip %s", res.CID, target)
+			return nil, smm, err // disconnect
+		}
+		realips, _, _, _, _ = undoAlg(h.resolver, target.Addr())
+	}
+
 	if px, err = h.prox.ProxyFor(res.PID); err != nil {
 		log.W("udp: %s failed to get proxy for %s: %v", res.CID, res.PID, err)
+		smm.trace.Event("flow-proxy", "udp %s: no proxy %s: %v", res.CID, res.PID, err)
 		return nil, smm, err // disconnect
 	}
+	px = ipn.WithFault(px) // as-is, unless a fault is in effect on it
+	if smm.trace != nil {
+		smm.trace.Event("flow-proxy", "udp %s: proxy %s (mtu %d)", res.CID, px.ID(), mtuOf(px))
+	}
+
+	// datagrams that do not fit into the proxy's mtu are answered with an
+	// icmp packet too big, instead of being blackholed
+	if gc, ok := gconn.(*netstack.GUDPConn); ok {
+		gc.ClampMTU(mtuOf(px))
+	}
 
 	var errs error
 	var selectedTarget netip.AddrPort
@@ -315,15 +624,53 @@ func (h *udpHandler) Connect(gconn net.Conn, src, target netip.AddrPort) (dst co
 	// unconnected udp socket?
 	if target.Addr().IsUnspecified() || !target.IsValid() {
 		log.I("udp: unconnected udp at (%s) for uid %s via %s", src, res.UID, px.ID())
-		pc, errs = px.Announce("udp", src.String())
+		if pc, errs = px.Announce("udp", src.String()); errs == nil {
+			// ip4 literals sent to over it are unreachable on ip6-only networks sans 464xlat
+			pc = xlatUDP(h.resolver, px.ID(), pc)
+		}
 	} else {
+		// destinations whose realips all failed to dial of late are not redialed
+		breakk := breakerkey(domains, target.Addr())
+		if !h.breaker.allow(breakk) {
+			log.I("udp: %s circuit open for %s -> %s (%s) for uid %s", res.CID, src, target, breakk, res.UID)
+			smm.trace.Event("flow-block", "udp %s: circuit open for %s", res.CID, breakk)
+			return nil, smm, errCircuitOpen // disconnect
+		}
+		defer func() {
+			if pc != nil || errs != nil { // else: nothing dialed
+				h.breaker.done(breakk, errs)
+				h.retries.done(retryk, res.PID, errs)
+			}
+		}()
 		// note: fake-dns-ips shouldn't be un-nated / un-alg'd
-		for i, dstipp := range makeIPPorts(realips, target, 0) {
+		eimk := eimkey(res.UID, px.ID(), src)
+		stickyk := stickykey(res.UID, domains)
+		ipps := makeIPPorts(realips, target, 0)
+		if hairpin { // dialed on loopback, lest the flow loop back into the tunnel
+			ipps = []netip.AddrPort{lo}
+		}
+		hit := h.sticky.pick(stickyk, ipps)
+		for i, dstipp := range ipps {
 			selectedTarget = dstipp
-			if pc, err = px.Dial("udp", selectedTarget.String()); err == nil {
+			// ip4 literals are unreachable on ip6-only networks sans 464xlat
+			if ipp6, ok := xlat464(h.resolver, px.ID(), dstipp); ok {
+				smm.Target4 = dstipp.Addr().String()
+				selectedTarget = ipp6
+			} else {
+				smm.Target4 = ""
+			}
+			dialstart := time.Now()
+			pc, err = h.dial(px, eimk, src, target, selectedTarget)
+			if smm.trace != nil {
+				smm.trace.Event("flow-dial", "udp %s: #%d %s over %s (sticky? %t) in %s; err? %v", res.CID, i, selectedTarget, px.ID(), hit && i == 0, time.Since(dialstart), err)
+			}
+			if err == nil {
+				h.sticky.ok(stickyk, dstipp.Addr())
+				smm.Sticky = hit && i == 0
 				errs = nil // reset errs
 				break
 			} // else try the next realip
+			h.sticky.fail(stickyk, dstipp.Addr())
 			errs = err // store just the last err; complicates logging
 			end := time.Since(smm.start)
 			elapsed := int32(end.Seconds() * 1000)
@@ -357,13 +704,38 @@ func (h *udpHandler) Connect(gconn net.Conn, src, target netip.AddrPort) (dst co
 	return dst, smm, nil // connect
 }
 
+// dial dials dst (a realip of target) over px; over an upstream socket
+// shared with other flows from src, if src sends to many targets (see: eim).
+func (h *udpHandler) dial(px ipn.Proxy, k string, src, target, dst netip.AddrPort) (io.Closer, error) {
+	if c := h.eim.dial(k, px, src, target, dst); c != nil {
+		return c, nil
+	}
+	return px.Dial("udp", dst.String())
+}
+
+// End stops h from handling new flows, closes those in flight, and waits
+// (up to endtimeout) for their goroutines to return.
 func (h *udpHandler) End() error {
-	h.status = UDPEND
-	h.CloseConns(nil)
+	h.status.Store(UDPEND)
+	if !h.td.End(endtimeout, func() { h.CloseConns(nil) }) {
+		log.W("udp: end: %d flows still running", h.td.Running())
+		return errEndTimeout
+	}
+	log.I("udp: end: done")
 	return nil
 }
 
 // CloseConns implements netstack.GUDPConnHandler
 func (h *udpHandler) CloseConns(cids []string) (closed []string) {
-	return closeconns(h.conntracker, cids)
+	return append(closeconns(h.conntracker, cids), h.hold.release(cids)...)
+}
+
+// conns implements tracker
+func (h *udpHandler) conns() core.ConnMapper {
+	return h.conntracker
+}
+
+// stalls implements tracker
+func (h *udpHandler) stalls() *core.ExpMap {
+	return h.fwtracker
 }
@@ -0,0 +1,122 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/settings"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// sendUDP sends a datagram from client to testServer:port, over a new
+// conn (and so, from a new src port).
+func sendUDP(tb testing.TB, client *stack.Stack, port uint16, b []byte) {
+	tb.Helper()
+	c, err := gonet.DialUDP(client, nil, &tcpip.FullAddress{NIC: 1, Addr: testServer, Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(b); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestUDPNotReady(t *testing.T) {
+	tt := newTestTunnel(ipn.Base)
+	// netstack has no ip4 routes, so endpoints of ip4 flows are never made
+	client := tt.up(t, settings.IP6)
+	defer tt.udp.End()
+
+	fd0 := fds(t)
+	const n = 8
+	for i := range n {
+		sendUDP(t, client, 5000, []byte{byte(i)}) // unique, lest dropped as retransmits
+	}
+
+	for _, s := range tt.l.summaries(t, n) {
+		if !strings.Contains(s.Msg, errUdpNotReady.Error()) {
+			t.Errorf("udp: %s: want %q, got %q", s.ID, errUdpNotReady, s.Msg)
+		}
+	}
+	if d := tt.px.dials.Load(); d != 0 {
+		t.Errorf("udp: %d dials for flows not ready", d)
+	}
+	if m := tt.conns.Len(); m != 0 {
+		t.Errorf("udp: %d conns tracked for flows not ready", m)
+	}
+	eventually(t, 5*time.Second, func() bool { return fds(t) <= fd0 },
+		"udp: fds not back to %d", fd0)
+}
+
+func TestUDPEnd(t *testing.T) {
+	const n = 4
+	tt := newTestTunnel(ipn.Base)
+	tt.px.to = map[string]string{"udp": echoServer(t).String()}
+	client := tt.up(t, settings.IP4)
+
+	for i := range n {
+		c, err := gonet.DialUDP(client, nil, &tcpip.FullAddress{NIC: 1, Addr: testServer, Port: 7}, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		b := []byte{byte(i)}
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(b); err != nil {
+			t.Fatalf("udp: flow %d not echoed: %v", i, err)
+		}
+	}
+	if r := tt.udp.td.Running(); r != n {
+		t.Fatalf("udp: %d flows running; want %d", r, n)
+	}
+	if d := tt.px.dials.Load(); d != n {
+		t.Fatalf("udp: %d upstream conns dialed; want %d", d, n)
+	}
+
+	if err := tt.udp.End(); err != nil {
+		t.Fatal(err)
+	}
+	if r := tt.udp.td.Running(); r != 0 {
+		t.Errorf("udp: %d flows running after end", r)
+	}
+	if m := tt.px.open(); m != 0 {
+		t.Errorf("udp: %d upstream conns open after end", m)
+	}
+	if m := tt.conns.Len(); m != 0 {
+		t.Errorf("udp: %d conns tracked after end", m)
+	}
+}
+
+func TestUDPEndReleasesParked(t *testing.T) {
+	tt := newTestTunnel(ipn.Defer)
+	client := tt.up(t, settings.IP4)
+
+	sendUDP(t, client, 5000, []byte{1})
+	eventually(t, 5*time.Second, func() bool { return len(tt.udp.hold.list()) > 0 },
+		"udp: flow not parked")
+
+	if err := tt.udp.End(); err != nil {
+		t.Fatal(err)
+	}
+	if r := tt.udp.td.Running(); r != 0 {
+		t.Errorf("udp: %d flows running after end", r)
+	}
+	if d := tt.px.dials.Load(); d != 0 {
+		t.Errorf("udp: %d dials for a parked flow", d)
+	}
+}
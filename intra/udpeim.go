@@ -0,0 +1,207 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// flows from a src to a new dst within this window share an upstream
+	eimwindow = 10 * time.Second
+	// max srcs tracked, and max upstreams shared
+	eimmax = 1024
+)
+
+var errEimNoUDPConn = errors.New("udp: eim: announced conn is not a udp conn")
+
+// eim holds endpoint-independent mappings (rfc4787 req-1): once a src
+// sends to more than one dst in quick succession, its subsequent flows
+// share one announced upstream socket, so that its external ip:port is
+// the same for all its peers, as nat traversal (webrtc, games) expects.
+// Only ipn.Base and ipn.Exit support announced (unconnected) sockets.
+type eim struct {
+	sync.Mutex                     // protects seen and socks
+	seen       map[string]*eimseen // eimkey -> last flow
+	socks      map[string]*muxer   // eimkey -> shared upstream
+}
+
+type eimseen struct {
+	dst netip.AddrPort
+	at  time.Time
+}
+
+func newEim() *eim {
+	return &eim{
+		seen:  make(map[string]*eimseen),
+		socks: make(map[string]*muxer),
+	}
+}
+
+// eimkey returns the key for flows from src (a tun addr) of uid over pid;
+// empty if pid cannot share upstream sockets.
+func eimkey(uid, pid string, src netip.AddrPort) string {
+	if pid != ipn.Base && pid != ipn.Exit {
+		return ""
+	}
+	return uid + ":" + pid + ":" + src.String()
+}
+
+// dial returns a conn to dst (a realip of target) over the socket shared
+// by flows keyed k, if flows keyed k went to a different target within
+// eimwindow; nil otherwise. The flow that came before keeps its own
+// upstream conn, as-is. Sockets are announced outside the lock, as
+// announcing over a proxy may block on the network.
+func (e *eim) dial(k string, px ipn.Proxy, src, target, dst netip.AddrPort) core.UDPConn {
+	if len(k) <= 0 || px == nil {
+		return nil
+	}
+	raddr := net.UDPAddrFromAddrPort(dst)
+
+	if c, share := e.lookup(k, target, raddr); c != nil || !share {
+		return c
+	}
+
+	pc, err := announce(px, src.Port())
+	if err != nil {
+		log.W("udp: eim: %s announce for %s failed; err: %v", k, dst, err)
+		return nil
+	}
+	x := newSharedMuxer(pc)
+
+	e.Lock()
+	if y := e.socks[k]; y != nil { // another flow announced first
+		e.Unlock()
+		_ = x.stop()
+		if c, err := y.dial(raddr); err == nil {
+			return c
+		}
+		return nil
+	}
+	if len(e.socks) >= eimmax && e.pruneLocked() <= 0 {
+		e.Unlock()
+		_ = x.stop()
+		log.W("udp: eim: %s not shared; %d upstreams in use", k, eimmax)
+		return nil
+	}
+	c, err := x.dial(raddr) // before x is shared, lest it be pruned as unused
+	if err != nil {         // unlikely
+		e.Unlock()
+		_ = x.stop()
+		log.W("udp: eim: %s dial %s failed; err: %v", k, dst, err)
+		return nil
+	}
+	e.socks[k] = x
+	e.Unlock()
+
+	log.I("udp: eim: %s shares %s for %s", k, pc.LocalAddr(), dst)
+	return c
+}
+
+// lookup returns a conn to raddr over the upstream shared by flows keyed k,
+// if any; or, if there is none, whether flows keyed k must share one.
+func (e *eim) lookup(k string, target netip.AddrPort, raddr *net.UDPAddr) (c core.UDPConn, share bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	if x := e.socks[k]; x != nil {
+		if c, err := x.dial(raddr); err == nil {
+			return c, true
+		} // else: muxer done; announce anew
+		delete(e.socks, k)
+	} else if !e.upgradeLocked(k, target, time.Now()) {
+		return nil, false
+	}
+	if len(e.socks) >= eimmax && e.pruneLocked() <= 0 {
+		log.W("udp: eim: %s not shared; %d upstreams in use", k, len(e.socks))
+		return nil, false
+	}
+	return nil, true
+}
+
+// forget drops flows seen so far, so that flows on a new link do not
+// share upstreams based on flows seen on the previous one.
+func (e *eim) forget() {
+	e.Lock()
+	defer e.Unlock()
+
+	clear(e.seen)
+	e.pruneLocked()
+}
+
+// upgradeLocked records a flow keyed k to dst; and returns true if the
+// previous flow keyed k went to a different dst within eimwindow.
+// A flow retried over many realips of the same dst is seen just once.
+func (e *eim) upgradeLocked(k string, dst netip.AddrPort, now time.Time) bool {
+	last := e.seen[k]
+	if last == nil && len(e.seen) >= eimmax {
+		e.evictLocked(now)
+	}
+	e.seen[k] = &eimseen{dst: dst, at: now}
+
+	return last != nil && last.dst != dst && now.Sub(last.at) <= eimwindow
+}
+
+// evictLocked removes stale entries; or, if none are, an arbitrary one.
+// Upstreams no longer shared are removed, too.
+func (e *eim) evictLocked(now time.Time) {
+	e.pruneLocked()
+
+	n := len(e.seen)
+	for k, v := range e.seen {
+		if now.Sub(v.at) > eimwindow {
+			delete(e.seen, k)
+		}
+	}
+	if len(e.seen) < n {
+		return
+	}
+	for k := range e.seen {
+		delete(e.seen, k)
+		return
+	}
+}
+
+// pruneLocked removes upstreams that are no longer shared, as their muxers
+// stopped once flows over them were done; and returns the number removed.
+func (e *eim) pruneLocked() (n int) {
+	for k, x := range e.socks {
+		if x.stopped() {
+			delete(e.socks, k)
+			n++
+		}
+	}
+	return
+}
+
+// announce binds a udp socket on px, preferably on port (src's port), so
+// that the external port is the same as the app's (if not nat-ed later).
+func announce(px ipn.Proxy, port uint16) (core.UDPConn, error) {
+	pc, err := px.Announce("udp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		log.D("udp: eim: port %d unavailable on %s; err: %v", port, px.ID(), err)
+		pc, err = px.Announce("udp", ":0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := pc.(core.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, errEimNoUDPConn
+	}
+	return uc, nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/protect"
+)
+
+var eimsrc = netip.MustParseAddrPort("10.111.222.1:5000")
+
+// eimflows dials flows from eimsrc over px to dsts in turn, and returns
+// their conns, as shared by e; nil for flows that are not.
+func eimflows(e *eim, k string, px ipn.Proxy, dsts ...netip.AddrPort) []core.UDPConn {
+	out := make([]core.UDPConn, 0, len(dsts))
+	for _, dst := range dsts {
+		out = append(out, e.dial(k, px, eimsrc, dst, dst))
+	}
+	return out
+}
+
+// echoes writes b over c, and returns true if it is echoed back.
+func echoes(tb testing.TB, c core.UDPConn, b []byte) bool {
+	tb.Helper()
+	if _, err := c.Write(b); err != nil {
+		tb.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(b)+1)
+	n, err := c.Read(got)
+	return err == nil && string(got[:n]) == string(b)
+}
+
+func (e *eim) shared() int {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.socks)
+}
+
+func TestEimDemux(t *testing.T) {
+	e := newEim()
+	px := &testProxy{id: ipn.Base}
+	k := eimkey("0", px.id, eimsrc)
+	d1, d2, d3 := echoServer(t), echoServer(t), echoServer(t)
+
+	cs := eimflows(e, k, px, d1, d2, d3)
+	if cs[0] != nil {
+		t.Fatalf("eim: first flow to %s shared", d1)
+	}
+	c2, c3 := cs[1], cs[2]
+	if c2 == nil || c3 == nil {
+		t.Fatalf("eim: flows to %s, %s not shared", d2, d3)
+	}
+	if c2.LocalAddr().String() != c3.LocalAddr().String() {
+		t.Errorf("eim: upstreams %s != %s", c2.LocalAddr(), c3.LocalAddr())
+	}
+	// datagrams from each dst are demuxed to the flow to it
+	if !echoes(t, c2, []byte("two")) || !echoes(t, c3, []byte("three")) {
+		t.Error("eim: replies not demuxed")
+	}
+	if d := px.dials.Load(); d != 1 {
+		t.Errorf("eim: %d announces; want 1", d)
+	}
+
+	// the upstream is stopped once its flows are done; and is pruned,
+	// when entries of flows seen are evicted, without being dialed again
+	e.Lock()
+	x := e.socks[k]
+	e.Unlock()
+	c2.Close()
+	c3.Close()
+	eventually(t, 5*time.Second, x.stopped, "eim: upstream not stopped")
+	if n := e.shared(); n != 1 {
+		t.Fatalf("eim: %d upstreams before eviction; want 1", n)
+	}
+	for i := range eimmax { // the last of which evicts
+		eimflows(e, "k"+strconv.Itoa(i), px, d1)
+	}
+	if n := e.shared(); n != 0 {
+		t.Errorf("eim: %d upstreams after eviction; want 0", n)
+	}
+}
+
+func TestEimCap(t *testing.T) {
+	e := newEim()
+	px := &testProxy{id: ipn.Base}
+	d1, d2, d3 := echoServer(t), echoServer(t), echoServer(t)
+
+	// an upstream in use by eimmax srcs (as if each had its own)
+	cs := eimflows(e, "k0", px, d1, d2)
+	c := cs[1]
+	if c == nil {
+		t.Fatalf("eim: flow to %s not shared", d2)
+	}
+	e.Lock()
+	x := e.socks["k0"]
+	for i := 1; i < eimmax; i++ {
+		e.socks["k"+strconv.Itoa(i)] = x
+	}
+	e.Unlock()
+
+	k := eimkey("0", px.id, eimsrc)
+	if cs := eimflows(e, k, px, d1, d3); cs[1] != nil {
+		t.Errorf("eim: flow to %s shared over the cap", d3)
+	}
+	if n := e.shared(); n != eimmax {
+		t.Errorf("eim: %d upstreams; want %d", n, eimmax)
+	}
+
+	// upstreams no longer in use make way for new ones
+	c.Close()
+	eventually(t, 5*time.Second, x.stopped, "eim: upstream not stopped")
+	if cs := eimflows(e, k, px, d2); cs[0] == nil {
+		t.Errorf("eim: flow to %s not shared under the cap", d2)
+	} else if !echoes(t, cs[0], []byte("two")) {
+		t.Errorf("eim: reply from %s not demuxed", d2)
+	}
+	if n := e.shared(); n != 1 {
+		t.Errorf("eim: %d upstreams; want 1", n)
+	}
+}
+
+// holdProxy is a testProxy whose announces block till released.
+type holdProxy struct {
+	*testProxy
+	held    chan struct{} // closed to release announces
+	holding chan struct{} // signalled on each announce
+}
+
+func (p *holdProxy) Announce(network, local string) (protect.PacketConn, error) {
+	p.holding <- struct{}{}
+	<-p.held
+	return p.testProxy.Announce(network, local)
+}
+
+func TestEimAnnounceUnlocked(t *testing.T) {
+	e := newEim()
+	slow := &holdProxy{&testProxy{id: ipn.Base}, make(chan struct{}), make(chan struct{}, 1)}
+	fast := &testProxy{id: ipn.Base}
+	d1, d2 := echoServer(t), echoServer(t)
+
+	done := make(chan core.UDPConn, 1)
+	go func() {
+		done <- eimflows(e, "slow", slow, d1, d2)[1]
+	}()
+	<-slow.holding
+
+	// others share upstreams while one is being announced
+	if cs := eimflows(e, "fast", fast, d1, d2); cs[1] == nil {
+		t.Error("eim: flow not shared while another announces")
+	} else if !echoes(t, cs[1], []byte("fast")) {
+		t.Error("eim: no reply while another announces")
+	}
+	e.forget()
+
+	close(slow.held)
+	select {
+	case c := <-done:
+		if c == nil || !echoes(t, c, []byte("slow")) {
+			t.Error("eim: announced flow not shared")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("eim: announce did not return")
+	}
+	if n := e.shared(); n != 2 {
+		t.Errorf("eim: %d upstreams; want 2", n)
+	}
+}
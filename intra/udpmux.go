@@ -22,10 +22,13 @@ import (
 
 const (
 	maxtimeouterrors = 3
+	// datagrams queued per demuxed conn
+	dxqlen = 32
 )
 
 var (
 	errMuxerDone = errors.New("udp: muxer closed")
+	errNoRoute   = errors.New("udp: muxer: no route")
 )
 
 type sender interface {
@@ -49,6 +52,8 @@ func (s *stats) String() string {
 type muxer struct {
 	mxconn core.UDPConn
 	stats  *stats
+	vends  bool // vend conns to new remotes; if false, see: dial
+	idle   bool // no routes left to a non-vending muxer; protected by rmu
 
 	until time.Time // deadline extension
 
@@ -87,13 +92,25 @@ type slice struct {
 }
 
 var _ sender = (*muxer)(nil)
-var _ net.Conn = (*demuxconn)(nil)
+var _ core.UDPConn = (*demuxconn)(nil)
 
 // mux creates a muxer/demuxer for a connectionless conn.
 func newMuxer(conn core.UDPConn) *muxer {
+	return newMuxerWith(conn, true)
+}
+
+// newSharedMuxer creates a muxer for conn shared by conns to remotes
+// routed with dial; datagrams from other remotes are dropped; and conn
+// is closed once no routes remain.
+func newSharedMuxer(conn core.UDPConn) *muxer {
+	return newMuxerWith(conn, false)
+}
+
+func newMuxerWith(conn core.UDPConn, vends bool) *muxer {
 	x := &muxer{
 		mxconn:   conn,
 		stats:    &stats{start: time.Now()},
+		vends:    vends,
 		routes:   make(map[string]*demuxconn),
 		rmu:      sync.Mutex{},
 		dxconns:  make(chan *demuxconn),
@@ -104,8 +121,37 @@ func newMuxer(conn core.UDPConn) *muxer {
 	return x
 }
 
-// vend waits for and returns a demuxed conn to process.
-func (x *muxer) vend() (net.Conn, error) {
+// dial returns a demuxed conn to raddr, routing datagrams from raddr to it.
+func (x *muxer) dial(raddr net.Addr) (*demuxconn, error) {
+	x.rmu.Lock()
+	defer x.rmu.Unlock()
+
+	select {
+	case <-x.doneCh:
+		return nil, errMuxerDone
+	default:
+	}
+	if x.idle {
+		return nil, errMuxerDone
+	}
+	if c, ok := x.routes[raddr.String()]; ok {
+		return c, nil
+	}
+	c := x.demux(raddr)
+	x.routes[raddr.String()] = c
+	x.stats.dxcount++
+	x.dxconnWG.Add(1)
+	go func() {
+		<-c.closed
+		x.unroute(c)
+		x.dxconnWG.Done()
+	}()
+	return c, nil
+}
+
+// vend waits for and returns a demuxed conn to process; errs once x stops,
+// or done is closed.
+func (x *muxer) vend(done <-chan struct{}) (net.Conn, error) {
 	select {
 	case c := <-x.dxconns:
 		x.dxconnWG.Add(1) // accept
@@ -118,6 +164,9 @@ func (x *muxer) vend() (net.Conn, error) {
 
 	case <-x.doneCh:
 		return nil, errMuxerDone
+
+	case <-done: // owner ended; see: udpHandler.End
+		return nil, errMuxerDone
 	}
 }
 
@@ -129,6 +178,9 @@ func (x *muxer) stop() error {
 		close(x.doneCh)
 		x.drain()
 		err = x.mxconn.Close() // close the muxed conn
+		if !x.vends {          // dialed conns have no one else to close them
+			x.closeRoutes()
+		}
 
 		x.dxconnWG.Wait() // all conns close / error out
 		x.stats.dur = time.Since(x.stats.start)
@@ -137,6 +189,33 @@ func (x *muxer) stop() error {
 	return err
 }
 
+// stopped returns true if x is stopped, or is about to be, as no routes
+// are left to it (if it does not vend conns).
+func (x *muxer) stopped() bool {
+	x.rmu.Lock()
+	defer x.rmu.Unlock()
+
+	select {
+	case <-x.doneCh:
+		return true
+	default:
+	}
+	return x.idle
+}
+
+func (x *muxer) closeRoutes() {
+	x.rmu.Lock()
+	cs := make([]*demuxconn, 0, len(x.routes))
+	for _, c := range x.routes {
+		cs = append(cs, c)
+	}
+	x.rmu.Unlock()
+
+	for _, c := range cs {
+		c.Close() // unroutes c
+	}
+}
+
 func (x *muxer) drain() {
 	x.rmu.Lock()
 	defer x.rmu.Unlock()
@@ -186,15 +265,20 @@ func (x *muxer) read() {
 			return
 		}
 
-		if dst, err := x.route(who); err != nil {
+		if dst, err := x.route(who); err == errNoRoute {
+			log.D("udp: mux: read: drop(sz: %d); no route from %s", n, who)
+			free()
+		} else if err != nil {
 			// route fails if muxer.dxconns is closed (which is never closed)
 			log.W("udp: mux: new route failed: %v", err)
+			free()
 			return
 		} else { // may be existing route or a new route
 			select {
 			case dst.incomingCh <- &slice{v: b[:n], free: free}:
-			default: // dst probably closed, but not yet unrouted
-				log.W("udp: mux: read: drop(sz: %d); route to %s closed but yet found?", n, dst.raddr)
+			default: // dst probably closed, but not yet unrouted; or is full
+				log.W("udp: mux: read: drop(sz: %d); route to %s closed or full", n, dst.raddr)
+				free()
 			}
 		}
 	}
@@ -204,7 +288,9 @@ func (x *muxer) route(raddr net.Addr) (*demuxconn, error) {
 	x.rmu.Lock()
 	defer x.rmu.Unlock()
 	conn, ok := x.routes[raddr.String()]
-	if !ok {
+	if !ok && !x.vends {
+		return nil, errNoRoute
+	} else if !ok {
 		conn = x.demux(raddr)
 		select {
 		case <-x.doneCh:
@@ -221,7 +307,15 @@ func (x *muxer) route(raddr net.Addr) (*demuxconn, error) {
 func (x *muxer) unroute(c *demuxconn) {
 	x.rmu.Lock()
 	delete(x.routes, c.raddr.String())
+	idle := !x.vends && !x.idle && len(x.routes) <= 0
+	if idle {
+		x.idle = true
+	}
 	x.rmu.Unlock()
+
+	if idle { // must not block the caller, who stop waits on
+		go x.stop()
+	}
 }
 
 func (x *muxer) sendto(p []byte, addr net.Addr) (int, error) {
@@ -250,7 +344,7 @@ func (x *muxer) demux(r net.Addr) *demuxconn {
 		remux:      x,
 		laddr:      x.mxconn.LocalAddr(),
 		raddr:      r,
-		incomingCh: make(chan *slice),
+		incomingCh: make(chan *slice, dxqlen),
 		overflowCh: make(chan *slice),
 		closed:     make(chan struct{}),
 		wt:         time.NewTicker(udptimeout),
@@ -328,6 +422,18 @@ func (c *demuxconn) Close() error {
 	return nil
 }
 
+// WriteTo implements core.UDPConn.WriteTo; writes to the remote
+// address connected to, as demuxed conns are connected.
+func (c *demuxconn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// ReadFrom implements core.UDPConn.ReadFrom
+func (c *demuxconn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.raddr, err
+}
+
 // LocalAddr implements net.Conn.LocalAddr
 func (c *demuxconn) LocalAddr() net.Addr {
 	return c.laddr
@@ -0,0 +1,354 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+	"github.com/celzero/firestack/intra/log"
+)
+
+const (
+	// max watches at once; see: Tunnel.WatchUid
+	maxUidWatches = 4
+	// max events queued per watch; the oldest are dropped for newer ones
+	uidWatchQueue = 64
+)
+
+// kinds of UidEvent
+const (
+	UidFlowOpen     = "flow-open"     // a flow was let through (or deferred)
+	UidFlowClose    = "flow-close"    // a flow closed, for whatever reason
+	UidVerdictBlock = "verdict-block" // a flow was blocked by Flow's verdict
+	UidPolicyChange = "policy-change" // a per-uid policy was set
+	UidProxyChange  = "proxy-change"  // flows were let through over a proxy other than before
+)
+
+var (
+	errUidWatchNoUid = errors.New("uidwatch: no uid")
+	errUidWatchLimit = errors.New("uidwatch: too many watches")
+	errUidWatchOff   = errors.New("uidwatch: stopped")
+	errUidWatchNoL   = errors.New("uidwatch: listener does not implement UidListener")
+)
+
+// UidListener is optionally implemented by Bridge to watch uids;
+// see: Tunnel.WatchUid.
+type UidListener interface {
+	// OnUidEvent is called with each event (a one-line json of UidEvent)
+	// of a watched uid, in order; see: Tunnel.WatchUid.
+	OnUidEvent(uid, event string)
+}
+
+// UidEvent is a change in native state of an app; see: Tunnel.WatchUid.
+type UidEvent struct {
+	Kind    string `json:"kind"`              // UidFlowOpen, UidFlowClose, UidVerdictBlock, UidPolicyChange, UidProxyChange.
+	UID     string `json:"uid"`               // UID of the app.
+	At      int64  `json:"at"`                // Unix millis.
+	Proto   string `json:"proto,omitempty"`   // Of flows: tcp, udp, icmp.
+	CID     string `json:"cid,omitempty"`     // Of flows.
+	PID     string `json:"pid,omitempty"`     // Of flows: the proxy (or Block, Defer); of proxy changes: the new proxy.
+	Prev    string `json:"prev,omitempty"`    // Of proxy changes: the proxy flows were let through over before.
+	Dst     string `json:"dst,omitempty"`     // Of flows: ip:port (ip, for closed flows).
+	Domains string `json:"domains,omitempty"` // Of opened or blocked flows: csv.
+	Rx      int64  `json:"rx,omitempty"`      // Of closed flows: bytes downloaded.
+	Tx      int64  `json:"tx,omitempty"`      // Of closed flows: bytes uploaded.
+	Code    int    `json:"code,omitempty"`    // Of closed flows; see: backend.ErrNone.
+	Msg     string `json:"msg,omitempty"`     // Of closed flows; human-readable, may change.
+	Policy  string `json:"policy,omitempty"`  // Of policy changes: the Tunnel method called.
+	Value   string `json:"value,omitempty"`   // Of policy changes: what it was set to.
+	Dropped int64  `json:"dropped,omitempty"` // Events dropped (queue full) since the previous one.
+}
+
+// UidWatch delivers events of a uid to UidListener until it is unwatched;
+// events are queued (up to 64), and the oldest are dropped if the listener
+// falls behind.
+type UidWatch struct {
+	uid  string
+	l    UidListener
+	ws   *uidwatches
+	wake chan struct{} // signals queued events
+	done chan struct{} // closed on Unwatch
+	once sync.Once
+
+	mu      sync.Mutex // protects q, dropped
+	q       []*UidEvent
+	dropped int64 // since the last event delivered
+}
+
+// Uid returns the uid watched.
+func (w *UidWatch) Uid() string {
+	return w.uid
+}
+
+// Unwatch stops delivery of events; those queued are dropped.
+func (w *UidWatch) Unwatch() {
+	w.once.Do(func() {
+		w.ws.remove(w)
+		close(w.done)
+		log.I("uidwatch: %s: unwatched", w.uid)
+	})
+}
+
+// push queues ev, dropping the oldest event if full.
+func (w *UidWatch) push(ev *UidEvent) {
+	w.mu.Lock()
+	if len(w.q) >= uidWatchQueue {
+		w.q[0] = nil
+		w.q = w.q[1:]
+		w.dropped++
+	}
+	w.q = append(w.q, ev)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// pop dequeues the oldest event, if any.
+func (w *UidWatch) pop() *UidEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.q) <= 0 {
+		return nil
+	}
+	ev := *w.q[0] // copy; events are shared between watches of the same uid
+	w.q[0] = nil
+	w.q = w.q[1:]
+	ev.Dropped, w.dropped = w.dropped, 0
+	return &ev
+}
+
+// run delivers queued events until unwatched.
+func (w *UidWatch) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.wake:
+		}
+		for ev := w.pop(); ev != nil; ev = w.pop() {
+			select {
+			case <-w.done:
+				return
+			default:
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				log.W("uidwatch: %s: %s: err %v", w.uid, ev.Kind, err)
+				continue
+			}
+			w.l.OnUidEvent(w.uid, string(b))
+		}
+	}
+}
+
+// uidwatches is a Listener that fans out events of flows of watched uids
+// (and changes to their policies) to UidListener; all calls pass through
+// to Listener.
+type uidwatches struct {
+	Listener
+	ul   UidListener  // may be nil
+	mu   sync.RWMutex // protects all, pids
+	all  []*UidWatch
+	pids map[string]string // watched uid -> proxy of its last flow let through
+	n    atomic.Int32      // len(all); to skip the lock when nothing is watched
+	off  atomic.Bool       // no more watches once stopped
+}
+
+var _ Listener = (*uidwatches)(nil)
+
+// newUidWatches passes calls through to l; events are delivered to ul,
+// which may be nil, in which case there are no watches.
+func newUidWatches(l Listener, ul UidListener) *uidwatches {
+	return &uidwatches{Listener: l, ul: ul, pids: make(map[string]string)}
+}
+
+// watch starts delivering events of uid; there may be at most
+// maxUidWatches at once, incl those of the same uid.
+func (u *uidwatches) watch(uid string) (*UidWatch, error) {
+	if len(uid) <= 0 {
+		return nil, errUidWatchNoUid
+	}
+	if u.off.Load() {
+		return nil, errUidWatchOff
+	}
+	if u.ul == nil {
+		return nil, errUidWatchNoL
+	}
+	w := &UidWatch{
+		uid:  uid,
+		l:    u.ul,
+		ws:   u,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	u.mu.Lock()
+	if len(u.all) >= maxUidWatches {
+		u.mu.Unlock()
+		log.W("uidwatch: %s: too many watches (%d)", uid, maxUidWatches)
+		return nil, errUidWatchLimit
+	}
+	u.all = append(u.all, w)
+	u.n.Store(int32(len(u.all)))
+	u.mu.Unlock()
+
+	go w.run()
+	log.I("uidwatch: %s: watched", uid)
+	return w, nil
+}
+
+func (u *uidwatches) remove(w *UidWatch) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, x := range u.all {
+		if x == w {
+			u.all = append(u.all[:i], u.all[i+1:]...)
+			break
+		}
+	}
+	u.n.Store(int32(len(u.all)))
+	if !u.watchedLocked(w.uid) {
+		delete(u.pids, w.uid)
+	}
+}
+
+// stop unwatches all watches, and turns away new ones.
+func (u *uidwatches) stop() {
+	u.off.Store(true)
+	u.mu.RLock()
+	all := append([]*UidWatch(nil), u.all...)
+	u.mu.RUnlock()
+	for _, w := range all {
+		w.Unwatch()
+	}
+}
+
+// watched returns true if uid has any watches.
+func (u *uidwatches) watched(uid string) bool {
+	if u.n.Load() <= 0 || len(uid) <= 0 {
+		return false
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.watchedLocked(uid)
+}
+
+func (u *uidwatches) watchedLocked(uid string) bool {
+	for _, w := range u.all {
+		if w.uid == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues ev to all watches of its uid.
+func (u *uidwatches) send(ev *UidEvent) {
+	ev.At = time.Now().UnixMilli()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, w := range u.all {
+		if w.uid == ev.UID {
+			w.push(ev)
+		}
+	}
+}
+
+// reassigned returns the proxy flows of uid were let through over before
+// pid, if any other; and records pid as its proxy.
+func (u *uidwatches) reassigned(uid, pid string) (prev string, ok bool) {
+	if pid == ipn.Block || pid == ipn.Defer {
+		return "", false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.watchedLocked(uid) {
+		return "", false
+	}
+	prev, u.pids[uid] = u.pids[uid], pid
+	return prev, len(prev) > 0 && prev != pid
+}
+
+// policy sends a UidPolicyChange of uid, if watched.
+func (u *uidwatches) policy(uid, what, value string) {
+	if !u.watched(uid) {
+		return
+	}
+	u.send(&UidEvent{Kind: UidPolicyChange, UID: uid, Policy: what, Value: value})
+}
+
+// Flow implements SocketListener.
+func (u *uidwatches) Flow(protocol int32, uid int, src, dst, origdsts, domains, probableDomains, blocklists, meta string) *Mark {
+	res := u.Listener.Flow(protocol, uid, src, dst, origdsts, domains, probableDomains, blocklists, meta)
+	if u.n.Load() <= 0 || res == nil {
+		return res
+	}
+	suid := res.UID
+	if len(suid) <= 0 {
+		suid = strconv.Itoa(uid)
+	}
+	if !u.watched(suid) {
+		return res
+	}
+	kind := UidFlowOpen
+	if res.PID == ipn.Block {
+		kind = UidVerdictBlock
+	}
+	if prev, ok := u.reassigned(suid, res.PID); ok {
+		u.send(&UidEvent{Kind: UidProxyChange, UID: suid, PID: res.PID, Prev: prev})
+	}
+	u.send(&UidEvent{
+		Kind:    kind,
+		UID:     suid,
+		Proto:   protoName(protocol),
+		CID:     res.CID,
+		PID:     res.PID,
+		Dst:     dst,
+		Domains: domains,
+	})
+	return res
+}
+
+// OnSocketClosed implements SocketListener.
+func (u *uidwatches) OnSocketClosed(s *SocketSummary) {
+	if s != nil && u.watched(s.UID) {
+		u.send(&UidEvent{
+			Kind:  UidFlowClose,
+			UID:   s.UID,
+			Proto: s.Proto,
+			CID:   s.ID,
+			PID:   s.PID,
+			Dst:   s.Target,
+			Rx:    s.Rx,
+			Tx:    s.Tx,
+			Code:  s.Code,
+			Msg:   s.Msg,
+		})
+	}
+	u.Listener.OnSocketClosed(s)
+}
+
+func protoName(protocol int32) string {
+	switch protocol {
+	case 6:
+		return ProtoTypeTCP
+	case 17:
+		return ProtoTypeUDP
+	case 1, 58:
+		return ProtoTypeICMP
+	}
+	return strconv.Itoa(int(protocol))
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/ipn"
+)
+
+// uidListener records events of watched uids; deliveries block while hold
+// is set and not yet closed.
+type uidListener struct {
+	hold chan struct{}
+
+	mu  sync.Mutex
+	evs []*UidEvent
+}
+
+func (l *uidListener) OnUidEvent(uid, event string) {
+	if l.hold != nil {
+		<-l.hold
+	}
+	ev := new(UidEvent)
+	if err := json.Unmarshal([]byte(event), ev); err != nil {
+		panic(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evs = append(l.evs, ev)
+}
+
+func (l *uidListener) events() []*UidEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*UidEvent(nil), l.evs...)
+}
+
+// kinds waits for n events, and returns their kinds.
+func (l *uidListener) kinds(tb testing.TB, n int) (kinds []string) {
+	tb.Helper()
+	eventually(tb, 5*time.Second, func() bool {
+		return len(l.events()) >= n
+	}, "uidwatch: want %d events", n)
+	for _, ev := range l.events() {
+		kinds = append(kinds, ev.Kind)
+	}
+	return
+}
+
+func newTestUidWatches(pid string) (*uidwatches, *testListener, *uidListener) {
+	tl := newTestListener(pid)
+	ul := &uidListener{}
+	return newUidWatches(tl, ul), tl, ul
+}
+
+func TestUidWatchLimits(t *testing.T) {
+	u, _, _ := newTestUidWatches(ipn.Base)
+
+	if _, err := u.watch(""); err != errUidWatchNoUid {
+		t.Errorf("uidwatch: no uid: err %v", err)
+	}
+	var ws []*UidWatch
+	for range maxUidWatches {
+		w, err := u.watch("10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws = append(ws, w)
+	}
+	if _, err := u.watch("11"); err != errUidWatchLimit {
+		t.Errorf("uidwatch: over the cap: err %v", err)
+	}
+	ws[0].Unwatch()
+	ws[0].Unwatch() // no-op
+	if _, err := u.watch("11"); err != nil {
+		t.Errorf("uidwatch: after unwatch: err %v", err)
+	}
+
+	u.stop()
+	if u.watched("10") || u.watched("11") {
+		t.Error("uidwatch: watches remain once stopped")
+	}
+	if _, err := u.watch("10"); err != errUidWatchOff {
+		t.Errorf("uidwatch: once stopped: err %v", err)
+	}
+
+	// sans a UidListener, there are no watches
+	if _, err := newUidWatches(newTestListener(ipn.Base), nil).watch("10"); err != errUidWatchNoL {
+		t.Errorf("uidwatch: no listener: err %v", err)
+	}
+}
+
+func TestUidWatchEvents(t *testing.T) {
+	u, tl, ul := newTestUidWatches(ipn.Base)
+	w, err := u.watch("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Unwatch()
+
+	// flows of other uids are not sent
+	u.Flow(6, 11, "10.0.0.1:1", "192.0.2.1:443", "", "", "", "", "")
+	u.Flow(6, 10, "10.0.0.1:2", "192.0.2.1:443", "", "a.test", "", "", "")
+	tl.pids = map[uint16]string{53: ipn.Block}
+	u.Flow(17, 10, "10.0.0.1:3", "192.0.2.1:53", "", "", "", "", "")
+	u.OnSocketClosed(&SocketSummary{Proto: ProtoTypeTCP, ID: "t2", PID: ipn.Base, UID: "10", Target: "192.0.2.1", Rx: 1, Tx: 2, Code: 7, Msg: "seven"})
+	u.OnSocketClosed(&SocketSummary{ID: "t9", UID: "11"})
+	u.policy("10", "SetBlockCapture", "true")
+	u.policy("11", "SetBlockCapture", "true")
+
+	want := []string{UidFlowOpen, UidVerdictBlock, UidFlowClose, UidPolicyChange}
+	if got := ul.kinds(t, len(want)); len(got) != len(want) {
+		t.Fatalf("uidwatch: kinds %v; want %v", got, want)
+	} else {
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("uidwatch: kinds %v; want %v", got, want)
+				break
+			}
+		}
+	}
+	evs := ul.events()
+	if ev := evs[0]; ev.UID != "10" || ev.Proto != ProtoTypeTCP || ev.CID != "t2" || ev.PID != ipn.Base || ev.Domains != "a.test" || ev.At <= 0 {
+		t.Errorf("uidwatch: open: %+v", ev)
+	}
+	if ev := evs[1]; ev.Proto != ProtoTypeUDP || ev.PID != ipn.Block {
+		t.Errorf("uidwatch: block: %+v", ev)
+	}
+	if ev := evs[2]; ev.CID != "t2" || ev.Rx != 1 || ev.Tx != 2 || ev.Code != 7 || ev.Msg != "seven" {
+		t.Errorf("uidwatch: close: %+v", ev)
+	}
+	if ev := evs[3]; ev.Policy != "SetBlockCapture" || ev.Value != "true" {
+		t.Errorf("uidwatch: policy: %+v", ev)
+	}
+	// and all calls pass through
+	if n := tl.n.Load(); n != 3 {
+		t.Errorf("uidwatch: %d flows passed through; want 3", n)
+	}
+	if n := len(tl.smms); n != 2 {
+		t.Errorf("uidwatch: %d summaries passed through; want 2", n)
+	}
+}
+
+func TestUidWatchProxyChange(t *testing.T) {
+	u, tl, ul := newTestUidWatches("wg0")
+	w, err := u.watch("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Unwatch()
+
+	flow := func(pid string) {
+		tl.pid = pid
+		u.Flow(6, 10, "10.0.0.1:1", "192.0.2.1:443", "", "", "", "", "")
+	}
+	flow("wg0")
+	flow("wg0")
+	flow(ipn.Block) // blocks and deferrals are not a change of proxy
+	flow("wg1")
+	flow(ipn.Defer)
+	flow("wg1")
+
+	want := []string{UidFlowOpen, UidFlowOpen, UidVerdictBlock, UidProxyChange, UidFlowOpen, UidFlowOpen, UidFlowOpen}
+	got := ul.kinds(t, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("uidwatch: kinds %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("uidwatch: kinds %v; want %v", got, want)
+		}
+	}
+	if ev := ul.events()[3]; ev.PID != "wg1" || ev.Prev != "wg0" {
+		t.Errorf("uidwatch: proxy change: %+v", ev)
+	}
+
+	// proxies are forgotten once the uid is no longer watched
+	w.Unwatch()
+	if _, ok := u.pids["10"]; ok {
+		t.Error("uidwatch: proxy of an unwatched uid remains")
+	}
+}
+
+func TestUidWatchDropsOldest(t *testing.T) {
+	u, _, ul := newTestUidWatches(ipn.Base)
+	ul.hold = make(chan struct{})
+	w, err := u.watch("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Unwatch()
+
+	const extra = 10
+	// the first is taken off the queue, and held in delivery
+	u.policy("10", "p", "0")
+	eventually(t, 5*time.Second, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.q) == 0
+	}, "uidwatch: first event not dequeued")
+	for i := range uidWatchQueue + extra {
+		u.policy("10", "p", strconv.Itoa(i+1))
+	}
+	close(ul.hold)
+
+	var evs []*UidEvent
+	eventually(t, 5*time.Second, func() bool {
+		evs = ul.events()
+		return len(evs) >= 1+uidWatchQueue
+	}, "uidwatch: want %d events", 1+uidWatchQueue)
+	if len(evs) != 1+uidWatchQueue {
+		t.Fatalf("uidwatch: %d events; want %d", len(evs), 1+uidWatchQueue)
+	}
+	// the oldest were dropped, and counted by the next one delivered
+	if ev := evs[1]; ev.Value != strconv.Itoa(extra+1) || ev.Dropped != extra {
+		t.Errorf("uidwatch: after drops: %+v; want value %d, dropped %d", ev, extra+1, extra)
+	}
+	if ev := evs[2]; ev.Dropped != 0 {
+		t.Errorf("uidwatch: dropped %d again", ev.Dropped)
+	}
+	if ev := evs[len(evs)-1]; ev.Value != strconv.Itoa(uidWatchQueue+extra) {
+		t.Errorf("uidwatch: last: %+v", ev)
+	}
+}
+
+func TestUidWatchUnwatch(t *testing.T) {
+	u, _, ul := newTestUidWatches(ipn.Base)
+	w1, _ := u.watch("10")
+	w2, err := u.watch("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.policy("10", "p", "1")
+	if got := ul.kinds(t, 2); len(got) != 2 {
+		t.Fatalf("uidwatch: two watches: %v", got)
+	}
+
+	w1.Unwatch()
+	u.policy("10", "p", "2")
+	ul.kinds(t, 3)
+	w2.Unwatch()
+	u.policy("10", "p", "3")
+	time.Sleep(50 * time.Millisecond)
+	if n := len(ul.events()); n != 3 {
+		t.Errorf("uidwatch: %d events; want 3, none after unwatch", n)
+	}
+}
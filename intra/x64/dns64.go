@@ -62,12 +62,18 @@ type dns64 struct {
 	ip64 map[string][]*net.IPNet
 	// dns-resolver -> unique nat64-ips
 	uniqIP64 map[string]map[string]struct{}
+	// dns-resolver -> transport, to rediscover nat64-ips on link changes
+	rs map[string]dnsx.Transport
+	// dns-resolver -> times it was added or removed; see: AddResolver
+	gen map[string]uint64
 }
 
 func newDns64() *dns64 {
 	x := &dns64{
 		ip64:     make(map[string][]*net.IPNet),
 		uniqIP64: make(map[string]map[string]struct{}),
+		rs:       make(map[string]dnsx.Transport),
+		gen:      make(map[string]uint64),
 	}
 	go x.init()
 	return x
@@ -99,31 +105,64 @@ func (d *dns64) register(id string) {
 }
 
 func (d *dns64) AddResolver(id string, r dnsx.Transport) bool {
+	d.Lock()
+	d.gen[id]++
+	gen := d.gen[id]
+	d.rs[id] = r
+	d.Unlock()
+
+	return d.discover(id, r, gen)
+}
+
+// discover sets nat64 prefixes of id to those r answers with, unless id
+// was added (or removed) again since gen.
+func (d *dns64) discover(id string, r dnsx.Transport, gen uint64) bool {
+	ips, err := d.query(id, r)
+
+	// prefixes of resolvers replaced (or removed) since are stale; and
+	// those of id are kept till r's are in, lest queries go without
+	d.Lock()
+	stale := d.gen[id] != gen
+	d.Unlock()
+	if stale {
+		log.I("dns64: resolver %s replaced; discard its ip64 (%d)", id, len(ips))
+		return false
+	}
 	d.register(id)
+	if err != nil {
+		return false
+	}
+	if err := d.add(id, ips); err != nil {
+		return false
+	}
+	return true
+}
 
+// query returns nat64 ips of ipv4only.arpa as answered by r.
+func (d *dns64) query(id string, r dnsx.Transport) ([]net.IP, error) {
 	discarded := new(x.DNSSummary)
 	b, err := r.Query(dnsx.NetTypeUDP, arpa64, discarded)
 	if err != nil {
 		log.W("dns64: udp: could not query resolver %s", id)
-		return false
+		return nil, err
 	}
 
 	ans := &dns.Msg{}
 	err = ans.Unpack(b)
 	if err != nil {
-		return false
+		return nil, err
 	} else if ans.Truncated { // should never be the case for DOH, ODOH, DOT
 		// else if: returned response is truncated dns ans, retry over tcp
 		b, err = r.Query(dnsx.NetTypeTCP, arpa64, discarded)
 		if err != nil {
 			log.W("dns64: tcp: could not query resolver %s", id)
-			return false
+			return nil, err
 		}
 		ans = &dns.Msg{}
 		err = ans.Unpack(b)
 		if err != nil {
 			log.W("dns64: tcp: invalid response from resolver %s", id)
-			return false
+			return nil, err
 		}
 	}
 
@@ -135,11 +174,7 @@ func (d *dns64) AddResolver(id string, r dnsx.Transport) bool {
 			}
 		}
 	}
-
-	if err := d.add(id, ips); err != nil {
-		return false
-	}
-	return true
+	return ips, nil
 }
 
 func (d *dns64) RemoveResolver(id string) bool {
@@ -147,9 +182,39 @@ func (d *dns64) RemoveResolver(id string) bool {
 	defer d.Unlock()
 	delete(d.ip64, id)
 	delete(d.uniqIP64, id)
+	delete(d.rs, id)
+	d.gen[id]++
 	return true
 }
 
+// rediscover re-runs nat64 prefix discovery on all resolvers, as
+// prefixes discovered on the previous link may not hold.
+func (d *dns64) rediscover() {
+	type reg struct {
+		r   dnsx.Transport
+		gen uint64
+	}
+	d.Lock()
+	rs := make(map[string]reg, len(d.rs))
+	for id, r := range d.rs {
+		rs[id] = reg{r, d.gen[id]}
+	}
+	// overlay prefixes are only ever overwritten on success
+	delete(d.ip64, dnsx.OverlayResolver)
+	delete(d.uniqIP64, dnsx.OverlayResolver)
+	d.Unlock()
+
+	d.init()
+	n := 0
+	for id, x := range rs {
+		// resolvers added (or removed) in the meantime are left be
+		if d.discover(id, x.r, x.gen) {
+			n++
+		}
+	}
+	log.I("dns64: rediscover: %d/%d resolvers have nat64 prefixes", n, len(rs))
+}
+
 // TODO: handle svcb/https ipv4hint/ipv6hint
 // datatracker.ietf.org/doc/html/draft-ietf-dnsop-svcb-https-10#section-7.4
 func (d *dns64) eval(id string, force64 bool, og []byte, r dnsx.Transport) []byte {
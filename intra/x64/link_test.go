@@ -0,0 +1,117 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package x64
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	x "github.com/celzero/firestack/intra/backend"
+	"github.com/celzero/firestack/intra/core"
+	"github.com/celzero/firestack/intra/dialers"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/miekg/dns"
+)
+
+// underlay answers A queries with 1.2.3.4; and ipv4only.arpa with the
+// well-known nat64 prefix only while v6 is set, as on a v6-only network.
+type underlay struct {
+	v6 atomic.Bool
+}
+
+func (*underlay) ID() string      { return dnsx.UnderlayResolver }
+func (*underlay) Type() string    { return dnsx.DNS53 }
+func (*underlay) P50() int64      { return 0 }
+func (*underlay) GetAddr() string { return "" }
+func (*underlay) Status() int     { return dnsx.Complete }
+
+func (u *underlay) Query(_ string, q []byte, smm *x.DNSSummary) ([]byte, error) {
+	msg := xdns.AsMsg(q)
+	ans := new(dns.Msg)
+	ans.SetReply(msg)
+	qq := msg.Question[0]
+	switch {
+	case qq.Name == dnsx.Rfc7050WKN && qq.Qtype == dns.TypeAAAA:
+		if u.v6.Load() {
+			ans.Answer = append(ans.Answer, xdns.MakeAAAARecord(qq.Name, "64:ff9b::c000:aa", 60))
+		}
+	case qq.Qtype == dns.TypeA:
+		ans.Answer = append(ans.Answer, xdns.MakeARecord(qq.Name, "1.2.3.4", 60))
+	}
+	smm.Status = dnsx.Complete
+	return ans.Pack()
+}
+
+// synth64 returns the aaaa synthesized for an aaaa query with no answers.
+func synth64(t *testing.T, pt dnsx.NatPt, u *underlay) netip.Addr {
+	q := new(dns.Msg)
+	q.SetQuestion("v4only.example.", dns.TypeAAAA)
+	ans := new(dns.Msg)
+	ans.SetReply(q)
+	b, _ := ans.Pack()
+	d64 := pt.D64(dnsx.UnderlayResolver, b, u)
+	if len(d64) <= 0 {
+		t.Fatal("link: no aaaa synthesized")
+	}
+	ips := xdns.AAAAAnswer(xdns.AsMsg(d64))
+	if len(ips) != 1 {
+		t.Fatalf("link: want 1 aaaa, got %v", ips)
+	}
+	return *ips[0]
+}
+
+func TestLinkChange64(t *testing.T) {
+	pt := NewNatPt(&settings.TunMode{PtMode: settings.PtModeAuto})
+	o, ok := pt.(core.LinkObserver)
+	if !ok {
+		t.Fatal("link: natpt does not observe link changes")
+	}
+	defer core.ObserveLink(o)()
+
+	u := new(underlay)
+	u.v6.Store(true)
+	if !pt.Add64(dnsx.UnderlayResolver, u) {
+		t.Fatal("link: no nat64 prefix on the v6 link")
+	}
+	on6 := netip.MustParseAddr("64:ff9b::102:304")
+	if got := synth64(t, pt, u); got != on6 {
+		t.Fatalf("link: v6: want %s, got %s", on6, got)
+	}
+
+	core.LinkChanged(core.Link{L3: settings.IP6})
+	if dialers.Use4() || !dialers.Use6() {
+		t.Errorf("link: v6: use4? %t, use6? %t", dialers.Use4(), dialers.Use6())
+	}
+
+	// the network no longer has nat64; synthesis falls back to the
+	// local 464 prefix once the underlay's prefix is rediscovered
+	u.v6.Store(false)
+	core.LinkChanged(core.Link{L3: settings.IP4})
+	if !dialers.Use4() || dialers.Use6() {
+		t.Errorf("link: v4: use4? %t, use6? %t", dialers.Use4(), dialers.Use6())
+	}
+
+	on4 := netip.MustParseAddr("64:ff9b:1:fffe::102:304")
+	var got netip.Addr
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if got = synth64(t, pt, u); got == on4 {
+			break
+		}
+	}
+	if got != on4 {
+		t.Errorf("link: v4: want %s, got %s", on4, got)
+	}
+
+	core.LinkChanged(core.Link{L3: settings.IP46})
+	if !dialers.Use4() || !dialers.Use6() {
+		t.Errorf("link: v46: use4? %t, use6? %t", dialers.Use4(), dialers.Use6())
+	}
+}
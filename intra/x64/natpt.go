@@ -9,9 +9,11 @@ package x64
 import (
 	"net"
 
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/dnsx"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/xdns"
 )
 
 // app    |  interface  |  pt        |  who    |  internet?
@@ -38,6 +40,7 @@ type natPt struct {
 }
 
 var _ dnsx.NatPt = (*natPt)(nil)
+var _ core.LinkObserver = (*natPt)(nil)
 
 // NewNatPt returns a new NatPt.
 func NewNatPt(tunmode *settings.TunMode) dnsx.NatPt {
@@ -103,6 +106,25 @@ func (n *natPt) X64(id string, rawip6 []byte) []byte {
 	return nil
 }
 
+// S64 Implements NAT64.
+func (n *natPt) S64(id string, rawip4 []byte) []byte {
+	ip4 := net.IP(rawip4).To4()
+	if ip4 == nil {
+		log.D("natpt: s64: ip4(%v) len(%d) != 4", rawip4, len(rawip4))
+		return nil
+	}
+
+	n.dns64.RLock()
+	prefixes := n.nat64PrefixForResolver(id)
+	n.dns64.RUnlock()
+
+	if len(prefixes) <= 0 {
+		log.D("natpt: s64: no prefix64 found for resolver(%s)", id)
+		return nil
+	}
+	return xdns.IP4to6(prefixes[0], ip4)
+}
+
 // Add64 implements DNS64.
 func (h *natPt) Add64(id string, f dnsx.Transport) bool {
 	return h.dns64.AddResolver(id, f)
@@ -126,6 +148,12 @@ func (n *natPt) ResetNat64Prefix(ip6prefix string) bool {
 	return false
 }
 
+// OnLinkChange implements core.LinkObserver.
+func (n *natPt) OnLinkChange(l core.Link) {
+	log.I("natpt: link: %s; rediscover nat64 prefixes", l.L3)
+	go n.dns64.rediscover()
+}
+
 // Returns the first matching local-interface net.IP for the network
 func (n *natPt) UIP(network string) []byte {
 	switch network {
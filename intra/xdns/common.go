@@ -32,9 +32,21 @@ const (
 	XChacha20Poly1305
 )
 
+const (
+	// SVCBBlockNoData answers blocked svcb and https queries with no records
+	SVCBBlockNoData = iota
+	// SVCBBlockFakeTarget answers blocked svcb and https queries with a record
+	// that points to a fake domain, which resolves to the unspecified ip
+	SVCBBlockFakeTarget
+	// SVCBBlockDotTarget answers blocked svcb and https queries with a record
+	// that points to "." (the owner name itself), with no hints
+	SVCBBlockDotTarget
+)
+
 const (
 	ClientMagicLen     = 8
 	blocklistHeaderKey = "x-nile-flags" // "x-bl-fl"
+	edns0PadHeaderLen  = 2 + 2          // option-code, option-length; rfc7830
 )
 
 var (
@@ -19,9 +19,13 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"unicode/utf8"
 
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/miekg/dns"
 )
@@ -98,6 +102,29 @@ func EmptyResponseFromMessage(srcMsg *dns.Msg) *dns.Msg {
 	return &dstMsg
 }
 
+// RcodeResponseFromMessage returns an answer to srcMsg with rcode, and
+// with at most its first question; srcMsg may have no questions at all.
+func RcodeResponseFromMessage(srcMsg *dns.Msg, rcode int) *dns.Msg {
+	if srcMsg == nil {
+		return nil
+	}
+	dstMsg := new(dns.Msg)
+	dstMsg.SetRcode(srcMsg, rcode) // copies id, opcode, and the first question
+	dstMsg.RecursionAvailable = srcMsg.RecursionDesired
+	return dstMsg
+}
+
+// StripExtraQuestions removes all but the first question from msg;
+// returns the number of questions removed.
+func StripExtraQuestions(msg *dns.Msg) int {
+	if msg == nil || len(msg.Question) <= 1 {
+		return 0
+	}
+	n := len(msg.Question) - 1
+	msg.Question = msg.Question[:1]
+	return n
+}
+
 func TruncatedResponse(packet []byte) ([]byte, error) {
 	if len(packet) <= 0 {
 		return nil, errNoAns
@@ -165,6 +192,35 @@ func WithTtl(msg *dns.Msg, secs uint32) (ok bool) {
 	return ok
 }
 
+// ClampTTL clamps ttls of all records in the answer and authority sections
+// of msg to [lo, hi], and returns true if any ttl was changed; hi of 0 sets
+// no upper bound. lo is lowered to hi, if it is higher.
+func ClampTTL(msg *dns.Msg, lo, hi uint32) (ok bool) {
+	if msg == nil || (lo <= 0 && hi <= 0) {
+		return ok
+	}
+	if hi > 0 && lo > hi {
+		lo = hi
+	}
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range sec {
+			h := rr.Header()
+			if h == nil || h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := max(h.Ttl, lo)
+			if hi > 0 {
+				ttl = min(ttl, hi)
+			}
+			if ttl != h.Ttl {
+				h.Ttl = ttl
+				ok = true
+			}
+		}
+	}
+	return ok
+}
+
 func RTtl(msg *dns.Msg) int {
 	maxttl := uint32(0)
 	if msg == nil || !HasAnyAnswer(msg) {
@@ -182,183 +238,322 @@ func RTtl(msg *dns.Msg) int {
 	return int(maxttl)
 }
 
-func GetInterestingRData(msg *dns.Msg) string {
+// RData is the interesting data of an answer; see: InterestingRData.
+type RData struct {
+	// IPs of A and AAAA answers, in order, followed by ipv4 and ipv6
+	// hints of svcb and https answers, if any.
+	IPs []netip.Addr
+	// Primary is the main field (ex: the target of a SRV, the exchange of
+	// a MX, the params of a svcb sans hints) of the first answer that has
+	// one; empty if there are IPs.
+	Primary string
+	// Rtype is the type of the first answer IPs are from, or of the
+	// answer Primary is from; 0 if neither.
+	Rtype uint16
+}
+
+// InterestingRData returns the ips in msg, if any; or else, the primary
+// field of its first answer that has one. Address records (and hints)
+// always take precedence over other types, wherever they are in msg.
+func InterestingRData(msg *dns.Msg) (d RData) {
 	if msg == nil {
-		return "--"
-	}
-	var ipcsv string
-	ip4s := IPHints(msg, dns.SVCB_IPV4HINT)
-	ip6s := IPHints(msg, dns.SVCB_IPV6HINT)
-	data := make([]string, 0)
-	if len(ip4s) > 0 {
-		data = append(data, netips2str(ip4s)...)
-	}
-	if len(ip6s) > 0 {
-		data = append(data, netips2str(ip6s)...)
-	}
-	if len(data) > 0 {
-		ipcsv += strings.Join(data, ",")
-		log.D("dnsutil: RData: %s", ipcsv)
+		return
 	}
+	n := 0
 	for _, a := range msg.Answer {
 		switch r := a.(type) {
-		case *dns.A:
-			if len(ipcsv) > 0 {
-				ipcsv += "," + ip2str(r.A)
-			} else {
-				ipcsv += ip2str(r.A)
-			}
-		case *dns.AAAA:
-			if len(ipcsv) > 0 {
-				ipcsv += "," + ip2str(r.AAAA)
-			} else {
-				ipcsv += ip2str(r.AAAA)
-			}
-		case *dns.NS:
-			return r.Ns
-		case *dns.TXT:
-			if len(r.Txt) > 0 {
-				return r.Txt[0]
-			}
-			return r.String()
-		case *dns.SOA:
-			return r.Mbox
-		case *dns.HINFO:
-			return r.Os
-		case *dns.SRV:
-			return r.Target
-		case *dns.CAA:
-			return r.Value
-		case *dns.MX:
-			return r.Mx
-		case *dns.RP:
-			return r.Mbox
-		case *dns.DNSKEY:
-			return r.PublicKey
-		case *dns.DS:
-			return r.Digest
-		case *dns.RRSIG:
-			return r.SignerName
+		case *dns.A, *dns.AAAA:
+			n++
 		case *dns.SVCB:
-			// if no hints, simply dump the entire kv list
-			if len(ip4s) <= 0 && len(ip6s) <= 0 {
-				if len(ipcsv) > 0 {
-					ipcsv += "," + r.String()
-				} else {
-					log.V("dnsutil: RData: svcb(%s)", r.String())
-					return svcbstr(r)
-				}
-			} else {
-				log.D("dnsutil: RData: ignored svcb(%s) for ipcsv(%s)", r.String(), ipcsv)
-			}
-			continue
+			n += nhints(r.Value)
 		case *dns.HTTPS:
-			// if no hints, simply dump the entire kv list
-			if len(ip4s) <= 0 && len(ip6s) <= 0 {
-				if len(ipcsv) > 0 {
-					ipcsv += "," + r.String()
-				} else {
-					log.V("dnsutil: RData: https(%s)", r.String())
-					return httpsstr(r)
-				}
-			} else {
-				log.D("dnsutil: RData: ignored https(%s) for ipcsv(%s)", r.String(), ipcsv)
-			}
-			continue
-		case *dns.NSEC:
-			return r.NextDomain
-		case *dns.NSEC3:
-			return r.NextDomain
-		case *dns.NSEC3PARAM:
-			return r.Salt
-		case *dns.TLSA:
-			return r.Certificate
-		case *dns.OPT:
-			if len(ipcsv) > 0 {
-				ipcsv += "," + r.String()
-			} else {
-				return r.String()
-			}
-		case *dns.APL:
-			if len(ipcsv) > 0 {
-				ipcsv += "," + r.String()
-			} else {
-				return r.String()
-			}
-		case *dns.SSHFP:
-			return r.FingerPrint
-		case *dns.DNAME:
-			return r.Target
-		case *dns.NAPTR:
-			return r.Service
-		case *dns.CERT:
-			return r.Certificate
-		case *dns.DLV:
-			return r.Digest
-		case *dns.DHCID:
-			return r.Digest
-		case *dns.SMIMEA:
-			return r.Certificate
-		case *dns.NINFO:
-			var str string
-			if len(r.ZSData) > 0 {
-				str = r.ZSData[0]
-			} else {
-				str = r.String()
-			}
-			if len(ipcsv) > 0 {
-				ipcsv += "," + str
-			} else {
-				return str
+			n += nhints(r.Value)
+		}
+	}
+	if n > 0 {
+		d.IPs = make([]netip.Addr, 0, n)
+		for _, a := range msg.Answer { // address records first
+			var ip net.IP
+			switch r := a.(type) {
+			case *dns.A:
+				ip = r.A
+			case *dns.AAAA:
+				ip = r.AAAA
+			default:
+				continue
 			}
-		case *dns.RKEY:
-			return r.PublicKey
-		case *dns.TKEY:
-			return r.OtherData
-		case *dns.TSIG:
-			return r.OtherData
-		case *dns.URI:
-			return r.Target
-		case *dns.HIP:
-			return r.PublicKey
-		case *dns.CDS:
-			return r.Digest
-		case *dns.OPENPGPKEY:
-			return r.PublicKey
-		case *dns.SPF:
-			var str string
-			if len(r.Txt) > 0 {
-				return r.Txt[0]
-			} else {
-				str = r.String()
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				d.IPs = append(d.IPs, addr.Unmap())
+				if d.Rtype == 0 {
+					d.Rtype = a.Header().Rrtype
+				}
 			}
-			if len(ipcsv) > 0 {
-				ipcsv += "," + str
-			} else {
-				return str
+		}
+		for _, x := range []dns.SVCBKey{dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT} {
+			for _, a := range msg.Answer { // then hints
+				var kvs []dns.SVCBKeyValue
+				switch r := a.(type) {
+				case *dns.SVCB:
+					kvs = r.Value
+				case *dns.HTTPS:
+					kvs = r.Value
+				default:
+					continue
+				}
+				if m := len(d.IPs); appendHints(&d.IPs, kvs, x) && m == 0 {
+					d.Rtype = a.Header().Rrtype
+				}
 			}
-		case *dns.NSAPPTR:
-			return r.Ptr
-		case *dns.TALINK:
-			return r.NextName
-		case *dns.CSYNC:
-			if len(ipcsv) > 0 {
-				ipcsv += "," + r.String()
-			} else {
-				return r.String()
+		}
+		if len(d.IPs) > 0 {
+			return
+		}
+	}
+	for _, a := range msg.Answer {
+		if s, ok := primaryRData(a); ok {
+			d.Primary = s
+			d.Rtype = a.Header().Rrtype
+			return
+		}
+	}
+	return
+}
+
+const (
+	// DefaultMaxRDataIPs is the default number of ips in RData.String.
+	DefaultMaxRDataIPs = 16
+	// DefaultMaxCsvLen is the default length in bytes of csvs capped by CapCsv.
+	DefaultMaxCsvLen = 1024
+)
+
+var (
+	maxrdataips atomic.Int32 // 0 is DefaultMaxRDataIPs
+	maxcsvlen   atomic.Int32 // 0 is DefaultMaxCsvLen
+)
+
+// SetSummaryCaps sets the number of ips in RData.String to ips, and the
+// length of csvs capped by CapCsv to csvlen; or resets either to its
+// default, if not positive. Answers with hundreds of records otherwise
+// make for callbacks (summaries, flows) too large to cross over to the
+// client.
+func SetSummaryCaps(ips, csvlen int) {
+	maxrdataips.Store(int32(max(ips, 0)))
+	maxcsvlen.Store(int32(max(csvlen, 0)))
+	log.I("dnsutil: summary caps: ips %d, csv %d", ips, csvlen)
+}
+
+func maxRDataIPs() int {
+	if n := maxrdataips.Load(); n > 0 {
+		return int(n)
+	}
+	return DefaultMaxRDataIPs
+}
+
+// more appends "+k more" to b, for k values left out.
+func more(b []byte, k int) []byte {
+	b = append(b, '+')
+	b = strconv.AppendInt(b, int64(k), 10)
+	return append(b, " more"...)
+}
+
+// CapCsv returns csv as-is if it is no longer than the cap (see:
+// SetSummaryCaps); or else, as many of its leading values as fit, in
+// order, followed by "+k more" for the k values left out, all within it.
+func CapCsv(csv string) string {
+	n := DefaultMaxCsvLen
+	if m := maxcsvlen.Load(); m > 0 {
+		n = int(m)
+	}
+	return capcsv(csv, n)
+}
+
+func capcsv(csv string, n int) string {
+	if len(csv) <= n {
+		return csv
+	}
+	total := strings.Count(csv, ",") + 1
+	end, kept := 0, 0 // csv[:end] of kept values fits, with the suffix
+	for kept < total {
+		start := end
+		if kept > 0 {
+			start++ // skip the comma
+		}
+		next := len(csv)
+		if i := strings.IndexByte(csv[start:], ','); i >= 0 {
+			next = start + i
+		}
+		// len(",+k more") for the values left out, if csv[:next] is kept
+		suffix := len(",+ more") + len(strconv.Itoa(total-kept-1))
+		if next+suffix > n {
+			break
+		}
+		end, kept = next, kept+1
+	}
+	if kept <= 0 {
+		b := more(nil, total)
+		return string(b[:min(len(b), n)])
+	}
+	b := make([]byte, 0, n)
+	b = append(b, csv[:end]...)
+	b = append(b, ',')
+	return string(more(b, total-kept))
+}
+
+// String returns a csv of ips in d, if any, capped to the first few (see:
+// SetSummaryCaps) and "+k more" for the k left out; or else, its primary
+// field; "--" if neither.
+func (d RData) String() string {
+	if len(d.IPs) > 0 {
+		n := min(len(d.IPs), maxRDataIPs())
+		b := make([]byte, 0, n*16+len(",+ more")+4)
+		for i, ip := range d.IPs[:n] {
+			if i > 0 {
+				b = append(b, ',')
 			}
-		case *dns.ZONEMD:
-			return r.Digest
-		default:
-			// no-op
-			continue
+			b = ip.AppendTo(b)
+		}
+		if k := len(d.IPs) - n; k > 0 {
+			b = more(append(b, ','), k)
 		}
+		return string(b)
 	}
-	if len(ipcsv) > 0 {
-		return strings.TrimSuffix(ipcsv, ",")
-	} else {
-		return "--"
+	if len(d.Primary) > 0 {
+		return d.Primary
 	}
+	return "--"
+}
+
+// GetInterestingRData returns InterestingRData of msg as a string.
+func GetInterestingRData(msg *dns.Msg) string {
+	return InterestingRData(msg).String()
+}
+
+// nhints returns the number of ip hints in kvs.
+func nhints(kvs []dns.SVCBKeyValue) (n int) {
+	for _, kv := range kvs {
+		switch h := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			n += len(h.Hint)
+		case *dns.SVCBIPv6Hint:
+			n += len(h.Hint)
+		}
+	}
+	return
+}
+
+// appendHints appends ip hints of type x in kvs to ips, and returns true
+// if any were.
+func appendHints(ips *[]netip.Addr, kvs []dns.SVCBKeyValue, x dns.SVCBKey) (ok bool) {
+	for _, kv := range kvs {
+		if kv.Key() != x {
+			continue
+		}
+		var hints []net.IP
+		switch h := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			hints = h.Hint
+		case *dns.SVCBIPv6Hint:
+			hints = h.Hint
+		}
+		for _, ip := range hints {
+			if addr, aok := netip.AddrFromSlice(ip); aok {
+				*ips = append(*ips, addr.Unmap())
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+// primaryRData returns the main field of rr, if it has one; address
+// records have none, as their ips are collected by InterestingRData.
+func primaryRData(rr dns.RR) (string, bool) {
+	switch r := rr.(type) {
+	case *dns.NS:
+		return r.Ns, true
+	case *dns.TXT:
+		if len(r.Txt) > 0 {
+			return r.Txt[0], true
+		}
+		return r.String(), true
+	case *dns.SPF:
+		if len(r.Txt) > 0 {
+			return r.Txt[0], true
+		}
+		return r.String(), true
+	case *dns.SOA:
+		return r.Mbox, true
+	case *dns.HINFO:
+		return r.Os, true
+	case *dns.SRV:
+		return r.Target, true
+	case *dns.CAA:
+		return r.Value, true
+	case *dns.MX:
+		return r.Mx, true
+	case *dns.RP:
+		return r.Mbox, true
+	case *dns.DNSKEY:
+		return r.PublicKey, true
+	case *dns.DS:
+		return r.Digest, true
+	case *dns.RRSIG:
+		return r.SignerName, true
+	case *dns.SVCB: // sans hints, or they'd be in ips
+		return svcbstr(r), true
+	case *dns.HTTPS:
+		return httpsstr(r), true
+	case *dns.NSEC:
+		return r.NextDomain, true
+	case *dns.NSEC3:
+		return r.NextDomain, true
+	case *dns.NSEC3PARAM:
+		return r.Salt, true
+	case *dns.TLSA:
+		return r.Certificate, true
+	case *dns.SSHFP:
+		return r.FingerPrint, true
+	case *dns.DNAME:
+		return r.Target, true
+	case *dns.NAPTR:
+		return r.Service, true
+	case *dns.CERT:
+		return r.Certificate, true
+	case *dns.DLV:
+		return r.Digest, true
+	case *dns.DHCID:
+		return r.Digest, true
+	case *dns.SMIMEA:
+		return r.Certificate, true
+	case *dns.NINFO:
+		if len(r.ZSData) > 0 {
+			return r.ZSData[0], true
+		}
+		return r.String(), true
+	case *dns.RKEY:
+		return r.PublicKey, true
+	case *dns.TKEY:
+		return r.OtherData, true
+	case *dns.TSIG:
+		return r.OtherData, true
+	case *dns.URI:
+		return r.Target, true
+	case *dns.HIP:
+		return r.PublicKey, true
+	case *dns.CDS:
+		return r.Digest, true
+	case *dns.OPENPGPKEY:
+		return r.PublicKey, true
+	case *dns.NSAPPTR:
+		return r.Ptr, true
+	case *dns.TALINK:
+		return r.NextName, true
+	case *dns.ZONEMD:
+		return r.Digest, true
+	case *dns.OPT, *dns.APL, *dns.CSYNC:
+		return rr.String(), true
+	}
+	return "", false
 }
 
 func Targets(msg *dns.Msg) (targets []string) {
@@ -470,6 +665,73 @@ func AddEDNS0PaddingIfNoneFound(msg *dns.Msg, unpaddedPacket []byte, paddingLen
 	return msg.Pack()
 }
 
+// AddEDNS0PaddingToBlock pads msg with an edns0 padding option (rfc7830) so
+// that it packs to a multiple of block bytes (rfc8467), but to no more than
+// limit bytes (ex: the udp size it advertises); it is padded up to limit if
+// the next multiple is past it, and left as-is if not even the option fits
+// within limit, or if it is truncated, or already padded. Returns msg packed.
+func AddEDNS0PaddingToBlock(msg *dns.Msg, block, limit int) ([]byte, error) {
+	if msg == nil {
+		return nil, errNoDns
+	}
+	if block <= 0 || msg.Truncated {
+		return msg.Pack()
+	}
+	added := false
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+		if edns0 = msg.IsEdns0(); edns0 == nil {
+			return msg.Pack()
+		}
+		added = true
+	}
+	for _, option := range edns0.Option {
+		if option.Option() == dns.EDNS0PADDING {
+			return msg.Pack()
+		}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = dns.MaxMsgSize
+	}
+	sz := len(b) + edns0PadHeaderLen
+	want := min(((sz+block-1)/block)*block, limit)
+	if want < sz { // padding overflows limit
+		if added {
+			msg.Extra = msg.Extra[:len(msg.Extra)-1] // SetEdns0 appends
+			return msg.Pack()
+		}
+		return b, nil
+	}
+	edns0.Option = append(edns0.Option, &dns.EDNS0_PADDING{Padding: make([]byte, want-sz)})
+	return msg.Pack()
+}
+
+// RemoveEDNS0Padding removes edns0 padding options from msg, if any, and
+// returns true if it did.
+func RemoveEDNS0Padding(msg *dns.Msg) bool {
+	if msg == nil {
+		return false
+	}
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return false
+	}
+	opts := edns0.Option[:0]
+	for _, option := range edns0.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			opts = append(opts, option)
+		}
+	}
+	removed := len(opts) != len(edns0.Option)
+	edns0.Option = opts
+	return removed
+}
+
 func BlockResponseFromMessage(q []byte) (*dns.Msg, error) {
 	r := &dns.Msg{}
 	if err := r.Unpack(q); err != nil {
@@ -478,7 +740,16 @@ func BlockResponseFromMessage(q []byte) (*dns.Msg, error) {
 	return RefusedResponseFromMessage(r)
 }
 
+// RefusedResponseFromMessage returns a blocked answer to srcMsg; svcb and
+// https questions are answered NODATA.
 func RefusedResponseFromMessage(srcMsg *dns.Msg) (dstMsg *dns.Msg, err error) {
+	return RefusedResponseWithMode(srcMsg, SVCBBlockNoData)
+}
+
+// RefusedResponseWithMode returns a blocked answer to srcMsg; svcb and https
+// questions are answered as per svcbmode (SVCBBlockNoData, SVCBBlockFakeTarget,
+// SVCBBlockDotTarget); NODATA if unknown.
+func RefusedResponseWithMode(srcMsg *dns.Msg, svcbmode int) (dstMsg *dns.Msg, err error) {
 	if srcMsg == nil {
 		return nil, errNoDns
 	}
@@ -530,6 +801,20 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg) (dstMsg *dns.Msg, err error) {
 		dstMsg.Answer = nil
 		// NOEXTRA datatracker.ietf.org/doc/draft-ietf-dnsop-svcb-https/11 pg 16 sec 4.2
 		dstMsg.Extra = nil
+		switch svcbmode {
+		case SVCBBlockFakeTarget:
+			// clients that honour svcb connect to fakedomain, which
+			// resolves to the unspecified ip
+			target := dns.Fqdn(fakedomain)
+			dstMsg.Answer = []dns.RR{svcbRecord(question, target, ttl)}
+			if a := MakeARecord(target, ip4zero.String(), int(ttl)); a != nil {
+				dstMsg.Extra = []dns.RR{a}
+			}
+		case SVCBBlockDotTarget:
+			// "." is the owner name itself, with no hints;
+			// datatracker.ietf.org/doc/draft-ietf-dnsop-svcb-https/11 sec 2.5.2
+			dstMsg.Answer = []dns.RR{svcbRecord(question, ".", ttl)}
+		}
 		sendHInfoResponse = false
 	}
 
@@ -549,6 +834,22 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg) (dstMsg *dns.Msg, err error) {
 	return
 }
 
+// svcbRecord returns a service mode svcb (or https, as per q) record for
+// q that points to target, with no params.
+func svcbRecord(q dns.Question, target string, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	svcb := dns.SVCB{Hdr: hdr, Priority: 1, Target: target}
+	if IsHTTPSQType(q.Qtype) {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
+
 func AQuadAForQuery(q *dns.Msg, ips ...netip.Addr) (a *dns.Msg, err error) {
 	if q == nil {
 		return nil, errNoDns
@@ -738,63 +1039,91 @@ func httpsstr(r *dns.HTTPS) (s string) {
 	return strings.TrimSpace(s)
 }
 
+// SubstSVCBRecordIPs replaces every ip hint of type x (ipv4hint or ipv6hint)
+// in https / svcb answers of out with a single ip from subiphints, and returns
+// true if any hint was replaced. If there are more hint key-values across all
+// answers than there are subiphints, subiphints are cycled through (the n-th
+// hint gets subiphints[n % len(subiphints)]). Nil, invalid, or subiphints of
+// the wrong ip family are ignored; if none remain, out is left untouched.
 func SubstSVCBRecordIPs(out *dns.Msg, x dns.SVCBKey, subiphints []*netip.Addr, ttl int) bool {
 	if out == nil || len(subiphints) == 0 {
 		return false
 	}
+	subs := hintsFor(x, subiphints)
+	if len(subs) == 0 {
+		log.D("dnsutil: subst svcb: no valid %s in %d subs", x, len(subiphints))
+		return false
+	}
 	// substitute ip hints in https / svcb records
-	i := 0
+	n := 0
 	for _, answer := range out.Answer {
-		switch rec := answer.(type) {
+		var rec *dns.SVCB
+		switch r := answer.(type) {
 		case *dns.SVCB:
-			for j, kv := range rec.Value {
-				k := kv.Key()
-				// replace with a single ip hint
-				if k == x && x == dns.SVCB_IPV6HINT {
-					rec.Value[j] = &dns.SVCBIPv6Hint{
-						Hint: []net.IP{subiphints[i].AsSlice()},
-					}
-					rec.Hdr.Ttl = uint32(ttl)
-					i = (i + 1) % len(subiphints)
-				} else if k == x && x == dns.SVCB_IPV4HINT {
-					rec.Value[j] = &dns.SVCBIPv4Hint{
-						Hint: []net.IP{subiphints[i].AsSlice()},
-					}
-					rec.Hdr.Ttl = uint32(ttl)
-					i = (i + 1) % len(subiphints)
-				}
-			}
+			rec = r
 		case *dns.HTTPS:
-			if rec.Priority == 0 || len(rec.Target) > 1 {
+			if r.Priority == 0 || len(r.Target) > 1 {
 				// no kv pairs to process for https records when pri is 0
 				// datatracker.ietf.org/doc/draft-ietf-dnsop-svcb-https/ section 1.2
 				continue
 			}
-			for j, kv := range rec.Value {
-				k := kv.Key()
-				// replace with a single ip hint
-				if k == x && x == dns.SVCB_IPV6HINT {
-					rec.Value[j] = &dns.SVCBIPv6Hint{
-						Hint: []net.IP{subiphints[i].AsSlice()},
-					}
-					rec.Hdr.Ttl = uint32(ttl)
-					i = (i + 1) % len(subiphints)
-				} else if k == x && x == dns.SVCB_IPV4HINT {
-					rec.Value[j] = &dns.SVCBIPv4Hint{
-						Hint: []net.IP{subiphints[i].AsSlice()},
-					}
-					rec.Hdr.Ttl = uint32(ttl)
-					i = (i + 1) % len(subiphints)
-				}
+			rec = &r.SVCB
+		default:
+			continue
+		}
+		for j, kv := range rec.Value {
+			if kv == nil || kv.Key() != x {
+				continue
+			}
+			// replace with a single ip hint
+			ip := subs[n%len(subs)]
+			if x == dns.SVCB_IPV6HINT {
+				rec.Value[j] = &dns.SVCBIPv6Hint{Hint: []net.IP{ip}}
+			} else {
+				rec.Value[j] = &dns.SVCBIPv4Hint{Hint: []net.IP{ip}}
 			}
+			rec.Hdr.Ttl = uint32(ttl)
+			n++
 		}
 	}
-	if i > 0 {
+	if n > 0 {
 		// datatracker.ietf.org/doc/draft-ietf-dnsop-svcb-https/11 pg 16 sec 4.2
 		// remove additional records, as they may further have svcb or a / aaaa records
 		out.Extra = nil
 	}
-	return i > 0
+	return n > 0
+}
+
+// hintsFor returns ips in subs that can be used as hints of type x.
+func hintsFor(x dns.SVCBKey, subs []*netip.Addr) []net.IP {
+	out := make([]net.IP, 0, len(subs))
+	for _, ip := range subs {
+		if ip == nil || !ip.IsValid() {
+			continue
+		}
+		unmapped := ip.Unmap()
+		if x == dns.SVCB_IPV4HINT && unmapped.Is4() {
+			out = append(out, unmapped.AsSlice())
+		} else if x == dns.SVCB_IPV6HINT && unmapped.Is6() {
+			out = append(out, unmapped.AsSlice())
+		}
+	}
+	return out
+}
+
+// hintIPs returns ips in kv if it is an ip hint of type x.
+func hintIPs(kv dns.SVCBKeyValue, x dns.SVCBKey) []net.IP {
+	switch h := kv.(type) {
+	case *dns.SVCBIPv4Hint:
+		if x == dns.SVCB_IPV4HINT {
+			return h.Hint
+		}
+	case *dns.SVCBIPv6Hint:
+		if x == dns.SVCB_IPV6HINT {
+			return h.Hint
+		}
+	}
+	return nil
 }
 
 func IPHints(msg *dns.Msg, x dns.SVCBKey) []*netip.Addr {
@@ -811,46 +1140,154 @@ func IPHints(msg *dns.Msg, x dns.SVCBKey) []*netip.Addr {
 	// tools.ietf.org/html/draft-ietf-dnsop-svcb-https-02#section-8.1
 	ips := []*netip.Addr{}
 	for _, answer := range msg.Answer {
-		if !(answer.Header().Rrtype == dns.TypeHTTPS) && !(answer.Header().Rrtype == dns.TypeSVCB) {
-			continue
-		}
+		var kvs []dns.SVCBKeyValue
 		switch rec := answer.(type) {
 		case *dns.SVCB:
-			for _, kv := range rec.Value {
-				log.V("dnsutil: svcb(%s): current k(%v)/v(%v)", qname, kv.Key(), kv.String())
-				if kv.Key() != x {
-					continue
-				}
-				// ipcsv may be "<nil>" or a csv of ips
-				ipcsv := kv.String()
-				for _, ipstr := range strings.Split(ipcsv, ",") {
-					if v, err := netip.ParseAddr(ipstr); err == nil {
-						ips = append(ips, &v)
-					} else {
-						log.W("dnsutil: svcb(%s): could not parse iphint %v", qname, ipstr)
-					}
+			kvs = rec.Value
+		case *dns.HTTPS:
+			kvs = rec.Value
+		default:
+			continue
+		}
+		for _, kv := range kvs {
+			for _, ip := range hintIPs(kv, x) {
+				if v, ok := core.IPFromSlice(ip); ok {
+					ips = append(ips, &v)
+				} else {
+					log.W("dnsutil: svcb/https(%s): could not parse iphint %v", qname, ip)
 				}
 			}
+		}
+	}
+	log.D("dnsutil: svcb/https(%s): ip hints %v from %d answers", qname, ips, len(msg.Answer))
+	return ips
+}
+
+// ALPNs returns distinct alpn ids (ex: h3, h2) advertised
+// by https / svcb answers in msg, in order of appearance.
+func ALPNs(msg *dns.Msg) []string {
+	if msg == nil {
+		return nil
+	}
+	if !HasSVCBQuestion(msg) && !HasHTTPQuestion(msg) {
+		return nil
+	}
+	seen := make(map[string]struct{})
+	ids := []string{}
+	for _, answer := range msg.Answer {
+		var kvs []dns.SVCBKeyValue
+		switch rec := answer.(type) {
+		case *dns.SVCB:
+			kvs = rec.Value
 		case *dns.HTTPS:
-			for _, kv := range rec.Value {
-				log.V("dnsutil: https(%s): current k(%v)/v(%v)", qname, kv.Key(), kv.String())
-				if kv.Key() != x {
+			kvs = rec.Value
+		default:
+			continue
+		}
+		for _, kv := range kvs {
+			a, ok := kv.(*dns.SVCBAlpn)
+			if !ok {
+				continue
+			}
+			for _, id := range a.Alpn {
+				if _, dup := seen[id]; dup || len(id) <= 0 {
 					continue
 				}
-				// ipcsv may be "<nil>" or a csv of ips
-				ipcsv := kv.String()
-				for _, ipstr := range strings.Split(ipcsv, ",") {
-					if v, err := netip.ParseAddr(ipstr); err == nil {
-						ips = append(ips, &v)
-					} else {
-						log.W("dnsutil: https(%s): could not parse iphint %v", qname, ipstr)
-					}
-				}
+				seen[id] = struct{}{}
+				ids = append(ids, id)
 			}
 		}
 	}
-	log.D("dnsutil: svcb/https(%s): ip hints %v from %d answers", qname, ips, len(msg.Answer))
-	return ips
+	return ids
+}
+
+// DDRName is queried (type SVCB) for resolvers designated by a resolver
+// to be used in its stead; rfc9462 sec 4.
+const DDRName = "_dns.resolver.arpa."
+
+// Designation is an encrypted resolver designated by a svcb answer to a
+// DDRName query; rfc9461.
+type Designation struct {
+	Priority uint16
+	Target   string       // sans the trailing dot
+	ALPN     []string     // ex: h2, h3, dot
+	Port     uint16       // 0 if unset
+	DoHPath  string       // uri template; ex: /dns-query{?dns}
+	Hints    []netip.Addr // ipv4hint and ipv6hint, if any
+}
+
+// Designations returns designations in svcb (service mode) answers in msg,
+// in order of their priorities.
+func Designations(msg *dns.Msg) []Designation {
+	if msg == nil || !HasSVCBQuestion(msg) {
+		return nil
+	}
+	var ds []Designation
+	for _, answer := range msg.Answer {
+		rec, ok := answer.(*dns.SVCB)
+		if !ok || rec.Priority == 0 { // alias mode is not for ddr
+			continue
+		}
+		d := Designation{Priority: rec.Priority, Target: strings.TrimSuffix(rec.Target, ".")}
+		for _, kv := range rec.Value {
+			switch v := kv.(type) {
+			case *dns.SVCBAlpn:
+				d.ALPN = append(d.ALPN, v.Alpn...)
+			case *dns.SVCBPort:
+				d.Port = v.Port
+			case *dns.SVCBDoHPath:
+				d.DoHPath = v.Template
+			case *dns.SVCBIPv4Hint:
+				d.Hints = append(d.Hints, ips2addrs(v.Hint)...)
+			case *dns.SVCBIPv6Hint:
+				d.Hints = append(d.Hints, ips2addrs(v.Hint)...)
+			}
+		}
+		ds = append(ds, d)
+	}
+	slices.SortStableFunc(ds, func(a, b Designation) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+	return ds
+}
+
+func ips2addrs(ips []net.IP) (out []netip.Addr) {
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			out = append(out, addr.Unmap())
+		}
+	}
+	return
+}
+
+// DoH returns the url of d as a DoH (over h2) resolver, sans the query
+// part of its uri template (as queries are POSTed); false if d is not.
+func (d Designation) DoH() (string, bool) {
+	if !slices.Contains(d.ALPN, "h2") || len(d.Target) <= 0 {
+		return "", false
+	}
+	// rfc9461 sec 5: the template must have a "dns" variable
+	i := strings.Index(d.DoHPath, "{")
+	if !strings.HasPrefix(d.DoHPath, "/") || i < 0 || !strings.Contains(d.DoHPath[i:], "dns") {
+		return "", false
+	}
+	port := d.Port
+	if port == 0 {
+		port = 443
+	}
+	return "https://" + net.JoinHostPort(d.Target, strconv.Itoa(int(port))) + d.DoHPath[:i], true
+}
+
+// DoT returns the url of d as a DoT resolver; false if d is not.
+func (d Designation) DoT() (string, bool) {
+	if !slices.Contains(d.ALPN, "dot") || len(d.Target) <= 0 {
+		return "", false
+	}
+	port := d.Port
+	if port == 0 {
+		port = 853
+	}
+	return "tls://" + net.JoinHostPort(d.Target, strconv.Itoa(int(port))), true
 }
 
 func AAnswer(msg *dns.Msg) []*netip.Addr {
@@ -861,7 +1298,8 @@ func AAnswer(msg *dns.Msg) []*netip.Addr {
 	for _, answer := range msg.Answer {
 		if answer.Header().Rrtype == dns.TypeA {
 			if rec, ok := answer.(*dns.A); ok {
-				if ipaddr, ok := netip.AddrFromSlice(rec.A); ok {
+				// miekg/dns unpacks A records as 16 byte (4in6) ips
+				if ipaddr, ok := core.IPFromSlice(rec.A); ok {
 					a4 = append(a4, &ipaddr)
 				}
 			}
@@ -878,7 +1316,7 @@ func AAAAAnswer(msg *dns.Msg) []*netip.Addr {
 	for _, answer := range msg.Answer {
 		if answer.Header().Rrtype == dns.TypeAAAA {
 			if rec, ok := answer.(*dns.AAAA); ok {
-				if ipaddr, ok := netip.AddrFromSlice(rec.AAAA); ok {
+				if ipaddr, ok := core.IPFromSlice(rec.AAAA); ok {
 					a6 = append(a6, &ipaddr)
 				}
 			}
@@ -887,6 +1325,87 @@ func AAAAAnswer(msg *dns.Msg) []*netip.Addr {
 	return a6
 }
 
+// RotateIPs rotates each A and AAAA RRset in the answer section of msg left
+// by n, in place; other records (ex: CNAMEs) keep their positions. Returns
+// true if any RRset was reordered.
+func RotateIPs(msg *dns.Msg, n int) bool {
+	return reorderIPs(msg, func(rrs []dns.RR) {
+		k := n % len(rrs)
+		if k < 0 {
+			k += len(rrs)
+		}
+		slices.Reverse(rrs[:k])
+		slices.Reverse(rrs[k:])
+		slices.Reverse(rrs)
+	})
+}
+
+// SortIPs stable-sorts each A and AAAA RRset in the answer section of msg
+// by cmp, in place; other records keep their positions. Returns true if
+// any RRset was reordered.
+func SortIPs(msg *dns.Msg, cmp func(a, b netip.Addr) int) bool {
+	return reorderIPs(msg, func(rrs []dns.RR) {
+		slices.SortStableFunc(rrs, func(a, b dns.RR) int {
+			return cmp(rrIP(a), rrIP(b))
+		})
+	})
+}
+
+// reorderIPs applies fn to each A and AAAA RRset (records of the same
+// name and type) of msg's answer section that has more than one record,
+// and writes the records back to the positions the RRset occupied.
+func reorderIPs(msg *dns.Msg, fn func(rrs []dns.RR)) (ok bool) {
+	if msg == nil || len(msg.Answer) < 2 {
+		return ok
+	}
+	type rrset struct {
+		name string
+		typ  uint16
+	}
+	pos := make(map[rrset][]int)
+	var sets []rrset // in order of appearance
+	for i, rr := range msg.Answer {
+		h := rr.Header()
+		if h == nil || (h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA) {
+			continue
+		}
+		k := rrset{strings.ToLower(h.Name), h.Rrtype}
+		if _, seen := pos[k]; !seen {
+			sets = append(sets, k)
+		}
+		pos[k] = append(pos[k], i)
+	}
+	for _, k := range sets {
+		idx := pos[k]
+		if len(idx) < 2 {
+			continue
+		}
+		rrs := make([]dns.RR, len(idx))
+		for j, i := range idx {
+			rrs[j] = msg.Answer[i]
+		}
+		fn(rrs)
+		for j, i := range idx {
+			if msg.Answer[i] != rrs[j] {
+				msg.Answer[i] = rrs[j]
+				ok = true
+			}
+		}
+	}
+	return ok
+}
+
+// rrIP returns the ip of an A or AAAA record; zero addr otherwise.
+func rrIP(rr dns.RR) (ip netip.Addr) {
+	switch r := rr.(type) {
+	case *dns.A:
+		ip, _ = netip.AddrFromSlice(r.A)
+	case *dns.AAAA:
+		ip, _ = netip.AddrFromSlice(r.AAAA)
+	}
+	return ip.Unmap()
+}
+
 // whether the qtype code is a aaaa qtype
 func IsAAAAQType(qtype uint16) bool {
 	return qtype == dns.TypeAAAA
@@ -911,6 +1430,17 @@ func HasAnyQuestion(msg *dns.Msg) bool {
 	return msg != nil && len(msg.Question) > 0
 }
 
+// whether the given msg (query) has more than one question
+func HasManyQuestions(msg *dns.Msg) bool {
+	return msg != nil && len(msg.Question) > 1
+}
+
+// whether the given msg (query) is a standard query (OPCODE QUERY);
+// and not, for ex, a NOTIFY or an UPDATE
+func IsStdQuery(msg *dns.Msg) bool {
+	return msg != nil && msg.Opcode == dns.OpcodeQuery
+}
+
 // whether the given msg (ans/query) has a AAAA question section
 func HasAAAAQuestion(msg *dns.Msg) bool {
 	if !HasAnyQuestion(msg) {
@@ -1012,6 +1542,45 @@ func MakeAAAARecord(name string, ip6 string, expiry int) dns.RR {
 	return rec
 }
 
+func MakeCNAMERecord(name string, target string, expiry int) dns.RR {
+	if len(target) <= 0 || len(name) <= 0 {
+		return nil
+	}
+	ttl := uint32(expiry)
+
+	rec := new(dns.CNAME)
+	rec.Hdr = dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeCNAME,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	rec.Target = dns.Fqdn(target)
+	return rec
+}
+
+func MakeTXTRecord(name string, txt string, expiry int) dns.RR {
+	if len(name) <= 0 {
+		return nil
+	}
+	ttl := uint32(expiry)
+
+	rec := new(dns.TXT)
+	rec.Hdr = dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeTXT,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	// character-strings are at most 255 octets; rfc1035 sec 3.3
+	for len(txt) > 255 {
+		rec.Txt = append(rec.Txt, txt[:255])
+		txt = txt[255:]
+	}
+	rec.Txt = append(rec.Txt, txt)
+	return rec
+}
+
 func MaybeToQuadA(answer dns.RR, prefix *net.IPNet, minttl uint32) dns.RR {
 	header := answer.Header()
 	if prefix == nil || header.Rrtype != dns.TypeA {
@@ -1066,18 +1635,14 @@ func ToIp6Hint(answer dns.RR, prefix *net.IPNet) dns.RR {
 	}
 	ttl := uint32(300) // 5 minutes
 
-	hint4 := make([]string, 0)
+	hint4 := make([]net.IP, 0)
 	rest := make([]dns.SVCBKeyValue, 0)
 	for _, x := range kv {
 		if x.Key() == dns.SVCB_IPV6HINT {
 			// ipv6hint found, no need to translate ipv4s
 			return nil
 		} else if x.Key() == dns.SVCB_IPV4HINT {
-			ipstr := x.String()
-			if len(ipstr) <= 0 {
-				continue
-			}
-			hint4 = append(hint4, strings.Split(ipstr, ",")...)
+			hint4 = append(hint4, hintIPs(x, dns.SVCB_IPV4HINT)...)
 		} else {
 			rest = append(rest, x)
 		}
@@ -1085,9 +1650,9 @@ func ToIp6Hint(answer dns.RR, prefix *net.IPNet) dns.RR {
 
 	hint6 := new(dns.SVCBIPv6Hint)
 	for _, x := range hint4 {
-		ip4 := net.ParseIP(x)
+		ip4 := x.To4()
 		if ip4 == nil {
-			log.W("dnsutil: invalid https/svcb ipv4hint %s", x)
+			log.W("dnsutil: invalid https/svcb ipv4hint %v", x)
 			continue
 		}
 		hint6.Hint = append(hint6.Hint, ip4to6(prefix, ip4))
@@ -1120,6 +1685,11 @@ func ToIp6Hint(answer dns.RR, prefix *net.IPNet) dns.RR {
 	}
 }
 
+// IP4to6 synthesizes an ip6 from ip4 and nat64 prefix6; see: rfc6052#section-2.2
+func IP4to6(prefix6 *net.IPNet, ip4 net.IP) net.IP {
+	return ip4to6(prefix6, ip4.To4())
+}
+
 func ip4to6(prefix6 *net.IPNet, ip4 net.IP) net.IP {
 	ip6 := make(net.IP, net.IPv6len)
 	if prefix6 == nil || len(ip4) <= 0 {
@@ -1176,6 +1746,27 @@ func Servfail(q []byte) []byte {
 	return b
 }
 
+// ServfailWithEDE returns a SERVFAIL response to q with an extended dns error
+// (rfc8914) of code (ex: dns.ExtendedErrorCodeNetworkError) and text, or nil.
+func ServfailWithEDE(q []byte, code uint16, text string) []byte {
+	msg := &dns.Msg{}
+	if err := msg.Unpack(q); err != nil {
+		log.W("dnsutil: servfail: error reading q: %v", err)
+		return nil
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Rcode = dns.RcodeServerFailure
+	msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+	opt := msg.SetEdns0(dns.DefaultMsgSize, false).IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+	b, err := msg.Pack()
+	if err != nil {
+		log.W("dnsutil: servfail: ctor error: %v", err)
+	}
+	return b
+}
+
 // GetBlocklistStampHeaderKey returns the http-header key for blocklists stamp
 func GetBlocklistStampHeaderKey() string {
 	return http.CanonicalHeaderKey(blocklistHeaderKey)
@@ -1225,10 +1816,3 @@ func netips2str(addrs []*netip.Addr) []string {
 	}
 	return str
 }
-
-func ip2str(ip net.IP) string {
-	if ip == nil {
-		return ""
-	}
-	return ip.String()
-}
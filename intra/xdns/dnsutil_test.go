@@ -0,0 +1,730 @@
+// Copyright (c) 2024 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package xdns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func httpsAns(qname string, recs ...dns.RR) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(qname), dns.TypeHTTPS)
+	ans := new(dns.Msg)
+	ans.SetReply(q)
+	ans.Answer = recs
+	ans.Extra = []dns.RR{MakeARecord(dns.Fqdn(qname), "9.9.9.9", 60)}
+	return ans
+}
+
+func httpsRec(qname string, kv ...dns.SVCBKeyValue) *dns.HTTPS {
+	r := new(dns.HTTPS)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300}
+	r.Priority = 1
+	r.Target = "."
+	r.Value = kv
+	return r
+}
+
+func v4hint(ips ...string) *dns.SVCBIPv4Hint {
+	h := new(dns.SVCBIPv4Hint)
+	for _, ip := range ips {
+		h.Hint = append(h.Hint, net.ParseIP(ip).To4())
+	}
+	return h
+}
+
+func v6hint(ips ...string) *dns.SVCBIPv6Hint {
+	h := new(dns.SVCBIPv6Hint)
+	for _, ip := range ips {
+		h.Hint = append(h.Hint, net.ParseIP(ip))
+	}
+	return h
+}
+
+func addrs(ips ...string) (out []*netip.Addr) {
+	for _, ip := range ips {
+		a := netip.MustParseAddr(ip)
+		out = append(out, &a)
+	}
+	return
+}
+
+func hintsIn(t *testing.T, msg *dns.Msg, x dns.SVCBKey) []string {
+	t.Helper()
+	// round-trip to ensure the substituted records are well-formed
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	re := new(dns.Msg)
+	if err := re.Unpack(b); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	return netips2str(IPHints(re, x))
+}
+
+func TestSubstSVCBMultiHint(t *testing.T) {
+	// two records, each with an ipv4hint; more hints than substitutes
+	ans := httpsAns("example.com",
+		httpsRec("example.com", &dns.SVCBAlpn{Alpn: []string{"h2"}}, v4hint("1.1.1.1", "1.0.0.1")),
+		httpsRec("example.com", v4hint("8.8.8.8"), v6hint("2606:4700::1111")),
+	)
+	if ok := SubstSVCBRecordIPs(ans, dns.SVCB_IPV4HINT, addrs("100.64.0.1"), 15); !ok {
+		t.Fatal("multi: expected substitution")
+	}
+	got := hintsIn(t, ans, dns.SVCB_IPV4HINT)
+	if len(got) != 2 || got[0] != "100.64.0.1" || got[1] != "100.64.0.1" {
+		t.Fatalf("multi: want [100.64.0.1 100.64.0.1], got %v", got)
+	}
+	if v6 := hintsIn(t, ans, dns.SVCB_IPV6HINT); len(v6) != 1 || v6[0] != "2606:4700::1111" {
+		t.Fatalf("multi: ipv6hint must be untouched, got %v", v6)
+	}
+	if ans.Extra != nil {
+		t.Fatal("multi: extra must be removed on substitution")
+	}
+	for _, rr := range ans.Answer {
+		if rr.Header().Ttl != 15 {
+			t.Fatalf("multi: ttl not set: %v", rr)
+		}
+	}
+}
+
+func TestSubstSVCBCycle(t *testing.T) {
+	// as many hints as substitutes; the counter wraps to zero
+	ans := httpsAns("example.com",
+		httpsRec("example.com", v6hint("2001:db8::1")),
+		httpsRec("example.com", v6hint("2001:db8::2")),
+		httpsRec("example.com", v6hint("2001:db8::3")),
+	)
+	subs := addrs("64:ff9b:1:da19:100::1", "64:ff9b:1:da19:100::2")
+	if ok := SubstSVCBRecordIPs(ans, dns.SVCB_IPV6HINT, subs, 15); !ok {
+		t.Fatal("cycle: expected substitution")
+	}
+	got := hintsIn(t, ans, dns.SVCB_IPV6HINT)
+	want := []string{"64:ff9b:1:da19:100::1", "64:ff9b:1:da19:100::2", "64:ff9b:1:da19:100::1"}
+	if len(got) != len(want) {
+		t.Fatalf("cycle: want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("cycle: want %v, got %v", want, got)
+		}
+	}
+
+	exact := httpsAns("example.com", httpsRec("example.com", v4hint("1.1.1.1")))
+	if ok := SubstSVCBRecordIPs(exact, dns.SVCB_IPV4HINT, addrs("100.64.0.9"), 15); !ok {
+		t.Fatal("cycle: substituting exactly len(subs) hints must report ok")
+	}
+}
+
+func TestSubstSVCBZeroHint(t *testing.T) {
+	noHints := func() *dns.Msg {
+		return httpsAns("example.com", httpsRec("example.com", &dns.SVCBAlpn{Alpn: []string{"h3"}}))
+	}
+	if SubstSVCBRecordIPs(noHints(), dns.SVCB_IPV4HINT, addrs("100.64.0.1"), 15) {
+		t.Fatal("zero: no hints in answer; nothing to substitute")
+	}
+	withHint := httpsAns("example.com", httpsRec("example.com", v4hint("1.1.1.1")))
+	if SubstSVCBRecordIPs(withHint, dns.SVCB_IPV4HINT, nil, 15) {
+		t.Fatal("zero: nil substitutes")
+	}
+	if SubstSVCBRecordIPs(withHint, dns.SVCB_IPV4HINT, []*netip.Addr{nil, {}}, 15) {
+		t.Fatal("zero: nil / invalid substitutes")
+	}
+	if SubstSVCBRecordIPs(withHint, dns.SVCB_IPV4HINT, addrs("2001:db8::1"), 15) {
+		t.Fatal("zero: substitutes of the wrong family")
+	}
+	if got := hintsIn(t, withHint, dns.SVCB_IPV4HINT); len(got) != 1 || got[0] != "1.1.1.1" {
+		t.Fatalf("zero: answer must be untouched, got %v", got)
+	}
+	if SubstSVCBRecordIPs(nil, dns.SVCB_IPV4HINT, addrs("100.64.0.1"), 15) {
+		t.Fatal("zero: nil msg")
+	}
+}
+
+func TestSubstSVCBMalformed(t *testing.T) {
+	// alias mode (priority 0) records carry no params to substitute
+	alias := httpsRec("example.com", v4hint("1.1.1.1"))
+	alias.Priority = 0
+	ans := httpsAns("example.com", alias)
+	if SubstSVCBRecordIPs(ans, dns.SVCB_IPV4HINT, addrs("100.64.0.1"), 15) {
+		t.Fatal("malformed: alias mode must be skipped")
+	}
+
+	// nil key-values and non-svcb answers must not panic
+	rec := httpsRec("example.com", nil, v4hint("1.1.1.1"))
+	mixed := httpsAns("example.com", MakeARecord("example.com.", "1.2.3.4", 60), rec)
+	if !SubstSVCBRecordIPs(mixed, dns.SVCB_IPV4HINT, addrs("100.64.0.1"), 15) {
+		t.Fatal("malformed: expected substitution past nil kv")
+	}
+}
+
+func TestIPHints(t *testing.T) {
+	ans := httpsAns("example.com",
+		httpsRec("example.com", v4hint("1.1.1.1", "1.0.0.1"), v6hint("2606:4700::1111")),
+		httpsRec("example.com", v4hint("8.8.8.8")),
+	)
+	if got := IPHints(ans, dns.SVCB_IPV4HINT); len(got) != 3 {
+		t.Fatalf("iphints: want 3 ipv4hints, got %v", got)
+	} else {
+		for _, ip := range got {
+			if !ip.Is4() {
+				t.Fatalf("iphints: ipv4hint %v not unmapped", ip)
+			}
+		}
+	}
+	if got := IPHints(ans, dns.SVCB_IPV6HINT); len(got) != 1 {
+		t.Fatalf("iphints: want 1 ipv6hint, got %v", got)
+	}
+
+	none := httpsAns("example.com", httpsRec("example.com", &dns.SVCBAlpn{Alpn: []string{"h2"}}))
+	if got := IPHints(none, dns.SVCB_IPV4HINT); len(got) != 0 {
+		t.Fatalf("iphints: want none, got %v", got)
+	}
+
+	// a hint that stringifies as "<nil>" must be skipped, not parsed
+	bad := httpsAns("example.com", httpsRec("example.com", &dns.SVCBIPv4Hint{Hint: []net.IP{{1, 2}}}))
+	if got := IPHints(bad, dns.SVCB_IPV4HINT); len(got) != 0 {
+		t.Fatalf("iphints: want none for malformed hint, got %v", got)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if got := IPHints(q, dns.SVCB_IPV4HINT); got != nil {
+		t.Fatalf("iphints: want nil for non-svcb question, got %v", got)
+	}
+	if got := IPHints(nil, dns.SVCB_IPV4HINT); got != nil {
+		t.Fatalf("iphints: want nil for nil msg, got %v", got)
+	}
+}
+
+func alpn(ids ...string) *dns.SVCBAlpn {
+	return &dns.SVCBAlpn{Alpn: ids}
+}
+
+func TestALPNs(t *testing.T) {
+	cases := []struct {
+		name string
+		ans  *dns.Msg
+		want []string
+	}{
+		{"h3", httpsAns("example.com", httpsRec("example.com", alpn("h3"))), []string{"h3"}},
+		{"h3-h2", httpsAns("example.com", httpsRec("example.com", alpn("h3", "h2"), v4hint("1.1.1.1"))), []string{"h3", "h2"}},
+		{"dedup", httpsAns("example.com",
+			httpsRec("example.com", alpn("h2", "http/1.1")),
+			httpsRec("example.com", alpn("h3", "h2")),
+		), []string{"h2", "http/1.1", "h3"}},
+		{"none", httpsAns("example.com", httpsRec("example.com", v4hint("1.1.1.1"))), []string{}},
+	}
+	for _, c := range cases {
+		got := ALPNs(c.ans)
+		if len(got) != len(c.want) {
+			t.Fatalf("alpns: %s: want %v, got %v", c.name, c.want, got)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("alpns: %s: want %v, got %v", c.name, c.want, got)
+			}
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if got := ALPNs(q); got != nil {
+		t.Fatalf("alpns: want nil for non-svcb question, got %v", got)
+	}
+}
+
+func TestClampTTL(t *testing.T) {
+	mk := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Answer = []dns.RR{
+			MakeARecord("example.com.", "1.2.3.4", 5),
+			MakeARecord("example.com.", "1.2.3.5", 604800),
+		}
+		m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900}}}
+		return m
+	}
+	ttls := func(m *dns.Msg) (out []uint32) {
+		for _, rr := range append(m.Answer, m.Ns...) {
+			out = append(out, rr.Header().Ttl)
+		}
+		return
+	}
+	cases := []struct {
+		lo, hi uint32
+		ok     bool
+		want   []uint32
+	}{
+		{0, 0, false, []uint32{5, 604800, 900}},
+		{60, 0, true, []uint32{60, 604800, 900}},
+		{0, 3600, true, []uint32{5, 3600, 900}},
+		{60, 600, true, []uint32{60, 600, 600}},
+		{1000, 600, true, []uint32{600, 600, 600}}, // lo lowered to hi
+	}
+	for _, c := range cases {
+		m := mk()
+		if ok := ClampTTL(m, c.lo, c.hi); ok != c.ok {
+			t.Errorf("ClampTTL(%d, %d) = %t; want %t", c.lo, c.hi, ok, c.ok)
+		}
+		if got := ttls(m); !slices.Equal(got, c.want) {
+			t.Errorf("ClampTTL(%d, %d) ttls = %v; want %v", c.lo, c.hi, got, c.want)
+		}
+	}
+}
+
+func TestIP4to6(t *testing.T) {
+	cases := []struct {
+		prefix string
+		want   string
+	}{
+		{"64:ff9b::/96", "64:ff9b::c000:201"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:1::"}, // rfc6052 2.4
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:100:0"},
+	}
+	ip4 := net.ParseIP("192.0.2.1")
+	for _, c := range cases {
+		_, pfx, _ := net.ParseCIDR(c.prefix)
+		ip6 := IP4to6(pfx, ip4)
+		if got, _ := netip.AddrFromSlice(ip6); got != netip.MustParseAddr(c.want) {
+			t.Errorf("IP4to6(%s, %s) = %s; want %s", c.prefix, ip4, got, c.want)
+		}
+	}
+}
+
+func ipsOf(msg *dns.Msg) (out []string) {
+	for _, rr := range msg.Answer {
+		switch r := rr.(type) {
+		case *dns.A:
+			out = append(out, r.A.String())
+		case *dns.AAAA:
+			out = append(out, r.AAAA.String())
+		case *dns.CNAME:
+			out = append(out, r.Target)
+		}
+	}
+	return
+}
+
+func TestRotateIPs(t *testing.T) {
+	ans := new(dns.Msg)
+	ans.Answer = []dns.RR{
+		MakeCNAMERecord("a.example.", "b.example.", 60),
+		MakeARecord("b.example.", "10.0.0.1", 60),
+		MakeARecord("b.example.", "10.0.0.2", 60),
+		MakeAAAARecord("b.example.", "2001:db8::1", 60),
+		MakeARecord("b.example.", "10.0.0.3", 60),
+		MakeAAAARecord("b.example.", "2001:db8::2", 60),
+	}
+	if !RotateIPs(ans, 1) {
+		t.Fatal("rotate: no change")
+	}
+	want := []string{"b.example.", "10.0.0.2", "10.0.0.3", "2001:db8::2", "10.0.0.1", "2001:db8::1"}
+	if got := ipsOf(ans); !slices.Equal(got, want) {
+		t.Errorf("rotate: want %v, got %v", want, got)
+	}
+	// a full turn leaves the order as-is
+	if RotateIPs(ans, 6) {
+		t.Errorf("rotate: full turn reordered: %v", ipsOf(ans))
+	}
+	single := new(dns.Msg)
+	single.Answer = []dns.RR{MakeARecord("c.example.", "10.0.0.9", 60)}
+	if RotateIPs(single, 1) {
+		t.Error("rotate: single record reordered")
+	}
+}
+
+func TestSortIPs(t *testing.T) {
+	ans := new(dns.Msg)
+	ans.Answer = []dns.RR{
+		MakeARecord("b.example.", "10.0.0.1", 60),
+		MakeARecord("b.example.", "10.0.0.2", 60),
+		MakeARecord("b.example.", "10.0.0.3", 60),
+	}
+	rank := map[string]int{"10.0.0.3": 1, "10.0.0.1": 2} // 10.0.0.2 unranked
+	byrank := func(a, b netip.Addr) int {
+		ra, oka := rank[a.String()]
+		rb, okb := rank[b.String()]
+		if !oka || !okb {
+			return boolcmp(okb, oka)
+		}
+		return ra - rb
+	}
+	if !SortIPs(ans, byrank) {
+		t.Fatal("sort: no change")
+	}
+	want := []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}
+	if got := ipsOf(ans); !slices.Equal(got, want) {
+		t.Errorf("sort: want %v, got %v", want, got)
+	}
+}
+
+func boolcmp(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+func TestAddEDNS0PaddingToBlock(t *testing.T) {
+	query := func(qname string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(dns.Fqdn(qname), dns.TypeA)
+		return q
+	}
+	for _, block := range []int{16, 128, 468} {
+		for _, qname := range []string{"a.b", "www.example.com", "a-rather-long-label.of.some.subdomain.example.org"} {
+			b, err := AddEDNS0PaddingToBlock(query(qname), block, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b)%block != 0 {
+				t.Errorf("%s/%d: len %d not a multiple of block", qname, block, len(b))
+			}
+			// already padded; as-is
+			m := new(dns.Msg)
+			if err := m.Unpack(b); err != nil {
+				t.Fatal(err)
+			}
+			if b2, _ := AddEDNS0PaddingToBlock(m, 64, 0); len(b2) != len(b) {
+				t.Errorf("%s/%d: repadded %d to %d", qname, block, len(b), len(b2))
+			}
+			if !RemoveEDNS0Padding(m) || m.IsEdns0() == nil {
+				t.Errorf("%s/%d: padding not removed, or opt removed", qname, block)
+			}
+		}
+	}
+
+	// the next multiple overflows the limit; padded up to it
+	q := query("www.example.com")
+	unpadded, _ := q.Copy().Pack()
+	limit := len(unpadded) + 11 + 4 + 10 // + opt rr + padding header + some
+	b, _ := AddEDNS0PaddingToBlock(q, 128, limit)
+	if len(b) != limit {
+		t.Errorf("len %d; want limit %d", len(b), limit)
+	}
+	// not even the padding header fits; as-is, sans the opt rr
+	q = query("www.example.com")
+	b, _ = AddEDNS0PaddingToBlock(q, 128, len(unpadded)+1)
+	if len(b) != len(unpadded) || q.IsEdns0() != nil {
+		t.Errorf("len %d; want %d unpadded, sans opt", len(b), len(unpadded))
+	}
+	// truncated; as-is
+	q = query("www.example.com")
+	q.Truncated = true
+	b, _ = AddEDNS0PaddingToBlock(q, 128, 0)
+	if len(b) != len(unpadded) {
+		t.Errorf("truncated: len %d; want %d", len(b), len(unpadded))
+	}
+	if _, err := AddEDNS0PaddingToBlock(nil, 128, 0); err == nil {
+		t.Error("nil msg: want err")
+	}
+}
+
+// blockedSVCB packs and unpacks the blocked answer to a qtype query for qname,
+// as per mode.
+func blockedSVCB(t *testing.T, qname string, qtype uint16, mode int) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(qname), qtype)
+	ans, err := RefusedResponseWithMode(q, mode)
+	if err != nil {
+		t.Fatalf("%d/%d: %v", qtype, mode, err)
+	}
+	b, err := ans.Pack()
+	if err != nil {
+		t.Fatalf("%d/%d: pack: %v", qtype, mode, err)
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(b); err != nil {
+		t.Fatalf("%d/%d: unpack: %v", qtype, mode, err)
+	}
+	if out.Rcode != dns.RcodeSuccess || !out.Response || out.Id != q.Id {
+		t.Errorf("%d/%d: bad header %v", qtype, mode, out.MsgHdr)
+	}
+	return out
+}
+
+func TestRefusedResponseSVCB(t *testing.T) {
+	fake := dns.Fqdn(fakedomain)
+	for _, qtype := range []uint16{dns.TypeHTTPS, dns.TypeSVCB} {
+		// default: nodata, and never the fake domain
+		for _, mode := range []int{SVCBBlockNoData, -1, 42} {
+			ans := blockedSVCB(t, "blocked.example", qtype, mode)
+			if len(ans.Answer) != 0 || len(ans.Extra) != 0 {
+				t.Errorf("%d/%d: want nodata, got %v", qtype, mode, ans)
+			}
+			if strings.Contains(ans.String(), fakedomain) {
+				t.Errorf("%d/%d: refers to fakedomain", qtype, mode)
+			}
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("blocked.example.", qtype)
+		if ans, _ := RefusedResponseFromMessage(q); len(ans.Answer) != 0 || len(ans.Extra) != 0 {
+			t.Errorf("%d: default: want nodata, got %v", qtype, ans)
+		}
+
+		ans := blockedSVCB(t, "blocked.example", qtype, SVCBBlockFakeTarget)
+		if len(ans.Answer) != 1 || len(ans.Extra) != 1 {
+			t.Fatalf("%d: fake: want 1 answer, 1 extra; got %v", qtype, ans)
+		}
+		if rr := ans.Answer[0]; rr.Header().Rrtype != qtype || rr.Header().Name != "blocked.example." {
+			t.Errorf("%d: fake: answer %s", qtype, rr)
+		}
+		if target, _ := svcbTarget(ans.Answer[0]); target != fake {
+			t.Errorf("%d: fake: target %s; want %s", qtype, target, fake)
+		}
+		if a, ok := ans.Extra[0].(*dns.A); !ok || a.Hdr.Name != fake || !a.A.IsUnspecified() {
+			t.Errorf("%d: fake: extra %s", qtype, ans.Extra[0])
+		}
+
+		ans = blockedSVCB(t, "blocked.example", qtype, SVCBBlockDotTarget)
+		if len(ans.Answer) != 1 || len(ans.Extra) != 0 {
+			t.Fatalf("%d: dot: want 1 answer, no extra; got %v", qtype, ans)
+		}
+		target, kv := svcbTarget(ans.Answer[0])
+		if target != "." || len(kv) != 0 {
+			t.Errorf("%d: dot: target %s, params %v", qtype, target, kv)
+		}
+		if strings.Contains(ans.String(), fakedomain) {
+			t.Errorf("%d: dot: refers to fakedomain", qtype)
+		}
+	}
+
+	// other qtypes are blocked the same regardless of mode
+	for _, mode := range []int{SVCBBlockFakeTarget, SVCBBlockDotTarget} {
+		ans := blockedSVCB(t, "blocked.example", dns.TypeA, mode)
+		if a, ok := ans.Answer[0].(*dns.A); len(ans.Answer) != 1 || !ok || !a.A.IsUnspecified() || len(ans.Extra) != 0 {
+			t.Errorf("a/%d: got %v", mode, ans)
+		}
+	}
+}
+
+func svcbTarget(rr dns.RR) (string, []dns.SVCBKeyValue) {
+	switch r := rr.(type) {
+	case *dns.HTTPS:
+		return r.Target, r.Value
+	case *dns.SVCB:
+		return r.Target, r.Value
+	}
+	return "", nil
+}
+
+func rrA(name, ip string) dns.RR {
+	return MakeARecord(dns.Fqdn(name), ip, 300)
+}
+
+func rrAAAA(name, ip string) dns.RR {
+	r := new(dns.AAAA)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300}
+	r.AAAA = net.ParseIP(ip)
+	return r
+}
+
+func rrNS(name, ns string) dns.RR {
+	r := new(dns.NS)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}
+	r.Ns = dns.Fqdn(ns)
+	return r
+}
+
+func rrMX(name, mx string) dns.RR {
+	r := new(dns.MX)
+	r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 300}
+	r.Mx = dns.Fqdn(mx)
+	return r
+}
+
+func answer(qtype uint16, rrs ...dns.RR) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", qtype)
+	ans := new(dns.Msg)
+	ans.SetReply(q)
+	ans.Answer = rrs
+	return ans
+}
+
+func TestInterestingRData(t *testing.T) {
+	hinted := httpsRec("example.com", v4hint("1.1.1.1", "1.0.0.1"), v6hint("2606:4700::1111"))
+	alpn := httpsRec("example.com", &dns.SVCBAlpn{Alpn: []string{"h3", "h2"}})
+
+	tests := []struct {
+		name  string
+		msg   *dns.Msg
+		want  string
+		rtype uint16
+	}{
+		{"nil", nil, "--", 0},
+		{"empty", answer(dns.TypeA), "--", 0},
+		{"a", answer(dns.TypeA, rrA("example.com", "9.9.9.9")), "9.9.9.9", dns.TypeA},
+		{"a+aaaa", answer(dns.TypeA, rrAAAA("example.com", "2620:fe::fe"), rrA("example.com", "9.9.9.9")), "2620:fe::fe,9.9.9.9", dns.TypeAAAA},
+		// address records win over other types, wherever they are
+		{"ns before a", answer(dns.TypeA, rrNS("example.com", "ns1.example.com"), rrA("example.com", "9.9.9.9")), "9.9.9.9", dns.TypeA},
+		{"mx before aaaa", answer(dns.TypeA, rrMX("example.com", "mx.example.com"), rrAAAA("example.com", "::1")), "::1", dns.TypeAAAA},
+		// sans address records, the first answer with a primary field
+		{"ns", answer(dns.TypeNS, rrNS("example.com", "ns1.example.com"), rrMX("example.com", "mx.example.com")), "ns1.example.com.", dns.TypeNS},
+		{"mx", answer(dns.TypeMX, rrMX("example.com", "mx.example.com"), rrNS("example.com", "ns1.example.com")), "mx.example.com.", dns.TypeMX},
+		// hints are ips, after those of address records
+		{"https hints", answer(dns.TypeHTTPS, hinted), "1.1.1.1,1.0.0.1,2606:4700::1111", dns.TypeHTTPS},
+		{"a+https hints", answer(dns.TypeHTTPS, hinted, rrA("example.com", "9.9.9.9")), "9.9.9.9,1.1.1.1,1.0.0.1,2606:4700::1111", dns.TypeA},
+		{"https sans hints", answer(dns.TypeHTTPS, alpn), `alpn=h3,h2`, dns.TypeHTTPS},
+	}
+	for _, tc := range tests {
+		d := InterestingRData(tc.msg)
+		if got := d.String(); got != tc.want || d.Rtype != tc.rtype {
+			t.Errorf("%s: want %s (%d), got %s (%d)", tc.name, tc.want, tc.rtype, got, d.Rtype)
+		}
+		if len(d.IPs) > 0 && len(d.Primary) > 0 {
+			t.Errorf("%s: both ips %v and primary %s", tc.name, d.IPs, d.Primary)
+		}
+		if got := GetInterestingRData(tc.msg); got != tc.want {
+			t.Errorf("%s: GetInterestingRData: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestInterestingRDataCapped(t *testing.T) {
+	rrs := make([]dns.RR, 0, 500)
+	for i := range 500 {
+		rrs = append(rrs, rrA("example.com", fmt.Sprintf("10.0.%d.%d", i/256, i%256)))
+	}
+	msg := answer(dns.TypeA, rrs...)
+	if d := InterestingRData(msg); len(d.IPs) != 500 {
+		t.Errorf("capped: want all 500 ips, got %d", len(d.IPs))
+	}
+
+	got := GetInterestingRData(msg)
+	ips, suffix, _ := strings.Cut(got, ",+")
+	if n := strings.Count(ips, ",") + 1; n != DefaultMaxRDataIPs || suffix != "484 more" {
+		t.Errorf("capped: want %d ips, +484 more; got %d, %q", DefaultMaxRDataIPs, n, suffix)
+	}
+	if !strings.HasPrefix(got, "10.0.0.0,10.0.0.1,") || !strings.Contains(got, ",10.0.0.15,+") {
+		t.Errorf("capped: want the first ips in order, got %s", got)
+	}
+
+	SetSummaryCaps(2, 0)
+	defer SetSummaryCaps(0, 0)
+	if got := GetInterestingRData(msg); got != "10.0.0.0,10.0.0.1,+498 more" {
+		t.Errorf("capped: 2: got %s", got)
+	}
+	if got := GetInterestingRData(answer(dns.TypeA, rrs[:2]...)); got != "10.0.0.0,10.0.0.1" {
+		t.Errorf("capped: 2 of 2: got %s", got)
+	}
+}
+
+func TestCapCsv(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		n    int
+		want string
+	}{
+		{"empty", "", 8, ""},
+		{"fits", "a,b,c", 5, "a,b,c"},
+		{"trunc", "aa,bb,cc,dd", 10, "aa,+3 more"},
+		{"trunc more", "aa,bb,cc,dd,ee", 13, "aa,bb,+3 more"},
+		{"none fit", "aaaaaaaa,bb", 8, "+2 more"},
+		{"tiny", "aaaaaaaa,bb", 3, "+2 "},
+	}
+	for _, tc := range tests {
+		if got := capcsv(tc.csv, tc.n); got != tc.want || len(got) > max(tc.n, len(tc.csv)) {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+
+	names := make([]string, 500)
+	for i := range names {
+		names[i] = fmt.Sprintf("tracker%d.ads.example.com", i)
+	}
+	csv := strings.Join(names, ",")
+	got := CapCsv(csv)
+	if len(got) > DefaultMaxCsvLen {
+		t.Errorf("capcsv: want at most %d bytes, got %d", DefaultMaxCsvLen, len(got))
+	}
+	vals := strings.Split(got, ",")
+	last := vals[len(vals)-1]
+	kept := vals[:len(vals)-1]
+	if want := fmt.Sprintf("+%d more", 500-len(kept)); last != want || !slices.Equal(kept, names[:len(kept)]) {
+		t.Errorf("capcsv: want leading names and %q, got %d names and %q", want, len(kept), last)
+	}
+	if again := CapCsv(csv); again != got {
+		t.Errorf("capcsv: not deterministic: %q != %q", again, got)
+	}
+}
+
+func BenchmarkInterestingRData(b *testing.B) {
+	msgs := []*dns.Msg{
+		answer(dns.TypeA, rrA("example.com", "93.184.215.14"), rrA("example.com", "93.184.215.15")),
+		answer(dns.TypeAAAA, rrAAAA("example.com", "2606:2800:21f:cb07:6820:80da:af6b:8b2c")),
+		answer(dns.TypeHTTPS, httpsRec("example.com", &dns.SVCBAlpn{Alpn: []string{"h3", "h2"}},
+			v4hint("104.16.132.229", "104.16.133.229"), v6hint("2606:4700::6810:84e5", "2606:4700::6810:85e5"))),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, m := range msgs {
+			_ = GetInterestingRData(m)
+		}
+	}
+}
+
+func TestDesignations(t *testing.T) {
+	ans := new(dns.Msg)
+	ans.SetQuestion(DDRName, dns.TypeSVCB)
+	for _, rr := range []string{
+		`_dns.resolver.arpa. 300 IN SVCB 2 dot.example.net. alpn=dot ipv6hint=2001:db8::1`,
+		`_dns.resolver.arpa. 300 IN SVCB 1 doh.example.net. alpn=h2,h3 port=8443 dohpath=/q{?dns} ipv4hint=192.0.2.1,192.0.2.2`,
+		`_dns.resolver.arpa. 300 IN SVCB 0 alias.example.net.`,
+		`_dns.resolver.arpa. 300 IN SVCB 3 h3.example.net. alpn=h3 dohpath=/dns-query{?dns}`,
+		`_dns.resolver.arpa. 300 IN SVCB 4 nopath.example.net. alpn=h2`,
+	} {
+		r, err := dns.NewRR(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans.Answer = append(ans.Answer, r)
+	}
+
+	ds := Designations(ans)
+	if len(ds) != 4 {
+		t.Fatalf("ddr: want 4 designations, got %d: %v", len(ds), ds)
+	}
+	if ds[0].Target != "doh.example.net" || len(ds[0].Hints) != 2 || ds[0].Hints[1] != netip.MustParseAddr("192.0.2.2") {
+		t.Errorf("ddr: first: %+v", ds[0])
+	}
+	if u, ok := ds[0].DoH(); !ok || u != "https://doh.example.net:8443/q" {
+		t.Errorf("ddr: doh: %s %t", u, ok)
+	}
+	if _, ok := ds[0].DoT(); ok {
+		t.Errorf("ddr: doh as dot")
+	}
+	if u, ok := ds[1].DoT(); !ok || u != "tls://dot.example.net:853" || ds[1].Hints[0] != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("ddr: dot: %s %t %v", u, ok, ds[1].Hints)
+	}
+	if _, ok := ds[2].DoH(); ok { // h3 only
+		t.Errorf("ddr: h3 as doh")
+	}
+	if _, ok := ds[3].DoH(); ok { // sans dohpath
+		t.Errorf("ddr: no dohpath as doh")
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if got := Designations(q); got != nil {
+		t.Errorf("ddr: want nil for non-svcb question, got %v", got)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/celzero/firestack/intra/core"
 	"github.com/celzero/firestack/intra/log"
 	"github.com/celzero/firestack/intra/netstack"
 	"github.com/celzero/firestack/intra/settings"
@@ -50,7 +51,8 @@ type Tunnel interface {
 	Write(data []byte) (int, error)
 	// Close connections
 	CloseConns(activecsv string) (closedcsv string)
-	// Creates a new link using fd (tun device) and mtu.
+	// Creates a new link using fd (tun device) and mtu; if it replaces
+	// an existing link, core.LinkObserver(s) are notified of it.
 	SetLink(fd, mtu int) error
 	// internal method that creates the link and updates the routes
 	SetLinkAndRoutes(fd, mtu, engine int) error
@@ -60,6 +62,18 @@ type Tunnel interface {
 	SetPcap(fpcap string) error
 	// Set or unset the pcap sink
 	SetPcapFd(fpcap int32) error
+	// Tunes tcp (buffer sizes, sack, congestion control, rcvwnd) of conns
+	// made after; nil resets to defaults (settings.DefaultTCPOptions).
+	SetTCPOptions(o *settings.TCPOptions) error
+	// Batches packets written to the tun device, if it is a socket (on by
+	// default); off writes each as it is sent, to debug latency.
+	SetWriteCoalescing(on bool)
+	// Json of batch-size stats of writes to the tun device (see:
+	// netstack.WriteStats); resets them if reset is set.
+	WriteStats(reset bool) string
+	// Json of counts, by category, of endpoints netstack failed to create
+	// for new flows (see: netstack.EndpointErrs); resets them if reset is set.
+	EndpointErrors(reset bool) string
 }
 
 type gtunnel struct {
@@ -69,6 +83,8 @@ type gtunnel struct {
 	pcapio *pcapsink             // pcap output, if any
 	closed atomic.Bool           // open/close?
 	once   *sync.Once
+	linked atomic.Bool  // true once the first link is up
+	l3     atomic.Value // string; families the link routes, per the last engine set
 }
 
 type pcapsink struct {
@@ -161,7 +177,9 @@ func NewGTunnel(fd, mtu int, tcph netstack.GTCPConnHandler, udph netstack.GUDPCo
 	stack := netstack.NewNetstack() // always dual-stack
 	sink := new(pcapsink)
 	once := new(sync.Once)
-	t = &gtunnel{stack, hdl, mtu, sink, atomic.Bool{}, once}
+	g := &gtunnel{stack: stack, hdl: hdl, mtu: mtu, pcapio: sink, once: once}
+	g.l3.Store(settings.IP46)
+	t = g
 
 	err = t.SetLinkAndRoutes(fd, mtu, settings.Ns46) // creates endpoint / brings up nic
 	if err != nil {
@@ -230,7 +248,29 @@ func (t *gtunnel) SetPcapFd(fpcap int32) error {
 	}
 }
 
-func (t *gtunnel) setLinkAndRoutes(fd, mtu, engine int) (err error) {
+func (t *gtunnel) SetTCPOptions(o *settings.TCPOptions) error {
+	s := t.stack
+
+	if s == nil {
+		return errStackMissing
+	}
+	return netstack.SetTCPOptions(s, o)
+}
+
+func (t *gtunnel) SetWriteCoalescing(on bool) {
+	netstack.CoalesceWrites(on)
+}
+
+func (t *gtunnel) WriteStats(reset bool) string {
+	return netstack.GetWriteStats(reset)
+}
+
+func (t *gtunnel) EndpointErrors(reset bool) string {
+	return netstack.GetEndpointErrors(reset)
+}
+
+func (t *gtunnel) SetLinkAndRoutes(fd, mtu, engine int) (err error) {
+	t.l3.Store(settings.L3(engine)) // observers of the new link see engine
 	if err = t.SetLink(fd, mtu); err == nil {
 		err = t.SetRoute(engine)
 	}
@@ -262,8 +302,14 @@ func (t *gtunnel) SetLink(fd, mtu int) error {
 		return err
 	}
 
-	log.I("tun: new link; fd(%d), mtu(%d)", dupfd, mtu)
 	t.mtu = mtu
+	replaced := t.linked.Swap(true)
+	l3, _ := t.l3.Load().(string)
+	n := 0
+	if replaced { // conclusions drawn on the previous link may not hold
+		n = core.LinkChanged(core.Link{L3: l3, MTU: mtu})
+	}
+	log.I("tun: new link; fd(%d), mtu(%d), l3(%s); replaced? %t, observers: %d", dupfd, mtu, l3, replaced, n)
 	return nil
 }
 
@@ -274,6 +320,7 @@ func (t *gtunnel) SetRoute(engine int) error {
 		return errStackMissing
 	}
 	l3 := settings.L3(engine)
+	t.l3.Store(l3)
 	// netstack route is never changed; always dual-stack
 	netstack.Route(s, settings.IP46)
 	log.I("tun: new route; (no-op) got %s but set %s", l3, settings.IP46)